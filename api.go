@@ -1,12 +1,25 @@
 package guerrilla
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/dashboard"
 	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/reputation"
+	"github.com/flashmob/go-guerrilla/stats"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
 	"time"
 )
 
@@ -22,8 +35,37 @@ type Daemon struct {
 
 	configLoadTime time.Time
 	subs           []deferredSub
+
+	allowsHost AllowsHostFunc
+	allowsIP   AllowsIPFunc
+	// clock is set by SetClock, nil for the real clock
+	clock clock.Clock
+	// reputationProviders are consulted with those of the reputation config
+	reputationProviders []reputation.Provider
+	// policy decides what to do with the connections before the greeting, see SetConnectionPolicy
+	policy ConnectionPolicy
+
+	// configPath is the file last read by LoadConfig, configReader reads the config when reloading through the admin API
+	configPath   string
+	configReader func() (AppConfig, error)
+	admin        *adminServer
+	// pprof serves net/http/pprof on localhost when pprof_port is set
+	pprof     *http.Server
+	dashboard *dashboard.Dashboard
+	// dashboardState is kept for the dashboard while it's running
+	dashboardState dashboardState
+	// adminGuard guards admin, pprof and dashboard
+	adminGuard sync.Mutex
+	startTime  time.Time
+
+	// stopWatch is closed on Shutdown to stop waiting for the context passed to StartContext
+	stopWatch chan struct{}
+	guard     sync.Mutex
 }
 
+// DefaultShutdownTimeout is how long the graceful shutdown may take after the context passed to StartContext is done
+var DefaultShutdownTimeout = 60 * time.Second
+
 type deferredSub struct {
 	topic Event
 	fn    interface{}
@@ -35,6 +77,87 @@ func (d *Daemon) AddProcessor(name string, pc backends.ProcessorConstructor) {
 	backends.Svc.AddProcessor(name, pc)
 }
 
+// AddProcessorConfig registers the config type of a processor added with AddProcessor, so that its options
+// are checked before the config is loaded or reloaded. The type can implement backends.ConfigValidator
+// and backends.ConnectivityChecker
+func (d *Daemon) AddProcessorConfig(name string, newConfig func() backends.BaseConfig) {
+	backends.Svc.AddProcessorConfig(name, newConfig)
+}
+
+// SetIDGenerator sets the function used to generate the queued id of each envelope.
+// Built-in options are mail.MD5ID (the default), mail.ULID and mail.UUIDv7.
+// Note that the generator is shared by all daemons in the process
+func (d *Daemon) SetIDGenerator(g mail.IDGenerator) {
+	mail.SetIDGenerator(g)
+}
+
+// SetAllowedHostsFunc sets a function that is consulted when the host of a recipient is not
+// in the allowed_hosts list, eg. to look up the host in a database. It must be safe for concurrent use.
+// Pass nil to only use the list
+func (d *Daemon) SetAllowedHostsFunc(f func(host string) bool) {
+	d.allowsHost = f
+	d.setAllowsFuncs()
+}
+
+// SetAllowedIPFunc is like SetAllowedHostsFunc, but for recipients with an address literal, eg. test@[192.0.2.1]
+func (d *Daemon) SetAllowedIPFunc(f func(ip net.IP) bool) {
+	d.allowsIP = f
+	d.setAllowsFuncs()
+}
+
+// setAllowsFuncs passes the allows functions to the servers, once started
+func (d *Daemon) setAllowsFuncs() {
+	if g, ok := d.g.(*guerrilla); ok {
+		g.setAllowsFuncs(d.allowsHost, d.allowsIP)
+	}
+}
+
+// SetClock sets the clock that the servers and the backend gateway use for their timeouts, so that
+// a *clock.Mock can simulate a gw_save_timeout or the end of the shutdown grace without sleeping.
+// Pass nil for the real clock
+func (d *Daemon) SetClock(c clock.Clock) {
+	d.clock = c
+	d.setClock()
+}
+
+// setClock passes the clock to the servers and the backend, once started
+func (d *Daemon) setClock() {
+	if g, ok := d.g.(*guerrilla); ok {
+		g.setClock(d.clock)
+	}
+}
+
+// AddReputationProvider adds a provider that scores the clients' IP addresses, in addition to the lists
+// and DNSBLs of the reputation config. The scores of all the providers are added up, then compared to
+// the thresholds of the config. The provider must be safe for concurrent use
+func (d *Daemon) AddReputationProvider(p reputation.Provider) {
+	d.reputationProviders = append(d.reputationProviders, p)
+	d.setReputationProviders()
+}
+
+// setReputationProviders passes the providers to the reputation checker, once started
+func (d *Daemon) setReputationProviders() {
+	if g, ok := d.g.(*guerrilla); ok {
+		g.reputation.SetProviders(d.reputationProviders)
+	}
+}
+
+// SetConnectionPolicy sets a policy that decides what to do with each connection before the greeting is sent:
+// allow it, deny it with a 554, or tarpit it by holding each reply for the server's tarpit_delay. It runs
+// before the reputation checks and the processors, eg. to block countries or a custom list of addresses.
+// Pass nil to allow all connections
+func (d *Daemon) SetConnectionPolicy(p ConnectionPolicy) {
+	d.policy = p
+	d.setConnectionPolicy()
+}
+
+// setConnectionPolicy passes the policy to the servers, once started
+func (d *Daemon) setConnectionPolicy() {
+	if g, ok := d.g.(*guerrilla); ok {
+		g.setConnectionPolicy(d.policy)
+	}
+}
+
 // Starts the daemon, initializing d.Config, d.Logger and d.Backend with defaults
 // can only be called once through the lifetime of the program
 func (d *Daemon) Start() (err error) {
@@ -45,6 +168,9 @@ func (d *Daemon) Start() (err error) {
 		if err = d.configureDefaults(); err != nil {
 			return err
 		}
+		if err = log.SetFormat(d.Config.LogFormat); err != nil {
+			return err
+		}
 		if d.Logger == nil {
 			d.Logger, err = log.GetLogger(d.Config.LogFile, d.Config.LogLevel)
 			if err != nil {
@@ -66,25 +192,95 @@ func (d *Daemon) Start() (err error) {
 
 		}
 		d.subs = make([]deferredSub, 0)
+		d.setAllowsFuncs()
+		d.setClock()
+		d.setReputationProviders()
+		d.setConnectionPolicy()
+		d.startTime = time.Now()
 	}
 	err = d.g.Start()
 	if err == nil {
 		if err := d.resetLogger(); err == nil {
 			d.Log().Infof("main log configured to %s", d.Config.LogFile)
 		}
-
+		err = d.StartHTTPServers()
 	}
+	// handed over listeners that are not in the config are not needed
+	closeInheritedListeners()
 	return err
 }
 
+// StartContext starts the daemon like Start does, then shuts it down when ctx is done.
+// The shutdown is graceful, but the remaining clients are disconnected after DefaultShutdownTimeout
+func (d *Daemon) StartContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := d.Start(); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	d.guard.Lock()
+	d.stopWatch = stop
+	d.guard.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.Log().Infof("context done, shutting down: %s", ctx.Err())
+			sctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+			defer cancel()
+			if err := d.ShutdownContext(sctx); err != nil {
+				d.Log().WithError(err).Error("graceful shutdown timed out")
+			}
+		case <-stop:
+		}
+	}()
+	return nil
+}
+
 // Shuts down the daemon, including servers and backend.
 // Do not call Start on it again, use a new server.
 func (d *Daemon) Shutdown() {
+	d.guard.Lock()
+	if d.stopWatch != nil {
+		close(d.stopWatch)
+		d.stopWatch = nil
+	}
+	d.guard.Unlock()
+	d.StopHTTPServers()
 	if d.g != nil {
 		d.g.Shutdown()
 	}
 }
 
+// ShutdownContext shuts down the daemon like Shutdown does, but stops waiting when ctx is done.
+// If ctx is done first, the clients that are still connected are disconnected, and ctx.Err() is returned
+// while the shutdown continues in the background
+func (d *Daemon) ShutdownContext(ctx context.Context) error {
+	// get the servers now, the list is locked during the shutdown
+	var servers []*server
+	if g, ok := d.g.(*guerrilla); ok {
+		g.mapServers(func(s *server) {
+			servers = append(servers, s)
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		d.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, s := range servers {
+			// an expired deadline makes the clients' next read or write fail
+			s.clientPool.SetTimeout(0)
+		}
+		return ctx.Err()
+	}
+}
+
 // LoadConfig reads in the config from a JSON file.
 // Note: if d.Config is nil, the sets d.Config with the unmarshalled AppConfig which will be returned
 func (d *Daemon) LoadConfig(path string) (AppConfig, error) {
@@ -93,10 +289,11 @@ func (d *Daemon) LoadConfig(path string) (AppConfig, error) {
 	if err != nil {
 		return ac, fmt.Errorf("could not read config file: %s", err.Error())
 	}
-	err = ac.Load(data)
+	err = ac.load(data, filepath.Dir(path))
 	if err != nil {
 		return ac, err
 	}
+	d.configPath = path
 	if d.Config == nil {
 		d.Config = &ac
 	}
@@ -120,33 +317,83 @@ func (d *Daemon) SetConfig(c AppConfig) error {
 	return nil
 }
 
-// Reload a config using the passed in AppConfig and emit config change events
+// Reload a config using the passed in AppConfig and emit config change events.
+// The new config is validated before any change is made. If a server or the backend then fails to apply it,
+// all the changes are rolled back to the previous config, and EventConfigReloadFailed is published
 func (d *Daemon) ReloadConfig(c AppConfig) error {
 	oldConfig := *d.Config
 	err := d.SetConfig(c)
+	if err == nil {
+		err = d.validateReload(&oldConfig)
+	}
 	if err != nil {
+		d.Config = &oldConfig
 		d.Log().WithError(err).Error("Error while reloading config")
+		d.Publish(EventConfigReloadFailed, &c, err)
 		return err
 	}
 	d.Log().Infof("Configuration was reloaded at %s", d.configLoadTime)
 	d.Config.EmitChangeEvents(&oldConfig, d.g)
-
+	if g, ok := d.g.(*guerrilla); ok {
+		if errs := g.reloadErrors(); len(errs) > 0 {
+			newConfig := *d.Config
+			d.Log().WithError(errs).Error("Config could not be applied, rolling back to the previous config")
+			d.Config = &oldConfig
+			oldConfig.EmitChangeEvents(&newConfig, d.g)
+			if rollbackErrs := g.reloadErrors(); len(rollbackErrs) > 0 {
+				d.Log().WithError(rollbackErrs).Error("Errors while rolling back to the previous config")
+			}
+			d.Publish(EventConfigReloadFailed, &newConfig, error(errs))
+			return errs
+		}
+	}
+	d.reloadAdmin(oldConfig.Admin)
+	d.reloadPprof(oldConfig.PprofPort)
+	d.reloadDashboard(oldConfig.Dashboard)
 	return nil
 }
 
-// Reload a config from a file and emit config change events
+// validateReload checks the parts of d.Config that changed from oldConfig and are not validated when loaded
+func (d *Daemon) validateReload(oldConfig *AppConfig) error {
+	if !reflect.DeepEqual(oldConfig.BackendConfig, d.Config.BackendConfig) {
+		if err := backends.ValidateConfig(d.Config.BackendConfig); err != nil {
+			return err
+		}
+		// the processors connect with the new config while the running backend keeps serving
+		if check, _ := d.Config.BackendConfig["gw_check_connectivity"].(bool); check {
+			if err := backends.CheckConnectivity(d.Config.BackendConfig); err != nil {
+				return err
+			}
+		}
+	}
+	return d.Config.Validate()
+}
+
+// Reload a config from a file and emit config change events, see ReloadConfig
 func (d *Daemon) ReloadConfigFile(path string) error {
 	ac, err := d.LoadConfig(path)
 	if err != nil {
 		d.Log().WithError(err).Error("Error while reloading config from file")
 		return err
-	} else if d.Config != nil {
-		oldConfig := *d.Config
-		d.Config = &ac
-		d.Log().Infof("Configuration was reloaded at %s", d.configLoadTime)
-		d.Config.EmitChangeEvents(&oldConfig, d.g)
 	}
-	return nil
+	return d.ReloadConfig(ac)
+}
+
+// SetConfigReader sets the function used to read the config when a reload is requested through the admin API.
+// Defaults to reading the file last passed to LoadConfig
+func (d *Daemon) SetConfigReader(f func() (AppConfig, error)) {
+	d.configReader = f
+}
+
+// readConfig reads the config for a reload requested through the admin API
+func (d *Daemon) readConfig() (AppConfig, error) {
+	if d.configReader != nil {
+		return d.configReader()
+	}
+	if d.configPath == "" {
+		return AppConfig{}, errors.New("no config file to reload from")
+	}
+	return d.LoadConfig(d.configPath)
 }
 
 // ReopenLogs send events to re-opens all log files.
@@ -159,7 +406,212 @@ func (d *Daemon) ReopenLogs() error {
 	return nil
 }
 
-// Subscribe for subscribing to config change events
+// DaemonStatus is a snapshot of the daemon's runtime state
+type DaemonStatus struct {
+	Started    time.Time      `json:"started"`
+	Uptime     string         `json:"uptime"`
+	Goroutines int            `json:"goroutines"`
+	HeapAlloc  uint64         `json:"heap_alloc"`
+	Servers    []ServerStatus `json:"servers"`
+}
+
+// Status returns the daemon's runtime state, including the state of each server
+func (d *Daemon) Status() DaemonStatus {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	status := DaemonStatus{
+		Started:    d.startTime,
+		Uptime:     time.Since(d.startTime).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  m.HeapAlloc,
+	}
+	if g, ok := d.g.(*guerrilla); ok {
+		status.Servers = g.serverStatus()
+	}
+	return status
+}
+
+// Stats returns the counts of the messages received in the last minute, 5 minutes and hour,
+// per listener and per recipient domain
+func (d *Daemon) Stats() stats.Report {
+	if g, ok := d.g.(*guerrilla); ok {
+		return g.stats.Report()
+	}
+	return stats.Report{Listeners: map[string]stats.Windows{}, Domains: map[string]stats.Windows{}}
+}
+
+// StopServer shuts down the server listening on iface, cutting its connected clients short
+func (d *Daemon) StopServer(iface string) error {
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return errors.New("daemon not started")
+	}
+	return g.stopServer(iface, false)
+}
+
+// DrainServer stops the server listening on iface from accepting new clients,
+// and waits for the connected clients to finish their sessions
+func (d *Daemon) DrainServer(iface string) error {
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return errors.New("daemon not started")
+	}
+	return g.stopServer(iface, true)
+}
+
+// Clients returns the clients connected to the daemon's servers, sorted by listener then by ID
+func (d *Daemon) Clients() []ClientInfo {
+	if g, ok := d.g.(*guerrilla); ok {
+		return g.clients()
+	}
+	return nil
+}
+
+// KillClient disconnects the client with the id from the server listening on iface
+func (d *Daemon) KillClient(iface string, id uint64) error {
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return errors.New("daemon not started")
+	}
+	s, err := g.findServer(iface)
+	if err != nil {
+		return err
+	}
+	if s.disconnectClients(func(c ClientInfo) bool { return c.ID == id }) == 0 {
+		return fmt.Errorf("client [%d] is not connected to [%s]", id, iface)
+	}
+	return nil
+}
+
+// KillClientsFrom disconnects all the clients connected from the IP address, returning how many
+func (d *Daemon) KillClientsFrom(ip string) (int, error) {
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return 0, errors.New("daemon not started")
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0, fmt.Errorf("invalid IP address [%s]", ip)
+	}
+	return g.disconnectClients(func(c ClientInfo) bool {
+		return parsed.Equal(net.ParseIP(c.Peer))
+	}), nil
+}
+
+// AddServer adds a new server to the config, then creates and starts it if the daemon is running.
+// Returns an error if a server with the same listen interface exists, or if the server could not start,
+// eg. when the port is in use or the TLS keys could not be loaded. The config is unchanged on error
+func (d *Daemon) AddServer(sc ServerConfig) error {
+	if d.Config == nil {
+		d.Config = &AppConfig{}
+	}
+	if _, i := d.findServerConfig(sc.ListenInterface); i != -1 {
+		return fmt.Errorf("server [%s] already exists", sc.ListenInterface)
+	}
+	if err := d.prepareServerConfig(&sc); err != nil {
+		return err
+	}
+	if g, ok := d.g.(*guerrilla); ok {
+		if err := g.addServer(&sc); err != nil {
+			return err
+		}
+		d.Config.Servers = append(d.Config.Servers, sc)
+		g.setConfig(d.Config)
+		return nil
+	}
+	// not started yet, the server will be created by Start
+	d.Config.Servers = append(d.Config.Servers, sc)
+	return nil
+}
+
+// ReconfigureServer replaces the config of the server with the same listen interface as sc,
+// applying the changes the same way ReloadConfig does. Returns an error if the server does not exist,
+// the new TLS keys could not be loaded, or the server was enabled but could not start, then the server keeps
+// its old config
+func (d *Daemon) ReconfigureServer(sc ServerConfig) error {
+	old, i := d.findServerConfig(sc.ListenInterface)
+	if i == -1 {
+		return fmt.Errorf("server [%s] not found", sc.ListenInterface)
+	}
+	if err := d.prepareServerConfig(&sc); err != nil {
+		return err
+	}
+	d.Config.Servers[i] = sc
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return nil
+	}
+	s, err := g.findServer(sc.ListenInterface)
+	if err != nil {
+		return err
+	}
+	failed := s.state == ServerStateStartError
+	g.setConfig(d.Config)
+	sc.emitChangeEvents(&old, d.g)
+	if s.state == ServerStateStartError && !failed {
+		// the server could not start with the new config, it keeps the old one and can be enabled again
+		startErr := s.startErr
+		s.state = ServerStateStopped
+		d.Config.Servers[i] = old
+		g.setConfig(d.Config)
+		old.emitChangeEvents(&sc, d.g)
+		return startErr
+	}
+	return nil
+}
+
+// RemoveServer stops the server listening on iface and removes it from the config
+func (d *Daemon) RemoveServer(iface string) error {
+	_, i := d.findServerConfig(iface)
+	if i == -1 {
+		return fmt.Errorf("server [%s] not found", iface)
+	}
+	if g, ok := d.g.(*guerrilla); ok {
+		if s, err := g.findServer(iface); err == nil {
+			if s.state == ServerStateRunning {
+				s.Shutdown()
+			}
+			g.removeServer(iface)
+			g.mainlog().Infof("Server [%s] removed", iface)
+		}
+	}
+	d.Config.Servers = append(d.Config.Servers[:i], d.Config.Servers[i+1:]...)
+	if g, ok := d.g.(*guerrilla); ok {
+		g.setConfig(d.Config)
+	}
+	return nil
+}
+
+// findServerConfig returns the config of the server listening on iface, and its index in d.Config.Servers.
+// The index is -1 if not found
+func (d *Daemon) findServerConfig(iface string) (ServerConfig, int) {
+	if d.Config != nil {
+		for i := range d.Config.Servers {
+			if d.Config.Servers[i].ListenInterface == iface {
+				return d.Config.Servers[i], i
+			}
+		}
+	}
+	return ServerConfig{}, -1
+}
+
+// prepareServerConfig sets the defaults for a server added at runtime, then validates it
+func (d *Daemon) prepareServerConfig(sc *ServerConfig) error {
+	if sc.ListenInterface == "" {
+		return errors.New("listen interface not specified for server")
+	}
+	h, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	sc.setDefaults(h, d.Config.LogFile)
+	if err := sc.Validate(); err != nil {
+		return err
+	}
+	return sc.loadTlsKeyTimestamps()
+}
+
+// Subscribe for subscribing to config change events, and to the client and message events
 func (d *Daemon) Subscribe(topic Event, fn interface{}) error {
 	if d.g == nil {
 		// defer the subscription until the daemon is started
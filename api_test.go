@@ -2,16 +2,23 @@ package guerrilla
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/clock"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/reputation"
 	"github.com/flashmob/go-guerrilla/response"
 	"io/ioutil"
 	"net"
+	"net/textproto"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -774,3 +781,770 @@ func TestCustomBackendResult(t *testing.T) {
 	}
 
 }
+
+func TestAllowedHostsFile(t *testing.T) {
+	defer func(d time.Duration) { hostsFileInterval = d }(hostsFileInterval)
+	hostsFileInterval = 50 * time.Millisecond
+	hostsFile := "tests/allowed_hosts.txt"
+	if err := ioutil.WriteFile(hostsFile, []byte("# test hosts\nfile.example.com\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(hostsFile) }()
+
+	d := Daemon{}
+	d.Config = &AppConfig{AllowedHosts: []string{"grr.la"}, AllowedHostsFile: hostsFile, LogFile: "off"}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	s, err := d.g.(*guerrilla).findServer(d.Config.Servers[0].ListenInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.allowsHost("grr.la") || !s.allowsHost("file.example.com") {
+		t.Error("expecting hosts from allowed_hosts and allowed_hosts_file to be allowed")
+	}
+	if s.allowsHost("new.example.com") {
+		t.Error("new.example.com should not be allowed yet")
+	}
+	// change the file, with a different size so that it's detected even if the mtime did not change
+	if err := ioutil.WriteFile(hostsFile, []byte("file.example.com\nnew.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40 && !s.allowsHost("new.example.com"); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !s.allowsHost("new.example.com") {
+		t.Error("expecting the allowed_hosts_file to be reloaded")
+	}
+	if !s.allowsHost("grr.la") {
+		t.Error("grr.la from allowed_hosts should still be allowed")
+	}
+}
+
+func TestAllowedHostsFunc(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{AllowedHosts: []string{"grr.la"}, LogFile: "off"}
+	// set before starting
+	d.SetAllowedHostsFunc(func(host string) bool {
+		return host == "db.example.com"
+	})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	s, err := d.g.(*guerrilla).findServer(d.Config.Servers[0].ListenInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.allowsHost("grr.la") || !s.allowsHost("db.example.com") {
+		t.Error("expecting hosts from the list and the func to be allowed")
+	}
+	if s.allowsHost("other.example.com") {
+		t.Error("other.example.com should not be allowed")
+	}
+	if s.allowsIp(net.ParseIP("192.0.2.1")) {
+		t.Error("192.0.2.1 should not be allowed")
+	}
+	// set while running
+	d.SetAllowedIPFunc(func(ip net.IP) bool {
+		return ip.Equal(net.ParseIP("192.0.2.1"))
+	})
+	if !s.allowsIp(net.ParseIP("192.0.2.1")) {
+		t.Error("expecting 192.0.2.1 to be allowed by the func")
+	}
+	d.SetAllowedHostsFunc(nil)
+	if s.allowsHost("db.example.com") {
+		t.Error("db.example.com should not be allowed after removing the func")
+	}
+}
+
+func TestConnectionPolicy(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2670", IsEnabled: true}},
+	}
+	var listeners = make(chan string, 1)
+	d.SetConnectionPolicy(ConnectionPolicyFunc(func(ip net.IP, listener string) PolicyAction {
+		listeners <- listener
+		if ip.Equal(net.ParseIP("127.0.0.1")) {
+			return PolicyDeny
+		}
+		return PolicyAllow
+	}))
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	greeting := func() string {
+		conn, err := net.Dial("tcp", "127.0.0.1:2670")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	if line := greeting(); !strings.HasPrefix(line, "554 5.7.1") {
+		t.Error("expecting the connection to be denied, got", line)
+	}
+	if l := <-listeners; l != "127.0.0.1:2670" {
+		t.Error("expecting the policy to get the listener, got", l)
+	}
+	// removed while running
+	d.SetConnectionPolicy(nil)
+	if line := greeting(); !strings.HasPrefix(line, "220") {
+		t.Error("expecting the connection to be allowed, got", line)
+	}
+}
+
+func TestAddRemoveServer(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2643", IsEnabled: true}},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	if err := d.AddServer(ServerConfig{ListenInterface: "127.0.0.1:2644", IsEnabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:2644"); err != nil {
+		t.Error("expecting the new server to be listening", err)
+	} else {
+		_ = conn.Close()
+	}
+	if err := d.AddServer(ServerConfig{ListenInterface: "127.0.0.1:2644", IsEnabled: true}); err == nil {
+		t.Error("expecting an error when adding a server that already exists")
+	}
+	// port in use
+	l, err := net.Listen("tcp", "127.0.0.1:2645")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	if err := d.AddServer(ServerConfig{ListenInterface: "127.0.0.1:2645", IsEnabled: true}); err == nil ||
+		!strings.Contains(err.Error(), "Cannot listen") {
+		t.Error("expecting a listen error, got", err)
+	}
+	// bad TLS
+	badTLS := ServerConfig{ListenInterface: "127.0.0.1:2646", IsEnabled: true}
+	badTLS.TLS.StartTLSOn = true
+	badTLS.TLS.PublicKeyFile = "tests/no-such-cert.pem"
+	badTLS.TLS.PrivateKeyFile = "tests/no-such-key.pem"
+	if err := d.AddServer(badTLS); err == nil {
+		t.Error("expecting an error for a server with bad TLS keys")
+	}
+	if len(d.Config.Servers) != 2 || len(d.Status().Servers) != 2 {
+		t.Error("expecting failed servers to not be added", d.Status().Servers)
+	}
+
+	// disable, then enable again
+	sc, _ := d.findServerConfig("127.0.0.1:2644")
+	sc.IsEnabled = false
+	if err := d.ReconfigureServer(sc); err != nil {
+		t.Error(err)
+	}
+	if s, _ := d.g.(*guerrilla).findServer("127.0.0.1:2644"); s.state != ServerStateStopped {
+		t.Error("expecting the server to be stopped")
+	}
+	sc.IsEnabled = true
+	if err := d.ReconfigureServer(sc); err != nil {
+		t.Error(err)
+	}
+	if s, _ := d.g.(*guerrilla).findServer("127.0.0.1:2644"); s.state != ServerStateRunning {
+		t.Error("expecting the server to be running")
+	}
+	if err := d.ReconfigureServer(ServerConfig{ListenInterface: "127.0.0.1:2659"}); err == nil {
+		t.Error("expecting an error when reconfiguring an unknown server")
+	}
+
+	if err := d.RemoveServer("127.0.0.1:2644"); err != nil {
+		t.Error(err)
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:2644"); err == nil {
+		t.Error("expecting the removed server to not be listening")
+	}
+	if len(d.Config.Servers) != 1 || len(d.Status().Servers) != 1 {
+		t.Error("expecting one server left", d.Status().Servers)
+	}
+	if err := d.RemoveServer("127.0.0.1:2644"); err == nil {
+		t.Error("expecting an error when removing a server that does not exist")
+	}
+}
+
+func TestReconfigureServerStartError(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2643", IsEnabled: true}},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	if err := d.AddServer(ServerConfig{ListenInterface: "127.0.0.1:2645", Timeout: 30}); err != nil {
+		t.Fatal(err)
+	}
+	// port in use
+	l, err := net.Listen("tcp", "127.0.0.1:2645")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, _ := d.findServerConfig("127.0.0.1:2645")
+	sc.IsEnabled, sc.Timeout = true, 60
+	if err := d.ReconfigureServer(sc); err == nil || !strings.Contains(err.Error(), "Cannot listen") {
+		t.Error("expecting a listen error, got", err)
+	}
+	if old, _ := d.findServerConfig("127.0.0.1:2645"); old.IsEnabled || old.Timeout != 30 {
+		t.Errorf("expecting the old config to be restored, got %+v", old)
+	}
+	s, _ := d.g.(*guerrilla).findServer("127.0.0.1:2645")
+	if s.state != ServerStateStopped || s.isEnabled() {
+		t.Error("expecting the server to be stopped with its old config, got", s.state)
+	}
+
+	// it starts once the port is free
+	_ = l.Close()
+	if err := d.ReconfigureServer(sc); err != nil {
+		t.Error(err)
+	}
+	if s.state != ServerStateRunning {
+		t.Error("expecting the server to be running, got", s.state)
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{AllowedHosts: []string{"grr.la"}, LogFile: "off"}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := d.StartContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	iface := d.Config.Servers[0].ListenInterface
+	if conn, err := net.Dial("tcp", iface); err != nil {
+		t.Fatal("expecting the server to be listening", err)
+	} else {
+		_ = conn.Close()
+	}
+	cancel()
+	stopped := false
+	for i := 0; i < 40 && !stopped; i++ {
+		time.Sleep(50 * time.Millisecond)
+		stopped = d.Status().Servers[0].State == "stopped"
+	}
+	if !stopped {
+		t.Error("expecting the server to be stopped after the context was cancelled")
+	}
+	// already cancelled
+	if err := (&Daemon{}).StartContext(ctx); err != context.Canceled {
+		t.Error("expecting context.Canceled, got", err)
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{AllowedHosts: []string{"grr.la"}, LogFile: "off"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.StartContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ShutdownContext(ctx); err != nil {
+		t.Error(err)
+	}
+	if d.Status().Servers[0].State != "stopped" {
+		t.Error("expecting the server to be stopped")
+	}
+}
+
+func TestReloadConfigRollback(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2647", IsEnabled: true}},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	var failed []error
+	if err := d.Subscribe(EventConfigReloadFailed, func(c *AppConfig, err error) {
+		failed = append(failed, err)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// the port of the third server is in use
+	l, err := net.Listen("tcp", "127.0.0.1:2649")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	newConfig := *d.Config
+	newConfig.AllowedHosts = []string{"grr.la", "new.example.com"}
+	newConfig.Servers = []ServerConfig{
+		{ListenInterface: "127.0.0.1:2647", IsEnabled: true},
+		{ListenInterface: "127.0.0.1:2648", IsEnabled: true},
+		{ListenInterface: "127.0.0.1:2649", IsEnabled: true},
+	}
+	if err := d.ReloadConfig(newConfig); err == nil {
+		t.Fatal("expecting the reload to fail")
+	}
+	if len(failed) != 1 {
+		t.Error("expecting one reload failed event, got", len(failed))
+	}
+	if len(d.Config.AllowedHosts) != 1 || len(d.Config.Servers) != 1 {
+		t.Error("expecting the config to be rolled back", d.Config.AllowedHosts, len(d.Config.Servers))
+	}
+	status := d.Status().Servers
+	if len(status) != 1 || status[0].ListenInterface != "127.0.0.1:2647" || status[0].State != "running" {
+		t.Errorf("expecting only the original server to be running, got %+v", status)
+	}
+	s, _ := d.g.(*guerrilla).findServer("127.0.0.1:2647")
+	if s.allowsHost("new.example.com") {
+		t.Error("expecting the allowed hosts to be rolled back")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:2648"); err == nil {
+		t.Error("expecting the new server to be stopped")
+	}
+
+	// invalid backend config, nothing is applied
+	newConfig = *d.Config
+	newConfig.AllowedHosts = []string{"grr.la", "new.example.com"}
+	newConfig.BackendConfig = backends.BackendConfig{"save_process": "HeadersParser|NoSuchProcessor"}
+	if err := d.ReloadConfig(newConfig); err == nil {
+		t.Error("expecting an error for an unknown processor")
+	}
+	if len(failed) != 2 || len(d.Config.AllowedHosts) != 1 || s.allowsHost("new.example.com") {
+		t.Error("expecting the invalid config to not be applied")
+	}
+
+	// the processors cannot connect, the running backend is kept
+	newConfig = *d.Config
+	newConfig.BackendConfig = backends.BackendConfig{
+		"save_process":          "HeadersParser|Hasher|SQL",
+		"mail_table":            "new_mail",
+		"sql_driver":            "nosuchdriver",
+		"sql_dsn":               "test",
+		"primary_mail_host":     "grr.la",
+		"gw_check_connectivity": true,
+	}
+	if err := d.ReloadConfig(newConfig); err == nil || !strings.Contains(err.Error(), "processor [sql]") {
+		t.Error("expecting the sql processor to fail to connect, got", err)
+	}
+	if len(failed) != 3 || d.Config.BackendConfig["save_process"] == "HeadersParser|Hasher|SQL" {
+		t.Error("expecting the config that cannot connect to not be applied")
+	}
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "guerrilla-json-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = logFile.Close()
+	defer func() { _ = os.Remove(logFile.Name()) }()
+	// the format applies to all the loggers
+	defer func() { _ = log.SetFormat(log.FormatText) }()
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      logFile.Name(),
+		LogLevel:     "info",
+		LogFormat:    log.FormatJSON,
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2653", IsEnabled: true, Hostname: "mx.grr.la"}},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := talkToServer("127.0.0.1:2653"); err != nil {
+		t.Error(err)
+	}
+	d.Shutdown()
+	b, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	var queuedID, clientID interface{}
+	var backendLines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line is not JSON: %s", line)
+		}
+		if entry["ts"] == nil || entry["level"] == nil || entry["msg"] == nil {
+			t.Errorf("missing ts, level or msg: %s", line)
+		}
+		if strings.HasPrefix(entry["msg"].(string), "Handle client") {
+			found = true
+			if entry["iface"] != "127.0.0.1:2653" || entry["serverID"] != "mx.grr.la" ||
+				entry["peer"] != "127.0.0.1" || entry["queuedID"] == "" || entry["queuedID"] == nil {
+				t.Errorf("unexpected connection fields: %s", line)
+			}
+			queuedID, clientID = entry["queuedID"], entry["clientID"]
+		}
+		if strings.HasPrefix(entry["msg"].(string), "Mail from:") {
+			backendLines = append(backendLines, entry)
+		}
+	}
+	if !found {
+		t.Error("expecting the client to be logged")
+	}
+	// the lines logged by the processors can be correlated with the connection
+	if len(backendLines) != 1 || backendLines[0]["queuedID"] != queuedID || backendLines[0]["clientID"] != clientID {
+		t.Error("expecting the debugger's line to have the connection's queued id and client id", backendLines)
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers: []ServerConfig{
+			{ListenInterface: "127.0.0.1:2656", IsEnabled: true},
+			// the message is too big for this server, it gets a 451 response
+			{ListenInterface: "127.0.0.1:2657", IsEnabled: true, MaxSize: 10},
+		},
+	}
+	var mu sync.Mutex
+	clients := make(map[Event][]ClientInfo)
+	messages := make(map[Event][]MessageEvent)
+	onClient := func(topic Event) func(c ClientInfo) {
+		return func(c ClientInfo) {
+			mu.Lock()
+			clients[topic] = append(clients[topic], c)
+			mu.Unlock()
+		}
+	}
+	onMessage := func(topic Event) func(m MessageEvent) {
+		return func(m MessageEvent) {
+			mu.Lock()
+			messages[topic] = append(messages[topic], m)
+			mu.Unlock()
+		}
+	}
+	_ = d.Subscribe(EventClientConnect, onClient(EventClientConnect))
+	_ = d.Subscribe(EventClientDisconnect, onClient(EventClientDisconnect))
+	for _, topic := range []Event{EventMessageAccepted, EventMessageRejected, EventMessageDeferred} {
+		_ = d.Subscribe(topic, onMessage(topic))
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := talkToServer("127.0.0.1:2656"); err != nil {
+		t.Error(err)
+	}
+	if err := talkToServer("127.0.0.1:2657"); err != nil {
+		t.Error(err)
+	}
+	d.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	connects, disconnects := clients[EventClientConnect], clients[EventClientDisconnect]
+	if len(connects) != 2 || len(disconnects) != 2 {
+		t.Fatalf("expecting 2 connect and 2 disconnect events, got %+v", clients)
+	}
+	for _, c := range connects {
+		if c.Peer != "127.0.0.1" || c.BytesIn != 0 || c.State != "greeting" {
+			t.Errorf("unexpected connect event %+v", c)
+		}
+	}
+	for _, c := range disconnects {
+		if c.Peer != "127.0.0.1" || c.BytesIn == 0 || c.BytesOut == 0 {
+			t.Errorf("unexpected disconnect event %+v", c)
+		}
+	}
+	if len(messages[EventMessageAccepted]) != 1 || len(messages[EventMessageDeferred]) != 1 ||
+		len(messages[EventMessageRejected]) != 0 {
+		t.Fatalf("unexpected message events %+v", messages)
+	}
+	m := messages[EventMessageAccepted][0]
+	if m.Client.Listener != "127.0.0.1:2656" || m.Code != 250 || m.QueuedID == "" ||
+		m.Helo != "maildiranasaurustester" || m.MailFrom != "test@example.com" ||
+		len(m.RcptTo) != 1 || m.RcptTo[0] != "test@grr.la" || m.Size == 0 {
+		t.Errorf("unexpected accepted event %+v", m)
+	}
+	if m := messages[EventMessageDeferred][0]; m.Client.Listener != "127.0.0.1:2657" || m.Code != 451 {
+		t.Errorf("unexpected deferred event %+v", m)
+	}
+}
+
+func TestLifecycleHandlers(t *testing.T) {
+	var h EventHandler
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var calls int32
+	// a handler that blocks does not stall the publisher, the events that don't fit in its queue are dropped
+	blocked := func(c ClientInfo) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		atomic.AddInt32(&calls, 1)
+	}
+	if err := h.Subscribe(EventClientConnect, blocked); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < lifecycleBuffer+10; i++ {
+		h.Publish(EventClientConnect, ClientInfo{Peer: fmt.Sprint(i)})
+	}
+
+	var got []string
+	var mu sync.Mutex
+	republished := make(chan struct{})
+	// a handler can subscribe and publish
+	onConnect := func(c ClientInfo) {
+		mu.Lock()
+		got = append(got, c.Peer)
+		mu.Unlock()
+		if c.Peer == "last" {
+			_ = h.Subscribe(EventClientDisconnect, func(c ClientInfo) { close(republished) })
+			h.Publish(EventClientDisconnect, c)
+		}
+	}
+	if err := h.Subscribe(EventClientConnect, onConnect); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := h.Unsubscribe(EventClientConnect, blocked); err != nil {
+		t.Error(err)
+	}
+	for _, peer := range []string{"a", "b", "c", "last"} {
+		h.Publish(EventClientConnect, ClientInfo{Peer: peer})
+	}
+	select {
+	case <-republished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler that subscribed and published did not return")
+	}
+	mu.Lock()
+	if strings.Join(got, ",") != "a,b,c,last" {
+		t.Error("expecting the events in the order they were published, got", got)
+	}
+	mu.Unlock()
+	if err := h.Unsubscribe(EventClientConnect, blocked); err == nil {
+		t.Error("expecting an error, the handler was unsubscribed")
+	}
+
+	// the blocked handler was unsubscribed, it's not called with the events of its queue once it returns
+	close(release)
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error("expecting the blocked handler to return once, got", n)
+	}
+	if EventBackendFallback.String() != "backend:fallback" || EventConfigOutbound.String() != "config_change:outbound" {
+		t.Error("unexpected event names", EventBackendFallback, EventConfigOutbound)
+	}
+}
+
+// customProvider scores every address with its score, which can be changed while running
+type customProvider struct {
+	score atomic.Value
+}
+
+func (p *customProvider) Score(ip net.IP) (reputation.Score, error) {
+	return reputation.Score{Value: p.score.Load().(float64), Reason: "custom"}, nil
+}
+
+func TestReputation(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2667", IsEnabled: true}},
+		BackendConfig: backends.BackendConfig{
+			"save_process":      "HeadersParser|Header|Memory",
+			"primary_mail_host": "grr.la",
+		},
+		Reputation: reputation.Config{
+			Lists:         []reputation.ListConfig{{Networks: []string{"127.0.0.0/8"}, Score: 1, Reason: "loopback"}},
+			RejectScore:   10,
+			GreylistScore: 5,
+			TagScore:      2,
+			GreylistDelay: "5m",
+		},
+	}
+	provider := &customProvider{}
+	provider.score.Store(float64(9))
+	d.AddReputationProvider(provider)
+	mock := clock.NewMock(time.Now())
+	d.SetClock(mock)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	backends.MemoryStore.Reset()
+	defer backends.MemoryStore.Reset()
+
+	conn, err := textproto.Dial("tcp", "127.0.0.1:2667")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadResponse(220); err == nil || !strings.HasPrefix(msg, "5.7.1") {
+		t.Error("expecting a score of 10 to be rejected when connecting, got", msg, err)
+	}
+	_ = conn.Close()
+
+	// the score is cached for 10 minutes
+	provider.score.Store(float64(4))
+	mock.Add(10 * time.Minute)
+	if conn, err = textproto.Dial("tcp", "127.0.0.1:2667"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	cmd := func(expect int, format string, args ...interface{}) string {
+		if err := conn.PrintfLine(format, args...); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadResponse(expect)
+		if err != nil {
+			t.Error(format, err)
+		}
+		return msg
+	}
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal("expecting a score of 5 to be greeted, got", err)
+	}
+	cmd(250, "EHLO test.example.com")
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(451, "RCPT TO:<test@grr.la>")
+	mock.Add(4 * time.Minute)
+	cmd(451, "RCPT TO:<test@grr.la>")
+	mock.Add(time.Minute)
+	cmd(250, "RCPT TO:<test@grr.la>")
+	cmd(354, "DATA")
+	cmd(250, "Subject: test\r\n\r\nThis is a test.\r\n.")
+
+	envelopes := backends.MemoryStore.Envelopes()
+	if len(envelopes) != 1 {
+		t.Fatal("expecting the message to be saved, got", len(envelopes))
+	}
+	if e := envelopes[0]; !strings.Contains(e.DeliveryHeader, "X-Reputation: 5 custom,loopback\n") ||
+		e.Values["reputation_score"] != float64(5) {
+		t.Errorf("expecting the message to be tagged, got %q %v", e.DeliveryHeader, e.Values)
+	}
+}
+
+// knownUsers rejects the recipients other than known@
+var knownUsers = func() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskValidateRcpt && e.RcptTo[len(e.RcptTo)-1].User != "known" {
+					return backends.NewResult(response.Canned.FailRcptCmd), backends.NoSuchUser
+				}
+				return p.Process(e, task)
+			})
+	}
+}
+
+func TestDomains(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la", "archive.example", "null.example"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2668", IsEnabled: true}},
+		BackendConfig: backends.BackendConfig{
+			"save_process":      "HeadersParser|Header|Memory",
+			"validate_process":  "KnownUsers",
+			"save_routes":       map[string]interface{}{"archive": "HeadersParser|Memory"},
+			"primary_mail_host": "grr.la",
+		},
+		Domains: DomainsConfig{
+			"grr.la":          {CatchAll: "postmaster@grr.la", MaxSize: 100},
+			"archive.example": {SaveRoute: "archive"},
+			"null.example":    {Discard: true},
+		},
+	}
+	d.AddProcessor("KnownUsers", knownUsers)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	backends.MemoryStore.Reset()
+	defer backends.MemoryStore.Reset()
+
+	conn, err := textproto.Dial("tcp", "127.0.0.1:2668")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	cmd := func(expect int, format string, args ...interface{}) {
+		if err := conn.PrintfLine(format, args...); err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := conn.ReadResponse(expect); err != nil {
+			t.Error(format, msg, err)
+		}
+	}
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	cmd(250, "EHLO test.example.com")
+
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<unknown@grr.la>")
+	cmd(250, "RCPT TO:<known@grr.la>")
+	cmd(250, "RCPT TO:<other@grr.la>")
+	cmd(452, "RCPT TO:<known@archive.example>")
+	cmd(454, "RCPT TO:<unknown@example.com>")
+	cmd(354, "DATA")
+	cmd(250, "Subject: test\r\n\r\nThis is a test.\r\n.")
+
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<known@archive.example>")
+	cmd(452, "RCPT TO:<known@grr.la>")
+	cmd(354, "DATA")
+	cmd(250, "Subject: archived\r\n\r\nThis is a test.\r\n.")
+
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<anyone@null.example>")
+	cmd(354, "DATA")
+	cmd(250, "Subject: discarded\r\n\r\nThis is a test.\r\n.")
+
+	// the size declared with MAIL is over the max_size of grr.la, its recipients are rejected before DATA
+	cmd(250, "MAIL FROM:<sender@example.com> SIZE=1000")
+	cmd(552, "RCPT TO:<known@grr.la>")
+	cmd(250, "RSET")
+	cmd(250, "MAIL FROM:<sender@example.com> SIZE=100")
+	cmd(250, "RCPT TO:<known@grr.la>")
+	cmd(250, "RSET")
+
+	envelopes := backends.MemoryStore.Envelopes()
+	if len(envelopes) != 2 {
+		t.Fatal("expecting 2 messages to be saved, got", len(envelopes))
+	}
+	if e := envelopes[0]; len(e.RcptTo) != 2 || e.RcptTo[0].String() != "postmaster@grr.la" ||
+		e.RcptTo[1].String() != "known@grr.la" || e.Route != "" {
+		t.Errorf("expecting the unknown recipients to go to the catch-all address, got %v %q", e.RcptTo, e.Route)
+	}
+	if e := envelopes[1]; e.Route != "archive" || e.DeliveryHeader != "" {
+		t.Errorf("expecting the message to be saved by the archive route, got %q %q", e.Route, e.DeliveryHeader)
+	}
+
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<known@grr.la>")
+	cmd(354, "DATA")
+	cmd(552, "Subject: too big\r\n\r\n%s\r\n.", strings.Repeat("x", 100))
+	if n := len(backends.MemoryStore.Envelopes()); n != 2 {
+		t.Error("expecting the message over the domain's max_size not to be saved, got", n)
+	}
+}
@@ -0,0 +1,119 @@
+package backends
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// AuthResult is the result of a message authentication method, eg. SPF or DKIM. The processors that
+// authenticate the messages add their results with AddAuthResult, then the Header processor writes
+// them in a single Authentication-Results header (RFC 8601), with a Received-SPF header for SPF (RFC 7208)
+type AuthResult struct {
+	// Method is the authentication method, eg. "spf", "dkim", "dmarc", "iprev" or "auth"
+	Method string
+	// Result is the result of the method, eg. "pass", "fail", "softfail", "neutral", "none",
+	// "temperror" or "permerror"
+	Result string
+	// Reason explains the result, eg. "domain of example.com designates 192.0.2.1 as permitted sender"
+	Reason string
+	// Properties are what the method looked at, in order, eg. smtp.mailfrom=alice@example.com
+	Properties []AuthProperty
+}
+
+// AuthProperty is a property of an AuthResult, eg. {"smtp.mailfrom", "alice@example.com"} or {"header.d", "example.com"}
+type AuthProperty struct {
+	Name  string
+	Value string
+}
+
+// authMethodOrder is the order of the methods in the header: a method comes after the methods it depends on
+var authMethodOrder = map[string]int{
+	"iprev": 1,
+	"auth":  2,
+	"spf":   3,
+	"dkim":  4,
+	"arc":   5,
+	"dmarc": 6,
+}
+
+// AddAuthResult adds the result of an authentication method to e.Values["auth_results"]
+func AddAuthResult(e *mail.Envelope, r AuthResult) {
+	results, _ := e.Values["auth_results"].([]AuthResult)
+	e.Values["auth_results"] = append(results, r)
+}
+
+// AuthResults returns the results added with AddAuthResult, ordered by method. The methods that
+// are not known come last, in the order they were added
+func AuthResults(e *mail.Envelope) []AuthResult {
+	results, _ := e.Values["auth_results"].([]AuthResult)
+	return sortAuthResults(append([]AuthResult(nil), results...))
+}
+
+func sortAuthResults(results []AuthResult) []AuthResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		return methodOrder(results[i].Method) < methodOrder(results[j].Method)
+	})
+	return results
+}
+
+func methodOrder(method string) int {
+	if o, ok := authMethodOrder[strings.ToLower(method)]; ok {
+		return o
+	}
+	return len(authMethodOrder) + 1
+}
+
+// AuthResultsHeader returns the Authentication-Results header of the results, eg.
+//
+//	Authentication-Results: mx.example.com;
+//		spf=pass smtp.mailfrom=alice@example.org;
+//		dkim=pass header.d=example.org
+//
+// authServID identifies the server that authenticated the message. The results are written in the order given
+func AuthResultsHeader(authServID string, results []AuthResult) string {
+	h := "Authentication-Results: " + authServID
+	if len(results) == 0 {
+		return h + "; none\n"
+	}
+	for _, r := range results {
+		h += ";\n\t" + strings.ToLower(r.Method) + "=" + strings.ToLower(r.Result)
+		if r.Reason != "" {
+			h += " reason=" + quoteAuthValue(r.Reason)
+		}
+		for _, p := range r.Properties {
+			h += " " + p.Name + "=" + quoteAuthValue(p.Value)
+		}
+	}
+	return h + "\n"
+}
+
+// ReceivedSPFHeader returns the Received-SPF header of an SPF result, eg.
+//
+//	Received-SPF: pass (domain of example.org designates 192.0.2.1 as permitted sender)
+//		client-ip=192.0.2.1; envelope-from=alice@example.org; helo=mail.example.org; receiver=mx.example.com;
+//
+// The key-value pairs are taken from the envelope
+func ReceivedSPFHeader(receiver string, r AuthResult, e *mail.Envelope) string {
+	h := "Received-SPF: " + strings.ToLower(r.Result)
+	if r.Reason != "" {
+		h += " (" + strings.NewReplacer("(", "", ")", "", "\n", " ", "\r", "").Replace(r.Reason) + ")"
+	}
+	h += "\n\tclient-ip=" + e.RemoteIP + ";"
+	if from := e.MailFrom.String(); from != "" {
+		h += " envelope-from=" + quoteAuthValue(from) + ";"
+	}
+	if e.Helo != "" {
+		h += " helo=" + quoteAuthValue(e.Helo) + ";"
+	}
+	return h + " receiver=" + receiver + ";\n"
+}
+
+// quoteAuthValue quotes a value that is not a token, an address or a domain
+func quoteAuthValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\r\n;\"()\\,") {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", "", "\n", " ").Replace(v) + `"`
+}
@@ -0,0 +1,37 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestAuthResultsHeader(t *testing.T) {
+	e := mail.NewEnvelope("192.0.2.1", 1)
+	e.Helo = "mail.example.org"
+	e.MailFrom = mail.Address{User: "alice", Host: "example.org"}
+	AddAuthResult(e, AuthResult{Method: "dmarc", Result: "pass", Properties: []AuthProperty{{"header.from", "example.org"}}})
+	AddAuthResult(e, AuthResult{Method: "x-scanner", Result: "pass"})
+	AddAuthResult(e, AuthResult{Method: "DKIM", Result: "Fail", Reason: "bad signature",
+		Properties: []AuthProperty{{"header.d", "example.org"}, {"header.s", "sel;1"}}})
+	spf := AuthResult{Method: "spf", Result: "pass", Reason: "domain of example.org designates (192.0.2.1)",
+		Properties: []AuthProperty{{"smtp.mailfrom", "alice@example.org"}}}
+	AddAuthResult(e, spf)
+
+	expected := "Authentication-Results: mx.example.com;\n" +
+		"\tspf=pass reason=\"domain of example.org designates (192.0.2.1)\" smtp.mailfrom=alice@example.org;\n" +
+		"\tdkim=fail reason=\"bad signature\" header.d=example.org header.s=\"sel;1\";\n" +
+		"\tdmarc=pass header.from=example.org;\n" +
+		"\tx-scanner=pass\n"
+	if h := AuthResultsHeader("mx.example.com", AuthResults(e)); h != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, h)
+	}
+	if h := AuthResultsHeader("mx.example.com", nil); h != "Authentication-Results: mx.example.com; none\n" {
+		t.Error("unexpected header without results", h)
+	}
+	expected = "Received-SPF: pass (domain of example.org designates 192.0.2.1)\n" +
+		"\tclient-ip=192.0.2.1; envelope-from=alice@example.org; helo=mail.example.org; receiver=mx.example.com;\n"
+	if h := ReceivedSPFHeader("mx.example.com", spf, e); h != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, h)
+	}
+}
@@ -1,10 +1,10 @@
 package backends
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/retention"
 	"reflect"
 	"strconv"
 	"strings"
@@ -18,12 +18,17 @@ var (
 	// Store the constructor for making an new processor decorator.
 	processors map[string]ProcessorConstructor
 
+	// processorConfigs makes a new config type for the processors that have options,
+	// so that the options can be checked without initializing the processor. See ValidateConfig
+	processorConfigs map[string]func() BaseConfig
+
 	b Backend
 )
 
 func init() {
 	Svc = &service{}
 	processors = make(map[string]ProcessorConstructor)
+	processorConfigs = make(map[string]func() BaseConfig)
 }
 
 type ProcessorConstructor func() Decorator
@@ -52,10 +57,25 @@ type BackendConfig map[string]interface{}
 // All config structs extend from this
 type BaseConfig interface{}
 
+// ConfigValidator is implemented by the config types that check their options beyond their types,
+// eg. that a duration can be parsed. Called by ValidateConfig, without connecting to anything
+type ConfigValidator interface {
+	Validate() error
+}
+
+// ConnectivityChecker is implemented by the config types of the processors that connect to
+// a service, eg. a database. Called by CheckConnectivity
+type ConnectivityChecker interface {
+	// CheckConnectivity connects with the options, then closes the connection
+	CheckConnectivity() error
+}
+
 type notifyMsg struct {
 	err      error
 	queuedID string
 	result   Result
+	// fellBack is true if save_process_fallback saved the email
+	fellBack bool
 }
 
 // Result represents a response to an SMTP client after receiving DATA.
@@ -69,12 +89,12 @@ type Result interface {
 
 // Internal implementation of BackendResult for use by backend implementations.
 type result struct {
-	// we're going to use a bytes.Buffer for building a string
-	bytes.Buffer
+	// s is built once by NewResult
+	s string
 }
 
 func (r *result) String() string {
-	return r.Buffer.String()
+	return r.s
 }
 
 // Parses the SMTP code from the first 3 characters of the SMTP message.
@@ -92,7 +112,9 @@ func (r *result) Code() int {
 }
 
 func NewResult(r ...interface{}) Result {
-	buf := new(result)
+	var buf strings.Builder
+	// enough for most responses, such as "250 2.0.0 OK: queued as <hash>"
+	buf.Grow(64)
 	for _, item := range r {
 		switch v := item.(type) {
 		case error:
@@ -103,7 +125,43 @@ func NewResult(r ...interface{}) Result {
 			_, _ = buf.WriteString(v)
 		}
 	}
-	return buf
+	return &result{s: buf.String()}
+}
+
+// RcptResults is implemented by the results of TaskSaveMail that have a response for each recipient,
+// eg. when the message could be delivered to some of its recipients only. The Result itself is the
+// response sent to the client after DATA
+type RcptResults interface {
+	Result
+	// Rcpts returns the responses of the recipients, in the order of e.RcptTo
+	Rcpts() []Result
+}
+
+type rcptResults struct {
+	Result
+	rcpts []Result
+}
+
+func (r *rcptResults) Rcpts() []Result {
+	return r.rcpts
+}
+
+// NewRcptResults returns the result res, with the responses of each recipient in the order of e.RcptTo
+func NewRcptResults(res Result, rcpts []Result) Result {
+	return &rcptResults{Result: res, rcpts: rcpts}
+}
+
+// RcptResultsOf returns the responses of the n recipients of a message saved with the result r.
+// If r does not have a response for each recipient, its own response is used for all of them
+func RcptResultsOf(r Result, n int) []Result {
+	if rr, ok := r.(RcptResults); ok && len(rr.Rcpts()) == n {
+		return rr.Rcpts()
+	}
+	rcpts := make([]Result, n)
+	for i := range rcpts {
+		rcpts[i] = r
+	}
+	return rcpts
 }
 
 type processorInitializer interface {
@@ -154,6 +212,12 @@ type service struct {
 	shutdowners  []processorShutdowner
 	sync.Mutex
 	mainlog atomic.Value
+	// stores are the stores of the processors, for the retention rules. Guarded by storesMu,
+	// since the processors add them from their initializers
+	stores   map[string]retention.Store
+	storesMu sync.Mutex
+	// logs are the loggers of the processors that have a level of their own, see ProcessorLog
+	logs processorLogs
 }
 
 // Get loads the log.logger in an atomic operation. Returns a stderr logger if not able to load
@@ -183,10 +247,41 @@ func (s *service) AddShutdowner(sh processorShutdowner) {
 	s.shutdowners = append(s.shutdowners, sh)
 }
 
+// AddStore adds the store of a processor, so that the retention rules apply to it. The processors of
+// each worker add the same store, keyed by name, eg. "sql:emails"; the first one is kept
+func (s *service) AddStore(name string, st retention.Store) {
+	s.storesMu.Lock()
+	defer s.storesMu.Unlock()
+	if s.stores == nil {
+		s.stores = make(map[string]retention.Store)
+	}
+	if _, ok := s.stores[name]; !ok {
+		s.stores[name] = st
+	}
+}
+
+// Stores returns the stores added by the processors of the running backend, keyed by name
+func Stores() map[string]retention.Store {
+	Svc.storesMu.Lock()
+	defer Svc.storesMu.Unlock()
+	stores := make(map[string]retention.Store, len(Svc.stores))
+	for name, st := range Svc.stores {
+		stores[name] = st
+	}
+	return stores
+}
+
+func (s *service) resetStores() {
+	s.storesMu.Lock()
+	defer s.storesMu.Unlock()
+	s.stores = nil
+}
+
 // reset clears the initializers and Shutdowners
 func (s *service) reset() {
 	s.shutdowners = make([]processorShutdowner, 0)
 	s.initializers = make([]processorInitializer, 0)
+	s.resetStores()
 }
 
 // Initialize initializes all the processors one-by-one and returns any errors.
@@ -214,6 +309,8 @@ func (s *service) initialize(backend BackendConfig) Errors {
 func (s *service) shutdown() Errors {
 	s.Lock()
 	defer s.Unlock()
+	// the stores are closed by the shutdowners
+	s.resetStores()
 	var errors Errors
 	failed := make([]processorShutdowner, 0)
 	for i := range s.shutdowners {
@@ -240,12 +337,19 @@ func (s *service) AddProcessor(name string, p ProcessorConstructor) {
 	processors[strings.ToLower(name)] = c
 }
 
+// AddProcessorConfig registers the config type of a processor added with AddProcessor, so that its
+// options are checked by ValidateConfig and CheckConnectivity, and listed by Processors.
+// newConfig returns a pointer to a new config struct, see ExtractConfig
+func (s *service) AddProcessorConfig(name string, newConfig func() BaseConfig) {
+	processorConfigs[strings.ToLower(name)] = newConfig
+}
+
 // extractConfig loads the backend config. It has already been unmarshalled
 // configData contains data from the main config file's "backend_config" value
 // configType is a Processor's specific config value.
 // The reason why using reflection is because we'll get a nice error message if the field is missing
 // the alternative solution would be to json.Marshal() and json.Unmarshal() however that will not give us any
-// error messages
+// error messages. The fields of embedded structs are loaded too
 func (s *service) ExtractConfig(configData BackendConfig, configType BaseConfig) (interface{}, error) {
 	// Use reflection so that we can provide a nice error message
 	v := reflect.ValueOf(configType).Elem() // so that we can set the values
@@ -255,6 +359,13 @@ func (s *service) ExtractConfig(configData BackendConfig, configType BaseConfig)
 
 	for i := 0; i < v.NumField(); i++ {
 		f := v.Field(i)
+		if t.Field(i).Anonymous && f.Kind() == reflect.Struct {
+			// the options of an embedded struct are the options of its parent
+			if _, err := s.ExtractConfig(configData, f.Addr().Interface()); err != nil {
+				return configType, err
+			}
+			continue
+		}
 		// read the tags of the config struct
 		fieldName := t.Field(i).Tag.Get("json")
 		omitempty := false
@@ -0,0 +1,121 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultBreakerWindow is how long the failures of a stack are counted when gw_breaker_window is not set
+const defaultBreakerWindow = time.Minute
+
+// defaultBreakerProbe is how long a circuit is open when gw_breaker_probe is not set
+const defaultBreakerProbe = time.Second * 30
+
+// errCircuitOpen is the error of save_process given to the fallback while its circuit is open
+var errCircuitOpen = errors.New("circuit of [save_process] is open")
+
+// storageFailure returns true if err, returned by a save stack, is a failure of the storage
+// rather than a rejection of the message or a client that went away
+func storageFailure(err error) bool {
+	switch err {
+	case nil, context.Canceled, NoSuchUser, QuotaExceeded, UserSuspended,
+		SenderDomainRejected, SenderNullMX, SenderUnverified:
+		return false
+	}
+	return true
+}
+
+// stackBreaker is a circuit breaker for the processor stacks. A stack that failed limit times within
+// the window is open: it's not used for the cooldown, then one message is let through to probe it.
+// A success closes the circuit, a failure opens it for another cooldown
+type stackBreaker struct {
+	sync.Mutex
+	// limit is the number of failures that opens the circuit, 0 never opens it
+	limit    int
+	window   time.Duration
+	cooldown time.Duration
+	stacks   map[string]*circuit
+}
+
+// circuit is the state of the circuit of a stack
+type circuit struct {
+	// failures are the times of the recent failures
+	failures []time.Time
+	open     bool
+	// until is when the open circuit can be probed
+	until time.Time
+}
+
+// configure sets the options of the breaker, and closes all the circuits
+func (b *stackBreaker) configure(limit int, window, cooldown time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.limit = limit
+	b.window = window
+	b.cooldown = cooldown
+	b.stacks = nil
+}
+
+// allow returns true if the stack can be used at now. When the cooldown of an open circuit is
+// over, it returns true for one probe, then false until the probe succeeded or another cooldown passed
+func (b *stackBreaker) allow(stack string, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	c, ok := b.stacks[stack]
+	if !ok || !c.open {
+		return true
+	}
+	if now.Before(c.until) {
+		return false
+	}
+	c.until = now.Add(b.cooldown)
+	return true
+}
+
+// failure records a failure of the stack at now. Returns true if it opened the circuit
+func (b *stackBreaker) failure(stack string, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.limit < 1 {
+		return false
+	}
+	if b.stacks == nil {
+		b.stacks = make(map[string]*circuit)
+	}
+	c, ok := b.stacks[stack]
+	if !ok {
+		c = &circuit{}
+		b.stacks[stack] = c
+	}
+	if c.open {
+		// the probe failed
+		c.until = now.Add(b.cooldown)
+		return true
+	}
+	recent := c.failures[:0]
+	for _, t := range c.failures {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	c.failures = append(recent, now)
+	if len(c.failures) < b.limit {
+		return false
+	}
+	c.failures = nil
+	c.open = true
+	c.until = now.Add(b.cooldown)
+	return true
+}
+
+// success records that the stack worked, which closes its circuit if it's open. The failures of a closed
+// circuit are kept, they're counted until they're older than the window
+func (b *stackBreaker) success(stack string) {
+	b.Lock()
+	defer b.Unlock()
+	if c, ok := b.stacks[stack]; ok && c.open {
+		delete(b.stacks, stack)
+	}
+}
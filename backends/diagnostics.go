@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// diagnostics records how an envelope was saved, for the X-Guerrilla headers of gw_diagnostic_headers.
+// The worker sets it in e.Values["diagnostics"], then the processors of the stack note when they start
+type diagnostics struct {
+	// stack names the stack that saves the envelope, eg. "save_process" or "save_routes.archive"
+	stack      string
+	processors string
+	worker     int
+	started    []processorStart
+}
+
+type processorStart struct {
+	name string
+	at   time.Time
+}
+
+// setDiagnostics starts recording the diagnostics of an envelope to be saved by the stack
+func setDiagnostics(e *mail.Envelope, stack, processors string, worker int) {
+	e.Values["diagnostics"] = &diagnostics{stack: stack, processors: processors, worker: worker}
+}
+
+// diagnosed wraps the processor made by d so that it notes when it starts, if the envelope has diagnostics.
+// When last is true, the processor is the last of the stack, usually the one that stores the envelope,
+// and the headers are added to e.DeliveryHeader before it runs
+func diagnosed(name string, last bool, d Decorator) Decorator {
+	return func(p Processor) Processor {
+		next := d(p)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if diag, ok := e.Values["diagnostics"].(*diagnostics); ok && task == TaskSaveMail {
+				diag.started = append(diag.started, processorStart{name: name, at: time.Now()})
+				if last {
+					e.DeliveryHeader += diag.header(e)
+				}
+			}
+			return next.Process(e, task)
+		})
+	}
+}
+
+// header returns the X-Guerrilla header fields. The time of each processor is from its start
+// to the start of the next one, so the last processor is not timed
+func (d *diagnostics) header(e *mail.Envelope) string {
+	var b strings.Builder
+	b.WriteString("X-Guerrilla-Connection: " + strconv.FormatUint(e.ClientID, 10) + "\n")
+	if listener, ok := e.Values["listener"].(string); ok {
+		b.WriteString("X-Guerrilla-Listener: " + listener + "\n")
+	}
+	b.WriteString("X-Guerrilla-Chain: " + d.stack + " " + d.processors + " (worker " + strconv.Itoa(d.worker) + ")\n")
+	if len(d.started) > 1 {
+		b.WriteString("X-Guerrilla-Timings:")
+		for i := 0; i < len(d.started)-1; i++ {
+			us := d.started[i+1].at.Sub(d.started[i].at).Nanoseconds() / int64(time.Microsecond)
+			b.WriteString(" " + d.started[i].name + "=" + strconv.FormatInt(us, 10) + "us")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
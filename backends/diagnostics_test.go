@@ -0,0 +1,60 @@
+package backends
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestDiagnosticHeaders(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":          "HeadersParser|Header|Memory",
+		"save_routes":           map[string]interface{}{"archive": "Memory"},
+		"save_workers_size":     1,
+		"primary_mail_host":     "example.com",
+		"gw_diagnostic_headers": true,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+
+	for _, route := range []string{"", "archive"} {
+		e := mail.NewEnvelope("127.0.0.1", 42)
+		e.Route = route
+		e.Values["listener"] = "127.0.0.1:2525"
+		e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+		e.Data.WriteString("Subject: test\n\nThis is a test.\n")
+		if r := gateway.Process(e); r.Code() != 250 {
+			t.Fatal("expecting the envelope to be saved, got", r.String())
+		}
+	}
+	envelopes := MemoryStore.Envelopes()
+	if len(envelopes) != 2 {
+		t.Fatal("expecting 2 envelopes, got", len(envelopes))
+	}
+	header := envelopes[0].DeliveryHeader
+	if !strings.HasPrefix(header, "Delivered-To: test@example.com\n") ||
+		!strings.Contains(header, "\nX-Guerrilla-Connection: 42\nX-Guerrilla-Listener: 127.0.0.1:2525\n"+
+			"X-Guerrilla-Chain: save_process HeadersParser|Header|Memory (worker 1)\n") {
+		t.Errorf("unexpected header %q", header)
+	}
+	if !regexp.MustCompile(`\nX-Guerrilla-Timings: headersparser=\d+us header=\d+us\n$`).MatchString(header) {
+		t.Errorf("expecting the timings of the processors before memory, got %q", header)
+	}
+	header = envelopes[1].DeliveryHeader
+	if !strings.Contains(header, "X-Guerrilla-Chain: save_routes.archive Memory (worker 1)\n") ||
+		strings.Contains(header, "X-Guerrilla-Timings") {
+		t.Errorf("unexpected header of the archive route %q", header)
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"runtime/debug"
 	"strings"
 
+	"github.com/flashmob/go-guerrilla/clock"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/metrics"
 	"github.com/flashmob/go-guerrilla/response"
 )
 
@@ -30,25 +33,72 @@ type BackendGateway struct {
 	workStoppers []chan bool
 	processors   []Processor
 	validators   []Processor
+	// routes are the stacks of save_routes of each worker, keyed by route name
+	routes []map[string]Processor
+	// fallbacks are the save_process_fallback stacks of each worker, nil if not configured
+	fallbacks []Processor
 
 	// controls access to state
 	sync.Mutex
 	State    backendState
 	config   BackendConfig
 	gwConfig *GatewayConfig
+	// clockStore stores the clock that times out the tasks, see SetClock
+	clockStore clock.Value
+	// panicHandlerStore stores the PanicHandler, see SetPanicHandler
+	panicHandlerStore atomic.Value
+	// fallbackHandlerStore stores the FallbackHandler, see SetFallbackHandler
+	fallbackHandlerStore atomic.Value
+	// panics disables the stacks that panic repeatedly, see gw_panic_limit
+	panics stackBreaker
+	// failures opens the circuit of the save stacks that fail repeatedly, see gw_breaker_limit
+	failures stackBreaker
 }
 
 type GatewayConfig struct {
 	// WorkersSize controls how many concurrent workers to start. Defaults to 1
-	WorkersSize int `json:"save_workers_size,omitempty"`
-	// SaveProcess controls which processors to chain in a stack for saving email tasks
-	SaveProcess string `json:"save_process,omitempty"`
+	WorkersSize int `json:"save_workers_size,omitempty" default:"1"`
+	// SaveProcess controls which processors to chain in a stack for saving email tasks.
+	// The daemon's config defaults to "HeadersParser|Header|Debugger"
+	SaveProcess string `json:"save_process,omitempty" default:"HeadersParser|Header|Debugger"`
+	// SaveProcessFallback is the stack that saves the email when the SaveProcess stack failed with an error,
+	// eg. a stack that keeps it on disk when the database is down
+	SaveProcessFallback string `json:"save_process_fallback,omitempty"`
 	// ValidateProcess is like ProcessorStack, but for recipient validation tasks
 	ValidateProcess string `json:"validate_process,omitempty"`
+	// SaveRoutes are other stacks for saving email, keyed by name, eg. {"archive": "HeadersParser|Header|Sql"}.
+	// An envelope is saved with the stack named by its Route instead of SaveProcess. Read by loadConfig,
+	// since ExtractConfig does not read maps
+	SaveRoutes map[string]string `json:"save_routes,omitempty"`
 	// TimeoutSave is duration before timeout when saving an email, eg "29s"
-	TimeoutSave string `json:"gw_save_timeout,omitempty"`
+	TimeoutSave string `json:"gw_save_timeout,omitempty" default:"30s"`
 	// TimeoutValidateRcpt duration before timeout when validating a recipient, eg "1s"
-	TimeoutValidateRcpt string `json:"gw_val_rcpt_timeout,omitempty"`
+	TimeoutValidateRcpt string `json:"gw_val_rcpt_timeout,omitempty" default:"5s"`
+	// CheckConnectivity makes a reload connect the processors with the new config (see CheckConnectivity)
+	// before the running backend is replaced, so that a config that cannot connect is rejected
+	CheckConnectivity bool `json:"gw_check_connectivity,omitempty"`
+	// DiagnosticHeaders adds X-Guerrilla header fields to the saved messages, with the connection, the listener,
+	// the stack that saved it and the time taken by its processors, to debug which stack handled a message
+	DiagnosticHeaders bool `json:"gw_diagnostic_headers,omitempty"`
+	// PanicLimit disables a stack for PanicCooldown once its processors panicked this many times within a minute,
+	// its messages and recipients are then deferred. 0 never disables a stack
+	PanicLimit int `json:"gw_panic_limit,omitempty"`
+	// PanicCooldown is how long a stack stays disabled, eg. "5m"
+	PanicCooldown string `json:"gw_panic_cooldown,omitempty" default:"5m"`
+	// BreakerLimit opens the circuit of a save stack once it failed this many times within BreakerWindow.
+	// Its messages are then deferred, or saved by BreakerFallback, without waiting for gw_save_timeout.
+	// 0 never opens a circuit
+	BreakerLimit int `json:"gw_breaker_limit,omitempty"`
+	// BreakerWindow is how long the failures of a stack are counted, eg. "1m"
+	BreakerWindow string `json:"gw_breaker_window,omitempty" default:"1m"`
+	// BreakerProbe is how long a circuit stays open before a message is let through to probe the stack, eg. "30s"
+	BreakerProbe string `json:"gw_breaker_probe,omitempty" default:"30s"`
+	// BreakerFallback names the route of save_routes that saves the messages of the stacks whose circuit is open,
+	// eg. a stack that keeps them on disk
+	BreakerFallback string `json:"gw_breaker_fallback,omitempty"`
+	// LogLevels sets the log level of some processors, eg. "debugger=warn,callout=debug".
+	// The others log at the level of the main log
+	LogLevels string `json:"gw_log_levels,omitempty"`
 }
 
 // workerMsg is what get placed on the BackendGateway.saveMailChan channel
@@ -59,6 +109,8 @@ type workerMsg struct {
 	notifyMe chan *notifyMsg
 	// select the task type
 	task SelectTask
+	// fallback saves the email with save_process_fallback straight away, the circuit of save_process is open
+	fallback bool
 }
 
 type backendState int
@@ -124,6 +176,7 @@ func (w *workerMsg) reset(e *mail.Envelope, task SelectTask) {
 	}
 	w.e = e
 	w.task = task
+	w.fallback = false
 }
 
 // Process distributes an envelope to one of the backend workers with a TaskSaveMail task
@@ -131,43 +184,51 @@ func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 	if gw.State != BackendStateRunning {
 		return NewResult(response.Canned.FailBackendNotRunning, response.SP, gw.State)
 	}
+	stack, skip := saveStack(e.Route), false
+	if now := gw.clock().Now(); !gw.failures.allow(stack, now) {
+		switch fallback := gw.gwConfig.BreakerFallback; {
+		case fallback != "" && fallback != e.Route && gw.failures.allow(saveStack(fallback), now):
+			Log().WithQueuedID(e.ClientID, e.QueuedId).Warnf("circuit of [%s] is open, saved by route [%s]", stack, fallback)
+			e.Route = fallback
+			stack = saveStack(fallback)
+		case e.Route == "" && gw.hasFallback() && gw.failures.allow(fallbackStack, now):
+			// the fallback saves it without waiting for save_process
+			skip = true
+			stack = fallbackStack
+		default:
+			return NewResult(response.Canned.ErrorBackendDisabled)
+		}
+	}
 	// borrow a workerMsg from the pool
 	workerMsg := workerMsgPool.Get().(*workerMsg)
 	workerMsg.reset(e, TaskSaveMail)
+	workerMsg.fallback = skip
 	// place on the channel so that one of the save mail workers can pick it up
 	gw.conveyor <- workerMsg
 	// wait for the save to complete
 	// or timeout
 	select {
 	case status := <-workerMsg.notifyMe:
-		// email saving transaction completed
-		if status.result == BackendResultOK && status.queuedID != "" {
-			return NewResult(response.Canned.SuccessMessageQueued, response.SP, status.queuedID)
+		// email saving transaction completed, the worker is done with workerMsg
+		workerMsgPool.Put(workerMsg)
+		result := gw.saveResult(e, status)
+		if status.fellBack && stack != fallbackStack {
+			// save_process failed, then the fallback ran
+			gw.saveFailed(stack)
+			stack = fallbackStack
 		}
-
-		// A custom result, there was probably an error, if so, log it
-		if status.result != nil {
-			if status.err != nil {
-				Log().Error(status.err)
-			}
-			return status.result
+		if storageFailure(status.err) {
+			gw.saveFailed(stack)
+		} else if status.err == nil {
+			gw.failures.success(stack)
 		}
+		return result
 
-		// if there was no result, but there's an error, then make a new result from the error
-		if status.err != nil {
-			if _, err := strconv.Atoi(status.err.Error()[:3]); err != nil {
-				return NewResult(response.Canned.FailBackendTransaction, response.SP, status.err)
-			}
-			return NewResult(status.err)
-		}
-
-		// both result & error are nil (should not happen)
-		err := errors.New("no response from backend - processor did not return a result or an error")
-		Log().Error(err)
-		return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
-
-	case <-time.After(gw.saveTimeout()):
-		Log().Error("Backend has timed out while saving email")
+	case <-gw.clock().After(gw.saveTimeout()):
+		Log().WithQueuedID(e.ClientID, e.QueuedId).Error("Backend has timed out while saving email")
+		gw.saveFailed(stack)
+		// let the processors know that the result will not be used
+		e.Cancel()
 		e.Lock() // lock the envelope - it's still processing here, we don't want the server to recycle it
 		go func() {
 			// keep waiting for the backend to finish processing
@@ -179,6 +240,57 @@ func (gw *BackendGateway) Process(e *mail.Envelope) Result {
 	}
 }
 
+// saveStack names the stack that saves the envelopes of the route, "save_process" for the default route
+func saveStack(route string) string {
+	if route == "" {
+		return "save_process"
+	}
+	return "save_routes." + route
+}
+
+// fallbackStack names the save_process_fallback stack
+const fallbackStack = "save_process_fallback"
+
+// hasFallback returns true if save_process_fallback is set
+func (gw *BackendGateway) hasFallback() bool {
+	return strings.TrimSpace(gw.gwConfig.SaveProcessFallback) != ""
+}
+
+// saveFailed records a failure of the save stack, for gw_breaker_limit
+func (gw *BackendGateway) saveFailed(stack string) {
+	if gw.failures.failure(stack, gw.clock().Now()) {
+		Log().Errorf("circuit of [%s] opened, it failed %d times", stack, gw.gwConfig.BreakerLimit)
+	}
+}
+
+// saveResult returns the result of the save, as notified by a worker
+func (gw *BackendGateway) saveResult(e *mail.Envelope, status *notifyMsg) Result {
+	if status.result == BackendResultOK && status.queuedID != "" {
+		return NewResult(response.Canned.SuccessMessageQueued, response.SP, status.queuedID)
+	}
+
+	// A custom result, there was probably an error, if so, log it
+	if status.result != nil {
+		if status.err != nil {
+			Log().WithQueuedID(e.ClientID, e.QueuedId).Error(status.err)
+		}
+		return status.result
+	}
+
+	// if there was no result, but there's an error, then make a new result from the error
+	if status.err != nil {
+		if _, err := strconv.Atoi(status.err.Error()[:3]); err != nil {
+			return NewResult(response.Canned.FailBackendTransaction, response.SP, status.err)
+		}
+		return NewResult(status.err)
+	}
+
+	// both result & error are nil (should not happen)
+	err := errors.New("no response from backend - processor did not return a result or an error")
+	Log().WithQueuedID(e.ClientID, e.QueuedId).Error(err)
+	return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
+}
+
 // ValidateRcpt asks one of the workers to validate the recipient
 // Only the last recipient appended to e.RcptTo will be validated.
 func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
@@ -203,13 +315,13 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 		}
 		return nil
 
-	case <-time.After(gw.validateRcptTimeout()):
+	case <-gw.clock().After(gw.validateRcptTimeout()):
 		e.Lock()
 		go func() {
 			<-workerMsg.notifyMe
 			e.Unlock()
 			workerMsgPool.Put(workerMsg)
-			Log().Error("Backend has timed out while validating rcpt")
+			Log().WithQueuedID(e.ClientID, e.QueuedId).Error("Backend has timed out while validating rcpt")
 		}()
 		return StorageTimeout
 	}
@@ -265,7 +377,7 @@ func (gw *BackendGateway) newStack(stackConfig string) (Processor, error) {
 	for i := range items {
 		name := items[len(items)-1-i] // reverse order, since decorators are stacked
 		if makeFunc, ok := processors[name]; ok {
-			decorators = append(decorators, makeFunc())
+			decorators = append(decorators, diagnosed(name, i == 0, traced(name, makeFunc())))
 		} else {
 			ErrProcessorNotFound = fmt.Errorf("processor [%s] not found", name)
 			return nil, ErrProcessorNotFound
@@ -276,6 +388,111 @@ func (gw *BackendGateway) newStack(stackConfig string) (Processor, error) {
 	return p, nil
 }
 
+// ValidateConfig checks the backend config without initializing any processors or opening connections.
+// It checks the gateway's options, that each processor in save_process and validate_process exists,
+// and that the options of processors with a registered config type are present and of the right type,
+// then valid if the config type is a ConfigValidator. All problems found are returned as Errors
+func ValidateConfig(cfg BackendConfig) error {
+	errs := eachProcessorConfig(cfg, func(name string, config BaseConfig) error {
+		if v, ok := config.(ConfigValidator); ok {
+			return v.Validate()
+		}
+		return nil
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// CheckConnectivity connects each processor whose config type is a ConnectivityChecker, eg. sql
+// and redis, with the options of cfg. Called after ValidateConfig, it returns all the problems as Errors
+func CheckConnectivity(cfg BackendConfig) error {
+	errs := eachProcessorConfig(cfg, func(name string, config BaseConfig) error {
+		if c, ok := config.(ConnectivityChecker); ok {
+			return c.CheckConnectivity()
+		}
+		return nil
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// eachProcessorConfig checks the gateway's options, then calls f with the config of each processor of
+// the stacks that has a config type, once per processor. Returns the problems found, and the errors of f
+func eachProcessorConfig(cfg BackendConfig, f func(name string, config BaseConfig) error) Errors {
+	var errs Errors
+	bcfg, err := Svc.ExtractConfig(cfg, &GatewayConfig{})
+	if err != nil {
+		return Errors{err}
+	}
+	gwConfig := bcfg.(*GatewayConfig)
+	for key, val := range map[string]string{
+		"gw_save_timeout":     gwConfig.TimeoutSave,
+		"gw_val_rcpt_timeout": gwConfig.TimeoutValidateRcpt,
+		"gw_panic_cooldown":   gwConfig.PanicCooldown,
+		"gw_breaker_window":   gwConfig.BreakerWindow,
+		"gw_breaker_probe":    gwConfig.BreakerProbe,
+	} {
+		if val == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(val); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %s", key, err))
+		}
+	}
+	if gwConfig.PanicLimit < 0 {
+		errs = append(errs, errors.New("invalid gw_panic_limit: must not be negative"))
+	}
+	if gwConfig.BreakerLimit < 0 {
+		errs = append(errs, errors.New("invalid gw_breaker_limit: must not be negative"))
+	}
+	if _, err := parseLogLevels(gwConfig.LogLevels); err != nil {
+		errs = append(errs, fmt.Errorf("invalid gw_log_levels: %s", err))
+	}
+	routes, err := SaveRoutes(cfg)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if _, ok := routes[gwConfig.BreakerFallback]; gwConfig.BreakerFallback != "" && !ok {
+		errs = append(errs, fmt.Errorf("invalid gw_breaker_fallback: route [%s] is not in save_routes",
+			gwConfig.BreakerFallback))
+	}
+	stacks := []string{gwConfig.SaveProcess, gwConfig.ValidateProcess, gwConfig.SaveProcessFallback}
+	for _, stack := range routes {
+		stacks = append(stacks, stack)
+	}
+	checked := make(map[string]bool)
+	for _, stack := range stacks {
+		stack = strings.ToLower(strings.TrimSpace(stack))
+		if stack == "" {
+			continue
+		}
+		for _, name := range strings.Split(stack, "|") {
+			if checked[name] {
+				continue
+			}
+			checked[name] = true
+			if _, ok := processors[name]; !ok {
+				errs = append(errs, fmt.Errorf("processor [%s] not found", name))
+				continue
+			}
+			if newConfig, ok := processorConfigs[name]; ok {
+				config, err := Svc.ExtractConfig(cfg, newConfig())
+				if err == nil {
+					err = f(name, config)
+				}
+				if err != nil {
+					errs = append(errs, fmt.Errorf("processor [%s]: %s", name, err))
+				}
+			}
+		}
+	}
+	return errs
+}
+
 // loadConfig loads the config for the GatewayConfig
 func (gw *BackendGateway) loadConfig(cfg BackendConfig) error {
 	configType := BaseConfig(&GatewayConfig{})
@@ -286,10 +503,44 @@ func (gw *BackendGateway) loadConfig(cfg BackendConfig) error {
 	if err != nil {
 		return err
 	}
-	gw.gwConfig = bcfg.(*GatewayConfig)
+	gwConfig := bcfg.(*GatewayConfig)
+	if gwConfig.SaveRoutes, err = SaveRoutes(cfg); err != nil {
+		return err
+	}
+	gw.gwConfig = gwConfig
 	return nil
 }
 
+// SaveRoutes returns the save_routes of the backend config, the processor stacks keyed by route name
+func SaveRoutes(cfg BackendConfig) (map[string]string, error) {
+	val, ok := cfg["save_routes"]
+	if !ok || val == nil {
+		return nil, nil
+	}
+	var routes map[string]string
+	switch v := val.(type) {
+	case map[string]string:
+		routes = v
+	case map[string]interface{}:
+		routes = make(map[string]string, len(v))
+		for name, stack := range v {
+			s, ok := stack.(string)
+			if !ok {
+				return nil, fmt.Errorf("save_routes: the stack of route [%s] is not a string", name)
+			}
+			routes[name] = s
+		}
+	default:
+		return nil, errors.New("save_routes must map route names to processor stacks")
+	}
+	for name, stack := range routes {
+		if strings.TrimSpace(stack) == "" {
+			return nil, fmt.Errorf("save_routes: route [%s] has no processors", name)
+		}
+	}
+	return routes, nil
+}
+
 // Initialize builds the workers and initializes each one
 func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 	gw.Lock()
@@ -302,6 +553,17 @@ func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 		gw.State = BackendStateError
 		return err
 	}
+	levels, err := parseLogLevels(gw.gwConfig.LogLevels)
+	if err != nil {
+		gw.State = BackendStateError
+		return fmt.Errorf("invalid gw_log_levels: %s", err)
+	}
+	Svc.logs.setLevels(levels)
+	gw.panics.configure(gw.gwConfig.PanicLimit, panicWindow,
+		parseDuration(gw.gwConfig.PanicCooldown, defaultPanicCooldown))
+	gw.failures.configure(gw.gwConfig.BreakerLimit,
+		parseDuration(gw.gwConfig.BreakerWindow, defaultBreakerWindow),
+		parseDuration(gw.gwConfig.BreakerProbe, defaultBreakerProbe))
 	workersSize := gw.workersSize()
 	if workersSize < 1 {
 		gw.State = BackendStateError
@@ -309,6 +571,8 @@ func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 	}
 	gw.processors = make([]Processor, 0)
 	gw.validators = make([]Processor, 0)
+	gw.routes = make([]map[string]Processor, 0)
+	gw.fallbacks = make([]Processor, 0)
 	for i := 0; i < workersSize; i++ {
 		p, err := gw.newStack(gw.gwConfig.SaveProcess)
 		if err != nil {
@@ -317,6 +581,24 @@ func (gw *BackendGateway) Initialize(cfg BackendConfig) error {
 		}
 		gw.processors = append(gw.processors, p)
 
+		routes := make(map[string]Processor, len(gw.gwConfig.SaveRoutes))
+		for name, stack := range gw.gwConfig.SaveRoutes {
+			if routes[name], err = gw.newStack(stack); err != nil {
+				gw.State = BackendStateError
+				return err
+			}
+		}
+		gw.routes = append(gw.routes, routes)
+
+		var fallback Processor
+		if strings.TrimSpace(gw.gwConfig.SaveProcessFallback) != "" {
+			if fallback, err = gw.newStack(gw.gwConfig.SaveProcessFallback); err != nil {
+				gw.State = BackendStateError
+				return err
+			}
+		}
+		gw.fallbacks = append(gw.fallbacks, fallback)
+
 		v, err := gw.newStack(gw.gwConfig.ValidateProcess)
 		if err != nil {
 			gw.State = BackendStateError
@@ -358,6 +640,8 @@ func (gw *BackendGateway) Start() error {
 						gw.conveyor,
 						gw.processors[workerId],
 						gw.validators[workerId],
+						gw.routes[workerId],
+						gw.fallbacks[workerId],
 						workerId+1,
 						stop)
 					// keep running after panic
@@ -376,6 +660,11 @@ func (gw *BackendGateway) Start() error {
 	}
 }
 
+// QueueDepth returns the number of envelopes waiting for a worker, and the capacity of the queue
+func (gw *BackendGateway) QueueDepth() (depth, capacity int) {
+	return len(gw.conveyor), cap(gw.conveyor)
+}
+
 // workersSize gets the number of workers to use for saving email by reading the save_workers_size config value
 // Returns 1 if no config value was set
 func (gw *BackendGateway) workersSize() int {
@@ -385,6 +674,16 @@ func (gw *BackendGateway) workersSize() int {
 	return gw.gwConfig.WorkersSize
 }
 
+// SetClock sets the clock that times out the save and validate tasks, eg. a *clock.Mock in tests.
+// Pass nil for the real clock
+func (gw *BackendGateway) SetClock(c clock.Clock) {
+	gw.clockStore.Store(c)
+}
+
+func (gw *BackendGateway) clock() clock.Clock {
+	return gw.clockStore.Load()
+}
+
 // saveTimeout returns the maximum amount of seconds to wait before timing out a save processing task
 func (gw *BackendGateway) saveTimeout() time.Duration {
 	if gw.gwConfig.TimeoutSave == "" {
@@ -397,6 +696,63 @@ func (gw *BackendGateway) saveTimeout() time.Duration {
 	return t
 }
 
+// parseDuration parses the duration of an option, def is returned if the option is not set or invalid
+func parseDuration(val string, def time.Duration) time.Duration {
+	if val == "" {
+		return def
+	}
+	t, err := time.ParseDuration(val)
+	if err != nil {
+		return def
+	}
+	return t
+}
+
+// SetFallbackHandler sets the function called when save_process_fallback saved an email, nil for none
+func (gw *BackendGateway) SetFallbackHandler(h FallbackHandler) {
+	gw.fallbackHandlerStore.Store(h)
+}
+
+// fellBack counts and logs that save_process failed with err, then tells the fallback handler.
+// The fallback stack saves the email next
+func (gw *BackendGateway) fellBack(workerId int, e *mail.Envelope, err error) {
+	Log().WithQueuedID(e.ClientID, e.QueuedId).WithError(err).Warn("save_process failed, saving with save_process_fallback")
+	metrics.Incr(metrics.BackendFallbacks)
+	if h, ok := gw.fallbackHandlerStore.Load().(FallbackHandler); ok && h != nil {
+		h(FallbackInfo{Worker: workerId, QueuedID: e.QueuedId, Error: err.Error()})
+	}
+}
+
+// SetPanicHandler sets the function called with the panics recovered by the workers, nil for none
+func (gw *BackendGateway) SetPanicHandler(h PanicHandler) {
+	gw.panicHandlerStore.Store(h)
+}
+
+// recovered counts and logs a panic of a processor of the stack, then tells the panic handler.
+// The stack is disabled if it panicked too often
+func (gw *BackendGateway) recovered(stack string, workerId int, msg *workerMsg, r interface{}) {
+	info := PanicInfo{
+		Stack:  stack,
+		Worker: workerId,
+		Value:  fmt.Sprint(r),
+		Trace:  string(debug.Stack()),
+	}
+	l := Log().WithField("worker", workerId)
+	if msg != nil {
+		info.QueuedID = msg.e.QueuedId
+		l = Log().WithQueuedID(msg.e.ClientID, msg.e.QueuedId)
+	}
+	l.Error("worker recovered from panic:", r, info.Trace)
+	metrics.Incr(metrics.BackendPanics, "stack:"+stack)
+	info.Disabled = gw.panics.failure(stack, gw.clock().Now())
+	if info.Disabled {
+		l.Errorf("processors of [%s] disabled, they panicked %d times", stack, gw.gwConfig.PanicLimit)
+	}
+	if h, ok := gw.panicHandlerStore.Load().(PanicHandler); ok && h != nil {
+		h(info)
+	}
+}
+
 // validateRcptTimeout returns the maximum amount of seconds to wait before timing out a recipient validation  task
 func (gw *BackendGateway) validateRcptTimeout() time.Duration {
 	if gw.gwConfig.TimeoutValidateRcpt == "" {
@@ -423,10 +779,14 @@ func (gw *BackendGateway) workDispatcher(
 	workIn chan *workerMsg,
 	save Processor,
 	validate Processor,
+	routes map[string]Processor,
+	fallback Processor,
 	workerId int,
 	stop chan bool) (state dispatcherState) {
 
 	var msg *workerMsg
+	// stack names the stack processing msg
+	var stack string
 
 	defer func() {
 
@@ -434,7 +794,7 @@ func (gw *BackendGateway) workDispatcher(
 		// since processors may call arbitrary code, some may be 3rd party / unstable
 		// we need to detect the panic, and notify the backend that it failed & unlock the envelope
 		if r := recover(); r != nil {
-			Log().Error("worker recovered from panic:", r, string(debug.Stack()))
+			gw.recovered(stack, workerId, msg, r)
 
 			if state == dispatcherStateWorking {
 				msg.notifyMe <- &notifyMsg{err: errors.New("storage failed")}
@@ -455,13 +815,65 @@ func (gw *BackendGateway) workDispatcher(
 			return
 		case msg = <-workIn:
 			state = dispatcherStateWorking // recovers from panic if in this state
-			if msg.task == TaskSaveMail {
-				result, err := save.Process(msg.e, msg.task)
+			stack = "validate_process"
+			if msg.fallback {
+				stack = fallbackStack
+			} else if msg.task == TaskSaveMail {
+				stack = saveStack(msg.e.Route)
+			}
+			if err := msg.e.Context().Err(); err != nil {
+				// the client has gone away, or the server is shutting down
+				state = dispatcherStateNotify
+				msg.notifyMe <- &notifyMsg{err: err}
+			} else if !gw.panics.allow(stack, gw.clock().Now()) {
+				// the stack panicked too often, defer until it's enabled again
+				state = dispatcherStateNotify
+				if msg.task == TaskSaveMail {
+					msg.notifyMe <- &notifyMsg{result: NewResult(response.Canned.ErrorBackendDisabled)}
+				} else {
+					msg.notifyMe <- &notifyMsg{err: StorageDisabled}
+				}
+			} else if msg.task == TaskSaveMail {
+				var result Result
+				var err error
+				fellBack := false
+				if gw.gwConfig.DiagnosticHeaders && !msg.fallback {
+					if msg.e.Route == "" {
+						setDiagnostics(msg.e, stack, gw.gwConfig.SaveProcess, workerId)
+					} else {
+						setDiagnostics(msg.e, stack, gw.gwConfig.SaveRoutes[msg.e.Route], workerId)
+					}
+				}
+				if msg.e.Route == "" {
+					header := msg.e.DeliveryHeader
+					if msg.fallback {
+						err = errCircuitOpen
+					} else {
+						result, err = save.Process(msg.e, msg.task)
+					}
+					if fallback != nil && storageFailure(err) && msg.e.Context().Err() == nil {
+						gw.fellBack(workerId, msg.e, err)
+						fellBack = true
+						// the fallback adds its own headers
+						msg.e.DeliveryHeader = header
+						stack = fallbackStack
+						if gw.gwConfig.DiagnosticHeaders {
+							setDiagnostics(msg.e, stack, gw.gwConfig.SaveProcessFallback, workerId)
+						}
+						result, err = fallback.Process(msg.e, msg.task)
+					}
+				} else if route, ok := routes[msg.e.Route]; ok {
+					result, err = route.Process(msg.e, msg.task)
+				} else {
+					err = fmt.Errorf("save route [%s] not found", msg.e.Route)
+				}
 				state = dispatcherStateNotify
-				msg.notifyMe <- &notifyMsg{err: err, result: result, queuedID: msg.e.QueuedId}
+				gw.panics.success(stack)
+				msg.notifyMe <- &notifyMsg{err: err, result: result, queuedID: msg.e.QueuedId, fellBack: fellBack}
 			} else {
 				result, err := validate.Process(msg.e, msg.task)
 				state = dispatcherStateNotify
+				gw.panics.success(stack)
 				msg.notifyMe <- &notifyMsg{err: err, result: result}
 			}
 		}
@@ -1,10 +1,15 @@
 package backends
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/flashmob/go-guerrilla/clock"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -86,7 +91,7 @@ func TestStartProcessStop(t *testing.T) {
 	e.Data.WriteString("Subject:Test\n\nThis is a test.")
 	notify := make(chan *notifyMsg)
 
-	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail}
+	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail, false}
 
 	// it should not produce any errors
 	// headers (subject) should be parsed.
@@ -111,3 +116,517 @@ func TestStartProcessStop(t *testing.T) {
 		t.Error("Gateway did not shutdown")
 	}
 }
+
+func TestProcessCancelled(t *testing.T) {
+	c := BackendConfig{
+		"save_process":       "HeadersParser|Debugger",
+		"log_received_mails": false,
+		"save_workers_size":  1,
+	}
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	e.Data.WriteString("Subject:Test\n\nThis is a test.")
+	ctx, cancel := context.WithCancel(context.Background())
+	e.SetContext(ctx)
+	// the client went away before the envelope was processed
+	cancel()
+	result := gateway.Process(e)
+	if result.Code() < 400 {
+		t.Error("expecting the cancelled envelope to fail, got", result.String())
+	}
+	if e.Header != nil {
+		t.Error("the envelope should not have been processed")
+	}
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+}
+
+func TestProcessTimeout(t *testing.T) {
+	release := make(chan struct{})
+	Svc.AddProcessor("Blocker", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				<-release
+				return p.Process(e, task)
+			})
+		}
+	})
+	c := BackendConfig{
+		"save_process":      "Blocker",
+		"save_workers_size": 1,
+		"gw_save_timeout":   "30s",
+	}
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(c); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	// the real clock can be swapped for the mock
+	gateway.SetClock(nil)
+	mock := clock.NewMock(time.Now())
+	gateway.SetClock(mock)
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	result := make(chan Result)
+	go func() {
+		result <- gateway.Process(e)
+	}()
+	// the processor is blocked, time out the save without waiting 30s
+	mock.BlockUntil(1)
+	mock.Add(29 * time.Second)
+	select {
+	case r := <-result:
+		t.Fatal("the save timed out early:", r.String())
+	default:
+	}
+	mock.Add(time.Second)
+	if r := <-result; r.Code() != response.Canned.FailBackendTimeout.BasicCode {
+		t.Error("expecting the save to time out, got", r.String())
+	}
+	close(release)
+	if err := gateway.Shutdown(); err != nil {
+		t.Error("Gateway did not shutdown")
+	}
+}
+
+func TestProcessRcptResults(t *testing.T) {
+	Svc.AddProcessor("Partial", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				rcpts := []Result{
+					NewResult(response.Canned.SuccessMessageQueued, response.SP, e.QueuedId),
+					NewResult("452 4.2.2 Mailbox full"),
+				}
+				return NewRcptResults(rcpts[0], rcpts), nil
+			})
+		}
+	})
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{"save_process": "Partial", "save_workers_size": 1}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	e.PushRcpt(mail.Address{User: "full", Host: "example.com"})
+	result := gateway.Process(e)
+	if _, ok := result.(RcptResults); !ok || result.Code() != 250 {
+		t.Fatal("expecting the results of the recipients, got", result.String())
+	}
+	if rcpts := RcptResultsOf(result, 2); rcpts[0].Code() != 250 || rcpts[1].Code() != 452 {
+		t.Error("unexpected results of the recipients", rcpts)
+	}
+	// a result for the whole message applies to each recipient
+	if rcpts := RcptResultsOf(NewResult("554 Error"), 2); rcpts[0].Code() != 554 || rcpts[1].Code() != 554 {
+		t.Error("expecting each recipient to have the message's result, got", rcpts)
+	}
+}
+
+func TestProcessPanicLimit(t *testing.T) {
+	Svc.AddProcessor("Panicker", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				panic("panic on purpose")
+			})
+		}
+	})
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "Panicker",
+		"validate_process":  "Panicker",
+		"save_workers_size": 1,
+		"gw_panic_limit":    2,
+		"gw_panic_cooldown": "1m",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	mock := clock.NewMock(time.Now())
+	gateway.SetClock(mock)
+	var panics []PanicInfo
+	gateway.SetPanicHandler(func(p PanicInfo) {
+		panics = append(panics, p)
+	})
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+
+	for i := 0; i < 2; i++ {
+		if r := gateway.Process(e); r.Code() != 554 {
+			t.Error("expecting the panic to fail the save, got", r.String())
+		}
+	}
+	if len(panics) != 2 || panics[0].Stack != "save_process" || panics[0].Disabled || !panics[1].Disabled {
+		t.Fatalf("unexpected panics %+v", panics)
+	}
+	// the stack is disabled, the messages are deferred without panicking
+	if r := gateway.Process(e); r.Code() != 451 {
+		t.Error("expecting the save to be deferred, got", r.String())
+	}
+	// validate_process has its own limit
+	for i := 0; i < 2; i++ {
+		if err := gateway.ValidateRcpt(e); err == nil || err == StorageDisabled {
+			t.Error("expecting the validation to panic, got", err)
+		}
+	}
+	if err := gateway.ValidateRcpt(e); err != StorageDisabled || len(panics) != 4 {
+		t.Error("expecting the validation to be disabled, got", err)
+	}
+	mock.Add(time.Minute)
+	if r := gateway.Process(e); r.Code() != 554 || len(panics) != 5 {
+		t.Error("expecting the stack to be enabled after the cooldown, got", r.String())
+	}
+}
+
+func TestProcessPanicWindow(t *testing.T) {
+	var calls int32
+	Svc.AddProcessor("Alternate", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if atomic.AddInt32(&calls, 1)%2 == 1 {
+					panic("panic on purpose")
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "Alternate",
+		"save_workers_size": 1,
+		"gw_panic_limit":    2,
+		"gw_panic_cooldown": "1m",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	mock := clock.NewMock(time.Now())
+	gateway.SetClock(mock)
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+
+	// a panic, a message saved, then a panic within the minute disables the stack
+	for _, code := range []int{554, 250, 554, 451} {
+		if r := gateway.Process(e); r.Code() != code {
+			t.Error("expecting", code, "got", r.String())
+		}
+	}
+	// the probe after the cooldown enables it, then a panic older than a minute is not counted
+	for _, step := range []struct {
+		wait time.Duration
+		code int
+	}{{time.Minute, 250}, {0, 554}, {0, 250}, {time.Minute + time.Second, 554}, {0, 250}} {
+		mock.Add(step.wait)
+		if r := gateway.Process(e); r.Code() != step.code {
+			t.Error("expecting", step.code, "got", r.String())
+		}
+	}
+}
+
+// flaky returns a processor that fails while down is 1, like a storage that cannot be reached
+func flaky(down *int32) ProcessorConstructor {
+	return func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				if atomic.LoadInt32(down) == 1 {
+					return NewResult("451 4.3.0 Storage unavailable"), errors.New("connection refused")
+				}
+				return p.Process(e, task)
+			})
+		}
+	}
+}
+
+func TestProcessBreaker(t *testing.T) {
+	var down int32 = 1
+	Svc.AddProcessor("Flaky", flaky(&down))
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":        "Flaky",
+		"save_routes":         map[string]interface{}{"spool": "Memory"},
+		"save_workers_size":   1,
+		"gw_breaker_limit":    2,
+		"gw_breaker_probe":    "30s",
+		"gw_breaker_fallback": "spool",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	mock := clock.NewMock(time.Now())
+	gateway.SetClock(mock)
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+	process := func() (*mail.Envelope, Result) {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+		return e, gateway.Process(e)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, r := process(); r.Code() != 451 {
+			t.Error("expecting the save to fail, got", r.String())
+		}
+	}
+	// the circuit is open, the messages are saved by the fallback
+	if e, r := process(); r.Code() != 250 || e.Route != "spool" {
+		t.Error("expecting the message to be saved by the fallback, got", r.String(), e.Route)
+	}
+	mock.Add(time.Second * 30)
+	atomic.StoreInt32(&down, 0)
+	// the probe succeeds and closes the circuit
+	for i := 0; i < 2; i++ {
+		if e, r := process(); r.Code() != 250 || e.Route != "" {
+			t.Error("expecting the message to be saved by save_process, got", r.String(), e.Route)
+		}
+	}
+	if n := len(MemoryStore.Envelopes()); n != 1 {
+		t.Error("expecting 1 message saved by the fallback, got", n)
+	}
+}
+
+func TestProcessFallback(t *testing.T) {
+	var down int32 = 1
+	Svc.AddProcessor("Flaky", flaky(&down))
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":          "Header|Flaky",
+		"save_process_fallback": "Header|Memory",
+		"save_workers_size":     1,
+		"primary_mail_host":     "example.com",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	var fallbacks []FallbackInfo
+	gateway.SetFallbackHandler(func(f FallbackInfo) {
+		fallbacks = append(fallbacks, f)
+	})
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	if r := gateway.Process(e); r.Code() != 250 {
+		t.Error("expecting the fallback to save the message, got", r.String())
+	}
+	if len(fallbacks) != 1 || fallbacks[0].Error != "connection refused" {
+		t.Errorf("unexpected fallbacks %+v", fallbacks)
+	}
+	envelopes := MemoryStore.Envelopes()
+	if len(envelopes) != 1 || strings.Count(envelopes[0].DeliveryHeader, "Received:") != 1 {
+		t.Fatal("expecting the message to be saved once with one Received header, got", envelopes)
+	}
+	// save_process works again
+	atomic.StoreInt32(&down, 0)
+	e = mail.NewEnvelope("127.0.0.1", 2)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	if r := gateway.Process(e); r.Code() != 250 || len(fallbacks) != 1 || len(MemoryStore.Envelopes()) != 1 {
+		t.Error("expecting the message to be saved by save_process, got", r.String())
+	}
+}
+
+func TestProcessBreakerFallback(t *testing.T) {
+	var down, calls int32 = 1, 0
+	Svc.AddProcessor("Flaky", flaky(&down))
+	Svc.AddProcessor("Counter", func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				atomic.AddInt32(&calls, 1)
+				return p.Process(e, task)
+			})
+		}
+	})
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":          "Counter|Flaky",
+		"save_process_fallback": "Memory",
+		"save_workers_size":     1,
+		"gw_breaker_limit":      2,
+		"gw_breaker_probe":      "30s",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	mock := clock.NewMock(time.Now())
+	gateway.SetClock(mock)
+	var fallbacks []FallbackInfo
+	gateway.SetFallbackHandler(func(f FallbackInfo) {
+		fallbacks = append(fallbacks, f)
+	})
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+	process := func() Result {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+		return gateway.Process(e)
+	}
+
+	// the fallback saves them, the failures of save_process are still counted
+	for i := 0; i < 2; i++ {
+		if r := process(); r.Code() != 250 {
+			t.Error("expecting the fallback to save the message, got", r.String())
+		}
+	}
+	// the circuit is open, save_process is not tried
+	if r := process(); r.Code() != 250 || atomic.LoadInt32(&calls) != 2 {
+		t.Error("expecting the fallback to save the message without save_process, got", r.String(), calls)
+	}
+	if len(fallbacks) != 3 || fallbacks[2].Error != errCircuitOpen.Error() {
+		t.Errorf("unexpected fallbacks %+v", fallbacks)
+	}
+	mock.Add(time.Second * 30)
+	atomic.StoreInt32(&down, 0)
+	// the probe succeeds and closes the circuit
+	for i := 0; i < 2; i++ {
+		if r := process(); r.Code() != 250 {
+			t.Error("expecting the message to be saved by save_process, got", r.String())
+		}
+	}
+	if atomic.LoadInt32(&calls) != 4 || len(MemoryStore.Envelopes()) != 3 {
+		t.Error("expecting save_process to be used again, got", calls, len(MemoryStore.Envelopes()))
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := ValidateConfig(BackendConfig{
+		"save_process":       "HeadersParser|Header|Debugger",
+		"log_received_mails": true,
+		"primary_mail_host":  "example.com",
+		"gw_save_timeout":    "30s",
+	}); err != nil {
+		t.Error("expecting config to be valid, got", err)
+	}
+
+	err := ValidateConfig(BackendConfig{
+		"save_process":       "HeadersParser|Nope|Header",
+		"validate_process":   "Redis",
+		"log_received_mails": true,
+		"gw_save_timeout":    "thirty",
+	})
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatal("expecting Errors, got", err)
+	}
+	// unknown processor, bad timeout, missing primary_mail_host and redis options
+	if len(errs) != 4 {
+		t.Error("expecting 4 errors, got", len(errs), errs)
+	}
+	for _, expect := range []string{"processor [nope] not found", "gw_save_timeout", "processor [header]", "processor [redis]"} {
+		if !strings.Contains(errs.Error(), expect) {
+			t.Error("expecting error to contain", expect, "got:", errs.Error())
+		}
+	}
+	// the stacks of save_routes are checked too
+	err = ValidateConfig(BackendConfig{
+		"save_process": "Debugger",
+		"save_routes":  map[string]interface{}{"archive": "HeadersParser|Archive", "empty": " "},
+	})
+	if err == nil || !strings.Contains(err.Error(), "route [empty] has no processors") {
+		t.Error("expecting the empty route to be invalid, got", err)
+	}
+	err = ValidateConfig(BackendConfig{
+		"save_process": "Debugger",
+		"save_routes":  map[string]interface{}{"archive": "HeadersParser|Archive"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "processor [archive] not found") {
+		t.Error("expecting the processors of the routes to be checked, got", err)
+	}
+	err = ValidateConfig(BackendConfig{
+		"save_process":        "Debugger",
+		"gw_breaker_fallback": "spool",
+		"gw_breaker_probe":    "soon",
+	})
+	if err == nil || !strings.Contains(err.Error(), "route [spool] is not in save_routes") ||
+		!strings.Contains(err.Error(), "gw_breaker_probe") {
+		t.Error("expecting the breaker options to be checked, got", err)
+	}
+	// the config types check their options
+	err = ValidateConfig(BackendConfig{
+		"save_process":      "Hasher|SQL",
+		"mail_table":        "messages",
+		"sql_driver":        "mysql",
+		"sql_dsn":           "test",
+		"primary_mail_host": "example.com",
+		"sql_columns":       "id=hashes",
+	})
+	if err == nil || !strings.Contains(err.Error(), "processor [sql]: sql_columns: column [id] has an unknown field [hashes]") {
+		t.Error("expecting the sql columns to be checked, got", err)
+	}
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	r := &fakeRedis{}
+	r.do = func(addr string, s RedisDialSettings, cmd string, args []interface{}) (interface{}, error) {
+		return "PONG", nil
+	}
+	defer r.install()()
+	cfg := BackendConfig{
+		"save_process":         "Hasher|Redis|SQL",
+		"mail_table":           "messages",
+		"sql_driver":           "fakesql",
+		"sql_dsn":              "test",
+		"primary_mail_host":    "example.com",
+		"redis_interface":      "127.0.0.1:6379",
+		"redis_expire_seconds": 60,
+	}
+	if err := CheckConnectivity(cfg); err != nil {
+		t.Error("expecting the processors to connect, got", err)
+	}
+	if r.dials["127.0.0.1:6379"] != 1 {
+		t.Error("expecting redis to be dialled once, got", r.dials)
+	}
+	cfg["redis_interface"] = "127.0.0.1:1"
+	cfg["sql_driver"] = "nosuchdriver"
+	err := CheckConnectivity(cfg)
+	if errs, ok := err.(Errors); !ok || len(errs) != 2 {
+		t.Fatal("expecting the sql and redis errors, got", err)
+	}
+	for _, expect := range []string{"processor [redis]: connection refused", "processor [sql]"} {
+		if !strings.Contains(err.Error(), expect) {
+			t.Error("expecting error to contain", expect, "got:", err)
+		}
+	}
+}
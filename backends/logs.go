@@ -0,0 +1,82 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/sirupsen/logrus"
+)
+
+// processorLogs holds the levels of gw_log_levels, and the loggers made at those levels
+type processorLogs struct {
+	sync.Mutex
+	// levels maps the lower-case names of the processors to their level
+	levels  map[string]string
+	loggers map[string]levelLogger
+}
+
+// levelLogger is a logger made from the main log at a level, it's made again if the main log changes
+type levelLogger struct {
+	main  log.Logger
+	level string
+	log   log.Logger
+}
+
+// parseLogLevels parses gw_log_levels, eg. "debugger=warn,sql=debug"
+func parseLogLevels(s string) (map[string]string, error) {
+	levels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) != 2 || name == "" {
+			return nil, fmt.Errorf("[%s] is not a processor=level pair", pair)
+		}
+		level := strings.ToLower(strings.TrimSpace(kv[1]))
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return nil, fmt.Errorf("[%s] is not a log level", level)
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+// setLevels replaces the levels of the processors
+func (p *processorLogs) setLevels(levels map[string]string) {
+	p.Lock()
+	defer p.Unlock()
+	p.levels = levels
+}
+
+// ProcessorLog returns the logger of the processor named name: the main log, or a logger writing to the same
+// destination at the level given to the processor by gw_log_levels. The processors should log with it
+// instead of Log(), so that their level can be set on their own
+func ProcessorLog(name string) log.Logger {
+	main := Log()
+	return Svc.logs.get(strings.ToLower(name), main)
+}
+
+func (p *processorLogs) get(name string, main log.Logger) log.Logger {
+	p.Lock()
+	defer p.Unlock()
+	level, ok := p.levels[name]
+	if !ok {
+		return main
+	}
+	if l, ok := p.loggers[name]; ok && l.main == main && l.level == level {
+		return l.log
+	}
+	l, err := log.WithLevel(main, level)
+	if err != nil {
+		return main
+	}
+	if p.loggers == nil {
+		p.loggers = make(map[string]levelLogger)
+	}
+	p.loggers[name] = levelLogger{main: main, level: level, log: l}
+	return l
+}
@@ -0,0 +1,61 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	levels, err := parseLogLevels(" Debugger=warn, sql = DEBUG,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || levels["debugger"] != "warn" || levels["sql"] != "debug" {
+		t.Error("unexpected levels:", levels)
+	}
+	for _, s := range []string{"debugger", "=warn", "debugger=loud"} {
+		if _, err := parseLogLevels(s); err == nil {
+			t.Errorf("[%s] should not parse", s)
+		}
+	}
+}
+
+func TestProcessorLog(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "info")
+	Svc.SetMainlog(mainlog)
+	defer Svc.logs.setLevels(nil)
+	Svc.logs.setLevels(map[string]string{"debugger": "debug"})
+
+	l := ProcessorLog("Debugger")
+	if l.GetLevel() != "debug" {
+		t.Error("the debugger should log at debug, got", l.GetLevel())
+	}
+	if mainlog.GetLevel() != "info" {
+		t.Error("the main log should stay at info, got", mainlog.GetLevel())
+	}
+	if ProcessorLog("debugger") != l {
+		t.Error("the logger of the debugger should be reused")
+	}
+	if ProcessorLog("sql") != mainlog {
+		t.Error("the processors without a level should get the main log")
+	}
+}
+
+func TestMaskAddress(t *testing.T) {
+	for _, test := range []struct {
+		addr mail.Address
+		want string
+	}{
+		{mail.Address{User: "jane.doe", Host: "example.com"}, "j***@example.com"},
+		{mail.Address{User: "élise", Host: "example.com"}, "é***@example.com"},
+		{mail.Address{User: "john smith", Host: "example.com", Quoted: true}, "j***@example.com"},
+		{mail.Address{User: "postmaster"}, "p***"},
+		{mail.Address{NullPath: true}, ""},
+	} {
+		if got := maskAddress(test.addr); got != test.want {
+			t.Errorf("%v: got [%s], want [%s]", test.addr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/metrics"
+	"github.com/flashmob/go-guerrilla/outbound"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: autoreply
+// ----------------------------------------------------------------------------------
+// Description   : Replies to the saved messages for the recipients that have a
+//               : template in autoreply_dir, eg. while they are on vacation. The
+//               : replies are sent from the null sender by the outbound queue. A
+//               : sender gets one reply from a recipient per autoreply_interval.
+//               : There is no reply to the null sender, the mailer daemons, the
+//               : list managers, and the automatic or bulk messages: those with
+//               : Auto-Submitted, Precedence bulk, list or junk, List-Id,
+//               : List-Unsubscribe or X-Auto-Response-Suppress (RFC 3834)
+// ----------------------------------------------------------------------------------
+// Config Options: autoreply_dir string - the directory of the templates, one file
+//               : per recipient, named after its address, eg. alice@example.com.
+//               : A template is the header fields of the reply, eg. Subject, a
+//               : blank line, then the body. {{.From}}, {{.To}} and {{.Subject}}
+//               : are the sender, the recipient and the subject of the message
+//               : autoreply_interval string - between two replies to a sender,
+//               : "168h" (7 days) default
+//               : autoreply_cache_size int - senders remembered, 10000 default
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.Header
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["autoreplies"] set to the ids of the replies in the
+//               : outbound queue
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["autoreply"] = func() Decorator {
+		return AutoReply()
+	}
+	processorConfigs["autoreply"] = func() BaseConfig {
+		return &AutoReplyConfig{}
+	}
+}
+
+type AutoReplyConfig struct {
+	Dir       string `json:"autoreply_dir,omitempty"`
+	Interval  string `json:"autoreply_interval,omitempty"`
+	CacheSize int    `json:"autoreply_cache_size,omitempty"`
+}
+
+// Validate checks the interval and the cache size
+func (c *AutoReplyConfig) Validate() error {
+	if c.Dir == "" {
+		return errors.New("autoreply needs autoreply_dir, the directory of the templates")
+	}
+	if c.Interval != "" {
+		if d, err := time.ParseDuration(c.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("autoreply_interval [%s] is not a valid duration", c.Interval)
+		}
+	}
+	if c.CacheSize < 0 {
+		return fmt.Errorf("autoreply_cache_size [%d] cannot be negative", c.CacheSize)
+	}
+	return nil
+}
+
+// results of the autoreply processor, tagging metrics.AutoReplies
+const (
+	autoReplySent       = "sent"
+	autoReplySuppressed = "suppressed"
+	autoReplyLimited    = "limited"
+	autoReplyFailed     = "failed"
+)
+
+// autoReplySenders are the local parts of the senders that never get a reply, the mailer daemons and
+// the list managers, see RFC 3834 2
+var autoReplySenders = []string{"mailer-daemon", "listserv", "majordomo", "noreply", "no-reply"}
+
+// autoReplyCache remembers when the senders got a reply from each recipient.
+// It's shared by the workers, so that the interval is the interval of the daemon
+type autoReplyCache struct {
+	sync.Mutex
+	replied  map[string]time.Time
+	clock    clock.Clock
+	interval time.Duration
+	size     int
+}
+
+var autoReplies = &autoReplyCache{clock: clock.Real}
+
+// configure applies the config, the senders replied to are kept
+func (c *autoReplyCache) configure(config *AutoReplyConfig) {
+	c.Lock()
+	defer c.Unlock()
+	c.interval = time.Hour * 24 * 7
+	if d, err := time.ParseDuration(config.Interval); err == nil {
+		c.interval = d
+	}
+	c.size = config.CacheSize
+	if c.size == 0 {
+		c.size = 10000
+	}
+}
+
+// reset forgets the senders replied to
+func (c *autoReplyCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.replied = nil
+}
+
+// allow returns false if the sender got a reply from the recipient within the interval, or records the reply
+func (c *autoReplyCache) allow(rcpt, sender string) bool {
+	c.Lock()
+	defer c.Unlock()
+	now := c.clock.Now()
+	key := rcpt + " " + sender
+	if last, ok := c.replied[key]; ok && now.Sub(last) < c.interval {
+		return false
+	}
+	if c.replied == nil {
+		c.replied = make(map[string]time.Time)
+	}
+	if len(c.replied) >= c.size {
+		for k, last := range c.replied {
+			if now.Sub(last) >= c.interval {
+				delete(c.replied, k)
+			}
+		}
+		// still full, forget any of them
+		for k := range c.replied {
+			if len(c.replied) < c.size {
+				break
+			}
+			delete(c.replied, k)
+		}
+	}
+	c.replied[key] = now
+	return true
+}
+
+// forget drops the reply recorded by allow, it could not be sent
+func (c *autoReplyCache) forget(rcpt, sender string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.replied, rcpt+" "+sender)
+}
+
+func (c *autoReplyCache) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.clock.Now()
+}
+
+// loadAutoReplyTemplates parses the templates of dir, keyed by the address of their recipient
+func loadAutoReplyTemplates(dir string) (map[string]*template.Template, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	templates := make(map[string]*template.Template)
+	for _, f := range files {
+		if f.IsDir() || !strings.Contains(f.Name(), "@") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(f.Name()).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("autoreply template [%s]: %s", f.Name(), err)
+		}
+		templates[strings.ToLower(f.Name())] = t
+	}
+	return templates, nil
+}
+
+// autoReplySuppression returns why the message must not get an automatic reply, "" if it can, see RFC 3834 2
+func autoReplySuppression(e *mail.Envelope) string {
+	if e.MailFrom.NullPath || e.MailFrom.IsEmpty() {
+		return "null sender"
+	}
+	user := strings.ToLower(e.MailFrom.User)
+	if strings.HasPrefix(user, "owner-") || strings.HasSuffix(user, "-request") {
+		return "list manager"
+	}
+	for _, u := range autoReplySenders {
+		if user == u {
+			return "automatic sender"
+		}
+	}
+	h := e.Header
+	auto := strings.TrimSpace(strings.SplitN(h.Get("Auto-Submitted"), ";", 2)[0])
+	if auto != "" && !strings.EqualFold(auto, "no") {
+		return "Auto-Submitted: " + auto
+	}
+	switch precedence := strings.ToLower(strings.TrimSpace(h.Get("Precedence"))); precedence {
+	case "bulk", "list", "junk":
+		return "Precedence: " + precedence
+	}
+	if h.Get("List-Id") != "" || h.Get("List-Unsubscribe") != "" {
+		return "list message"
+	}
+	if s := strings.ToLower(h.Get("X-Auto-Response-Suppress")); strings.Contains(s, "all") || strings.Contains(s, "oof") {
+		return "X-Auto-Response-Suppress"
+	}
+	return ""
+}
+
+// autoReplyData is passed to the templates
+type autoReplyData struct {
+	// From is the sender of the message, who gets the reply
+	From string
+	// To is the recipient of the message, who replies
+	To string
+	// Subject is the subject of the message
+	Subject string
+}
+
+// newAutoReply returns the reply of the recipient to the message, written by the template. The fields that
+// identify the reply are added to the header of the template, and a Subject if it has none
+func newAutoReply(t *template.Template, e *mail.Envelope, rcpt string, now time.Time) ([]byte, error) {
+	data := autoReplyData{
+		From: e.MailFrom.String(),
+		To:   rcpt,
+		// a subject spanning lines would end the header field
+		Subject: strings.Join(strings.Fields(e.Subject), " "),
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	text := strings.Replace(out.String(), "\r\n", "\n", -1)
+	var header []string
+	if i := strings.Index(text, "\n\n"); i >= 0 && isHeaderField(text[:strings.IndexByte(text, '\n')]) {
+		header, text = strings.Split(text[:i], "\n"), text[i+2:]
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: <%s>\r\n", rcpt)
+	fmt.Fprintf(&b, "To: <%s>\r\n", data.From)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	host := rcpt[strings.LastIndexByte(rcpt, '@')+1:]
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", mail.ULID(0), host)
+	if id := strings.TrimSpace(e.Header.Get("Message-Id")); id != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", id)
+		fmt.Fprintf(&b, "References: %s\r\n", id)
+	}
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	subject, contentType := false, false
+	for _, line := range header {
+		name := strings.ToLower(strings.TrimSpace(line[:strings.IndexByte(line+":", ':')]))
+		switch name {
+		case "subject":
+			subject = true
+			line = "Subject: " + mime.QEncoding.Encode("utf-8", strings.TrimSpace(line[len("subject:"):]))
+		case "content-type":
+			contentType = true
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	if !subject {
+		fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Auto: "+data.Subject))
+	}
+	if !contentType {
+		b.WriteString("MIME-Version: 1.0\r\n")
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	}
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(text, "\n", "\r\n", -1))
+	return b.Bytes(), nil
+}
+
+// isHeaderField returns true if the line starts a header field, eg. "Subject: hello"
+func isHeaderField(line string) bool {
+	i := strings.IndexByte(line, ':')
+	return i > 0 && !strings.ContainsAny(line[:i], " \t")
+}
+
+// autoReply queues the replies of the recipients that have a template, and were saved, to the sender
+func autoReply(templates map[string]*template.Template, e *mail.Envelope, results []Result) {
+	var ids []string
+	suppression := "-"
+	for i := range e.RcptTo {
+		rcpt := e.RcptTo[i].String()
+		t, ok := templates[strings.ToLower(rcpt)]
+		if !ok || results[i].Code() >= 300 {
+			continue
+		}
+		if suppression == "-" {
+			suppression = autoReplySuppression(e)
+		}
+		if suppression != "" {
+			ProcessorLog("autoreply").WithQueuedID(e.ClientID, e.QueuedId).WithField("rcpt", rcpt).
+				Debug("no reply: ", suppression)
+			metrics.Incr(metrics.AutoReplies, "result:"+autoReplySuppressed)
+			continue
+		}
+		sender := strings.ToLower(e.MailFrom.String())
+		if !autoReplies.allow(strings.ToLower(rcpt), sender) {
+			metrics.Incr(metrics.AutoReplies, "result:"+autoReplyLimited)
+			continue
+		}
+		id, err := sendAutoReply(t, e, rcpt)
+		if err != nil {
+			autoReplies.forget(strings.ToLower(rcpt), sender)
+			ProcessorLog("autoreply").WithQueuedID(e.ClientID, e.QueuedId).WithField("rcpt", rcpt).WithError(err).
+				Error("autoreply: could not queue the reply")
+			metrics.Incr(metrics.AutoReplies, "result:"+autoReplyFailed)
+			continue
+		}
+		ids = append(ids, id)
+		metrics.Incr(metrics.AutoReplies, "result:"+autoReplySent)
+	}
+	if ids != nil {
+		e.Values["autoreplies"] = ids
+	}
+}
+
+// sendAutoReply queues the reply of the recipient to outbound.Default, from the null sender, RFC 3834 3.3
+func sendAutoReply(t *template.Template, e *mail.Envelope, rcpt string) (string, error) {
+	q := outbound.Default()
+	if q == nil {
+		return "", outbound.ErrDisabled
+	}
+	msg, err := newAutoReply(t, e, rcpt, autoReplies.now())
+	if err != nil {
+		return "", err
+	}
+	return q.Send("", []string{e.MailFrom.String()}, msg)
+}
+
+// AutoReply replies to the messages for the recipients that have a template, once they are saved
+func AutoReply() Decorator {
+	var templates map[string]*template.Template
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&AutoReplyConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*AutoReplyConfig)
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		if templates, err = loadAutoReplyTemplates(config.Dir); err != nil {
+			return err
+		}
+		autoReplies.configure(config)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			result, err := p.Process(e, task)
+			if task != TaskSaveMail || err != nil || result == nil || result.Code() >= 300 {
+				return result, err
+			}
+			if e.Header == nil {
+				_ = e.ParseHeaders()
+			}
+			autoReply(templates, e, RcptResultsOf(result, len(e.RcptTo)))
+			return result, err
+		})
+	}
+}
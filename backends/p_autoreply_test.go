@@ -0,0 +1,124 @@
+package backends
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/outbound"
+)
+
+func TestAutoReply(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	dir, err := ioutil.TempDir("", "autoreply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	templates, queueDir := filepath.Join(dir, "templates"), filepath.Join(dir, "queue")
+	if err := os.Mkdir(templates, 0700); err != nil {
+		t.Fatal(err)
+	}
+	template := "Subject: Out of office: {{.Subject}}\n\nHi {{.From}}, {{.To}} is away.\n"
+	if err := ioutil.WriteFile(filepath.Join(templates, "alice@example.com"), []byte(template), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	autoReplies.clock = mock
+	defer func() {
+		autoReplies.clock = clock.Real
+		autoReplies.reset()
+	}()
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":       "HeadersParser|AutoReply",
+		"save_workers_size":  1,
+		"autoreply_dir":      templates,
+		"autoreply_interval": "24h",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	q := outbound.New(outbound.Config{QueueDir: queueDir, RetryMin: "1h"}, mainlog)
+	defer q.Close()
+	outbound.Set(q)
+	defer outbound.Set(nil)
+
+	send := func(from, header string, rcpts ...string) *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "q1"
+		if from == "" {
+			e.MailFrom = mail.Address{NullPath: true}
+		} else {
+			// the delivery to an address literal fails without looking up the DNS, the replies stay queued
+			e.MailFrom = mail.Address{User: from, Host: "127.0.0.1", IP: net.ParseIP("127.0.0.1")}
+		}
+		for _, rcpt := range rcpts {
+			a, _ := mail.NewAddress(rcpt)
+			e.PushRcpt(*a)
+		}
+		e.Data.WriteString(header + "Subject: hello\nMessage-ID: <1@example.org>\n\nHello\n")
+		if res := gateway.Process(e); res.Code() != 250 {
+			t.Fatal("expecting the message to be saved, got", res.String())
+		}
+		return e
+	}
+
+	e := send("bob", "", "alice@example.com", "carol@example.com")
+	ids, _ := e.Values["autoreplies"].([]string)
+	if len(ids) != 1 || q.Len() != 1 {
+		t.Fatal("expecting a reply of alice only, got", ids, q.Len())
+	}
+	b, err := ioutil.ReadFile(filepath.Join(queueDir, ids[0]+".eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"From: <alice@example.com>\r\n", "To: <bob@[127.0.0.1]>\r\n",
+		"Subject: Out of office: hello\r\n", "In-Reply-To: <1@example.org>\r\n", "Auto-Submitted: auto-replied\r\n",
+		"\r\n\r\nHi bob@[127.0.0.1], alice@example.com is away.\r\n"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("the reply should have %q: %s", want, b)
+		}
+	}
+	if item, err := ioutil.ReadFile(filepath.Join(queueDir, ids[0]+".json")); err != nil ||
+		!strings.Contains(string(item), `"from":""`) {
+		t.Error("the reply should be from the null sender", string(item), err)
+	}
+
+	// bob got a reply today
+	if e := send("bob", "", "alice@example.com"); e.Values["autoreplies"] != nil || q.Len() != 1 {
+		t.Error("expecting one reply per interval, got", e.Values["autoreplies"])
+	}
+	for _, m := range []struct{ from, header string }{
+		{"", ""},
+		{"mailer-daemon", ""},
+		{"owner-list", ""},
+		{"dave", "Auto-Submitted: auto-generated\n"},
+		{"dave", "Precedence: bulk\n"},
+		{"dave", "List-Id: <list.example.org>\n"},
+		{"dave", "X-Auto-Response-Suppress: OOF, AutoReply\n"},
+	} {
+		if e := send(m.from, m.header, "alice@example.com"); e.Values["autoreplies"] != nil {
+			t.Errorf("expecting no reply to %q %q", m.from, m.header)
+		}
+	}
+	if e := send("dave", "Auto-Submitted: no\n", "alice@example.com"); e.Values["autoreplies"] == nil {
+		t.Error("expecting a reply to a message that was not automatic")
+	}
+	mock.Add(25 * time.Hour)
+	if e := send("bob", "", "alice@example.com"); e.Values["autoreplies"] == nil || q.Len() != 3 {
+		t.Error("expecting a reply after the interval, got", e.Values["autoreplies"], q.Len())
+	}
+}
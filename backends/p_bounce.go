@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"github.com/flashmob/go-guerrilla/bounce"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: bounceparser
+// ----------------------------------------------------------------------------------
+// Description   : Reads the bounces (delivery status notifications) and complaints
+//               : (ARF feedback reports) about messages sent earlier, and the
+//               : recipients encoded in VERP return paths. The daemon publishes
+//               : the bounces of the saved messages as EventMessageBounce, and
+//               : sends them to the webhooks as "message.bounce"
+// ----------------------------------------------------------------------------------
+// Config Options: bounce_verp_prefix string - local part that the VERP addresses
+//               : start with, eg. "bounces" for bounces+alice=example.com@...
+//               : bounce_verp_delimiter string - after the prefix, "+" if empty
+// --------------:-------------------------------------------------------------------
+// Input         : e.RcptTo
+//               : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["bounces"] set to a []bounce.Bounce, if the message is a
+//               : report or was sent to a VERP address. The recipient of a VERP
+//               : address fills in a missing recipient of a report, and is a
+//               : bounce.Unknown when the message is not a report
+//               : e.Values["bounce_verp_recipient"] the recipient of a VERP address
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["bounceparser"] = func() Decorator {
+		return BounceParser()
+	}
+	processorConfigs["bounceparser"] = func() BaseConfig {
+		return &BounceConfig{}
+	}
+}
+
+type BounceConfig struct {
+	VERPPrefix    string `json:"bounce_verp_prefix,omitempty"`
+	VERPDelimiter string `json:"bounce_verp_delimiter,omitempty"`
+}
+
+// BounceParser classifies the bounces and complaints when saving
+func BounceParser() Decorator {
+
+	var verp bounce.VERP
+
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&BounceConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*BounceConfig)
+		verp = bounce.VERP{Prefix: config.VERPPrefix, Delimiter: config.VERPDelimiter}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			var rcpt string
+			for i := range e.RcptTo {
+				if r, ok := verp.Decode(e.RcptTo[i].User); ok {
+					rcpt = r
+					e.Values["bounce_verp_recipient"] = r
+					break
+				}
+			}
+			list, err := bounce.Parse(e.NewReader())
+			if err != nil && err != bounce.ErrNotReport {
+				ProcessorLog("bounceparser").WithQueuedID(e.ClientID, e.QueuedId).WithError(err).Debug("could not read the report")
+			}
+			if len(list) == 0 && rcpt != "" {
+				list = []bounce.Bounce{{Kind: bounce.Unknown, Recipient: rcpt}}
+			}
+			for i := range list {
+				if list[i].Recipient == "" {
+					list[i].Recipient = rcpt
+				}
+			}
+			if len(list) > 0 {
+				e.Values["bounces"] = list
+			}
+			return p.Process(e, task)
+		})
+	}
+}
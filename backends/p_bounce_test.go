@@ -0,0 +1,78 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/bounce"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestBounceParser(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":       "BounceParser|Memory",
+		"save_workers_size":  1,
+		"bounce_verp_prefix": "bounces",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+
+	messages := []struct {
+		to   string
+		data string
+	}{
+		// a DSN to a VERP address, without a Final-Recipient
+		{"bounces+alice=example.org", "Content-Type: multipart/report; report-type=delivery-status; boundary=b\n\n" +
+			"--b\nContent-Type: message/delivery-status\n\n" +
+			"Reporting-MTA: dns; mx.example.org\n\n" +
+			"Action: failed\nStatus: 5.1.1\n\n" +
+			"--b\nContent-Type: text/rfc822-headers\n\nMessage-ID: <1@example.com>\n\n" +
+			"--b--\n"},
+		// a bounce in plain text to a VERP address
+		{"bounces+bob=example.org", "Subject: failure notice\n\nSorry, I couldn't deliver your message.\n"},
+		// not a bounce
+		{"test", "Subject: test\n\nThis is a test.\n"},
+	}
+	for _, m := range messages {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.PushRcpt(mail.Address{User: m.to, Host: "example.com"})
+		e.Data.WriteString(m.data)
+		if r := gateway.Process(e); r.Code() != 250 {
+			t.Fatal("expecting the envelope to be saved, got", r.String())
+		}
+	}
+	envelopes := MemoryStore.Envelopes()
+	if len(envelopes) != 3 {
+		t.Fatal("expecting 3 envelopes, got", len(envelopes))
+	}
+	expected := bounce.Bounce{
+		Kind:              bounce.Hard,
+		Recipient:         "alice@example.org",
+		Status:            "5.1.1",
+		Action:            "failed",
+		ReportingMTA:      "mx.example.org",
+		OriginalMessageID: "<1@example.com>",
+	}
+	if list, ok := envelopes[0].Values["bounces"].([]bounce.Bounce); !ok || len(list) != 1 || list[0] != expected {
+		t.Error("expecting", expected, "got", envelopes[0].Values["bounces"])
+	}
+	expected = bounce.Bounce{Kind: bounce.Unknown, Recipient: "bob@example.org"}
+	if list, ok := envelopes[1].Values["bounces"].([]bounce.Bounce); !ok || len(list) != 1 || list[0] != expected {
+		t.Error("expecting", expected, "got", envelopes[1].Values["bounces"])
+	}
+	if envelopes[1].Values["bounce_verp_recipient"] != "bob@example.org" {
+		t.Error("expecting the VERP recipient, got", envelopes[1].Values["bounce_verp_recipient"])
+	}
+	if _, ok := envelopes[2].Values["bounces"]; ok {
+		t.Error("expecting no bounces for a message that is not a bounce, got", envelopes[2].Values["bounces"])
+	}
+}
@@ -0,0 +1,380 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/dnscache"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/metrics"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: callout
+// ----------------------------------------------------------------------------------
+// Description   : Verifies the address of MAIL FROM by connecting to the MX of its
+//               : domain and asking RCPT TO for it, without sending a message.
+//               : Only the senders of callout_domains are verified. The results are
+//               : cached, and the callouts to each domain are rate limited
+// ----------------------------------------------------------------------------------
+// Config Options: callout_domains string - comma separated sender domains to verify,
+//               : "*" for all of them
+//               : callout_helo string - the EHLO name, primary_mail_host if empty
+//               : callout_from string - the MAIL FROM of the callouts, <> if empty
+//               : callout_timeout string - of a callout, eg. "30s" (default)
+//               : callout_cache_ttl string - of the verified senders, "24h" default
+//               : callout_negative_ttl string - of the rejected senders, "1h" default
+//               : callout_error_ttl string - of the callouts that failed, "5m" default
+//               : callout_cache_size int - addresses cached, 10000 default
+//               : callout_rate_limit int - callouts per domain per minute, 10 default
+//               : callout_defer bool - reply 451 when saving if the callout failed,
+//               : instead of accepting the message
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["callout"] set to one of "pass", "fail", "temperror"
+//               : or "none" (null sender or a domain not verified)
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["callout"] = func() Decorator {
+		return Callout()
+	}
+	processorConfigs["callout"] = func() BaseConfig {
+		return &CalloutConfig{}
+	}
+}
+
+type CalloutConfig struct {
+	Domains     string `json:"callout_domains,omitempty"`
+	Helo        string `json:"callout_helo,omitempty"`
+	From        string `json:"callout_from,omitempty"`
+	Timeout     string `json:"callout_timeout,omitempty"`
+	CacheTTL    string `json:"callout_cache_ttl,omitempty"`
+	NegativeTTL string `json:"callout_negative_ttl,omitempty"`
+	ErrorTTL    string `json:"callout_error_ttl,omitempty"`
+	CacheSize   int    `json:"callout_cache_size,omitempty"`
+	RateLimit   int    `json:"callout_rate_limit,omitempty"`
+	Defer       bool   `json:"callout_defer,omitempty"`
+	PrimaryHost string `json:"primary_mail_host,omitempty"`
+}
+
+// Validate checks the durations and the limits
+func (c *CalloutConfig) Validate() error {
+	if strings.TrimSpace(c.Domains) == "" {
+		return errors.New("callout needs callout_domains, \"*\" to verify all the senders")
+	}
+	for _, d := range []struct{ key, value string }{
+		{"callout_timeout", c.Timeout},
+		{"callout_cache_ttl", c.CacheTTL},
+		{"callout_negative_ttl", c.NegativeTTL},
+		{"callout_error_ttl", c.ErrorTTL},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d.value); err != nil {
+			return fmt.Errorf("%s: %s", d.key, err)
+		}
+	}
+	if c.CacheSize < 0 {
+		return fmt.Errorf("callout_cache_size [%d] cannot be negative", c.CacheSize)
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("callout_rate_limit [%d] cannot be negative", c.RateLimit)
+	}
+	return nil
+}
+
+// calloutDuration returns the duration of s, or def if s is empty. s has been validated
+func calloutDuration(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d
+	}
+	return def
+}
+
+// verifies returns true if the senders of domain are verified
+func (c *CalloutConfig) verifies(domain string) bool {
+	for _, d := range strings.Split(c.Domains, ",") {
+		d = strings.TrimSpace(d)
+		if d == "*" || strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CalloutConfig) helo() string {
+	if c.Helo != "" {
+		return c.Helo
+	}
+	if c.PrimaryHost != "" {
+		return c.PrimaryHost
+	}
+	return "localhost"
+}
+
+// results of the callout
+const (
+	CalloutPass      = "pass"
+	CalloutFail      = "fail"
+	CalloutTempError = "temperror"
+	CalloutNone      = "none"
+)
+
+// calloutDial connects to the MX, replaced by the tests
+var calloutDial = func(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// calloutCache keeps the results of the callouts, and counts the callouts to each domain.
+// It's shared by the workers, so that the rate limit is the limit of the daemon
+type calloutCache struct {
+	sync.Mutex
+	results map[string]calloutResult
+	// rates counts the callouts to each domain in the current minute
+	rates       map[string]int
+	rateStart   time.Time
+	clock       clock.Clock
+	ttl         time.Duration
+	negativeTTL time.Duration
+	errorTTL    time.Duration
+	size        int
+	rateLimit   int
+}
+
+type calloutResult struct {
+	result  string
+	expires time.Time
+}
+
+var calloutResults = &calloutCache{clock: clock.Real}
+
+// configure applies the config, the cached results are kept
+func (c *calloutCache) configure(config *CalloutConfig) {
+	c.Lock()
+	defer c.Unlock()
+	c.ttl = calloutDuration(config.CacheTTL, time.Hour*24)
+	c.negativeTTL = calloutDuration(config.NegativeTTL, time.Hour)
+	c.errorTTL = calloutDuration(config.ErrorTTL, time.Minute*5)
+	c.size = config.CacheSize
+	if c.size == 0 {
+		c.size = 10000
+	}
+	c.rateLimit = config.RateLimit
+	if c.rateLimit == 0 {
+		c.rateLimit = 10
+	}
+}
+
+// reset drops the results and the counts
+func (c *calloutCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.results = nil
+	c.rates = nil
+}
+
+// get returns the cached result of the address
+func (c *calloutCache) get(address string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	r, ok := c.results[address]
+	if !ok || !c.clock.Now().Before(r.expires) {
+		return "", false
+	}
+	return r.result, true
+}
+
+// set caches the result of the address, with the ttl of the result
+func (c *calloutCache) set(address, result string) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.clock.Now()
+	ttl := c.errorTTL
+	switch result {
+	case CalloutPass:
+		ttl = c.ttl
+	case CalloutFail:
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	if c.results == nil {
+		c.results = make(map[string]calloutResult)
+	}
+	if len(c.results) >= c.size {
+		for a, r := range c.results {
+			if !now.Before(r.expires) {
+				delete(c.results, a)
+			}
+		}
+		// still full, drop any of them
+		for a := range c.results {
+			if len(c.results) < c.size {
+				break
+			}
+			delete(c.results, a)
+		}
+	}
+	c.results[address] = calloutResult{result: result, expires: now.Add(ttl)}
+}
+
+// allow counts a callout to the domain, it returns false if the domain had rateLimit callouts this minute
+func (c *calloutCache) allow(domain string) bool {
+	c.Lock()
+	defer c.Unlock()
+	now := c.clock.Now()
+	if c.rates == nil || now.Sub(c.rateStart) >= time.Minute {
+		c.rates = make(map[string]int)
+		c.rateStart = now
+	}
+	if c.rates[domain] >= c.rateLimit {
+		return false
+	}
+	c.rates[domain]++
+	return true
+}
+
+// callout asks the MX of the sender's domain if it accepts mail for the sender
+func callout(ctx context.Context, r mxResolver, config *CalloutConfig, from *mail.Address) string {
+	domain := from.HostASCII()
+	hosts := []string{domain}
+	mxs, err := r.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			// a null MX, the domain does not accept mail
+			return CalloutFail
+		}
+		hosts = hosts[:0]
+		for _, mx := range mxs {
+			hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+		}
+	} else if err != nil && !dnscache.IsNotFound(err) {
+		return CalloutTempError
+	}
+	// the second MX is tried when the first cannot be reached, not more, the callout must stay cheap
+	if len(hosts) > 2 {
+		hosts = hosts[:2]
+	}
+	address := from.User + "@" + domain
+	for _, host := range hosts {
+		result, err := calloutHost(ctx, config, host, address)
+		if err == nil {
+			return result
+		}
+		ProcessorLog("callout").WithError(err).WithField("mx", host).Debug("callout failed")
+	}
+	return CalloutTempError
+}
+
+// calloutHost asks host about address. An error is returned if the host could not be reached
+func calloutHost(ctx context.Context, config *CalloutConfig, host, address string) (string, error) {
+	conn, err := calloutDial(ctx, net.JoinHostPort(host, "25"))
+	if err != nil {
+		return "", err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return "", err
+	}
+	defer func() { _ = c.Close() }()
+	if err = c.Hello(config.helo()); err != nil {
+		return "", err
+	}
+	if err = c.Mail(config.From); err != nil {
+		// the MX does not like us, that says nothing about the sender
+		return CalloutTempError, nil
+	}
+	err = c.Rcpt(address)
+	_ = c.Quit()
+	if err == nil {
+		return CalloutPass, nil
+	}
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+		return CalloutFail, nil
+	}
+	return CalloutTempError, nil
+}
+
+// Callout verifies the sender once per transaction, when validating the first recipient or when saving
+func Callout() Decorator {
+	var config *CalloutConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&CalloutConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*CalloutConfig)
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		calloutResults.configure(config)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail && task != TaskValidateRcpt {
+				return p.Process(e, task)
+			}
+			result, ok := e.Values["callout"].(string)
+			if !ok {
+				result = verifySender(config, &e.MailFrom)
+				e.Values["callout"] = result
+				if result != CalloutNone {
+					metrics.Incr(metrics.Callouts, "result:"+result)
+				}
+				if result == CalloutFail || result == CalloutTempError {
+					ProcessorLog("callout").WithQueuedID(e.ClientID, e.QueuedId).WithField("from", e.MailFrom.String()).
+						Info("callout to the sender's domain: ", result)
+				}
+			}
+			switch result {
+			case CalloutFail:
+				return NewResult(response.Canned.FailSenderUnverified), SenderUnverified
+			case CalloutTempError:
+				if config.Defer && task == TaskSaveMail {
+					return NewResult(response.Canned.ErrorSenderUnverified), nil
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// verifySender returns the cached result of the sender, or calls out if the domain allows another callout
+func verifySender(config *CalloutConfig, from *mail.Address) string {
+	if from.IsEmpty() || from.NullPath || from.IP != nil || !config.verifies(from.HostASCII()) {
+		return CalloutNone
+	}
+	address := strings.ToLower(from.User + "@" + from.HostASCII())
+	if result, ok := calloutResults.get(address); ok {
+		return result
+	}
+	if !calloutResults.allow(strings.ToLower(from.HostASCII())) {
+		// not cached, the next transaction may be luckier
+		return CalloutTempError
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), calloutDuration(config.Timeout, time.Second*30))
+	defer cancel()
+	result := callout(ctx, mxCheckResolver(), config, from)
+	calloutResults.set(address, result)
+	return result
+}
@@ -0,0 +1,194 @@
+package backends
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// fakeMX is an MX that accepts RCPT TO for good@, rejects bad@ and defers the others
+type fakeMX struct {
+	sync.Mutex
+	ln    net.Listener
+	rcpts []string
+}
+
+func newFakeMX(t *testing.T) *fakeMX {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mx := &fakeMX{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go mx.serve(conn)
+		}
+	}()
+	return mx
+}
+
+func (mx *fakeMX) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	w := bufio.NewWriter(conn)
+	reply := func(s string) {
+		_, _ = w.WriteString(s + "\r\n")
+		_ = w.Flush()
+	}
+	reply("220 mx.example.com ESMTP")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250 mx.example.com")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			mx.Lock()
+			mx.rcpts = append(mx.rcpts, strings.TrimSpace(line[8:]))
+			mx.Unlock()
+			if strings.Contains(cmd, "<GOOD@") {
+				reply("250 OK")
+			} else if strings.Contains(cmd, "<BAD@") {
+				reply("550 5.1.1 No such user")
+			} else {
+				reply("451 4.3.0 Try again later")
+			}
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func (mx *fakeMX) install() func() {
+	saved := calloutDial
+	calloutDial = func(ctx context.Context, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(addr, "mx.example.com:") {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: addr}}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", mx.ln.Addr().String())
+	}
+	return func() {
+		calloutDial = saved
+		_ = mx.ln.Close()
+	}
+}
+
+func (mx *fakeMX) calls() []string {
+	mx.Lock()
+	defer mx.Unlock()
+	return append([]string(nil), mx.rcpts...)
+}
+
+func TestCallout(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	defer newFakeMXResolver().install()()
+	mx := newFakeMX(t)
+	defer mx.install()()
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	calloutResults.reset()
+	calloutResults.clock = mock
+	defer func() {
+		calloutResults.reset()
+		calloutResults.clock = clock.Real
+	}()
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":       "Callout|Memory",
+		"validate_process":   "Callout",
+		"save_workers_size":  1,
+		"callout_domains":    "example.com",
+		"callout_rate_limit": 3,
+		"callout_defer":      true,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+
+	for _, test := range []struct {
+		from mail.Address
+		err  error
+		code int
+	}{
+		{mail.Address{User: "good", Host: "example.com"}, nil, 250},
+		{mail.Address{User: "bad", Host: "example.com"}, SenderUnverified, 550},
+		{mail.Address{User: "busy", Host: "example.com"}, nil, 451},
+		// cached
+		{mail.Address{User: "Good", Host: "example.com"}, nil, 250},
+		// over the rate limit
+		{mail.Address{User: "other", Host: "example.com"}, nil, 451},
+		// not verified
+		{mail.Address{User: "bad", Host: "example.org"}, nil, 250},
+		{mail.Address{NullPath: true}, nil, 250},
+	} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = test.from
+		e.PushRcpt(mail.Address{User: "test", Host: "grr.la"})
+		e.Data.WriteString("Subject: test\n\nThis is a test.\n")
+		if err := gateway.ValidateRcpt(e); err != test.err {
+			t.Errorf("%s: expecting the rcpt error %v, got %v", test.from.String(), test.err, err)
+		}
+		if res := gateway.Process(e); res.Code() != test.code {
+			t.Errorf("%s: expecting %d, got %s", test.from.String(), test.code, res.String())
+		}
+	}
+	if calls := mx.calls(); strings.Join(calls, " ") != "<good@example.com> <bad@example.com> <busy@example.com>" {
+		t.Error("expecting a callout for each new sender, got", calls)
+	}
+
+	// a minute later, the domain can be called again, and the temporary error has expired
+	mock.Add(time.Minute * 6)
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "busy", Host: "example.com"}
+	e.PushRcpt(mail.Address{User: "test", Host: "grr.la"})
+	_ = gateway.ValidateRcpt(e)
+	if calls := mx.calls(); len(calls) != 4 {
+		t.Error("expecting the sender to be verified again, got", calls)
+	}
+	if envelopes := MemoryStore.Envelopes(); len(envelopes) != 4 {
+		t.Error("expecting 4 envelopes to be saved, got", len(envelopes))
+	}
+}
+
+func TestCalloutConfig(t *testing.T) {
+	for _, config := range []CalloutConfig{
+		{},
+		{Domains: "*", Timeout: "soon"},
+		{Domains: "*", RateLimit: -1},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("expecting %+v to be invalid", config)
+		}
+	}
+	config := CalloutConfig{Domains: "example.com, Example.org"}
+	if !config.verifies("example.org") || config.verifies("example.net") {
+		t.Error("unexpected domains verified")
+	}
+}
@@ -21,8 +21,8 @@ import (
 //               : to write the compressed data, simply use fmt to print as a string,
 //               : eg. fmt.Println("%s", e.Info["zlib-compressor"])
 //               : or just call the String() func .Info["zlib-compressor"].String()
-//               : Note that it can only be outputted once. It destroys the buffer
-//               : after being printed
+//               : The data is compressed once, when first printed, and e.Data is left
+//               : intact for the other processors
 // ----------------------------------------------------------------------------------
 func init() {
 	processors["compressor"] = func() Decorator {
@@ -34,22 +34,28 @@ func init() {
 type DataCompressor struct {
 	ExtraHeaders []byte
 	Data         *bytes.Buffer
+	// Spooled is the rest of the data if the envelope was spooled to disk, may be nil
+	Spooled io.Reader
 	// the pool is used to recycle buffers to ease up on the garbage collector
 	Pool *sync.Pool
+	// compressed caches the result of String, so that the processors down the line share it
+	compressed string
+	done       bool
+}
+
+// compressorBuffers recycles the buffers of all the compressors
+var compressorBuffers = sync.Pool{
+	// if not available, then create a new one
+	New: func() interface{} {
+		var b bytes.Buffer
+		return &b
+	},
 }
 
 // newCompressedData returns a new CompressedData
 func newCompressor() *DataCompressor {
-	// grab it from the pool
-	var p = sync.Pool{
-		// if not available, then create a new one
-		New: func() interface{} {
-			var b bytes.Buffer
-			return &b
-		},
-	}
 	return &DataCompressor{
-		Pool: &p,
+		Pool: &compressorBuffers,
 	}
 }
 
@@ -60,12 +66,15 @@ func (c *DataCompressor) set(b []byte, d *bytes.Buffer) {
 }
 
 // String implements the Stringer interface.
-// Can only be called once!
-// This is because the compression buffer will be reset and compressor will be returned to the pool
+// The data is compressed on the first call, later calls return the same result.
+// Data is read without being consumed, so the other processors can still read it
 func (c *DataCompressor) String() string {
 	if c.Data == nil {
 		return ""
 	}
+	if c.done {
+		return c.compressed
+	}
 	//borrow a buffer form the pool
 	b := c.Pool.Get().(*bytes.Buffer)
 	// put back in the pool
@@ -78,15 +87,21 @@ func (c *DataCompressor) String() string {
 	w, _ := zlib.NewWriterLevel(b, zlib.BestSpeed)
 	r = bytes.NewReader(c.ExtraHeaders)
 	_, _ = io.Copy(w, r)
-	_, _ = io.Copy(w, c.Data)
+	_, _ = w.Write(c.Data.Bytes())
+	if c.Spooled != nil {
+		_, _ = io.Copy(w, c.Spooled)
+	}
 	_ = w.Close()
-	return b.String()
+	c.compressed, c.done = b.String(), true
+	return c.compressed
 }
 
 // clear it, without clearing the pool
 func (c *DataCompressor) clear() {
 	c.ExtraHeaders = []byte{}
 	c.Data = nil
+	c.Spooled = nil
+	c.compressed, c.done = "", false
 }
 
 func Compressor() Decorator {
@@ -95,6 +110,7 @@ func Compressor() Decorator {
 			if task == TaskSaveMail {
 				compressor := newCompressor()
 				compressor.set([]byte(e.DeliveryHeader), &e.Data)
+				compressor.Spooled = e.SpoolReader()
 				// put the pointer in there for other processors to use later in the line
 				e.Values["zlib-compressor"] = compressor
 				// continue to the next Processor in the decorator stack
@@ -0,0 +1,45 @@
+package backends
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestCompressor(t *testing.T) {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.DeliveryHeader = "Received: from test\r\n"
+	msg := "Subject: Test\r\n\r\n" + strings.Repeat("This is a test. ", 100)
+	e.Data.WriteString(msg)
+	var compressed string
+	p := Compressor()(ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+		c := e.Values["zlib-compressor"].(*DataCompressor)
+		compressed = c.String()
+		if c.String() != compressed {
+			t.Error("expecting the same result when printed again")
+		}
+		return NewResult("250 OK"), nil
+	}))
+	if _, err := p.Process(e, TaskSaveMail); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zlib.NewReader(bytes.NewReader([]byte(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != e.DeliveryHeader+msg {
+		t.Error("expecting the delivery header and the data to be compressed")
+	}
+	// the processors down the line can still read the data
+	if e.Data.String() != msg {
+		t.Error("expecting e.Data to be left intact")
+	}
+}
@@ -2,8 +2,10 @@ package backends
 
 import (
 	"github.com/flashmob/go-guerrilla/mail"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // ----------------------------------------------------------------------------------
@@ -12,6 +14,8 @@ import (
 // Description   : Log received emails
 // ----------------------------------------------------------------------------------
 // Config Options: log_received_mails bool - log if true
+//               : log_redact bool - mask the addresses and log only the names of the
+//               : header fields, so that no personal data is logged
 // --------------:-------------------------------------------------------------------
 // Input         : e.MailFrom, e.RcptTo, e.Header
 // ----------------------------------------------------------------------------------
@@ -21,11 +25,16 @@ func init() {
 	processors[strings.ToLower(defaultProcessor)] = func() Decorator {
 		return Debugger()
 	}
+	processorConfigs[strings.ToLower(defaultProcessor)] = func() BaseConfig {
+		return &debuggerConfig{}
+	}
 }
 
 type debuggerConfig struct {
 	LogReceivedMails bool `json:"log_received_mails"`
-	SleepSec         int  `json:"sleep_seconds,omitempty"`
+	// Redact masks the local part of the addresses and leaves out the values of the header fields
+	Redact   bool `json:"log_redact,omitempty"`
+	SleepSec int  `json:"sleep_seconds,omitempty"`
 }
 
 func Debugger() Decorator {
@@ -43,15 +52,27 @@ func Debugger() Decorator {
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
-				if config.LogReceivedMails {
-					Log().Infof("Mail from: %s / to: %v", e.MailFrom.String(), e.RcptTo)
-					Log().Info("Headers are:", e.Header)
+				if config.LogReceivedMails && config.Redact {
+					rcpts := make([]string, len(e.RcptTo))
+					for i := range e.RcptTo {
+						rcpts[i] = maskAddress(e.RcptTo[i])
+					}
+					names := make([]string, 0, len(e.Header))
+					for name := range e.Header {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+					ProcessorLog("debugger").WithQueuedID(e.ClientID, e.QueuedId).Infof("Mail from: %s / to: %v", maskAddress(e.MailFrom), rcpts)
+					ProcessorLog("debugger").WithQueuedID(e.ClientID, e.QueuedId).Info("Header fields are:", names)
+				} else if config.LogReceivedMails {
+					ProcessorLog("debugger").WithQueuedID(e.ClientID, e.QueuedId).Infof("Mail from: %s / to: %v", e.MailFrom.String(), e.RcptTo)
+					ProcessorLog("debugger").WithQueuedID(e.ClientID, e.QueuedId).Info("Headers are:", e.Header)
 				}
 
 				if config.SleepSec > 0 {
-					Log().Infof("sleeping for %d", config.SleepSec)
+					ProcessorLog("debugger").WithQueuedID(e.ClientID, e.QueuedId).Infof("sleeping for %d", config.SleepSec)
 					time.Sleep(time.Second * time.Duration(config.SleepSec))
-					Log().Infof("woke up")
+					ProcessorLog("debugger").WithQueuedID(e.ClientID, e.QueuedId).Infof("woke up")
 
 					if config.SleepSec == 1 {
 						panic("panic on purpose")
@@ -67,3 +88,14 @@ func Debugger() Decorator {
 		})
 	}
 }
+
+// maskAddress returns the address with its local part masked but for its first character, eg. j***@example.com
+func maskAddress(a mail.Address) string {
+	if a.User == "" {
+		return a.String()
+	}
+	r, _ := utf8.DecodeRuneInString(a.User)
+	masked := a
+	masked.User, masked.Quoted = string(r)+"***", false
+	return masked.String()
+}
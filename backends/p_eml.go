@@ -0,0 +1,169 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+	"github.com/flashmob/go-guerrilla/retention"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: eml
+// ----------------------------------------------------------------------------------
+// Description   : Saves each message to <queued id>.eml in a directory, with the
+//               : envelope as JSON in <queued id>.json
+// ----------------------------------------------------------------------------------
+// Config Options: eml_dir string - the directory, created if missing
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader generated by Header() processor
+//               : e.QueuedId, which may be set by the Hasher() processor
+// ----------------------------------------------------------------------------------
+// Output        : the files are written under a temporary name, then renamed, so
+//               : they appear complete. The .json is written after the .eml, so a
+//               : program that watches the directory should wait for the .json.
+//               : The directory is a retention store named "eml:" + eml_dir
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["eml"] = func() Decorator {
+		return EML()
+	}
+	processorConfigs["eml"] = func() BaseConfig {
+		return &EMLProcessorConfig{}
+	}
+}
+
+type EMLProcessorConfig struct {
+	Dir string `json:"eml_dir"`
+}
+
+// Validate checks the options, the directory is created when the processor is initialized
+func (c *EMLProcessorConfig) Validate() error {
+	if c.Dir == "" {
+		return errors.New("eml_dir is empty")
+	}
+	return nil
+}
+
+// EML saves the messages to files, then continues to the next processor
+func EML() Decorator {
+	var config *EMLProcessorConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		bcfg, err := Svc.ExtractConfig(backendConfig, &EMLProcessorConfig{})
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*EMLProcessorConfig)
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(config.Dir, 0700); err != nil {
+			return err
+		}
+		Svc.AddStore("eml:"+config.Dir, &emlStore{dir: config.Dir})
+		return nil
+	}))
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			if !validEMLName(e.QueuedId) {
+				ProcessorLog("eml").WithQueuedID(e.ClientID, e.QueuedId).Error("eml: the queued id cannot be a file name")
+				return NewResult(response.Canned.FailBackendTransaction), StorageError
+			}
+			err := writeFileAtomic(config.Dir, e.QueuedId+".eml", func(w io.Writer) error {
+				_, err := e.WriteTo(w)
+				return err
+			})
+			if err == nil {
+				err = writeFileAtomic(config.Dir, e.QueuedId+".json", func(w io.Writer) error {
+					return json.NewEncoder(w).Encode(e)
+				})
+			}
+			if err != nil {
+				ProcessorLog("eml").WithQueuedID(e.ClientID, e.QueuedId).WithError(err).Error("eml: could not save the message")
+				return NewResult(response.Canned.FailBackendTransaction), err
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// validEMLName returns true if the queued id can be used as a file name
+func validEMLName(id string) bool {
+	return id != "" && id[0] != '.' && !strings.ContainsAny(id, `/\`)
+}
+
+// writeFileAtomic writes name in dir with write. The data is written to a temporary file, synced,
+// then renamed to name, so that name is either missing or complete
+func writeFileAtomic(dir, name string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(dir, ".tmp-"+name+"-")
+	if err != nil {
+		return err
+	}
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// emlStore implements retention.Store for the eml processor, the messages are identified by their queued id
+type emlStore struct {
+	dir string
+}
+
+func (s *emlStore) Expire(before time.Time, expired func(m retention.Message) bool) (int, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, ".") || !fi.ModTime().Before(before) {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".json")
+		eml := filepath.Join(s.dir, id+".eml")
+		msg := retention.Message{ID: id, Open: func() (io.Reader, error) {
+			b, err := ioutil.ReadFile(eml)
+			return bytes.NewReader(b), err
+		}}
+		var envelope struct {
+			RcptTo []string `json:"rcpt_to"`
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(s.dir, name)); err == nil && json.Unmarshal(b, &envelope) == nil &&
+			len(envelope.RcptTo) > 0 {
+			msg.Recipient = envelope.RcptTo[0]
+		}
+		if !expired(msg) {
+			continue
+		}
+		if err := os.Remove(eml); err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
@@ -0,0 +1,85 @@
+package backends
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/retention"
+)
+
+func TestEML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "HeadersParser|Header|EML",
+		"save_workers_size": 1,
+		"primary_mail_host": "example.com",
+		"eml_dir":           filepath.Join(dir, "mail"),
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	e.Data.WriteString("Subject: test\n\nThis is a test.\n")
+	if r := gateway.Process(e); r.Code() != 250 {
+		t.Fatal("expecting the envelope to be saved, got", r.String())
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "mail"))
+	if len(files) != 2 || files[0].Name() != e.QueuedId+".eml" || files[1].Name() != e.QueuedId+".json" {
+		t.Fatal("expecting the .eml and .json files only, got", files)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "mail", e.QueuedId+".eml"))
+	if !strings.HasPrefix(string(data), "Delivered-To: test@example.com\n") ||
+		!strings.HasSuffix(string(data), "Subject: test\n\nThis is a test.\n") {
+		t.Errorf("unexpected message %q", data)
+	}
+	var envelope map[string]interface{}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "mail", e.QueuedId+".json"))
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope["queued_id"] != e.QueuedId ||
+		envelope["subject"] != "test" {
+		t.Errorf("unexpected envelope %s", data)
+	}
+
+	store := &emlStore{dir: filepath.Join(dir, "mail")}
+	var seen []retention.Message
+	deleted, err := store.Expire(time.Now().Add(time.Hour), func(m retention.Message) bool {
+		seen = append(seen, m)
+		return true
+	})
+	if err != nil || deleted != 1 {
+		t.Error("expecting the message to be deleted, got", deleted, err)
+	}
+	if len(seen) != 1 || seen[0].ID != e.QueuedId || seen[0].Recipient != "test@example.com" {
+		t.Error("unexpected messages", seen)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "mail")); len(files) != 0 {
+		t.Error("expecting the files to be deleted, got", files)
+	}
+}
+
+func TestEMLConfig(t *testing.T) {
+	if err := ValidateConfig(BackendConfig{"save_process": "EML", "save_workers_size": 1}); err == nil {
+		t.Error("expecting eml_dir to be required")
+	}
+	if !validEMLName("2c0f5a") || validEMLName("../x") || validEMLName(".x") || validEMLName("") {
+		t.Error("unexpected valid names")
+	}
+}
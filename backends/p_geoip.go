@@ -0,0 +1,168 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/geoip"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: geoip
+// ----------------------------------------------------------------------------------
+// Description   : Looks up the client's IP in MaxMind databases, eg. GeoLite2 Country
+//               : and ASN, so that the processors after it can apply policies
+// ----------------------------------------------------------------------------------
+// Config Options: geoip_country_db string - path of a Country or City database
+//               : geoip_asn_db string - path of an ASN database
+//               : geoip_add_headers bool - add X-GeoIP-Country and X-GeoIP-ASN
+//               : to e.DeliveryHeader, place it after Header() for that
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["geoip"] set to the geoip.Record, and when known
+//               : e.Values["geoip_country"], e.Values["geoip_continent"],
+//               : e.Values["geoip_asn"] (uint) and e.Values["geoip_asn_org"]
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["geoip"] = func() Decorator {
+		return GeoIP()
+	}
+	processorConfigs["geoip"] = func() BaseConfig {
+		return &GeoIPConfig{}
+	}
+}
+
+type GeoIPConfig struct {
+	CountryDB  string `json:"geoip_country_db,omitempty"`
+	ASNDB      string `json:"geoip_asn_db,omitempty"`
+	AddHeaders bool   `json:"geoip_add_headers,omitempty"`
+}
+
+// Validate checks that the databases can be read, without opening them
+func (c *GeoIPConfig) Validate() error {
+	for _, db := range []struct{ key, path string }{{"geoip_country_db", c.CountryDB}, {"geoip_asn_db", c.ASNDB}} {
+		if db.path == "" {
+			continue
+		}
+		if _, err := os.Stat(db.path); err != nil {
+			return fmt.Errorf("%s: %s", db.key, err)
+		}
+	}
+	return nil
+}
+
+// geoIPDatabases are the databases opened with the latest config
+type geoIPDatabases struct {
+	sync.RWMutex
+	readers    []*geoip.Reader
+	addHeaders bool
+}
+
+func (g *geoIPDatabases) open(config *GeoIPConfig) error {
+	var readers []*geoip.Reader
+	for _, path := range []string{config.CountryDB, config.ASNDB} {
+		if path == "" {
+			continue
+		}
+		r, err := geoip.Open(path)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+	}
+	if len(readers) == 0 {
+		return errors.New("geoip needs geoip_country_db or geoip_asn_db")
+	}
+	g.Lock()
+	defer g.Unlock()
+	g.readers = readers
+	g.addHeaders = config.AddHeaders
+	return nil
+}
+
+// lookup returns what the databases know about ip
+func (g *geoIPDatabases) lookup(ip net.IP) (rec geoip.Record, err error) {
+	g.RLock()
+	defer g.RUnlock()
+	for _, r := range g.readers {
+		if err = r.Record(ip, &rec); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// GeoIP looks up the client's IP once per transaction, when validating the first recipient or when saving
+func GeoIP() Decorator {
+	dbs := &geoIPDatabases{}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&GeoIPConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		return dbs.open(bcfg.(*GeoIPConfig))
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail && task != TaskValidateRcpt {
+				return p.Process(e, task)
+			}
+			v, ok := e.Values["geoip"]
+			if !ok {
+				var rec geoip.Record
+				if ip := net.ParseIP(e.RemoteIP); ip != nil {
+					var err error
+					if rec, err = dbs.lookup(ip); err != nil {
+						ProcessorLog("geoip").WithQueuedID(e.ClientID, e.QueuedId).WithError(err).Warn("geoip lookup failed")
+					}
+				}
+				setGeoIPValues(e, rec)
+				v = rec
+			}
+			if task == TaskSaveMail {
+				dbs.RLock()
+				addHeaders := dbs.addHeaders
+				dbs.RUnlock()
+				if addHeaders {
+					rec := v.(geoip.Record)
+					if rec.Country != "" {
+						e.DeliveryHeader += "X-GeoIP-Country: " + rec.Country + "\n"
+					}
+					if rec.ASN != 0 {
+						asn := "AS" + strconv.FormatUint(uint64(rec.ASN), 10)
+						if rec.Org != "" {
+							asn += " " + rec.Org
+						}
+						e.DeliveryHeader += "X-GeoIP-ASN: " + asn + "\n"
+					}
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// setGeoIPValues saves rec in e.Values, the empty fields are left out
+func setGeoIPValues(e *mail.Envelope, rec geoip.Record) {
+	e.Values["geoip"] = rec
+	if rec.Country != "" {
+		e.Values["geoip_country"] = rec.Country
+	}
+	if rec.Continent != "" {
+		e.Values["geoip_continent"] = rec.Continent
+	}
+	if rec.ASN != 0 {
+		e.Values["geoip_asn"] = rec.ASN
+	}
+	if rec.Org != "" {
+		e.Values["geoip_asn_org"] = rec.Org
+	}
+}
@@ -0,0 +1,107 @@
+package backends
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/geoip"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// writeGeoIPDB writes a database with a record for 81.2.69.0/24
+func writeGeoIPDB(t *testing.T, path string, record map[string]interface{}) {
+	w := geoip.Writer{}
+	_, network, _ := net.ParseCIDR("81.2.69.0/24")
+	if err := w.Insert(network, record); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := w.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	countryDB := filepath.Join(dir, "country.mmdb")
+	asnDB := filepath.Join(dir, "asn.mmdb")
+	writeGeoIPDB(t, countryDB, map[string]interface{}{
+		"continent": map[string]interface{}{"code": "EU"},
+		"country":   map[string]interface{}{"iso_code": "GB"},
+	})
+	writeGeoIPDB(t, asnDB, map[string]interface{}{
+		"autonomous_system_number":       uint32(20712),
+		"autonomous_system_organization": "Andrews & Arnold Ltd",
+	})
+
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "Header|GeoIP|Memory",
+		"save_workers_size": 1,
+		"primary_mail_host": "example.com",
+		"geoip_country_db":  countryDB,
+		"geoip_asn_db":      asnDB,
+		"geoip_add_headers": true,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+
+	for _, ip := range []string{"81.2.69.160", "10.0.0.1"} {
+		e := mail.NewEnvelope(ip, 1)
+		e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+		e.Data.WriteString("Subject: test\n\nThis is a test.\n")
+		if r := gateway.Process(e); r.Code() != 250 {
+			t.Fatal("expecting the envelope to be saved, got", r.String())
+		}
+	}
+	envelopes := MemoryStore.Envelopes()
+	if len(envelopes) != 2 {
+		t.Fatal("expecting 2 envelopes, got", len(envelopes))
+	}
+	e := envelopes[0]
+	if e.Values["geoip_country"] != "GB" || e.Values["geoip_continent"] != "EU" ||
+		e.Values["geoip_asn"] != uint(20712) || e.Values["geoip_asn_org"] != "Andrews & Arnold Ltd" {
+		t.Error("unexpected values", e.Values)
+	}
+	if !strings.Contains(e.DeliveryHeader, "X-GeoIP-Country: GB\nX-GeoIP-ASN: AS20712 Andrews & Arnold Ltd\n") {
+		t.Errorf("expecting the geoip headers, got %q", e.DeliveryHeader)
+	}
+	e = envelopes[1]
+	if rec, ok := e.Values["geoip"].(geoip.Record); !ok || rec != (geoip.Record{}) {
+		t.Error("expecting an empty record for 10.0.0.1, got", e.Values["geoip"])
+	}
+	if _, ok := e.Values["geoip_country"]; ok || strings.Contains(e.DeliveryHeader, "X-GeoIP") {
+		t.Error("expecting no country for 10.0.0.1", e.Values, e.DeliveryHeader)
+	}
+
+	bad := &BackendGateway{}
+	if err := bad.Initialize(BackendConfig{
+		"save_process":     "GeoIP",
+		"geoip_country_db": filepath.Join(dir, "missing.mmdb"),
+	}); err == nil {
+		t.Error("expecting a missing database to fail the initialization")
+	}
+	// drop the failed initializer, it would run again with the config of the next test
+	Svc.reset()
+}
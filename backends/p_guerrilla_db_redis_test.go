@@ -1,37 +1,91 @@
 package backends
 
 import (
-	"bytes"
 	"compress/zlib"
-	"fmt"
-	"io"
+	"errors"
+	"io/ioutil"
 	"strings"
 	"testing"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
 )
 
-func TestCompressedData(t *testing.T) {
-	var b bytes.Buffer
-	var out bytes.Buffer
-	str := "Hello Hello Hello Hello Hello Hello Hello!"
-	sbj := "Subject:hello\r\n"
-	b.WriteString(str)
-	cd := newCompressedData()
-	cd.set([]byte(sbj), &b)
+func TestGuerrillaDbRedis(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	fakeDB.reset()
+	r := &fakeRedis{}
+	var saved []string
+	r.do = func(addr string, s RedisDialSettings, cmd string, args []interface{}) (interface{}, error) {
+		if len(saved) > 0 {
+			return nil, errors.New("OOM command not allowed when used memory > 'maxmemory'")
+		}
+		saved = append(saved, redisString(args[0]))
+		return "OK", nil
+	}
+	defer r.install()()
 
-	// compress
-	if _, err := fmt.Fprint(&out, cd); err != nil {
-		t.Error(err)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":         "HeadersParser|GuerrillaRedisDB",
+		"save_workers_size":    1,
+		"mail_table":           "new_mail",
+		"primary_mail_host":    "sharklasers.com",
+		"sql_driver":           "fakesql",
+		"sql_dsn":              "test",
+		"redis_interface":      "127.0.0.1:6379",
+		"redis_expire_seconds": 7200,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
 	}
 
-	// decompress
-	var result bytes.Buffer
-	zReader, _ := zlib.NewReader(bytes.NewReader(out.Bytes()))
-	if _, err := io.Copy(&result, zReader); err != nil {
-		t.Error(err)
+	var hashes []string
+	for i := 0; i < 2; i++ {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.PushRcpt(mail.Address{User: "test", Host: "grr.la"})
+		e.Data.WriteString("Subject: hello\n\nThis is a test.\n")
+		if r := gateway.Process(e); r.Code() != 250 {
+			t.Fatal("expecting the envelope to be saved, got", r.String())
+		}
+		hashes = append(hashes, e.QueuedId)
 	}
-	expect := sbj + str
-	if delta := strings.Compare(expect, result.String()); delta != 0 {
-		t.Error(delta, "compression did match, expected", expect, "but got", result.String())
+	// the rows are inserted in a batch, when shutting down at the latest
+	if err := gateway.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0] != hashes[0] {
+		t.Error("expecting the first envelope to be saved in redis, got", saved)
 	}
 
+	fakeDB.Lock()
+	defer fakeDB.Unlock()
+	if len(fakeDB.queries) != 1 || !strings.HasPrefix(fakeDB.queries[0], "INSERT INTO new_mail (`date`, `to`, `from`, `subject`, "+
+		"`body`, `charset`, `mail`, `spam_score`, `hash`, `content_type`, `recipient`, `has_attach`, `ip_addr`, `return_path`, "+
+		"`is_tls`) VALUES (NOW(), ?, ?, ?, ?, 'UTF-8', ?, 0, ?, '', ?, 0, ?, ?, ?),(NOW(),") {
+		t.Fatal("expecting a batch of 2 rows, got", fakeDB.queries)
+	}
+	args := fakeDB.args[0]
+	if len(args) != 20 {
+		t.Fatal("unexpected values", args)
+	}
+	if args[0] != "test@sharklasers.com" || args[2] != "hello" || args[3] != "redis" || args[4] != "" || args[5] != hashes[0] {
+		t.Error("unexpected row of the envelope saved in redis", args[:10])
+	}
+	// redis failed, the data is in the mail column
+	if args[13] != "gzencode" || args[15] != hashes[1] {
+		t.Error("unexpected row of the envelope saved in sql", args[10:])
+	}
+	zr, err := zlib.NewReader(strings.NewReader(args[14].(string)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(zr)
+	if !strings.HasPrefix(string(data), "Delivered-To: test@sharklasers.com\r\nReceived: from 127.0.0.1") ||
+		!strings.HasSuffix(string(data), "\r\nSubject: hello\n\nThis is a test.\n") {
+		t.Errorf("unexpected data %q", data)
+	}
 }
@@ -8,19 +8,25 @@ import (
 
 type HeaderConfig struct {
 	PrimaryHost string `json:"primary_mail_host"`
+	AuthServID  string `json:"auth_serv_id,omitempty"`
 }
 
 // ----------------------------------------------------------------------------------
 // Processor Name: header
 // ----------------------------------------------------------------------------------
-// Description   : Adds delivery information headers to e.DeliveryHeader
+// Description   : Adds delivery information headers to e.DeliveryHeader, and the
+//               : Authentication-Results of the processors placed before it
 // ----------------------------------------------------------------------------------
-// Config Options: none
+// Config Options: auth_serv_id string - the authserv-id of Authentication-Results,
+//               : primary_mail_host if empty
 // --------------:-------------------------------------------------------------------
 // Input         : e.Helo
 //               : e.RemoteAddress
 //               : e.RcptTo
 //               : e.Hashes
+//               : e.AuthUser
+//               : e.Values["reputation_tag"]
+//               : e.Values["auth_results"], see AddAuthResult
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.DeliveryHeader with additional delivery info
 // ----------------------------------------------------------------------------------
@@ -28,6 +34,9 @@ func init() {
 	processors["header"] = func() Decorator {
 		return Header()
 	}
+	processorConfigs["header"] = func() BaseConfig {
+		return &HeaderConfig{}
+	}
 }
 
 // Generate the MTA delivery header
@@ -61,13 +70,25 @@ func Header() Decorator {
 				if e.TLS {
 					protocol = protocol + "S"
 				}
+				if e.AuthUser != "" {
+					// RFC 3848, eg. ESMTPSA
+					protocol = protocol + "A"
+				}
 				var addHead string
 				addHead += "Delivered-To: " + to + "\n"
+				addHead += authHeaders(config, e)
 				addHead += "Received: from " + e.RemoteIP + " ([" + e.RemoteIP + "])\n"
+				if e.AuthUser != "" {
+					addHead += "	(authenticated as " + e.AuthUser + ")\n"
+				}
 				if len(e.RcptTo) > 0 {
 					addHead += "	by " + e.RcptTo[0].Host + " with " + protocol + " id " + hash + "@" + e.RcptTo[0].Host + ";\n"
 				}
 				addHead += "	" + time.Now().Format(time.RFC1123Z) + "\n"
+				if tag, ok := e.Values["reputation_tag"].(string); ok {
+					// the client's reputation score, tagged by the server
+					addHead += "X-Reputation: " + tag + "\n"
+				}
 				// save the result
 				e.DeliveryHeader = addHead
 				// next processor
@@ -79,3 +100,28 @@ func Header() Decorator {
 		})
 	}
 }
+
+// authHeaders returns the Received-SPF and Authentication-Results headers of the results added by the processors,
+// and of the SMTP AUTH of the client. Empty if there are none
+func authHeaders(config *HeaderConfig, e *mail.Envelope) string {
+	results := AuthResults(e)
+	if e.AuthUser != "" {
+		auth := AuthResult{Method: "auth", Result: "pass", Properties: []AuthProperty{{"smtp.auth", e.AuthUser}}}
+		results = sortAuthResults(append(results, auth))
+	}
+	if len(results) == 0 {
+		return ""
+	}
+	authServID := config.AuthServID
+	if authServID == "" {
+		authServID = config.PrimaryHost
+	}
+	var h string
+	for _, r := range results {
+		if strings.EqualFold(r.Method, "spf") {
+			h += ReceivedSPFHeader(authServID, r, e)
+			break
+		}
+	}
+	return h + AuthResultsHeader(authServID, results)
+}
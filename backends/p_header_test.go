@@ -0,0 +1,77 @@
+package backends
+
+import (
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"strings"
+	"testing"
+)
+
+func TestHeaderAuthenticated(t *testing.T) {
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	g, err := New(BackendConfig{
+		"save_process":       "Hasher|Header",
+		"log_received_mails": false,
+		"primary_mail_host":  "example.com",
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := g.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.ESMTP = true
+	e.TLS = true
+	e.AuthUser = "alice"
+	e.AuthMethod = "PLAIN"
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	e.Data.WriteString("Subject: Test\n\nThis is a test.")
+	g.Process(e)
+	if !strings.Contains(e.DeliveryHeader, "with ESMTPSA id") {
+		t.Error("expecting ESMTPSA protocol, got", e.DeliveryHeader)
+	}
+	if !strings.Contains(e.DeliveryHeader, "(authenticated as alice)") {
+		t.Error("expecting the authenticated user in the header, got", e.DeliveryHeader)
+	}
+}
+
+func TestHeaderAuthResults(t *testing.T) {
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	g, err := New(BackendConfig{
+		"save_process":      "Header",
+		"primary_mail_host": "example.com",
+		"auth_serv_id":      "mx.example.com",
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := g.Shutdown(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	e := mail.NewEnvelope("192.0.2.1", 1)
+	e.Helo = "mail.example.org"
+	e.AuthUser = "alice"
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	e.Data.WriteString("Subject: Test\n\nThis is a test.")
+	AddAuthResult(e, AuthResult{Method: "spf", Result: "pass", Properties: []AuthProperty{{"smtp.helo", e.Helo}}})
+	g.Process(e)
+	if !strings.HasPrefix(e.DeliveryHeader, "Delivered-To: test@example.com\n"+
+		"Received-SPF: pass\n\tclient-ip=192.0.2.1; helo=mail.example.org; receiver=mx.example.com;\n"+
+		"Authentication-Results: mx.example.com;\n\tauth=pass smtp.auth=alice;\n\tspf=pass smtp.helo=mail.example.org\n"+
+		"Received: from 192.0.2.1") {
+		t.Error("expecting the authentication headers before Received, got", e.DeliveryHeader)
+	}
+}
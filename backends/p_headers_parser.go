@@ -26,7 +26,7 @@ func HeadersParser() Decorator {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			if task == TaskSaveMail {
 				if err := e.ParseHeaders(); err != nil {
-					Log().WithError(err).Error("parse headers error")
+					ProcessorLog("headersparser").WithQueuedID(e.ClientID, e.QueuedId).WithError(err).Error("parse headers error")
 				}
 				// next processor
 				return p.Process(e, task)
@@ -0,0 +1,201 @@
+package backends
+
+import (
+	"io"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/retention"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: memory
+// ----------------------------------------------------------------------------------
+// Description   : Keeps a copy of the accepted envelopes in memory, for test suites to
+//               : inspect through MemoryStore
+// ----------------------------------------------------------------------------------
+// Config Options: memory_max_envelopes int - number of envelopes kept, the oldest are
+//               : dropped. 0 keeps them all
+// --------------:-------------------------------------------------------------------
+// Input         : e, accepted by the processors after it
+// ----------------------------------------------------------------------------------
+// Output        : a copy of e appended to MemoryStore, which the retention rules
+//               : apply to as the "memory" store
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["memory"] = func() Decorator {
+		return Memory()
+	}
+	processorConfigs["memory"] = func() BaseConfig {
+		return &memoryConfig{}
+	}
+}
+
+type memoryConfig struct {
+	MaxEnvelopes int `json:"memory_max_envelopes,omitempty"`
+}
+
+// MemoryEnvelopes holds the envelopes accepted by the memory processor, oldest first. It's safe for concurrent use
+type MemoryEnvelopes struct {
+	mu        sync.Mutex
+	envelopes []*mail.Envelope
+	// received is when each of the envelopes was added
+	received []time.Time
+	max      int
+}
+
+// MemoryStore is where the memory processor keeps the envelopes, it's shared by all the backends of the process
+var MemoryStore = &MemoryEnvelopes{}
+
+// Envelopes returns the envelopes kept
+func (m *MemoryEnvelopes) Envelopes() []*mail.Envelope {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*mail.Envelope(nil), m.envelopes...)
+}
+
+// Find returns the envelopes kept for which match returns true
+func (m *MemoryEnvelopes) Find(match func(e *mail.Envelope) bool) []*mail.Envelope {
+	var found []*mail.Envelope
+	for _, e := range m.Envelopes() {
+		if match(e) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// Len returns the number of envelopes kept
+func (m *MemoryEnvelopes) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.envelopes)
+}
+
+// Reset drops the envelopes kept, eg. between tests
+func (m *MemoryEnvelopes) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.envelopes = nil
+	m.received = nil
+}
+
+func (m *MemoryEnvelopes) setMax(max int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.max = max
+}
+
+func (m *MemoryEnvelopes) add(e *mail.Envelope) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.envelopes = append(m.envelopes, e)
+	m.received = append(m.received, time.Now())
+	if m.max > 0 && len(m.envelopes) > m.max {
+		m.envelopes = append(m.envelopes[:0], m.envelopes[len(m.envelopes)-m.max:]...)
+		m.received = append(m.received[:0], m.received[len(m.received)-m.max:]...)
+	}
+}
+
+// Expire implements retention.Store, the messages are identified by their queued id
+func (m *MemoryEnvelopes) Expire(before time.Time, expired func(m retention.Message) bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int
+	envelopes, received := m.envelopes[:0], m.received[:0]
+	for i, e := range m.envelopes {
+		if m.received[i].Before(before) {
+			e := e
+			msg := retention.Message{ID: e.QueuedId, Open: func() (io.Reader, error) {
+				return e.NewReader(), nil
+			}}
+			if len(e.RcptTo) > 0 {
+				msg.Recipient = e.RcptTo[0].String()
+			}
+			if expired(msg) {
+				deleted++
+				continue
+			}
+		}
+		envelopes = append(envelopes, e)
+		received = append(received, m.received[i])
+	}
+	m.envelopes, m.received = envelopes, received
+	return deleted, nil
+}
+
+// Memory keeps a copy of the envelopes that the rest of the stack accepted
+func Memory() Decorator {
+	initFunc := InitializeWith(func(backendConfig BackendConfig) error {
+		bcfg, err := Svc.ExtractConfig(backendConfig, &memoryConfig{})
+		if err != nil {
+			return err
+		}
+		MemoryStore.setMax(bcfg.(*memoryConfig).MaxEnvelopes)
+		Svc.AddStore("memory", MemoryStore)
+		return nil
+	})
+	Svc.AddInitializer(initFunc)
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			result, err := p.Process(e, task)
+			if task == TaskSaveMail && err == nil && (result == nil || result.Code() < 300) {
+				MemoryStore.add(copyEnvelope(e))
+			}
+			return result, err
+		})
+	}
+}
+
+// copyEnvelope copies e, the envelope is reused once processed.
+// The copy holds all of the message data in Data, including the part that was spooled to disk
+func copyEnvelope(e *mail.Envelope) *mail.Envelope {
+	c := mail.NewEnvelope(e.RemoteIP, e.ClientID)
+	c.Helo = e.Helo
+	c.MailFrom = e.MailFrom
+	c.MailParams = copyParams(e.MailParams)
+	c.RcptTo = append([]mail.Address(nil), e.RcptTo...)
+	for _, params := range e.RcptParams {
+		c.RcptParams = append(c.RcptParams, copyParams(params))
+	}
+	c.Subject = e.Subject
+	c.TLS = e.TLS
+	if e.Header != nil {
+		c.Header = make(textproto.MIMEHeader, len(e.Header))
+		for k, v := range e.Header {
+			c.Header[k] = append([]string(nil), v...)
+		}
+	}
+	c.RawHeaders = append([]mail.HeaderField(nil), e.RawHeaders...)
+	c.Hashes = append([]string(nil), e.Hashes...)
+	c.DeliveryHeader = e.DeliveryHeader
+	c.Route = e.Route
+	// the tags are not modified, they can be shared
+	c.Tags = e.Tags
+	for k, v := range e.Values {
+		c.Values[k] = v
+	}
+	c.QueuedId = e.QueuedId
+	c.ESMTP = e.ESMTP
+	c.AuthUser = e.AuthUser
+	c.AuthMethod = e.AuthMethod
+	c.Data.Grow(e.Len() - len(e.DeliveryHeader))
+	c.Data.Write(e.Data.Bytes())
+	if r := e.SpoolReader(); r != nil {
+		_, _ = io.Copy(&c.Data, r)
+	}
+	return c
+}
+
+func copyParams(p mail.ESMTPParams) mail.ESMTPParams {
+	if p == nil {
+		return nil
+	}
+	c := make(mail.ESMTPParams, len(p))
+	for k, v := range p {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,94 @@
+package backends
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/retention"
+)
+
+func TestMemory(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":         "HeadersParser|Memory",
+		"save_workers_size":    1,
+		"memory_max_envelopes": 2,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	for i := 0; i < 3; i++ {
+		// the envelope is reused, the copies must not change
+		e.ResetTransaction()
+		e.QueuedId = fmt.Sprintf("id%d", i)
+		e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+		e.Data.WriteString(fmt.Sprintf("Subject: message %d\n\nThis is a test.\n", i))
+		if r := gateway.Process(e); r.Code() != 250 {
+			t.Fatal("expecting the envelope to be saved, got", r.String())
+		}
+	}
+	envelopes := MemoryStore.Envelopes()
+	if len(envelopes) != 2 {
+		t.Fatal("expecting the 2 newest envelopes to be kept, got", len(envelopes))
+	}
+	if e := envelopes[0]; e.QueuedId != "id1" || e.Subject != "message 1" || e.Data.String() != "Subject: message 1\n\nThis is a test.\n" {
+		t.Errorf("unexpected envelope %s %q %q", e.QueuedId, e.Subject, e.Data.String())
+	}
+	if e := envelopes[1]; len(e.RcptTo) != 1 || e.RcptTo[0].String() != "test@example.com" || e.HeaderValue("Subject") != "message 2" {
+		t.Errorf("unexpected envelope %s %v", e.QueuedId, e.RcptTo)
+	}
+	found := MemoryStore.Find(func(e *mail.Envelope) bool {
+		return e.Subject == "message 2"
+	})
+	if len(found) != 1 || found[0].QueuedId != "id2" {
+		t.Error("expecting to find the envelope by subject, got", len(found))
+	}
+	MemoryStore.Reset()
+	if n := MemoryStore.Len(); n != 0 {
+		t.Error("expecting no envelopes after Reset, got", n)
+	}
+}
+
+func TestMemoryExpire(t *testing.T) {
+	MemoryStore.setMax(0)
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+	for i := 0; i < 3; i++ {
+		e := mail.NewEnvelope("127.0.0.1", uint64(i))
+		e.QueuedId = fmt.Sprint(i)
+		e.PushRcpt(mail.Address{User: fmt.Sprint("user", i), Host: "example.com"})
+		e.Data.WriteString("Subject: test\n\nThis is a test.\n")
+		MemoryStore.add(e)
+	}
+	var seen []string
+	deleted, err := MemoryStore.Expire(time.Now().Add(time.Second), func(m retention.Message) bool {
+		seen = append(seen, m.Recipient)
+		return m.ID != "1"
+	})
+	if err != nil || deleted != 2 {
+		t.Error("expecting 2 envelopes deleted, got", deleted, err)
+	}
+	if len(seen) != 3 || seen[0] != "user0@example.com" {
+		t.Error("expecting the 3 envelopes to be expired, got", seen)
+	}
+	if envelopes := MemoryStore.Envelopes(); len(envelopes) != 1 || envelopes[0].QueuedId != "1" {
+		t.Error("expecting envelope 1 to be kept, got", envelopes)
+	}
+	if deleted, _ := MemoryStore.Expire(time.Now().Add(-time.Hour), func(retention.Message) bool {
+		return true
+	}); deleted != 0 {
+		t.Error("expecting the recent envelopes to be kept, got", deleted)
+	}
+}
@@ -0,0 +1,154 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/dnscache"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/metrics"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: mxcheck
+// ----------------------------------------------------------------------------------
+// Description   : Checks that the domain of MAIL FROM can receive mail, ie. that it
+//               : has MX records, or A/AAAA records when it has no MX (RFC 5321 5.1)
+//               : The answers are cached by the dnscache resolver, with their TTL
+// ----------------------------------------------------------------------------------
+// Config Options: mx_check_reject bool - reject the senders whose domain does not
+//               : resolve, or publishes a null MX (RFC 7505). Lookups that fail for
+//               : other reasons are rejected with a 451 when saving
+//               : mx_check_timeout string - of the lookups, eg. "5s" (default)
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["mx_check"] set to one of "pass", "fail", "nullmx",
+//               : "temperror" or "none" (null sender)
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["mxcheck"] = func() Decorator {
+		return MXCheck()
+	}
+	processorConfigs["mxcheck"] = func() BaseConfig {
+		return &MXCheckConfig{}
+	}
+}
+
+type MXCheckConfig struct {
+	Reject  bool   `json:"mx_check_reject,omitempty"`
+	Timeout string `json:"mx_check_timeout,omitempty"`
+}
+
+// Validate checks the timeout
+func (c *MXCheckConfig) Validate() error {
+	_, err := c.timeout()
+	return err
+}
+
+func (c *MXCheckConfig) timeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return time.Second * 5, nil
+	}
+	return time.ParseDuration(c.Timeout)
+}
+
+// results of the check
+const (
+	MXCheckPass      = "pass"
+	MXCheckFail      = "fail"
+	MXCheckNullMX    = "nullmx"
+	MXCheckTempError = "temperror"
+	MXCheckNone      = "none"
+)
+
+// mxResolver is the part of dnscache.Resolver used by the check
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// mxCheckResolver returns the resolver of the lookups, replaced by the tests
+var mxCheckResolver = func() mxResolver {
+	return dnscache.Default()
+}
+
+// checkMX returns the result of the check of the sender's domain
+func checkMX(ctx context.Context, r mxResolver, from *mail.Address) string {
+	if from.IsEmpty() || from.NullPath {
+		return MXCheckNone
+	}
+	if from.IP != nil {
+		// an address literal does not need the DNS
+		return MXCheckPass
+	}
+	domain := from.HostASCII()
+	mxs, err := r.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			return MXCheckNullMX
+		}
+		return MXCheckPass
+	}
+	if err != nil && !dnscache.IsNotFound(err) {
+		return MXCheckTempError
+	}
+	// no MX, the domain itself is the implicit MX
+	if _, err = r.LookupHost(ctx, domain); err == nil {
+		return MXCheckPass
+	} else if dnscache.IsNotFound(err) {
+		return MXCheckFail
+	}
+	return MXCheckTempError
+}
+
+// MXCheck checks the sender's domain once per transaction, when validating the first recipient or when saving
+func MXCheck() Decorator {
+	var config *MXCheckConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MXCheckConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*MXCheckConfig)
+		return config.Validate()
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail && task != TaskValidateRcpt {
+				return p.Process(e, task)
+			}
+			result, ok := e.Values["mx_check"].(string)
+			if !ok {
+				timeout, _ := config.timeout()
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				result = checkMX(ctx, mxCheckResolver(), &e.MailFrom)
+				cancel()
+				e.Values["mx_check"] = result
+				metrics.Incr(metrics.MXChecks, "result:"+result)
+				if result != MXCheckPass && result != MXCheckNone {
+					ProcessorLog("mxcheck").WithQueuedID(e.ClientID, e.QueuedId).WithField("from", e.MailFrom.String()).
+						Info("mx check of the sender's domain: ", result)
+				}
+			}
+			if !config.Reject {
+				return p.Process(e, task)
+			}
+			switch result {
+			case MXCheckFail:
+				return NewResult(response.Canned.FailSenderDomain), SenderDomainRejected
+			case MXCheckNullMX:
+				return NewResult(response.Canned.FailSenderNullMX), SenderNullMX
+			case MXCheckTempError:
+				if task == TaskSaveMail {
+					return NewResult(response.Canned.ErrorSenderDomain), nil
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
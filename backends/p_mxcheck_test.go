@@ -0,0 +1,147 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// fakeMXResolver answers from its maps, the names it doesn't know do not exist
+type fakeMXResolver struct {
+	sync.Mutex
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	broken  map[string]bool
+	lookups int
+}
+
+func (r *fakeMXResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.lookups++
+	if r.broken[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name}
+	}
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name}
+}
+
+func (r *fakeMXResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.lookups++
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host}
+}
+
+func (r *fakeMXResolver) install() func() {
+	saved := mxCheckResolver
+	mxCheckResolver = func() mxResolver { return r }
+	return func() { mxCheckResolver = saved }
+}
+
+func newFakeMXResolver() *fakeMXResolver {
+	return &fakeMXResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+			"nullmx.com":  {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"a-only.com": {"192.0.2.1"},
+		},
+		broken: map[string]bool{"broken.com": true},
+	}
+}
+
+func TestCheckMX(t *testing.T) {
+	r := newFakeMXResolver()
+	for _, test := range []struct {
+		from   mail.Address
+		result string
+	}{
+		{mail.Address{User: "test", Host: "example.com"}, MXCheckPass},
+		{mail.Address{User: "test", Host: "a-only.com"}, MXCheckPass},
+		{mail.Address{User: "test", Host: "nullmx.com"}, MXCheckNullMX},
+		{mail.Address{User: "test", Host: "nowhere.com"}, MXCheckFail},
+		{mail.Address{User: "test", Host: "broken.com"}, MXCheckTempError},
+		{mail.Address{User: "test", Host: "192.0.2.1", IP: net.ParseIP("192.0.2.1")}, MXCheckPass},
+		{mail.Address{NullPath: true}, MXCheckNone},
+	} {
+		if result := checkMX(context.Background(), r, &test.from); result != test.result {
+			t.Errorf("%s: expecting %s, got %s", test.from.String(), test.result, result)
+		}
+	}
+}
+
+func TestMXCheck(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	r := newFakeMXResolver()
+	defer r.install()()
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "MXCheck|Memory",
+		"validate_process":  "MXCheck",
+		"save_workers_size": 1,
+		"mx_check_reject":   true,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+	MemoryStore.Reset()
+	defer MemoryStore.Reset()
+
+	for _, test := range []struct {
+		host string
+		err  error
+		code int
+	}{
+		{"example.com", nil, 250},
+		{"nowhere.com", SenderDomainRejected, 550},
+		{"nullmx.com", SenderNullMX, 550},
+		{"broken.com", nil, 451},
+	} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.MailFrom = mail.Address{User: "test", Host: test.host}
+		e.PushRcpt(mail.Address{User: "test", Host: "grr.la"})
+		e.Data.WriteString("Subject: test\n\nThis is a test.\n")
+		if err := gateway.ValidateRcpt(e); err != test.err {
+			t.Errorf("%s: expecting the rcpt error %v, got %v", test.host, test.err, err)
+		}
+		// the next recipient does not look up the domain again
+		lookups := r.lookups
+		e.PushRcpt(mail.Address{User: "test2", Host: "grr.la"})
+		_ = gateway.ValidateRcpt(e)
+		if r.lookups != lookups {
+			t.Errorf("%s: expecting the result to be kept in the envelope", test.host)
+		}
+		if res := gateway.Process(e); res.Code() != test.code {
+			t.Errorf("%s: expecting %d, got %s", test.host, test.code, res.String())
+		}
+	}
+	if envelopes := MemoryStore.Envelopes(); len(envelopes) != 1 || envelopes[0].Values["mx_check"] != MXCheckPass {
+		t.Error("expecting the envelope from example.com to be saved, got", envelopes)
+	}
+
+	bad := &BackendGateway{}
+	if err := bad.Initialize(BackendConfig{
+		"save_process":     "MXCheck",
+		"mx_check_timeout": "soon",
+	}); err == nil {
+		t.Error("expecting an invalid timeout to fail the initialization")
+	}
+	// drop the failed initializer, it would run again with the config of the next test
+	Svc.reset()
+}
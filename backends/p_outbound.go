@@ -0,0 +1,53 @@
+package backends
+
+import (
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/outbound"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: outbound
+// ----------------------------------------------------------------------------------
+// Description   : Queues the message to be delivered to the MX of its recipients,
+//               : by the outbound queue of the daemon. The message is written to
+//               : the queue_dir before the client gets its reply. A message with
+//               : more Received header fields than max_hops is rejected
+// ----------------------------------------------------------------------------------
+// Config Options: None, the queue is configured by "outbound" of the daemon's config
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["outbound_id"] set to the id of the message in the queue
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["outbound"] = func() Decorator {
+		return Outbound()
+	}
+}
+
+// Outbound queues the messages to outbound.Default when saving
+func Outbound() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail {
+				return p.Process(e, task)
+			}
+			q := outbound.Default()
+			if q == nil {
+				ProcessorLog("outbound").WithQueuedID(e.ClientID, e.QueuedId).Error("outbound: there is no queue")
+				return NewResult(response.Canned.FailBackendTransaction), outbound.ErrDisabled
+			}
+			id, err := q.Enqueue(e)
+			if err == outbound.ErrTooManyHops {
+				return NewResult(response.Canned.FailRoutingLoop), err
+			}
+			if err != nil {
+				ProcessorLog("outbound").WithQueuedID(e.ClientID, e.QueuedId).WithError(err).Error("outbound: could not queue the message")
+				return NewResult(response.Canned.FailBackendTransaction), err
+			}
+			e.Values["outbound_id"] = id
+			return p.Process(e, task)
+		})
+	}
+}
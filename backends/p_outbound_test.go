@@ -0,0 +1,68 @@
+package backends
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/outbound"
+)
+
+func TestOutbound(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	dir, err := ioutil.TempDir("", "outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "Outbound",
+		"save_workers_size": 1,
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+
+	newEnvelope := func() *mail.Envelope {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.QueuedId = "q1"
+		e.MailFrom = mail.Address{User: "test", Host: "example.com"}
+		// the delivery to an address literal fails without looking up the DNS
+		e.PushRcpt(mail.Address{User: "test", Host: "127.0.0.1", IP: net.ParseIP("127.0.0.1")})
+		e.Data.WriteString("Subject: test\n\nThis is a test.\n")
+		return e
+	}
+	if res := gateway.Process(newEnvelope()); res.Code() != 554 {
+		t.Error("expecting a failure without a queue, got", res.String())
+	}
+
+	q := outbound.New(outbound.Config{QueueDir: dir, RetryMin: "1h"}, mainlog)
+	defer q.Close()
+	outbound.Set(q)
+	defer outbound.Set(nil)
+	e := newEnvelope()
+	if res := gateway.Process(e); res.Code() != 250 {
+		t.Error("expecting the message to be queued, got", res.String())
+	}
+	if e.Values["outbound_id"] != "q1" || q.Len() != 1 {
+		t.Error("expecting the message in the queue, got", e.Values["outbound_id"], q.Len())
+	}
+
+	e = newEnvelope()
+	for i := 0; i < outbound.DefaultMaxHops+1; i++ {
+		e.DeliveryHeader += "Received: from somewhere\r\n"
+	}
+	if res := gateway.Process(e); !strings.Contains(res.String(), "5.4.6") || q.Len() != 1 {
+		t.Error("expecting a looping message to be rejected, got", res.String())
+	}
+}
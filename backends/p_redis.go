@@ -15,7 +15,20 @@ import (
 //               : e.Hashes
 // ----------------------------------------------------------------------------------
 // Config Options: redis_expire_seconds int - how many seconds to expiry
-//               : redis_interface string - <host>:<port> eg, 127.0.0.1:6379
+//               : redis_interface string - <host>:<port> eg, 127.0.0.1:6379, or
+//               : a comma separated list of the sentinels or the cluster's nodes
+//               : redis_username, redis_password string - AUTH, with an ACL user
+//               : redis_db int - database to select
+//               : redis_sentinel_master string - name of the master to ask the
+//               : sentinels for, redis_sentinel_password string - their AUTH
+//               : redis_cluster bool - send the keys to the nodes of their slots
+//               : redis_tls bool - connect with TLS, redis_tls_ca_file string,
+//               : redis_tls_skip_verify bool
+//               : redis_pool_size int - max connections shared by the workers
+//               : redis_timeout string - connect and command timeout, eg. "5s"
+//               : redis_key_prefix string - prefix of the keys, eg. "mail:"
+//               : redis_fallback bool - when redis fails, leave the data to the
+//               : next processor (eg. sql) instead of failing the transaction
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
 //               : e.DeliveryHeader generated by Header() processor
@@ -28,11 +41,40 @@ func init() {
 	processors["redis"] = func() Decorator {
 		return Redis()
 	}
+	processorConfigs["redis"] = func() BaseConfig {
+		return &RedisProcessorConfig{}
+	}
 }
 
 type RedisProcessorConfig struct {
 	RedisExpireSeconds int    `json:"redis_expire_seconds"`
 	RedisInterface     string `json:"redis_interface"`
+	// KeyPrefix is prepended to the hash to make the key
+	KeyPrefix string `json:"redis_key_prefix,omitempty"`
+	// Fallback lets the transaction continue when redis fails, without setting e.Values["redis"],
+	// so that the next processor saves the data itself
+	Fallback bool `json:"redis_fallback,omitempty"`
+	// RedisOptions are how to connect to redis_interface
+	RedisOptions
+}
+
+// Validate checks the options, without connecting to redis
+func (c *RedisProcessorConfig) Validate() error {
+	_, _, err := c.dialOptions()
+	return err
+}
+
+// CheckConnectivity connects to redis with a new connection, and sends it a PING
+func (c *RedisProcessorConfig) CheckConnectivity() error {
+	conn, err := newRedisConn(c.RedisInterface, &c.RedisOptions)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("PING")
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 type RedisProcessor struct {
@@ -40,9 +82,9 @@ type RedisProcessor struct {
 	conn        RedisConn
 }
 
-func (r *RedisProcessor) redisConnection(redisInterface string) (err error) {
+func (r *RedisProcessor) redisConnection(redisInterface string, options *RedisOptions) (err error) {
 	if r.isConnected == false {
-		r.conn, err = RedisDialer("tcp", redisInterface)
+		r.conn, err = openRedis(redisInterface, options)
 		if err != nil {
 			// handle error
 			return err
@@ -55,8 +97,14 @@ func (r *RedisProcessor) redisConnection(redisInterface string) (err error) {
 // The redis decorator stores the email data in redis
 
 func Redis() Decorator {
+	return newRedis(nil)
+}
+
+// newRedis returns the redis processor, configure can change the config once it's loaded
+func newRedis(configure func(c *RedisProcessorConfig)) Decorator {
 
 	var config *RedisProcessorConfig
+	var options *RedisOptions
 	redisClient := &RedisProcessor{}
 	// read the config into RedisProcessorConfig
 	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
@@ -66,7 +114,19 @@ func Redis() Decorator {
 			return err
 		}
 		config = bcfg.(*RedisProcessorConfig)
-		if redisErr := redisClient.redisConnection(config.RedisInterface); redisErr != nil {
+		if configure != nil {
+			configure(config)
+		}
+		options = &config.RedisOptions
+		if err := options.validate(); err != nil {
+			return err
+		}
+		if redisErr := redisClient.redisConnection(config.RedisInterface, options); redisErr != nil {
+			if config.Fallback {
+				// connects again with the next envelope
+				ProcessorLog("redis").WithError(redisErr).Warn("redis cannot connect, the data will be saved by the next processor")
+				return nil
+			}
 			err := fmt.Errorf("redis cannot connect, check your settings: %s", redisErr)
 			return err
 		}
@@ -97,21 +157,28 @@ func Redis() Decorator {
 					} else {
 						stringer = e
 					}
-					redisErr = redisClient.redisConnection(config.RedisInterface)
+					redisErr = redisClient.redisConnection(config.RedisInterface, options)
 					if redisErr != nil {
-						Log().WithError(redisErr).Warn("Error while connecting to redis")
+						ProcessorLog("redis").WithQueuedID(e.ClientID, e.QueuedId).WithError(redisErr).Warn("Error while connecting to redis")
+						if config.Fallback {
+							return p.Process(e, task)
+						}
 						result := NewResult(response.Canned.FailBackendTransaction)
 						return result, redisErr
 					}
-					_, doErr := redisClient.conn.Do("SETEX", hash, config.RedisExpireSeconds, stringer)
+					// a string is sent as it is, other values would be copied again when formatted
+					_, doErr := redisClient.conn.Do("SETEX", config.KeyPrefix+hash, config.RedisExpireSeconds, stringer.String())
 					if doErr != nil {
-						Log().WithError(doErr).Warn("Error while SETEX to redis")
+						ProcessorLog("redis").WithQueuedID(e.ClientID, e.QueuedId).WithError(doErr).Warn("Error while SETEX to redis")
+						if config.Fallback {
+							return p.Process(e, task)
+						}
 						result := NewResult(response.Canned.FailBackendTransaction)
 						return result, doErr
 					}
 					e.Values["redis"] = "redis" // the next processor will know to look in redis for the message data
 				} else {
-					Log().Error("Redis needs a Hasher() process before it")
+					ProcessorLog("redis").WithQueuedID(e.ClientID, e.QueuedId).Error("Redis needs a Hasher() process before it")
 					result := NewResult(response.Canned.FailBackendTransaction)
 					return result, StorageError
 				}
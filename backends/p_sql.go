@@ -1,12 +1,17 @@
 package backends
 
 import (
+	"bytes"
+	"compress/zlib"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
 	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/retention"
 
 	"math/big"
 	"net"
@@ -32,6 +37,14 @@ import (
 //               : idle connection pool. The default is 2
 //               : sql_max_conn_lifetime - sets the maximum amount of time
 //               : a connection may be reused
+//               : sql_columns string - the columns and their fields, eg.
+//               : "hash=hash, subject=subject, date=NOW()", see sqlFields. The
+//               : default is the MySQL table, see sqlDefaultColumns
+//               : sql_batch_size int - rows inserted by each query, in the
+//               : background if more than 1. sql_batch_timeout string - how
+//               : long a batch waits for more rows, eg. "3s"
+//               : The retention rules apply to the table as the "sql:<mail_table>"
+//               : store, using its mail_id, date and recipient columns
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
 //               : e.DeliveryHeader generated by ParseHeader() processor
@@ -44,6 +57,9 @@ func init() {
 	processors["sql"] = func() Decorator {
 		return SQL()
 	}
+	processorConfigs["sql"] = func() BaseConfig {
+		return &SQLProcessorConfig{}
+	}
 }
 
 type SQLProcessorConfig struct {
@@ -56,18 +72,258 @@ type SQLProcessorConfig struct {
 	MaxConnLifetime string `json:"sql_max_conn_lifetime,omitempty"`
 	MaxOpenConns    int    `json:"sql_max_open_conns,omitempty"`
 	MaxIdleConns    int    `json:"sql_max_idle_conns,omitempty"`
+	// Columns maps the columns of the table to the fields of the envelope, eg. "hash=hash, subject=subject",
+	// or to SQL expressions, eg. "date=NOW(), charset='UTF-8'". sqlDefaultColumns if empty
+	Columns string `json:"sql_columns,omitempty"`
+	// BatchSize is how many rows are inserted by each query, up to GuerrillaDBAndRedisBatchMax.
+	// The rows are inserted in the background if more than 1, so a failed insert is only logged
+	BatchSize int `json:"sql_batch_size,omitempty"`
+	// BatchTimeout is how long a batch waits for more rows, eg. "3s". GuerrillaDBAndRedisBatchTimeout if empty
+	BatchTimeout string `json:"sql_batch_timeout,omitempty"`
+}
+
+// sqlDefaultColumns are the columns of the default MySQL table
+const sqlDefaultColumns = "date=NOW(), to=to, from=from, subject=subject, body=body, mail=mail, spam_score=0, " +
+	"hash=hash, content_type=content_type, recipient=recipient, has_attach=0, ip_addr=ip_addr, " +
+	"return_path=return_path, is_tls=is_tls, message_id=message_id, reply_to=reply_to, sender=sender"
+
+// sqlRow is what the fields of a row are taken from
+type sqlRow struct {
+	s *SQLProcessor
+	e *mail.Envelope
+	// rcpt is the index of the row's recipient in e.RcptTo
+	rcpt int
+	hash string
+	// body describes how to interpret the data, eg 'redis' means stored in redis,
+	// and 'gzip' stored in mysql, using gzip compression
+	body string
+	co   *DataCompressor
+}
+
+// sqlField returns the value of a field of a row
+type sqlField func(r *sqlRow) interface{}
+
+// sqlFields are the fields that sql_columns can map the columns to
+var sqlFields = map[string]sqlField{
+	// to is the To header, otherwise the recipient
+	"to": func(r *sqlRow) interface{} {
+		if to := trimToLimit(r.s.fillAddressFromHeader(r.e, "To"), 255); to != "" {
+			return to
+		}
+		return trimToLimit(strings.TrimSpace(r.e.RcptTo[r.rcpt].String()), 255)
+	},
+	"from": func(r *sqlRow) interface{} {
+		return trimToLimit(r.e.MailFrom.String(), 255)
+	},
+	"subject": func(r *sqlRow) interface{} {
+		return trimToLimit(r.e.Subject, 255)
+	},
+	"body": func(r *sqlRow) interface{} {
+		return r.body
+	},
+	// mail is the data, empty if it was saved in redis
+	"mail": func(r *sqlRow) interface{} {
+		if r.body == "redis" {
+			return ""
+		} else if r.co != nil {
+			// use a compressor (automatically adds e.DeliveryHeader)
+			return r.co.String()
+		}
+		return r.e.String()
+	},
+	// hash is the redis key if saved in redis
+	"hash": func(r *sqlRow) interface{} {
+		return r.hash
+	},
+	"content_type": func(r *sqlRow) interface{} {
+		return trimToLimit(r.e.HeaderValue("Content-Type"), 255)
+	},
+	"recipient": func(r *sqlRow) interface{} {
+		return trimToLimit(strings.TrimSpace(r.e.RcptTo[r.rcpt].String()), 255)
+	},
+	// primary_recipient is the recipient's user at the primary_mail_host
+	"primary_recipient": func(r *sqlRow) interface{} {
+		return trimToLimit(strings.TrimSpace(r.e.RcptTo[r.rcpt].User)+"@"+r.s.config.PrimaryHost, 255)
+	},
+	// ip_addr is stored as varbinary(16)
+	"ip_addr": func(r *sqlRow) interface{} {
+		return r.s.ip2bint(r.e.RemoteIP).Bytes()
+	},
+	"remote_ip": func(r *sqlRow) interface{} {
+		return r.e.RemoteIP
+	},
+	"return_path": func(r *sqlRow) interface{} {
+		return trimToLimit(r.e.MailFrom.String(), 255)
+	},
+	"is_tls": func(r *sqlRow) interface{} {
+		return r.e.TLS
+	},
+	"message_id": func(r *sqlRow) interface{} {
+		if mid := trimToLimit(r.s.fillAddressFromHeader(r.e, "Message-Id"), 255); mid != "" {
+			return mid
+		}
+		return fmt.Sprintf("%s.%s@%s", r.hash, r.e.RcptTo[r.rcpt].User, r.s.config.PrimaryHost)
+	},
+	// reply_to is the 'Reply-to' header, it may be blank
+	"reply_to": func(r *sqlRow) interface{} {
+		return trimToLimit(r.s.fillAddressFromHeader(r.e, "Reply-To"), 255)
+	},
+	// sender is the 'Sender' header, it may be blank
+	"sender": func(r *sqlRow) interface{} {
+		return trimToLimit(r.s.fillAddressFromHeader(r.e, "Sender"), 255)
+	},
+	"helo": func(r *sqlRow) interface{} {
+		return trimToLimit(r.e.Helo, 255)
+	},
+	"queued_id": func(r *sqlRow) interface{} {
+		return r.e.QueuedId
+	},
+}
+
+// sqlColumn is a column of the table, and its field or its SQL expression
+type sqlColumn struct {
+	name  string
+	field sqlField
+	expr  string
+}
+
+// parseSQLColumns parses the column=value pairs of sql_columns. A value that is a name must be one of
+// the fields, other values are SQL expressions that are written in the query as they are
+func parseSQLColumns(columns string, fields map[string]sqlField) ([]sqlColumn, error) {
+	var list []sqlColumn
+	for _, pair := range splitSQLList(columns) {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("sql_columns: [%s] is not a column=value pair", pair)
+		}
+		c := sqlColumn{name: strings.TrimSpace(pair[:i])}
+		value := strings.TrimSpace(pair[i+1:])
+		if !isSQLName(c.name) {
+			return nil, fmt.Errorf("sql_columns: [%s] is not a column name", c.name)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("sql_columns: column [%s] has no value", c.name)
+		}
+		if isSQLName(value) && (value[0] < '0' || value[0] > '9') {
+			if c.field = fields[strings.ToLower(value)]; c.field == nil {
+				return nil, fmt.Errorf("sql_columns: column [%s] has an unknown field [%s]", c.name, value)
+			}
+		} else {
+			c.expr = value
+		}
+		list = append(list, c)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("sql_columns has no columns")
+	}
+	return list, nil
+}
+
+// splitSQLList splits s at the commas that are not in parentheses or quotes
+func splitSQLList(s string) []string {
+	var list []string
+	var depth int
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			list = append(list, s[start:i])
+			start = i + 1
+		}
+	}
+	if strings.TrimSpace(s[start:]) != "" {
+		list = append(list, s[start:])
+	}
+	return list
+}
+
+func isSQLName(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return s != ""
 }
 
 type SQLProcessor struct {
-	cache  stmtCache
-	config *SQLProcessorConfig
+	cache   stmtCache
+	config  *SQLProcessorConfig
+	columns []sqlColumn
+}
+
+// Validate checks the options, without connecting to the database
+func (c *SQLProcessorConfig) Validate() error {
+	return c.validate(sqlFields)
+}
+
+// validate checks the options, the columns can be mapped to the fields
+func (c *SQLProcessorConfig) validate(fields map[string]sqlField) error {
+	if c.Columns != "" && (c.SQLInsert != "" || c.SQLValues != "") {
+		return errors.New("sql_columns cannot be used with sql_insert or sql_values")
+	}
+	if c.BatchSize < 0 || c.BatchSize > GuerrillaDBAndRedisBatchMax {
+		return fmt.Errorf("sql_batch_size must be between 1 and %d", GuerrillaDBAndRedisBatchMax)
+	}
+	for key, val := range map[string]string{
+		"sql_batch_timeout":     c.BatchTimeout,
+		"sql_max_conn_lifetime": c.MaxConnLifetime,
+	} {
+		if val == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(val); err != nil || d <= 0 {
+			return fmt.Errorf("%s [%s] is not a valid duration", key, val)
+		}
+	}
+	_, err := parseSQLColumns(c.columns(), fields)
+	return err
+}
+
+// columns returns the sql_columns, sqlDefaultColumns if not set
+func (c *SQLProcessorConfig) columns() string {
+	if c.Columns == "" {
+		return sqlDefaultColumns
+	}
+	return c.Columns
+}
+
+// CheckConnectivity connects to the database, and checks that the table can be read
+func (c *SQLProcessorConfig) CheckConnectivity() error {
+	s := &SQLProcessor{config: c}
+	db, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// configure checks the config and parses its columns
+func (s *SQLProcessor) configure(config *SQLProcessorConfig, fields map[string]sqlField) (err error) {
+	if err := config.validate(fields); err != nil {
+		return err
+	}
+	s.config = config
+	s.columns, err = parseSQLColumns(config.columns(), fields)
+	return err
 }
 
 func (s *SQLProcessor) connect() (*sql.DB, error) {
 	var db *sql.DB
 	var err error
 	if db, err = sql.Open(s.config.Driver, s.config.DSN); err != nil {
-		Log().Error("cannot open database: ", err)
+		ProcessorLog("sql").Error("cannot open database: ", err)
 		return nil, err
 	}
 
@@ -86,10 +342,12 @@ func (s *SQLProcessor) connect() (*sql.DB, error) {
 	}
 
 	// do we have permission to access the table?
-	_, err = db.Query("SELECT mail_id FROM " + s.config.Table + " LIMIT 1")
+	rows, err := db.Query("SELECT mail_id FROM " + s.config.Table + " LIMIT 1")
 	if err != nil {
+		_ = db.Close()
 		return nil, err
 	}
+	_ = rows.Close()
 	return db, err
 }
 
@@ -111,16 +369,22 @@ func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 		}
 	} else {
 		// Default to MySQL SQL
-		sqlstr = "INSERT INTO " + s.config.Table + " "
-		sqlstr += "(`date`, `to`, `from`, `subject`, `body`,  `mail`, `spam_score`, "
-		sqlstr += "`hash`, `content_type`, `recipient`, `has_attach`, `ip_addr`, "
-		sqlstr += "`return_path`, `is_tls`, `message_id`, `reply_to`, `sender`)"
-		sqlstr += " VALUES "
+		names := make([]string, len(s.columns))
+		for i := range s.columns {
+			names[i] = "`" + s.columns[i].name + "`"
+		}
+		sqlstr = "INSERT INTO " + s.config.Table + " (" + strings.Join(names, ", ") + ") VALUES "
 	}
 	if s.config.SQLValues != "" {
 		values = s.config.SQLValues
 	} else {
-		values = "(NOW(), ?, ?, ?, ? , ?, 0, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?)"
+		exprs := make([]string, len(s.columns))
+		for i := range s.columns {
+			if exprs[i] = s.columns[i].expr; exprs[i] == "" {
+				exprs[i] = "?"
+			}
+		}
+		values = "(" + strings.Join(exprs, ", ") + ")"
 	}
 	// add more rows
 	comma := ""
@@ -132,7 +396,7 @@ func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 	}
 	stmt, sqlErr := db.Prepare(sqlstr)
 	if sqlErr != nil {
-		Log().WithError(sqlErr).Panic("failed while db.Prepare(INSERT...)")
+		ProcessorLog("sql").WithError(sqlErr).Panic("failed while db.Prepare(INSERT...)")
 	}
 	// cache it
 	s.cache[rows-1] = stmt
@@ -142,14 +406,14 @@ func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]interface{}) (execErr error) {
 	defer func() {
 		if r := recover(); r != nil {
-			Log().Error("Recovered form panic:", r, string(debug.Stack()))
+			ProcessorLog("sql").Error("Recovered form panic:", r, string(debug.Stack()))
 			sum := 0
 			for _, v := range *vals {
 				if str, ok := v.(string); ok {
 					sum = sum + len(str)
 				}
 			}
-			Log().Errorf("panic while inserting query [%s] size:%d, err %v", r, sum, execErr)
+			ProcessorLog("sql").Errorf("panic while inserting query [%s] size:%d, err %v", r, sum, execErr)
 			panic("query failed")
 		}
 	}()
@@ -157,11 +421,32 @@ func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]
 	insertStmt = s.prepareInsertQuery(c, db)
 	_, execErr = insertStmt.Exec(*vals...)
 	if execErr != nil {
-		Log().WithError(execErr).Error("There was a problem the insert")
+		ProcessorLog("sql").WithError(execErr).Error("There was a problem the insert")
 	}
 	return
 }
 
+// insert inserts the rows of vals, recovering from a failed query
+func (s *SQLProcessor) insert(c int, db *sql.DB, vals []interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return s.doQuery(c, db, nil, &vals)
+}
+
+// values returns the values of the fields of the row, in the order of the columns
+func (s *SQLProcessor) values(r *sqlRow) []interface{} {
+	vals := make([]interface{}, 0, len(s.columns))
+	for i := range s.columns {
+		if s.columns[i].field != nil {
+			vals = append(vals, s.columns[i].field(r))
+		}
+	}
+	return vals
+}
+
 // for storing ip addresses in the ip_addr column
 func (s *SQLProcessor) ip2bint(ip string) *big.Int {
 	bint := big.NewInt(0)
@@ -175,20 +460,107 @@ func (s *SQLProcessor) ip2bint(ip string) *big.Int {
 }
 
 func (s *SQLProcessor) fillAddressFromHeader(e *mail.Envelope, headerKey string) string {
-	if v, ok := e.Header[headerKey]; ok {
-		addr, err := mail.NewAddress(v[0])
+	if list, err := e.HeaderAddresses(headerKey); err == nil && len(list) > 0 {
+		return list[0].String()
+	}
+	return ""
+}
+
+// sqlBatcher inserts the rows it's fed in batches, when a batch is full or has waited for the timeout
+type sqlBatcher struct {
+	s       *SQLProcessor
+	db      *sql.DB
+	size    int
+	timeout time.Duration
+	feeder  chan []interface{}
+	done    chan struct{}
+}
+
+func newSQLBatcher(s *SQLProcessor, db *sql.DB) *sqlBatcher {
+	b := &sqlBatcher{
+		s:       s,
+		db:      db,
+		size:    s.config.BatchSize,
+		timeout: GuerrillaDBAndRedisBatchTimeout,
+		feeder:  make(chan []interface{}, 1),
+		done:    make(chan struct{}),
+	}
+	if d, err := time.ParseDuration(s.config.BatchTimeout); err == nil && d > 0 {
+		b.timeout = d
+	}
+	go b.run()
+	return b
+}
+
+// add queues the values of a row
+func (b *sqlBatcher) add(vals []interface{}) {
+	b.feeder <- vals
+}
+
+// stop inserts the queued rows and stops the batcher
+func (b *sqlBatcher) stop() {
+	close(b.feeder)
+	<-b.done
+}
+
+func (b *sqlBatcher) run() {
+	defer close(b.done)
+	var vals []interface{}
+	count := 0
+	inserter := func() {
+		if count == 0 {
+			return
+		}
+		err := b.s.insert(count, b.db, vals)
+		// maybe a connection problem, retry the query
+		for i := 0; err != nil && i < 3; i++ {
+			ProcessorLog("sql").Infof("retrying query rows[%d]", count)
+			time.Sleep(time.Second)
+			err = b.s.insert(count, b.db, vals)
+		}
 		if err != nil {
-			return ""
+			ProcessorLog("sql").WithError(err).Errorf("could not insert %d rows to %s", count, b.s.config.Table)
+		}
+		vals = nil
+		count = 0
+	}
+	t := time.NewTimer(b.timeout)
+	defer t.Stop()
+	for {
+		select {
+		case row, ok := <-b.feeder:
+			if !ok {
+				// insert the remaining rows
+				inserter()
+				return
+			}
+			vals = append(vals, row...)
+			count++
+			if count >= b.size {
+				inserter()
+			}
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(b.timeout)
+		case <-t.C:
+			inserter()
+			t.Reset(b.timeout)
 		}
-		return addr.String()
 	}
-	return ""
 }
 
+// SQL saves the rows of the envelope's recipients in the mail table
 func SQL() Decorator {
+	return newSQL(nil, sqlFields)
+}
+
+// newSQL returns the sql processor. configure can change the config once it's loaded, and fields
+// are the fields that the columns can be mapped to
+func newSQL(configure func(c *SQLProcessorConfig), fields map[string]sqlField) Decorator {
 	var config *SQLProcessorConfig
-	var vals []interface{}
 	var db *sql.DB
+	var batcher *sqlBatcher
 	s := &SQLProcessor{}
 
 	// open the database connection (it will also check if we can select the table)
@@ -199,16 +571,29 @@ func SQL() Decorator {
 			return err
 		}
 		config = bcfg.(*SQLProcessorConfig)
-		s.config = config
+		if configure != nil {
+			configure(config)
+		}
+		if err := s.configure(config, fields); err != nil {
+			return err
+		}
 		db, err = s.connect()
 		if err != nil {
 			return err
 		}
+		if config.BatchSize > 1 {
+			batcher = newSQLBatcher(s, db)
+		}
+		Svc.AddStore("sql:"+config.Table, &sqlStore{db: db, table: config.Table})
 		return nil
 	}))
 
 	// shutdown will close the database connection
 	Svc.AddShutdowner(ShutdownWith(func() error {
+		if batcher != nil {
+			batcher.stop()
+			batcher = nil
+		}
 		if db != nil {
 			return db.Close()
 		}
@@ -219,83 +604,30 @@ func SQL() Decorator {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 
 			if task == TaskSaveMail {
-				var to, body string
-
-				hash := ""
+				row := sqlRow{s: s, e: e}
 				if len(e.Hashes) > 0 {
-					hash = e.Hashes[0]
+					row.hash = e.Hashes[0]
 					e.QueuedId = e.Hashes[0]
 				}
 
-				var co *DataCompressor
 				// a compressor was set by the Compress processor
 				if c, ok := e.Values["zlib-compressor"]; ok {
-					body = "gzip"
-					co = c.(*DataCompressor)
+					row.body = "gzip"
+					row.co = c.(*DataCompressor)
 				}
 				// was saved in redis by the Redis processor
 				if _, ok := e.Values["redis"]; ok {
-					body = "redis"
+					row.body = "redis"
 				}
 
 				for i := range e.RcptTo {
-
-					// use the To header, otherwise rcpt to
-					to = trimToLimit(s.fillAddressFromHeader(e, "To"), 255)
-					if to == "" {
-						// trimToLimit(strings.TrimSpace(e.RcptTo[i].User)+"@"+config.PrimaryHost, 255)
-						to = trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255)
-					}
-					mid := trimToLimit(s.fillAddressFromHeader(e, "Message-Id"), 255)
-					if mid == "" {
-						mid = fmt.Sprintf("%s.%s@%s", hash, e.RcptTo[i].User, config.PrimaryHost)
-					}
-					// replyTo is the 'Reply-to' header, it may be blank
-					replyTo := trimToLimit(s.fillAddressFromHeader(e, "Reply-To"), 255)
-					// sender is the 'Sender' header, it may be blank
-					sender := trimToLimit(s.fillAddressFromHeader(e, "Sender"), 255)
-
-					recipient := trimToLimit(strings.TrimSpace(e.RcptTo[i].String()), 255)
-					contentType := ""
-					if v, ok := e.Header["Content-Type"]; ok {
-						contentType = trimToLimit(v[0], 255)
-					}
-
+					row.rcpt = i
 					// build the values for the query
-					vals = []interface{}{} // clear the vals
-					vals = append(vals,
-						to,
-						trimToLimit(e.MailFrom.String(), 255), // from
-						trimToLimit(e.Subject, 255),
-						body, // body describes how to interpret the data, eg 'redis' means stored in redis, and 'gzip' stored in mysql, using gzip compression
-					)
-					// `mail` column
-					if body == "redis" {
-						// data already saved in redis
-						vals = append(vals, "")
-					} else if co != nil {
-						// use a compressor (automatically adds e.DeliveryHeader)
-						vals = append(vals, co.String())
-
-					} else {
-						vals = append(vals, e.String())
+					vals := s.values(&row)
+					if batcher != nil {
+						batcher.add(vals)
+						continue
 					}
-
-					vals = append(vals,
-						hash, // hash (redis hash if saved in redis)
-						contentType,
-						recipient,
-						s.ip2bint(e.RemoteIP).Bytes(),         // ip_addr store as varbinary(16)
-						trimToLimit(e.MailFrom.String(), 255), // return_path
-						// is_tls
-						e.TLS,
-						// message_id
-						mid,
-						// reply_to
-						replyTo,
-						sender,
-					)
-
 					stmt := s.prepareInsertQuery(1, db)
 					err := s.doQuery(1, db, stmt, &vals)
 					if err != nil {
@@ -325,3 +657,77 @@ func SQL() Decorator {
 		})
 	}
 }
+
+// sqlStore lets the retention rules delete the rows of the mail table
+type sqlStore struct {
+	db    *sql.DB
+	table string
+}
+
+// sqlDeleteBatch is how many rows are deleted by each query
+const sqlDeleteBatch = 100
+
+// Expire implements retention.Store
+func (s *sqlStore) Expire(before time.Time, expired func(m retention.Message) bool) (int, error) {
+	rows, err := s.db.Query("SELECT `mail_id`, `recipient` FROM "+s.table+" WHERE `date` < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	var messages []retention.Message
+	for rows.Next() {
+		var m retention.Message
+		if err := rows.Scan(&m.ID, &m.Recipient); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		messages = append(messages, m)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	// the rows are read before the messages are opened, which takes another connection
+	var ids []interface{}
+	for i := range messages {
+		id := messages[i].ID
+		messages[i].Open = func() (io.Reader, error) {
+			return s.open(id)
+		}
+		if expired(messages[i]) {
+			ids = append(ids, id)
+		}
+	}
+	var deleted int
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > sqlDeleteBatch {
+			n = sqlDeleteBatch
+		}
+		query := "DELETE FROM " + s.table + " WHERE `mail_id` IN (?" + strings.Repeat(",?", n-1) + ")"
+		res, err := s.db.Exec(query, ids[:n]...)
+		if err != nil {
+			return deleted, err
+		}
+		affected, _ := res.RowsAffected()
+		deleted += int(affected)
+		ids = ids[n:]
+	}
+	return deleted, nil
+}
+
+// open reads the message of a row, decompressed if it was saved with the Compressor processor
+func (s *sqlStore) open(id string) (io.Reader, error) {
+	var data []byte
+	var body string
+	err := s.db.QueryRow("SELECT `mail`, `body` FROM "+s.table+" WHERE `mail_id` = ?", id).Scan(&data, &body)
+	if err != nil {
+		return nil, err
+	}
+	switch body {
+	case "gzip":
+		return zlib.NewReader(bytes.NewReader(data))
+	case "redis":
+		return nil, errors.New("the message is saved in redis")
+	}
+	return bytes.NewReader(data), nil
+}
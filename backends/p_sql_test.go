@@ -2,10 +2,13 @@ package backends
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"flag"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -93,3 +96,150 @@ func findRows(hash string) ([]string, error) {
 	}
 	return results, nil
 }
+
+// fakeSQL is a database/sql driver that records the inserts
+type fakeSQL struct {
+	sync.Mutex
+	queries []string
+	args    [][]driver.Value
+}
+
+var fakeDB = &fakeSQL{}
+
+func init() {
+	sql.Register("fakesql", fakeDB)
+}
+
+func (d *fakeSQL) reset() {
+	d.Lock()
+	defer d.Unlock()
+	d.queries, d.args = nil, nil
+}
+
+func (d *fakeSQL) Open(name string) (driver.Conn, error) {
+	return fakeSQLConn{d}, nil
+}
+
+type fakeSQLConn struct {
+	d *fakeSQL
+}
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeSQLStmt{d: c.d, query: query}, nil
+}
+
+func (c fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, driver.ErrSkip
+}
+
+type fakeSQLStmt struct {
+	d     *fakeSQL
+	query string
+}
+
+func (s fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s fakeSQLStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.Lock()
+	defer s.d.Unlock()
+	s.d.queries = append(s.d.queries, s.query)
+	s.d.args = append(s.d.args, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return fakeSQLRows{}, nil
+}
+
+// fakeSQLRows is an empty result
+type fakeSQLRows struct{}
+
+func (fakeSQLRows) Columns() []string {
+	return []string{"mail_id"}
+}
+
+func (fakeSQLRows) Close() error {
+	return nil
+}
+
+func (fakeSQLRows) Next(dest []driver.Value) error {
+	return io.EOF
+}
+
+func TestSQLColumns(t *testing.T) {
+	mainlog, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	Svc.SetMainlog(mainlog)
+	fakeDB.reset()
+	gateway := &BackendGateway{}
+	if err := gateway.Initialize(BackendConfig{
+		"save_process":      "Hasher|SQL",
+		"save_workers_size": 1,
+		"mail_table":        "messages",
+		"primary_mail_host": "example.com",
+		"sql_driver":        "fakesql",
+		"sql_dsn":           "test",
+		"sql_columns":       "id=hash, rcpt=recipient, subj=subject, received=NOW(), note=CONCAT('a', 'b'), kind='mail'",
+	}); err != nil {
+		t.Fatal("Gateway did not init because:", err)
+	}
+	if err := gateway.Start(); err != nil {
+		t.Fatal("Gateway did not start because:", err)
+	}
+	defer func() { _ = gateway.Shutdown() }()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "alice", Host: "example.com"})
+	e.PushRcpt(mail.Address{User: "bob", Host: "example.com"})
+	e.Subject = "hello"
+	if r := gateway.Process(e); r.Code() != 250 {
+		t.Fatal("expecting the envelope to be saved, got", r.String())
+	}
+	fakeDB.Lock()
+	defer fakeDB.Unlock()
+	expected := "INSERT INTO messages (`id`, `rcpt`, `subj`, `received`, `note`, `kind`) " +
+		"VALUES (?, ?, ?, NOW(), CONCAT('a', 'b'), 'mail')"
+	if len(fakeDB.queries) != 2 || fakeDB.queries[0] != expected {
+		t.Fatal("unexpected queries", fakeDB.queries)
+	}
+	if args := fakeDB.args[1]; len(args) != 3 || args[0] != e.Hashes[0] || args[1] != "bob@example.com" || args[2] != "hello" {
+		t.Error("unexpected values", args)
+	}
+}
+
+func TestSQLColumnsInvalid(t *testing.T) {
+	for _, c := range []string{
+		"hash",
+		"id=",
+		"id=hashes",
+		"id column=hash",
+		",",
+	} {
+		if _, err := parseSQLColumns(c, sqlFields); err == nil {
+			t.Errorf("expected [%s] to be invalid", c)
+		}
+	}
+	s := &SQLProcessor{}
+	for _, c := range []SQLProcessorConfig{
+		{Columns: "id=hash", SQLInsert: "INSERT INTO messages (id) VALUES "},
+		{BatchSize: GuerrillaDBAndRedisBatchMax + 1},
+		{BatchSize: 10, BatchTimeout: "soon"},
+	} {
+		if err := s.configure(&c, sqlFields); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+	// the default columns are the MySQL table
+	if err := s.configure(&SQLProcessorConfig{}, sqlFields); err != nil || len(s.columns) != 17 {
+		t.Error("unexpected default columns", len(s.columns), err)
+	}
+}
@@ -0,0 +1,39 @@
+package backends
+
+import (
+	"time"
+)
+
+// panicWindow is how long the panics of a stack are counted for gw_panic_limit
+const panicWindow = time.Minute
+
+// defaultPanicCooldown is how long a stack stays disabled when gw_panic_cooldown is not set
+const defaultPanicCooldown = time.Minute * 5
+
+// PanicInfo describes a panic of a processor, recovered by a worker of the gateway
+type PanicInfo struct {
+	// Stack names the stack of the processor, eg. "save_process", "save_routes.archive" or "validate_process"
+	Stack    string `json:"stack"`
+	Worker   int    `json:"worker"`
+	QueuedID string `json:"queued_id,omitempty"`
+	// Value is the value passed to panic
+	Value string `json:"value"`
+	// Trace is the stack trace of the worker when it panicked
+	Trace string `json:"trace"`
+	// Disabled is true when the panic disabled the stack, because of gw_panic_limit
+	Disabled bool `json:"disabled"`
+}
+
+// PanicHandler is called with each panic recovered by the workers, it should return quickly
+type PanicHandler func(p PanicInfo)
+
+// FallbackInfo describes an email that save_process failed to save, saved by save_process_fallback instead
+type FallbackInfo struct {
+	Worker   int    `json:"worker"`
+	QueuedID string `json:"queued_id"`
+	// Error is why save_process failed
+	Error string `json:"error"`
+}
+
+// FallbackHandler is called each time save_process_fallback is used, it should return quickly
+type FallbackHandler func(f FallbackInfo)
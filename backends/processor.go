@@ -37,6 +37,28 @@ func (f ProcessWith) Process(e *mail.Envelope, task SelectTask) (Result, error)
 	return f(e, task)
 }
 
+// traced wraps the processor made by d in a span named after the processor.
+// The span is a child of the envelope's span, and is the envelope's span while the processor runs,
+// so the spans of the processors further down the stack are nested in it
+func traced(name string, d Decorator) Decorator {
+	return func(p Processor) Processor {
+		next := d(p)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if e.Span == nil {
+				return next.Process(e, task)
+			}
+			parent := e.Span
+			e.Span = parent.Child("processor " + name)
+			e.Span.SetAttribute("guerrilla.task", task.String())
+			result, err := next.Process(e, task)
+			e.Span.SetError(err)
+			e.Span.End()
+			e.Span = parent
+			return result, err
+		})
+	}
+}
+
 // DefaultProcessor is a undecorated worker that does nothing
 // Notice DefaultProcessor has no knowledge of the other decorators that have orthogonal concerns.
 type DefaultProcessor struct{}
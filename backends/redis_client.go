@@ -0,0 +1,561 @@
+package backends
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisOptions are how the processors that use redis connect to it, in addition to their redis_interface.
+// redis_interface is <host>:<port>, or a comma separated list of the sentinels or of the cluster's nodes
+type RedisOptions struct {
+	// Username is the ACL user, the default user if empty
+	Username string `json:"redis_username,omitempty"`
+	// Password is sent with AUTH, no AUTH if empty
+	Password string `json:"redis_password,omitempty"`
+	// DB is the database selected, not used with a cluster
+	DB int `json:"redis_db,omitempty"`
+	// SentinelMaster is the name of the master that the sentinels in redis_interface give the address of
+	SentinelMaster string `json:"redis_sentinel_master,omitempty"`
+	// SentinelPassword is the password of the sentinels, no AUTH if empty
+	SentinelPassword string `json:"redis_sentinel_password,omitempty"`
+	// Cluster sends the commands to the cluster's node that holds the key's slot
+	Cluster bool `json:"redis_cluster,omitempty"`
+	// TLS connects with TLS, verified with the system's roots or TLSCAFile
+	TLS           bool   `json:"redis_tls,omitempty"`
+	TLSSkipVerify bool   `json:"redis_tls_skip_verify,omitempty"`
+	TLSCAFile     string `json:"redis_tls_ca_file,omitempty"`
+	// PoolSize is the maximum number of connections to each server, shared by the workers.
+	// Unlimited if 0
+	PoolSize int `json:"redis_pool_size,omitempty"`
+	// Timeout is the timeout of connecting, and of each command, eg. "5s". No timeout if empty
+	Timeout string `json:"redis_timeout,omitempty"`
+}
+
+const (
+	// redisDefaultIdle is how many idle connections are kept when the pool size is unlimited
+	redisDefaultIdle = 10
+	// redisMaxRedirects is how many times a cluster command is redirected to another node
+	redisMaxRedirects = 5
+	// redisSlots is the number of hash slots of a cluster
+	redisSlots = 16384
+)
+
+func (o *RedisOptions) validate() error {
+	if o.Timeout != "" {
+		if d, err := time.ParseDuration(o.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("redis_timeout [%s] is not a valid duration", o.Timeout)
+		}
+	}
+	if o.PoolSize < 0 {
+		return errors.New("redis_pool_size cannot be negative")
+	}
+	if o.Cluster && o.SentinelMaster != "" {
+		return errors.New("redis_cluster and redis_sentinel_master cannot be used together")
+	}
+	return nil
+}
+
+// dialOptions returns the options of the network connections, and the options of the servers and of the
+// sentinels, which add their AUTH
+func (o *RedisOptions) dialOptions() (server, sentinel []RedisDialOption, err error) {
+	if err := o.validate(); err != nil {
+		return nil, nil, err
+	}
+	timeout, _ := time.ParseDuration(o.Timeout)
+	dialer := &net.Dialer{Timeout: timeout}
+	dial := dialer.Dial
+	if o.TLS {
+		config := &tls.Config{InsecureSkipVerify: o.TLSSkipVerify}
+		if o.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(o.TLSCAFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not read redis_tls_ca_file: %s", err)
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, nil, fmt.Errorf("redis_tls_ca_file [%s] has no certificates", o.TLSCAFile)
+			}
+		}
+		dial = func(network, addr string) (net.Conn, error) {
+			c := config.Clone()
+			c.ServerName, _, _ = net.SplitHostPort(addr)
+			return tls.DialWithDialer(dialer, network, addr, c)
+		}
+	}
+	common := []RedisDialOption{
+		RedisDialNetDial(dial),
+		RedisDialReadTimeout(timeout),
+		RedisDialWriteTimeout(timeout),
+	}
+	server = append(common[:len(common):len(common)],
+		RedisDialUsername(o.Username), RedisDialPassword(o.Password), RedisDialDatabase(o.DB))
+	sentinel = append(common[:len(common):len(common)], RedisDialPassword(o.SentinelPassword))
+	return server, sentinel, nil
+}
+
+// redisConns are the connections opened by openRedis, keyed by their settings
+var redisConns = struct {
+	sync.Mutex
+	m map[string]*redisShared
+}{m: make(map[string]*redisShared)}
+
+type redisShared struct {
+	conn RedisConn
+	refs int
+}
+
+// sharedRedisConn is a connection returned by openRedis, closing it releases it
+type sharedRedisConn struct {
+	RedisConn
+	key  string
+	once sync.Once
+}
+
+func (c *sharedRedisConn) Close() (err error) {
+	c.once.Do(func() {
+		redisConns.Lock()
+		defer redisConns.Unlock()
+		s := redisConns.m[c.key]
+		if s.refs--; s.refs == 0 {
+			delete(redisConns.m, c.key)
+			err = s.conn.Close()
+		}
+	})
+	return
+}
+
+// openRedis returns a connection to redis, shared by the processors that have the same settings, eg. the processors
+// of each worker. It's safe for concurrent use, and reconnects when needed. Close it when shutting down
+func openRedis(redisInterface string, o *RedisOptions) (RedisConn, error) {
+	key := redisInterface + fmt.Sprintf("|%+v", *o)
+	redisConns.Lock()
+	defer redisConns.Unlock()
+	s, ok := redisConns.m[key]
+	if !ok {
+		conn, err := newRedisConn(redisInterface, o)
+		if err != nil {
+			return nil, err
+		}
+		s = &redisShared{conn: conn}
+		redisConns.m[key] = s
+	}
+	s.refs++
+	return &sharedRedisConn{RedisConn: s.conn, key: key}, nil
+}
+
+// newRedisConn connects to a server, to the master given by the sentinels or to a cluster
+func newRedisConn(redisInterface string, o *RedisOptions) (RedisConn, error) {
+	server, sentinel, err := o.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, addr := range strings.Split(redisInterface, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("redis_interface is empty")
+	}
+	if o.Cluster {
+		c := &redisCluster{
+			seeds:    addrs,
+			poolSize: o.PoolSize,
+			nodes:    make(map[string]*redisPool),
+			dial: func(addr string) (RedisConn, error) {
+				return RedisDialer("tcp", addr, server...)
+			},
+		}
+		if err := c.refresh(); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	dial := func() (RedisConn, error) {
+		return RedisDialer("tcp", addrs[0], server...)
+	}
+	if o.SentinelMaster != "" {
+		dial = func() (RedisConn, error) {
+			return dialRedisMaster(addrs, o.SentinelMaster, sentinel, server)
+		}
+	}
+	p := newRedisPool(dial, o.PoolSize)
+	// connect now, so that bad settings are reported when initializing
+	if err := p.connect(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// redisPool is a RedisConn that sends each command on one of its connections, which are opened when needed
+type redisPool struct {
+	dial func() (RedisConn, error)
+	idle chan RedisConn
+	// sem limits the number of connections, nil if unlimited
+	sem    chan struct{}
+	mu     sync.Mutex
+	closed bool
+}
+
+func newRedisPool(dial func() (RedisConn, error), size int) *redisPool {
+	p := &redisPool{dial: dial}
+	if size > 0 {
+		p.sem = make(chan struct{}, size)
+		p.idle = make(chan RedisConn, size)
+	} else {
+		p.idle = make(chan RedisConn, redisDefaultIdle)
+	}
+	return p
+}
+
+// connect opens a connection and keeps it idle
+func (p *redisPool) connect() error {
+	c, err := p.dial()
+	if err != nil {
+		return err
+	}
+	p.put(c)
+	return nil
+}
+
+// get returns an idle connection, or opens one
+func (p *redisPool) get() (RedisConn, error) {
+	if p.sem != nil {
+		p.sem <- struct{}{}
+	}
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+	c, err := p.dial()
+	if err != nil && p.sem != nil {
+		<-p.sem
+	}
+	return c, err
+}
+
+// put makes the connection idle, or closes it if the pool is closed or has enough idle connections
+func (p *redisPool) put(c RedisConn) {
+	p.mu.Lock()
+	closed := p.closed
+	if !closed {
+		select {
+		case p.idle <- c:
+			c = nil
+		default:
+		}
+	}
+	p.mu.Unlock()
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+func (p *redisPool) Do(commandName string, args ...interface{}) (interface{}, error) {
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.Do(commandName, args...)
+	if err != nil && redisBroken(c, err) {
+		_ = c.Close()
+	} else {
+		p.put(c)
+	}
+	if p.sem != nil {
+		<-p.sem
+	}
+	return reply, err
+}
+
+// Close closes the idle connections, the busy connections are closed once their command is done
+func (p *redisPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	var err error
+	for {
+		select {
+		case c := <-p.idle:
+			if closeErr := c.Close(); closeErr != nil {
+				err = closeErr
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// redisBroken returns true if the connection cannot be used after err. Errors that redis replied with,
+// eg. WRONGTYPE, leave the connection usable
+func redisBroken(c RedisConn, err error) bool {
+	// eg. a redigo connection
+	if e, ok := c.(interface{ Err() error }); ok {
+		return e.Err() != nil
+	}
+	_, netErr := err.(net.Error)
+	return netErr || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// dialRedisMaster connects to the master that the first sentinel able to answer gives the address of
+func dialRedisMaster(sentinels []string, master string, sentinelOptions, serverOptions []RedisDialOption) (RedisConn, error) {
+	var lastErr error
+	for _, sentinel := range sentinels {
+		addr, err := redisSentinelMaster(sentinel, master, sentinelOptions)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c, err := RedisDialer("tcp", addr, serverOptions...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// the sentinel may not know about a failover yet
+		if role, err := c.Do("ROLE"); err != nil || !redisIsMaster(role) {
+			_ = c.Close()
+			lastErr = fmt.Errorf("[%s] given by sentinel [%s] is not a master", addr, sentinel)
+			continue
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("no sentinel gave the address of redis master [%s]: %v", master, lastErr)
+}
+
+// redisSentinelMaster asks a sentinel for the address of the master
+func redisSentinelMaster(sentinel, master string, options []RedisDialOption) (string, error) {
+	c, err := RedisDialer("tcp", sentinel, options...)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = c.Close() }()
+	reply, err := c.Do("SENTINEL", "get-master-addr-by-name", master)
+	if err != nil {
+		return "", err
+	}
+	if r, ok := reply.([]interface{}); ok && len(r) == 2 {
+		if host, port := redisString(r[0]), redisString(r[1]); host != "" && port != "" {
+			return net.JoinHostPort(host, port), nil
+		}
+	}
+	return "", fmt.Errorf("sentinel [%s] does not know master [%s]", sentinel, master)
+}
+
+func redisIsMaster(role interface{}) bool {
+	r, ok := role.([]interface{})
+	return ok && len(r) > 0 && redisString(r[0]) == "master"
+}
+
+// redisCluster is a RedisConn that sends each command to the node that holds the slot of its first argument,
+// the key. It follows the MOVED and ASK redirections of the nodes
+type redisCluster struct {
+	seeds    []string
+	dial     func(addr string) (RedisConn, error)
+	poolSize int
+	mu       sync.Mutex
+	// slots are the masters' slots, sorted
+	slots []redisSlotRange
+	nodes map[string]*redisPool
+}
+
+type redisSlotRange struct {
+	start, end int
+	addr       string
+}
+
+// node returns the pool of the node's connections
+func (c *redisCluster) node(addr string) *redisPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.nodes[addr]
+	if !ok {
+		p = newRedisPool(func() (RedisConn, error) { return c.dial(addr) }, c.poolSize)
+		c.nodes[addr] = p
+	}
+	return p
+}
+
+// addr returns the address of the node that holds the slot, a seed if no node does
+func (c *redisCluster) addr(slot int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := sort.Search(len(c.slots), func(i int) bool { return c.slots[i].end >= slot })
+	if i < len(c.slots) && c.slots[i].start <= slot {
+		return c.slots[i].addr
+	}
+	return c.seeds[0]
+}
+
+// refresh loads the slots from the first seed that answers CLUSTER SLOTS
+func (c *redisCluster) refresh() error {
+	var lastErr error
+	for _, seed := range c.seeds {
+		reply, err := c.node(seed).Do("CLUSTER", "SLOTS")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		slots, err := parseRedisSlots(reply, seed)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("could not load the slots of the redis cluster: %v", lastErr)
+}
+
+func (c *redisCluster) Do(commandName string, args ...interface{}) (interface{}, error) {
+	addr := c.addr(redisKeySlot(args))
+	for i := 0; ; i++ {
+		reply, err := c.node(addr).Do(commandName, args...)
+		if err == nil || i == redisMaxRedirects {
+			return reply, err
+		}
+		fields := strings.Fields(err.Error())
+		if len(fields) != 3 {
+			return reply, err
+		}
+		switch fields[0] {
+		case "MOVED":
+			// the slots have moved, eg. resharding or failover
+			addr = fields[2]
+			if err := c.refresh(); err != nil {
+				Log().WithError(err).Warn("redis cluster slots not refreshed")
+			}
+		case "ASK":
+			// the key is migrating, only this command goes to the other node
+			return c.ask(fields[2], commandName, args...)
+		default:
+			return reply, err
+		}
+	}
+}
+
+// ask sends a command that was redirected with ASK, on a connection of its own
+func (c *redisCluster) ask(addr string, commandName string, args ...interface{}) (interface{}, error) {
+	conn, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Do("ASKING"); err != nil {
+		return nil, err
+	}
+	return conn.Do(commandName, args...)
+}
+
+func (c *redisCluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, p := range c.nodes {
+		if closeErr := p.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// parseRedisSlots reads the reply of CLUSTER SLOTS, the masters with no host are on the same host as the seed
+func parseRedisSlots(reply interface{}, seed string) ([]redisSlotRange, error) {
+	entries, ok := reply.([]interface{})
+	if !ok || len(entries) == 0 {
+		return nil, errors.New("CLUSTER SLOTS returned no slots")
+	}
+	seedHost, _, _ := net.SplitHostPort(seed)
+	var slots []redisSlotRange
+	for _, e := range entries {
+		fields, ok := e.([]interface{})
+		if !ok || len(fields) < 3 {
+			return nil, errors.New("unexpected CLUSTER SLOTS reply")
+		}
+		master, ok := fields[2].([]interface{})
+		if !ok || len(master) < 2 {
+			return nil, errors.New("unexpected CLUSTER SLOTS reply")
+		}
+		host := redisString(master[0])
+		if host == "" || host == "?" {
+			host = seedHost
+		}
+		slots = append(slots, redisSlotRange{
+			start: redisInt(fields[0]),
+			end:   redisInt(fields[1]),
+			addr:  net.JoinHostPort(host, strconv.Itoa(redisInt(master[1]))),
+		})
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].start < slots[j].start })
+	return slots, nil
+}
+
+// redisKeySlot returns the slot of the key, the first argument. The slot of a key with a hash tag,
+// eg. "{user1}.mail", is the slot of the tag
+func redisKeySlot(args []interface{}) int {
+	if len(args) == 0 {
+		return 0
+	}
+	key := redisString(args[0])
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % redisSlots)
+}
+
+// crc16 is the CRC16-CCITT (XModem) of s, as used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func redisString(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	}
+	return ""
+}
+
+func redisInt(v interface{}) int {
+	switch v := v.(type) {
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case []byte:
+		n, _ := strconv.Atoi(string(v))
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,239 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeRedis answers the commands of the connections dialled with its dial
+type fakeRedis struct {
+	mu       sync.Mutex
+	dials    map[string]int
+	commands []string
+	// do answers a command sent to addr
+	do func(addr string, settings RedisDialSettings, cmd string, args []interface{}) (interface{}, error)
+}
+
+type fakeRedisConn struct {
+	r        *fakeRedis
+	addr     string
+	settings RedisDialSettings
+}
+
+func (c *fakeRedisConn) Close() error {
+	return nil
+}
+
+func (c *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.r.mu.Lock()
+	c.r.commands = append(c.r.commands, c.addr+" "+cmd)
+	c.r.mu.Unlock()
+	return c.r.do(c.addr, c.settings, cmd, args)
+}
+
+// install replaces the RedisDialer, until the returned function is called
+func (r *fakeRedis) install() func() {
+	r.dials = make(map[string]int)
+	old := RedisDialer
+	RedisDialer = func(network, address string, options ...RedisDialOption) (RedisConn, error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.dials[address]++
+		if _, port, _ := net.SplitHostPort(address); port == "1" {
+			return nil, errors.New("connection refused")
+		}
+		return &fakeRedisConn{r: r, addr: address, settings: NewRedisDialSettings(options...)}, nil
+	}
+	return func() { RedisDialer = old }
+}
+
+type fakeNetError struct{}
+
+func (fakeNetError) Error() string   { return "broken pipe" }
+func (fakeNetError) Timeout() bool   { return false }
+func (fakeNetError) Temporary() bool { return false }
+
+func TestRedisSentinel(t *testing.T) {
+	r := &fakeRedis{}
+	r.do = func(addr string, s RedisDialSettings, cmd string, args []interface{}) (interface{}, error) {
+		switch {
+		case cmd == "SENTINEL" && s.Password == "sentinel-secret":
+			return []interface{}{[]byte("10.0.0.2"), []byte("6379")}, nil
+		case cmd == "ROLE" && addr == "10.0.0.2:6379" && s.Password == "secret" && s.DB == 2:
+			return []interface{}{[]byte("master"), int64(0)}, nil
+		case cmd == "SETEX" && addr == "10.0.0.2:6379":
+			return "OK", nil
+		}
+		return nil, fmt.Errorf("unexpected %s to %s", cmd, addr)
+	}
+	defer r.install()()
+
+	conn, err := openRedis("sentinel1:1, sentinel2:26379", &RedisOptions{
+		SentinelMaster:   "mymaster",
+		SentinelPassword: "sentinel-secret",
+		Password:         "secret",
+		DB:               2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := conn.Do("SETEX", "key", 60, "value"); err != nil || reply != "OK" {
+		t.Error("expected the command to reach the master, got", reply, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+	if r.dials["sentinel1:1"] != 1 || r.dials["sentinel2:26379"] != 1 || r.dials["10.0.0.2:6379"] != 1 {
+		t.Error("unexpected dials", r.dials)
+	}
+
+	// a replica given by a sentinel that did not see the failover yet
+	r.do = func(addr string, s RedisDialSettings, cmd string, args []interface{}) (interface{}, error) {
+		if cmd == "SENTINEL" {
+			return []interface{}{[]byte("10.0.0.3"), []byte("6379")}, nil
+		}
+		return []interface{}{[]byte("slave")}, nil
+	}
+	if _, err := openRedis("sentinel2:26379", &RedisOptions{SentinelMaster: "mymaster"}); err == nil {
+		t.Error("expected a replica to be refused")
+	}
+}
+
+func TestRedisPool(t *testing.T) {
+	r := &fakeRedis{}
+	broken := false
+	r.do = func(addr string, s RedisDialSettings, cmd string, args []interface{}) (interface{}, error) {
+		if cmd == "GET" {
+			return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		if broken {
+			broken = false
+			return nil, fakeNetError{}
+		}
+		return "OK", nil
+	}
+	defer r.install()()
+
+	o := &RedisOptions{PoolSize: 2, Timeout: "5s"}
+	conn, err := openRedis("127.0.0.1:6379", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the workers with the same settings share the connections
+	other, err := openRedis("127.0.0.1:6379", &RedisOptions{PoolSize: 2, Timeout: "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("GET", "key"); err == nil {
+		t.Error("expected an error")
+	}
+	if _, err := other.Do("SETEX", "key", 60, "value"); err != nil {
+		t.Error(err)
+	}
+	if r.dials["127.0.0.1:6379"] != 1 {
+		t.Error("expected a redis error to keep the connection, got dials", r.dials)
+	}
+	broken = true
+	if _, err := conn.Do("SETEX", "key", 60, "value"); err == nil {
+		t.Error("expected the broken connection to fail")
+	}
+	if _, err := conn.Do("SETEX", "key", 60, "value"); err != nil {
+		t.Error(err)
+	}
+	if r.dials["127.0.0.1:6379"] != 2 {
+		t.Error("expected a reconnection after a network error, got dials", r.dials)
+	}
+	_ = conn.Close()
+	_ = other.Close()
+	redisConns.Lock()
+	if len(redisConns.m) != 0 {
+		t.Error("expected the pool to be closed with its last connection")
+	}
+	redisConns.Unlock()
+
+	for _, o := range []*RedisOptions{{Timeout: "soon"}, {PoolSize: -1}, {Cluster: true, SentinelMaster: "m"},
+		{TLS: true, TLSCAFile: "/does/not/exist"}} {
+		if _, err := openRedis("127.0.0.1:6379", o); err == nil {
+			t.Errorf("expected %+v to be invalid", o)
+		}
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	if s := crc16("123456789"); s != 0x31c3 {
+		t.Errorf("unexpected crc16 %x", s)
+	}
+	if s := redisKeySlot([]interface{}{"foo"}); s != 12182 {
+		t.Error("unexpected slot of foo", s)
+	}
+	if redisKeySlot([]interface{}{"{foo}.bar"}) != 12182 || redisKeySlot([]interface{}{[]byte("x{foo}")}) != 12182 {
+		t.Error("expected the slot of the hash tag")
+	}
+
+	r := &fakeRedis{}
+	// at first node 7000 holds all the slots, then the slots above 8191 move to node 7001
+	moved := false
+	slots := func() interface{} {
+		if !moved {
+			return []interface{}{
+				[]interface{}{int64(0), int64(16383), []interface{}{[]byte("10.0.0.1"), int64(7000), []byte("id1")}},
+			}
+		}
+		return []interface{}{
+			[]interface{}{int64(8192), int64(16383), []interface{}{[]byte(""), int64(7001)}},
+			[]interface{}{int64(0), int64(8191), []interface{}{[]byte("10.0.0.1"), int64(7000)}},
+		}
+	}
+	r.do = func(addr string, s RedisDialSettings, cmd string, args []interface{}) (interface{}, error) {
+		if cmd == "CLUSTER" {
+			return slots(), nil
+		}
+		if cmd == "ASKING" {
+			return "OK", nil
+		}
+		slot := redisKeySlot(args)
+		owner := "10.0.0.1:7000"
+		if moved && slot > 8191 {
+			owner = "10.0.0.1:7001"
+		}
+		if redisString(args[0]) == "migrating" && addr == owner {
+			return nil, fmt.Errorf("ASK %d 10.0.0.1:7002", slot)
+		}
+		if addr != owner && addr != "10.0.0.1:7002" {
+			return nil, fmt.Errorf("MOVED %d %s", slot, owner)
+		}
+		return addr, nil
+	}
+	defer r.install()()
+
+	conn, err := openRedis("10.0.0.1:1,10.0.0.1:7000", &RedisOptions{Cluster: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if reply, err := conn.Do("SETEX", "foo", 60, "value"); err != nil || reply != "10.0.0.1:7000" {
+		t.Error("expected foo on node 7000, got", reply, err)
+	}
+	moved = true
+	if reply, err := conn.Do("SETEX", "foo", 60, "value"); err != nil || reply != "10.0.0.1:7001" {
+		t.Error("expected foo to be redirected to node 7001, got", reply, err)
+	}
+	r.mu.Lock()
+	r.commands = nil
+	r.mu.Unlock()
+	// the slots were refreshed, no more redirections
+	if reply, err := conn.Do("SETEX", "foo", 60, "value"); err != nil || reply != "10.0.0.1:7001" {
+		t.Error("expected foo on node 7001, got", reply, err)
+	}
+	if reply, err := conn.Do("SETEX", "migrating", 60, "value"); err != nil || reply != "10.0.0.1:7002" {
+		t.Error("expected the ASK redirection to be followed, got", reply, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.commands) != 4 || r.commands[0] != "10.0.0.1:7001 SETEX" || r.commands[2] != "10.0.0.1:7002 ASKING" {
+		t.Error("unexpected commands", r.commands)
+	}
+}
@@ -28,16 +28,60 @@ func (m *RedisMockConn) Do(commandName string, args ...interface{}) (reply inter
 	return nil, nil
 }
 
-type dialOptions struct {
-	readTimeout  time.Duration
-	writeTimeout time.Duration
-	dial         func(network, addr string) (net.Conn, error)
-	db           int
-	password     string
+// RedisDialSettings are the settings of a connection, given to the RedisDialer as RedisDialOptions.
+// The drivers read them with NewRedisDialSettings
+type RedisDialSettings struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Dial opens the network connection, eg. with TLS. The driver's default if nil
+	Dial     func(network, addr string) (net.Conn, error)
+	DB       int
+	Username string
+	Password string
 }
 
+// RedisDialOption sets one of the RedisDialSettings
 type RedisDialOption struct {
-	f func(*dialOptions)
+	f func(*RedisDialSettings)
+}
+
+// NewRedisDialSettings returns the settings set by the options
+func NewRedisDialSettings(options ...RedisDialOption) RedisDialSettings {
+	var s RedisDialSettings
+	for _, o := range options {
+		o.f(&s)
+	}
+	return s
+}
+
+// RedisDialReadTimeout sets the timeout of reading a reply
+func RedisDialReadTimeout(d time.Duration) RedisDialOption {
+	return RedisDialOption{func(s *RedisDialSettings) { s.ReadTimeout = d }}
+}
+
+// RedisDialWriteTimeout sets the timeout of writing a command
+func RedisDialWriteTimeout(d time.Duration) RedisDialOption {
+	return RedisDialOption{func(s *RedisDialSettings) { s.WriteTimeout = d }}
+}
+
+// RedisDialNetDial sets the function that opens the network connection
+func RedisDialNetDial(dial func(network, addr string) (net.Conn, error)) RedisDialOption {
+	return RedisDialOption{func(s *RedisDialSettings) { s.Dial = dial }}
+}
+
+// RedisDialDatabase sets the database selected once connected
+func RedisDialDatabase(db int) RedisDialOption {
+	return RedisDialOption{func(s *RedisDialSettings) { s.DB = db }}
+}
+
+// RedisDialUsername sets the ACL user of AUTH, the default user if empty
+func RedisDialUsername(username string) RedisDialOption {
+	return RedisDialOption{func(s *RedisDialSettings) { s.Username = username }}
+}
+
+// RedisDialPassword sets the password of AUTH, no AUTH if empty
+func RedisDialPassword(password string) RedisDialOption {
+	return RedisDialOption{func(s *RedisDialSettings) { s.Password = password }}
 }
 
 type redisDial func(network, address string, options ...RedisDialOption) (RedisConn, error)
@@ -0,0 +1,80 @@
+package backends
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigOption describes an option of the backend_config, read from the tags of a config struct.
+// The json tag gives the key, and omitempty makes it optional. The default tag documents the value used
+// when an optional key is missing, eg. `json:"gw_save_timeout,omitempty" default:"30s"`
+type ConfigOption struct {
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	Default  string `json:"default,omitempty"`
+}
+
+// ProcessorInfo describes a registered processor
+type ProcessorInfo struct {
+	// Name is the name used in save_process and validate_process, names are case-insensitive
+	Name string `json:"name"`
+	// Options of the processor, nil if it has none or did not register a config type
+	Options []ConfigOption `json:"options"`
+	// HasConfig is true if the processor registered a config type, so that its options are known
+	HasConfig bool `json:"has_config"`
+}
+
+// Processors returns the registered processors with their options, sorted by name
+func Processors() []ProcessorInfo {
+	list := make([]ProcessorInfo, 0, len(processors))
+	for name := range processors {
+		info := ProcessorInfo{Name: name}
+		if newConfig, ok := processorConfigs[name]; ok {
+			info.Options = ConfigOptions(newConfig())
+			info.HasConfig = true
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// GatewayOptions returns the options of the gateway, which apply to the backend regardless of its processors
+func GatewayOptions() []ConfigOption {
+	return ConfigOptions(&GatewayConfig{})
+}
+
+// ConfigOptions returns the options of a config struct, in the order of its fields, with the options
+// of its embedded structs. Only the fields that ExtractConfig can set (int, string and bool) are returned
+func ConfigOptions(config BaseConfig) []ConfigOption {
+	t := reflect.TypeOf(config)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var options []ConfigOption
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			options = append(options, ConfigOptions(reflect.New(field.Type).Interface())...)
+			continue
+		}
+		switch field.Type.Name() {
+		case "int", "string", "bool":
+		default:
+			continue
+		}
+		option := ConfigOption{Key: field.Name, Type: field.Type.Name(), Required: true}
+		if tag := field.Tag.Get("json"); tag != "" {
+			split := strings.Split(tag, ",")
+			option.Key = split[0]
+			option.Required = !(len(split) > 1 && split[1] == "omitempty")
+		}
+		option.Default = field.Tag.Get("default")
+		options = append(options, option)
+	}
+	return options
+}
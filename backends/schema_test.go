@@ -0,0 +1,69 @@
+package backends
+
+import "testing"
+
+func TestProcessors(t *testing.T) {
+	var sql *ProcessorInfo
+	list := Processors()
+	for i := range list {
+		if i > 0 && list[i-1].Name >= list[i].Name {
+			t.Error("expecting the processors to be sorted by name")
+		}
+		if list[i].Name == "sql" {
+			sql = &list[i]
+		}
+	}
+	if sql == nil || !sql.HasConfig {
+		t.Fatal("expecting the sql processor with its options, got", list)
+	}
+	found := 0
+	for _, o := range sql.Options {
+		switch o.Key {
+		case "sql_dsn":
+			if !o.Required || o.Type != "string" {
+				t.Errorf("unexpected option %+v", o)
+			}
+			found++
+		case "sql_max_open_conns":
+			if o.Required || o.Type != "int" {
+				t.Errorf("unexpected option %+v", o)
+			}
+			found++
+		}
+	}
+	if found != 2 {
+		t.Error("expecting the sql_dsn and sql_max_open_conns options, got", sql.Options)
+	}
+}
+
+func TestGatewayOptions(t *testing.T) {
+	for _, o := range GatewayOptions() {
+		if o.Key == "gw_save_timeout" {
+			if o.Required || o.Default != "30s" {
+				t.Errorf("unexpected option %+v", o)
+			}
+			return
+		}
+	}
+	t.Error("expecting the gw_save_timeout option")
+}
+
+func TestConfigOptionsEmbedded(t *testing.T) {
+	options := ConfigOptions(&RedisProcessorConfig{})
+	keys := make(map[string]bool, len(options))
+	for _, o := range options {
+		keys[o.Key] = true
+	}
+	// the options of the embedded RedisOptions are options of the redis processor
+	if !keys["redis_interface"] || !keys["redis_pool_size"] || !keys["redis_sentinel_master"] {
+		t.Error("unexpected options", options)
+	}
+	c, err := Svc.ExtractConfig(BackendConfig{
+		"redis_interface":      "127.0.0.1:6379",
+		"redis_expire_seconds": 60,
+		"redis_pool_size":      4,
+	}, &RedisProcessorConfig{})
+	if err != nil || c.(*RedisProcessorConfig).PoolSize != 4 {
+		t.Error("expecting the embedded options to be extracted, got", c, err)
+	}
+}
@@ -0,0 +1,177 @@
+package backends
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQL dialects of the schema
+const (
+	DialectMySQL    = "mysql"
+	DialectPostgres = "postgres"
+)
+
+// SQLMigration is a version of the schema of the sql processor's table
+type SQLMigration struct {
+	Version     int
+	Description string
+	// MySQL and Postgres are the statements of each dialect, %[1]s is the name of the table
+	MySQL    []string
+	Postgres []string
+}
+
+// SQLMigrations are the versions of the sql processor's table, oldest first. A new version is
+// appended when the columns of sqlDefaultColumns change, the old versions are never edited
+var SQLMigrations = []SQLMigration{
+	{
+		Version:     1,
+		Description: "create the mail table",
+		MySQL: []string{`CREATE TABLE IF NOT EXISTS %[1]s (
+  mail_id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  date DATETIME NOT NULL,
+  ` + "`to`" + ` VARCHAR(255) NOT NULL DEFAULT '',
+  ` + "`from`" + ` VARCHAR(255) NOT NULL DEFAULT '',
+  subject VARCHAR(255) NOT NULL DEFAULT '',
+  body VARCHAR(16) NOT NULL DEFAULT '',
+  mail LONGBLOB NOT NULL,
+  spam_score FLOAT NOT NULL DEFAULT 0,
+  hash CHAR(32) NOT NULL DEFAULT '',
+  content_type VARCHAR(255) NOT NULL DEFAULT '',
+  recipient VARCHAR(255) NOT NULL DEFAULT '',
+  has_attach INT NOT NULL DEFAULT 0,
+  ip_addr VARBINARY(16) NOT NULL,
+  return_path VARCHAR(255) NOT NULL DEFAULT '',
+  is_tls BOOLEAN NOT NULL DEFAULT FALSE,
+  message_id VARCHAR(255) NOT NULL DEFAULT '',
+  reply_to VARCHAR(255) NOT NULL DEFAULT '',
+  sender VARCHAR(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (mail_id),
+  KEY date (date),
+  KEY hash (hash),
+  KEY recipient (recipient)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`},
+		Postgres: []string{`CREATE TABLE IF NOT EXISTS %[1]s (
+  mail_id BIGSERIAL PRIMARY KEY,
+  date TIMESTAMP NOT NULL,
+  "to" VARCHAR(255) NOT NULL DEFAULT '',
+  "from" VARCHAR(255) NOT NULL DEFAULT '',
+  subject VARCHAR(255) NOT NULL DEFAULT '',
+  body VARCHAR(16) NOT NULL DEFAULT '',
+  mail BYTEA NOT NULL,
+  spam_score REAL NOT NULL DEFAULT 0,
+  hash CHAR(32) NOT NULL DEFAULT '',
+  content_type VARCHAR(255) NOT NULL DEFAULT '',
+  recipient VARCHAR(255) NOT NULL DEFAULT '',
+  has_attach INTEGER NOT NULL DEFAULT 0,
+  ip_addr BYTEA NOT NULL,
+  return_path VARCHAR(255) NOT NULL DEFAULT '',
+  is_tls BOOLEAN NOT NULL DEFAULT FALSE,
+  message_id VARCHAR(255) NOT NULL DEFAULT '',
+  reply_to VARCHAR(255) NOT NULL DEFAULT '',
+  sender VARCHAR(255) NOT NULL DEFAULT ''
+)`,
+			`CREATE INDEX IF NOT EXISTS %[1]s_date ON %[1]s (date)`,
+			`CREATE INDEX IF NOT EXISTS %[1]s_hash ON %[1]s (hash)`,
+			`CREATE INDEX IF NOT EXISTS %[1]s_recipient ON %[1]s (recipient)`,
+		},
+	},
+}
+
+// SQLSchemaTable records the version of each table
+const SQLSchemaTable = "guerrilla_schema"
+
+// SQLDialect returns the dialect of a database/sql driver name
+func SQLDialect(driver string) (string, error) {
+	switch strings.ToLower(driver) {
+	case "mysql":
+		return DialectMySQL, nil
+	case "postgres", "pgx", "pq":
+		return DialectPostgres, nil
+	}
+	return "", fmt.Errorf("no schema for the sql driver [%s], only for mysql and postgres", driver)
+}
+
+// Statements returns the statements of the migration for the dialect and the table
+func (m *SQLMigration) Statements(dialect, table string) []string {
+	list := m.MySQL
+	if dialect == DialectPostgres {
+		list = m.Postgres
+	}
+	statements := make([]string, len(list))
+	for i := range list {
+		statements[i] = fmt.Sprintf(list[i], table)
+	}
+	return statements
+}
+
+// SQLSchemaVersion returns the version of the table, 0 if it was not migrated yet
+func SQLSchemaVersion(db *sql.DB, dialect, table string) (int, error) {
+	create := "CREATE TABLE IF NOT EXISTS " + SQLSchemaTable +
+		" (table_name VARCHAR(255) NOT NULL PRIMARY KEY, version INTEGER NOT NULL)"
+	if _, err := db.Exec(create); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow("SELECT version FROM "+SQLSchemaTable+" WHERE table_name = "+sqlPlaceholder(dialect, 1), table).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// MigrateSQL applies the migrations newer than the table's version, in order, and returns those applied.
+// The version is recorded after each migration, so a failed run continues where it stopped
+func MigrateSQL(db *sql.DB, dialect, table string) ([]SQLMigration, error) {
+	if !isSQLName(table) {
+		return nil, fmt.Errorf("[%s] is not a table name", table)
+	}
+	version, err := SQLSchemaVersion(db, dialect, table)
+	if err != nil {
+		return nil, err
+	}
+	if version > SQLMigrations[len(SQLMigrations)-1].Version {
+		return nil, fmt.Errorf("table [%s] is at version %d, newer than this build", table, version)
+	}
+	var applied []SQLMigration
+	for _, m := range SQLMigrations {
+		if m.Version <= version {
+			continue
+		}
+		for _, s := range m.Statements(dialect, table) {
+			if _, err := db.Exec(s); err != nil {
+				return applied, fmt.Errorf("migration %d of [%s] failed: %s", m.Version, table, err)
+			}
+		}
+		if err := setSQLSchemaVersion(db, dialect, table, version, m.Version); err != nil {
+			return applied, err
+		}
+		version = m.Version
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func setSQLSchemaVersion(db *sql.DB, dialect, table string, from, to int) error {
+	var err error
+	if from == 0 {
+		_, err = db.Exec("INSERT INTO "+SQLSchemaTable+" (table_name, version) VALUES ("+
+			sqlPlaceholder(dialect, 1)+", "+sqlPlaceholder(dialect, 2)+")", table, to)
+	} else {
+		_, err = db.Exec("UPDATE "+SQLSchemaTable+" SET version = "+sqlPlaceholder(dialect, 1)+
+			" WHERE table_name = "+sqlPlaceholder(dialect, 2), to, table)
+	}
+	if err != nil {
+		return errors.New("could not record the version of [" + table + "]: " + err.Error())
+	}
+	return nil
+}
+
+// sqlPlaceholder returns the nth placeholder of a query
+func sqlPlaceholder(dialect string, n int) string {
+	if dialect == DialectPostgres {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
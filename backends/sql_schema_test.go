@@ -0,0 +1,57 @@
+package backends
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestMigrateSQL(t *testing.T) {
+	fakeDB.reset()
+	db, err := sql.Open("fakesql", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	applied, err := MigrateSQL(db, DialectMySQL, "new_mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].Version != 1 {
+		t.Fatal("expecting version 1 to be applied, got", applied)
+	}
+	fakeDB.Lock()
+	queries, args := fakeDB.queries, fakeDB.args
+	fakeDB.Unlock()
+	if len(queries) != 3 || !strings.HasPrefix(queries[1], "CREATE TABLE IF NOT EXISTS new_mail (") ||
+		queries[2] != "INSERT INTO guerrilla_schema (table_name, version) VALUES (?, ?)" {
+		t.Fatal("unexpected queries", queries)
+	}
+	if args[2][0] != "new_mail" || args[2][1] != int64(1) {
+		t.Error("unexpected version", args[2])
+	}
+	if _, err := MigrateSQL(db, DialectMySQL, "mail; DROP TABLE mail"); err == nil {
+		t.Error("expecting an invalid table name to be refused")
+	}
+}
+
+func TestSQLSchemaColumns(t *testing.T) {
+	// the latest schema has the columns that the sql processor inserts by default
+	columns, err := parseSQLColumns(sqlDefaultColumns, sqlFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := SQLMigrations[len(SQLMigrations)-1]
+	for _, dialect := range []string{DialectMySQL, DialectPostgres} {
+		schema := strings.Join(latest.Statements(dialect, "mail"), "\n")
+		for _, c := range append(columns, sqlColumn{name: "mail_id"}) {
+			if !strings.Contains(schema, "\n  "+c.name+" ") && !strings.Contains(schema, "\n  `"+c.name+"` ") &&
+				!strings.Contains(schema, "\n  \""+c.name+"\" ") {
+				t.Errorf("expecting the %s schema to have the column %s", dialect, c.name)
+			}
+		}
+	}
+	if d, err := SQLDialect("pgx"); err != nil || d != DialectPostgres {
+		t.Error("expecting pgx to be postgres, got", d, err)
+	}
+}
@@ -5,6 +5,33 @@ import redigo "github.com/gomodule/redigo/redis"
 
 func init() {
 	backends.RedisDialer = func(network, address string, options ...backends.RedisDialOption) (backends.RedisConn, error) {
-		return redigo.Dial(network, address)
+		s := backends.NewRedisDialSettings(options...)
+		redigoOptions := []redigo.DialOption{
+			redigo.DialReadTimeout(s.ReadTimeout),
+			redigo.DialWriteTimeout(s.WriteTimeout),
+		}
+		if s.Dial != nil {
+			redigoOptions = append(redigoOptions, redigo.DialNetDial(s.Dial))
+		}
+		if s.Username == "" {
+			redigoOptions = append(redigoOptions, redigo.DialPassword(s.Password), redigo.DialDatabase(s.DB))
+			return redigo.Dial(network, address, redigoOptions...)
+		}
+		// AUTH with an ACL user, then select the database
+		c, err := redigo.Dial(network, address, redigoOptions...)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Do("AUTH", s.Username, s.Password); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		if s.DB != 0 {
+			if _, err := c.Do("SELECT", s.DB); err != nil {
+				_ = c.Close()
+				return nil, err
+			}
+		}
+		return c, nil
 	}
 }
@@ -14,4 +14,12 @@ var (
 	QuotaExceeded       = RcptError(errors.New("quota exceeded"))
 	UserSuspended       = RcptError(errors.New("user suspended"))
 	StorageError        = RcptError(errors.New("storage error"))
+	// SenderDomainRejected and SenderNullMX are returned by the mxcheck processor, when the domain
+	// of MAIL FROM does not resolve, or publishes a null MX
+	SenderDomainRejected = RcptError(errors.New("sender domain not found"))
+	SenderNullMX         = RcptError(errors.New("sender domain does not accept mail"))
+	// SenderUnverified is returned by the callout processor, when the MX of the sender rejects the sender
+	SenderUnverified = RcptError(errors.New("sender address rejected by its domain"))
+	// StorageDisabled is returned when the processors of validate_process panicked too often, see gw_panic_limit
+	StorageDisabled = RcptError(errors.New("storage temporarily disabled"))
 )
@@ -0,0 +1,215 @@
+// Package bounce reads the bounces and complaints received about messages sent earlier:
+// delivery status notifications (RFC 3464), abuse feedback reports (ARF, RFC 5965)
+// and VERP return paths, which encode the recipient of the message that bounced
+package bounce
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Kind classifies a bounce
+type Kind string
+
+const (
+	// Hard bounces are permanent failures, eg. the mailbox does not exist
+	Hard Kind = "hard"
+	// Soft bounces are temporary failures, eg. the mailbox is full, or a delayed delivery
+	Soft Kind = "soft"
+	// Complaint is an abuse report, eg. the recipient marked the message as spam
+	Complaint Kind = "complaint"
+	// Unknown is a bounce to a VERP address that could not be read, eg. a bounce in plain text
+	Unknown Kind = "unknown"
+)
+
+// Bounce is what a bounce or a complaint says about one recipient of a message sent earlier
+type Bounce struct {
+	Kind Kind `json:"kind"`
+	// Recipient is the recipient of the message that bounced, or that complained
+	Recipient string `json:"recipient,omitempty"`
+	// Status is the enhanced status code, eg. "5.1.1"
+	Status string `json:"status,omitempty"`
+	// Action is the action of the DSN, eg. "failed" or "delayed"
+	Action string `json:"action,omitempty"`
+	// Diagnostic is the response of the remote server, eg. "smtp; 550 5.1.1 User unknown"
+	Diagnostic string `json:"diagnostic,omitempty"`
+	// FeedbackType is the type of a complaint, eg. "abuse"
+	FeedbackType string `json:"feedback_type,omitempty"`
+	// ReportingMTA is the server that reported the bounce
+	ReportingMTA string `json:"reporting_mta,omitempty"`
+	// OriginalMessageID is the Message-ID of the message that bounced, when the report includes it
+	OriginalMessageID string `json:"original_message_id,omitempty"`
+}
+
+// ErrNotReport is returned by Parse when the message is not a delivery status notification
+// or a feedback report
+var ErrNotReport = errors.New("not a delivery status notification or a feedback report")
+
+// maxPartSize is how much of each part of a report is read
+const maxPartSize = 1 << 20
+
+// Parse reads a message and returns the bounces of its delivery status notification (a multipart/report
+// of delivery-status), or the complaint of its feedback report (a multipart/report of feedback-report).
+// Delivered, relayed and expanded recipients are left out. Returns ErrNotReport for other messages
+func Parse(r io.Reader) ([]Bounce, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, ErrNotReport
+	}
+	reportType := strings.ToLower(params["report-type"])
+	if reportType != "delivery-status" && reportType != "feedback-report" {
+		return nil, ErrNotReport
+	}
+	var report []textproto.MIMEHeader
+	var messageID string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status", "message/feedback-report":
+			if report, err = readFields(decode(part)); err != nil {
+				return nil, err
+			}
+		case "text/rfc822-headers", "message/rfc822", "message/global", "message/global-headers":
+			h, err := textproto.NewReader(bufio.NewReader(decode(part))).ReadMIMEHeader()
+			if len(h) == 0 && err != nil {
+				continue
+			}
+			messageID = strings.TrimSpace(h.Get("Message-Id"))
+		}
+	}
+	if len(report) == 0 {
+		return nil, ErrNotReport
+	}
+	if reportType == "feedback-report" {
+		return []Bounce{complaint(report[0], messageID)}, nil
+	}
+	return bounces(report, messageID), nil
+}
+
+// complaint returns the complaint of a feedback report
+func complaint(f textproto.MIMEHeader, messageID string) Bounce {
+	b := Bounce{
+		Kind:              Complaint,
+		Recipient:         address(f.Get("Original-Rcpt-To")),
+		FeedbackType:      strings.ToLower(f.Get("Feedback-Type")),
+		ReportingMTA:      address(f.Get("Reporting-MTA")),
+		OriginalMessageID: messageID,
+	}
+	if b.ReportingMTA == "" {
+		b.ReportingMTA = f.Get("Source-IP")
+	}
+	return b
+}
+
+// bounces returns the bounces of a delivery status: the per-message fields followed by the per-recipient fields
+func bounces(fields []textproto.MIMEHeader, messageID string) []Bounce {
+	reportingMTA := address(fields[0].Get("Reporting-MTA"))
+	var list []Bounce
+	for _, f := range fields[1:] {
+		b := Bounce{
+			Recipient:         address(f.Get("Final-Recipient")),
+			Status:            status(f.Get("Status")),
+			Action:            strings.ToLower(strings.TrimSpace(f.Get("Action"))),
+			Diagnostic:        strings.TrimSpace(f.Get("Diagnostic-Code")),
+			ReportingMTA:      reportingMTA,
+			OriginalMessageID: messageID,
+		}
+		if b.Recipient == "" {
+			b.Recipient = address(f.Get("Original-Recipient"))
+		}
+		switch {
+		case b.Action == "delayed" || strings.HasPrefix(b.Status, "4."):
+			b.Kind = Soft
+		case b.Action == "failed" || strings.HasPrefix(b.Status, "5."):
+			b.Kind = Hard
+		default:
+			// delivered, relayed or expanded
+			continue
+		}
+		list = append(list, b)
+	}
+	return list
+}
+
+// readFields reads the groups of fields of a report, they are separated by blank lines
+func readFields(r io.Reader) ([]textproto.MIMEHeader, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	var groups []textproto.MIMEHeader
+	for {
+		// skip the blank lines between the groups
+		for {
+			b, err := tr.R.Peek(1)
+			if err != nil {
+				return groups, nil
+			}
+			if b[0] != '\r' && b[0] != '\n' {
+				break
+			}
+			_, _ = tr.R.ReadByte()
+		}
+		h, err := tr.ReadMIMEHeader()
+		if len(h) > 0 {
+			groups = append(groups, h)
+		}
+		if err == io.EOF {
+			return groups, nil
+		}
+		if err != nil {
+			return groups, err
+		}
+	}
+}
+
+// decode returns the content of a part, decoded if it's in base64. Parts in quoted-printable
+// are decoded by the multipart reader
+func decode(p *multipart.Part) io.Reader {
+	r := io.LimitReader(p, maxPartSize)
+	if strings.EqualFold(p.Header.Get("Content-Transfer-Encoding"), "base64") {
+		b, _ := ioutil.ReadAll(r)
+		return base64.NewDecoder(base64.StdEncoding, bytes.NewReader(bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' {
+				return -1
+			}
+			return r
+		}, b)))
+	}
+	return r
+}
+
+// address returns the address of a field with an address type, eg. "rfc822; bob@example.com"
+func address(field string) string {
+	if i := strings.IndexByte(field, ';'); i >= 0 {
+		field = field[i+1:]
+	}
+	return strings.Trim(strings.TrimSpace(field), "<>")
+}
+
+// status returns the code of a Status field, without a comment, eg. "5.1.1" for "5.1.1 (user unknown)"
+func status(field string) string {
+	field = strings.TrimSpace(field)
+	if i := strings.IndexAny(field, " \t("); i >= 0 {
+		field = field[:i]
+	}
+	return field
+}
@@ -0,0 +1,179 @@
+package bounce
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const dsn = "From: MAILER-DAEMON@mx.example.org\r\n" +
+	"To: bounces+alice=example.com@mail.example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"Arrival-Date: Mon, 1 Jun 2020 10:00:00 +0000\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; alice@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1 (user unknown)\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; bob@example.org\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.2.2\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; carol@example.org\r\n" +
+	"Action: delivered\r\n" +
+	"Status: 2.0.0\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"Message-ID: <123@mail.example.com>\r\n" +
+	"Subject: hello\r\n" +
+	"\r\n" +
+	"--b1--\r\n"
+
+func TestParseDSN(t *testing.T) {
+	list, err := Parse(strings.NewReader(dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 bounces, the delivered recipient left out, got %+v", list)
+	}
+	hard := Bounce{
+		Kind:              Hard,
+		Recipient:         "alice@example.org",
+		Status:            "5.1.1",
+		Action:            "failed",
+		Diagnostic:        "smtp; 550 5.1.1 User unknown",
+		ReportingMTA:      "mx.example.org",
+		OriginalMessageID: "<123@mail.example.com>",
+	}
+	if list[0] != hard {
+		t.Error("expected", hard, "got", list[0])
+	}
+	if list[1].Kind != Soft || list[1].Recipient != "bob@example.org" || list[1].Status != "4.2.2" {
+		t.Error("expected a soft bounce of bob@example.org, got", list[1])
+	}
+}
+
+func TestParseBase64(t *testing.T) {
+	status := "Reporting-MTA: dns; mx.example.org\r\n\r\n" +
+		"Original-Recipient: rfc822;<dave@example.org>\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.2.2\r\n"
+	msg := "Content-Type: multipart/report; report-type=delivery-status; boundary=b2\r\n" +
+		"\r\n" +
+		"--b2\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte(status)) + "\r\n" +
+		"--b2--\r\n"
+	list, err := Parse(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Kind != Hard || list[0].Recipient != "dave@example.org" {
+		t.Error("expected a hard bounce of dave@example.org, got", list)
+	}
+}
+
+func TestParseComplaint(t *testing.T) {
+	msg := "Content-Type: multipart/report; report-type=feedback-report; boundary=b3\r\n" +
+		"\r\n" +
+		"--b3\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is an abuse report\r\n" +
+		"--b3\r\n" +
+		"Content-Type: message/feedback-report\r\n" +
+		"\r\n" +
+		"Feedback-Type: abuse\r\n" +
+		"User-Agent: SomeGenerator/1.0\r\n" +
+		"Version: 1\r\n" +
+		"Original-Rcpt-To: <erin@example.org>\r\n" +
+		"Reporting-MTA: dns; fbl.example.org\r\n" +
+		"\r\n" +
+		"--b3\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Message-ID: <456@mail.example.com>\r\n" +
+		"Subject: offer\r\n" +
+		"\r\n" +
+		"body\r\n" +
+		"--b3--\r\n"
+	list, err := Parse(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Bounce{
+		Kind:              Complaint,
+		Recipient:         "erin@example.org",
+		FeedbackType:      "abuse",
+		ReportingMTA:      "fbl.example.org",
+		OriginalMessageID: "<456@mail.example.com>",
+	}
+	if len(list) != 1 || list[0] != expected {
+		t.Error("expected", expected, "got", list)
+	}
+}
+
+func TestParseNotReport(t *testing.T) {
+	for _, msg := range []string{
+		"Subject: hello\r\n\r\nplain text\r\n",
+		"Content-Type: multipart/mixed; boundary=b4\r\n\r\n--b4\r\n\r\ntext\r\n--b4--\r\n",
+		"Content-Type: multipart/report; report-type=disposition-notification; boundary=b5\r\n\r\n--b5--\r\n",
+		// a report without a delivery-status part
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=b6\r\n\r\n" +
+			"--b6\r\nContent-Type: text/plain\r\n\r\ntext\r\n--b6--\r\n",
+	} {
+		if _, err := Parse(strings.NewReader(msg)); err != ErrNotReport {
+			t.Errorf("expected ErrNotReport, got %v for %q", err, msg)
+		}
+	}
+}
+
+func TestVERP(t *testing.T) {
+	v := VERP{Prefix: "bounces"}
+	addr := v.Encode("alice@example.com", "mail.example.org")
+	if addr != "bounces+alice=example.com@mail.example.org" {
+		t.Error("unexpected VERP address", addr)
+	}
+	tests := []struct {
+		local, rcpt string
+		ok          bool
+	}{
+		{"bounces+alice=example.com", "alice@example.com", true},
+		{"Bounces+a=b=example.com", "a=b@example.com", true},
+		{"bounces+alice", "", false},
+		{"bounces+alice=", "", false},
+		{"bounces+", "", false},
+		{"bounces", "", false},
+		{"alice", "", false},
+	}
+	for _, test := range tests {
+		rcpt, ok := v.Decode(test.local)
+		if rcpt != test.rcpt || ok != test.ok {
+			t.Errorf("Decode(%q) = %q, %v, expected %q, %v", test.local, rcpt, ok, test.rcpt, test.ok)
+		}
+	}
+	v = VERP{Prefix: "bounces", Delimiter: "-"}
+	if rcpt, ok := v.Decode("bounces-bob=example.net"); !ok || rcpt != "bob@example.net" {
+		t.Error("expected bob@example.net, got", rcpt)
+	}
+	if _, ok := (VERP{}).Decode("+alice=example.com"); ok {
+		t.Error("expected no VERP addresses without a prefix")
+	}
+}
@@ -0,0 +1,48 @@
+package bounce
+
+import "strings"
+
+// VERP encodes and decodes Variable Envelope Return Paths: the return path of a message sent to
+// alice@example.com is eg. bounces+alice=example.com@mail.example.org, so that a bounce sent to it
+// says which recipient bounced, even when the bounce cannot be read
+type VERP struct {
+	// Prefix is the local part that the VERP addresses start with, eg. "bounces"
+	Prefix string
+	// Delimiter separates the prefix from the recipient, "+" if empty
+	Delimiter string
+}
+
+func (v VERP) delimiter() string {
+	if v.Delimiter == "" {
+		return "+"
+	}
+	return v.Delimiter
+}
+
+// Encode returns the return path of a message to recipient, in the domain
+func (v VERP) Encode(recipient, domain string) string {
+	i := strings.LastIndexByte(recipient, '@')
+	if i < 0 {
+		return v.Prefix + v.delimiter() + recipient + "@" + domain
+	}
+	return v.Prefix + v.delimiter() + recipient[:i] + "=" + recipient[i+1:] + "@" + domain
+}
+
+// Decode returns the recipient encoded in the local part of a VERP address, eg. "alice@example.com"
+// for "bounces+alice=example.com". Returns false if the local part is not a VERP address
+func (v VERP) Decode(localPart string) (string, bool) {
+	if v.Prefix == "" {
+		return "", false
+	}
+	start := v.Prefix + v.delimiter()
+	if len(localPart) <= len(start) || !strings.EqualFold(localPart[:len(start)], start) {
+		return "", false
+	}
+	encoded := localPart[len(start):]
+	// the local part of the recipient may have a '=' too, the domain cannot
+	i := strings.LastIndexByte(encoded, '=')
+	if i <= 0 || i == len(encoded)-1 {
+		return "", false
+	}
+	return encoded[:i] + "@" + encoded[i+1:], true
+}
@@ -0,0 +1,91 @@
+package guerrilla
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// dataBudget limits the bytes of DATA that the clients of all the servers hold in memory together.
+// Bytes spooled to disk are not counted. A nil *dataBudget has no limit
+type dataBudget struct {
+	// limit is the number of bytes allowed, 0 for no limit. Accessed atomically
+	limit int64
+	// used is the number of bytes held by the clients. Accessed atomically
+	used int64
+}
+
+// validateDataBudget returns an error if n is not a valid data_budget
+func validateDataBudget(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("data_budget [%d] cannot be negative", n)
+	}
+	return nil
+}
+
+func newDataBudget(limit int64) *dataBudget {
+	return &dataBudget{limit: limit}
+}
+
+// setLimit changes the limit, the bytes already held are kept
+func (b *dataBudget) setLimit(limit int64) {
+	atomic.StoreInt64(&b.limit, limit)
+}
+
+// exhausted returns true when no more DATA should be accepted until some is released
+func (b *dataBudget) exhausted() bool {
+	if b == nil {
+		return false
+	}
+	limit := atomic.LoadInt64(&b.limit)
+	return limit > 0 && atomic.LoadInt64(&b.used) >= limit
+}
+
+// inUse returns the number of bytes held by the clients
+func (b *dataBudget) inUse() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.used)
+}
+
+// budgetReader counts the bytes read in to memory against a dataBudget.
+// Each client has one, it's reset for every DATA command and released with the transaction
+type budgetReader struct {
+	r       io.Reader
+	b       *dataBudget
+	max     int64
+	counted int64
+}
+
+// reset makes br count the bytes read from r against b, up to max bytes if max is more than 0
+// (the rest is spooled to disk). Returns r unwrapped when b is nil
+func (br *budgetReader) reset(b *dataBudget, r io.Reader, max int64) io.Reader {
+	br.release()
+	if b == nil {
+		return r
+	}
+	br.r, br.b, br.max = r, b, max
+	return br
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	count := int64(n)
+	if br.max > 0 && br.counted+count > br.max {
+		count = br.max - br.counted
+	}
+	if count > 0 {
+		br.counted += count
+		atomic.AddInt64(&br.b.used, count)
+	}
+	return n, err
+}
+
+// release gives the counted bytes back to the budget
+func (br *budgetReader) release() {
+	if br.b != nil && br.counted > 0 {
+		atomic.AddInt64(&br.b.used, -br.counted)
+	}
+	br.r, br.b, br.counted = nil, nil, 0
+}
@@ -8,13 +8,17 @@ import (
 	"fmt"
 	"net"
 	"net/textproto"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/flashmob/go-guerrilla/backends"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/mail/rfc5321"
 	"github.com/flashmob/go-guerrilla/response"
+	"github.com/flashmob/go-guerrilla/tracing"
 )
 
 // ClientState indicates which part of the SMTP transaction a given client is in.
@@ -54,35 +58,49 @@ type client struct {
 	connGuard sync.Mutex
 	log       log.Logger
 	parser    rfc5321.Parser
+	// span traces the connection, the Envelope's span traces the current transaction
+	span *tracing.Span
+	// transcript records the SMTP dialog, nil if transcripts are disabled
+	transcript *transcript
+	// peer is the IP address of the connection, unlike RemoteIP it cannot be changed by XCLIENT
+	peer string
+	// counter counts the bytes of the connection, it wraps the connection before any TLS upgrade
+	counter *countingConn
+	// registryState mirrors state for the registry, see setState
+	registryState int32
+	// budget counts the DATA held in memory against the data_budget
+	budget budgetReader
+	// header limits the size of the header of the DATA to max_header_size
+	header headerReader
+	// eightBit notes if the DATA has 8-bit bytes, for strict_7bit
+	eightBit eightBitReader
+	// idling is 1 while the client is waiting for a command between transactions, see setIdle
+	idling int32
+	// domain holds the settings of the domains of the transaction's recipients
+	domain transactionDomain
+	// dataSession is true while the client counts against the server's max_data_sessions
+	dataSession bool
+	// history keeps the last commands, see command_history
+	history commandHistory
+	// tarpitDelay is how long each reply is held, when the connection policy tarpitted the client
+	tarpitDelay time.Duration
 }
 
 // NewClient allocates a new client.
 func NewClient(conn net.Conn, clientID uint64, logger log.Logger, envelope *mail.Pool) *client {
-	c := &client{
-		conn: conn,
-		// Envelope will be borrowed from the envelope pool
-		// the envelope could be 'detached' from the client later when processing
-		Envelope:    envelope.Borrow(getRemoteAddr(conn), clientID),
-		ConnectedAt: time.Now(),
-		bufin:       newSMTPBufferedReader(conn),
-		bufout:      bufio.NewWriter(conn),
-		ID:          clientID,
-		log:         logger,
-	}
+	return newClient(conn, clientID, logger, envelope, bufferSizes{})
+}
 
-	// used for reading the DATA state
-	c.smtpReader = textproto.NewReader(c.bufin.Reader)
+// newClient allocates a new client with buffers of the given sizes
+func newClient(conn net.Conn, clientID uint64, logger log.Logger, envelope *mail.Pool, sizes bufferSizes) *client {
+	c := &client{log: logger}
+	c.init(conn, clientID, envelope, sizes)
 	return c
 }
 
 // sendResponse adds a response to be written on the next turn
 // the response gets buffered
 func (c *client) sendResponse(r ...interface{}) {
-	c.bufout.Reset(c.conn)
-	if c.log.IsDebug() {
-		// an additional buffer so that we can log the response in debug mode only
-		c.response.Reset()
-	}
 	var out string
 	if c.bufErr != nil {
 		c.bufErr = nil
@@ -102,6 +120,7 @@ func (c *client) sendResponse(r ...interface{}) {
 		if c.log.IsDebug() {
 			c.response.WriteString(out)
 		}
+		c.transcript.response(out)
 		if c.bufErr != nil {
 			return
 		}
@@ -118,9 +137,52 @@ func (c *client) sendResponse(r ...interface{}) {
 // -End of DATA command
 // TLS handshake
 func (c *client) resetTransaction() {
+	c.budget.release()
+	c.domain = transactionDomain{}
 	c.Envelope.ResetTransaction()
 }
 
+// startSpan starts tracing the connection, if t is not nil
+func (c *client) startSpan(t *tracing.Tracer, listenInterface string) {
+	c.span = t.Start("smtp.connection")
+	c.span.SetAttribute("net.peer.ip", c.RemoteIP)
+	c.span.SetAttribute("guerrilla.client_id", strconv.FormatUint(c.ID, 10))
+	c.span.SetAttribute("guerrilla.listen_interface", listenInterface)
+}
+
+// endSpan ends the spans of the connection and of any unfinished transaction
+func (c *client) endSpan() {
+	c.Span.End()
+	c.Span = nil
+	c.span.SetAttribute("smtp.messages_sent", strconv.Itoa(c.messagesSent))
+	c.span.End()
+	c.span = nil
+}
+
+// startTransactionSpan starts tracing a transaction, once MAIL was accepted
+func (c *client) startTransactionSpan() {
+	c.Span = c.span.Child("smtp.transaction")
+	if c.Span == nil {
+		// not traced, don't build the attributes
+		return
+	}
+	c.Span.SetAttribute("guerrilla.queued_id", c.QueuedId)
+	c.Span.SetAttribute("smtp.mail_from", c.MailFrom.String())
+}
+
+// endTransactionSpan records the outcome of the DATA command, the span ends with the transaction
+func (c *client) endTransactionSpan(size int64, res backends.Result) {
+	if c.Span == nil {
+		return
+	}
+	c.Span.SetAttribute("smtp.rcpt_count", strconv.Itoa(len(c.RcptTo)))
+	c.Span.SetAttribute("smtp.data_size", strconv.FormatInt(size, 10))
+	c.Span.SetAttribute("smtp.response_code", strconv.Itoa(res.Code()))
+	if res.Code() > 399 {
+		c.Span.SetError(errors.New(res.String()))
+	}
+}
+
 // isInTransaction returns true if the connection is inside a transaction.
 // A transaction starts after a MAIL command gets issued by the client.
 // Call resetTransaction to end the transaction
@@ -131,6 +193,20 @@ func (c *client) isInTransaction() bool {
 	return true
 }
 
+// setIdle records if the client is waiting for a command between transactions, goroutine safe
+func (c *client) setIdle(idle bool) {
+	var v int32
+	if idle {
+		v = 1
+	}
+	atomic.StoreInt32(&c.idling, v)
+}
+
+// idle returns true if the client is waiting for a command between transactions, goroutine safe
+func (c *client) idle() bool {
+	return atomic.LoadInt32(&c.idling) == 1
+}
+
 // kill flags the connection to close on the next turn
 func (c *client) kill() {
 	c.KilledAt = time.Now()
@@ -160,19 +236,37 @@ func (c *client) closeConn() {
 }
 
 // init is called after the client is borrowed from the pool, to get it ready for the connection
-func (c *client) init(conn net.Conn, clientID uint64, ep *mail.Pool) {
-	c.conn = conn
-	// reset our reader & writer
-	c.bufout.Reset(conn)
-	c.bufin.Reset(conn)
+func (c *client) init(conn net.Conn, clientID uint64, ep *mail.Pool, sizes bufferSizes) {
+	c.counter = &countingConn{Conn: conn}
+	c.conn = c.counter
+	// borrow the reader & writer, they are released when the client is returned to the pool
+	c.bufin = newSMTPBufferedReader(c.conn, sizes.read)
+	c.bufout = ioBuffers.writer(c.conn, sizes.write)
+	// used for reading the DATA state
+	c.smtpReader = textproto.NewReader(c.bufin.Reader)
 	// reset session data
-	c.state = 0
+	c.setState(ClientGreeting)
+	c.peer = getRemoteAddr(conn)
 	c.KilledAt = time.Time{}
 	c.ConnectedAt = time.Now()
 	c.ID = clientID
 	c.errors = 0
-	// borrow an envelope from the envelope pool
+	c.tarpitDelay = 0
+	c.setIdle(false)
+	// Envelope will be borrowed from the envelope pool
+	// the envelope could be 'detached' from the client later when processing
 	c.Envelope = ep.Borrow(getRemoteAddr(conn), clientID)
+	c.Timings.Connected = c.ConnectedAt
+}
+
+// release returns the reader & writer to ioBuffers, once the connection is closed
+func (c *client) release() {
+	c.budget.release()
+	if c.bufin != nil {
+		ioBuffers.putReader(c.bufin.Reader)
+		ioBuffers.putWriter(c.bufout)
+		c.bufin, c.bufout, c.smtpReader = nil, nil, nil
+	}
 }
 
 // getID returns the client's unique ID
@@ -190,7 +284,9 @@ func (c *client) upgradeToTLS(tlsConfig *tls.Config) error {
 		return err
 	}
 	// convert tlsConn to net.Conn
+	c.connGuard.Lock()
 	c.conn = net.Conn(tlsConn)
+	c.connGuard.Unlock()
 	c.bufout.Reset(c.conn)
 	c.bufin.Reset(c.conn)
 	c.TLS = true
@@ -226,7 +322,7 @@ func (c *client) parsePath(in []byte, p pathParser) (mail.Address, error) {
 	} else {
 		address = mail.Address{
 			User:       c.parser.LocalPart,
-			Host:       c.parser.Domain,
+			Host:       mail.NormalizeHost(c.parser.Domain),
 			ADL:        c.parser.ADL,
 			PathParams: c.parser.PathParams,
 			NullPath:   c.parser.NullPath,
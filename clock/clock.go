@@ -0,0 +1,144 @@
+// Package clock lets the server and the backend gateway tell the time through an interface,
+// so that tests and embedders can simulate their timeouts with a Mock instead of sleeping
+package clock
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After sends the time on the returned channel once d has passed, like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the Clock of the system, it's used when no other Clock is set
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+// Value holds a Clock that can be swapped while it's in use. The zero Value holds Real
+type Value struct {
+	v atomic.Value
+}
+
+// holder wraps the clocks, an atomic.Value cannot store clocks of different types
+type holder struct {
+	Clock
+}
+
+// Store sets the clock, nil for Real
+func (v *Value) Store(c Clock) {
+	if c == nil {
+		c = Real
+	}
+	v.v.Store(holder{c})
+}
+
+// Load returns the clock, Real if none was stored
+func (v *Value) Load() Clock {
+	if h, ok := v.v.Load().(holder); ok {
+		return h.Clock
+	}
+	return Real
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Mock is a Clock that only moves when Add or Set is called. It's safe for concurrent use
+type Mock struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	waiters []waiter
+}
+
+// waiter is a channel returned by After that has not fired yet
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewMock returns a Mock that starts at now
+func NewMock(now time.Time) *Mock {
+	m := &Mock{now: now}
+	m.changed = sync.NewCond(&m.mu)
+	return m
+}
+
+// Now returns the time of the mock
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// After returns a channel that fires once the mock has been moved by d or more
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- m.now
+		return c
+	}
+	m.waiters = append(m.waiters, waiter{at: m.now.Add(d), c: c})
+	m.changed.Broadcast()
+	return c
+}
+
+// Add moves the mock forward by d, firing the channels that are due
+func (m *Mock) Add(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(m.now.Add(d))
+}
+
+// Set moves the mock to t, firing the channels that are due
+func (m *Mock) Set(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.set(t)
+}
+
+func (m *Mock) set(t time.Time) {
+	m.now = t
+	pending := m.waiters[:0]
+	for _, w := range m.waiters {
+		if w.at.After(t) {
+			pending = append(pending, w)
+			continue
+		}
+		// buffered, never blocks
+		w.c <- t
+	}
+	m.waiters = pending
+	m.changed.Broadcast()
+}
+
+// Waiters returns the number of channels returned by After that have not fired yet
+func (m *Mock) Waiters() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.waiters)
+}
+
+// BlockUntil blocks until n or more channels returned by After are waiting to fire.
+// Use it to know that the code under test has started waiting before moving the mock
+func (m *Mock) BlockUntil(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.waiters) < n {
+		m.changed.Wait()
+	}
+}
@@ -0,0 +1,82 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMock(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	m := NewMock(start)
+	if !m.Now().Equal(start) {
+		t.Error("expecting the mock to start at", start, "got", m.Now())
+	}
+	select {
+	case <-m.After(0):
+	default:
+		t.Error("expecting After(0) to fire straight away")
+	}
+
+	done := make(chan time.Time)
+	go func() {
+		done <- <-m.After(10 * time.Second)
+	}()
+	m.BlockUntil(1)
+	short := m.After(time.Second)
+	if n := m.Waiters(); n != 2 {
+		t.Fatal("expecting 2 waiters, got", n)
+	}
+	m.Add(5 * time.Second)
+	select {
+	case <-short:
+	default:
+		t.Error("expecting the 1s channel to fire after 5s")
+	}
+	select {
+	case <-done:
+		t.Error("the 10s channel fired after 5s")
+	default:
+	}
+	if n := m.Waiters(); n != 1 {
+		t.Error("expecting 1 waiter left, got", n)
+	}
+	m.Set(start.Add(10 * time.Second))
+	select {
+	case at := <-done:
+		if !at.Equal(start.Add(10 * time.Second)) {
+			t.Error("expecting the channel to send the time of the mock, got", at)
+		}
+	case <-time.After(time.Second):
+		t.Error("expecting the 10s channel to fire after 10s")
+	}
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	if now := Real.Now(); now.Before(before) {
+		t.Error("expecting Real to tell the time, got", now)
+	}
+	select {
+	case <-Real.After(time.Millisecond):
+	case <-time.After(time.Second):
+		t.Error("expecting Real.After to fire")
+	}
+}
+
+func TestValue(t *testing.T) {
+	var v Value
+	if v.Load() != Real {
+		t.Error("expecting the zero Value to hold Real")
+	}
+	// the clocks stored are of different types
+	m := NewMock(time.Now())
+	v.Store(m)
+	v.Store(nil)
+	if v.Load() != Real {
+		t.Error("expecting nil to store Real")
+	}
+	v.Store(m)
+	if v.Load() != m {
+		t.Error("expecting the mock to be stored")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// benchOptions are the flags of the bench command
+type benchOptions struct {
+	server      string
+	from        string
+	to          []string
+	helo        string
+	connections int
+	messages    int
+	size        int
+	shape       string
+	startTLS    bool
+	insecure    bool
+	timeout     time.Duration
+}
+
+// the MIME shapes of the messages sent by bench
+const (
+	shapePlain       = "plain"
+	shapeAlternative = "alternative"
+	shapeAttachment  = "attachment"
+)
+
+var (
+	benchOpts benchOptions
+
+	benchCmd = &cobra.Command{
+		Use:   "bench",
+		Short: "send messages over concurrent connections and report the latency",
+		Long: `Opens --connections connections to an SMTP server and sends --messages messages over them,
+of about --size bytes each, then prints the throughput, the latency percentiles of the transactions
+(from MAIL FROM to the reply to DATA) and the failures. A connection is reopened after a failure.
+Use it to compare tuning changes, eg. save_workers_size, against a test server:
+guerrillad bench --server 127.0.0.1:2525 --to test@example.com --connections 50 --messages 10000`,
+		Run: bench,
+	}
+)
+
+func init() {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	f := benchCmd.Flags()
+	f.StringVar(&benchOpts.server, "server", "127.0.0.1:25", "host:port of the SMTP server")
+	f.StringVar(&benchOpts.from, "from", "bench@"+hostname, "sender address")
+	f.StringSliceVar(&benchOpts.to, "to", nil, "recipient address, can be repeated")
+	f.StringVar(&benchOpts.helo, "helo", hostname, "host name to send with EHLO")
+	f.IntVar(&benchOpts.connections, "connections", 10, "number of concurrent connections")
+	f.IntVar(&benchOpts.messages, "messages", 1000, "number of messages to send in total")
+	f.IntVar(&benchOpts.size, "size", 4096, "approximate size of each message, in bytes")
+	f.StringVar(&benchOpts.shape, "shape", shapePlain,
+		"MIME shape of the messages: plain, alternative (text and html) or attachment (text and a base64 file)")
+	f.BoolVar(&benchOpts.startTLS, "starttls", false, "upgrade the connections with STARTTLS")
+	f.BoolVar(&benchOpts.insecure, "insecure", false, "do not verify the server's certificate")
+	f.DurationVar(&benchOpts.timeout, "timeout", 30*time.Second, "timeout of each transaction")
+	rootCmd.AddCommand(benchCmd)
+}
+
+func bench(cmd *cobra.Command, args []string) {
+	result, err := runBench(benchOpts)
+	if err != nil {
+		mainlog.WithError(err).Error("bench could not run")
+		os.Exit(1)
+	}
+	result.print(cmd.OutOrStdout())
+	if result.sent == 0 {
+		os.Exit(1)
+	}
+}
+
+// benchResult is the outcome of a bench run
+type benchResult struct {
+	elapsed time.Duration
+	// sent is the number of messages accepted
+	sent int
+	// latencies of the messages accepted
+	latencies []time.Duration
+	// failures counts the errors by message
+	failures map[string]int
+}
+
+// record adds the outcome of a message, d is how long its transaction took
+func (r *benchResult) record(d time.Duration, err error) {
+	if err != nil {
+		r.failures[err.Error()]++
+		return
+	}
+	r.sent++
+	r.latencies = append(r.latencies, d)
+}
+
+// percentile returns the latency under which p percent of the messages were sent.
+// The latencies must be sorted
+func (r *benchResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(r.latencies) {
+		i = len(r.latencies) - 1
+	}
+	return r.latencies[i]
+}
+
+// print writes the report of the run to w
+func (r *benchResult) print(w io.Writer) {
+	failed := 0
+	for _, n := range r.failures {
+		failed += n
+	}
+	_, _ = fmt.Fprintf(w, "messages:   %d sent, %d failed in %s\n", r.sent, failed, r.elapsed.Round(time.Millisecond))
+	if r.elapsed > 0 {
+		_, _ = fmt.Fprintf(w, "throughput: %.1f messages/s\n", float64(r.sent)/r.elapsed.Seconds())
+	}
+	if len(r.latencies) > 0 {
+		_, _ = fmt.Fprintf(w, "latency:    p50 %s, p90 %s, p99 %s, max %s\n",
+			r.percentile(50).Round(time.Microsecond),
+			r.percentile(90).Round(time.Microsecond),
+			r.percentile(99).Round(time.Microsecond),
+			r.latencies[len(r.latencies)-1].Round(time.Microsecond))
+	}
+	if failed == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(r.failures))
+	for reason := range r.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		return r.failures[reasons[i]] > r.failures[reasons[j]]
+	})
+	_, _ = fmt.Fprintln(w, "failures:")
+	for _, reason := range reasons {
+		_, _ = fmt.Fprintf(w, "  %6d  %s\n", r.failures[reason], reason)
+	}
+}
+
+// runBench sends the messages described by opts and returns the result
+func runBench(opts benchOptions) (*benchResult, error) {
+	if len(opts.to) == 0 {
+		return nil, errors.New("at least one recipient is required, use --to")
+	}
+	if opts.connections < 1 || opts.messages < 1 {
+		return nil, errors.New("connections and messages must be at least 1")
+	}
+	body, contentType, err := benchBody(opts.shape, opts.size)
+	if err != nil {
+		return nil, err
+	}
+	if opts.connections > opts.messages {
+		opts.connections = opts.messages
+	}
+	result := &benchResult{failures: make(map[string]int)}
+	var (
+		mu        sync.Mutex
+		remaining = opts.messages
+		wg        sync.WaitGroup
+	)
+	// next takes a message to send, false when all were taken
+	next := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if remaining == 0 {
+			return false
+		}
+		remaining--
+		return true
+	}
+	record := func(d time.Duration, err error) {
+		mu.Lock()
+		result.record(d, err)
+		mu.Unlock()
+	}
+	start := time.Now()
+	for i := 0; i < opts.connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			benchConnection(opts, body, contentType, next, record)
+		}()
+	}
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	sort.Slice(result.latencies, func(i, j int) bool {
+		return result.latencies[i] < result.latencies[j]
+	})
+	return result, nil
+}
+
+// benchConnection sends messages over a connection while next returns true, reconnecting after a failure
+func benchConnection(opts benchOptions, body, contentType string, next func() bool, record func(time.Duration, error)) {
+	var d *smtpDialog
+	defer func() {
+		if d != nil {
+			_ = d.cmd(221, "QUIT")
+			d.close()
+		}
+	}()
+	for next() {
+		if d == nil {
+			var err error
+			if d, err = dialSMTP(ioutil.Discard, opts.server, opts.helo, opts.startTLS, opts.insecure, opts.timeout); err != nil {
+				record(0, err)
+				continue
+			}
+		}
+		start := time.Now()
+		_ = d.conn.SetDeadline(start.Add(opts.timeout))
+		err := benchTransaction(d, opts, body, contentType)
+		record(time.Since(start), err)
+		if err != nil {
+			// the state of the connection is unknown
+			d.close()
+			d = nil
+		}
+	}
+}
+
+// benchTransaction sends a message
+func benchTransaction(d *smtpDialog, opts benchOptions, body, contentType string) error {
+	if err := d.cmd(250, "MAIL FROM:<%s>", opts.from); err != nil {
+		return err
+	}
+	for _, rcpt := range opts.to {
+		if err := d.cmd(250, "RCPT TO:<%s>", rcpt); err != nil {
+			return err
+		}
+	}
+	if err := d.cmd(354, "DATA"); err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	w := d.text.DotWriter()
+	_, _ = fmt.Fprintf(w, "From: <%s>\r\nTo: <%s>\r\nSubject: guerrillad bench\r\nDate: %s\r\n"+
+		"Message-ID: <%s@%s>\r\nMIME-Version: 1.0\r\nContent-Type: %s\r\n\r\n",
+		opts.from, strings.Join(opts.to, ">, <"), time.Now().Format(time.RFC1123Z),
+		hex.EncodeToString(id), opts.helo, contentType)
+	if _, err := io.WriteString(w, body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return d.response(250)
+}
+
+// benchBoundary separates the parts of the multipart shapes
+const benchBoundary = "guerrillad-bench-boundary"
+
+// benchBody returns the body of the messages of the given shape, and its Content-Type.
+// The body is about size bytes, less the 250 or so bytes of the header
+func benchBody(shape string, size int) (body string, contentType string, err error) {
+	size -= 250
+	if size < 0 {
+		size = 0
+	}
+	var b strings.Builder
+	switch shape {
+	case shapePlain:
+		writeBenchText(&b, size)
+		return b.String(), "text/plain; charset=us-ascii", nil
+	case shapeAlternative:
+		b.WriteString("--" + benchBoundary + "\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n")
+		writeBenchText(&b, size/2)
+		b.WriteString("--" + benchBoundary + "\r\nContent-Type: text/html; charset=us-ascii\r\n\r\n<html><body><p>\r\n")
+		writeBenchText(&b, size/2)
+		b.WriteString("</p></body></html>\r\n--" + benchBoundary + "--\r\n")
+		return b.String(), "multipart/alternative; boundary=\"" + benchBoundary + "\"", nil
+	case shapeAttachment:
+		b.WriteString("--" + benchBoundary + "\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n")
+		writeBenchText(&b, 256)
+		b.WriteString("--" + benchBoundary + "\r\nContent-Type: application/octet-stream\r\n" +
+			"Content-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=\"bench.bin\"\r\n\r\n")
+		attachment := size - 256
+		if attachment < 0 {
+			attachment = 0
+		}
+		// base64 makes the data a third bigger
+		data := make([]byte, attachment*3/4)
+		_, _ = rand.Read(data)
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 76 {
+			b.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		b.WriteString(encoded + "\r\n--" + benchBoundary + "--\r\n")
+		return b.String(), "multipart/mixed; boundary=\"" + benchBoundary + "\"", nil
+	}
+	return "", "", fmt.Errorf("unknown shape [%s], expecting plain, alternative or attachment", shape)
+}
+
+// writeBenchText writes lines of text to b, about size bytes
+func writeBenchText(b *strings.Builder, size int) {
+	const line = "The quick brown fox jumps over the lazy dog, and then some more words follow.\r\n"
+	for n := 0; n < size; n += len(line) {
+		b.WriteString(line)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+)
+
+func TestBenchBody(t *testing.T) {
+	for _, shape := range []string{shapePlain, shapeAlternative, shapeAttachment} {
+		body, contentType, err := benchBody(shape, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) < 7000 || len(body) > 8500 {
+			t.Errorf("%s: expecting a body of about 8k, got %d bytes", shape, len(body))
+		}
+		media, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			t.Fatal(shape, err)
+		}
+		if !strings.HasPrefix(media, "multipart/") {
+			continue
+		}
+		r := multipart.NewReader(strings.NewReader(body), params["boundary"])
+		parts := 0
+		for {
+			if _, err := r.NextPart(); err != nil {
+				break
+			}
+			parts++
+		}
+		if parts != 2 {
+			t.Errorf("%s: expecting 2 parts, got %d", shape, parts)
+		}
+	}
+	if _, _, err := benchBody("html", 1024); err == nil {
+		t.Error("expecting an unknown shape to be refused")
+	}
+	if _, _, err := benchBody(shapeAttachment, 10); err != nil {
+		t.Error("expecting a small attachment to be sent, got", err)
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	d := guerrilla.Daemon{Config: &guerrilla.AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers: []guerrilla.ServerConfig{{
+			ListenInterface: "127.0.0.1:2562",
+			IsEnabled:       true,
+			MaxClients:      10,
+		}},
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	opts := benchOptions{
+		server:      "127.0.0.1:2562",
+		from:        "bench@example.com",
+		to:          []string{"test@grr.la"},
+		helo:        "client.example.com",
+		connections: 4,
+		messages:    20,
+		size:        2048,
+		shape:       shapeAlternative,
+		timeout:     10 * time.Second,
+	}
+	result, err := runBench(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	result.print(&out)
+	if result.sent != 20 || len(result.failures) != 0 {
+		t.Errorf("expecting the 20 messages to be sent:\n%s", out.String())
+	}
+	if p50, p99 := result.percentile(50), result.percentile(99); p50 <= 0 || p50 > p99 {
+		t.Errorf("unexpected percentiles %s %s", p50, p99)
+	}
+	if !strings.Contains(out.String(), "latency:    p50 ") {
+		t.Errorf("expecting the latency to be reported:\n%s", out.String())
+	}
+
+	opts.to = []string{"test@example.org"}
+	opts.messages = 3
+	if result, err = runBench(opts); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	result.print(&out)
+	if result.sent != 0 || !strings.Contains(out.String(), "       3  expecting 250, got: 454") {
+		t.Errorf("expecting the 3 messages to fail:\n%s", out.String())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/flashmob/go-guerrilla/backends"
+)
+
+var (
+	configTestPath    string
+	configTestConnect bool
+
+	configTestCmd = &cobra.Command{
+		Use:   "configtest",
+		Short: "check the configuration file and exit",
+		Long: `Loads the configuration file and checks the servers, TLS certificates and keys,
+backend processor names and their options, without binding any ports or connecting to
+any databases, unless --connect is given. Exits with a non-zero status if there were any errors.`,
+		Run: configTest,
+	}
+)
+
+func init() {
+	cfgFile := "goguerrilla.conf" // deprecated default name
+	if _, err := os.Stat(cfgFile); err != nil {
+		cfgFile = "goguerrilla.conf.json" // use the new name
+	}
+	configTestCmd.Flags().StringVarP(&configTestPath, "config", "c",
+		cfgFile, "Path to the configuration file")
+	configTestCmd.Flags().StringArrayVar(&configSets, "set", nil,
+		"Override a config key after the config is loaded, eg. --set servers[0].listen_interface=:2525 (can be repeated)")
+	configTestCmd.Flags().BoolVar(&configTestConnect, "connect", false,
+		"Also connect the processors to their databases, eg. sql and redis")
+	rootCmd.AddCommand(configTestCmd)
+}
+
+func configTest(cmd *cobra.Command, args []string) {
+	if err := checkConfig(configTestPath); err != nil {
+		mainlog.WithError(err).Errorf("configuration file %s test failed", configTestPath)
+		os.Exit(1)
+	}
+	mainlog.Infof("configuration file %s test is successful", configTestPath)
+}
+
+// checkConfig loads the config at path and validates it without starting anything
+func checkConfig(path string) error {
+	var d guerrilla.Daemon
+	// Load validates the servers and their TLS settings
+	c, err := d.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := applyOverrides(&c, configSets); err != nil {
+		return err
+	}
+	var errs backends.Errors
+	interfaces := make(map[string]int)
+	for i, sc := range c.Servers {
+		host, port, err := net.SplitHostPort(sc.ListenInterface)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("server at index %d: invalid listen_interface: %s", i, err))
+			continue
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			errs = append(errs, fmt.Errorf("server at index %d: invalid port in listen_interface [%s]", i, sc.ListenInterface))
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			if _, err := net.LookupHost(host); err != nil {
+				errs = append(errs, fmt.Errorf("server at index %d: cannot resolve host in listen_interface [%s]", i, sc.ListenInterface))
+			}
+		}
+		if j, ok := interfaces[sc.ListenInterface]; ok && sc.IsEnabled {
+			errs = append(errs, fmt.Errorf("server at index %d: listen_interface [%s] already used by server at index %d", i, sc.ListenInterface, j))
+		} else if sc.IsEnabled {
+			interfaces[sc.ListenInterface] = i
+		}
+	}
+	if err := c.Validate(); err != nil {
+		if ge, ok := err.(guerrilla.Errors); ok {
+			errs = append(errs, ge...)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	err = backends.ValidateConfig(c.BackendConfig)
+	if err == nil && configTestConnect {
+		err = backends.CheckConnectivity(c.BackendConfig)
+	}
+	if err != nil {
+		if be, ok := err.(backends.Errors); ok {
+			errs = append(errs, be...)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/tests/testcert"
+)
+
+func TestCheckConfig(t *testing.T) {
+	err := testcert.GenerateCert("mail2.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "../../tests/")
+	if err != nil {
+		t.Error("failed to generate a test certificate", err)
+		t.FailNow()
+	}
+	if err := ioutil.WriteFile("configtest.json", []byte(configJsonA), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove("configtest.json") }()
+	if err := checkConfig("configtest.json"); err != nil {
+		t.Error("expecting configJsonA to pass, got", err)
+	}
+
+	bad := strings.Replace(configJsonA, `"save_process": "HeadersParser|Debugger"`, `"save_process": "HeadersParser|Missing"`, 1)
+	bad = strings.Replace(bad, `"listen_interface":"127.0.0.1:3536"`, `"listen_interface":"127.0.0.1:35x"`, 1)
+	// the sections are checked as a reload would
+	bad = strings.Replace(bad, `"log_level" : "debug",`, `"log_level" : "debug", "outbound": {"dane": true, "max_hops": -1},`, 1)
+	if err := ioutil.WriteFile("configtest.json", []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = checkConfig("configtest.json")
+	if err == nil {
+		t.Fatal("expecting an error")
+	}
+	for _, expect := range []string{"processor [missing] not found", "invalid port", "max_hops cannot be negative",
+		"outbound dane needs dns upstream"} {
+		if !strings.Contains(err.Error(), expect) {
+			t.Error("expecting error to contain", expect, "got:", err)
+		}
+	}
+
+	if err := checkConfig("configtest-missing.json"); err == nil {
+		t.Error("expecting an error for a missing file")
+	}
+}
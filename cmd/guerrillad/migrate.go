@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/flashmob/go-guerrilla/backends"
+)
+
+var (
+	migrateConfigPath string
+	migrateProcessor  string
+	migratePrint      bool
+
+	migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "create or upgrade the tables of a processor",
+		Long: `Creates the table of the processor given with --processor, or upgrades it to the schema of
+this build, using the driver, the DSN and the table of the backend_config. The version of each
+table is kept in the guerrilla_schema table. With --print, the statements are printed instead,
+without connecting to the database.`,
+		Run: migrate,
+	}
+)
+
+func init() {
+	cfgFile := "goguerrilla.conf" // deprecated default name
+	if _, err := os.Stat(cfgFile); err != nil {
+		cfgFile = "goguerrilla.conf.json" // use the new name
+	}
+	migrateCmd.Flags().StringVarP(&migrateConfigPath, "config", "c",
+		cfgFile, "Path to the configuration file")
+	migrateCmd.Flags().StringVar(&migrateProcessor, "processor", "sql",
+		"Processor whose tables to migrate: sql")
+	migrateCmd.Flags().BoolVar(&migratePrint, "print", false,
+		"Print the statements of the schema and exit")
+	migrateCmd.Flags().StringArrayVar(&configSets, "set", nil,
+		"Override a config key after the config is loaded, eg. --set backend_config.mail_table=new_mail (can be repeated)")
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func migrate(cmd *cobra.Command, args []string) {
+	if err := runMigrate(cmd.OutOrStdout(), migrateConfigPath, migrateProcessor, migratePrint); err != nil {
+		mainlog.WithError(err).Error("migrate failed")
+		os.Exit(1)
+	}
+}
+
+// runMigrate migrates the tables of the processor, configured by the config file at path
+func runMigrate(w io.Writer, path, processor string, print bool) error {
+	switch strings.ToLower(processor) {
+	case "sql":
+	case "chunksaver":
+		return errors.New("the chunksaver processor is not part of this build")
+	default:
+		return fmt.Errorf("processor [%s] has no tables to migrate", processor)
+	}
+	var d guerrilla.Daemon
+	c, err := d.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := applyOverrides(&c, configSets); err != nil {
+		return err
+	}
+	driver, _ := c.BackendConfig["sql_driver"].(string)
+	dsn, _ := c.BackendConfig["sql_dsn"].(string)
+	table, _ := c.BackendConfig["mail_table"].(string)
+	if driver == "" || table == "" {
+		return errors.New("backend_config needs the sql_driver and mail_table of the sql processor")
+	}
+	dialect, err := backends.SQLDialect(driver)
+	if err != nil {
+		return err
+	}
+	if print {
+		for _, m := range backends.SQLMigrations {
+			_, _ = fmt.Fprintf(w, "-- version %d: %s\n", m.Version, m.Description)
+			for _, s := range m.Statements(dialect, table) {
+				_, _ = fmt.Fprintf(w, "%s;\n", s)
+			}
+		}
+		return nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+	applied, err := backends.MigrateSQL(db, dialect, table)
+	for _, m := range applied {
+		_, _ = fmt.Fprintf(w, "%s: applied version %d, %s\n", table, m.Version, m.Description)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		_, _ = fmt.Fprintf(w, "%s is up to date\n", table)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunMigrate(t *testing.T) {
+	if err := ioutil.WriteFile("migrate.json", []byte(`{
+	"allowed_hosts": ["grr.la"],
+	"servers": [{"listen_interface": "127.0.0.1:2525", "is_enabled": true}],
+	"backend_config": {
+		"save_process": "HeadersParser|Hasher|SQL",
+		"sql_driver": "postgres",
+		"sql_dsn": "postgres://localhost/mail",
+		"mail_table": "new_mail",
+		"primary_mail_host": "grr.la"
+	}
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove("migrate.json") }()
+
+	var buf bytes.Buffer
+	if err := runMigrate(&buf, "migrate.json", "sql", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"-- version 1: create the mail table\n",
+		"CREATE TABLE IF NOT EXISTS new_mail (",
+		"mail_id BIGSERIAL PRIMARY KEY",
+		"CREATE INDEX IF NOT EXISTS new_mail_date ON new_mail (date);\n",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expecting the output to contain %q:\n%s", expect, buf.String())
+		}
+	}
+
+	if err := runMigrate(&buf, "migrate.json", "chunksaver", true); err == nil {
+		t.Error("expecting an error for the chunksaver")
+	}
+	configSets = []string{"backend_config.sql_driver=sqlite3"}
+	defer func() { configSets = nil }()
+	if err := runMigrate(&buf, "migrate.json", "sql", true); err == nil || !strings.Contains(err.Error(), "sqlite3") {
+		t.Error("expecting an error for a driver without a schema, got", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla"
+)
+
+// configSets are the --set flags, eg. servers[0].listen_interface=:2525
+var configSets []string
+
+// applyOverrides sets the config keys given as path=value, then loads the config again so that
+// it's validated and its defaults are set. The path is made of the json keys separated by dots,
+// with [n] to index an array, eg. backend_config.save_workers_size=8. The value is parsed as JSON,
+// or taken as a string if it's not valid JSON or the key already holds a string
+func applyOverrides(c *guerrilla.AppConfig, sets []string) error {
+	if len(sets) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	for _, set := range sets {
+		i := strings.Index(set, "=")
+		if i < 1 {
+			return fmt.Errorf("invalid --set [%s], use key=value", set)
+		}
+		path, err := parsePath(set[:i])
+		if err != nil {
+			return fmt.Errorf("invalid --set [%s]: %s", set, err)
+		}
+		if doc, err = setPath(doc, path, set[i+1:]); err != nil {
+			return fmt.Errorf("invalid --set [%s]: %s", set, err)
+		}
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	var overridden guerrilla.AppConfig
+	if err := overridden.Load(data); err != nil {
+		return fmt.Errorf("config is invalid after --set: %s", err)
+	}
+	*c = overridden
+	return nil
+}
+
+// parsePath splits a path into its keys (strings) and array indexes (ints)
+func parsePath(path string) ([]interface{}, error) {
+	var parts []interface{}
+	for _, segment := range strings.Split(path, ".") {
+		key := segment
+		var indexes []interface{}
+		if i := strings.Index(segment, "["); i >= 0 {
+			key = segment[:i]
+			for rest := segment[i:]; rest != ""; {
+				end := strings.Index(rest, "]")
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("bad index in [%s]", segment)
+				}
+				n, err := strconv.Atoi(rest[1:end])
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("bad index in [%s]", segment)
+				}
+				indexes = append(indexes, n)
+				rest = rest[end+1:]
+			}
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty key in [%s]", path)
+		}
+		parts = append(append(parts, key), indexes...)
+	}
+	return parts, nil
+}
+
+// setPath sets the value at path in node, creating the objects that are missing.
+// An index equal to the length of an array appends to it. Returns the updated node
+func setPath(node interface{}, path []interface{}, value string) (interface{}, error) {
+	if len(path) == 0 {
+		if _, isString := node.(string); isString {
+			return value, nil
+		}
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return value, nil
+		}
+		return v, nil
+	}
+	switch p := path[0].(type) {
+	case string:
+		if node == nil {
+			node = make(map[string]interface{})
+		}
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("[%s] is not in an object", p)
+		}
+		v, err := setPath(m[p], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		m[p] = v
+		return m, nil
+	case int:
+		a, ok := node.([]interface{})
+		if !ok && node != nil {
+			return nil, fmt.Errorf("index [%d] is not in an array", p)
+		}
+		if p > len(a) {
+			return nil, fmt.Errorf("index [%d] is out of range, the array has %d elements", p, len(a))
+		}
+		if p == len(a) {
+			a = append(a, nil)
+		}
+		v, err := setPath(a[p], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		a[p] = v
+		return a, nil
+	}
+	return node, nil
+}
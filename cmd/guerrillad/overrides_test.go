@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	var c guerrilla.AppConfig
+	if err := c.Load([]byte(`{
+	"allowed_hosts": ["grr.la"],
+	"servers": [{"listen_interface": "127.0.0.1:2525", "is_enabled": true}],
+	"backend_config": {"save_workers_size": 1}
+}`)); err != nil {
+		t.Fatal(err)
+	}
+	err := applyOverrides(&c, []string{
+		"servers[0].listen_interface=:2526",
+		"servers[0].max_clients=42",
+		"backend_config.save_workers_size=8",
+		"backend_config.primary_mail_host=mx.example.com",
+		`allowed_hosts=["a.com","b.com"]`,
+		"log_level=warn",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Servers[0].ListenInterface != ":2526" || c.Servers[0].MaxClients != 42 || !c.Servers[0].IsEnabled {
+		t.Errorf("unexpected server config %+v", c.Servers[0])
+	}
+	if c.BackendConfig["save_workers_size"] != float64(8) || c.BackendConfig["primary_mail_host"] != "mx.example.com" {
+		t.Errorf("unexpected backend config %+v", c.BackendConfig)
+	}
+	if len(c.AllowedHosts) != 2 || c.LogLevel != "warn" {
+		t.Errorf("unexpected config %+v", c)
+	}
+
+	for set, expect := range map[string]string{
+		"log_level":                      "use key=value",
+		"servers[2].listen_interface=:1": "out of range",
+		"servers[x].is_enabled=true":     "bad index",
+		"log_level.x=1":                  "not in an object",
+		"servers[0].max_clients=lots":    "config is invalid",
+	} {
+		if err := applyOverrides(&c, []string{set}); err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("expecting an error with %q for %s, got %v", expect, set, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/flashmob/go-guerrilla/backends"
+)
+
+var processorsCmd = &cobra.Command{
+	Use:   "processors",
+	Short: "list the backend processors and their options",
+	Long: `Prints the options of the backend, then each registered processor that can be used in
+save_process or validate_process with its options, their types and defaults.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		printProcessors(cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(processorsCmd)
+}
+
+// printProcessors writes the backend options and the registered processors to w
+func printProcessors(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "backend_config options:")
+	printOptions(tw, backends.GatewayOptions())
+	_, _ = fmt.Fprintln(tw, "\nprocessors (names are case-insensitive):")
+	for _, p := range backends.Processors() {
+		_, _ = fmt.Fprintf(tw, "  %s\n", p.Name)
+		switch {
+		case !p.HasConfig:
+			_, _ = fmt.Fprintln(tw, "    options not declared")
+		case len(p.Options) == 0:
+			_, _ = fmt.Fprintln(tw, "    no options")
+		default:
+			printOptions(tw, p.Options)
+		}
+	}
+	_ = tw.Flush()
+}
+
+func printOptions(w io.Writer, options []backends.ConfigOption) {
+	for _, o := range options {
+		required := "optional"
+		if o.Required {
+			required = "required"
+		}
+		line := fmt.Sprintf("    %s\t%s\t%s", o.Key, o.Type, required)
+		if o.Default != "" {
+			line += "\tdefault: " + o.Default
+		}
+		_, _ = fmt.Fprintln(w, line)
+	}
+}
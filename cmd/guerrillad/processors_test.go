@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintProcessors(t *testing.T) {
+	var buf bytes.Buffer
+	printProcessors(&buf)
+	out := buf.String()
+	for _, expect := range []string{
+		"backend_config options:",
+		"gw_save_timeout",
+		"default: 30s",
+		"  headersparser\n",
+		"  sql\n",
+		"sql_dsn",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Errorf("expecting the output to contain %q:\n%s", expect, out)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// sendmailOptions are the flags of the sendmail command
+type sendmailOptions struct {
+	server   string
+	from     string
+	to       []string
+	helo     string
+	subject  string
+	body     string
+	startTLS bool
+	insecure bool
+	timeout  time.Duration
+}
+
+var (
+	sendmailOpts sendmailOptions
+
+	sendmailCmd = &cobra.Command{
+		Use:   "sendmail",
+		Short: "send a test message and print the SMTP dialog",
+		Long: `Connects to an SMTP server, sends a test message to the recipients given with --to,
+and prints the dialog. Exits with a non-zero status if the message was not accepted.
+Use it to smoke-test a deployment, eg.
+guerrillad sendmail --server mx.example.com:25 --starttls --to test@example.com`,
+		Run: sendmail,
+	}
+)
+
+func init() {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	f := sendmailCmd.Flags()
+	f.StringVar(&sendmailOpts.server, "server", "127.0.0.1:25", "host:port of the SMTP server")
+	f.StringVar(&sendmailOpts.from, "from", "test@"+hostname, "sender address")
+	f.StringSliceVar(&sendmailOpts.to, "to", nil, "recipient address, can be repeated")
+	f.StringVar(&sendmailOpts.helo, "helo", hostname, "host name to send with EHLO")
+	f.StringVar(&sendmailOpts.subject, "subject", "guerrillad test message", "subject of the message")
+	f.StringVar(&sendmailOpts.body, "body", "This is a test message sent by guerrillad sendmail.", "body of the message")
+	f.BoolVar(&sendmailOpts.startTLS, "starttls", false, "upgrade the connection with STARTTLS before sending")
+	f.BoolVar(&sendmailOpts.insecure, "insecure", false, "do not verify the server's certificate")
+	f.DurationVar(&sendmailOpts.timeout, "timeout", 30*time.Second, "timeout of the whole transaction")
+	rootCmd.AddCommand(sendmailCmd)
+}
+
+func sendmail(cmd *cobra.Command, args []string) {
+	if err := sendTestMail(cmd.OutOrStdout(), sendmailOpts); err != nil {
+		mainlog.WithError(err).Error("test message was not sent")
+		os.Exit(1)
+	}
+}
+
+// smtpDialog is an SMTP client connection that prints each line sent and received
+type smtpDialog struct {
+	conn net.Conn
+	text *textproto.Conn
+	out  io.Writer
+}
+
+func (d *smtpDialog) setConn(conn net.Conn) {
+	d.conn = conn
+	d.text = textproto.NewConn(conn)
+}
+
+func (d *smtpDialog) close() {
+	_ = d.conn.Close()
+}
+
+// cmd sends a command and reads the response, returning an error unless its code is expectCode
+func (d *smtpDialog) cmd(expectCode int, format string, args ...interface{}) error {
+	line := fmt.Sprintf(format, args...)
+	_, _ = fmt.Fprintf(d.out, "C: %s\n", line)
+	if err := d.text.PrintfLine("%s", line); err != nil {
+		return err
+	}
+	return d.response(expectCode)
+}
+
+// response reads a response, which may have multiple lines, returning an error unless its code is expectCode
+func (d *smtpDialog) response(expectCode int) error {
+	for {
+		line, err := d.text.ReadLine()
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(d.out, "S: %s\n", line)
+		if len(line) > 3 && line[3] == '-' {
+			continue
+		}
+		if !strings.HasPrefix(line, strconv.Itoa(expectCode)) {
+			return fmt.Errorf("expecting %d, got: %s", expectCode, line)
+		}
+		return nil
+	}
+}
+
+// dialSMTP connects to server, reads the greeting and sends EHLO, upgrading the connection with STARTTLS
+// if startTLS is true. The deadline of the connection is set to timeout from now. The dialog is written to out
+func dialSMTP(out io.Writer, server, helo string, startTLS, insecure bool, timeout time.Duration) (*smtpDialog, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server [%s]: %s", server, err)
+	}
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	_, _ = fmt.Fprintf(out, "*: connected to %s\n", conn.RemoteAddr())
+
+	d := &smtpDialog{out: out}
+	d.setConn(conn)
+	if err := d.response(220); err != nil {
+		d.close()
+		return nil, err
+	}
+	if err := d.cmd(250, "EHLO %s", helo); err != nil {
+		d.close()
+		return nil, err
+	}
+	if !startTLS {
+		return d, nil
+	}
+	if err := d.cmd(220, "STARTTLS"); err != nil {
+		d.close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: insecure})
+	if err := tlsConn.Handshake(); err != nil {
+		d.close()
+		return nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	_, _ = fmt.Fprintln(out, "*: TLS handshake completed")
+	d.setConn(tlsConn)
+	if err := d.cmd(250, "EHLO %s", helo); err != nil {
+		d.close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// sendTestMail sends a test message as described by opts, writing the dialog to out
+func sendTestMail(out io.Writer, opts sendmailOptions) error {
+	if len(opts.to) == 0 {
+		return errors.New("at least one recipient is required, use --to")
+	}
+	d, err := dialSMTP(out, opts.server, opts.helo, opts.startTLS, opts.insecure, opts.timeout)
+	if err != nil {
+		return err
+	}
+	defer d.close()
+	if err := d.cmd(250, "MAIL FROM:<%s>", opts.from); err != nil {
+		return err
+	}
+	for _, rcpt := range opts.to {
+		if err := d.cmd(250, "RCPT TO:<%s>", rcpt); err != nil {
+			return err
+		}
+	}
+	if err := d.cmd(354, "DATA"); err != nil {
+		return err
+	}
+	w := d.text.DotWriter()
+	for _, line := range testMessage(opts) {
+		_, _ = fmt.Fprintf(out, "C: %s\n", line)
+		if _, err := io.WriteString(w, line+"\r\n"); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(out, "C: .")
+	if err := d.response(250); err != nil {
+		return err
+	}
+	return d.cmd(221, "QUIT")
+}
+
+// testMessage returns the lines of the test message
+func testMessage(opts sendmailOptions) []string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	lines := []string{
+		"From: <" + opts.from + ">",
+		"To: <" + strings.Join(opts.to, ">, <") + ">",
+		"Subject: " + opts.subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-ID: <" + hex.EncodeToString(id) + "@" + opts.helo + ">",
+		"",
+	}
+	return append(lines, strings.Split(opts.body, "\n")...)
+}
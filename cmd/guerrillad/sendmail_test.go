@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/flashmob/go-guerrilla/tests/testcert"
+)
+
+func TestSendTestMail(t *testing.T) {
+	err := testcert.GenerateCert("mail2.guerrillamail.com", "", 365*24*time.Hour, false, 2048, "P256", "../../tests/")
+	if err != nil {
+		t.Fatal("failed to generate a test certificate", err)
+	}
+	d := guerrilla.Daemon{Config: &guerrilla.AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers: []guerrilla.ServerConfig{{
+			ListenInterface: "127.0.0.1:2560",
+			IsEnabled:       true,
+			Hostname:        "mail2.guerrillamail.com",
+			TLS: guerrilla.ServerTLSConfig{
+				StartTLSOn:     true,
+				PrivateKeyFile: "../../tests/mail2.guerrillamail.com.key.pem",
+				PublicKeyFile:  "../../tests/mail2.guerrillamail.com.cert.pem",
+			},
+		}},
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	opts := sendmailOptions{
+		server:   "127.0.0.1:2560",
+		from:     "test@example.com",
+		to:       []string{"test@grr.la"},
+		helo:     "client.example.com",
+		subject:  "smoke test",
+		body:     "hello",
+		startTLS: true,
+		insecure: true,
+		timeout:  10 * time.Second,
+	}
+	var out bytes.Buffer
+	if err := sendTestMail(&out, opts); err != nil {
+		t.Fatal(err, out.String())
+	}
+	for _, expect := range []string{
+		"S: 220 mail2.guerrillamail.com",
+		"C: STARTTLS\n",
+		"*: TLS handshake completed\n",
+		"C: RCPT TO:<test@grr.la>\n",
+		"C: Subject: smoke test\n",
+		"S: 250 2.0.0 OK: queued as ",
+		"S: 221 ",
+	} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("expecting the dialog to contain %q:\n%s", expect, out.String())
+		}
+	}
+
+	opts.to = []string{"test@example.org"}
+	out.Reset()
+	if err := sendTestMail(&out, opts); err == nil || !strings.Contains(err.Error(), "expecting 250") {
+		t.Error("expecting the recipient to be rejected, got", err)
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
 	"time"
 
 	"github.com/flashmob/go-guerrilla"
@@ -24,11 +24,14 @@ import (
 
 const (
 	defaultPidFile = "/var/run/go-guerrilla.pid"
+	// watchRetryDelay is how long to wait before watching the config source again after an error
+	watchRetryDelay = 5 * time.Second
 )
 
 var (
-	configPath string
-	pidFile    string
+	configPath   string
+	configSource string
+	pidFile      string
 
 	serveCmd = &cobra.Command{
 		Use:   "serve",
@@ -36,6 +39,9 @@ var (
 		Run:   serve,
 	}
 
+	// src is set when the config is loaded from a config source
+	src guerrilla.ConfigSource
+
 	signalChannel = make(chan os.Signal, 1) // for trapping SIGHUP and friends
 	mainlog       log.Logger
 
@@ -55,61 +61,66 @@ func init() {
 	}
 	serveCmd.PersistentFlags().StringVarP(&configPath, "config", "c",
 		cfgFile, "Path to the configuration file")
+	serveCmd.PersistentFlags().StringArrayVar(&configSets, "set", nil,
+		"Override a config key after the config is loaded, eg. --set servers[0].listen_interface=:2525 (can be repeated)")
+	serveCmd.PersistentFlags().StringVarP(&configSource, "config-source", "",
+		"", "Load the configuration from consul://host:port/key or etcd://host:port/key instead of a file, and watch it for changes")
 	// intentionally didn't specify default pidFile; value from config is used if flag is empty
 	serveCmd.PersistentFlags().StringVarP(&pidFile, "pidFile", "p",
 		"", "Path to the pid file")
 	rootCmd.AddCommand(serveCmd)
 }
 
-func sigHandler() {
-	signal.Notify(signalChannel,
-		syscall.SIGHUP,
-		syscall.SIGTERM,
-		syscall.SIGQUIT,
-		syscall.SIGINT,
-		syscall.SIGKILL,
-		syscall.SIGUSR1,
-		os.Kill,
-	)
-	for sig := range signalChannel {
-		if sig == syscall.SIGHUP {
-			if ac, err := readConfig(configPath, pidFile); err == nil {
-				_ = d.ReloadConfig(*ac)
-			} else {
-				mainlog.WithError(err).Error("Could not reload config")
-			}
-		} else if sig == syscall.SIGUSR1 {
-			if err := d.ReopenLogs(); err != nil {
-				mainlog.WithError(err).Error("reopening logs failed")
-			}
-		} else if sig == syscall.SIGTERM || sig == syscall.SIGQUIT || sig == syscall.SIGINT || sig == os.Kill {
-			mainlog.Infof("Shutdown signal caught")
-			go func() {
-				select {
-				// exit if graceful shutdown not finished in 60 sec.
-				case <-time.After(time.Second * 60):
-					mainlog.Error("graceful shutdown timed out")
-					os.Exit(1)
-				}
-			}()
-			d.Shutdown()
-			mainlog.Infof("Shutdown completed, exiting.")
-			return
-		} else {
-			mainlog.Infof("Shutdown, unknown signal caught")
-			return
-		}
+// reloadConfig reads the config again and applies any changes
+func reloadConfig() {
+	if ac, err := readConfig(configPath, pidFile); err == nil {
+		_ = d.ReloadConfig(*ac)
+	} else {
+		mainlog.WithError(err).Error("Could not reload config")
+	}
+}
+
+// reopenLogs re-opens all log files, eg. after they were rotated
+func reopenLogs() {
+	if err := d.ReopenLogs(); err != nil {
+		mainlog.WithError(err).Error("reopening logs failed")
 	}
 }
 
+// shutdown shuts down the daemon gracefully, exits if it takes longer than 60 seconds
+func shutdown() {
+	mainlog.Infof("Shutdown signal caught")
+	go func() {
+		select {
+		// exit if graceful shutdown not finished in 60 sec.
+		case <-time.After(time.Second * 60):
+			mainlog.Error("graceful shutdown timed out")
+			os.Exit(1)
+		}
+	}()
+	d.Shutdown()
+	mainlog.Infof("Shutdown completed, exiting.")
+}
+
 func serve(cmd *cobra.Command, args []string) {
 	logVersion()
 	d = guerrilla.Daemon{Logger: mainlog}
+	if configSource != "" {
+		var err error
+		if src, err = guerrilla.NewConfigSource(configSource); err != nil {
+			mainlog.WithError(err).Fatal("Invalid config source")
+		}
+	}
 	c, err := readConfig(configPath, pidFile)
 	if err != nil {
 		mainlog.WithError(err).Fatal("Error while reading config")
 	}
 	_ = d.SetConfig(*c)
+	// reloads requested through the admin API apply the command line flags, same as SIGHUP
+	d.SetConfigReader(func() (guerrilla.AppConfig, error) {
+		ac, err := readConfig(configPath, pidFile)
+		return *ac, err
+	})
 
 	// Check that max clients is not greater than system open file limit.
 	if ok, maxClients, fileLimit := guerrilla.CheckFileLimit(c); !ok {
@@ -122,12 +133,62 @@ func serve(cmd *cobra.Command, args []string) {
 		mainlog.WithError(err).Error("Error(s) when creating new server(s)")
 		os.Exit(1)
 	}
+	notifyUpgraded()
+	if src != nil {
+		go watchConfigSource(src)
+	}
 	sigHandler()
 
 }
 
+// upgradeFDEnv is set by the process being upgraded, to the file descriptor of a pipe for reporting
+// back once the servers started
+const upgradeFDEnv = "GUERRILLAD_UPGRADE_FD"
+
+const upgradeReady = "ok"
+
+// notifyUpgraded tells the process that started us for an upgrade that the servers started
+func notifyUpgraded() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeFDEnv))
+	_ = os.Unsetenv(upgradeFDEnv)
+	if err != nil {
+		return
+	}
+	if f := os.NewFile(uintptr(fd), "upgrade"); f != nil {
+		if _, err := f.WriteString(upgradeReady); err != nil {
+			mainlog.WithError(err).Error("could not notify the process being upgraded")
+		}
+		_ = f.Close()
+	}
+}
+
+// watchConfigSource reloads the config each time it changes in the remote store
+func watchConfigSource(src guerrilla.ConfigSource) {
+	for {
+		data, err := src.Watch(context.Background())
+		if err != nil {
+			mainlog.WithError(err).Errorf("Error while watching config source %s", configSource)
+			time.Sleep(watchRetryDelay)
+			continue
+		}
+		ac, err := parseConfig(data, pidFile)
+		if err != nil {
+			mainlog.WithError(err).Error("Could not reload config from config source")
+			continue
+		}
+		_ = d.ReloadConfig(*ac)
+	}
+}
+
 // ReadConfig is called at startup, or when a SIG_HUP is caught
 func readConfig(path string, pidFile string) (*guerrilla.AppConfig, error) {
+	if src != nil {
+		data, err := src.Fetch(context.Background())
+		if err != nil {
+			return &guerrilla.AppConfig{}, fmt.Errorf("could not fetch config from %s: %s", configSource, err.Error())
+		}
+		return parseConfig(data, pidFile)
+	}
 	// Load in the config.
 	// Note here is the only place we can make an exception to the
 	// "treat config values as immutable". For example, here the
@@ -136,6 +197,23 @@ func readConfig(path string, pidFile string) (*guerrilla.AppConfig, error) {
 	if err != nil {
 		return &appConfig, fmt.Errorf("could not read config file: %s", err.Error())
 	}
+	return overrideConfig(&appConfig, pidFile)
+}
+
+// parseConfig loads a config document that was fetched from the config source
+func parseConfig(data []byte, pidFile string) (*guerrilla.AppConfig, error) {
+	var appConfig guerrilla.AppConfig
+	if err := appConfig.Load(data); err != nil {
+		return &appConfig, err
+	}
+	return overrideConfig(&appConfig, pidFile)
+}
+
+// overrideConfig applies the command line flags to the config
+func overrideConfig(appConfig *guerrilla.AppConfig, pidFile string) (*guerrilla.AppConfig, error) {
+	if err := applyOverrides(appConfig, configSets); err != nil {
+		return appConfig, err
+	}
 	// override config pidFile with with flag from the command line
 	if len(pidFile) > 0 {
 		appConfig.PidFile = pidFile
@@ -145,5 +223,5 @@ func readConfig(path string, pidFile string) (*guerrilla.AppConfig, error) {
 	if verbose {
 		appConfig.LogLevel = "debug"
 	}
-	return &appConfig, nil
+	return appConfig, nil
 }
@@ -838,7 +838,8 @@ func TestServerStopEvent(t *testing.T) {
 	// send a sighup signal to the server
 	sigHup()
 	// detect config change
-	if _, err := grepTestlog("Listening on TCP 127.0.0.1:2228", 0); err != nil {
+	started, err := grepTestlog("Listening on TCP 127.0.0.1:2228", 0)
+	if err != nil {
 		t.Error("new server didn't start")
 	}
 
@@ -871,7 +872,7 @@ func TestServerStopEvent(t *testing.T) {
 	// send a sighup signal to the server
 	sigHup()
 	// detect config change
-	if _, err := grepTestlog("Server [127.0.0.1:2228] has stopped accepting new clients", 27); err != nil {
+	if _, err := grepTestlog("Server [127.0.0.1:2228] stopped.", started); err != nil {
 		t.Error("127.0.0.1:2228 did not stop")
 	}
 
@@ -0,0 +1,154 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+)
+
+// how long to wait for the new process to start during an upgrade
+var upgradeTimeout = 30 * time.Second
+
+// sigHandler blocks until the daemon is shut down.
+// SIGHUP reloads the config, SIGUSR1 re-opens the logs, SIGUSR2 upgrades to a new binary,
+// SIGTERM/SIGQUIT/SIGINT shut down
+func sigHandler() {
+	signal.Notify(signalChannel,
+		syscall.SIGHUP,
+		syscall.SIGTERM,
+		syscall.SIGQUIT,
+		syscall.SIGINT,
+		syscall.SIGKILL,
+		syscall.SIGUSR1,
+		syscall.SIGUSR2,
+		os.Kill,
+	)
+	for sig := range signalChannel {
+		if sig == syscall.SIGHUP {
+			reloadConfig()
+		} else if sig == syscall.SIGUSR1 {
+			reopenLogs()
+		} else if sig == syscall.SIGUSR2 {
+			if err := upgrade(); err != nil {
+				mainlog.WithError(err).Error("upgrade failed, continuing with the current process")
+				continue
+			}
+			drain()
+			return
+		} else if sig == syscall.SIGTERM || sig == syscall.SIGQUIT || sig == syscall.SIGINT || sig == os.Kill {
+			shutdown()
+			return
+		} else {
+			mainlog.Infof("Shutdown, unknown signal caught")
+			return
+		}
+	}
+}
+
+// upgrade starts a new guerrillad process from the same path and arguments, handing over the listeners.
+// The admin API, pprof and the dashboard are stopped first, the new process listens on their interfaces,
+// they're started again if the upgrade fails. Returns when the new process has started its servers, the new
+// process is killed if it did not start them
+func upgrade() (err error) {
+	files, ifaces, err := d.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	d.StopHTTPServers()
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := d.StartHTTPServers(); err != nil {
+			mainlog.WithError(err).Error("could not restart the admin API, pprof or the dashboard")
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// the pipe for reporting back follows the listener files
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		guerrilla.ListenFDsEnv+"="+strings.Join(ifaces, ","),
+		upgradeFDEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	mainlog.Infof("Upgrading, starting a new process with the listeners for %s", strings.Join(ifaces, ", "))
+	err = cmd.Start()
+	_ = w.Close()
+	if err != nil {
+		return err
+	}
+	go func() {
+		// don't leave a zombie if the new process exits early
+		_ = cmd.Wait()
+	}()
+	ready := make(chan error, 1)
+	go func() {
+		// the new process writes "ok" after its servers started, or exits
+		msg, err := ioutil.ReadAll(r)
+		if err == nil && string(msg) != upgradeReady {
+			err = fmt.Errorf("new process (pid %d) did not start", cmd.Process.Pid)
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("new process (pid %d) did not start in %s", cmd.Process.Pid, upgradeTimeout)
+	}
+	if err != nil {
+		// it has the listeners, it must not serve alongside us
+		_ = cmd.Process.Kill()
+		return err
+	}
+	mainlog.Infof("New process (pid %d) started, draining", cmd.Process.Pid)
+	return nil
+}
+
+// drain stops accepting clients, waits for the connected clients to finish, then shuts down
+func drain() {
+	var wg sync.WaitGroup
+	for _, s := range d.Status().Servers {
+		if s.State != "running" {
+			continue
+		}
+		wg.Add(1)
+		go func(iface string) {
+			defer wg.Done()
+			if err := d.DrainServer(iface); err != nil {
+				mainlog.WithError(err).Errorf("could not drain server [%s]", iface)
+			}
+		}(s.ListenInterface)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(guerrilla.DefaultShutdownTimeout):
+		mainlog.Error("clients did not finish draining in time")
+	}
+	shutdown()
+}
@@ -0,0 +1,191 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/spf13/cobra"
+)
+
+var configJsonUpgrade = `
+{
+    "log_file" : "../../tests/testlog",
+    "log_level" : "debug",
+    "pid_file" : "./pidfile.pid",
+    "allowed_hosts": ["grr.la"],
+    "admin": {"listen_interface": "127.0.0.1:8026", "token": "secret"},
+    "backend_config": {
+        "save_workers_size" : 1,
+        "save_process": "HeadersParser|Debugger"
+    },
+    "servers" : [
+        {
+            "is_enabled" : true,
+            "host_name":"mail.test.com",
+            "listen_interface":"127.0.0.1:3537",
+            "log_file" : "../../tests/testlog"
+        }
+    ]
+}
+`
+
+// adminStatus returns the status code of GET /status of the admin API in configJsonUpgrade
+func adminStatus() (int, error) {
+	req, err := http.NewRequest("GET", "http://127.0.0.1:8026/status", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// start the server with the admin API, then SIGUSR2 to upgrade: the new process must be able to start
+// the admin API, and the old process exits.
+// The processes are started by executing the test, the old one exits once drained
+func TestUpgradeAdmin(t *testing.T) {
+	var err error
+	mainlog, err = getTestLog()
+	if err != nil {
+		t.Fatal("could not get logger,", err)
+	}
+	cmd := &cobra.Command{}
+	configPath = "configJsonUpgrade.json"
+	switch os.Getenv("BE_UPGRADED") {
+	case "old":
+		// the new process is started with our arguments and environment
+		if err := os.Setenv("BE_UPGRADED", "new"); err != nil {
+			t.Fatal(err)
+		}
+		serve(cmd, []string{})
+		return
+	case "new":
+		// serve() exits if the admin API cannot listen
+		serve(cmd, []string{})
+		return
+	}
+	defer cleanTestArtifacts(t)
+	defer func() { _ = os.Remove(configPath) }()
+	if err := ioutil.WriteFile(configPath, []byte(configJsonUpgrade), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := exec.Command(os.Args[0], "-test.run=^TestUpgradeAdmin$")
+	old.Env = append(os.Environ(), "BE_UPGRADED=old")
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- old.Wait()
+	}()
+	for i := 0; ; i++ {
+		if code, err := adminStatus(); err == nil && code == http.StatusOK {
+			break
+		} else if i == 100 {
+			_ = old.Process.Kill()
+			t.Fatal("the admin API did not start", code, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := old.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Error("the old process failed", err)
+		}
+	case <-time.After(time.Minute):
+		_ = old.Process.Kill()
+		t.Fatal("the old process did not exit, the upgrade failed")
+	}
+	data, err := ioutil.ReadFile("pidfile.pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil || pid == old.Process.Pid {
+		t.Fatal("expecting the pid of the new process, got", string(data), err)
+	}
+	defer func() { _ = syscall.Kill(pid, syscall.SIGTERM) }()
+	if code, err := adminStatus(); err != nil || code != http.StatusOK {
+		t.Error("expecting the new process to serve the admin API, got", code, err)
+	}
+}
+
+// the new process that never reports back is killed when the upgrade times out, the old one keeps serving
+func TestUpgradeTimeout(t *testing.T) {
+	if os.Getenv("BE_UPGRADED") == "hang" {
+		// the new process, it never starts its servers
+		if err := ioutil.WriteFile("upgrade.pid", []byte(strconv.Itoa(os.Getpid())), 0644); err == nil {
+			time.Sleep(time.Minute)
+		}
+		return
+	}
+	var err error
+	mainlog, err = getTestLog()
+	if err != nil {
+		t.Fatal("could not get logger,", err)
+	}
+	defer func() { _ = os.Remove("upgrade.pid") }()
+	d = guerrilla.Daemon{Config: &guerrilla.AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers: []guerrilla.ServerConfig{{
+			ListenInterface: "127.0.0.1:2563",
+			IsEnabled:       true,
+			MaxClients:      10,
+		}},
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	args, timeout := os.Args, upgradeTimeout
+	defer func() { os.Args, upgradeTimeout = args, timeout }()
+	os.Args = []string{os.Args[0], "-test.run=^TestUpgradeTimeout$"}
+	upgradeTimeout = 5 * time.Second
+	if err := os.Setenv("BE_UPGRADED", "hang"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Unsetenv("BE_UPGRADED") }()
+
+	if err := upgrade(); err == nil {
+		t.Fatal("expecting the upgrade to time out")
+	}
+	data, err := ioutil.ReadFile("upgrade.pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i == 50 {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatal("expecting the new process to be killed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:2563"); err != nil {
+		t.Error("expecting the old process to keep serving, got", err)
+	} else {
+		_ = conn.Close()
+	}
+}
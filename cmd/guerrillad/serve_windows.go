@@ -0,0 +1,64 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceName is the name that guerrillad runs under as a Windows service.
+const serviceName = "guerrillad"
+
+// reopenLogsCmd is a user-defined service control code to re-open the logs,
+// eg. sc control guerrillad 128
+const reopenLogsCmd = svc.Cmd(128)
+
+// sigHandler blocks until the daemon is shut down.
+// When running as a Windows service, the service control codes are used instead of signals:
+// stop/shutdown to shut down, paramchange to reload the config and 128 to re-open the logs.
+// When running from a console, Ctrl+C shuts down, and the config is reloaded when its file is saved
+func sigHandler() {
+	if interactive, err := svc.IsAnInteractiveSession(); err == nil && !interactive {
+		if err := svc.Run(serviceName, &windowsService{}); err != nil {
+			mainlog.WithError(err).Error("Windows service failed")
+		}
+		return
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfig(configPath, stop, reloadConfig)
+	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	for range signalChannel {
+		shutdown()
+		return
+	}
+}
+
+// windowsService implements svc.Handler, dispatching the service control codes
+type windowsService struct{}
+
+func (s *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	changes <- svc.Status{State: svc.Running, Accepts: accepts}
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+		case svc.ParamChange:
+			reloadConfig()
+		case reopenLogsCmd:
+			reopenLogs()
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending}
+			shutdown()
+			return false, 0
+		default:
+			mainlog.Infof("unexpected service control request #%d", c.Cmd)
+		}
+	}
+	return false, 0
+}
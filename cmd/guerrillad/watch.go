@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// configWatchInterval is how often the config file is checked for changes by watchConfig
+var configWatchInterval = 5 * time.Second
+
+// watchConfig calls reload each time the file at path is modified, until stop is closed.
+// It reloads the config where there is no signal to send, eg. in a Windows console
+func watchConfig(path string, stop <-chan struct{}, reload func()) {
+	modTime, size := fileStamp(path)
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m, s := fileStamp(path)
+			if m.Equal(modTime) && s == size {
+				continue
+			}
+			modTime, size = m, s
+			if !m.IsZero() {
+				// not while the file is missing, eg. replaced by an editor
+				reload()
+			}
+		}
+	}
+}
+
+// fileStamp returns the modification time and the size of the file, zero if it cannot be read
+func fileStamp(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
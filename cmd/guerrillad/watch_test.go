@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	saved := configWatchInterval
+	configWatchInterval = 10 * time.Millisecond
+	defer func() { configWatchInterval = saved }()
+	f, err := ioutil.TempFile("", "guerrillad-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	_ = f.Close()
+	defer func() { _ = os.Remove(path) }()
+
+	reloads := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfig(path, stop, func() { reloads <- struct{}{} })
+	select {
+	case <-reloads:
+		t.Fatal("the config should not be reloaded before it changes")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"log_level": "debug"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+	case <-time.After(time.Second):
+		t.Fatal("the config should be reloaded once it changed")
+	}
+	// missing, then written again
+	_ = os.Remove(path)
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(path, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+	case <-time.After(time.Second):
+		t.Fatal("the config should be reloaded once written again")
+	}
+	if len(reloads) != 0 {
+		t.Error("expecting one reload for each change, got more", len(reloads))
+	}
+}
@@ -1,17 +1,31 @@
 package guerrilla
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
 	"strings"
 	"time"
 
 	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/dashboard"
+	"github.com/flashmob/go-guerrilla/dnscache"
 	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/metrics"
+	"github.com/flashmob/go-guerrilla/notify"
+	"github.com/flashmob/go-guerrilla/outbound"
+	"github.com/flashmob/go-guerrilla/reputation"
+	"github.com/flashmob/go-guerrilla/retention"
+	"github.com/flashmob/go-guerrilla/stats"
+	"github.com/flashmob/go-guerrilla/tracing"
 )
 
 // AppConfig is the holder of the configuration of the app
@@ -21,6 +35,9 @@ type AppConfig struct {
 	Servers []ServerConfig `json:"servers"`
 	// AllowedHosts lists which hosts to accept email for. Defaults to os.Hostname
 	AllowedHosts []string `json:"allowed_hosts"`
+	// AllowedHostsFile is the path to a newline-delimited list of hosts to accept email for, in addition
+	// to AllowedHosts. Lines starting with # are ignored. The file is reloaded when it's modified
+	AllowedHostsFile string `json:"allowed_hosts_file,omitempty"`
 	// PidFile is the path for writing out the process id. No output if empty
 	PidFile string `json:"pid_file"`
 	// LogFile is where the logs go. Use path to file, or "stderr", "stdout"
@@ -29,8 +46,55 @@ type AppConfig struct {
 	// LogLevel controls the lowest level we log.
 	// "info", "debug", "error", "panic". Default "info"
 	LogLevel string `json:"log_level,omitempty"`
+	// LogFormat is "text" (the default) or "json", for all the logs
+	LogFormat string `json:"log_format,omitempty"`
 	// BackendConfig configures the email envelope processing backend
 	BackendConfig backends.BackendConfig `json:"backend_config"`
+	// Include is a glob pattern of config fragments to merge in, eg. "conf.d/*.json".
+	// Relative to the config file's directory. Fragments may only contain servers (appended),
+	// allowed_hosts (appended), domains and backend_config (merged, the last file wins)
+	Include string `json:"include,omitempty"`
+	// Admin configures the admin HTTP API, disabled by default
+	Admin AdminConfig `json:"admin"`
+	// Tracing configures the tracing of connections, transactions and backend processors, disabled by default
+	Tracing tracing.Config `json:"tracing"`
+	// Metrics configures sending metrics to StatsD or a Datadog agent, disabled by default
+	Metrics metrics.Config `json:"metrics"`
+	// Webhooks configures the notification of message events to webhooks, disabled by default
+	Webhooks notify.Config `json:"webhooks"`
+	// Stats configures the statistics of the messages received, per listener and per recipient domain
+	Stats stats.Config `json:"stats"`
+	// Dashboard configures the web dashboard, disabled by default
+	Dashboard dashboard.Config `json:"dashboard"`
+	// PprofPort exposes net/http/pprof on 127.0.0.1:<pprof_port>, for investigating deadlocks and leaks.
+	// Disabled if 0
+	PprofPort int `json:"pprof_port,omitempty"`
+	// DataBudget is the number of bytes of DATA that the clients of all the servers may hold in memory together.
+	// Once used up, DATA is deferred with a 452 until some messages are done. Bytes spooled to disk
+	// (see spool_threshold) are not counted. No limit if 0
+	DataBudget int64 `json:"data_budget,omitempty"`
+	// Reputation configures the scoring of the clients' IP addresses and what to do with them, disabled by default
+	Reputation reputation.Config `json:"reputation"`
+	// DNS configures the caching resolver of the policy lookups, eg. the DNSBL queries.
+	// The system resolver is used when no upstream is set
+	DNS dnscache.Config `json:"dns"`
+	// Domains are settings for the recipients of some of the allowed hosts, eg. a catch-all address
+	// or the save route of their messages
+	Domains DomainsConfig `json:"domains,omitempty"`
+	// Retention deletes or archives the messages stored by the backend's processors once they are
+	// older than the max age of their recipient's rule, disabled by default
+	Retention retention.Config `json:"retention"`
+	// Outbound configures the queue of the messages to deliver to the MX of their recipients, which the
+	// Outbound processor queues to. Disabled by default
+	Outbound outbound.Config `json:"outbound"`
+}
+
+// configFragment is the part of the config that can be set in an included file
+type configFragment struct {
+	Servers       []ServerConfig         `json:"servers"`
+	AllowedHosts  []string               `json:"allowed_hosts"`
+	Domains       DomainsConfig          `json:"domains"`
+	BackendConfig backends.BackendConfig `json:"backend_config"`
 }
 
 // ServerConfig specifies config options for a single server
@@ -50,18 +114,88 @@ type ServerConfig struct {
 	// MaxSize is the maximum size of an email that will be accepted for delivery.
 	// Defaults to 10 Mebibytes
 	MaxSize int64 `json:"max_size"`
+	// MaxHops is the number of Received header fields a message may have, a message with more is
+	// rejected as looping. Defaults to 25
+	MaxHops int `json:"max_hops,omitempty"`
 	// Timeout specifies the connection timeout in seconds. Defaults to 30
 	Timeout int `json:"timeout"`
+	// IdleTimeout is how many seconds a client may wait between transactions before it's disconnected,
+	// when it's less than Timeout. Timeout applies if 0
+	IdleTimeout int `json:"idle_timeout,omitempty"`
 	// MaxClients controls how many maximum clients we can handle at once.
 	// Defaults to defaultMaxClients
 	MaxClients int `json:"max_clients"`
+	// ReadBufferSize and WriteBufferSize are the sizes of each client's read and write buffers, in bytes.
+	// Larger buffers need fewer reads and writes, smaller ones save memory when there are many clients.
+	// DefaultBufferSize if 0, the read buffer cannot be smaller than MinReadBufferSize.
+	// Changes apply to the clients that connect after a reload
+	ReadBufferSize  int `json:"read_buffer_size,omitempty"`
+	WriteBufferSize int `json:"write_buffer_size,omitempty"`
+	// ReusePort opens AcceptLoops listening sockets on the listen interface with SO_REUSEPORT, each accepting
+	// clients in its own goroutine, for very high connection rates. Only on Linux and the BSDs.
+	// Changes apply when the server is next started
+	ReusePort bool `json:"reuse_port,omitempty"`
+	// AcceptLoops is the number of sockets opened when ReusePort is set, one per CPU core (GOMAXPROCS) if 0
+	AcceptLoops int `json:"accept_loops,omitempty"`
+	// MaxDataSessions is how many of the server's clients may be sending DATA at once, the DATA command of
+	// the others is deferred while the clients in the command phase are still served. No limit if 0
+	MaxDataSessions int `json:"max_data_sessions,omitempty"`
 	// IsEnabled set to true to start the server, false will ignore it
 	IsEnabled bool `json:"is_enabled"`
 	// XClientOn when using a proxy such as Nginx, XCLIENT command is used to pass the
 	// original client's IP address & client's HELO
 	XClientOn bool `json:"xclient_on,omitempty"`
+	// SpoolThreshold is the number of bytes of message data to keep in memory, the rest will be
+	// spooled to a temporary file. 0 (default) keeps everything in memory
+	SpoolThreshold int64 `json:"spool_threshold,omitempty"`
+	// SpoolDir is where to create the spool files. Defaults to the OS temp dir
+	SpoolDir string `json:"spool_dir,omitempty"`
+	// TranscriptDir is where to record the SMTP dialog of each connection, for debugging interoperability
+	// problems. Each connection is recorded to a file named after its queued id. Disabled if empty
+	TranscriptDir string `json:"transcript_dir,omitempty"`
+	// TranscriptDataLimit is how many bytes of each message to record, the rest is truncated. 0 records it all
+	TranscriptDataLimit int64 `json:"transcript_data_limit,omitempty"`
+	// TranscriptRedactData records only the size of each message, instead of its data
+	TranscriptRedactData bool `json:"transcript_redact_data,omitempty"`
+	// Tags label the envelopes received by the server, eg. {"tenant": "acme"}, so that the processors can
+	// route them (see mail.Envelope.Tags). The server's metrics are tagged with them too, eg. "tenant:acme"
+	Tags map[string]string `json:"tags,omitempty"`
+	// RelayDeniedResponse replaces the reply to the recipients of the domains that are not allowed,
+	// eg. "550 5.7.1 Relay access denied" to stop the retries. The domain is appended to it.
+	// Defaults to "454 4.1.1 Error: Relay access denied:"
+	RelayDeniedResponse string `json:"relay_denied_response,omitempty"`
+	// AddressLiterals is what to do with the addresses whose domain is an IP address, eg. hi@[192.0.2.1]:
+	// "allow" them (the default), "reject" them in MAIL FROM and RCPT TO, or "reject_rcpt" to reject the recipients only
+	AddressLiterals string `json:"address_literals,omitempty"`
+	// MaxHeaderSize is the maximum size of the header of a message, in bytes, checked as the message is read.
+	// 0 leaves it to max_size
+	MaxHeaderSize int64 `json:"max_header_size,omitempty"`
+	// Strict7Bit is what to do with the messages that have 8-bit bytes when the client did not declare
+	// BODY=8BITMIME: "reject" them, or "transcode" their body to quoted-printable (the messages that cannot be
+	// transcoded, eg. multipart, are rejected). 8BITMIME is advertised when it's set, by default they are accepted
+	Strict7Bit string `json:"strict_7bit,omitempty"`
+	// NullSenderMaxSize is the maximum size of the messages from the null sender <>, ie. the bounces.
+	// 0 leaves them to max_size
+	NullSenderMaxSize int64 `json:"null_sender_max_size,omitempty"`
+	// NullSenderSingleRcpt accepts one recipient for each message from the null sender, as a bounce
+	// is sent to its original sender only. The other recipients are deferred
+	NullSenderSingleRcpt bool `json:"null_sender_single_rcpt,omitempty"`
+	// CommandHistory is how many of the last commands of each client to keep, to see what a rejected client
+	// attempted. They are logged when a message is rejected and when the client disconnects, and are in the
+	// client:disconnect and message:rejected events. 0 (default) keeps none
+	CommandHistory int `json:"command_history,omitempty"`
+	// TarpitDelay is how many seconds each reply to a client tarpitted by the connection policy is held,
+	// see Daemon.SetConnectionPolicy. Defaults to 10
+	TarpitDelay int `json:"tarpit_delay,omitempty"`
 }
 
+// the values of address_literals
+const (
+	addressLiteralsAllow      = "allow"
+	addressLiteralsReject     = "reject"
+	addressLiteralsRejectRcpt = "reject_rcpt"
+)
+
 type ServerTLSConfig struct {
 	// TLS Protocols to use. [0] = min, [1]max
 	// Use Go's default if empty
@@ -159,10 +293,18 @@ const defaultMaxSize = int64(10 << 20) // 10 Mebibytes
 // Unmarshalls json data into AppConfig struct and any other initialization of the struct
 // also does validation, returns error if validation failed or something went wrong
 func (c *AppConfig) Load(jsonBytes []byte) error {
+	return c.load(jsonBytes, "")
+}
+
+// load is like Load, dir is the directory that relative includes are resolved from
+func (c *AppConfig) load(jsonBytes []byte, dir string) error {
 	err := json.Unmarshal(jsonBytes, c)
 	if err != nil {
 		return fmt.Errorf("could not parse config file: %s", err)
 	}
+	if err = c.loadIncludes(dir); err != nil {
+		return err
+	}
 	if err = c.setDefaults(); err != nil {
 		return err
 	}
@@ -186,6 +328,50 @@ func (c *AppConfig) Load(jsonBytes []byte) error {
 	return nil
 }
 
+// loadIncludes merges the config fragments matched by c.Include, in lexical order of their file names
+func (c *AppConfig) loadIncludes(dir string) error {
+	if c.Include == "" {
+		return nil
+	}
+	pattern := c.Include
+	if !filepath.IsAbs(pattern) && dir != "" {
+		pattern = filepath.Join(dir, pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid include pattern [%s]: %s", c.Include, err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("could not read included config file: %s", err)
+		}
+		var frag configFragment
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&frag); err != nil {
+			return fmt.Errorf("could not parse included config file [%s]: %s", file, err)
+		}
+		c.Servers = append(c.Servers, frag.Servers...)
+		c.AllowedHosts = append(c.AllowedHosts, frag.AllowedHosts...)
+		if len(frag.Domains) > 0 && c.Domains == nil {
+			c.Domains = make(DomainsConfig, len(frag.Domains))
+		}
+		for name, d := range frag.Domains {
+			c.Domains[name] = d
+		}
+		if len(frag.BackendConfig) > 0 && c.BackendConfig == nil {
+			c.BackendConfig = make(backends.BackendConfig, len(frag.BackendConfig))
+		}
+		for key, val := range frag.BackendConfig {
+			c.BackendConfig[key] = val
+		}
+	}
+	// the fragments are merged now, don't include them again if this config is loaded again (eg. by SetConfig)
+	c.Include = ""
+	return nil
+}
+
 // Emits any configuration change events onto the event bus.
 func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	// has backend changed?
@@ -197,9 +383,49 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 		app.Publish(EventConfigNewConfig, c)
 	}
 	// has 'allowed hosts' changed?
-	if !reflect.DeepEqual(oldConfig.AllowedHosts, c.AllowedHosts) {
+	if !reflect.DeepEqual(oldConfig.AllowedHosts, c.AllowedHosts) || oldConfig.AllowedHostsFile != c.AllowedHostsFile {
 		app.Publish(EventConfigAllowedHosts, c)
 	}
+	// has tracing changed?
+	if !reflect.DeepEqual(oldConfig.Tracing, c.Tracing) {
+		app.Publish(EventConfigTracing, c)
+	}
+	// has metrics changed?
+	if !reflect.DeepEqual(oldConfig.Metrics, c.Metrics) {
+		app.Publish(EventConfigMetrics, c)
+	}
+	// have the webhooks changed?
+	if !reflect.DeepEqual(oldConfig.Webhooks, c.Webhooks) {
+		app.Publish(EventConfigWebhooks, c)
+	}
+	// have the stats changed?
+	if !reflect.DeepEqual(oldConfig.Stats, c.Stats) {
+		app.Publish(EventConfigStats, c)
+	}
+	// has the data budget changed?
+	if oldConfig.DataBudget != c.DataBudget {
+		app.Publish(EventConfigDataBudget, c)
+	}
+	// has the reputation changed?
+	if !reflect.DeepEqual(oldConfig.Reputation, c.Reputation) {
+		app.Publish(EventConfigReputation, c)
+	}
+	// has the dns config changed?
+	if !reflect.DeepEqual(oldConfig.DNS, c.DNS) {
+		app.Publish(EventConfigDNS, c)
+	}
+	// have the domains changed?
+	if !reflect.DeepEqual(oldConfig.Domains, c.Domains) {
+		app.Publish(EventConfigDomains, c)
+	}
+	// has the retention changed?
+	if !reflect.DeepEqual(oldConfig.Retention, c.Retention) {
+		app.Publish(EventConfigRetention, c)
+	}
+	// has the outbound config changed?
+	if !reflect.DeepEqual(oldConfig.Outbound, c.Outbound) {
+		app.Publish(EventConfigOutbound, c)
+	}
 	// has pid file changed?
 	if strings.Compare(oldConfig.PidFile, c.PidFile) != 0 {
 		app.Publish(EventConfigPidFile, c)
@@ -208,6 +434,10 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	if strings.Compare(oldConfig.LogFile, c.LogFile) != 0 {
 		app.Publish(EventConfigLogFile, c)
 	}
+	// has log format changed?
+	if oldConfig.LogFormat != c.LogFormat {
+		app.Publish(EventConfigLogFormat, c)
+	}
 	// has log level changed?
 	if strings.Compare(oldConfig.LogLevel, c.LogLevel) != 0 {
 		app.Publish(EventConfigLogLevel, c)
@@ -233,6 +463,39 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	}
 }
 
+// Validate checks the sections of the config, pprof_port and data_budget. The servers are checked by Load and
+// the backend_config by backends.ValidateConfig. Returns Errors with each error found
+func (c *AppConfig) Validate() error {
+	var errs Errors
+	for _, err := range []error{
+		log.ValidateFormat(c.LogFormat),
+		c.Admin.Validate(),
+		c.Tracing.Validate(),
+		c.Metrics.Validate(),
+		c.Webhooks.Validate(),
+		validatePprofPort(c.PprofPort),
+		validateDataBudget(c.DataBudget),
+		c.Stats.Validate(),
+		c.Reputation.Validate(),
+		c.DNS.Validate(),
+		c.Domains.Validate(c.BackendConfig),
+		c.Retention.Validate(),
+		c.Outbound.Validate(),
+		c.Dashboard.Validate(),
+	} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.Outbound.DANE && len(c.DNS.Upstream) == 0 {
+		errs = append(errs, errors.New("outbound dane needs dns upstream servers that validate DNSSEC"))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
 // EmitLogReopen emits log reopen events using existing config
 func (c *AppConfig) EmitLogReopenEvents(app Guerrilla) {
 	app.Publish(EventConfigLogReopen, c)
@@ -268,7 +531,17 @@ func (c *AppConfig) setDefaults() error {
 	if c.LogLevel == "" {
 		c.LogLevel = "debug"
 	}
-	if len(c.AllowedHosts) == 0 {
+	if err := log.ValidateFormat(c.LogFormat); err != nil {
+		return err
+	}
+	for _, h := range c.AllowedHosts {
+		if strings.HasPrefix(h, "~") {
+			if _, err := compileHostPattern(h[1:]); err != nil {
+				return fmt.Errorf("invalid allowed host pattern [%s]: %s", h, err)
+			}
+		}
+	}
+	if len(c.AllowedHosts) == 0 && c.AllowedHostsFile == "" {
 		if h, err := os.Hostname(); err != nil {
 			return err
 		} else {
@@ -292,24 +565,10 @@ func (c *AppConfig) setDefaults() error {
 	} else {
 		// make sure each server has defaults correctly configured
 		for i := range c.Servers {
-			if c.Servers[i].Hostname == "" {
-				c.Servers[i].Hostname = h
-			}
-			if c.Servers[i].MaxClients == 0 {
-				c.Servers[i].MaxClients = defaultMaxClients
-			}
-			if c.Servers[i].Timeout == 0 {
-				c.Servers[i].Timeout = defaultTimeout
-			}
-			if c.Servers[i].MaxSize == 0 {
-				c.Servers[i].MaxSize = defaultMaxSize // 10 Mebibytes
-			}
 			if c.Servers[i].ListenInterface == "" {
 				return fmt.Errorf("listen interface not specified for server at index %d", i)
 			}
-			if c.Servers[i].LogFile == "" {
-				c.Servers[i].LogFile = c.LogFile
-			}
+			c.Servers[i].setDefaults(h, c.LogFile)
 			// validate the server config
 			err = c.Servers[i].Validate()
 			if err != nil {
@@ -320,6 +579,25 @@ func (c *AppConfig) setDefaults() error {
 	return nil
 }
 
+// setDefaults sets the default values for the server's options that were not set
+func (sc *ServerConfig) setDefaults(hostname string, logFile string) {
+	if sc.Hostname == "" {
+		sc.Hostname = hostname
+	}
+	if sc.MaxClients == 0 {
+		sc.MaxClients = defaultMaxClients
+	}
+	if sc.Timeout == 0 {
+		sc.Timeout = defaultTimeout
+	}
+	if sc.MaxSize == 0 {
+		sc.MaxSize = defaultMaxSize // 10 Mebibytes
+	}
+	if sc.LogFile == "" {
+		sc.LogFile = logFile
+	}
+}
+
 // setBackendDefaults sets default values for the backend config,
 // if no backend config was added before starting, then use a default config
 // otherwise, see what required values were missed in the config and add any missing with defaults
@@ -437,6 +715,15 @@ func (sc *ServerConfig) loadTlsKeyTimestamps() error {
 }
 
 // Validate validates the server's configuration.
+// rejectionCode matches the codes of a 4xx or 5xx reply, eg. "550 5.7.1", the enhanced code being optional
+var rejectionCode = regexp.MustCompile(`^([45])[0-9]{2}(?: ([45])\.[0-9]{1,3}\.[0-9]{1,3})?(?: |$)`)
+
+// isRejection returns true if reply starts with a 4xx or 5xx code, whose class matches its enhanced code
+func isRejection(reply string) bool {
+	m := rejectionCode.FindStringSubmatch(reply)
+	return m != nil && (m[2] == "" || m[1] == m[2])
+}
+
 func (sc *ServerConfig) Validate() error {
 	var errs Errors
 
@@ -451,6 +738,68 @@ func (sc *ServerConfig) Validate() error {
 			errs = append(errs, fmt.Errorf("cannot use TLS config for [%s], %v", sc.ListenInterface, err))
 		}
 	}
+	if sc.TranscriptDir != "" {
+		if fi, err := os.Stat(sc.TranscriptDir); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("transcript_dir [%s] is not a directory", sc.TranscriptDir))
+		}
+	}
+	if sc.TranscriptDataLimit < 0 {
+		errs = append(errs, errors.New("transcript_data_limit cannot be negative"))
+	}
+	if sc.ReadBufferSize != 0 && sc.ReadBufferSize < MinReadBufferSize {
+		errs = append(errs, fmt.Errorf("read_buffer_size cannot be less than %d", MinReadBufferSize))
+	}
+	for key := range sc.Tags {
+		if key == "" || strings.ContainsAny(key, ":,") {
+			errs = append(errs, fmt.Errorf("tags: [%s] is not a valid tag name", key))
+		}
+	}
+	if sc.RelayDeniedResponse != "" && !isRejection(sc.RelayDeniedResponse) {
+		errs = append(errs, errors.New("relay_denied_response must start with a 4xx or 5xx code, eg. \"550 5.7.1\""))
+	}
+	switch sc.AddressLiterals {
+	case "", addressLiteralsAllow, addressLiteralsReject, addressLiteralsRejectRcpt:
+	default:
+		errs = append(errs, fmt.Errorf("address_literals must be %s, %s or %s",
+			addressLiteralsAllow, addressLiteralsReject, addressLiteralsRejectRcpt))
+	}
+	switch sc.Strict7Bit {
+	case "", strict7BitReject, strict7BitTranscode:
+	default:
+		errs = append(errs, fmt.Errorf("strict_7bit must be %s or %s", strict7BitReject, strict7BitTranscode))
+	}
+	if sc.MaxHeaderSize < 0 {
+		errs = append(errs, errors.New("max_header_size cannot be negative"))
+	}
+	if sc.TarpitDelay < 0 {
+		errs = append(errs, errors.New("tarpit_delay cannot be negative"))
+	}
+	if sc.CommandHistory < 0 {
+		errs = append(errs, errors.New("command_history cannot be negative"))
+	}
+	if sc.NullSenderMaxSize < 0 {
+		errs = append(errs, errors.New("null_sender_max_size cannot be negative"))
+	}
+	if sc.MaxDataSessions < 0 {
+		errs = append(errs, errors.New("max_data_sessions cannot be negative"))
+	}
+	if sc.MaxHops < 0 {
+		errs = append(errs, errors.New("max_hops cannot be negative"))
+	}
+	if sc.WriteBufferSize < 0 {
+		errs = append(errs, errors.New("write_buffer_size cannot be negative"))
+	}
+	if sc.ReusePort && !reusePortSupported {
+		errs = append(errs, errors.New("reuse_port is not supported on this platform"))
+	}
+	if sc.AcceptLoops < 0 {
+		errs = append(errs, errors.New("accept_loops cannot be negative"))
+	}
+	if sc.IdleTimeout < 0 {
+		errs = append(errs, errors.New("idle_timeout cannot be negative"))
+	} else if sc.Timeout > 0 && sc.IdleTimeout > sc.Timeout {
+		errs = append(errs, errors.New("idle_timeout cannot be more than timeout"))
+	}
 	if len(errs) > 0 {
 		return errs
 	}
@@ -458,6 +807,14 @@ func (sc *ServerConfig) Validate() error {
 	return nil
 }
 
+// acceptLoops returns the number of sockets opened with reuse_port
+func (sc *ServerConfig) acceptLoops() int {
+	if sc.AcceptLoops > 0 {
+		return sc.AcceptLoops
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
 // Gets the timestamp of the TLS certificates. Returns a unix time of when they were last modified
 // when the config was read. We use this info to determine if TLS needs to be re-loaded.
 func (stc *ServerTLSConfig) getTlsKeyTimestamps() (int64, int64) {
@@ -501,7 +858,7 @@ func getChanges(a interface{}, b interface{}) map[string]interface{} {
 }
 
 // Convert fields of a struct to a map
-// only able to convert int, bool, slice-of-strings and string; not recursive
+// only able to convert int, bool, slice-of-strings, map-of-strings and string; not recursive
 // slices are marshal'd to json for convenient comparison later
 func structtomap(obj interface{}) map[string]interface{} {
 	ret := make(map[string]interface{})
@@ -525,6 +882,12 @@ func structtomap(obj interface{}) map[string]interface{} {
 			ret[fName] = value
 		case reflect.Slice:
 			ret[fName] = vField.Interface().([]string)
+		case reflect.Map:
+			// compared as json, which sorts the keys
+			if m, ok := vField.Interface().(map[string]string); ok {
+				value, _ := json.Marshal(m)
+				ret[fName] = string(value)
+			}
 		}
 	}
 	return ret
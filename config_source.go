@@ -0,0 +1,247 @@
+package guerrilla
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ConfigSource is a remote store that holds the config JSON document, such as Consul or etcd.
+// Pass the loaded document to AppConfig.Load, and reload it with Daemon.ReloadConfig when Watch returns
+type ConfigSource interface {
+	// Fetch returns the current config document
+	Fetch(ctx context.Context) ([]byte, error)
+	// Watch blocks until the document changes from the last one returned by Fetch or Watch,
+	// then returns the new document. Returns an error if ctx is done
+	Watch(ctx context.Context) ([]byte, error)
+}
+
+// NewConfigSource returns a ConfigSource for a URL of the form
+// consul://host:port/key/path or etcd://host:port/key/path
+// Use consul+https or etcd+https for TLS. The Consul ACL token is read from the token query parameter
+func NewConfigSource(rawURL string) (ConfigSource, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("config source [%s] needs a host and a key", rawURL)
+	}
+	scheme := "http"
+	kind := u.Scheme
+	if strings.HasSuffix(kind, "+https") {
+		scheme = "https"
+		kind = strings.TrimSuffix(kind, "+https")
+	}
+	addr := scheme + "://" + u.Host
+	switch kind {
+	case "consul":
+		return NewConsulConfigSource(addr, key, u.Query().Get("token")), nil
+	case "etcd":
+		return NewEtcdConfigSource(addr, key), nil
+	}
+	return nil, fmt.Errorf("unsupported config source [%s], use consul:// or etcd://", u.Scheme)
+}
+
+// remote config sources use long polling, so the client has no overall timeout
+var configSourceClient = &http.Client{}
+
+// consulConfigSource reads a key from the Consul KV store, using blocking queries to watch
+type consulConfigSource struct {
+	addr  string
+	key   string
+	token string
+	index uint64
+	last  []byte
+}
+
+// NewConsulConfigSource returns a ConfigSource for key in Consul's KV store, addr is like http://127.0.0.1:8500
+func NewConsulConfigSource(addr, key, token string) ConfigSource {
+	return &consulConfigSource{addr: strings.TrimSuffix(addr, "/"), key: key, token: token}
+}
+
+func (c *consulConfigSource) get(ctx context.Context, index uint64) ([]byte, uint64, error) {
+	u := c.addr + "/v1/kv/" + c.key + "?raw"
+	if index > 0 {
+		u += "&wait=5m&index=" + strconv.FormatUint(index, 10)
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := configSourceClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s for key [%s]", resp.Status, c.key)
+	}
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, errors.New("consul response is missing X-Consul-Index")
+	}
+	return body, newIndex, nil
+}
+
+func (c *consulConfigSource) Fetch(ctx context.Context) ([]byte, error) {
+	data, index, err := c.get(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	c.index, c.last = index, data
+	return data, nil
+}
+
+func (c *consulConfigSource) Watch(ctx context.Context) ([]byte, error) {
+	for {
+		data, index, err := c.get(ctx, c.index)
+		if err != nil {
+			return nil, err
+		}
+		if index < c.index {
+			// the index went backwards, eg. the raft snapshot was restored. Start over
+			index = 0
+		}
+		c.index = index
+		if !bytes.Equal(data, c.last) {
+			c.last = data
+			return data, nil
+		}
+		// woken up without a change to the value
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// etcdConfigSource reads a key from etcd, using the v3 JSON gateway
+type etcdConfigSource struct {
+	addr     string
+	key      string
+	revision int64
+}
+
+// NewEtcdConfigSource returns a ConfigSource for key in etcd (v3 API), addr is like http://127.0.0.1:2379
+func NewEtcdConfigSource(addr, key string) ConfigSource {
+	return &etcdConfigSource{addr: strings.TrimSuffix(addr, "/"), key: key}
+}
+
+// etcdKV is a key-value in etcd's JSON gateway responses, []byte fields are base64 encoded
+type etcdKV struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+func (e *etcdConfigSource) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", e.addr+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := configSourceClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("etcd returned %s for key [%s]", resp.Status, e.key)
+	}
+	return resp, nil
+}
+
+func (e *etcdConfigSource) Fetch(ctx context.Context) ([]byte, error) {
+	resp, err := e.post(ctx, "/v3/kv/range", map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(e.key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var r struct {
+		Header etcdHeader `json:"header"`
+		Kvs    []etcdKV   `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if len(r.Kvs) == 0 {
+		return nil, fmt.Errorf("etcd key [%s] not found", e.key)
+	}
+	e.revision = r.Header.Revision
+	return r.Kvs[0].Value, nil
+}
+
+func (e *etcdConfigSource) Watch(ctx context.Context) ([]byte, error) {
+	// the watch stream is closed when we return, the next Watch continues from the next revision
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := e.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]string{
+			"key":            base64.StdEncoding.EncodeToString([]byte(e.key)),
+			"start_revision": strconv.FormatInt(e.revision+1, 10),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var r struct {
+			Result struct {
+				Header   etcdHeader `json:"header"`
+				Canceled bool       `json:"canceled"`
+				Events   []struct {
+					Type string `json:"type"`
+					Kv   etcdKV `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&r); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if r.Result.Canceled {
+			return nil, fmt.Errorf("etcd cancelled the watch for key [%s]", e.key)
+		}
+		var value []byte
+		for _, ev := range r.Result.Events {
+			// a deleted key is ignored, keep running with the last config
+			if ev.Type != "DELETE" {
+				value = ev.Kv.Value
+			}
+			e.revision = ev.Kv.ModRevision
+		}
+		if value != nil {
+			return value, nil
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package guerrilla
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewConfigSource(t *testing.T) {
+	if src, err := NewConfigSource("consul://127.0.0.1:8500/guerrilla/config?token=abc"); err != nil {
+		t.Error(err)
+	} else if c, ok := src.(*consulConfigSource); !ok || c.addr != "http://127.0.0.1:8500" || c.key != "guerrilla/config" || c.token != "abc" {
+		t.Errorf("unexpected consul source %+v", src)
+	}
+	if src, err := NewConfigSource("etcd+https://etcd.local:2379/guerrilla"); err != nil {
+		t.Error(err)
+	} else if e, ok := src.(*etcdConfigSource); !ok || e.addr != "https://etcd.local:2379" || e.key != "guerrilla" {
+		t.Errorf("unexpected etcd source %+v", src)
+	}
+	for _, bad := range []string{"zookeeper://127.0.0.1/x", "consul://127.0.0.1:8500/", "consul:///key"} {
+		if _, err := NewConfigSource(bad); err == nil {
+			t.Error("expecting an error for", bad)
+		}
+	}
+}
+
+// fakeKV holds a value and its index, waking up blocked readers when it changes
+type fakeKV struct {
+	sync.Mutex
+	value   string
+	index   uint64
+	changed chan struct{}
+}
+
+func (kv *fakeKV) set(value string) {
+	kv.Lock()
+	defer kv.Unlock()
+	kv.value = value
+	kv.index++
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+}
+
+func (kv *fakeKV) get() (string, uint64, chan struct{}) {
+	kv.Lock()
+	defer kv.Unlock()
+	return kv.value, kv.index, kv.changed
+}
+
+func TestConsulConfigSource(t *testing.T) {
+	kv := &fakeKV{value: `{"log_level":"info"}`, index: 10, changed: make(chan struct{})}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/guerrilla/config" || r.Header.Get("X-Consul-Token") != "secret" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		value, index, changed := kv.get()
+		if wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); wait >= index {
+			select {
+			case <-changed:
+				value, index, _ = kv.get()
+			case <-time.After(50 * time.Millisecond):
+				// blocking query timed out, the value did not change
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		_, _ = w.Write([]byte(value))
+	}))
+	defer ts.Close()
+
+	src := NewConsulConfigSource(ts.URL, "guerrilla/config", "secret")
+	data, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"log_level":"info"}` {
+		t.Error("unexpected config", string(data))
+	}
+	go func() {
+		time.Sleep(120 * time.Millisecond)
+		kv.set(`{"log_level":"debug"}`)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err = src.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"log_level":"debug"}` {
+		t.Error("unexpected config after watch", string(data))
+	}
+
+	if _, err := NewConsulConfigSource(ts.URL, "missing", "secret").Fetch(context.Background()); err == nil {
+		t.Error("expecting an error for a missing key")
+	}
+}
+
+func TestEtcdConfigSource(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("guerrilla/config"))
+	kv := &fakeKV{value: `{"log_level":"info"}`, index: 5, changed: make(chan struct{})}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			if !strings.Contains(string(body), key) {
+				_, _ = fmt.Fprint(w, `{"header":{"revision":"5"}}`)
+				return
+			}
+			value, index, _ := kv.get()
+			_, _ = fmt.Fprintf(w, `{"header":{"revision":"%d"},"kvs":[{"key":"%s","value":"%s","mod_revision":"%d"}]}`,
+				index, key, encode(value), index)
+		case "/v3/watch":
+			var req struct {
+				CreateRequest struct {
+					StartRevision uint64 `json:"start_revision,string"`
+				} `json:"create_request"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil || req.CreateRequest.StartRevision != 6 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _, changed := kv.get()
+			_, _ = fmt.Fprint(w, `{"result":{"header":{"revision":"5"},"created":true}}`)
+			w.(http.Flusher).Flush()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			value, index, _ := kv.get()
+			_, _ = fmt.Fprintf(w, `{"result":{"header":{"revision":"%d"},"events":[{"kv":{"key":"%s","value":"%s","mod_revision":"%d"}}]}}`,
+				index, key, encode(value), index)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer ts.Close()
+
+	src := NewEtcdConfigSource(ts.URL, "guerrilla/config")
+	data, err := src.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"log_level":"info"}` {
+		t.Error("unexpected config", string(data))
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		kv.set(`{"log_level":"debug"}`)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err = src.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"log_level":"debug"}` {
+		t.Error("unexpected config after watch", string(data))
+	}
+
+	if _, err := NewEtcdConfigSource(ts.URL, "missing").Fetch(context.Background()); err == nil {
+		t.Error("expecting an error for a missing key")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/flashmob/go-guerrilla/tests/testcert"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -194,6 +195,57 @@ func TestConfigLoad(t *testing.T) {
 	}
 }
 
+func TestConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"main.json": `{
+			"allowed_hosts": ["grr.la"],
+			"include": "conf.d/*.json",
+			"backend_config": {"log_received_mails": true, "save_workers_size": 1},
+			"servers": [{"is_enabled": true, "listen_interface": "127.0.0.1:2525"}]
+		}`,
+		"conf.d/10-server.json": `{
+			"allowed_hosts": ["spam4.me"],
+			"servers": [{"is_enabled": true, "listen_interface": "127.0.0.1:2526"}]
+		}`,
+		"conf.d/20-backend.json": `{"backend_config": {"save_workers_size": 2, "primary_mail_host": "grr.la"}}`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var d Daemon
+	ac, err := d.LoadConfig(filepath.Join(dir, "main.json"))
+	if err != nil {
+		t.Fatal("Cannot load config |", err)
+	}
+	if len(ac.Servers) != 2 || ac.Servers[1].ListenInterface != "127.0.0.1:2526" {
+		t.Error("expecting the included server to be appended, got", ac.Servers)
+	}
+	if len(ac.AllowedHosts) != 2 || ac.AllowedHosts[1] != "spam4.me" {
+		t.Error("expecting the included allowed host to be appended, got", ac.AllowedHosts)
+	}
+	if ac.BackendConfig["save_workers_size"] != float64(2) || ac.BackendConfig["log_received_mails"] != true {
+		t.Error("expecting the backend config to be merged, got", ac.BackendConfig)
+	}
+
+	// only servers, allowed_hosts and backend_config can be included
+	if err := ioutil.WriteFile(filepath.Join(dir, "conf.d/30-bad.json"), []byte(`{"log_level": "info"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.LoadConfig(filepath.Join(dir, "main.json")); err == nil || !strings.Contains(err.Error(), "30-bad.json") {
+		t.Error("expecting an error for the bad fragment, got", err)
+	}
+}
+
 // Test the sample config to make sure a valid one is given!
 func TestSampleConfig(t *testing.T) {
 	fileName := "goguerrilla.conf.sample"
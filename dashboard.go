@@ -0,0 +1,140 @@
+package guerrilla
+
+import (
+	"time"
+
+	"github.com/flashmob/go-guerrilla/dashboard"
+)
+
+// dashboardState is what the daemon keeps for the dashboard while it's running
+type dashboardState struct {
+	// tail keeps the last lines of the main log, it's kept across restarts of the dashboard
+	tail *dashboard.Tail
+	// stream pushes the client and message events, and the lines of the main log, to the dashboard's consumers
+	stream *dashboard.Stream
+	// handlers are the client and message event handlers, by event
+	handlers map[Event]interface{}
+}
+
+// dashboardSnapshot returns the state of the daemon shown on the dashboard
+func (d *Daemon) dashboardSnapshot() dashboard.Snapshot {
+	status := d.Status()
+	snapshot := dashboard.Snapshot{
+		Time:       time.Now(),
+		Uptime:     status.Uptime,
+		Goroutines: status.Goroutines,
+		HeapAlloc:  status.HeapAlloc,
+		Servers:    make([]dashboard.ServerStats, 0, len(status.Servers)),
+		Stats:      d.Stats(),
+		Log:        d.dashboardState.tail.Lines(),
+	}
+	for _, s := range status.Servers {
+		snapshot.Servers = append(snapshot.Servers, dashboard.ServerStats{
+			ListenInterface: s.ListenInterface,
+			State:           s.State,
+			ActiveClients:   s.ActiveClients,
+			MaxClients:      s.MaxClients,
+		})
+	}
+	if g, ok := d.g.(*guerrilla); ok {
+		if q, ok := g.backend().(interface{ QueueDepth() (int, int) }); ok {
+			snapshot.Queue.Depth, snapshot.Queue.Capacity = q.QueueDepth()
+		}
+	}
+	return snapshot
+}
+
+// attachDashboardTail makes the dashboard's tail keep the lines of the main log, which may have changed
+func (d *Daemon) attachDashboardTail() {
+	d.dashboardState.tail.Attach(d.Log())
+	if g, ok := d.g.(*guerrilla); ok {
+		d.dashboardState.tail.Attach(g.mainlog())
+	}
+}
+
+// startDashboard starts the dashboard, if it's enabled in the config
+func (d *Daemon) startDashboard() error {
+	d.adminGuard.Lock()
+	defer d.adminGuard.Unlock()
+	if d.dashboard != nil || d.Config.Dashboard.ListenInterface == "" {
+		return nil
+	}
+	ds := &d.dashboardState
+	if ds.tail == nil {
+		ds.tail = dashboard.NewTail(d.Config.Dashboard.LogLinesOrDefault())
+		ds.stream = dashboard.NewStream()
+		ds.tail.SetStream(ds.stream)
+	} else {
+		ds.tail.Resize(d.Config.Dashboard.LogLinesOrDefault())
+	}
+	db, err := dashboard.New(d.Config.Dashboard, d.dashboardSnapshot, ds.stream, d.Log())
+	if err != nil {
+		return err
+	}
+	if err := db.Start(); err != nil {
+		return err
+	}
+	d.attachDashboardTail()
+	ds.handlers = make(map[Event]interface{})
+	for _, topic := range []Event{EventClientConnect, EventClientDisconnect} {
+		topic := topic
+		ds.handlers[topic] = func(c ClientInfo) {
+			ds.stream.Publish(dashboard.StreamEvent{
+				Type:     topic.String(),
+				Time:     time.Now(),
+				Listener: c.Listener,
+				PeerIP:   c.Peer,
+				Data:     c,
+			})
+		}
+	}
+	for _, topic := range []Event{EventMessageAccepted, EventMessageRejected, EventMessageDeferred} {
+		topic := topic
+		ds.handlers[topic] = func(m MessageEvent) {
+			ds.stream.Publish(dashboard.StreamEvent{
+				Type:     topic.String(),
+				Time:     time.Now(),
+				Listener: m.Client.Listener,
+				PeerIP:   m.Client.Peer,
+				Data:     m,
+			})
+		}
+	}
+	for topic, handler := range ds.handlers {
+		_ = d.Subscribe(topic, handler)
+	}
+	d.dashboard = db
+	return nil
+}
+
+// stopDashboard stops the dashboard, if it's running
+func (d *Daemon) stopDashboard() {
+	d.adminGuard.Lock()
+	defer d.adminGuard.Unlock()
+	if d.dashboard == nil {
+		return
+	}
+	d.dashboard.Stop()
+	d.dashboard = nil
+	for topic, handler := range d.dashboardState.handlers {
+		_ = d.Unsubscribe(topic, handler)
+	}
+	d.dashboardState.handlers = nil
+}
+
+// reloadDashboard restarts the dashboard if its config changed
+func (d *Daemon) reloadDashboard(old dashboard.Config) {
+	if d.Config.Dashboard == old {
+		d.adminGuard.Lock()
+		if d.dashboard != nil {
+			// the main log may have changed
+			d.attachDashboardTail()
+		}
+		d.adminGuard.Unlock()
+		return
+	}
+	d.stopDashboard()
+	if err := d.startDashboard(); err != nil {
+		d.Log().WithError(err).Error("could not restart the dashboard")
+	}
+}
@@ -0,0 +1,319 @@
+// Package dashboard serves a web page with the live state of the daemon: the servers and their clients,
+// the backend's queue and the last lines of the log
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/stats"
+	"github.com/flashmob/go-guerrilla/webauth"
+)
+
+// DefaultLogLines is the number of log lines shown when log_lines is not set
+const DefaultLogLines = 50
+
+// how often the page refreshes itself, in seconds
+const refreshSeconds = 5
+
+// how long to wait for requests to finish when the dashboard is stopped
+const shutdownTimeout = 5 * time.Second
+
+// Config configures the dashboard. It's served over HTTPS unless it listens on a loopback address,
+// and requests must carry the token or a client certificate
+type Config struct {
+	// ListenInterface is the address the dashboard listens on, eg. "127.0.0.1:8080".
+	// The dashboard is disabled if empty
+	ListenInterface string `json:"listen_interface,omitempty"`
+	// Token authenticates requests. Browsers send it as the password of basic auth (the user name is ignored),
+	// other clients may send an "Authorization: Bearer <token>" header. It may be left empty if clients
+	// are authenticated with certificates, see ClientCAFile
+	Token string `json:"token,omitempty"`
+	// PrivateKeyFile and PublicKeyFile are the TLS key and certificate of the dashboard.
+	// TLS is required unless the dashboard listens on a loopback address
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	PublicKeyFile  string `json:"public_key_file,omitempty"`
+	// ClientCAFile are the certificates of the CAs that sign the client certificates, in PEM format.
+	// If set, clients must present a valid certificate
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+	// LogLines is how many of the last log lines are shown, DefaultLogLines if 0
+	LogLines int `json:"log_lines,omitempty"`
+}
+
+// Validate checks the config, an empty config is valid (dashboard disabled)
+func (c *Config) Validate() error {
+	if c.ListenInterface == "" {
+		return nil
+	}
+	s := c.settings()
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if c.LogLines < 0 {
+		return fmt.Errorf("dashboard log_lines [%d] cannot be negative", c.LogLines)
+	}
+	return nil
+}
+
+// settings returns the security settings of the dashboard's listener
+func (c *Config) settings() webauth.Settings {
+	return webauth.Settings{
+		Name:            "dashboard",
+		ListenInterface: c.ListenInterface,
+		Token:           c.Token,
+		PrivateKeyFile:  c.PrivateKeyFile,
+		PublicKeyFile:   c.PublicKeyFile,
+		ClientCAFile:    c.ClientCAFile,
+	}
+}
+
+// LogLinesOrDefault returns the number of log lines to keep
+func (c *Config) LogLinesOrDefault() int {
+	if c.LogLines == 0 {
+		return DefaultLogLines
+	}
+	return c.LogLines
+}
+
+// ServerStats is the state of a server
+type ServerStats struct {
+	ListenInterface string `json:"listen_interface"`
+	State           string `json:"state"`
+	ActiveClients   int    `json:"active_clients"`
+	MaxClients      int    `json:"max_clients"`
+}
+
+// QueueStats is the backend's queue of envelopes waiting for a worker
+type QueueStats struct {
+	Depth int `json:"depth"`
+	// Capacity is 0 if the backend does not report its queue
+	Capacity int `json:"capacity"`
+}
+
+// Snapshot is what the dashboard shows
+type Snapshot struct {
+	Time       time.Time     `json:"time"`
+	Uptime     string        `json:"uptime"`
+	Goroutines int           `json:"goroutines"`
+	HeapAlloc  uint64        `json:"heap_alloc"`
+	Servers    []ServerStats `json:"servers"`
+	Queue      QueueStats    `json:"queue"`
+	// Stats are the messages received per listener and per recipient domain
+	Stats stats.Report `json:"stats"`
+	Log   []LogLine    `json:"log"`
+}
+
+// how many recipient domains are shown, the busiest in the last hour
+const pageDomains = 20
+
+// statsRow is a row of the tables of stats
+type statsRow struct {
+	Name string
+	stats.Windows
+}
+
+// Dashboard serves the snapshots returned by a function, and the events of a stream
+type Dashboard struct {
+	config   Config
+	snapshot func() Snapshot
+	stream   *Stream
+	log      log.Logger
+	srv      *http.Server
+	// done is closed when the dashboard stops, to end the streams of events
+	done chan struct{}
+}
+
+// New returns a dashboard for c, nil if c does not enable it. snapshot is called for each page.
+// The events published to stream are pushed to the consumers of /events, stream may be nil
+func New(c Config, snapshot func() Snapshot, stream *Stream, l log.Logger) (*Dashboard, error) {
+	if c.ListenInterface == "" {
+		return nil, nil
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	d := &Dashboard{config: c, snapshot: snapshot, stream: stream, log: l, done: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.page)
+	mux.HandleFunc("/stats", d.stats)
+	mux.HandleFunc("/live", d.live)
+	mux.HandleFunc("/events", d.events)
+	guard := webauth.NewGuard(c.settings(), `Basic realm="guerrilla"`, func(w http.ResponseWriter, code int, msg string) {
+		http.Error(w, msg, code)
+	})
+	d.srv = &http.Server{Handler: guard.Wrap(mux)}
+	return d, nil
+}
+
+// Start listens on the configured interface and serves the dashboard in a new goroutine
+func (d *Dashboard) Start() error {
+	settings := d.config.settings()
+	l, err := settings.Listen()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := d.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			d.log.WithError(err).Error("dashboard stopped")
+		}
+	}()
+	scheme := "http"
+	if settings.TLS() {
+		scheme = "https"
+	}
+	d.log.Infof("dashboard listening on %s://%s/", scheme, l.Addr())
+	return nil
+}
+
+// Stop stops accepting requests, waiting for the requests in progress to finish
+func (d *Dashboard) Stop() {
+	if d == nil {
+		return
+	}
+	// the streams are hijacked connections, Shutdown does not wait for them
+	close(d.done)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := d.srv.Shutdown(ctx); err != nil {
+		d.log.WithError(err).Error("dashboard did not shutdown cleanly")
+	}
+}
+
+// page renders the dashboard
+func (d *Dashboard) page(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Snapshot
+		Refresh   int
+		Listeners []statsRow
+		Domains   []statsRow
+	}{Snapshot: d.snapshot(), Refresh: refreshSeconds}
+	for name, w := range data.Stats.Listeners {
+		data.Listeners = append(data.Listeners, statsRow{name, w})
+	}
+	sort.Slice(data.Listeners, func(i, j int) bool {
+		return data.Listeners[i].Name < data.Listeners[j].Name
+	})
+	for _, name := range data.Stats.TopDomains(pageDomains) {
+		data.Domains = append(data.Domains, statsRow{name, data.Stats.Domains[name]})
+	}
+	if err := pageTemplate.Execute(w, data); err != nil {
+		d.log.WithError(err).Error("could not render the dashboard")
+	}
+}
+
+// live renders a page showing the events of /events as they come, the query's filter is passed on to /events
+func (d *Dashboard) live(w http.ResponseWriter, r *http.Request) {
+	if d.stream == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := ParseStreamFilter(r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := liveTemplate.Execute(w, r.URL.RawQuery); err != nil {
+		d.log.WithError(err).Error("could not render the live events")
+	}
+}
+
+// stats writes the snapshot as JSON
+func (d *Dashboard) stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(d.snapshot())
+}
+
+var pageTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>guerrillad</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+pre { background: #f4f4f4; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>guerrillad</h1>
+<p><a href="/live">Live events</a></p>
+<p>Up {{.Uptime}}, {{.Goroutines}} goroutines, {{.HeapAlloc}} bytes of heap. Updated {{.Time.Format "2006-01-02 15:04:05 MST"}}.</p>
+<h2>Servers</h2>
+<table>
+<tr><th>Listener</th><th>State</th><th>Clients</th></tr>
+{{range .Servers}}<tr><td>{{.ListenInterface}}</td><td>{{.State}}</td><td>{{.ActiveClients}} / {{.MaxClients}}</td></tr>
+{{end}}</table>
+<h2>Messages</h2>
+<p>Accepted / rejected / deferred messages, and bytes received.</p>
+{{define "windows"}}<td>{{.Minute.Accepted}} / {{.Minute.Rejected}} / {{.Minute.Deferred}}</td><td>{{.FiveMinute.Accepted}} / {{.FiveMinute.Rejected}} / {{.FiveMinute.Deferred}}</td><td>{{.Hour.Accepted}} / {{.Hour.Rejected}} / {{.Hour.Deferred}}</td><td>{{.Hour.Bytes}}</td>{{end}}
+<table>
+<tr><th>Listener</th><th>Last minute</th><th>Last 5 minutes</th><th>Last hour</th><th>Bytes, last hour</th></tr>
+{{range .Listeners}}<tr><td>{{.Name}}</td>{{template "windows" .Windows}}</tr>
+{{end}}</table>
+<table>
+<tr><th>Recipient domain</th><th>Last minute</th><th>Last 5 minutes</th><th>Last hour</th><th>Bytes, last hour</th></tr>
+{{range .Domains}}<tr><td>{{.Name}}</td>{{template "windows" .Windows}}</tr>
+{{end}}</table>
+<h2>Backend queue</h2>
+<p>{{if .Queue.Capacity}}{{.Queue.Depth}} of {{.Queue.Capacity}} envelopes waiting for a worker{{else}}not reported by the backend{{end}}</p>
+<h2>Log</h2>
+<pre>{{range .Log}}{{.Time.Format "2006-01-02 15:04:05"}} {{.Level}} {{.Message}}{{if .Fields}} {{.Fields}}{{end}}
+{{end}}</pre>
+</body>
+</html>
+`))
+
+var liveTemplate = template.Must(template.New("live").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>guerrillad live events</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f4f4f4; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Live events</h1>
+<p><a href="/">Dashboard</a>. Filter with ?listener=&lt;listen interface&gt;, ?ip=&lt;peer IP&gt; or ?level=&lt;log level&gt;.</p>
+<p id="status">connecting</p>
+<pre id="events"></pre>
+<script>
+var query = {{.}};
+var events = document.getElementById("events");
+var statusLine = document.getElementById("status");
+var ws = new WebSocket((location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/events" + (query ? "?" + query : ""));
+ws.onopen = function () { statusLine.textContent = "connected"; };
+ws.onclose = function () { statusLine.textContent = "disconnected, reload the page to reconnect"; };
+ws.onmessage = function (m) {
+	var e = JSON.parse(m.data);
+	var line = e.time + " " + e.type;
+	if (e.type === "log") {
+		line += " " + e.level + " " + e.data.message + (e.data.fields ? " " + e.data.fields : "");
+	} else {
+		line += " " + (e.listener || "") + " " + (e.peer_ip || "") + " " + JSON.stringify(e.data);
+	}
+	events.insertBefore(document.createTextNode(line + "\n"), events.firstChild);
+	while (events.childNodes.length > 500) {
+		events.removeChild(events.lastChild);
+	}
+};
+</script>
+</body>
+</html>
+`))
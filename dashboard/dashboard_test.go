@@ -0,0 +1,245 @@
+package dashboard
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/stats"
+	"github.com/flashmob/go-guerrilla/tests/testcert"
+	"golang.org/x/net/websocket"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := (&Config{}).Validate(); err != nil {
+		t.Error("a disabled dashboard should be valid", err)
+	}
+	for _, c := range []Config{
+		{ListenInterface: "127.0.0.1", Token: "x", PrivateKeyFile: "k", PublicKeyFile: "c"},
+		{ListenInterface: "127.0.0.1:8080", PrivateKeyFile: "k", PublicKeyFile: "c"},
+		{ListenInterface: "0.0.0.0:8080", Token: "x"},
+		{ListenInterface: "127.0.0.1:8080", Token: "x", PrivateKeyFile: "k", PublicKeyFile: "c", LogLines: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expecting an error for %+v", c)
+		}
+	}
+	// served over plain HTTP on a loopback address only
+	if err := (&Config{ListenInterface: "localhost:8080", Token: "x"}).Validate(); err != nil {
+		t.Error("expecting a loopback address without TLS to be valid", err)
+	}
+}
+
+func TestTail(t *testing.T) {
+	l, err := log.GetLogger(log.OutputOff.String(), "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail := NewTail(3)
+	tail.Attach(l)
+	// attaching again does not duplicate the lines
+	tail.Attach(l)
+	for _, msg := range []string{"one", "two", "three", "four"} {
+		l.WithField("n", msg).Info(msg)
+	}
+	l.Debug("not logged at the info level")
+	lines := tail.Lines()
+	if len(lines) != 3 || lines[0].Message != "two" || lines[2].Message != "four" {
+		t.Fatalf("expecting the last 3 lines, got %+v", lines)
+	}
+	if lines[2].Level != "info" || lines[2].Fields != "n=four" {
+		t.Errorf("unexpected line %+v", lines[2])
+	}
+	tail.Resize(2)
+	if lines = tail.Lines(); len(lines) != 2 || lines[0].Message != "three" {
+		t.Errorf("expecting the last 2 lines after resizing, got %+v", lines)
+	}
+	tail.Resize(4)
+	l.Info("five")
+	if lines = tail.Lines(); len(lines) != 3 || lines[2].Message != "five" {
+		t.Errorf("expecting 3 lines after growing, got %+v", lines)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	if err := testcert.GenerateCert("dashboard.test.com", "", 365*24*time.Hour, false, 2048, "P256", "../tests/"); err != nil {
+		t.Fatal("failed to generate a test certificate", err)
+	}
+	l, err := log.GetLogger(log.OutputOff.String(), "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := New(Config{}, nil, nil, l); d != nil || err != nil {
+		t.Error("expecting no dashboard when it's disabled", d, err)
+	}
+	snapshot := func() Snapshot {
+		return Snapshot{
+			Uptime:  "1m0s",
+			Servers: []ServerStats{{ListenInterface: "127.0.0.1:2525", State: "running"}},
+			Queue:   QueueStats{Depth: 1, Capacity: 4},
+			Stats: stats.Report{
+				Listeners: map[string]stats.Windows{"127.0.0.1:2525": {Hour: stats.Counts{Accepted: 7}}},
+				Domains:   map[string]stats.Windows{"example.com": {Hour: stats.Counts{Accepted: 7, Bytes: 1234}}},
+			},
+			Log: []LogLine{{Level: "info", Message: "<hello>"}},
+		}
+	}
+	d, err := New(Config{
+		ListenInterface: "127.0.0.1:2662",
+		Token:           "secret",
+		PrivateKeyFile:  "../tests/dashboard.test.com.key.pem",
+		PublicKeyFile:   "../tests/dashboard.test.com.cert.pem",
+	}, snapshot, NewStream(), l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	get := func(path string, auth func(r *http.Request)) (int, string) {
+		req, err := http.NewRequest("GET", "https://127.0.0.1:2662"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	noAuth := func(r *http.Request) {}
+	basic := func(r *http.Request) { r.SetBasicAuth("admin", "secret") }
+	bearer := func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }
+
+	if code, _ := get("/", noAuth); code != http.StatusUnauthorized {
+		t.Error("expecting 401 without a token, got", code)
+	}
+	if code, _ := get("/", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }); code != http.StatusUnauthorized {
+		t.Error("expecting 401 with a wrong token, got", code)
+	}
+	code, body := get("/", basic)
+	if code != http.StatusOK {
+		t.Fatal("expecting 200, got", code, body)
+	}
+	for _, expect := range []string{"127.0.0.1:2525", "1 of 4 envelopes", "&lt;hello&gt;", "example.com", "7 / 0 / 0", "1234"} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("expecting the page to contain %q, got %s", expect, body)
+		}
+	}
+	if code, _ := get("/nothing", basic); code != http.StatusNotFound {
+		t.Error("expecting 404, got", code)
+	}
+	code, body = get("/stats", bearer)
+	var s Snapshot
+	if err := json.Unmarshal([]byte(body), &s); err != nil || code != http.StatusOK {
+		t.Fatal("could not get the stats", code, err, body)
+	}
+	if len(s.Servers) != 1 || s.Stats.Domains["example.com"].Hour.Accepted != 7 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if code, body := get("/live?level=warning", basic); code != http.StatusOK || !strings.Contains(body, "warning") {
+		t.Error("expecting the live page to pass the filter on", code, body)
+	}
+	if code, _ := get("/live?level=loud", basic); code != http.StatusBadRequest {
+		t.Error("expecting 400 for an invalid level, got", code)
+	}
+
+	dial := func(origin string, token string) (*websocket.Conn, error) {
+		config, err := websocket.NewConfig("wss://127.0.0.1:2662/events?listener=127.0.0.1:2525", origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+		config.Header.Set("Authorization", "Bearer "+token)
+		return websocket.DialConfig(config)
+	}
+	if _, err := dial("https://127.0.0.1:2662", "wrong"); err == nil {
+		t.Error("expecting the stream to require the token")
+	}
+	if _, err := dial("https://example.com", "secret"); err == nil {
+		t.Error("expecting the stream to refuse other origins")
+	}
+	ws, err := dial("https://127.0.0.1:2662", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	// wait for the consumer to be subscribed
+	for i := 0; i < 100; i++ {
+		d.stream.Lock()
+		n := len(d.stream.consumers)
+		d.stream.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.stream.Publish(StreamEvent{Type: "client:connect", Listener: "127.0.0.1:2526"})
+	d.stream.Publish(StreamEvent{Type: "client:connect", Listener: "127.0.0.1:2525", PeerIP: "10.0.0.1"})
+	var e StreamEvent
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "client:connect" || e.Listener != "127.0.0.1:2525" || e.PeerIP != "10.0.0.1" {
+		t.Errorf("expecting only the events of the listener, got %+v", e)
+	}
+}
+
+func TestStreamFilter(t *testing.T) {
+	if _, err := ParseStreamFilter(url.Values{"level": {"loud"}}); err == nil {
+		t.Error("expecting an error for an invalid level")
+	}
+	f, err := ParseStreamFilter(url.Values{"ip": {"10.0.0.1"}, "level": {"warning"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		e     StreamEvent
+		match bool
+	}{
+		{StreamEvent{Type: "message:accepted", PeerIP: "10.0.0.1"}, true},
+		{StreamEvent{Type: "message:accepted", PeerIP: "10.0.0.2"}, false},
+		{StreamEvent{Type: EventLog, PeerIP: "10.0.0.1", Level: "error"}, true},
+		{StreamEvent{Type: EventLog, PeerIP: "10.0.0.1", Level: "info"}, false},
+	} {
+		if f.match(&c.e) != c.match {
+			t.Errorf("expecting match to be %t for %+v", c.match, c.e)
+		}
+	}
+
+	l, err := log.GetLogger(log.OutputOff.String(), "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStream()
+	c := s.subscribe(StreamFilter{Listener: "127.0.0.1:2525"})
+	tail := NewTail(0)
+	tail.SetStream(s)
+	tail.Attach(l)
+	l.WithField(log.FieldIface, "127.0.0.1:2525").Debug("for the listener")
+	l.Debug("not for the listener")
+	s.unsubscribe(c)
+	l.WithField(log.FieldIface, "127.0.0.1:2525").Debug("after unsubscribing")
+	if len(c) != 1 {
+		t.Fatalf("expecting one event, got %d", len(c))
+	}
+	if e := <-c; e.Type != EventLog || e.Data.(LogLine).Message != "for the listener" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if len(tail.Lines()) != 0 {
+		t.Error("expecting a tail of size 0 to keep no lines")
+	}
+}
@@ -0,0 +1,171 @@
+package dashboard
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// EventLog is the type of the events that carry a log line
+const EventLog = "log"
+
+// how many events are buffered for a consumer, the events that do not fit are dropped
+const streamBufferSize = 256
+
+// StreamEvent is an event pushed to the consumers of the stream
+type StreamEvent struct {
+	// Type is the daemon's event, eg. "client:connect" or "message:accepted", or EventLog
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Listener is the listen interface of the server the event is about, if any
+	Listener string `json:"listener,omitempty"`
+	// PeerIP is the IP of the client the event is about, if any
+	PeerIP string `json:"peer_ip,omitempty"`
+	// Level is the level of a log line
+	Level string `json:"level,omitempty"`
+	// Data is the daemon's event, or a LogLine
+	Data interface{} `json:"data"`
+}
+
+// StreamFilter selects the events sent to a consumer, the zero value selects them all
+type StreamFilter struct {
+	// Listener only selects the events about the server listening on it
+	Listener string
+	// PeerIP only selects the events about the clients from this IP
+	PeerIP string
+	// Level only selects the log lines of this level or more severe, the other events are not affected
+	Level string
+}
+
+// ParseStreamFilter reads a filter from the listener, ip and level parameters of a query
+func ParseStreamFilter(q url.Values) (StreamFilter, error) {
+	f := StreamFilter{Listener: q.Get("listener"), PeerIP: q.Get("ip"), Level: q.Get("level")}
+	if f.Level != "" {
+		if _, err := logrus.ParseLevel(f.Level); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// match returns true if e is selected by the filter
+func (f *StreamFilter) match(e *StreamEvent) bool {
+	if f.Listener != "" && f.Listener != e.Listener {
+		return false
+	}
+	if f.PeerIP != "" && f.PeerIP != e.PeerIP {
+		return false
+	}
+	if f.Level != "" && e.Type == EventLog {
+		min, _ := logrus.ParseLevel(f.Level)
+		level, err := logrus.ParseLevel(e.Level)
+		// logrus levels are more severe as they get lower
+		return err == nil && level <= min
+	}
+	return true
+}
+
+// Stream pushes events to its consumers, as they are published
+type Stream struct {
+	consumers map[chan StreamEvent]StreamFilter
+	sync.Mutex
+}
+
+// NewStream returns a stream without consumers
+func NewStream() *Stream {
+	return &Stream{consumers: make(map[chan StreamEvent]StreamFilter)}
+}
+
+// Publish sends e to the consumers whose filter selects it. It never blocks,
+// consumers that are too slow to keep up miss the events
+func (s *Stream) Publish(e StreamEvent) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for c, f := range s.consumers {
+		if !f.match(&e) {
+			continue
+		}
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving the events selected by f
+func (s *Stream) subscribe(f StreamFilter) chan StreamEvent {
+	c := make(chan StreamEvent, streamBufferSize)
+	s.Lock()
+	defer s.Unlock()
+	s.consumers[c] = f
+	return c
+}
+
+// unsubscribe stops sending events to c
+func (s *Stream) unsubscribe(c chan StreamEvent) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.consumers, c)
+}
+
+// sameOrigin rejects the WebSocket handshakes of pages from other sites, since browsers send the
+// credentials of the dashboard with them. Clients that do not send an Origin header are accepted
+func sameOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return errors.New("cross-origin WebSocket refused")
+	}
+	return nil
+}
+
+// events streams the events selected by the query's filter over a WebSocket, as JSON messages
+func (d *Dashboard) events(w http.ResponseWriter, r *http.Request) {
+	if d.stream == nil {
+		http.NotFound(w, r)
+		return
+	}
+	filter, err := ParseStreamFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	websocket.Server{
+		Handshake: sameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			c := d.stream.subscribe(filter)
+			defer d.stream.unsubscribe(c)
+			// the consumer does not send anything, reading returns when it goes away
+			gone := make(chan struct{})
+			go func() {
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+				close(gone)
+			}()
+			for {
+				select {
+				case e := <-c:
+					if err := websocket.JSON.Send(ws, e); err != nil {
+						return
+					}
+				case <-gone:
+					return
+				case <-d.done:
+					return
+				}
+			}
+		},
+	}.ServeHTTP(w, r)
+}
@@ -0,0 +1,140 @@
+package dashboard
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/sirupsen/logrus"
+)
+
+// LogLine is a log entry kept by a Tail
+type LogLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	// Fields are the entry's fields as key=value pairs, sorted by key
+	Fields string `json:"fields,omitempty"`
+}
+
+// Tail is a logrus hook that keeps the most recent log entries, and publishes them to a stream
+type Tail struct {
+	stream *Stream
+	lines  []LogLine
+	// next is the index of lines where the next entry goes
+	next int
+	// full is true once lines wrapped around
+	full bool
+	sync.Mutex
+	// attached are the loggers the tail was added to
+	attached map[log.Logger]bool
+	// attachGuard guards attached. Fire is called while the logger is locked,
+	// so the loggers must not be called with the tail's lock held
+	attachGuard sync.Mutex
+}
+
+// NewTail returns a tail that keeps the last size entries
+func NewTail(size int) *Tail {
+	return &Tail{
+		lines:    make([]LogLine, size),
+		attached: make(map[log.Logger]bool),
+	}
+}
+
+// SetStream makes the tail publish the entries to s, as EventLog events
+func (t *Tail) SetStream(s *Stream) {
+	t.Lock()
+	defer t.Unlock()
+	t.stream = s
+}
+
+// Attach adds the tail to a logger, it does nothing if the tail was already added to it
+func (t *Tail) Attach(l log.Logger) {
+	t.attachGuard.Lock()
+	defer t.attachGuard.Unlock()
+	if t.attached[l] {
+		return
+	}
+	t.attached[l] = true
+	l.AddHook(t)
+}
+
+// Levels implements logrus.Hook, the tail keeps the entries of every level that is logged
+func (t *Tail) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (t *Tail) Fire(e *logrus.Entry) error {
+	line := LogLine{Time: e.Time, Level: e.Level.String(), Message: e.Message}
+	if len(e.Data) > 0 {
+		keys := make([]string, 0, len(e.Data))
+		for k := range e.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			fields[i] = fmt.Sprintf("%s=%v", k, e.Data[k])
+		}
+		line.Fields = strings.Join(fields, " ")
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.stream != nil {
+		iface, _ := e.Data[log.FieldIface].(string)
+		peer, _ := e.Data[log.FieldPeer].(string)
+		t.stream.Publish(StreamEvent{
+			Type:     EventLog,
+			Time:     line.Time,
+			Listener: iface,
+			PeerIP:   peer,
+			Level:    line.Level,
+			Data:     line,
+		})
+	}
+	if len(t.lines) == 0 {
+		return nil
+	}
+	t.lines[t.next] = line
+	t.next++
+	if t.next == len(t.lines) {
+		t.next = 0
+		t.full = true
+	}
+	return nil
+}
+
+// Lines returns the entries kept, oldest first
+func (t *Tail) Lines() []LogLine {
+	t.Lock()
+	defer t.Unlock()
+	return t.ordered()
+}
+
+// ordered returns the entries kept, oldest first. The caller must hold the lock
+func (t *Tail) ordered() []LogLine {
+	if !t.full {
+		return append([]LogLine(nil), t.lines[:t.next]...)
+	}
+	return append(append([]LogLine(nil), t.lines[t.next:]...), t.lines[:t.next]...)
+}
+
+// Resize changes the number of entries kept, keeping the most recent ones
+func (t *Tail) Resize(size int) {
+	t.Lock()
+	defer t.Unlock()
+	lines := t.ordered()
+	if len(lines) > size {
+		lines = lines[len(lines)-size:]
+	}
+	t.lines = make([]LogLine, size)
+	t.next = copy(t.lines, lines)
+	t.full = size > 0 && t.next == size
+	if t.full {
+		t.next = 0
+	}
+}
@@ -0,0 +1,111 @@
+package guerrilla
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/dashboard"
+	"github.com/flashmob/go-guerrilla/tests/testcert"
+	"golang.org/x/net/websocket"
+)
+
+func TestDashboard(t *testing.T) {
+	if err := testcert.GenerateCert("dashboard.test.com", "", 365*24*time.Hour, false, 2048, "P256", "./tests/"); err != nil {
+		t.Fatal("failed to generate a test certificate", err)
+	}
+	d := Daemon{Config: &AppConfig{
+		LogFile:      "off",
+		AllowedHosts: []string{"grr.la"},
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2661", IsEnabled: true}},
+		Dashboard: dashboard.Config{
+			ListenInterface: "127.0.0.1:2663",
+			Token:           "secret",
+			PrivateKeyFile:  "./tests/dashboard.test.com.key.pem",
+			PublicKeyFile:   "./tests/dashboard.test.com.cert.pem",
+		},
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	config, err := websocket.NewConfig("wss://127.0.0.1:2663/events?listener=127.0.0.1:2661&level=error", "https://127.0.0.1:2663")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	config.Header.Set("Authorization", "Bearer secret")
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	// the handshake is done before the consumer is subscribed
+	time.Sleep(100 * time.Millisecond)
+
+	if err := talkToServer("127.0.0.1:2661"); err != nil {
+		t.Fatal(err)
+	}
+	// info lines are filtered out, and talkToServer leaves the connection open
+	var types []string
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(types) < 2 {
+		var e dashboard.StreamEvent
+		if err := websocket.JSON.Receive(ws, &e); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, e.Type)
+	}
+	sort.Strings(types)
+	if strings.Join(types, " ") != "client:connect message:accepted" {
+		t.Errorf("unexpected events %v", types)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	stats := func() dashboard.Snapshot {
+		req, err := http.NewRequest("GET", "https://127.0.0.1:2663/stats", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("", "secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		var s dashboard.Snapshot
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := stats()
+	if len(s.Servers) != 1 || s.Servers[0].ListenInterface != "127.0.0.1:2661" {
+		t.Errorf("expecting the server, got %+v", s.Servers)
+	}
+	if s.Stats.Listeners["127.0.0.1:2661"].Minute.Accepted != 1 || s.Stats.Domains["grr.la"].Hour.Accepted != 1 {
+		t.Errorf("expecting one message accepted by the server, got %+v", s.Stats)
+	}
+	if s.Queue.Capacity == 0 {
+		t.Error("expecting the gateway to report its queue")
+	}
+	if len(s.Log) == 0 {
+		t.Error("expecting the last lines of the log")
+	}
+
+	// changing the dashboard's config restarts it
+	c := *d.Config
+	c.Dashboard.LogLines = 5
+	if err := d.ReloadConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s = stats(); len(s.Servers) != 1 || len(s.Log) > 5 {
+		t.Errorf("expecting 5 log lines at most, got %+v", s)
+	}
+}
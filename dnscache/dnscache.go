@@ -0,0 +1,451 @@
+// Package dnscache is a caching DNS resolver shared by the policy lookups, eg. the DNSBL queries,
+// so that a busy server does not send the same queries to its resolvers over and over.
+// Answers are cached for their TTL, kept between a minimum and a maximum, and names that do not exist
+// are cached too. The process-wide resolver is returned by Default and configured with Set
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/metrics"
+)
+
+const (
+	// DefaultMaxTTL is the longest an answer is cached, whatever its TTL
+	DefaultMaxTTL = time.Hour
+	// DefaultNegativeTTL is the longest a name that does not exist is cached
+	DefaultNegativeTTL = 5 * time.Minute
+	// DefaultTimeout is the timeout of a lookup, all the upstream servers included
+	DefaultTimeout = 5 * time.Second
+	// DefaultMaxEntries is how many answers are cached at most
+	DefaultMaxEntries = 10000
+	// systemTTL is how long the answers of the system resolver are cached, it does not tell their TTL
+	systemTTL = time.Minute
+)
+
+// Config configures the resolver, the zero value uses the system resolver with the defaults
+type Config struct {
+	// Upstream are the addresses of the DNS servers to query in turn, eg. ["127.0.0.1:53", "192.0.2.53"].
+	// The system resolver is used when empty
+	Upstream []string `json:"upstream,omitempty"`
+	// MinTTL is the shortest an answer is cached, eg. "30s"
+	MinTTL string `json:"min_ttl,omitempty"`
+	// MaxTTL is the longest an answer is cached, eg. "1h"
+	MaxTTL string `json:"max_ttl,omitempty"`
+	// NegativeTTL is the longest a name that does not exist is cached, eg. "5m"
+	NegativeTTL string `json:"negative_ttl,omitempty"`
+	// Timeout is the timeout of a lookup, eg. "5s"
+	Timeout string `json:"timeout,omitempty"`
+	// MaxEntries is how many answers are cached at most
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+// Validate checks the config, an empty config is valid
+func (c *Config) Validate() error {
+	for _, d := range []struct {
+		name, value string
+	}{
+		{"min_ttl", c.MinTTL},
+		{"max_ttl", c.MaxTTL},
+		{"negative_ttl", c.NegativeTTL},
+		{"timeout", c.Timeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			return fmt.Errorf("dns %s [%s] is not a valid duration", d.name, d.value)
+		}
+	}
+	if duration(c.MinTTL, 0) > duration(c.MaxTTL, DefaultMaxTTL) {
+		return errors.New("dns min_ttl is longer than max_ttl")
+	}
+	if c.MaxEntries < 0 {
+		return errors.New("dns max_entries cannot be negative")
+	}
+	for _, u := range c.Upstream {
+		if _, err := upstreamAddr(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func duration(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return d
+	}
+	return def
+}
+
+// upstreamAddr returns the address of an upstream server, the port is 53 if not given
+func upstreamAddr(s string) (string, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(s, "53"), nil
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("dns upstream [%s] is not an IP address with an optional port", s)
+	}
+	return s, nil
+}
+
+// Resolver resolves names and caches the answers. It's safe for concurrent use
+type Resolver struct {
+	mu          sync.Mutex
+	upstream    []string
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	timeout     time.Duration
+	maxEntries  int
+	cache       map[string]*entry
+	clock       clock.Clock
+	system      *net.Resolver
+}
+
+// entry is a cached answer, or a lookup in flight until done is closed
+type entry struct {
+	done    chan struct{}
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// New returns a resolver configured with c, which should be valid
+func New(c Config) *Resolver {
+	r := &Resolver{
+		clock:  clock.Real,
+		system: &net.Resolver{},
+	}
+	r.Reconfigure(c)
+	return r
+}
+
+// Reconfigure applies a new config, the cache is dropped
+func (r *Resolver) Reconfigure(c Config) {
+	var upstream []string
+	for _, u := range c.Upstream {
+		if addr, err := upstreamAddr(u); err == nil {
+			upstream = append(upstream, addr)
+		}
+	}
+	maxEntries := c.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upstream = upstream
+	r.minTTL = duration(c.MinTTL, 0)
+	r.maxTTL = duration(c.MaxTTL, DefaultMaxTTL)
+	r.negativeTTL = duration(c.NegativeTTL, DefaultNegativeTTL)
+	r.timeout = duration(c.Timeout, DefaultTimeout)
+	if r.timeout == 0 {
+		r.timeout = DefaultTimeout
+	}
+	r.maxEntries = maxEntries
+	r.cache = make(map[string]*entry)
+}
+
+// SetClock sets the clock for the expiry of the answers, nil for the real one
+func (r *Resolver) SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = c
+}
+
+// Flush drops the cached answers
+func (r *Resolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = make(map[string]*entry)
+}
+
+// Len returns the number of cached answers, the lookups in flight included
+func (r *Resolver) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.cache)
+}
+
+// LookupHost returns the addresses of host, like net.Resolver.LookupHost
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	if r.upstreamServers() == nil {
+		v, err := r.lookup(ctx, "host", host, func(ctx context.Context) (interface{}, time.Duration, error) {
+			addrs, err := r.system.LookupHost(ctx, host)
+			return addrs, systemTTL, err
+		})
+		addrs, _ := v.([]string)
+		return addrs, err
+	}
+	// both families at once, like the system resolver
+	var v4, v6 interface{}
+	var err4, err6 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v6, err6 = r.lookupUpstream(ctx, typeAAAA, host)
+	}()
+	v4, err4 = r.lookupUpstream(ctx, typeA, host)
+	wg.Wait()
+	addrs4, _ := v4.([]string)
+	addrs6, _ := v6.([]string)
+	if addrs := append(append([]string(nil), addrs4...), addrs6...); len(addrs) > 0 {
+		return addrs, nil
+	}
+	if err4 != nil && !IsNotFound(err4) {
+		return nil, err4
+	}
+	if err6 != nil && !IsNotFound(err6) {
+		return nil, err6
+	}
+	return nil, notFound(host)
+}
+
+// LookupAddr returns the names of addr, like net.Resolver.LookupAddr
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if r.upstreamServers() == nil {
+		v, err := r.lookup(ctx, "ptr", addr, func(ctx context.Context) (interface{}, time.Duration, error) {
+			names, err := r.system.LookupAddr(ctx, addr)
+			return names, systemTTL, err
+		})
+		names, _ := v.([]string)
+		return names, err
+	}
+	name, err := reverseName(addr)
+	if err != nil {
+		return nil, err
+	}
+	v, err := r.lookupUpstream(ctx, typePTR, name)
+	names, _ := v.([]string)
+	return names, err
+}
+
+// LookupMX returns the MX records of name, sorted by preference, like net.Resolver.LookupMX
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	var v interface{}
+	var err error
+	if r.upstreamServers() == nil {
+		v, err = r.lookup(ctx, "mx", name, func(ctx context.Context) (interface{}, time.Duration, error) {
+			mx, err := r.system.LookupMX(ctx, name)
+			return mx, systemTTL, err
+		})
+	} else {
+		v, err = r.lookupUpstream(ctx, typeMX, name)
+	}
+	cached, _ := v.([]*net.MX)
+	// copies, the records are shared with the other callers
+	mx := make([]*net.MX, len(cached))
+	for i := range cached {
+		m := *cached[i]
+		mx[i] = &m
+	}
+	return mx, err
+}
+
+// LookupTXT returns the TXT records of name, like net.Resolver.LookupTXT
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.upstreamServers() == nil {
+		v, err := r.lookup(ctx, "txt", name, func(ctx context.Context) (interface{}, time.Duration, error) {
+			txt, err := r.system.LookupTXT(ctx, name)
+			return txt, systemTTL, err
+		})
+		txt, _ := v.([]string)
+		return txt, err
+	}
+	v, err := r.lookupUpstream(ctx, typeTXT, name)
+	txt, _ := v.([]string)
+	return txt, err
+}
+
+// TLSA is a TLSA record, which tells the certificate of a TLS service for DANE, see RFC 6698
+type TLSA struct {
+	// Usage is how the certificate is verified, eg. 3 for DANE-EE: the server's certificate must match
+	Usage uint8
+	// Selector is 0 if Data is of the whole certificate, 1 if of its public key
+	Selector uint8
+	// MatchingType is 0 if Data is the selected data, 1 if its SHA-256, 2 if its SHA-512
+	MatchingType uint8
+	Data         []byte
+}
+
+// LookupTLSA returns the TLSA records of name, eg. _25._tcp.mx.example.com. Only the records validated
+// with DNSSEC are returned: the upstream servers must validate, and say so with the AD flag. The system
+// resolver does not tell, so without upstream servers the name is always not found
+func (r *Resolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, error) {
+	if r.upstreamServers() == nil {
+		return nil, notFound(name)
+	}
+	v, err := r.lookupUpstream(ctx, typeTLSA, name)
+	tlsa, _ := v.([]TLSA)
+	return tlsa, err
+}
+
+func (r *Resolver) upstreamServers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.upstream
+}
+
+func (r *Resolver) lookupUpstream(ctx context.Context, t queryType, name string) (interface{}, error) {
+	return r.lookup(ctx, t.String(), name, func(ctx context.Context) (interface{}, time.Duration, error) {
+		return r.query(ctx, r.upstreamServers(), name, t)
+	})
+}
+
+// lookup returns the cached answer of the query, or resolves it with fn. Concurrent lookups of the same query
+// wait for the first one. Answers, and names that do not exist, are cached for the TTL returned by fn,
+// kept between min_ttl and max_ttl, or negative_ttl. Other errors are not cached
+func (r *Resolver) lookup(
+	ctx context.Context,
+	qtype, name string,
+	fn func(ctx context.Context) (interface{}, time.Duration, error),
+) (interface{}, error) {
+	key := qtype + " " + strings.ToLower(strings.TrimSuffix(name, "."))
+	r.mu.Lock()
+	now := r.clock.Now()
+	if e, ok := r.cache[key]; ok {
+		select {
+		case <-e.done:
+			if now.Before(e.expires) {
+				r.mu.Unlock()
+				metrics.Incr(metrics.DNSCacheHits, "type:"+qtype)
+				return e.value, e.err
+			}
+		default:
+			r.mu.Unlock()
+			metrics.Incr(metrics.DNSCacheHits, "type:"+qtype)
+			select {
+			case <-e.done:
+				return e.value, e.err
+			case <-ctx.Done():
+				return nil, timeoutError(name, ctx.Err())
+			}
+		}
+	}
+	e := &entry{done: make(chan struct{})}
+	r.makeRoom(now)
+	cached := len(r.cache) < r.maxEntries
+	if cached {
+		r.cache[key] = e
+	}
+	timeout := r.timeout
+	r.mu.Unlock()
+	metrics.Incr(metrics.DNSCacheMisses, "type:"+qtype)
+
+	// the lookup is shared, the caller giving up must not cancel it for the others
+	lctx, cancel := context.WithTimeout(context.Background(), timeout)
+	start := time.Now()
+	go func() {
+		defer cancel()
+		value, ttl, err := fn(lctx)
+		metrics.Since(metrics.DNSLookupTime, start, "type:"+qtype)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		e.value, e.err = value, err
+		switch {
+		case err == nil:
+			e.expires = r.clock.Now().Add(r.clampTTL(ttl))
+		case IsNotFound(err):
+			if ttl <= 0 || ttl > r.negativeTTL {
+				ttl = r.negativeTTL
+			}
+			e.expires = r.clock.Now().Add(ttl)
+		default:
+			metrics.Incr(metrics.DNSErrors, "type:"+qtype)
+			if cached && r.cache[key] == e {
+				delete(r.cache, key)
+			}
+		}
+		close(e.done)
+	}()
+	select {
+	case <-e.done:
+		return e.value, e.err
+	case <-ctx.Done():
+		return nil, timeoutError(name, ctx.Err())
+	}
+}
+
+func (r *Resolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < r.minTTL {
+		ttl = r.minTTL
+	}
+	if ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	return ttl
+}
+
+// makeRoom removes the expired answers when the cache is full, r.mu must be held
+func (r *Resolver) makeRoom(now time.Time) {
+	if len(r.cache) < r.maxEntries {
+		return
+	}
+	for k, e := range r.cache {
+		select {
+		case <-e.done:
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		default:
+		}
+	}
+}
+
+// IsNotFound returns true if err says that the name does not exist, or has no records of the type asked
+func IsNotFound(err error) bool {
+	// DNSError.IsNotFound is not in Go 1.12
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.Err == errNoSuchHost
+}
+
+const errNoSuchHost = "no such host"
+
+func notFound(name string) error {
+	return &net.DNSError{Err: errNoSuchHost, Name: name}
+}
+
+func timeoutError(name string, err error) error {
+	return &net.DNSError{Err: err.Error(), Name: name, IsTimeout: err == context.DeadlineExceeded}
+}
+
+// resolver holds the resolver in an atomic.Value, which needs the same concrete type every time
+type resolver struct {
+	*Resolver
+}
+
+var defaultResolver atomic.Value
+
+func init() {
+	defaultResolver.Store(resolver{New(Config{})})
+}
+
+// Default returns the process-wide resolver, which uses the system resolver until Set is called
+func Default() *Resolver {
+	return defaultResolver.Load().(resolver).Resolver
+}
+
+// Set replaces the process-wide resolver, nil for one with the default config
+func Set(r *Resolver) {
+	if r == nil {
+		r = New(Config{})
+	}
+	defaultResolver.Store(resolver{r})
+}
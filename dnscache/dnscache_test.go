@@ -0,0 +1,369 @@
+package dnscache
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer answers the queries over UDP and TCP on the same port, and counts them
+type testServer struct {
+	udp     net.PacketConn
+	tcp     net.Listener
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		_ = udp.Close()
+		t.Fatal(err)
+	}
+	s := &testServer{udp: udp, tcp: tcp, queries: make(map[string]int)}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *testServer) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *testServer) close() {
+	_ = s.udp.Close()
+	_ = s.tcp.Close()
+}
+
+func (s *testServer) count(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[key]
+}
+
+func (s *testServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if b := s.answer(buf[:n], false); b != nil {
+			_, _ = s.udp.WriteTo(b, addr)
+		}
+	}
+}
+
+func (s *testServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err == nil {
+			buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, buf); err == nil {
+				b := s.answer(buf, true)
+				binary.BigEndian.PutUint16(length[:], uint16(len(b)))
+				_, _ = conn.Write(append(length[:], b...))
+			}
+		}
+		_ = conn.Close()
+	}
+}
+
+func (s *testServer) answer(b []byte, tcp bool) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(b); err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	question := q.Questions[0]
+	key := strings.ToLower(question.Name.String()) + " " + queryType(question.Type).String()
+	if tcp {
+		key += " tcp"
+	}
+	s.mu.Lock()
+	s.queries[key]++
+	s.mu.Unlock()
+
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+	}
+	header := func(ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	var validated bool
+	var tlsa []byte
+	mustName := func(s string) dnsmessage.Name {
+		n, _ := dnsmessage.NewName(s)
+		return n
+	}
+	switch strings.TrimSuffix(key, " tcp") {
+	case "mail.example.org. a":
+		m.Answers = []dnsmessage.Resource{
+			{Header: header(300), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}},
+			{Header: header(100), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}},
+		}
+	case "mail.example.org. aaaa":
+		var ip [16]byte
+		copy(ip[:], net.ParseIP("2001:db8::1"))
+		m.Answers = []dnsmessage.Resource{{Header: header(300), Body: &dnsmessage.AAAAResource{AAAA: ip}}}
+	case "example.org. mx":
+		m.Answers = []dnsmessage.Resource{
+			{Header: header(7200), Body: &dnsmessage.MXResource{Pref: 20, MX: mustName("mx2.example.org.")}},
+			{Header: header(7200), Body: &dnsmessage.MXResource{Pref: 10, MX: mustName("mx1.example.org.")}},
+		}
+	case "example.org. txt":
+		m.Answers = []dnsmessage.Resource{{Header: header(1), Body: &dnsmessage.TXTResource{TXT: []string{"v=spf1 ", "-all"}}}}
+	case "big.example.org. txt":
+		if !tcp {
+			m.Truncated = true
+			break
+		}
+		for i := 0; i < 10; i++ {
+			m.Answers = append(m.Answers, dnsmessage.Resource{
+				Header: header(300),
+				Body:   &dnsmessage.TXTResource{TXT: []string{strings.Repeat("x", 100)}},
+			})
+		}
+	case "1.2.0.192.in-addr.arpa. ptr":
+		m.Answers = []dnsmessage.Resource{{Header: header(300), Body: &dnsmessage.PTRResource{PTR: mustName("mail.example.org.")}}}
+	case "_25._tcp.mx1.example.org. tlsa", "_25._tcp.mx2.example.org. tlsa":
+		// only the records of mx1 are validated. The record is written by hand after the message, with its name
+		// pointing to the question
+		validated = strings.HasPrefix(key, "_25._tcp.mx1.")
+		tlsa = []byte{0xc0, 12, 0, 52, 0, 1, 0, 0, 1, 44, 0, 5, 3, 1, 1, 0xab, 0xcd}
+	case "mail.example.org. txt":
+		// the name exists, without TXT records
+	case "fail.example.org. a":
+		m.RCode = dnsmessage.RCodeServerFailure
+	default:
+		m.RCode = dnsmessage.RCodeNameError
+		m.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: mustName("example.org."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body: &dnsmessage.SOAResource{
+				NS: mustName("ns.example.org."), MBox: mustName("hostmaster.example.org."),
+				Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 120,
+			},
+		}}
+	}
+	b, err := m.Pack()
+	if err != nil {
+		panic(err)
+	}
+	if validated {
+		binary.BigEndian.PutUint16(b[2:], binary.BigEndian.Uint16(b[2:])|headerBitAD)
+	}
+	if tlsa != nil {
+		binary.BigEndian.PutUint16(b[6:], 1)
+		b = append(b, tlsa...)
+	}
+	return b
+}
+
+func TestUpstream(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	c := Config{Upstream: []string{s.addr()}, MinTTL: "1m", MaxTTL: "1h", NegativeTTL: "5m", Timeout: "2s"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r := New(c)
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	r.SetClock(mock)
+	ctx := context.Background()
+
+	addrs, err := r.LookupHost(ctx, "mail.example.org")
+	if err != nil || !reflect.DeepEqual(addrs, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}) {
+		t.Error("unexpected addresses", addrs, err)
+	}
+	mx, err := r.LookupMX(ctx, "Example.org.")
+	if err != nil || len(mx) != 2 || mx[0].Host != "mx1.example.org." || mx[0].Pref != 10 {
+		t.Error("expecting the MX records sorted by preference, got", mx, err)
+	}
+	mx[0].Host = "changed"
+	txt, err := r.LookupTXT(ctx, "example.org")
+	if err != nil || !reflect.DeepEqual(txt, []string{"v=spf1 -all"}) {
+		t.Error("unexpected TXT records", txt, err)
+	}
+	names, err := r.LookupAddr(ctx, "192.0.2.1")
+	if err != nil || !reflect.DeepEqual(names, []string{"mail.example.org."}) {
+		t.Error("unexpected names", names, err)
+	}
+	if _, err := r.LookupHost(ctx, "missing.example.org"); !IsNotFound(err) {
+		t.Error("expecting no such host, got", err)
+	}
+	if _, err := r.LookupHost(ctx, "fail.example.org"); err == nil || IsNotFound(err) {
+		t.Error("expecting a server failure, got", err)
+	}
+	if txt, err := r.LookupTXT(ctx, "big.example.org"); err != nil || len(txt) != 10 || s.count("big.example.org. txt tcp") != 1 {
+		t.Error("expecting the truncated answer to be asked again over TCP, got", len(txt), err)
+	}
+
+	// all cached, but the failure
+	mock.Add(59 * time.Second)
+	_, _ = r.LookupHost(ctx, "mail.example.org")
+	mx, _ = r.LookupMX(ctx, "example.org")
+	_, _ = r.LookupTXT(ctx, "example.org")
+	_, _ = r.LookupAddr(ctx, "192.0.2.1")
+	_, _ = r.LookupHost(ctx, "missing.example.org")
+	_, _ = r.LookupHost(ctx, "fail.example.org")
+	for key, n := range map[string]int{
+		"mail.example.org. a":         1,
+		"mail.example.org. aaaa":      1,
+		"example.org. mx":             1,
+		"example.org. txt":            1,
+		"1.2.0.192.in-addr.arpa. ptr": 1,
+		"missing.example.org. a":      1,
+		"fail.example.org. a":         2,
+	} {
+		if c := s.count(key); c != n {
+			t.Errorf("%s: expecting %d queries, got %d", key, n, c)
+		}
+	}
+	if mx[0].Host != "mx1.example.org." {
+		t.Error("expecting the cached records to be copied, got", mx[0].Host)
+	}
+
+	// the TXT record is kept for min_ttl, the A records for the shortest of their TTLs, the absence
+	// of a name for the minimum of the SOA record and the MX records for max_ttl
+	for _, step := range []struct {
+		after   time.Duration
+		expired []string
+		kept    []string
+	}{
+		{time.Second, []string{"example.org. txt"}, []string{"mail.example.org. a", "missing.example.org. a"}},
+		{time.Minute, []string{"mail.example.org. a", "missing.example.org. a"}, []string{"mail.example.org. aaaa"}},
+		{3 * time.Minute, []string{"mail.example.org. aaaa"}, []string{"example.org. mx"}},
+		{time.Hour, []string{"example.org. mx"}, nil},
+	} {
+		mock.Add(step.after)
+		before := map[string]int{}
+		for _, key := range append(step.expired, step.kept...) {
+			before[key] = s.count(key)
+		}
+		_, _ = r.LookupHost(ctx, "mail.example.org")
+		_, _ = r.LookupMX(ctx, "example.org")
+		_, _ = r.LookupTXT(ctx, "example.org")
+		_, _ = r.LookupHost(ctx, "missing.example.org")
+		for _, key := range step.expired {
+			if s.count(key) != before[key]+1 {
+				t.Errorf("expecting %s to expire after %s", key, step.after)
+			}
+		}
+		for _, key := range step.kept {
+			if s.count(key) != before[key] {
+				t.Errorf("expecting %s to be cached after %s", key, step.after)
+			}
+		}
+	}
+
+	if _, err := r.LookupTXT(ctx, "mail.example.org"); !IsNotFound(err) {
+		t.Error("expecting no such host without records, got", err)
+	}
+	if addrs, err := r.LookupHost(ctx, "192.0.2.9"); err != nil || addrs[0] != "192.0.2.9" {
+		t.Error("expecting an address to be returned as is, got", addrs, err)
+	}
+	r.Flush()
+	if r.Len() != 0 {
+		t.Error("expecting the cache to be empty, got", r.Len())
+	}
+}
+
+func TestLookupTLSA(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	r := New(Config{Upstream: []string{s.addr()}, Timeout: "2s"})
+	ctx := context.Background()
+	tlsa, err := r.LookupTLSA(ctx, "_25._tcp.mx1.example.org")
+	if want := []TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Data: []byte{0xab, 0xcd}}}; err != nil || !reflect.DeepEqual(tlsa, want) {
+		t.Error("expecting", want, "got", tlsa, err)
+	}
+	if tlsa, err := r.LookupTLSA(ctx, "_25._tcp.mx2.example.org"); !IsNotFound(err) {
+		t.Error("expecting the records that were not validated to be ignored, got", tlsa, err)
+	}
+	if _, err := New(Config{}).LookupTLSA(ctx, "_25._tcp.mx1.example.org"); !IsNotFound(err) {
+		t.Error("expecting no records without upstream servers, got", err)
+	}
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	r := New(Config{Upstream: []string{s.addr()}, MaxEntries: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.LookupMX(context.Background(), "example.org"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := s.count("example.org. mx"); n > 2 {
+		t.Error("expecting the lookups in flight to be shared, got queries:", n)
+	}
+	_, _ = r.LookupTXT(context.Background(), "example.org")
+	_, _ = r.LookupAddr(context.Background(), "192.0.2.1")
+	if r.Len() != 2 {
+		t.Error("expecting max_entries answers to be cached, got", r.Len())
+	}
+}
+
+func TestUnreachableUpstream(t *testing.T) {
+	// nothing listens on the first server, the second one answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	silent := pc.LocalAddr().String()
+	s := newTestServer(t)
+	defer s.close()
+	defer func() { _ = pc.Close() }()
+
+	r := New(Config{Upstream: []string{silent}, Timeout: "100ms"})
+	if _, err := r.LookupHost(context.Background(), "mail.example.org"); err == nil || IsNotFound(err) {
+		t.Error("expecting a timeout, got", err)
+	}
+	if r.Len() != 0 {
+		t.Error("expecting the timeout not to be cached")
+	}
+	r.Reconfigure(Config{Upstream: []string{"127.0.0.1:1", s.addr()}})
+	if addrs, err := r.LookupHost(context.Background(), "mail.example.org"); err != nil || len(addrs) != 3 {
+		t.Error("expecting the second server to answer, got", addrs, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Upstream: []string{"dns.example.org"}},
+		{MaxTTL: "forever"},
+		{MinTTL: "2h"},
+		{MaxEntries: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expecting %+v to be invalid", c)
+		}
+	}
+	c := Config{Upstream: []string{"192.0.2.53", "[2001:db8::53]:5353"}, MinTTL: "0s"}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,407 @@
+package dnscache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// queryType is the type of the records asked to the upstream servers
+type queryType dnsmessage.Type
+
+const (
+	typeA    = queryType(dnsmessage.TypeA)
+	typeAAAA = queryType(dnsmessage.TypeAAAA)
+	typeMX   = queryType(dnsmessage.TypeMX)
+	typeTXT  = queryType(dnsmessage.TypeTXT)
+	typePTR  = queryType(dnsmessage.TypePTR)
+	// typeTLSA is not one of the dnsmessage types, see RFC 6698
+	typeTLSA = queryType(52)
+)
+
+func (t queryType) String() string {
+	switch t {
+	case typeA:
+		return "a"
+	case typeAAAA:
+		return "aaaa"
+	case typeMX:
+		return "mx"
+	case typeTXT:
+		return "txt"
+	case typePTR:
+		return "ptr"
+	case typeTLSA:
+		return "tlsa"
+	}
+	return "unknown"
+}
+
+// maxUDPSize is the largest UDP answer read, the answers are 512 bytes at most since EDNS is not used
+const maxUDPSize = 512
+
+var errMisbehaving = errors.New("server misbehaving")
+
+// query asks the servers in turn until one answers. It returns the records of type t, converted to
+// what the net.Resolver methods return, and the shortest of their TTLs. When the name does not exist,
+// or has no records of type t, the error is a "no such host" net.DNSError and the TTL is from the SOA record
+// of the zone, if the server sent it
+func (r *Resolver) query(ctx context.Context, servers []string, name string, t queryType) (interface{}, time.Duration, error) {
+	fqdn := name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	qname, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid name", Name: name}
+	}
+	q := dnsmessage.Question{Name: qname, Type: dnsmessage.Type(t), Class: dnsmessage.ClassINET}
+	var lastErr error
+	for _, server := range servers {
+		msg, err := exchange(ctx, server, q)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		switch msg.RCode {
+		case dnsmessage.RCodeSuccess:
+			value, ttl := answers(msg, t)
+			if t == typeTLSA && !msg.authenticData {
+				// the records are of no use to DANE if the server did not validate them
+				value = nil
+			}
+			if value == nil {
+				return nil, negativeTTL(msg), &net.DNSError{Err: errNoSuchHost, Name: name, Server: server}
+			}
+			return value, ttl, nil
+		case dnsmessage.RCodeNameError:
+			return nil, negativeTTL(msg), &net.DNSError{Err: errNoSuchHost, Name: name, Server: server}
+		default:
+			lastErr = errMisbehaving
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstream servers")
+	}
+	dnsErr := &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+	if ne, ok := lastErr.(net.Error); ok && ne.Timeout() {
+		dnsErr.IsTimeout = true
+	}
+	return nil, 0, dnsErr
+}
+
+// headerBitAD is the AD bit of the flags of a DNS header, see RFC 4035 3.2.3. It's read and written by hand,
+// the dnsmessage package of the vendored x/net does not know it
+const headerBitAD = 1 << 5
+
+// message is an answer of an upstream server: its header, and the raw message the records are read from.
+// The records are read with a dnsmessage.Parser, which skips those of the types it does not know,
+// except for the TLSA records that tlsaRecords reads
+type message struct {
+	dnsmessage.Header
+	// authenticData is true if the server validated the answer, see RFC 6840 5.7
+	authenticData bool
+	raw           []byte
+}
+
+// readAnswer returns the answer in b to the query with the given id and question, nil if b is not one
+func readAnswer(b []byte, id uint16, q dnsmessage.Question) *message {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil || !h.Response || h.ID != id {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		return nil
+	}
+	a := questions[0]
+	if a.Type != q.Type || a.Class != q.Class || !strings.EqualFold(a.Name.String(), q.Name.String()) {
+		return nil
+	}
+	// the records are read later, the sections must be complete
+	if p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return nil
+	}
+	return &message{Header: h, authenticData: binary.BigEndian.Uint16(b[2:])&headerBitAD != 0, raw: b}
+}
+
+// answers returns the records of type t in the answer section, nil if there are none.
+// The CNAME records are skipped, the recursive servers follow them
+func answers(msg *message, t queryType) (interface{}, time.Duration) {
+	if t == typeTLSA {
+		if tlsa, ttl := tlsaRecords(msg.raw); tlsa != nil {
+			return tlsa, time.Duration(ttl) * time.Second
+		}
+		return nil, 0
+	}
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg.raw); err != nil || p.SkipAllQuestions() != nil {
+		return nil, 0
+	}
+	var ttl uint32
+	var addrs, names []string
+	var mx []*net.MX
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			// dnsmessage.ErrSectionDone after the last record
+			break
+		}
+		if h.Type != dnsmessage.Type(t) || h.Class != dnsmessage.ClassINET {
+			if err := p.SkipAnswer(); err != nil {
+				break
+			}
+			continue
+		}
+		if (addrs == nil && names == nil && mx == nil) || h.TTL < ttl {
+			ttl = h.TTL
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			b, err := p.AResource()
+			if err != nil {
+				return nil, 0
+			}
+			addrs = append(addrs, net.IP(b.A[:]).String())
+		case dnsmessage.TypeAAAA:
+			b, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0
+			}
+			addrs = append(addrs, net.IP(b.AAAA[:]).String())
+		case dnsmessage.TypeMX:
+			b, err := p.MXResource()
+			if err != nil {
+				return nil, 0
+			}
+			mx = append(mx, &net.MX{Host: b.MX.String(), Pref: b.Pref})
+		case dnsmessage.TypeTXT:
+			b, err := p.TXTResource()
+			if err != nil {
+				return nil, 0
+			}
+			names = append(names, strings.Join(b.TXT, ""))
+		case dnsmessage.TypePTR:
+			b, err := p.PTRResource()
+			if err != nil {
+				return nil, 0
+			}
+			names = append(names, b.PTR.String())
+		}
+	}
+	d := time.Duration(ttl) * time.Second
+	switch {
+	case addrs != nil:
+		return addrs, d
+	case names != nil:
+		return names, d
+	case mx != nil:
+		sort.SliceStable(mx, func(i, j int) bool { return mx[i].Pref < mx[j].Pref })
+		return mx, d
+	}
+	return nil, 0
+}
+
+// tlsaRecords returns the TLSA records in the answer section of the raw message b, and the shortest of
+// their TTLs. The dnsmessage package cannot read them, they are read by hand
+func tlsaRecords(b []byte) ([]TLSA, uint32) {
+	if len(b) < 12 {
+		return nil, 0
+	}
+	questions, count := int(binary.BigEndian.Uint16(b[4:])), int(binary.BigEndian.Uint16(b[6:]))
+	off := 12
+	for i := 0; i < questions; i++ {
+		// the name, then its type and class
+		if off = skipName(b, off); off < 0 || off+4 > len(b) {
+			return nil, 0
+		}
+		off += 4
+	}
+	var ttl uint32
+	var tlsa []TLSA
+	for i := 0; i < count; i++ {
+		// the name, then its type, class, TTL and the length of the data
+		if off = skipName(b, off); off < 0 || off+10 > len(b) {
+			return nil, 0
+		}
+		t, class := queryType(binary.BigEndian.Uint16(b[off:])), dnsmessage.Class(binary.BigEndian.Uint16(b[off+2:]))
+		rrTTL, length := binary.BigEndian.Uint32(b[off+4:]), int(binary.BigEndian.Uint16(b[off+8:]))
+		if off += 10; off+length > len(b) {
+			return nil, 0
+		}
+		data := b[off : off+length]
+		off += length
+		if t != typeTLSA || class != dnsmessage.ClassINET || len(data) < 4 {
+			continue
+		}
+		if tlsa == nil || rrTTL < ttl {
+			ttl = rrTTL
+		}
+		tlsa = append(tlsa, TLSA{Usage: data[0], Selector: data[1], MatchingType: data[2],
+			Data: append([]byte(nil), data[3:]...)})
+	}
+	return tlsa, ttl
+}
+
+// skipName returns the offset after the name at off in b, -1 if the name is not valid
+func skipName(b []byte, off int) int {
+	for off >= 0 && off < len(b) {
+		switch l := int(b[off]); l & 0xc0 {
+		case 0x00:
+			if l == 0 {
+				return off + 1
+			}
+			off += 1 + l
+		case 0xc0:
+			// a pointer to the rest of the name, elsewhere in the message
+			if off+2 > len(b) {
+				return -1
+			}
+			return off + 2
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// negativeTTL returns how long the absence of a name can be cached, given by the SOA record in the authority section
+func negativeTTL(msg *message) time.Duration {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg.raw); err != nil || p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil {
+		return 0
+	}
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return 0
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return 0
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return 0
+		}
+		ttl := h.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return time.Duration(ttl) * time.Second
+	}
+}
+
+// exchange sends q to server over UDP, and again over TCP if the answer was truncated
+func exchange(ctx context.Context, server string, q dnsmessage.Question) (*message, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// AD asks the server to tell if it validated the answer, see RFC 6840 5.7
+	binary.BigEndian.PutUint16(b[2:], binary.BigEndian.Uint16(b[2:])|headerBitAD)
+	msg, err := exchangeUDP(ctx, server, b, query.Header.ID, q)
+	if err != nil || !msg.Truncated {
+		return msg, err
+	}
+	return exchangeTCP(ctx, server, b, query.Header.ID, q)
+}
+
+func exchangeUDP(ctx context.Context, server string, b []byte, id uint16, q dnsmessage.Question) (*message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		msg := readAnswer(buf[:n], id, q)
+		if msg == nil {
+			// not for us, eg. a late answer to a previous query, keep waiting
+			continue
+		}
+		return msg, nil
+	}
+}
+
+func exchangeTCP(ctx context.Context, server string, b []byte, id uint16, q dnsmessage.Question) (*message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// the messages are prefixed with their length over TCP
+	req := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(req, uint16(len(b)))
+	copy(req[2:], b)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	msg := readAnswer(buf, id, q)
+	if msg == nil {
+		return nil, errMisbehaving
+	}
+	return msg, nil
+}
+
+// reverseName returns the name of the PTR query of addr, eg. 2.0.0.127.in-addr.arpa. for 127.0.0.2
+func reverseName(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPv4(ip4[3], ip4[2], ip4[1], ip4[0]).String() + ".in-addr.arpa.", nil
+	}
+	const hex = "0123456789abcdef"
+	b := make([]byte, 0, 73)
+	for i := len(ip) - 1; i >= 0; i-- {
+		b = append(b, hex[ip[i]&0xf], '.', hex[ip[i]>>4], '.')
+	}
+	return string(b) + "ip6.arpa.", nil
+}
@@ -0,0 +1,181 @@
+package guerrilla
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// DomainConfig holds the settings of the recipients of a domain
+type DomainConfig struct {
+	// MaxSize is the maximum size of the messages to the domain, when smaller than the server's max_size.
+	// The server's max_size applies if 0
+	MaxSize int64 `json:"max_size,omitempty"`
+	// CatchAll is the address that receives the recipients of the domain that the backend's
+	// validate_process does not know (backends.NoSuchUser), eg. "postmaster@example.com"
+	CatchAll string `json:"catch_all,omitempty"`
+	// SaveRoute is the name of the stack in backend_config's save_routes that saves the messages
+	// to the domain, save_process if empty
+	SaveRoute string `json:"save_route,omitempty"`
+	// Discard accepts the messages to the domain without validating the recipients or saving the messages
+	Discard bool `json:"discard,omitempty"`
+}
+
+// DomainsConfig holds the settings of some recipient domains, keyed by domain. A key starting with "*."
+// applies to the subdomains, eg. "*.example.com". The domains must be allowed hosts too
+type DomainsConfig map[string]DomainConfig
+
+// Validate checks the settings, and that their save routes are in the backend config
+func (d DomainsConfig) Validate(backendConfig backends.BackendConfig) error {
+	routes, err := backends.SaveRoutes(backendConfig)
+	if err != nil {
+		return err
+	}
+	for domain, c := range d {
+		if strings.TrimPrefix(domain, "*.") == "" {
+			return fmt.Errorf("domains: [%s] is not a domain", domain)
+		}
+		if c.MaxSize < 0 {
+			return fmt.Errorf("domains: max_size of [%s] cannot be negative", domain)
+		}
+		if c.CatchAll != "" {
+			if _, err := mail.NewAddress(c.CatchAll); err != nil {
+				return fmt.Errorf("domains: catch_all of [%s] is not a valid address: %s", domain, err)
+			}
+		}
+		if c.SaveRoute != "" {
+			if c.Discard {
+				return fmt.Errorf("domains: [%s] cannot have a save_route and discard", domain)
+			}
+			if _, ok := routes[c.SaveRoute]; !ok {
+				return fmt.Errorf("domains: save_route [%s] of [%s] is not in backend_config's save_routes",
+					c.SaveRoute, domain)
+			}
+		}
+	}
+	return nil
+}
+
+// domain are the settings of a domain, ready for the server
+type domain struct {
+	DomainConfig
+	catchAll *mail.Address
+}
+
+// domainTable looks up the settings of the recipients' domains. It's shared by the servers, a nil
+// *domainTable has no settings
+type domainTable struct {
+	sync.RWMutex
+	table map[string]*domain
+	// wildcards are the settings of the subdomains, keyed by suffix, eg. ".example.com"
+	wildcards map[string]*domain
+}
+
+func newDomainTable(c DomainsConfig) *domainTable {
+	t := &domainTable{}
+	t.set(c)
+	return t
+}
+
+// set replaces the settings, c should be valid
+func (t *domainTable) set(c DomainsConfig) {
+	table := make(map[string]*domain, len(c))
+	wildcards := make(map[string]*domain)
+	for name, dc := range c {
+		d := &domain{DomainConfig: dc}
+		if dc.CatchAll != "" {
+			d.catchAll, _ = mail.NewAddress(dc.CatchAll)
+		}
+		if strings.HasPrefix(name, "*.") {
+			wildcards[strings.ToLower(mail.NormalizeHost(name[1:]))] = d
+		} else {
+			table[strings.ToLower(mail.NormalizeHost(name))] = d
+		}
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.table, t.wildcards = table, wildcards
+}
+
+// lookup returns the settings of host, the most specific wildcard applies when host has no settings
+// of its own. Returns nil if there are none
+func (t *domainTable) lookup(host string) *domain {
+	if t == nil {
+		return nil
+	}
+	host = strings.ToLower(host)
+	t.RLock()
+	defer t.RUnlock()
+	if d, ok := t.table[host]; ok {
+		return d
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		if d, ok := t.wildcards[host[i:]]; ok {
+			return d
+		}
+		host = host[i+1:]
+	}
+	return nil
+}
+
+// transactionDomain holds what the domains of the recipients of a transaction decide, the save route
+// is kept in the envelope's Route
+type transactionDomain struct {
+	discard bool
+	// maxSize is the smallest max_size of the domains, 0 if they don't have one
+	maxSize int64
+}
+
+// rcptDomain checks that the recipient can be added to the transaction, and returns its domain's settings.
+// The recipients of a transaction must have the same save route, those of another route are deferred,
+// the client sends them in another transaction
+func (s *server) rcptDomain(c *client, to mail.Address) (*domain, *response.Response) {
+	d := s.domains.lookup(to.Host)
+	var route string
+	var discard bool
+	if d != nil {
+		route, discard = d.SaveRoute, d.Discard
+	}
+	if len(c.RcptTo) > 0 && (route != c.Route || discard != c.domain.discard) {
+		return nil, response.Canned.ErrorDomainRoute
+	}
+	// the size declared with MAIL is checked now, so that the client does not send a message that is refused
+	// after DATA
+	if size, ok := c.MailParams.Size(); ok && d != nil && d.MaxSize > 0 && size > d.MaxSize {
+		return nil, response.Canned.FailRcptMessageSize
+	}
+	return d, nil
+}
+
+// addDomain applies the settings of the domain of an accepted recipient to the transaction
+func (c *client) addDomain(d *domain) {
+	if d == nil {
+		return
+	}
+	c.Route = d.SaveRoute
+	c.domain.discard = d.Discard
+	if d.MaxSize > 0 && (c.domain.maxSize == 0 || d.MaxSize < c.domain.maxSize) {
+		c.domain.maxSize = d.MaxSize
+	}
+}
+
+// catchAll replaces the last recipient, unknown to the backend, with the catch-all address of its domain.
+// Returns false if the domain has no catch-all address
+func (c *client) catchAll(d *domain) bool {
+	if d == nil || d.catchAll == nil {
+		return false
+	}
+	c.PopRcpt()
+	for _, rcpt := range c.RcptTo {
+		if strings.EqualFold(rcpt.String(), d.catchAll.String()) {
+			// already a recipient
+			return true
+		}
+	}
+	c.PushRcpt(*d.catchAll)
+	return true
+}
@@ -0,0 +1,56 @@
+package guerrilla
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/backends"
+)
+
+func TestDomainTableLookup(t *testing.T) {
+	table := newDomainTable(DomainsConfig{
+		"Example.com":        {MaxSize: 1},
+		"*.example.com":      {MaxSize: 2},
+		"*.eu.example.com":   {MaxSize: 3},
+		"bücher.example.org": {MaxSize: 4},
+	})
+	for host, size := range map[string]int64{
+		"example.com":               1,
+		"mail.example.com":          2,
+		"a.b.example.com":           2,
+		"mail.eu.example.com":       3,
+		"xn--bcher-kva.example.org": 4,
+		"example.org":               0,
+		"notexample.com":            0,
+	} {
+		d := table.lookup(host)
+		if (d == nil && size != 0) || (d != nil && d.MaxSize != size) {
+			t.Errorf("%s: expecting the max_size %d, got %v", host, size, d)
+		}
+	}
+	var none *domainTable
+	if none.lookup("example.com") != nil {
+		t.Error("expecting a nil table to have no settings")
+	}
+}
+
+func TestDomainsValidate(t *testing.T) {
+	bc := backends.BackendConfig{"save_routes": map[string]interface{}{"archive": "HeadersParser|Debugger"}}
+	for _, c := range []DomainsConfig{
+		{"*.": {}},
+		{"example.com": {MaxSize: -1}},
+		{"example.com": {CatchAll: "not an address"}},
+		{"example.com": {SaveRoute: "missing"}},
+		{"example.com": {SaveRoute: "archive", Discard: true}},
+	} {
+		if err := c.Validate(bc); err == nil {
+			t.Errorf("expecting %v to be invalid", c)
+		}
+	}
+	c := DomainsConfig{"example.com": {SaveRoute: "archive", CatchAll: "all@example.com"}, "*.example.org": {Discard: true}}
+	if err := c.Validate(bc); err != nil {
+		t.Error(err)
+	}
+	if err := c.Validate(backends.BackendConfig{"save_routes": "archive"}); err == nil {
+		t.Error("expecting save_routes that are not a map to be invalid")
+	}
+}
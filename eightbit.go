@@ -0,0 +1,138 @@
+package guerrilla
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// the values of strict_7bit
+const (
+	strict7BitReject    = "reject"
+	strict7BitTranscode = "transcode"
+)
+
+var (
+	// EightBitData is returned when a message has 8-bit bytes, but the client did not declare BODY=8BITMIME
+	EightBitData = errors.New("message has 8-bit data, but BODY=8BITMIME was not declared")
+	// errNotTranscodable is returned when a message with 8-bit data cannot be converted to 7-bit
+	errNotTranscodable = errors.New("message has 8-bit data that cannot be converted to 7-bit")
+)
+
+// eightBitReader notes if the DATA has any 8-bit byte. Each client has one, it's reset for every DATA command
+type eightBitReader struct {
+	r    io.Reader
+	seen bool
+}
+
+// reset makes er check the data read from r. Returns r unwrapped when the client may send 8-bit data,
+// because strict_7bit is not set or the client declared BODY=8BITMIME or SMTPUTF8
+func (er *eightBitReader) reset(r io.Reader, policy string, params mail.ESMTPParams) io.Reader {
+	er.r, er.seen = nil, false
+	if policy == "" || params.Body() == "8BITMIME" || params.Body() == "BINARYMIME" || params.SMTPUTF8() {
+		return r
+	}
+	er.r = r
+	return er
+}
+
+func (er *eightBitReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if !er.seen {
+		for i := 0; i < n; i++ {
+			if p[i] >= 0x80 {
+				er.seen = true
+				break
+			}
+		}
+	}
+	return n, err
+}
+
+// check7Bit applies the strict_7bit policy to the message just read. When it's "transcode", the body of
+// a message that is not multipart is converted to quoted-printable. Returns EightBitData if the message
+// has 8-bit data that was not converted
+func (c *client) check7Bit(policy string) error {
+	if !c.eightBit.seen {
+		return nil
+	}
+	if policy == strict7BitTranscode {
+		if err := transcode7Bit(c.Envelope); err == nil {
+			return nil
+		}
+	}
+	return EightBitData
+}
+
+// transcode7Bit converts the body of e to quoted-printable, its header must be 7-bit. Messages that were
+// spooled, and multipart or message/* messages, whose parts cannot be encoded as a whole, are not transcodable
+func transcode7Bit(e *mail.Envelope) error {
+	data := e.Data.Bytes()
+	end := bytes.Index(data, []byte("\n\n"))
+	if e.Spooled() || end == -1 {
+		return errNotTranscodable
+	}
+	header, body := data[:end+1], data[end+2:]
+	var out bytes.Buffer
+	mimeVersion := false
+	skip := false
+	for _, line := range bytes.SplitAfter(header, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		for _, b := range line {
+			if b >= 0x80 {
+				return errNotTranscodable
+			}
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// folded, part of the previous field
+			if !skip {
+				out.Write(line)
+			}
+			continue
+		}
+		skip = false
+		i := bytes.IndexByte(line, ':')
+		if i == -1 {
+			out.Write(line)
+			continue
+		}
+		name, value := line[:i], line[i+1:]
+		switch strings.ToLower(string(bytes.TrimSpace(name))) {
+		case "content-transfer-encoding":
+			skip = true
+			continue
+		case "mime-version":
+			mimeVersion = true
+		case "content-type":
+			// the parameters may be folded, only the media type is needed
+			mediaType := strings.ToLower(strings.TrimSpace(string(value)))
+			if strings.HasPrefix(mediaType, "multipart/") || strings.HasPrefix(mediaType, "message/") {
+				return errNotTranscodable
+			}
+		}
+		out.Write(line)
+	}
+	if !mimeVersion {
+		out.WriteString("MIME-Version: 1.0\n")
+	}
+	out.WriteString("Content-Transfer-Encoding: quoted-printable\n\n")
+	var qp bytes.Buffer
+	w := quotedprintable.NewWriter(&qp)
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// the writer ends the lines with \r\n, the data read has \n
+	out.Write(bytes.Replace(qp.Bytes(), []byte("\r\n"), []byte("\n"), -1))
+	e.Data.Reset()
+	_, _ = e.Data.Write(out.Bytes())
+	return nil
+}
@@ -0,0 +1,43 @@
+package guerrilla
+
+import (
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+func TestTranscode7Bit(t *testing.T) {
+	for _, test := range []struct {
+		data, expect string
+	}{
+		{
+			"Subject: test\nContent-Type: text/plain; charset=utf-8\n\nCaf\xc3\xa9\n",
+			"Subject: test\nContent-Type: text/plain; charset=utf-8\nMIME-Version: 1.0\n" +
+				"Content-Transfer-Encoding: quoted-printable\n\nCaf=C3=A9\n",
+		},
+		{
+			"MIME-Version: 1.0\nContent-Transfer-Encoding:\n 8bit\nSubject: test\n\n\xe9t\xe9\n",
+			"MIME-Version: 1.0\nSubject: test\nContent-Transfer-Encoding: quoted-printable\n\n=E9t=E9\n",
+		},
+		// not transcodable
+		{"Subject: caf\xc3\xa9\n\nCaf\xc3\xa9\n", ""},
+		{"Content-Type: multipart/mixed;\n boundary=x\n\n--x\n\nCaf\xc3\xa9\n--x--\n", ""},
+		{"Content-Type: message/rfc822\n\nSubject: caf\xc3\xa9\n\n", ""},
+		{"Caf\xc3\xa9\n", ""},
+	} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(test.data)
+		err := transcode7Bit(e)
+		if test.expect == "" {
+			if err == nil {
+				t.Errorf("expecting %q not to be transcodable", test.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("could not transcode %q: %s", test.data, err)
+		} else if e.Data.String() != test.expect {
+			t.Errorf("expecting %q, got %q", test.expect, e.Data.String())
+		}
+	}
+}
@@ -1,7 +1,13 @@
 package guerrilla
 
 import (
+	"fmt"
+	"reflect"
+	"sync"
+
 	evbus "github.com/asaskevich/EventBus"
+	"github.com/flashmob/go-guerrilla/bounce"
+	"github.com/flashmob/go-guerrilla/metrics"
 )
 
 type Event int
@@ -41,6 +47,31 @@ const (
 	EventConfigServerMaxClients
 	// when a server's TLS config changed
 	EventConfigServerTLSConfig
+	// when a config could not be applied and the changes were rolled back.
+	// Handlers are called with the config that failed and the error, eg. func(c *AppConfig, err error)
+	EventConfigReloadFailed
+	// when the tracing config changed
+	EventConfigTracing
+	// when the metrics config changed
+	EventConfigMetrics
+	// when the log format changed
+	EventConfigLogFormat
+	// when the webhooks config changed
+	EventConfigWebhooks
+	// when the stats config changed
+	EventConfigStats
+	// when the data_budget changed
+	EventConfigDataBudget
+	// when the reputation config changed
+	EventConfigReputation
+	// when the dns config changed
+	EventConfigDNS
+	// when the domains config changed
+	EventConfigDomains
+	// when the retention config changed
+	EventConfigRetention
+	// when the outbound config changed
+	EventConfigOutbound
 )
 
 var eventList = [...]string{
@@ -61,27 +92,296 @@ var eventList = [...]string{
 	"server_change:timeout",
 	"server_change:max_clients",
 	"server_change:tls_config",
+	"config_change:reload_failed",
+	"config_change:tracing",
+	"config_change:metrics",
+	"config_change:log_format",
+	"config_change:webhooks",
+	"config_change:stats",
+	"config_change:data_budget",
+	"config_change:reputation",
+	"config_change:dns",
+	"config_change:domains",
+	"config_change:retention",
+	"config_change:outbound",
+}
+
+// The lifecycle events are published while the clients are served: the client, message and backend events.
+// They're delivered to each handler by a goroutine of its own, see EventHandler
+const (
+	// when a client connected. Handlers are called with a ClientInfo, eg. func(c ClientInfo)
+	EventClientConnect Event = iota + lifecycleEvents
+	// when a client disconnected, eg. func(c ClientInfo)
+	EventClientDisconnect
+	// when the backend accepted a message. Handlers are called with a MessageEvent, eg. func(m MessageEvent)
+	EventMessageAccepted
+	// when a message was rejected with a permanent (5xx) error, eg. func(m MessageEvent)
+	EventMessageRejected
+	// when a message was deferred with a transient (4xx) error, eg. func(m MessageEvent)
+	EventMessageDeferred
+	// when a saved message was a bounce or a complaint, read by the BounceParser processor.
+	// Handlers are called with a BounceEvent, eg. func(b BounceEvent)
+	EventMessageBounce
+	// when a worker of the backend recovered from a panic of a processor.
+	// Handlers are called with a backends.PanicInfo, eg. func(p backends.PanicInfo)
+	EventBackendPanic
+	// when save_process failed to save a message, and save_process_fallback saved it instead.
+	// Handlers are called with a backends.FallbackInfo, eg. func(f backends.FallbackInfo)
+	EventBackendFallback
+)
+
+// lifecycleEvents is the first lifecycle event, the config events are numbered below it
+const lifecycleEvents Event = 1000
+
+var lifecycleEventList = [...]string{
+	"client:connect",
+	"client:disconnect",
+	"message:accepted",
+	"message:rejected",
+	"message:deferred",
+	"message:bounce",
+	"backend:panic",
+	"backend:fallback",
 }
 
 func (e Event) String() string {
+	if e.isLifecycle() {
+		return lifecycleEventList[e-lifecycleEvents]
+	}
 	return eventList[e]
 }
 
+// isLifecycle returns true for the events about clients, messages and the backend
+func (e Event) isLifecycle() bool {
+	return e >= lifecycleEvents
+}
+
+// MessageEvent is passed to the handlers of EventMessageAccepted, EventMessageRejected and EventMessageDeferred
+type MessageEvent struct {
+	// Client is the client that sent the message
+	Client   ClientInfo `json:"client"`
+	QueuedID string     `json:"queued_id"`
+	// RemoteIP is the IP address of the client, or the address forwarded with XCLIENT
+	RemoteIP string   `json:"remote_ip"`
+	Helo     string   `json:"helo"`
+	MailFrom string   `json:"mail_from"`
+	RcptTo   []string `json:"rcpt_to"`
+	// Size is the size of the message data, in bytes
+	Size int64 `json:"size"`
+	// Code is the SMTP code of the response, eg. 250
+	Code int `json:"code"`
+	// Response is the response sent to the client
+	Response string `json:"response"`
+	// SaveFailed is true when the message was received, but the backend did not accept it
+	SaveFailed bool `json:"save_failed"`
+	// Reason says why the message was rejected or deferred, one of the Reason constants. Empty if accepted
+	Reason string `json:"reason,omitempty"`
+	// Rcpts are the responses of each recipient, when the backend returned backends.RcptResults
+	Rcpts []RcptResult `json:"rcpts,omitempty"`
+}
+
+// RcptResult is the response of the backend for one of the recipients of a message
+type RcptResult struct {
+	Rcpt     string `json:"rcpt"`
+	Code     int    `json:"code"`
+	Response string `json:"response"`
+}
+
+// Reasons of the rejected and deferred messages
+const (
+	// ReasonBackend is when the backend did not accept the message
+	ReasonBackend = "backend"
+	// ReasonBackendTimeout is when the backend took longer than gw_save_timeout
+	ReasonBackendTimeout = "backend_timeout"
+	// ReasonDataBudget is when DATA was deferred because the data_budget was used up
+	ReasonDataBudget = "data_budget"
+	// ReasonDataSessions is when DATA was deferred because of the server's max_data_sessions
+	ReasonDataSessions = "data_sessions"
+	// ReasonMessageSize is when the message was over the max_size
+	ReasonMessageSize = "message_size"
+	// ReasonHeaderSize is when the header of the message was over the max_header_size
+	ReasonHeaderSize = "header_size"
+	// ReasonEightBit is when the message had 8-bit data, rejected because of strict_7bit
+	ReasonEightBit = "8bit"
+	// ReasonLineLimit is when a line of the message was too long
+	ReasonLineLimit = "line_limit"
+	// ReasonReadError is when the message could not be read
+	ReasonReadError = "read_error"
+	// ReasonLoop is when the message had too many hops or was looping
+	ReasonLoop = "loop"
+)
+
+// BounceEvent is passed to the handlers of EventMessageBounce
+type BounceEvent struct {
+	// Client is the client that sent the bounce
+	Client   ClientInfo `json:"client"`
+	QueuedID string     `json:"queued_id"`
+	MailFrom string     `json:"mail_from"`
+	RcptTo   []string   `json:"rcpt_to"`
+	// Bounces are the recipients of the messages sent earlier that bounced or complained
+	Bounces []bounce.Bounce `json:"bounces"`
+}
+
+// lifecycleBuffer is how many lifecycle events can wait for a handler, the next ones are dropped
+const lifecycleBuffer = 1024
+
+// EventHandler publishes the events to the subscribed handlers.
+// The config events are passed to their handlers one at a time, by the goroutine that published them.
+// The lifecycle events are queued to each of their handlers, and a goroutine of the handler calls it with
+// them, in the order they were published, so that the clients don't wait for the handlers.
+// Handlers must not block: the events that don't fit in the queue of a handler are dropped,
+// and counted by the events.dropped metric. The handlers can subscribe and publish
 type EventHandler struct {
 	evbus.Bus
+	// lifecycle are the handlers of the lifecycle events, by topic
+	lifecycle   map[Event][]*subscriber
+	lifecycleMu sync.RWMutex
+}
+
+// subscriber calls a handler of a lifecycle event with the events queued to it
+type subscriber struct {
+	fn    reflect.Value
+	queue chan delivery
+	// done is closed when the handler is unsubscribed
+	done chan struct{}
+}
+
+// delivery is an event queued to a subscriber, or a marker that is closed when the events before it were delivered
+type delivery struct {
+	args    []reflect.Value
+	flushed chan struct{}
+}
+
+func newSubscriber(fn interface{}) (*subscriber, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%s is not of type reflect.Func", v.Kind())
+	}
+	sub := &subscriber{
+		fn:    v,
+		queue: make(chan delivery, lifecycleBuffer),
+		done:  make(chan struct{}),
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// run calls the handler with the queued events until it's unsubscribed
+func (sub *subscriber) run() {
+	for {
+		select {
+		case <-sub.done:
+			return
+		default:
+		}
+		select {
+		case d := <-sub.queue:
+			if d.flushed != nil {
+				close(d.flushed)
+				continue
+			}
+			sub.fn.Call(d.args)
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// args returns the arguments of the handler, the nil ones are the zero values of their types
+func (sub *subscriber) args(args []interface{}) []reflect.Value {
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		if arg == nil {
+			in[i] = reflect.New(sub.fn.Type().In(i)).Elem()
+		} else {
+			in[i] = reflect.ValueOf(arg)
+		}
+	}
+	return in
+}
+
+// is returns true if fn is the handler
+func (sub *subscriber) is(fn interface{}) bool {
+	v := reflect.ValueOf(fn)
+	return v.Kind() == reflect.Func && v.Type() == sub.fn.Type() && v.Pointer() == sub.fn.Pointer()
 }
 
 func (h *EventHandler) Subscribe(topic Event, fn interface{}) error {
-	if h.Bus == nil {
-		h.Bus = evbus.New()
+	if !topic.isLifecycle() {
+		if h.Bus == nil {
+			h.Bus = evbus.New()
+		}
+		return h.Bus.Subscribe(topic.String(), fn)
+	}
+	sub, err := newSubscriber(fn)
+	if err != nil {
+		return err
+	}
+	h.lifecycleMu.Lock()
+	defer h.lifecycleMu.Unlock()
+	if h.lifecycle == nil {
+		h.lifecycle = make(map[Event][]*subscriber)
 	}
-	return h.Bus.Subscribe(topic.String(), fn)
+	h.lifecycle[topic] = append(h.lifecycle[topic], sub)
+	return nil
 }
 
 func (h *EventHandler) Publish(topic Event, args ...interface{}) {
-	h.Bus.Publish(topic.String(), args...)
+	if !topic.isLifecycle() {
+		if h.Bus != nil {
+			h.Bus.Publish(topic.String(), args...)
+		}
+		return
+	}
+	h.lifecycleMu.RLock()
+	defer h.lifecycleMu.RUnlock()
+	for _, sub := range h.lifecycle[topic] {
+		select {
+		case sub.queue <- delivery{args: sub.args(args)}:
+		default:
+			metrics.Incr(metrics.EventsDropped, "event:"+topic.String())
+		}
+	}
 }
 
 func (h *EventHandler) Unsubscribe(topic Event, handler interface{}) error {
-	return h.Bus.Unsubscribe(topic.String(), handler)
+	if !topic.isLifecycle() {
+		if h.Bus == nil {
+			return fmt.Errorf("topic %s doesn't exist", topic)
+		}
+		return h.Bus.Unsubscribe(topic.String(), handler)
+	}
+	h.lifecycleMu.Lock()
+	defer h.lifecycleMu.Unlock()
+	subs := h.lifecycle[topic]
+	for i := range subs {
+		if subs[i].is(handler) {
+			close(subs[i].done)
+			h.lifecycle[topic] = append(subs[:i:i], subs[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("topic %s doesn't exist", topic)
+}
+
+// flush waits until the lifecycle events published so far were passed to their handlers
+func (h *EventHandler) flush() {
+	var subs []*subscriber
+	h.lifecycleMu.RLock()
+	for _, list := range h.lifecycle {
+		subs = append(subs, list...)
+	}
+	h.lifecycleMu.RUnlock()
+	for _, sub := range subs {
+		flushed := make(chan struct{})
+		select {
+		case sub.queue <- delivery{flushed: flushed}:
+		case <-sub.done:
+			continue
+		}
+		select {
+		case <-flushed:
+		case <-sub.done:
+		}
+	}
 }
@@ -0,0 +1,101 @@
+// Command embedded runs go-guerrilla inside another program, with a processor of its own.
+// The Tagger processor adds an X-Tag header field, set by the tagger_tag option, to the messages,
+// and the program prints the messages that were accepted:
+//
+//	go run ./examples/embedded -listen 127.0.0.1:2525 -tag example
+//
+// Send it a message with any SMTP client, eg. swaks --server 127.0.0.1:2525 --to test@example.com
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// taggerConfig is the config of the Tagger processor, read from the backend_config
+type taggerConfig struct {
+	Tag string `json:"tagger_tag"`
+}
+
+// tagger adds the X-Tag header field to the messages
+func tagger() backends.Decorator {
+	var config *taggerConfig
+	backends.Svc.AddInitializer(backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		bcfg, err := backends.Svc.ExtractConfig(backendConfig, &taggerConfig{})
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*taggerConfig)
+		return nil
+	}))
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+			if task == backends.TaskSaveMail {
+				e.DeliveryHeader += "X-Tag: " + config.Tag + "\n"
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// newDaemon returns a daemon listening on listen, which accepts the messages of all the domains
+// and tags them with tag
+func newDaemon(listen, tag string) *guerrilla.Daemon {
+	d := &guerrilla.Daemon{Config: &guerrilla.AppConfig{
+		LogFile:      "stderr",
+		LogLevel:     "info",
+		AllowedHosts: []string{"."},
+		Servers: []guerrilla.ServerConfig{{
+			ListenInterface: listen,
+			IsEnabled:       true,
+		}},
+		BackendConfig: backends.BackendConfig{
+			"save_process":      "HeadersParser|Header|Tagger",
+			"save_workers_size": 2,
+			"tagger_tag":        tag,
+		},
+	}}
+	d.AddProcessor("Tagger", tagger)
+	d.AddProcessorConfig("Tagger", func() backends.BaseConfig {
+		return &taggerConfig{}
+	})
+	return d
+}
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:2525", "the interface to listen on")
+	tag := flag.String("tag", "embedded", "the value of the X-Tag header field")
+	flag.Parse()
+
+	d := newDaemon(*listen, *tag)
+	if err := d.Subscribe(guerrilla.EventMessageAccepted, func(m guerrilla.MessageEvent) {
+		fmt.Println("accepted", m.QueuedID, "from", m.MailFrom, "to", m.RcptTo)
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := d.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Start does not block, wait for a signal to shut down
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := d.ShutdownContext(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
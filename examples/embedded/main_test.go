@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/guerrillatest"
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+func TestEmbedded(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	d := newDaemon(addr, "test")
+	d.Config.LogFile = log.OutputOff.String()
+	// keep the messages to check them
+	d.Config.BackendConfig["save_process"] = "HeadersParser|Header|Tagger|Memory"
+	backends.MemoryStore.Reset()
+	defer backends.MemoryStore.Reset()
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	if reply, err := guerrillatest.SendMail(addr, "from@example.com", []string{"to@example.com"}, "Subject: hi\n\nhello\n"); err != nil {
+		t.Fatal(err, reply)
+	}
+	envelopes := backends.MemoryStore.Envelopes()
+	if len(envelopes) != 1 || !strings.HasSuffix(envelopes[0].DeliveryHeader, "X-Tag: test\n") {
+		t.Error("expecting the message to be tagged, got", envelopes)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build go1.18
+// +build go1.18
+
+package guerrilla
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/mocks"
+)
+
+// FuzzCommandParser feeds random input to server.handleClient over a mock connection.
+// The seeds are the crashers found by the previous fuzzer, see the TestFuzz* tests in tests/
+// Run with go test -fuzz=FuzzCommandParser .
+func FuzzCommandParser(f *testing.F) {
+	seeds := []string{
+		// crashed the server by submitting DATA as the first command
+		"DATA\r\n",
+		// appeared to hang the fuzzer
+		"X_\r\nMAIL FROM:<u\xfd\xfdrU\x10c22695140\xfd727235530 Walter Sobchak\x1a\tDonny, x_6_, Donnyre   " +
+			"\t\t outof89 !om>\r\nMAIL\t\t \t\tFROM:<C4o\xfd\xfdr@example.c22695140\xfd727235530 Walter Sobchak: " +
+			"Donny, you>re out of your element!om>\r\nMAIL RCPT TO:t@IRSETRCPTIRSETRCP:<\x00\xfd\xfdr@example " +
+			"7A924_F__4_c22695140\xfd-061.0x30C8bC87fE4d3 Walter MAIL Donny, youiq__n_l>\r\n",
+		"HELO test.test.com\r\nMAIL FROM:<test@example.com>\r\nRCPT TO:<test@test.com>\r\nDATA\r\n" +
+			"Subject: Test\r\n\r\nHello\r\n.\r\nQUIT\r\n",
+		"EHLO test.test.com\r\nXCLIENT ADDR=212.96.64.216 HELO=[UNAVAILABLE]\r\nRSET\r\nSTARTTLS\r\n",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	sc := getMockServerConfig()
+	sc.LogFile = log.OutputOff.String()
+	_, server := getMockServerConn(sc, f)
+	mainlog, _ := log.GetLogger(sc.LogFile, "info")
+	envelopes := mail.NewPool(5)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		conn := mocks.NewConn()
+		client := NewClient(conn.Server, 1, mainlog, envelopes)
+		done := make(chan bool)
+		go func() {
+			server.handleClient(client)
+			envelopes.Return(client.Envelope)
+			close(done)
+		}()
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, conn.Client)
+		}()
+		_, _ = conn.Client.Write(input)
+		_ = conn.Client.Close()
+		<-done
+	})
+}
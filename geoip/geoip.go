@@ -0,0 +1,61 @@
+package geoip
+
+import (
+	"net"
+)
+
+// Record is what is known about an address, the fields are empty when the databases don't have them
+type Record struct {
+	// Country is the ISO 3166-1 code of the country, eg. "DE"
+	Country string
+	// Continent is the code of the continent, eg. "EU"
+	Continent string
+	// ASN is the number of the autonomous system announcing the address
+	ASN uint
+	// Org is the organization of the autonomous system
+	Org string
+}
+
+// Record fills in the fields of rec that the database has for ip, leaving the others untouched.
+// It can be called with a Country or City database, then an ASN database, to get both
+func (r *Reader) Record(ip net.IP, rec *Record) error {
+	v, err := r.Lookup(ip)
+	if err != nil {
+		return err
+	}
+	m, _ := v.(map[string]interface{})
+	if m == nil {
+		return nil
+	}
+	// the country where the address is, or else where it is registered
+	for _, key := range []string{"country", "registered_country"} {
+		if code := lookupString(m, key, "iso_code"); code != "" {
+			rec.Country = code
+			break
+		}
+	}
+	if code := lookupString(m, "continent", "code"); code != "" {
+		rec.Continent = code
+	}
+	if asn, ok := m["autonomous_system_number"].(uint64); ok {
+		rec.ASN = uint(asn)
+	}
+	if org, ok := m["autonomous_system_organization"].(string); ok {
+		rec.Org = org
+	}
+	return nil
+}
+
+// lookupString returns the string at the path of keys in the nested maps of m
+func lookupString(m map[string]interface{}, keys ...string) string {
+	var v interface{} = m
+	for _, key := range keys {
+		next, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = next[key]
+	}
+	s, _ := v.(string)
+	return s
+}
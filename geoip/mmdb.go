@@ -0,0 +1,363 @@
+// Package geoip looks up IP addresses in MaxMind DB files, eg. the GeoLite2 Country, City and ASN databases.
+// It has a minimal reader of the MaxMind DB format (https://maxmind.github.io/MaxMind-DB/), without dependencies.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// metadataStart marks the start of the metadata, at the end of the file
+var metadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// the metadata section is at most 128KiB
+const maxMetadataSize = 128 * 1024
+
+// ErrInvalidDatabase is returned when a file is not a MaxMind DB, or it's corrupted
+var ErrInvalidDatabase = errors.New("invalid MaxMind DB")
+
+// Metadata describes a database
+type Metadata struct {
+	DatabaseType string
+	IPVersion    uint
+	RecordSize   uint
+	NodeCount    uint
+	BuildEpoch   uint64
+	Languages    []string
+}
+
+// Reader looks up addresses in a MaxMind DB, the whole database is kept in memory.
+// It's safe for concurrent use
+type Reader struct {
+	Metadata Metadata
+
+	buf []byte
+	// the data section, pointers are offsets from its start
+	data []byte
+	// the node where the IPv4 addresses start in an IPv6 tree
+	ipv4Start uint
+	nodeBytes uint
+}
+
+// Open reads the database at path
+func Open(path string) (*Reader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return r, nil
+}
+
+// FromBytes returns a reader of the database in buf
+func FromBytes(buf []byte) (*Reader, error) {
+	from := len(buf) - maxMetadataSize
+	if from < 0 {
+		from = 0
+	}
+	i := bytes.LastIndex(buf[from:], metadataStart)
+	if i == -1 {
+		return nil, ErrInvalidDatabase
+	}
+	metaStart := from + i + len(metadataStart)
+	d := decoder{buf: buf[metaStart:]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidDatabase
+	}
+	r := &Reader{buf: buf}
+	r.Metadata.DatabaseType, _ = meta["database_type"].(string)
+	r.Metadata.IPVersion = uint(toUint64(meta["ip_version"]))
+	r.Metadata.RecordSize = uint(toUint64(meta["record_size"]))
+	r.Metadata.NodeCount = uint(toUint64(meta["node_count"]))
+	r.Metadata.BuildEpoch = toUint64(meta["build_epoch"])
+	if langs, ok := meta["languages"].([]interface{}); ok {
+		for _, l := range langs {
+			if s, ok := l.(string); ok {
+				r.Metadata.Languages = append(r.Metadata.Languages, s)
+			}
+		}
+	}
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s, unsupported record size %d", ErrInvalidDatabase, r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("%s, unsupported ip version %d", ErrInvalidDatabase, r.Metadata.IPVersion)
+	}
+	r.nodeBytes = r.Metadata.RecordSize / 4
+	treeSize := r.Metadata.NodeCount * r.nodeBytes
+	// the tree is followed by 16 zero bytes, then the data section
+	if treeSize+16 > uint(from+i) {
+		return nil, ErrInvalidDatabase
+	}
+	r.data = buf[treeSize+16 : from+i]
+	if r.Metadata.IPVersion == 6 {
+		// the IPv4 addresses are in ::/96
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Lookup returns the record of ip, or nil if the database has no record for it.
+// The maps are map[string]interface{}, the arrays []interface{} and the unsigned integers uint64, or
+// *big.Int for the 128 bit ones
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 32
+		if r.Metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("invalid ip [%s]", ip)
+	} else if r.Metadata.IPVersion == 4 {
+		return nil, fmt.Errorf("cannot look up the IPv6 address [%s] in an IPv4 database", ip)
+	}
+	count := r.Metadata.NodeCount
+	for i := 0; i < bits && node < count; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = r.record(node, bit)
+	}
+	if node == count {
+		// not found
+		return nil, nil
+	}
+	if node < count {
+		return nil, ErrInvalidDatabase
+	}
+	offset := node - count - 16
+	if offset >= uint(len(r.data)) {
+		return nil, ErrInvalidDatabase
+	}
+	d := decoder{buf: r.data}
+	v, _, err := d.decode(offset)
+	return v, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (r *Reader) record(node uint, bit uint) uint {
+	b := r.buf[node*r.nodeBytes:]
+	switch r.Metadata.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// the types of the data section
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decoder decodes the values of a data section, pointers are offsets in buf
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at offset, and the offset after it
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d *decoder) decodeDepth(offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("maximum data structure depth exceeded")
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, ErrInvalidDatabase
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decodeDepth(pointer, depth+1)
+		return v, next, err
+	}
+	if typ == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, ErrInvalidDatabase
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, ErrInvalidDatabase
+			}
+			if v, offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+	end := offset + size
+	if end > uint(len(d.buf)) || end < offset {
+		return nil, 0, ErrInvalidDatabase
+	}
+	b := d.buf[offset:end]
+	switch typ {
+	case typeString:
+		return string(b), end, nil
+	case typeBytes:
+		return append([]byte(nil), b...), end, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), end, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), end, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, end, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		// the value is padded with zeroes, not sign extended
+		return int64(int32(n)), end, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, ErrInvalidDatabase
+		}
+		return new(big.Int).SetBytes(b), end, nil
+	}
+	return nil, 0, fmt.Errorf("%s, unexpected data type %d", ErrInvalidDatabase, typ)
+}
+
+// size reads the size of a value, it's in the control byte or the bytes after it
+func (d *decoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, ErrInvalidDatabase
+	}
+	var extra uint
+	for _, c := range d.buf[offset : offset+n] {
+		extra = extra<<8 | uint(c)
+	}
+	switch size {
+	case 29:
+		size = 29 + extra
+	case 30:
+		size = 285 + extra
+	default:
+		size = 65821 + extra
+	}
+	return size, offset + n, nil
+}
+
+// pointer reads a pointer, returning the offset it points to and the offset after it
+func (d *decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&0x3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, ErrInvalidDatabase
+	}
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 0x7)
+	}
+	for _, c := range d.buf[offset : offset+n] {
+		p = p<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	return p, offset + n, nil
+}
+
+func toUint64(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
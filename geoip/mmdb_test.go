@@ -0,0 +1,116 @@
+package geoip
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testDB(t *testing.T) *Reader {
+	w := Writer{DatabaseType: "GeoLite2-Country"}
+	insert := func(cidr string, record interface{}) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("81.0.0.0/8", map[string]interface{}{
+		"continent": map[string]interface{}{"code": "EU"},
+		"country":   map[string]interface{}{"iso_code": "DE", "geoname_id": uint32(2921044)},
+	})
+	// more specific, inserted after the /8
+	insert("81.2.69.0/24", map[string]interface{}{
+		"continent":                      map[string]interface{}{"code": "EU"},
+		"registered_country":             map[string]interface{}{"iso_code": "GB"},
+		"autonomous_system_number":       uint32(20712),
+		"autonomous_system_organization": "Andrews & Arnold Ltd",
+	})
+	insert("2001:db8::/32", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "NL"},
+		"note":    strings.Repeat("x", 300),
+		"values":  []interface{}{true, 1.5, uint64(1 << 40), []byte{1, 2}},
+	})
+	var b bytes.Buffer
+	if _, err := w.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	r, err := FromBytes(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestLookup(t *testing.T) {
+	r := testDB(t)
+	if r.Metadata.DatabaseType != "GeoLite2-Country" || r.Metadata.IPVersion != 6 || r.Metadata.RecordSize != 24 {
+		t.Errorf("unexpected metadata %+v", r.Metadata)
+	}
+
+	var rec Record
+	if err := r.Record(net.ParseIP("81.1.2.3"), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec != (Record{Country: "DE", Continent: "EU"}) {
+		t.Errorf("unexpected record for 81.1.2.3: %+v", rec)
+	}
+	rec = Record{}
+	if err := r.Record(net.ParseIP("81.2.69.160"), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec != (Record{Country: "GB", Continent: "EU", ASN: 20712, Org: "Andrews & Arnold Ltd"}) {
+		t.Errorf("unexpected record for 81.2.69.160: %+v", rec)
+	}
+
+	v, err := r.Lookup(net.ParseIP("2001:db8:1::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := v.(map[string]interface{})
+	if len(m["note"].(string)) != 300 {
+		t.Error("expecting a string of 300 bytes, got", m["note"])
+	}
+	values := m["values"].([]interface{})
+	if values[0] != true || values[1] != 1.5 || values[2] != uint64(1<<40) || !bytes.Equal(values[3].([]byte), []byte{1, 2}) {
+		t.Error("unexpected values", values)
+	}
+
+	for _, ip := range []string{"82.0.0.1", "10.0.0.1", "2001:db9::1"} {
+		if v, err := r.Lookup(net.ParseIP(ip)); err != nil || v != nil {
+			t.Error("expecting no record for", ip, "got", v, err)
+		}
+	}
+}
+
+func TestDecodePointer(t *testing.T) {
+	// a map of {"a": pointer to "hi"}, followed by "hi" at offset 6
+	d := decoder{buf: []byte{0xe1, 0x41, 'a', 0x20, 0x06, 0x00, 0x42, 'h', 'i'}}
+	v, next, err := d.decode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := v.(map[string]interface{}); m["a"] != "hi" || next != 5 {
+		t.Error("unexpected value", v, next)
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); err != ErrInvalidDatabase {
+		t.Error("expecting ErrInvalidDatabase, got", err)
+	}
+	// truncated tree
+	var b bytes.Buffer
+	b.Write(metadataStart)
+	if err := encode(&b, map[string]interface{}{
+		"ip_version": uint16(6), "record_size": uint16(24), "node_count": uint32(1000),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FromBytes(b.Bytes()); err != ErrInvalidDatabase {
+		t.Error("expecting ErrInvalidDatabase, got", err)
+	}
+}
@@ -0,0 +1,261 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// Writer builds a small IPv6 MaxMind DB, eg. for tests or to map private networks.
+// The IPv4 networks are inserted in ::/96, where Reader looks them up.
+// Records are maps, arrays, strings, bools, float64, []byte and unsigned integers
+type Writer struct {
+	// DatabaseType is written in the metadata, eg. "GeoLite2-Country"
+	DatabaseType string
+	root         *writerNode
+}
+
+type writerNode struct {
+	children [2]*writerNode
+	// data of each side, when it's a leaf
+	data [2]interface{}
+	// nodes are numbered when written
+	id uint
+}
+
+// Insert sets the record of the addresses in network, the networks inserted later win
+func (w *Writer) Insert(network *net.IPNet, record interface{}) error {
+	if record == nil {
+		return errors.New("the record cannot be nil")
+	}
+	ip := network.IP.To16()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits == 0 {
+		return fmt.Errorf("invalid network [%s]", network)
+	}
+	if network.IP.To4() != nil {
+		ip = make(net.IP, net.IPv6len)
+		copy(ip[12:], network.IP.To4())
+		ones += 96
+	}
+	if ones == 0 {
+		return errors.New("cannot insert the whole address space")
+	}
+	if w.root == nil {
+		w.root = &writerNode{}
+	}
+	node := w.root
+	for i := 0; i < ones; i++ {
+		bit := ip[i>>3] >> (7 - uint(i&7)) & 1
+		if i == ones-1 {
+			node.children[bit] = nil
+			node.data[bit] = record
+			break
+		}
+		if node.children[bit] == nil {
+			// split a broader network that was inserted before
+			inherited := node.data[bit]
+			node.children[bit] = &writerNode{data: [2]interface{}{inherited, inherited}}
+			node.data[bit] = nil
+		}
+		node = node.children[bit]
+	}
+	return nil
+}
+
+// WriteTo writes the database to out
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	root := w.root
+	if root == nil {
+		root = &writerNode{}
+	}
+	// number the nodes breadth first
+	var nodes []*writerNode
+	queue := []*writerNode{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		n.id = uint(len(nodes))
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	count := uint(len(nodes))
+	var data bytes.Buffer
+	offsets := make(map[string]uint)
+	recordValue := func(n *writerNode, side int) (uint, error) {
+		if c := n.children[side]; c != nil {
+			return c.id, nil
+		}
+		if n.data[side] == nil {
+			return count, nil
+		}
+		var b bytes.Buffer
+		if err := encode(&b, n.data[side]); err != nil {
+			return 0, err
+		}
+		offset, ok := offsets[b.String()]
+		if !ok {
+			offset = uint(data.Len())
+			offsets[b.String()] = offset
+			data.Write(b.Bytes())
+		}
+		return count + 16 + offset, nil
+	}
+	recordSize := 24
+	var tree bytes.Buffer
+	for _, n := range nodes {
+		for side := 0; side < 2; side++ {
+			v, err := recordValue(n, side)
+			if err != nil {
+				return 0, err
+			}
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(v))
+			tree.Write(b[:])
+		}
+	}
+	// use 24 bit records when the values fit
+	if count+16+uint(data.Len()) < 1<<24 {
+		packed := make([]byte, 0, tree.Len()*3/4)
+		for b := tree.Bytes(); len(b) > 0; b = b[4:] {
+			packed = append(packed, b[1:4]...)
+		}
+		tree.Reset()
+		tree.Write(packed)
+	} else {
+		recordSize = 32
+	}
+	tree.Write(make([]byte, 16))
+	tree.Write(data.Bytes())
+	tree.Write(metadataStart)
+	dbType := w.DatabaseType
+	if dbType == "" {
+		dbType = "guerrilla"
+	}
+	err := encode(&tree, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               dbType,
+		"description":                 map[string]interface{}{},
+		"ip_version":                  uint16(6),
+		"languages":                   []interface{}{},
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(recordSize),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return tree.WriteTo(out)
+}
+
+// encode appends the encoded value v to b
+func encode(b *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		writeControl(b, typeString, uint(len(v)))
+		b.WriteString(v)
+	case []byte:
+		writeControl(b, typeBytes, uint(len(v)))
+		b.Write(v)
+	case bool:
+		n := uint(0)
+		if v {
+			n = 1
+		}
+		writeControl(b, typeBool, n)
+	case float64:
+		writeControl(b, typeDouble, 8)
+		var f [8]byte
+		binary.BigEndian.PutUint64(f[:], math.Float64bits(v))
+		b.Write(f[:])
+	case uint16:
+		writeUint(b, typeUint16, uint64(v))
+	case uint32:
+		writeUint(b, typeUint32, uint64(v))
+	case uint:
+		writeUint(b, typeUint64, uint64(v))
+	case uint64:
+		writeUint(b, typeUint64, v)
+	case int:
+		if v < 0 {
+			return fmt.Errorf("negative integer %d", v)
+		}
+		writeUint(b, typeUint32, uint64(v))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeControl(b, typeMap, uint(len(v)))
+		for _, k := range keys {
+			if err := encode(b, k); err != nil {
+				return err
+			}
+			if err := encode(b, v[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		writeControl(b, typeArray, uint(len(v)))
+		for _, item := range v {
+			if err := encode(b, item); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode a %T", v)
+	}
+	return nil
+}
+
+func writeUint(b *bytes.Buffer, typ int, n uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	i := 0
+	for i < 8 && buf[i] == 0 {
+		i++
+	}
+	writeControl(b, typ, uint(8-i))
+	b.Write(buf[i:])
+}
+
+// writeControl writes the control byte of a value of type typ, and its size
+func writeControl(b *bytes.Buffer, typ int, size uint) {
+	ctrl := byte(typ) << 5
+	var extended []byte
+	if typ > 7 {
+		ctrl = 0
+		extended = []byte{byte(typ - 7)}
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		extra = []byte{byte(size - 29)}
+	case size < 65821:
+		ctrl |= 30
+		size -= 285
+		extra = []byte{byte(size >> 8), byte(size)}
+	default:
+		ctrl |= 31
+		size -= 65821
+		extra = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+	}
+	b.WriteByte(ctrl)
+	b.Write(extended)
+	b.Write(extra)
+}
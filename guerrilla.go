@@ -4,11 +4,21 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 
 	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/dnscache"
 	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/metrics"
+	"github.com/flashmob/go-guerrilla/notify"
+	"github.com/flashmob/go-guerrilla/outbound"
+	"github.com/flashmob/go-guerrilla/reputation"
+	"github.com/flashmob/go-guerrilla/retention"
+	"github.com/flashmob/go-guerrilla/stats"
+	"github.com/flashmob/go-guerrilla/tracing"
 )
 
 const (
@@ -53,6 +63,37 @@ type guerrilla struct {
 	EventHandler
 	logStore
 	backendStore
+	hostsFile hostsFile
+	// allowsHost and allowsIP are consulted by the servers after the allowed hosts list, guarded by guard
+	allowsHost AllowsHostFunc
+	allowsIP   AllowsIPFunc
+	// policy is consulted by the servers before the greeting, guarded by guard
+	policy ConnectionPolicy
+	// reloadErrs are the errors while applying config changes, guarded by reloadGuard
+	reloadErrs  Errors
+	reloadGuard sync.Mutex
+	// tracer traces the servers' connections, nil if tracing is disabled. Guarded by guard
+	tracer *tracing.Tracer
+	// clock is passed to the servers, nil for the real clock. Guarded by guard
+	clock clock.Clock
+	// statsd sends the metrics, nil if metrics are disabled. Guarded by guard
+	statsd *metrics.StatsD
+	// notifierStore stores the *notify.Notifier that sends the message events to the webhooks
+	notifierStore atomic.Value
+	// stats aggregates the outcome of the messages, it's never nil
+	stats *stats.Aggregator
+	// budget limits the DATA held in memory by the clients of all the servers, it's never nil
+	budget *dataBudget
+	// reputation scores the clients of all the servers, it's never nil
+	reputation *reputation.Checker
+	// dns resolves the policy lookups of the processors and the DNSBLs, it's never nil
+	dns *dnscache.Resolver
+	// domains holds the settings of the recipients' domains for all the servers, it's never nil
+	domains *domainTable
+	// retention applies the retention rules to the backend's stores, it's never nil
+	retention *retention.Policy
+	// outbound delivers the messages queued by the Outbound processor, it's never nil
+	outbound *outbound.Queue
 }
 
 type logStore struct {
@@ -65,6 +106,8 @@ type backendStore struct {
 
 type daemonEvent func(c *AppConfig)
 type serverEvent func(sc *ServerConfig)
+type messageEvent func(m MessageEvent)
+type bounceEvent func(b BounceEvent)
 
 // Get loads the log.logger in an atomic operation. Returns a stderr logger if not able to load
 func (ls *logStore) mainlog() log.Logger {
@@ -87,7 +130,15 @@ func New(ac *AppConfig, b backends.Backend, l log.Logger) (Guerrilla, error) {
 		servers: make(map[string]*server, len(ac.Servers)),
 	}
 	g.backendStore.Store(b)
+	g.watchBackend(b)
 	g.setMainlog(l)
+	g.stats = stats.New(ac.Stats, l)
+	g.budget = newDataBudget(ac.DataBudget)
+	g.reputation = reputation.New(ac.Reputation, l)
+	g.dns = dnscache.New(ac.DNS)
+	g.domains = newDomainTable(ac.Domains)
+	g.retention = retention.New(ac.Retention, l, backends.Stores)
+	g.outbound = outbound.New(ac.Outbound, l)
 
 	if ac.LogLevel != "" {
 		if h, ok := l.(*log.HookedLogger); ok {
@@ -101,6 +152,21 @@ func New(ac *AppConfig, b backends.Backend, l log.Logger) (Guerrilla, error) {
 	_ = g.writePid()
 
 	g.state = daemonStateNew
+	if err := validateDataBudget(ac.DataBudget); err != nil {
+		return g, err
+	}
+	if err := ac.Domains.Validate(ac.BackendConfig); err != nil {
+		return g, err
+	}
+	if _, err := g.loadHostsFile(ac.AllowedHostsFile); err != nil {
+		return g, fmt.Errorf("could not read allowed_hosts_file: %s", err)
+	}
+	if err := g.startTelemetry(); err != nil {
+		return g, err
+	}
+	if err := g.startNotifier(); err != nil {
+		return g, err
+	}
 	err := g.makeServers()
 	if err != nil {
 		return g, err
@@ -140,7 +206,15 @@ func (g *guerrilla) makeServers() error {
 			}
 			if server != nil {
 				g.servers[sc.ListenInterface] = server
-				server.setAllowedHosts(g.Config.AllowedHosts)
+				server.setAllowedHosts(g.allowedHosts(&g.Config))
+				server.setAllowsFuncs(g.allowsHost, g.allowsIP)
+				server.setTracer(g.tracer)
+				server.setClock(g.clock)
+				server.publish = g.Publish
+				server.budget = g.budget
+				server.reputation = g.reputation
+				server.setConnectionPolicy(g.policy)
+				server.domains = g.domains
 			}
 		}
 	}
@@ -153,6 +227,72 @@ func (g *guerrilla) makeServers() error {
 	return errs
 }
 
+// addServer creates a new server from sc, and starts it if the daemon is running and the server is enabled.
+// The server is not added if it could not be created or started
+func (g *guerrilla) addServer(sc *ServerConfig) error {
+	g.guard.Lock()
+	if _, ok := g.servers[sc.ListenInterface]; ok {
+		g.guard.Unlock()
+		return fmt.Errorf("server [%s] already exists", sc.ListenInterface)
+	}
+	server, err := newServer(sc, g.backend(), g.mainlog())
+	if err != nil {
+		g.guard.Unlock()
+		return err
+	}
+	server.setAllowedHosts(g.allowedHosts(&g.Config))
+	server.setAllowsFuncs(g.allowsHost, g.allowsIP)
+	server.setTracer(g.tracer)
+	server.setClock(g.clock)
+	server.publish = g.Publish
+	server.budget = g.budget
+	server.reputation = g.reputation
+	server.setConnectionPolicy(g.policy)
+	server.domains = g.domains
+	g.servers[sc.ListenInterface] = server
+	started := g.state == daemonStateStarted
+	g.guard.Unlock()
+	if started && sc.IsEnabled {
+		if err := g.startServer(server); err != nil {
+			g.removeServer(sc.ListenInterface)
+			return err
+		}
+	}
+	g.mainlog().Infof("New server added [%s]", sc.ListenInterface)
+	return nil
+}
+
+// startServer starts a single server, returning an error if it could not start listening
+func (g *guerrilla) startServer(s *server) error {
+	var startWG sync.WaitGroup
+	startWG.Add(1)
+	g.mainlog().Infof("Starting: %s", s.listenInterface)
+	go func() {
+		_ = s.Start(&startWG)
+	}()
+	startWG.Wait()
+	if s.state == ServerStateStartError {
+		return s.startErr
+	}
+	return nil
+}
+
+// reloadError records an error while applying a config change, so that the reload can be rolled back
+func (g *guerrilla) reloadError(err error) {
+	g.reloadGuard.Lock()
+	defer g.reloadGuard.Unlock()
+	g.reloadErrs = append(g.reloadErrs, err)
+}
+
+// reloadErrors returns the errors recorded while applying config changes, and clears them
+func (g *guerrilla) reloadErrors() Errors {
+	g.reloadGuard.Lock()
+	defer g.reloadGuard.Unlock()
+	errs := g.reloadErrs
+	g.reloadErrs = nil
+	return errs
+}
+
 // findServer finds a server by iface (interface), retuning the server or err
 func (g *guerrilla) findServer(iface string) (*server, error) {
 	g.guard.Lock()
@@ -177,6 +317,48 @@ func (g *guerrilla) setConfig(c *AppConfig) {
 	g.Config = *c
 }
 
+// setAllowsFuncs sets the functions that all servers consult when a host is not in the allowed hosts list
+func (g *guerrilla) setAllowsFuncs(hostFunc AllowsHostFunc, ipFunc AllowsIPFunc) {
+	g.guard.Lock()
+	g.allowsHost, g.allowsIP = hostFunc, ipFunc
+	g.guard.Unlock()
+	g.mapServers(func(server *server) {
+		server.setAllowsFuncs(hostFunc, ipFunc)
+	})
+}
+
+// setConnectionPolicy sets the connection policy of all servers
+func (g *guerrilla) setConnectionPolicy(p ConnectionPolicy) {
+	g.guard.Lock()
+	g.policy = p
+	g.guard.Unlock()
+	g.mapServers(func(server *server) {
+		server.setConnectionPolicy(p)
+	})
+}
+
+// clockSetter is implemented by the backends that can time out with a given clock, eg. the BackendGateway
+type clockSetter interface {
+	SetClock(c clock.Clock)
+}
+
+// setClock sets the clock of all servers and of the backend
+func (g *guerrilla) setClock(c clock.Clock) {
+	g.guard.Lock()
+	g.clock = c
+	g.guard.Unlock()
+	g.mapServers(func(server *server) {
+		server.setClock(c)
+	})
+	if b, ok := g.backend().(clockSetter); ok {
+		b.SetClock(c)
+	}
+	g.reputation.SetClock(c)
+	g.dns.SetClock(c)
+	g.retention.SetClock(c)
+	g.outbound.SetClock(c)
+}
+
 // setServerConfig config updates the server's config, which will update for the next connected client
 func (g *guerrilla) setServerConfig(sc *ServerConfig) {
 	g.guard.Lock()
@@ -186,6 +368,51 @@ func (g *guerrilla) setServerConfig(sc *ServerConfig) {
 	}
 }
 
+// ServerStatus is a snapshot of a server's runtime state
+type ServerStatus struct {
+	ListenInterface string `json:"listen_interface"`
+	State           string `json:"state"`
+	ActiveClients   int    `json:"active_clients"`
+	MaxClients      int    `json:"max_clients"`
+}
+
+// serverStatus returns the status of each server, sorted by listen interface
+func (g *guerrilla) serverStatus() []ServerStatus {
+	var status []ServerStatus
+	g.mapServers(func(s *server) {
+		sc := s.configStore.Load().(ServerConfig)
+		status = append(status, ServerStatus{
+			ListenInterface: s.listenInterface,
+			State:           s.stateName(),
+			ActiveClients:   s.GetActiveClientsCount(),
+			MaxClients:      sc.MaxClients,
+		})
+	})
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].ListenInterface < status[j].ListenInterface
+	})
+	return status
+}
+
+// stopServer stops a running server. If drain is true, connected clients may finish their sessions
+func (g *guerrilla) stopServer(iface string, drain bool) error {
+	s, err := g.findServer(iface)
+	if err != nil {
+		return err
+	}
+	if s.state != ServerStateRunning {
+		return fmt.Errorf("server [%s] is not running", iface)
+	}
+	if drain {
+		g.mainlog().Infof("draining server [%s]", iface)
+		s.Drain()
+	} else {
+		s.Shutdown()
+	}
+	g.mainlog().Infof("Server [%s] stopped.", iface)
+	return nil
+}
+
 // mapServers calls a callback on each server in g.servers map
 // It locks the g.servers map before mapping
 func (g *guerrilla) mapServers(callback func(*server)) map[string]*server {
@@ -205,10 +432,103 @@ func (g *guerrilla) subscribeEvents() {
 	events[EventConfigNewConfig] = daemonEvent(func(c *AppConfig) {
 		g.setConfig(c)
 	})
+	// tracing changed, give the servers a new tracer
+	events[EventConfigTracing] = daemonEvent(func(c *AppConfig) {
+		tracer, err := tracing.New(c.Tracing, g.mainlog())
+		if err != nil {
+			g.mainlog().WithError(err).Error("could not configure tracing")
+			g.reloadError(err)
+			return
+		}
+		g.mapServers(func(server *server) {
+			server.setTracer(tracer)
+		})
+		g.guard.Lock()
+		old := g.tracer
+		g.tracer = tracer
+		g.guard.Unlock()
+		// export what the old tracer has queued in the background, so that the reload is not held up.
+		// Spans of the connections still in progress are dropped when they end
+		go old.Shutdown()
+		g.mainlog().Infof("tracing config changed")
+	})
+	// metrics changed, send them to a new emitter
+	events[EventConfigMetrics] = daemonEvent(func(c *AppConfig) {
+		statsd, err := metrics.New(c.Metrics, g.mainlog())
+		if err != nil {
+			g.mainlog().WithError(err).Error("could not configure metrics")
+			g.reloadError(err)
+			return
+		}
+		metrics.Set(statsd)
+		g.guard.Lock()
+		old := g.statsd
+		g.statsd = statsd
+		g.guard.Unlock()
+		_ = old.Close()
+		g.mainlog().Infof("metrics config changed")
+	})
+	// webhooks changed, send the events with a new notifier
+	events[EventConfigWebhooks] = daemonEvent(func(c *AppConfig) {
+		if err := g.reloadNotifier(c.Webhooks); err != nil {
+			g.mainlog().WithError(err).Error("could not configure the webhooks")
+			g.reloadError(err)
+			return
+		}
+		g.mainlog().Infof("webhooks config changed")
+	})
+	events[EventConfigStats] = daemonEvent(func(c *AppConfig) {
+		g.stats.Reconfigure(c.Stats, g.mainlog())
+		g.mainlog().Info("stats config changed")
+	})
+	events[EventConfigDataBudget] = daemonEvent(func(c *AppConfig) {
+		g.budget.setLimit(c.DataBudget)
+		g.mainlog().Infof("data_budget changed to %d", c.DataBudget)
+	})
+	events[EventConfigReputation] = daemonEvent(func(c *AppConfig) {
+		g.reputation.Reconfigure(c.Reputation, g.mainlog())
+		g.mainlog().Info("reputation config changed")
+	})
+	events[EventConfigDNS] = daemonEvent(func(c *AppConfig) {
+		g.dns.Reconfigure(c.DNS)
+		g.mainlog().Info("dns config changed")
+	})
+	events[EventConfigDomains] = daemonEvent(func(c *AppConfig) {
+		g.domains.set(c.Domains)
+		g.mainlog().Info("domains config changed")
+	})
+	events[EventConfigRetention] = daemonEvent(func(c *AppConfig) {
+		g.retention.Reconfigure(c.Retention, g.mainlog())
+		g.mainlog().Info("retention config changed")
+	})
+	events[EventConfigOutbound] = daemonEvent(func(c *AppConfig) {
+		g.outbound.Reconfigure(c.Outbound, g.mainlog())
+		g.mainlog().Info("outbound config changed")
+	})
+	// send the message events to the stats and webhooks
+	events[EventMessageAccepted] = messageEvent(func(m MessageEvent) {
+		g.stats.Record(m.Client.Listener, m.RcptTo, stats.Accepted, m.Size)
+		g.notify(notify.EventAccepted, m)
+	})
+	events[EventMessageRejected] = messageEvent(func(m MessageEvent) {
+		g.stats.Record(m.Client.Listener, m.RcptTo, stats.Rejected, m.Size)
+		g.notify(notify.EventRejected, m)
+	})
+	events[EventMessageDeferred] = messageEvent(func(m MessageEvent) {
+		g.stats.Record(m.Client.Listener, m.RcptTo, stats.Deferred, m.Size)
+		g.notify(notify.EventDeferred, m)
+	})
+	events[EventMessageBounce] = bounceEvent(func(b BounceEvent) {
+		g.notifier().Notify(notify.EventBounce, b)
+	})
 	// allowed_hosts changed, set for all servers
 	events[EventConfigAllowedHosts] = daemonEvent(func(c *AppConfig) {
+		if _, err := g.loadHostsFile(c.AllowedHostsFile); err != nil {
+			g.mainlog().WithError(err).Errorf("could not read allowed_hosts_file [%s]", c.AllowedHostsFile)
+		}
+		hosts := g.allowedHosts(c)
 		g.mapServers(func(server *server) {
-			server.setAllowedHosts(c.AllowedHosts)
+			server.setAllowedHosts(hosts)
 		})
 		g.mainlog().Infof("allowed_hosts config changed, a new list was set")
 	})
@@ -252,6 +572,16 @@ func (g *guerrilla) subscribeEvents() {
 		}
 	})
 
+	// log_format changed, it applies to all the logs
+	events[EventConfigLogFormat] = daemonEvent(func(c *AppConfig) {
+		if err := log.SetFormat(c.LogFormat); err != nil {
+			g.mainlog().WithError(err).Error("could not change the log format")
+			g.reloadError(err)
+			return
+		}
+		g.mainlog().Infof("log format changed to [%s]", c.LogFormat)
+	})
+
 	// write out our pid whenever the file name changes in the config
 	events[EventConfigPidFile] = daemonEvent(func(ac *AppConfig) {
 		_ = g.writePid()
@@ -271,6 +601,7 @@ func (g *guerrilla) subscribeEvents() {
 			//
 			if err := g.makeServers(); err != nil {
 				g.mainlog().WithError(err).Errorf("cannot add server [%s]", sc.ListenInterface)
+				g.reloadError(err)
 				return
 			}
 			g.mainlog().Infof("New server added [%s]", sc.ListenInterface)
@@ -278,6 +609,7 @@ func (g *guerrilla) subscribeEvents() {
 				err := g.Start()
 				if err != nil {
 					g.mainlog().WithError(err).Info("Event server_change:new_server returned errors when starting")
+					g.reloadError(err)
 				}
 			}
 		} else {
@@ -293,6 +625,7 @@ func (g *guerrilla) subscribeEvents() {
 				err := g.Start()
 				if err != nil {
 					g.mainlog().WithError(err).Info("Event server_change:start_server returned errors when starting")
+					g.reloadError(err)
 				}
 			}
 		}
@@ -324,6 +657,7 @@ func (g *guerrilla) subscribeEvents() {
 				g.mainlog().Infof("Server [%s] new TLS configuration loaded", sc.ListenInterface)
 			} else {
 				g.mainlog().WithError(err).Errorf("Server [%s] failed to load the new TLS configuration", sc.ListenInterface)
+				g.reloadError(err)
 			}
 		}
 	})
@@ -385,6 +719,7 @@ func (g *guerrilla) subscribeEvents() {
 		// init a new backend, Revert to old backend config if it fails
 		if newBackend, newErr := backends.New(appConfig.BackendConfig, logger); newErr != nil {
 			logger.WithError(newErr).Error("Error while loading the backend")
+			g.reloadError(newErr)
 			err = g.backend().Reinitialize()
 			if err != nil {
 				logger.WithError(err).Fatal("failed to revert to old backend config")
@@ -400,6 +735,7 @@ func (g *guerrilla) subscribeEvents() {
 			// swap to the bew backend (assuming old backend was shutdown so it can be safely swapped)
 			if err := newBackend.Start(); err != nil {
 				logger.WithError(err).Error("backend could not start")
+				g.reloadError(err)
 			}
 			logger.Info("new backend started")
 			g.storeBackend(newBackend)
@@ -412,6 +748,10 @@ func (g *guerrilla) subscribeEvents() {
 			err = g.Subscribe(topic, f)
 		case serverEvent:
 			err = g.Subscribe(topic, f)
+		case messageEvent:
+			err = g.Subscribe(topic, f)
+		case bounceEvent:
+			err = g.Subscribe(topic, f)
 		}
 		if err != nil {
 			g.mainlog().WithError(err).Errorf("failed to subscribe on topic [%s]", topic)
@@ -422,12 +762,44 @@ func (g *guerrilla) subscribeEvents() {
 }
 
 func (g *guerrilla) storeBackend(b backends.Backend) {
+	g.guard.Lock()
+	if c, ok := b.(clockSetter); ok && g.clock != nil {
+		c.SetClock(g.clock)
+	}
+	g.guard.Unlock()
+	g.watchBackend(b)
 	g.backendStore.Store(b)
 	g.mapServers(func(server *server) {
 		server.setBackend(b)
 	})
 }
 
+// panicNotifier is implemented by the backends that recover from the panics of their processors,
+// eg. the BackendGateway
+type panicNotifier interface {
+	SetPanicHandler(h backends.PanicHandler)
+}
+
+// fallbackNotifier is implemented by the backends that can save with a fallback, eg. the BackendGateway
+type fallbackNotifier interface {
+	SetFallbackHandler(h backends.FallbackHandler)
+}
+
+// watchBackend publishes the panics recovered by the backend b as EventBackendPanic,
+// and the messages that it saved with its fallback as EventBackendFallback
+func (g *guerrilla) watchBackend(b backends.Backend) {
+	if p, ok := b.(panicNotifier); ok {
+		p.SetPanicHandler(func(info backends.PanicInfo) {
+			g.Publish(EventBackendPanic, info)
+		})
+	}
+	if f, ok := b.(fallbackNotifier); ok {
+		f.SetFallbackHandler(func(info backends.FallbackInfo) {
+			g.Publish(EventBackendFallback, info)
+		})
+	}
+}
+
 func (g *guerrilla) backend() backends.Backend {
 	if b, ok := g.backendStore.Load().(backends.Backend); ok {
 		return b
@@ -454,10 +826,25 @@ func (g *guerrilla) Start() error {
 		if err := g.backend().Start(); err != nil {
 			startErrors = append(startErrors, err)
 		}
+		if err := g.startTelemetry(); err != nil {
+			startErrors = append(startErrors, err)
+		}
+		if err := g.startNotifier(); err != nil {
+			startErrors = append(startErrors, err)
+		}
+		g.stats.Reconfigure(g.Config.Stats, g.mainlog())
+		g.reputation.Reconfigure(g.Config.Reputation, g.mainlog())
+		g.dns.Reconfigure(g.Config.DNS)
+		g.domains.set(g.Config.Domains)
+		g.retention.Reconfigure(g.Config.Retention, g.mainlog())
+		g.outbound.Reconfigure(g.Config.Outbound, g.mainlog())
 	}
-	// channel for reading errors
-	errs := make(chan error, len(g.servers))
+	// the processors and the DNSBLs resolve with dnscache.Default
+	dnscache.Set(g.dns)
+	// the Outbound processor queues to outbound.Default
+	outbound.Set(g.outbound)
 	var startWG sync.WaitGroup
+	var starting []*server
 
 	// start servers, send any errors back to errs channel
 	for ListenInterface := range g.servers {
@@ -470,21 +857,20 @@ func (g *guerrilla) Start() error {
 			continue
 		}
 		startWG.Add(1)
+		starting = append(starting, g.servers[ListenInterface])
 		go func(s *server) {
 			g.mainlog().Infof("Starting: %s", s.listenInterface)
-			if err := s.Start(&startWG); err != nil {
-				errs <- err
-			}
+			_ = s.Start(&startWG)
 		}(g.servers[ListenInterface])
 	}
 	// wait for all servers to start (or fail)
 	startWG.Wait()
+	g.watchHostsFile()
 
-	// close, then read any errors
-	close(errs)
-	for err := range errs {
-		if err != nil {
-			startErrors = append(startErrors, err)
+	// the servers that failed set their state and error before they stopped the wait
+	for _, s := range starting {
+		if s.state == ServerStateStartError {
+			startErrors = append(startErrors, s.startErr)
 		}
 	}
 	if len(startErrors) > 0 {
@@ -494,6 +880,7 @@ func (g *guerrilla) Start() error {
 }
 
 func (g *guerrilla) Shutdown() {
+	g.stopHostsFileWatch()
 
 	// shut down the servers first
 	g.mapServers(func(s *server) {
@@ -513,6 +900,41 @@ func (g *guerrilla) Shutdown() {
 	} else {
 		g.mainlog().Infof("Backend shutdown completed")
 	}
+	// the handlers get the last events, eg. the webhooks before the notifier stops
+	g.flush()
+	g.stopTelemetry()
+	g.stopNotifier()
+	g.stats.Close()
+	g.retention.Close()
+	g.outbound.Close()
+}
+
+// startTelemetry starts the tracer and the metrics emitter configured in g.Config, and gives the tracer
+// to the servers. Called before the servers are started, or with the guard held
+func (g *guerrilla) startTelemetry() error {
+	tracer, err := tracing.New(g.Config.Tracing, g.mainlog())
+	if err != nil {
+		return fmt.Errorf("could not configure tracing: %s", err)
+	}
+	statsd, err := metrics.New(g.Config.Metrics, g.mainlog())
+	if err != nil {
+		tracer.Shutdown()
+		return fmt.Errorf("could not configure metrics: %s", err)
+	}
+	g.tracer, g.statsd = tracer, statsd
+	metrics.Set(statsd)
+	for _, s := range g.servers {
+		s.setTracer(tracer)
+	}
+	return nil
+}
+
+// stopTelemetry exports the remaining spans and metrics, and stops the tracer and the metrics emitter
+func (g *guerrilla) stopTelemetry() {
+	g.tracer.Shutdown()
+	metrics.Set(nil)
+	_ = g.statsd.Close()
+	g.tracer, g.statsd = nil, nil
 }
 
 // SetLogger sets the logger for the app and propagates it to sub-packages (eg.
@@ -7,10 +7,21 @@
 
 package guerrilla
 
-import "errors"
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortSupported is true if listeners can be opened with SO_REUSEPORT
+const reusePortSupported = false
 
 // getFileLimit checks how many files we can open
 // Don't know how to get that info (yet?), so returns false information & error
 func getFileLimit() (uint64, error) {
 	return 1000000, errors.New("syscall.RLIMIT_NOFILE not supported on your OS/platform")
 }
+
+// reusePort is not supported
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT not supported on your OS/platform")
+}
@@ -2,7 +2,14 @@
 
 package guerrilla
 
-import "syscall"
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported is true if listeners can be opened with SO_REUSEPORT
+const reusePortSupported = true
 
 // getFileLimit checks how many files we can open
 func getFileLimit() (uint64, error) {
@@ -14,3 +21,14 @@ func getFileLimit() (uint64, error) {
 	//unnecessary type conversions to uint64 is needed for FreeBSD
 	return uint64(rLimit.Max), nil
 }
+
+// reusePort sets SO_REUSEPORT on a listener's socket, it's a net.ListenConfig Control function
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
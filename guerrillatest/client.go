@@ -0,0 +1,132 @@
+package guerrillatest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+)
+
+// DefaultTimeout is the deadline of the connections made by SendMail
+const DefaultTimeout = 10 * time.Second
+
+// Connect connects to the server configured by sc and reads its greeting.
+// The connection starts with TLS when the server has tls_always_on, the certificate is not verified.
+// The deadline of the connection is set to timeout from now
+func Connect(sc guerrilla.ServerConfig, timeout time.Duration) (net.Conn, *bufio.Reader, error) {
+	var bufin *bufio.Reader
+	var conn net.Conn
+	var err error
+	if sc.TLS.AlwaysOn {
+		conn, err = tls.Dial("tcp", sc.ListenInterface, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "127.0.0.1",
+		})
+	} else {
+		conn, err = net.Dial("tcp", sc.ListenInterface)
+	}
+	if err != nil {
+		return conn, bufin, errors.New("Cannot dial server: " + sc.ListenInterface + "," + err.Error())
+	}
+	bufin = bufio.NewReader(conn)
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return conn, bufin, err
+	}
+	// read greeting, ignore it
+	_, err = bufin.ReadString('\n')
+	return conn, bufin, err
+}
+
+// Command sends command and returns the first line of the reply
+func Command(conn net.Conn, bufin *bufio.Reader, command string) (reply string, err error) {
+	_, err = fmt.Fprintln(conn, command+"\r")
+	if err == nil {
+		return bufin.ReadString('\n')
+	}
+	return "", err
+}
+
+// SendMail sends msg from the from address to the to addresses through the server at addr, without TLS.
+// msg is dot-stuffed and its line endings changed to CRLF. Returns the reply to the end of DATA, eg.
+// "250 2.0.0 OK: queued as 1d1b0e6d7c0f2cf0dc1c03fb1e2a2ac5". An unexpected reply is returned as a *textproto.Error
+func SendMail(addr, from string, to []string, msg string) (reply string, err error) {
+	conn, err := net.DialTimeout("tcp", addr, DefaultTimeout)
+	if err != nil {
+		return "", err
+	}
+	if err = conn.SetDeadline(time.Now().Add(DefaultTimeout)); err != nil {
+		_ = conn.Close()
+		return "", err
+	}
+	text := textproto.NewConn(conn)
+	defer func() {
+		_ = text.Close()
+	}()
+	if _, _, err = text.ReadResponse(220); err != nil {
+		return "", err
+	}
+	cmd := func(expectCode int, format string, args ...interface{}) error {
+		id, err := text.Cmd(format, args...)
+		if err != nil {
+			return err
+		}
+		text.StartResponse(id)
+		defer text.EndResponse(id)
+		_, _, err = text.ReadResponse(expectCode)
+		return err
+	}
+	if err = cmd(250, "EHLO guerrillatest.local"); err != nil {
+		return "", err
+	}
+	if err = cmd(250, "MAIL FROM:<%s>", from); err != nil {
+		return "", err
+	}
+	for _, rcpt := range to {
+		if err = cmd(250, "RCPT TO:<%s>", rcpt); err != nil {
+			return "", err
+		}
+	}
+	if err = cmd(354, "DATA"); err != nil {
+		return "", err
+	}
+	w := text.DotWriter()
+	if _, err = w.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	code, line, err := text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+	reply = fmt.Sprintf("%d %s", code, line)
+	_ = cmd(221, "QUIT")
+	return reply, nil
+}
+
+// MatchLog returns true if a line of the log file at path contains match
+func MatchLog(path string, match string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	in := bufio.NewScanner(f)
+	in.Buffer(nil, 1024*1024)
+	for in.Scan() {
+		if strings.Contains(in.Text(), match) {
+			return true, nil
+		}
+	}
+	return false, in.Err()
+}
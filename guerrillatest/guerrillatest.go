@@ -0,0 +1,250 @@
+// Package guerrillatest starts go-guerrilla daemons for the tests of the projects that embed it.
+// A Server listens on a free port of 127.0.0.1, keeps the messages saved by its backend and logs to a temporary file,
+// so that a test can send a message with SendMail and check what was saved and logged
+package guerrillatest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// ProcessorName is the name of the processor that keeps the messages saved by the backend of a Server.
+// NewServer appends it to the save_process of the backend_config
+const ProcessorName = "GuerrillaTest"
+
+// DefaultSaveProcess is the save_process of a Server that was given no backend_config
+const DefaultSaveProcess = "HeadersParser|Header|" + ProcessorName
+
+// Message is a message saved by the backend of a Server
+type Message struct {
+	QueuedID string
+	RemoteIP string
+	Helo     string
+	MailFrom string
+	RcptTo   []string
+	// Subject and Header are set when the HeadersParser processor is in the save_process
+	Subject string
+	Header  textproto.MIMEHeader
+	// Data is the message as it was saved, including the delivery header added by the processors
+	Data string
+}
+
+// Server is a Daemon started by NewServer
+type Server struct {
+	Daemon *guerrilla.Daemon
+	// Addr is the address that the first server of the config listens on, eg. 127.0.0.1:41235
+	Addr string
+	// LogFile is the main log, see MatchLog
+	LogFile string
+
+	id      int
+	tempLog bool
+	mu      sync.Mutex
+	// messages are the messages saved, guarded by mu
+	messages []Message
+	// saved is closed and replaced when a message is saved, guarded by mu
+	saved chan struct{}
+}
+
+var (
+	// servers are the running Servers by id, for the processor to find
+	servers  = make(map[int]*Server)
+	lastID   int
+	serverMu sync.Mutex
+)
+
+func init() {
+	backends.Svc.AddProcessor(ProcessorName, processor)
+}
+
+type processorConfig struct {
+	ID int `json:"guerrillatest_id"`
+}
+
+// processor keeps the messages for the Server given by the guerrillatest_id of the backend_config
+func processor() backends.Decorator {
+	var config *processorConfig
+	initFunc := backends.InitializeWith(func(backendConfig backends.BackendConfig) error {
+		if config != nil {
+			// the initializers are shared by the backends, a later one is initializing
+			return nil
+		}
+		bcfg, err := backends.Svc.ExtractConfig(backendConfig, &processorConfig{})
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*processorConfig)
+		return nil
+	})
+	backends.Svc.AddInitializer(initFunc)
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+			if task == backends.TaskSaveMail {
+				serverMu.Lock()
+				s := servers[config.ID]
+				serverMu.Unlock()
+				if s != nil {
+					s.save(e)
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+// NewServer starts a Daemon with cfg, which may be nil for the defaults. The test fails if it can't start.
+// The first server of cfg (or the default server) listens on a free port of 127.0.0.1, recipients of any host
+// are allowed if cfg has no allowed_hosts, and the main log goes to a temporary file if cfg has no log_file.
+// cfg is not modified. Call Close once done
+func NewServer(t testing.TB, cfg *guerrilla.AppConfig) *Server {
+	t.Helper()
+	s, err := startServer(cfg)
+	if err != nil {
+		t.Fatal("guerrillatest: could not start the server:", err)
+	}
+	return s
+}
+
+func startServer(cfg *guerrilla.AppConfig) (*Server, error) {
+	c := guerrilla.AppConfig{}
+	if cfg != nil {
+		c = *cfg
+		c.Servers = append([]guerrilla.ServerConfig(nil), cfg.Servers...)
+	}
+	addr, err := freeAddr()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Servers) == 0 {
+		c.Servers = append(c.Servers, guerrilla.ServerConfig{IsEnabled: true})
+	}
+	c.Servers[0].ListenInterface = addr
+	if len(c.AllowedHosts) == 0 && c.AllowedHostsFile == "" {
+		c.AllowedHosts = []string{"."}
+	}
+	s := &Server{Addr: addr, saved: make(chan struct{})}
+	if c.LogFile == "" {
+		f, err := ioutil.TempFile("", "guerrillatest")
+		if err != nil {
+			return nil, err
+		}
+		_ = f.Close()
+		c.LogFile, s.tempLog = f.Name(), true
+	}
+	s.LogFile = c.LogFile
+
+	serverMu.Lock()
+	lastID++
+	s.id = lastID
+	servers[s.id] = s
+	serverMu.Unlock()
+
+	c.BackendConfig = backends.BackendConfig{}
+	if cfg != nil {
+		for k, v := range cfg.BackendConfig {
+			c.BackendConfig[k] = v
+		}
+	}
+	if process, ok := c.BackendConfig["save_process"].(string); ok && process != "" {
+		c.BackendConfig["save_process"] = process + "|" + ProcessorName
+	} else {
+		c.BackendConfig["save_process"] = DefaultSaveProcess
+	}
+	c.BackendConfig["guerrillatest_id"] = s.id
+
+	s.Daemon = &guerrilla.Daemon{Config: &c}
+	if err := s.Daemon.Start(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// freeAddr returns an address of 127.0.0.1 with a port that's free to listen on
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	addr := l.Addr().String()
+	return addr, l.Close()
+}
+
+// Close shuts down the daemon and removes the temporary log file
+func (s *Server) Close() {
+	s.Daemon.Shutdown()
+	serverMu.Lock()
+	delete(servers, s.id)
+	serverMu.Unlock()
+	if s.tempLog {
+		_ = os.Remove(s.LogFile)
+	}
+}
+
+// save keeps a copy of e, the envelope is reused once processed
+func (s *Server) save(e *mail.Envelope) {
+	m := Message{
+		QueuedID: e.QueuedId,
+		RemoteIP: e.RemoteIP,
+		Helo:     e.Helo,
+		MailFrom: e.MailFrom.String(),
+		Subject:  e.Subject,
+		Data:     e.String(),
+	}
+	for i := range e.RcptTo {
+		m.RcptTo = append(m.RcptTo, e.RcptTo[i].String())
+	}
+	if e.Header != nil {
+		m.Header = make(textproto.MIMEHeader, len(e.Header))
+		for k, v := range e.Header {
+			m.Header[k] = append([]string(nil), v...)
+		}
+	}
+	s.mu.Lock()
+	s.messages = append(s.messages, m)
+	close(s.saved)
+	s.saved = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// Messages returns the messages saved so far, oldest first
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// WaitMessages waits for n messages to be saved and returns the messages saved.
+// It returns an error if less than n were saved before the timeout
+func (s *Server) WaitMessages(n int, timeout time.Duration) ([]Message, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		messages, saved := append([]Message(nil), s.messages...), s.saved
+		s.mu.Unlock()
+		if len(messages) >= n {
+			return messages, nil
+		}
+		select {
+		case <-saved:
+		case <-deadline:
+			return messages, fmt.Errorf("%d messages were saved in %s, expecting %d", len(messages), timeout, n)
+		}
+	}
+}
+
+// MatchLog returns true if a line of the main log contains match
+func (s *Server) MatchLog(match string) bool {
+	found, err := MatchLog(s.LogFile, match)
+	return found && err == nil
+}
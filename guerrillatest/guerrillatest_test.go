@@ -0,0 +1,76 @@
+package guerrillatest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla"
+	"github.com/flashmob/go-guerrilla/backends"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(t, nil)
+	defer s.Close()
+	msg := "Subject: hello\nFrom: sender@example.com\n\nHi there\n.dot\n"
+	reply, err := SendMail(s.Addr, "sender@example.com", []string{"a@test.com", "b@example.org"}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(reply, "250 ") {
+		t.Error("expecting the message to be queued, got", reply)
+	}
+	messages, err := s.WaitMessages(1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := messages[0]
+	if m.MailFrom != "sender@example.com" || len(m.RcptTo) != 2 || m.RcptTo[1] != "b@example.org" {
+		t.Errorf("unexpected envelope %+v", m)
+	}
+	if m.Subject != "hello" || m.Header.Get("From") != "sender@example.com" {
+		t.Errorf("expecting the headers to be parsed, got %+v", m.Header)
+	}
+	if !strings.Contains(m.Data, "Received:") || !strings.HasSuffix(m.Data, "\n\nHi there\n.dot\n") {
+		t.Errorf("unexpected data %q", m.Data)
+	}
+	if !strings.Contains(reply, m.QueuedID) {
+		t.Error("expecting the reply to have the queued id", m.QueuedID)
+	}
+	if !s.MatchLog("Handle client") {
+		t.Error("expecting the log to have the client")
+	}
+	if s.MatchLog("no such line") {
+		t.Error("expecting the log not to match")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	s := NewServer(t, &guerrilla.AppConfig{
+		AllowedHosts: []string{"test.com"},
+		BackendConfig: backends.BackendConfig{
+			"save_process":      "HeadersParser|Debugger",
+			"save_workers_size": 2,
+		},
+	})
+	defer s.Close()
+	if _, err := SendMail(s.Addr, "sender@example.com", []string{"a@example.org"}, "Subject: x\n\nx\n"); err == nil {
+		t.Error("expecting the recipient to be refused")
+	}
+	if _, err := SendMail(s.Addr, "sender@example.com", []string{"a@test.com"}, "Subject: x\n\nx\n"); err != nil {
+		t.Fatal(err)
+	}
+	if messages := s.Messages(); len(messages) != 1 || messages[0].Subject != "x" {
+		t.Errorf("expecting the message to be saved, got %+v", messages)
+	}
+
+	sc := s.Daemon.Config.Servers[0]
+	conn, bufin, err := Connect(sc, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if reply, err := Command(conn, bufin, "HELO test"); err != nil || !strings.HasPrefix(reply, "250") {
+		t.Error("expecting HELO to be accepted, got", reply, err)
+	}
+}
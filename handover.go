@@ -0,0 +1,172 @@
+package guerrilla
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ListenFDsEnv is the environment variable that a parent process uses to hand over its listeners.
+// It lists the listen interfaces of the listeners, separated by commas, in the same order as
+// the listener files passed to the new process starting at file descriptor 3 (eg. with exec.Cmd.ExtraFiles)
+const ListenFDsEnv = "GUERRILLA_LISTEN_FDS"
+
+// the first file descriptor after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// inherited holds the listeners handed over by the parent process, keyed by listen interface
+var inherited struct {
+	sync.Mutex
+	once      sync.Once
+	listeners map[string]net.Listener
+	err       error
+}
+
+// loadInheritedListeners makes listeners from the files described by spec, starting at file descriptor fd
+func loadInheritedListeners(spec string, fd uintptr) (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	if spec == "" {
+		return listeners, nil
+	}
+	for i, iface := range strings.Split(spec, ",") {
+		f := os.NewFile(fd+uintptr(i), "listener:"+iface)
+		if f == nil {
+			return listeners, fmt.Errorf("inherited listener [%s] has an invalid file descriptor", iface)
+		}
+		l, err := net.FileListener(f)
+		// FileListener dups the file
+		_ = f.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("could not use the inherited listener [%s]: %s", iface, err)
+		}
+		listeners[iface] = l
+	}
+	return listeners, nil
+}
+
+// inheritedListener returns the listener handed over for iface, if any. A listener can only be taken once.
+// Returns an error if the handed over listeners could not be loaded
+func inheritedListener(iface string) (net.Listener, bool, error) {
+	inherited.Lock()
+	defer inherited.Unlock()
+	inherited.once.Do(func() {
+		spec := os.Getenv(ListenFDsEnv)
+		// don't let the listeners be inherited again by our own child processes
+		_ = os.Unsetenv(ListenFDsEnv)
+		inherited.listeners, inherited.err = loadInheritedListeners(spec, listenFDsStart)
+	})
+	if inherited.err != nil {
+		return nil, false, inherited.err
+	}
+	l, ok := inherited.listeners[iface]
+	if ok {
+		delete(inherited.listeners, iface)
+	}
+	return l, ok, nil
+}
+
+// closeInheritedListeners closes the handed over listeners that no server is using
+func closeInheritedListeners() {
+	inherited.Lock()
+	defer inherited.Unlock()
+	for iface, l := range inherited.listeners {
+		_ = l.Close()
+		delete(inherited.listeners, iface)
+	}
+}
+
+// listen returns the listener handed over for iface by the parent process, or starts listening on iface
+func listen(iface string) (net.Listener, error) {
+	if l, ok, err := inheritedListener(iface); err != nil {
+		return nil, err
+	} else if ok {
+		return l, nil
+	}
+	return net.Listen("tcp", iface)
+}
+
+// listenReusePort opens n listeners on iface with SO_REUSEPORT, the kernel spreads the connections among them.
+// The listener handed over for iface by the parent process, if any, is the first one,
+// it must have been opened with SO_REUSEPORT too
+func listenReusePort(iface string, n int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	if l, ok, err := inheritedListener(iface); err != nil {
+		return nil, err
+	} else if ok {
+		listeners = append(listeners, l)
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	for len(listeners) < n {
+		l, err := lc.Listen(context.Background(), "tcp", iface)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// ListenerFiles returns duplicates of the listener files of the running servers, and their listen interfaces.
+// Pass them to a new process with ListenFDsEnv to hand over the listeners, eg. for a zero-downtime upgrade.
+// The listeners of the admin API, pprof and the dashboard are not handed over, see StopHTTPServers.
+// The caller must close the files
+func (d *Daemon) ListenerFiles() ([]*os.File, []string, error) {
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return nil, nil, fmt.Errorf("daemon not started")
+	}
+	var files []*os.File
+	var ifaces []string
+	var errs Errors
+	g.mapServers(func(s *server) {
+		if s.state != ServerStateRunning {
+			return
+		}
+		// the first listener is handed over, the others share its port with SO_REUSEPORT
+		tl, ok := s.listeners[0].(*net.TCPListener)
+		if !ok {
+			errs = append(errs, fmt.Errorf("listener [%s] is not a TCP listener", s.listenInterface))
+			return
+		}
+		f, err := tl.File()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot get the file for listener [%s]: %s", s.listenInterface, err))
+			return
+		}
+		files = append(files, f)
+		ifaces = append(ifaces, s.listenInterface)
+	})
+	if len(errs) > 0 {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		return nil, nil, errs
+	}
+	return files, ifaces, nil
+}
+
+// StopHTTPServers stops the admin API, pprof and the dashboard, so that a new process can listen on their
+// interfaces: ListenerFiles only hands over the listeners of the SMTP servers
+func (d *Daemon) StopHTTPServers() {
+	d.stopAdmin()
+	d.stopPprof()
+	d.stopDashboard()
+}
+
+// StartHTTPServers starts the admin API, pprof and the dashboard that are enabled in the config,
+// eg. after StopHTTPServers when the new process could not start
+func (d *Daemon) StartHTTPServers() error {
+	if err := d.startAdmin(); err != nil {
+		return err
+	}
+	if err := d.startPprof(); err != nil {
+		return err
+	}
+	return d.startDashboard()
+}
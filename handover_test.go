@@ -0,0 +1,65 @@
+package guerrilla
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenerHandover(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface := l.Addr().String()
+	listeners, err := loadInheritedListeners(iface, f.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := listeners[iface]; !ok {
+		t.Fatal("expecting a listener for", iface)
+	}
+	// make sure the environment is not consulted, then hand over the listener
+	inherited.once.Do(func() {})
+	inherited.Lock()
+	inherited.listeners = listeners
+	inherited.Unlock()
+
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		// the port is still taken by l, so the server must use the handed over listener
+		Servers: []ServerConfig{{ListenInterface: iface, IsEnabled: true}},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	if _, ok, _ := inheritedListener(iface); ok {
+		t.Error("expecting the handed over listener to be taken by the server")
+	}
+	files, ifaces, err := d.ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		_ = f.Close()
+	}
+	if len(files) != 1 || len(ifaces) != 1 || ifaces[0] != iface {
+		t.Error("expecting the listener file for", iface, "got", ifaces)
+	}
+}
+
+func TestLoadInheritedListenersBadFD(t *testing.T) {
+	if _, err := loadInheritedListeners("127.0.0.1:2525", 1<<20); err == nil {
+		t.Error("expecting an error for a file descriptor that is not open")
+	}
+	if listeners, err := loadInheritedListeners("", listenFDsStart); err != nil || len(listeners) != 0 {
+		t.Error("expecting no listeners for an empty spec", err)
+	}
+}
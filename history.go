@@ -0,0 +1,48 @@
+package guerrilla
+
+import "bytes"
+
+// commandHistory keeps the last commands of a client in a ring, see command_history.
+// The zero value keeps none
+type commandHistory struct {
+	lines []string
+	// next is where the next command goes, the oldest once the ring is full
+	next int
+	full bool
+}
+
+// reset empties the history, and makes it keep the last n commands
+func (h *commandHistory) reset(n int) {
+	if cap(h.lines) >= n {
+		h.lines = h.lines[:n]
+	} else {
+		h.lines = make([]string, n)
+	}
+	for i := range h.lines {
+		h.lines[i] = ""
+	}
+	h.next, h.full = 0, false
+}
+
+// add records a command line, the credentials of AUTH commands are redacted
+func (h *commandHistory) add(line []byte) {
+	if len(h.lines) == 0 {
+		return
+	}
+	h.lines[h.next] = string(bytes.TrimRight(redactAuth(line), "\r\n"))
+	h.next++
+	if h.next == len(h.lines) {
+		h.next, h.full = 0, true
+	}
+}
+
+// list returns the commands, the oldest first. Nil if there are none
+func (h *commandHistory) list() []string {
+	if !h.full {
+		if h.next == 0 {
+			return nil
+		}
+		return append([]string(nil), h.lines[:h.next]...)
+	}
+	return append(append(make([]string, 0, len(h.lines)), h.lines[h.next:]...), h.lines[:h.next]...)
+}
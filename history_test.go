@@ -0,0 +1,33 @@
+package guerrilla
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandHistory(t *testing.T) {
+	var h commandHistory
+	h.add([]byte("HELO test.com"))
+	if h.list() != nil {
+		t.Error("the zero value should keep no command")
+	}
+	h.reset(3)
+	if h.list() != nil {
+		t.Error("expecting no command")
+	}
+	h.add([]byte("HELO test.com"))
+	h.add([]byte("AUTH PLAIN c2VjcmV0"))
+	if got, want := h.list(), []string{"HELO test.com", "AUTH PLAIN [redacted]"}; !reflect.DeepEqual(got, want) {
+		t.Error("expecting", want, "got", got)
+	}
+	h.add([]byte("MAIL FROM:<a@test.com>"))
+	h.add([]byte("RCPT TO:<b@test.com>"))
+	if got, want := h.list(), []string{"AUTH PLAIN [redacted]", "MAIL FROM:<a@test.com>", "RCPT TO:<b@test.com>"}; !reflect.DeepEqual(got, want) {
+		t.Error("expecting", want, "got", got)
+	}
+	h.reset(2)
+	h.add([]byte("QUIT"))
+	if got, want := h.list(), []string{"QUIT"}; !reflect.DeepEqual(got, want) {
+		t.Error("expecting", want, "got", got)
+	}
+}
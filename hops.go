@@ -0,0 +1,46 @@
+package guerrilla
+
+import (
+	"strings"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// defaultMaxHops is the number of Received header fields allowed when max_hops is 0, as RFC 5321 6.3 suggests
+const defaultMaxHops = 25
+
+// maxHops returns the number of hops allowed
+func (sc *ServerConfig) maxHops() int {
+	if sc.MaxHops == 0 {
+		return defaultMaxHops
+	}
+	return sc.MaxHops
+}
+
+// maxHeaderScan returns how much of the message is scanned for its header: max_header_size, or max_size
+// when there's no header limit
+func (sc *ServerConfig) maxHeaderScan() int64 {
+	if sc.MaxHeaderSize > 0 {
+		return sc.MaxHeaderSize
+	}
+	return sc.MaxSize
+}
+
+// checkHops counts the Received header fields of the message, and looks for the Delivered-To fields
+// that the Header processor adds. A message that was delivered to one of its recipients already came
+// through here, and an alias or a catch-all sent it back. The header is scanned up to limit bytes.
+// Returns nil if the message can be delivered
+func checkHops(e *mail.Envelope, max int, limit int64) error {
+	trace := mail.ReadTrace(e.NewReader(), limit)
+	if trace.Hops > max {
+		return HopCountExceeded
+	}
+	for _, to := range trace.DeliveredTo {
+		for i := range e.RcptTo {
+			if strings.EqualFold(e.RcptTo[i].String(), to) {
+				return MailLoopDetected
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package guerrilla
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostsFileInterval is how often the allowed_hosts_file is checked for changes
+var hostsFileInterval = 5 * time.Second
+
+// hostsFile holds the hosts loaded from the allowed_hosts_file
+type hostsFile struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	hosts   []string
+	// closing stop ends the watcher
+	stop chan struct{}
+}
+
+// readHostsFile reads a newline-delimited list of hosts. Blank lines and lines starting with # are skipped
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, scanner.Err()
+}
+
+// loadHostsFile loads the hosts from path, if the path changed or the file was modified since the last load.
+// Returns true if the hosts were (re)loaded. An empty path clears the hosts
+func (g *guerrilla) loadHostsFile(path string) (bool, error) {
+	g.hostsFile.Lock()
+	defer g.hostsFile.Unlock()
+	if path == "" {
+		changed := g.hostsFile.path != ""
+		g.hostsFile.path, g.hostsFile.hosts = "", nil
+		return changed, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if path == g.hostsFile.path && info.ModTime().Equal(g.hostsFile.modTime) && info.Size() == g.hostsFile.size {
+		return false, nil
+	}
+	hosts, err := readHostsFile(path)
+	if err != nil {
+		return false, err
+	}
+	g.hostsFile.path = path
+	g.hostsFile.modTime = info.ModTime()
+	g.hostsFile.size = info.Size()
+	g.hostsFile.hosts = hosts
+	return true, nil
+}
+
+// allowedHosts returns the allowed_hosts config setting combined with the hosts from the allowed_hosts_file
+func (g *guerrilla) allowedHosts(c *AppConfig) []string {
+	g.hostsFile.Lock()
+	defer g.hostsFile.Unlock()
+	if len(g.hostsFile.hosts) == 0 {
+		return c.AllowedHosts
+	}
+	hosts := make([]string, 0, len(c.AllowedHosts)+len(g.hostsFile.hosts))
+	hosts = append(hosts, c.AllowedHosts...)
+	return append(hosts, g.hostsFile.hosts...)
+}
+
+// watchHostsFile starts checking the allowed_hosts_file for changes, until stopHostsFileWatch is called.
+// The file is reloaded independently of the main config
+func (g *guerrilla) watchHostsFile() {
+	g.hostsFile.Lock()
+	if g.hostsFile.stop != nil {
+		// already watching
+		g.hostsFile.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	g.hostsFile.stop = stop
+	g.hostsFile.Unlock()
+	go func() {
+		ticker := time.NewTicker(hostsFileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				g.guard.Lock()
+				c := g.Config
+				g.guard.Unlock()
+				if c.AllowedHostsFile == "" {
+					continue
+				}
+				changed, err := g.loadHostsFile(c.AllowedHostsFile)
+				if err != nil {
+					g.mainlog().WithError(err).Errorf("could not reload allowed_hosts_file [%s]", c.AllowedHostsFile)
+					continue
+				}
+				if changed {
+					hosts := g.allowedHosts(&c)
+					g.mapServers(func(server *server) {
+						server.setAllowedHosts(hosts)
+					})
+					g.mainlog().Infof("allowed_hosts_file [%s] changed, a new list was set", c.AllowedHostsFile)
+				}
+			}
+		}
+	}()
+}
+
+// stopHostsFileWatch stops the watcher started by watchHostsFile
+func (g *guerrilla) stopHostsFileWatch() {
+	g.hostsFile.Lock()
+	defer g.hostsFile.Unlock()
+	if g.hostsFile.stop != nil {
+		close(g.hostsFile.stop)
+		g.hostsFile.stop = nil
+	}
+}
@@ -0,0 +1,75 @@
+package log
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	// FormatText writes lines as key=value pairs, the default
+	FormatText = "text"
+	// FormatJSON writes each line as a JSON object, for ingestion by ELK, Loki, etc.
+	FormatJSON = "json"
+)
+
+// Keys of the fields that have a fixed meaning
+const (
+	// FieldTime is the time of the entry, in RFC3339 format with nanoseconds
+	FieldTime = "ts"
+	// FieldLevel is the level of the entry, eg. "info"
+	FieldLevel = "level"
+	// FieldMsg is the message
+	FieldMsg = "msg"
+	// FieldIface is the listen interface of the server that logged the entry
+	FieldIface = "iface"
+	// FieldServerID is the host name of the server that logged the entry
+	FieldServerID = "serverID"
+	// FieldClientID is the id of the client's connection
+	FieldClientID = "clientID"
+	// FieldQueuedID is the queued id of the envelope being received
+	FieldQueuedID = "queuedID"
+	// FieldPeer is the IP address of the client
+	FieldPeer = "peer"
+)
+
+// ValidateFormat returns an error if format is not one of the formats, empty means the default format
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown log format [%s], use %s or %s", format, FormatText, FormatJSON)
+}
+
+// SetFormat sets the format of all the loggers returned by GetLogger, including the ones already returned
+func SetFormat(format string) error {
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	loggers.Lock()
+	defer loggers.Unlock()
+	loggers.format = format
+	for _, l := range loggers.cache {
+		if h, ok := l.(*HookedLogger); ok {
+			h.SetFormatter(newFormatter(format))
+		}
+	}
+	return nil
+}
+
+func newFormatter(format string) log.Formatter {
+	if format == FormatJSON {
+		return &log.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+			FieldMap: log.FieldMap{
+				log.FieldKeyTime:  FieldTime,
+				log.FieldKeyLevel: FieldLevel,
+				log.FieldKeyMsg:   FieldMsg,
+			},
+		}
+	}
+	return new(log.TextFormatter)
+}
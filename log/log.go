@@ -54,6 +54,7 @@ func (level Level) String() string {
 type Logger interface {
 	log.FieldLogger
 	WithConn(conn net.Conn) *log.Entry
+	WithQueuedID(clientID uint64, queuedID string) *log.Entry
 	Reopen() error
 	GetLogDest() string
 	SetLevel(level string)
@@ -86,7 +87,9 @@ type loggerCache map[loggerKey]Logger
 // loggers store the cached loggers created by NewLogger
 var loggers struct {
 	cache loggerCache
-	// mutex guards the cache
+	// format is the format of the loggers, see SetFormat
+	format string
+	// mutex guards the cache and format
 	sync.Mutex
 }
 
@@ -165,7 +168,7 @@ func newLogrus(o OutputOption, level string) (*log.Logger, error) {
 
 	logger := &log.Logger{
 		Out:       out,
-		Formatter: new(log.TextFormatter),
+		Formatter: newFormatter(loggers.format),
 		Hooks:     make(log.LevelHooks),
 		Level:     logLevel,
 	}
@@ -173,13 +176,37 @@ func newLogrus(o OutputOption, level string) (*log.Logger, error) {
 	return logger, nil
 }
 
-// AddHook adds a new logrus hook
+// WithLevel returns a logger that writes to the same destination as l, at another level, eg. so that a part
+// of the program logs more, or less, than the rest. It shares the file of l, which Reopen of l re-opens.
+// l is returned as it is if it's not a *HookedLogger
+func WithLevel(l Logger, level string) (Logger, error) {
+	logLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	hl, ok := l.(*HookedLogger)
+	if !ok {
+		return l, nil
+	}
+	derived := *hl
+	derived.Logger = &log.Logger{
+		Out:       hl.Out,
+		Formatter: hl.Formatter,
+		Hooks:     hl.Hooks,
+		Level:     logLevel,
+		ExitFunc:  hl.ExitFunc,
+	}
+	return &derived, nil
+}
+
+// AddHook adds a new logrus hook to the logger
 func (l *HookedLogger) AddHook(h log.Hook) {
-	log.AddHook(h)
+	l.Logger.AddHook(h)
 }
 
 func (l *HookedLogger) IsDebug() bool {
-	return l.GetLevel() == log.DebugLevel.String()
+	// compared as a Level, Level.String allocates
+	return l.Level == log.DebugLevel
 }
 
 // SetLevel sets a log level, one of the LogLevels
@@ -210,6 +237,12 @@ func (l *HookedLogger) GetLogDest() string {
 	return l.dest
 }
 
+// WithQueuedID returns an entry with the id of the client's connection and the queued id of the envelope,
+// so that all the lines about a message can be found with a single grep
+func (l *HookedLogger) WithQueuedID(clientID uint64, queuedID string) *log.Entry {
+	return l.WithFields(log.Fields{FieldClientID: clientID, FieldQueuedID: queuedID})
+}
+
 // WithConn extends logrus to be able to log with a net.Conn
 func (l *HookedLogger) WithConn(conn net.Conn) *log.Entry {
 	var addr = "unknown"
@@ -3,18 +3,22 @@ package mail
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net"
 	"net/textproto"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/flashmob/go-guerrilla/mail/rfc5321"
+	"github.com/flashmob/go-guerrilla/tracing"
 )
 
 // A WordDecoder decodes MIME headers containing RFC 2047 encoded-words.
@@ -35,7 +39,8 @@ const maxHeaderChunk = 1 + (4 << 10) // 4KB
 type Address struct {
 	// User is local part
 	User string
-	// Host is the domain
+	// Host is the domain. Internationalized domains are stored in their ASCII (punycode) form,
+	// see HostUnicode
 	Host string
 	// ADL is at-domain list if matched
 	ADL []string
@@ -111,14 +116,50 @@ func NewAddress(str string) (*Address, error) {
 	addr := &l.List[0]
 	a.User = addr.LocalPart
 	a.Quoted = addr.LocalPartQuoted
-	a.Host = addr.Domain
 	a.IP = addr.IP
+	if a.IP == nil {
+		a.Host = NormalizeHost(addr.Domain)
+	} else {
+		a.Host = addr.Domain
+	}
 	a.DisplayName = addr.DisplayName
 	a.DisplayNameQuoted = addr.DisplayNameQuoted
 	a.NullPath = addr.NullPath
 	return a, nil
 }
 
+// HeaderField records where a top-level header field was found in the envelope's Data
+// so that it can be canonicalized (eg. for DKIM) without re-reading the message
+type HeaderField struct {
+	// Name is the field name, exactly as it appeared (not canonicalized)
+	Name string
+	// Offset is the position of the first byte of the field in Data
+	Offset int
+	// Raw is a copy of the field's bytes, including any folded lines and the line endings
+	Raw []byte
+}
+
+// Len returns the length of the raw field in bytes
+func (h *HeaderField) Len() int {
+	return len(h.Raw)
+}
+
+// Timings are the times of the stages of a transaction, set by the server as they're reached.
+// The processors see the stages up to DataEnd, a stage that was not reached is zero
+type Timings struct {
+	// Connected is when the client connected, it's kept for all the transactions of the connection
+	Connected time.Time
+	// Mail is when MAIL was accepted
+	Mail time.Time
+	// FirstRcpt is when the first RCPT was accepted
+	FirstRcpt time.Time
+	// DataStart is when DATA was accepted, and DataEnd when the message was read
+	DataStart time.Time
+	DataEnd   time.Time
+	// Saved is when the backend returned
+	Saved time.Time
+}
+
 // Envelope of Email represents a single SMTP message.
 type Envelope struct {
 	// Remote IP address
@@ -127,9 +168,15 @@ type Envelope struct {
 	Helo string
 	// Sender
 	MailFrom Address
+	// MailParams holds the ESMTP parameters given with the MAIL command
+	MailParams ESMTPParams
 	// Recipients
 	RcptTo []Address
-	// Data stores the header and message body
+	// RcptParams holds the ESMTP parameters of each RCPT command, in the same order as RcptTo
+	RcptParams []ESMTPParams
+	// Data stores the header and message body.
+	// If the message was spooled to disk (see ReadData), Data only holds the beginning of the message.
+	// Use NewReader to read the entire message
 	Data bytes.Buffer
 	// Subject stores the subject of the email, extracted and decoded after calling ParseHeaders()
 	Subject string
@@ -137,18 +184,44 @@ type Envelope struct {
 	TLS bool
 	// Header stores the results from ParseHeaders()
 	Header textproto.MIMEHeader
+	// RawHeaders stores the location of each header field in Data, in the order they appeared.
+	// Populated by ParseHeaders()
+	RawHeaders []HeaderField
 	// Values hold the values generated when processing the envelope by the backend
 	Values map[string]interface{}
+	// Route names the stack of the backend's save_routes that saves the envelope, save_process if empty
+	Route string
+	// Tags are the tags of the server that received the envelope, eg. {"tenant": "acme"}.
+	// They're shared with the server's config, do not modify them
+	Tags map[string]string
 	// Hashes of each email on the rcpt
 	Hashes []string
 	// additional delivery header that may be added
 	DeliveryHeader string
 	// Email(s) will be queued with this id
 	QueuedId string
+	// ClientID is the id of the connection the envelope was received on
+	ClientID uint64
 	// ESMTP: true if EHLO was used
 	ESMTP bool
+	// AuthUser is the identity the client authenticated as, empty if the client did not authenticate
+	AuthUser string
+	// AuthMethod is the SASL mechanism used to authenticate, eg. PLAIN or LOGIN
+	AuthMethod string
+	// Timings are the times of the stages of the current transaction
+	Timings Timings
+	// Span traces the current transaction, nil if tracing is disabled.
+	// Processors are traced as its children
+	Span *tracing.Span
 	// When locked, it means that the envelope is being processed by the backend
 	sync.Mutex
+	// ctx is cancelled when the client disconnects, the server shuts down or the backend gives up
+	ctx       context.Context
+	cancel    context.CancelFunc
+	parentCtx context.Context
+	// spool holds the remainder of the message data when it went over the spool threshold
+	spool    *os.File
+	spoolLen int64
 }
 
 func NewEnvelope(remoteAddr string, clientID uint64) *Envelope {
@@ -156,13 +229,10 @@ func NewEnvelope(remoteAddr string, clientID uint64) *Envelope {
 		RemoteIP: remoteAddr,
 		Values:   make(map[string]interface{}),
 		QueuedId: queuedID(clientID),
+		ClientID: clientID,
 	}
 }
 
-func queuedID(clientID uint64) string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(string(time.Now().Unix())+string(clientID))))
-}
-
 // ParseHeaders parses the headers into Header field of the Envelope struct.
 // Data buffer must be full before calling.
 // It assumes that at most 30kb of email data can be a header
@@ -181,6 +251,7 @@ func (e *Envelope) ParseHeaders() error {
 	headerEnd := bytes.Index(buf, []byte{'\n', '\n'}) // the first two new-lines chars are the End Of Header
 	if headerEnd > -1 {
 		header := buf[0 : headerEnd+2]
+		e.RawHeaders = scanHeaderFields(header)
 		headerReader := textproto.NewReader(bufio.NewReader(bytes.NewBuffer(header)))
 		e.Header, err = headerReader.ReadMIMEHeader()
 		if err == nil || err == io.EOF {
@@ -195,23 +266,244 @@ func (e *Envelope) ParseHeaders() error {
 	return err
 }
 
+// HeaderValue returns the first value of the header field name, with any RFC2047 encoded-words decoded.
+// The headers are parsed if ParseHeaders was not called yet. Returns an empty string if not present
+func (e *Envelope) HeaderValue(name string) string {
+	e.parseHeadersOnce()
+	if e.Header == nil {
+		return ""
+	}
+	return MimeHeaderDecode(e.Header.Get(name))
+}
+
+// HeaderAddresses parses the addresses from all the header fields named name, eg. "To" or "Cc".
+// Display names are RFC2047 decoded. The headers are parsed if ParseHeaders was not called yet
+func (e *Envelope) HeaderAddresses(name string) ([]*Address, error) {
+	e.parseHeadersOnce()
+	if e.Header == nil {
+		return nil, nil
+	}
+	var list []*Address
+	for _, v := range e.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+		for _, str := range splitAddressList(v) {
+			a, err := NewAddress(str)
+			if err != nil {
+				return list, err
+			}
+			a.DisplayName = MimeHeaderDecode(a.DisplayName)
+			list = append(list, a)
+		}
+	}
+	return list, nil
+}
+
+// FromHeader returns the first address of the From header, or nil if there isn't one
+func (e *Envelope) FromHeader() (*Address, error) {
+	list, err := e.HeaderAddresses("From")
+	if len(list) == 0 {
+		return nil, err
+	}
+	return list[0], err
+}
+
+// ToHeaders returns the addresses listed in the To header
+func (e *Envelope) ToHeaders() ([]*Address, error) {
+	return e.HeaderAddresses("To")
+}
+
+// CcHeaders returns the addresses listed in the Cc header
+func (e *Envelope) CcHeaders() ([]*Address, error) {
+	return e.HeaderAddresses("Cc")
+}
+
+// parseHeadersOnce calls ParseHeaders if the headers were not parsed yet
+func (e *Envelope) parseHeadersOnce() {
+	if e.Header == nil {
+		_ = e.ParseHeaders()
+	}
+}
+
+// splitAddressList splits an address-list on the commas that are not inside quotes,
+// angle brackets or comments
+func splitAddressList(list string) []string {
+	var (
+		out     []string
+		start   int
+		quoted  bool
+		angle   int
+		comment int
+	)
+	for i := 0; i < len(list); i++ {
+		switch c := list[i]; {
+		case c == '\\' && (quoted || comment > 0):
+			i++
+		case c == '"' && comment == 0:
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			comment++
+		case c == ')' && comment > 0:
+			comment--
+		case comment > 0:
+		case c == '<':
+			angle++
+		case c == '>' && angle > 0:
+			angle--
+		case c == ',' && angle == 0:
+			if s := strings.TrimSpace(list[start:i]); s != "" {
+				out = append(out, s)
+			}
+			start = i + 1
+		}
+	}
+	if s := strings.TrimSpace(list[start:]); s != "" {
+		out = append(out, s)
+	}
+	return out
+}
+
+// RawHeader returns the raw header fields matching name (case-insensitive), in the order they appeared.
+// ParseHeaders must be called first
+func (e *Envelope) RawHeader(name string) []HeaderField {
+	var fields []HeaderField
+	for i := range e.RawHeaders {
+		if strings.EqualFold(e.RawHeaders[i].Name, name) {
+			fields = append(fields, e.RawHeaders[i])
+		}
+	}
+	return fields
+}
+
+// scanHeaderFields finds the byte ranges of each header field in header.
+// Folded lines (starting with a space or tab) are included with the field they continue.
+// Lines that do not look like a field (no colon) are skipped
+func scanHeaderFields(header []byte) []HeaderField {
+	var fields []HeaderField
+	var field *HeaderField
+	for pos := 0; pos < len(header); {
+		end := bytes.IndexByte(header[pos:], '\n')
+		if end == -1 {
+			end = len(header)
+		} else {
+			end += pos + 1
+		}
+		line := header[pos:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// end of header
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && field != nil {
+			// continuation of a folded field
+			field.Raw = append(field.Raw, line...)
+		} else if colon := bytes.IndexByte(line, ':'); colon > 0 {
+			fields = append(fields, HeaderField{
+				Name:   string(bytes.TrimRight(line[:colon], " \t")),
+				Offset: pos,
+				Raw:    append([]byte(nil), line...),
+			})
+			field = &fields[len(fields)-1]
+		} else {
+			field = nil
+		}
+		pos = end
+	}
+	return fields
+}
+
+// ReadData reads the message data from r until EOF.
+// If threshold is more than 0, at most threshold bytes will be kept in e.Data and the rest is spooled
+// to a temporary file in dir (or the default temp dir if dir is empty). The file is removed when the
+// transaction is reset. The threshold is never lower than the size needed to hold the header for ParseHeaders.
+// Returns the number of bytes read
+func (e *Envelope) ReadData(r io.Reader, threshold int64, dir string) (int64, error) {
+	if threshold <= 0 {
+		return e.Data.ReadFrom(r)
+	}
+	if threshold < maxHeaderChunk {
+		threshold = maxHeaderChunk
+	}
+	n, err := e.Data.ReadFrom(io.LimitReader(r, threshold))
+	if err != nil || n < threshold {
+		return n, err
+	}
+	// over the threshold, spool the rest
+	if e.spool, err = ioutil.TempFile(dir, "guerrilla-spool-"); err != nil {
+		return n, err
+	}
+	e.spoolLen, err = io.Copy(e.spool, r)
+	return n + e.spoolLen, err
+}
+
+// Spooled returns true if a part of the message data was spooled to disk by ReadData
+func (e *Envelope) Spooled() bool {
+	return e.spool != nil
+}
+
+// SpoolReader returns a reader for the part of the message data that was spooled to disk,
+// or nil if nothing was spooled
+func (e *Envelope) SpoolReader() io.Reader {
+	if e.spool == nil {
+		return nil
+	}
+	return io.NewSectionReader(e.spool, 0, e.spoolLen)
+}
+
+// removeSpool closes and deletes the spool file, if any
+func (e *Envelope) removeSpool() {
+	if e.spool == nil {
+		return
+	}
+	_ = e.spool.Close()
+	_ = os.Remove(e.spool.Name())
+	e.spool = nil
+	e.spoolLen = 0
+}
+
 // Len returns the number of bytes that would be in the reader returned by NewReader()
 func (e *Envelope) Len() int {
-	return len(e.DeliveryHeader) + e.Data.Len()
+	return len(e.DeliveryHeader) + e.Data.Len() + int(e.spoolLen)
 }
 
 // NewReader returns a new reader for reading the email contents, including the delivery headers
 func (e *Envelope) NewReader() io.Reader {
+	if e.spool != nil {
+		return io.MultiReader(
+			strings.NewReader(e.DeliveryHeader),
+			bytes.NewReader(e.Data.Bytes()),
+			e.SpoolReader(),
+		)
+	}
 	return io.MultiReader(
 		strings.NewReader(e.DeliveryHeader),
 		bytes.NewReader(e.Data.Bytes()),
 	)
 }
 
-// String converts the email to string.
-// Typically, you would want to use the compressor guerrilla.Processor for more efficiency, or use NewReader
+// WriteTo writes the email contents, including the delivery headers, to w.
+// It neither copies nor consumes e.Data, so each processor can read the message in turn
+func (e *Envelope) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, e.DeliveryHeader)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	n, err = w.Write(e.Data.Bytes())
+	written += int64(n)
+	if err != nil || e.spool == nil {
+		return written, err
+	}
+	m, err := io.Copy(w, e.SpoolReader())
+	return written + m, err
+}
+
+// String converts the email to string, making a copy of the message.
+// Typically, you would want to use the compressor guerrilla.Processor for more efficiency, or use WriteTo
+// or NewReader. Note that if the message was spooled, it will be read back in to memory
 func (e *Envelope) String() string {
-	return e.DeliveryHeader + e.Data.String()
+	var b strings.Builder
+	b.Grow(e.Len())
+	_, _ = e.WriteTo(&b)
+	return b.String()
 }
 
 // ResetTransaction is called when the transaction is reset (keeping the connection open)
@@ -223,39 +515,182 @@ func (e *Envelope) ResetTransaction() {
 	e.Unlock()
 
 	e.MailFrom = Address{}
-	e.RcptTo = []Address{}
+	e.MailParams = nil
+	// keep the recipients' array allocated for the next transaction
+	e.RcptTo = e.RcptTo[:0]
+	e.RcptParams = nil
 	// reset the data buffer, keep it allocated
 	e.Data.Reset()
+	e.removeSpool()
 
-	// todo: these are probably good candidates for buffers / use sync.Pool (after profiling)
 	e.Subject = ""
 	e.Header = nil
-	e.Hashes = make([]string, 0)
+	e.RawHeaders = nil
+	e.Hashes = e.Hashes[:0]
 	e.DeliveryHeader = ""
-	e.Values = make(map[string]interface{})
+	e.Route = ""
+	e.Timings = Timings{Connected: e.Timings.Connected}
+	if e.Values == nil {
+		e.Values = make(map[string]interface{})
+	}
+	for key := range e.Values {
+		delete(e.Values, key)
+	}
+	e.Span.End()
+	e.Span = nil
+	if e.parentCtx != nil {
+		// cancel the finished transaction's context and start a new one
+		e.SetContext(e.parentCtx)
+	}
 }
 
 // Reseed is called when used with a new connection, once it's accepted
 func (e *Envelope) Reseed(remoteIP string, clientID uint64) {
 	e.RemoteIP = remoteIP
 	e.QueuedId = queuedID(clientID)
+	e.ClientID = clientID
 	e.Helo = ""
 	e.TLS = false
 	e.ESMTP = false
+	e.AuthUser = ""
+	e.AuthMethod = ""
+	e.Tags = nil
+	e.Timings = Timings{}
+	e.Span.End()
+	e.Span = nil
+	e.Cancel()
+	e.ctx, e.cancel, e.parentCtx = nil, nil, nil
+}
+
+// SetContext sets the parent of the envelope's context, usually the context of the client's connection.
+// Each transaction gets a new context derived from parent
+func (e *Envelope) SetContext(parent context.Context) {
+	e.Cancel()
+	e.parentCtx = parent
+	e.ctx, e.cancel = context.WithCancel(parent)
+}
+
+// Context returns the context of the current transaction. Processors should check it to stop early
+// when the client has gone away, the server is shutting down or the backend timed out.
+// Returns context.Background() if SetContext was not called
+func (e *Envelope) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// Cancel cancels the context of the current transaction
+func (e *Envelope) Cancel() {
+	if e.cancel != nil {
+		e.cancel()
+	}
 }
 
 // PushRcpt adds a recipient email address to the envelope
+// The address' PathParams are also appended to RcptParams
 func (e *Envelope) PushRcpt(addr Address) {
 	e.RcptTo = append(e.RcptTo, addr)
+	e.RcptParams = append(e.RcptParams, NewESMTPParams(addr.PathParams))
 }
 
 // PopRcpt removes the last email address that was pushed to the envelope
 func (e *Envelope) PopRcpt() Address {
 	ret := e.RcptTo[len(e.RcptTo)-1]
 	e.RcptTo = e.RcptTo[:len(e.RcptTo)-1]
+	if len(e.RcptParams) > len(e.RcptTo) {
+		e.RcptParams = e.RcptParams[:len(e.RcptTo)]
+	}
 	return ret
 }
 
+// ESMTPParams maps the keywords of ESMTP parameters to their values.
+// Keywords are stored in upper-case, parameters without a value map to an empty string
+type ESMTPParams map[string]string
+
+// NewESMTPParams builds an ESMTPParams from the key/value pairs in Address.PathParams
+func NewESMTPParams(pathParams [][]string) ESMTPParams {
+	if len(pathParams) == 0 {
+		return nil
+	}
+	p := make(ESMTPParams, len(pathParams))
+	for _, kv := range pathParams {
+		if len(kv) == 0 || kv[0] == "" {
+			continue
+		}
+		var val string
+		if len(kv) > 1 {
+			val = kv[1]
+		}
+		p[strings.ToUpper(kv[0])] = val
+	}
+	return p
+}
+
+// Has returns true if the keyword was given, keyword is case-insensitive
+func (p ESMTPParams) Has(keyword string) bool {
+	_, ok := p[strings.ToUpper(keyword)]
+	return ok
+}
+
+// Get returns the value of the keyword, or an empty string if not present
+func (p ESMTPParams) Get(keyword string) string {
+	return p[strings.ToUpper(keyword)]
+}
+
+// Size returns the value of the SIZE parameter (RFC 1870).
+// ok is false if the parameter is missing or not a number
+func (p ESMTPParams) Size() (size int64, ok bool) {
+	v, found := p["SIZE"]
+	if !found {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// Body returns the value of the BODY parameter (RFC 6152), eg. 7BIT or 8BITMIME, in upper-case
+func (p ESMTPParams) Body() string {
+	return strings.ToUpper(p["BODY"])
+}
+
+// RequireTLS returns true if the REQUIRETLS parameter was given (RFC 8689)
+func (p ESMTPParams) RequireTLS() bool {
+	return p.Has("REQUIRETLS")
+}
+
+// SMTPUTF8 returns true if the SMTPUTF8 parameter was given (RFC 6531)
+func (p ESMTPParams) SMTPUTF8() bool {
+	return p.Has("SMTPUTF8")
+}
+
+// Ret returns the value of the DSN RET parameter, FULL or HDRS (RFC 3461)
+func (p ESMTPParams) Ret() string {
+	return strings.ToUpper(p["RET"])
+}
+
+// EnvID returns the value of the DSN ENVID parameter (RFC 3461)
+func (p ESMTPParams) EnvID() string {
+	return p["ENVID"]
+}
+
+// Notify returns the list of DSN NOTIFY conditions, eg. SUCCESS, FAILURE, DELAY or NEVER (RFC 3461)
+func (p ESMTPParams) Notify() []string {
+	v, ok := p["NOTIFY"]
+	if !ok || v == "" {
+		return nil
+	}
+	return strings.Split(strings.ToUpper(v), ",")
+}
+
+// ORcpt returns the value of the DSN ORCPT parameter (RFC 3461)
+func (p ESMTPParams) ORcpt() string {
+	return p["ORCPT"]
+}
+
 const (
 	statePlainText = iota
 	stateStartEncodedWord
@@ -1,10 +1,13 @@
 package mail
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Test MimeHeader decoding, not using iconv
@@ -146,3 +149,228 @@ func TestEncodedWordAhead(t *testing.T) {
 	}
 
 }
+
+func TestRawHeaders(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.Data.WriteString("Subject: Test\nDKIM-Signature: v=1; a=rsa-sha256;\n\td=example.com\nfrom : test@example.com\n\nbody: not a header\n")
+	if err := e.ParseHeaders(); err != nil && err != io.EOF {
+		t.Error("cannot parse headers:", err)
+		return
+	}
+	if len(e.RawHeaders) != 3 {
+		t.Error("expecting 3 raw headers, got:", len(e.RawHeaders))
+		return
+	}
+	data := e.Data.Bytes()
+	for _, h := range e.RawHeaders {
+		if string(data[h.Offset:h.Offset+h.Len()]) != string(h.Raw) {
+			t.Error("raw header does not match its position in Data:", h.Name)
+		}
+	}
+	if dkim := e.RawHeader("dkim-signature"); len(dkim) != 1 {
+		t.Error("expecting 1 dkim-signature header")
+	} else if string(dkim[0].Raw) != "DKIM-Signature: v=1; a=rsa-sha256;\n\td=example.com\n" {
+		t.Error("folded header not captured, got:", string(dkim[0].Raw))
+	}
+	if from := e.RawHeader("From"); len(from) != 1 || from[0].Name != "from" {
+		t.Error("expecting the From header with its original name")
+	}
+	e.ResetTransaction()
+	if e.RawHeaders != nil {
+		t.Error("RawHeaders should be cleared after reset")
+	}
+}
+
+func TestEnvelopeSpool(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.DeliveryHeader = "Delivered-To: test@example.com\n"
+	msg := "Subject: Spool\n\n" + strings.Repeat("0123456789", 1000)
+	n, err := e.ReadData(strings.NewReader(msg), 5000, "")
+	if err != nil {
+		t.Error("could not read data:", err)
+		return
+	}
+	if n != int64(len(msg)) {
+		t.Error("expecting", len(msg), "bytes read, got", n)
+	}
+	if !e.Spooled() {
+		t.Error("expecting the message to be spooled")
+		return
+	}
+	if e.Data.Len() != 5000 {
+		t.Error("expecting 5000 bytes in memory, got", e.Data.Len())
+	}
+	if e.Len() != len(e.DeliveryHeader)+len(msg) {
+		t.Error("e.Len() is incorrect, got", e.Len())
+	}
+	data, _ := ioutil.ReadAll(e.NewReader())
+	if string(data) != e.DeliveryHeader+msg {
+		t.Error("data read back from the spool does not match")
+	}
+	if e.String() != e.DeliveryHeader+msg {
+		t.Error("e.String() does not match")
+	}
+	if err := e.ParseHeaders(); err != nil && err != io.EOF {
+		t.Error("cannot parse headers:", err)
+	} else if e.Subject != "Spool" {
+		t.Error("Subject expecting: Spool, got:", e.Subject)
+	}
+	name := e.spool.Name()
+	e.ResetTransaction()
+	if e.Spooled() {
+		t.Error("spool should be removed after reset")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("spool file was not deleted:", name)
+	}
+	// under the threshold, stays in memory
+	if _, err = e.ReadData(strings.NewReader("Subject: Small\n\nHi"), 5000, ""); err != nil {
+		t.Error(err)
+	}
+	if e.Spooled() {
+		t.Error("small message should not be spooled")
+	}
+}
+
+func TestEnvelopeWriteTo(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.DeliveryHeader = "Received: from test\r\n"
+	msg := "Subject: Test\r\n\r\n" + strings.Repeat("0123456789", 1000)
+	if _, err := e.ReadData(strings.NewReader(msg), 5000, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer e.ResetTransaction()
+	// every reader gets the whole message, e.Data is not consumed
+	for i := 0; i < 2; i++ {
+		var b strings.Builder
+		n, err := e.WriteTo(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != e.DeliveryHeader+msg || n != int64(e.Len()) {
+			t.Errorf("expecting the whole message on write #%d, got %d bytes", i, n)
+		}
+	}
+	if e.String() != e.DeliveryHeader+msg {
+		t.Error("expecting String to return the whole message")
+	}
+}
+
+func TestESMTPParams(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.MailParams = NewESMTPParams([][]string{{"size", "1024"}, {"BODY", "8bitmime"}, {"RET", "hdrs"}, {"REQUIRETLS", ""}})
+	if size, ok := e.MailParams.Size(); !ok || size != 1024 {
+		t.Error("expecting size 1024, got", size, ok)
+	}
+	if body := e.MailParams.Body(); body != "8BITMIME" {
+		t.Error("expecting body 8BITMIME, got", body)
+	}
+	if ret := e.MailParams.Ret(); ret != "HDRS" {
+		t.Error("expecting ret HDRS, got", ret)
+	}
+	if !e.MailParams.RequireTLS() {
+		t.Error("expecting REQUIRETLS")
+	}
+	if e.MailParams.SMTPUTF8() {
+		t.Error("not expecting SMTPUTF8")
+	}
+
+	e.PushRcpt(Address{User: "a", Host: "example.com", PathParams: [][]string{{"NOTIFY", "success,delay"}}})
+	e.PushRcpt(Address{User: "b", Host: "example.com"})
+	if len(e.RcptParams) != 2 {
+		t.Fatal("expecting 2 RcptParams, got", len(e.RcptParams))
+	}
+	if n := e.RcptParams[0].Notify(); len(n) != 2 || n[0] != "SUCCESS" || n[1] != "DELAY" {
+		t.Error("unexpected notify", n)
+	}
+	if e.RcptParams[1].Has("NOTIFY") {
+		t.Error("second recipient has no params")
+	}
+	e.PopRcpt()
+	if len(e.RcptParams) != 1 {
+		t.Error("expecting RcptParams to be popped, got", len(e.RcptParams))
+	}
+
+	var empty ESMTPParams
+	if _, ok := empty.Size(); ok {
+		t.Error("nil params should have no size")
+	}
+
+	e.ResetTransaction()
+	if e.MailParams != nil || e.RcptParams != nil {
+		t.Error("params were not reset")
+	}
+}
+
+func TestHeaderAccessors(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	e.Data.WriteString("From: =?ISO-8859-1?Q?Andr=E9?= <andre@example.com>\n" +
+		"To: \"Doe, John\" <john@example.com>, Jane <jane@example.com>\n" +
+		"Cc: bob@example.com\n" +
+		"Cc: <alice@example.com>\n" +
+		"X-Label: =?utf-8?q?caf=C3=A9?=\n" +
+		"\n" +
+		"Hello")
+	// no ParseHeaders call, the accessors parse lazily
+	if v := e.HeaderValue("x-label"); v != "café" {
+		t.Error("expecting café, got", v)
+	}
+	from, err := e.FromHeader()
+	if err != nil || from == nil {
+		t.Fatal("expecting from address", err)
+	}
+	if from.DisplayName != "André" || from.String() != "andre@example.com" {
+		t.Error("unexpected from", from.DisplayName, from.String())
+	}
+	to, err := e.ToHeaders()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(to) != 2 || to[0].String() != "john@example.com" || to[1].String() != "jane@example.com" {
+		t.Error("unexpected to", to)
+	} else if to[0].DisplayName != "Doe, John" {
+		t.Error("expecting display name 'Doe, John', got", to[0].DisplayName)
+	}
+	cc, _ := e.CcHeaders()
+	if len(cc) != 2 {
+		t.Error("expecting 2 cc addresses, got", len(cc))
+	}
+	if v := e.HeaderValue("Missing"); v != "" {
+		t.Error("expecting empty value, got", v)
+	}
+}
+
+func TestEnvelopeContext(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 22)
+	if e.Context() == nil || e.Context().Err() != nil {
+		t.Error("expecting a usable default context")
+	}
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e.SetContext(parent)
+	ctx := e.Context()
+	e.ResetTransaction()
+	if ctx.Err() == nil {
+		t.Error("expecting the finished transaction's context to be cancelled")
+	}
+	if e.Context().Err() != nil {
+		t.Error("expecting a new context for the next transaction")
+	}
+	cancel()
+	if e.Context().Err() == nil {
+		t.Error("expecting the context to be cancelled with its parent")
+	}
+	e.Timings.Connected = time.Now()
+	e.Timings.Mail = time.Now()
+	e.ResetTransaction()
+	if e.Timings.Connected.IsZero() || !e.Timings.Mail.IsZero() {
+		t.Error("expecting the timings of the transaction to be reset, but not the time of the connection")
+	}
+	e.Reseed("127.0.0.1", 23)
+	if !e.Timings.Connected.IsZero() {
+		t.Error("expecting the timings to be cleared after reseed")
+	}
+	if e.Context().Err() != nil {
+		t.Error("expecting the context to be cleared after reseed")
+	}
+}
@@ -0,0 +1,62 @@
+package mail
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeHost converts an internationalized domain to its lower-case ASCII (A-label) form,
+// so that "bücher.example" and "xn--bcher-kva.example" compare equal.
+// Plain ASCII domains and domains that fail to convert are returned unchanged.
+// Labels containing a '*' wildcard are lower-cased and left as-is
+func NormalizeHost(host string) string {
+	if !isIDN(host) {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if strings.Contains(label, "*") {
+			labels[i] = strings.ToLower(label)
+			continue
+		}
+		ascii, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return host
+		}
+		labels[i] = ascii
+	}
+	return strings.Join(labels, ".")
+}
+
+// isIDN returns true if the host has non-ASCII characters or a punycode encoded label
+func isIDN(host string) bool {
+	for i := 0; i < len(host); i++ {
+		if host[i] >= 0x80 {
+			return true
+		}
+	}
+	return strings.HasPrefix(host, "xn--") || strings.Contains(host, ".xn--") ||
+		strings.HasPrefix(host, "XN--") || strings.Contains(host, ".XN--")
+}
+
+// HostASCII returns the Host in its ASCII (A-label) form, eg. xn--bcher-kva.example
+func (a *Address) HostASCII() string {
+	if a.IP != nil {
+		return a.Host
+	}
+	return NormalizeHost(a.Host)
+}
+
+// HostUnicode returns the Host in its Unicode (U-label) form, eg. bücher.example
+// The Host is returned unchanged if it cannot be converted
+func (a *Address) HostUnicode() string {
+	if a.IP != nil || !isIDN(a.Host) {
+		return a.Host
+	}
+	u, err := idna.Lookup.ToUnicode(a.Host)
+	if err != nil {
+		return a.Host
+	}
+	return u
+}
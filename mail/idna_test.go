@@ -0,0 +1,42 @@
+package mail
+
+import "testing"
+
+func TestNormalizeHost(t *testing.T) {
+	testTable := map[string]string{
+		"example.com":           "example.com",
+		"Example.COM":           "Example.COM",
+		"bücher.example":        "xn--bcher-kva.example",
+		"BÜCHER.example":        "xn--bcher-kva.example",
+		"XN--BCHER-KVA.example": "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"*.bücher.example":      "*.xn--bcher-kva.example",
+		"mail.xn--fiqs8s":       "mail.xn--fiqs8s",
+		"中国.example":            "xn--fiqs8s.example",
+		"127.0.0.1":             "127.0.0.1",
+		"exämple.xn--fiqs8s":    "xn--exmple-cua.xn--fiqs8s",
+	}
+	for in, expect := range testTable {
+		if out := NormalizeHost(in); out != expect {
+			t.Error(in, ": expected", expect, "but got", out)
+		}
+	}
+}
+
+func TestAddressHostForms(t *testing.T) {
+	a := &Address{User: "test", Host: "bücher.example"}
+	if a.HostASCII() != "xn--bcher-kva.example" {
+		t.Error("unexpected ascii form", a.HostASCII())
+	}
+	if a.HostUnicode() != "bücher.example" {
+		t.Error("unexpected unicode form", a.HostUnicode())
+	}
+
+	a, err := NewAddress("test@XN--BCHER-KVA.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Host != "xn--bcher-kva.example" || a.HostUnicode() != "bücher.example" {
+		t.Error("expecting the punycode form to be normalized, got", a.Host, a.HostUnicode())
+	}
+}
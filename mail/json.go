@@ -0,0 +1,104 @@
+package mail
+
+import (
+	"encoding/json"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// EnvelopeJSONVersion is the version of the JSON of an Envelope, see MarshalJSON. It's incremented
+// when a field is removed or changes its meaning, new fields may be added to the same version
+const EnvelopeJSONVersion = 1
+
+// jsonValues are the keys of Envelope.Values included in the JSON, see RegisterJSONValues
+var jsonValues = struct {
+	sync.RWMutex
+	keys map[string]bool
+}{keys: map[string]bool{
+	"listener":         true,
+	"reputation_score": true,
+	"reputation_tag":   true,
+	"geoip_country":    true,
+	"geoip_continent":  true,
+	"geoip_asn":        true,
+	"geoip_asn_org":    true,
+}}
+
+// RegisterJSONValues adds the keys of Envelope.Values to include in the JSON of the envelopes.
+// The values are not included by default, as they may hold anything, such as connections or large buffers.
+// The values of the keys must be marshalable to JSON. A processor usually registers its keys in its init
+func RegisterJSONValues(keys ...string) {
+	jsonValues.Lock()
+	defer jsonValues.Unlock()
+	for _, key := range keys {
+		jsonValues.keys[key] = true
+	}
+}
+
+// envelopeJSON is the JSON of an Envelope
+type envelopeJSON struct {
+	Version    int                    `json:"version"`
+	QueuedID   string                 `json:"queued_id"`
+	ClientID   uint64                 `json:"client_id"`
+	RemoteIP   string                 `json:"remote_ip"`
+	Helo       string                 `json:"helo"`
+	ESMTP      bool                   `json:"esmtp"`
+	TLS        bool                   `json:"tls"`
+	AuthUser   string                 `json:"auth_user,omitempty"`
+	MailFrom   string                 `json:"mail_from"`
+	MailParams ESMTPParams            `json:"mail_params,omitempty"`
+	RcptTo     []string               `json:"rcpt_to"`
+	RcptParams []ESMTPParams          `json:"rcpt_params,omitempty"`
+	Subject    string                 `json:"subject,omitempty"`
+	Header     textproto.MIMEHeader   `json:"header,omitempty"`
+	Size       int64                  `json:"size"`
+	Route      string                 `json:"route,omitempty"`
+	Tags       map[string]string      `json:"tags,omitempty"`
+	Values     map[string]interface{} `json:"values,omitempty"`
+	// Received is when the message was read, omitted before
+	Received *time.Time `json:"received,omitempty"`
+}
+
+// MarshalJSON returns the JSON of the envelope, for the processors that send envelopes to other systems.
+// It has the addresses, the ESMTP parameters, the parsed header (if ParseHeaders was called) and the values
+// registered with RegisterJSONValues, but not the message data. MailFrom is empty for the null sender.
+// The "version" field is EnvelopeJSONVersion
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	j := envelopeJSON{
+		Version:    EnvelopeJSONVersion,
+		QueuedID:   e.QueuedId,
+		ClientID:   e.ClientID,
+		RemoteIP:   e.RemoteIP,
+		Helo:       e.Helo,
+		ESMTP:      e.ESMTP,
+		TLS:        e.TLS,
+		AuthUser:   e.AuthUser,
+		MailFrom:   e.MailFrom.String(),
+		MailParams: e.MailParams,
+		RcptTo:     make([]string, len(e.RcptTo)),
+		RcptParams: e.RcptParams,
+		Subject:    e.Subject,
+		Header:     e.Header,
+		Size:       int64(e.Len()),
+		Route:      e.Route,
+		Tags:       e.Tags,
+	}
+	if !e.Timings.DataEnd.IsZero() {
+		j.Received = &e.Timings.DataEnd
+	}
+	for i := range e.RcptTo {
+		j.RcptTo[i] = e.RcptTo[i].String()
+	}
+	jsonValues.RLock()
+	for key, val := range e.Values {
+		if jsonValues.keys[key] {
+			if j.Values == nil {
+				j.Values = make(map[string]interface{})
+			}
+			j.Values[key] = val
+		}
+	}
+	jsonValues.RUnlock()
+	return json.Marshal(&j)
+}
@@ -0,0 +1,49 @@
+package mail
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEnvelopeMarshalJSON(t *testing.T) {
+	e := NewEnvelope("127.0.0.1", 42)
+	e.Helo = "client.example.com"
+	e.ESMTP = true
+	e.MailFrom = Address{NullPath: true}
+	e.MailParams = ESMTPParams{"SIZE": "10"}
+	e.PushRcpt(Address{User: "test", Host: "example.com"})
+	e.Data.WriteString("Subject: test\n\nHello\n")
+	if err := e.ParseHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	e.Values["listener"] = "127.0.0.1:25"
+	e.Values["secret"] = "not included"
+	RegisterJSONValues("custom")
+	e.Values["custom"] = []int{1, 2}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j map[string]interface{}
+	if err := json.Unmarshal(b, &j); err != nil {
+		t.Fatal(err)
+	}
+	if j["version"] != float64(EnvelopeJSONVersion) || j["queued_id"] != e.QueuedId || j["mail_from"] != "" ||
+		j["helo"] != "client.example.com" || j["subject"] != "test" || j["size"] != float64(21) {
+		t.Error("unexpected JSON", string(b))
+	}
+	if rcpts, ok := j["rcpt_to"].([]interface{}); !ok || len(rcpts) != 1 || rcpts[0] != "test@example.com" {
+		t.Error("unexpected recipients", j["rcpt_to"])
+	}
+	if params, ok := j["mail_params"].(map[string]interface{}); !ok || params["SIZE"] != "10" {
+		t.Error("unexpected parameters", j["mail_params"])
+	}
+	if _, ok := j["received"]; ok {
+		t.Error("expecting no time of receipt before the message was read")
+	}
+	values, ok := j["values"].(map[string]interface{})
+	if !ok || len(values) != 2 || values["listener"] != "127.0.0.1:25" || values["custom"] == nil {
+		t.Error("expecting only the registered values, got", j["values"])
+	}
+}
@@ -0,0 +1,93 @@
+package mail
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// IDGenerator returns a new queued id for an envelope.
+// clientID is the id of the client that the envelope was borrowed for
+type IDGenerator func(clientID uint64) string
+
+var idGenerator atomic.Value
+
+func init() {
+	idGenerator.Store(IDGenerator(MD5ID))
+}
+
+// SetIDGenerator sets the function used to generate Envelope.QueuedId for all envelopes in the process.
+// Passing nil restores the default, MD5ID
+func SetIDGenerator(g IDGenerator) {
+	if g == nil {
+		g = MD5ID
+	}
+	idGenerator.Store(g)
+}
+
+func queuedID(clientID uint64) string {
+	return idGenerator.Load().(IDGenerator)(clientID)
+}
+
+// MD5ID is the default generator, a hex encoded md5 of the time and client id
+func MD5ID(clientID uint64) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(string(time.Now().Unix())+string(clientID))))
+}
+
+// crockford is the base32 alphabet used by ULID
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID generates a Universally Unique Lexicographically Sortable Identifier,
+// 26 characters that sort in the order they were created (to the millisecond)
+func ULID(clientID uint64) string {
+	var b [16]byte
+	putMillis(b[:6], time.Now())
+	_, _ = rand.Read(b[6:])
+	return encodeULID(b)
+}
+
+func encodeULID(b [16]byte) string {
+	// encode 128 bits as 26 base32 characters, the first character takes the 3 top bits
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// UUIDv7 generates a time-ordered UUID version 7 (RFC 9562), in the canonical hex form
+func UUIDv7(clientID uint64) string {
+	var b [16]byte
+	putMillis(b[:6], time.Now())
+	_, _ = rand.Read(b[6:])
+	b[6] = b[6]&0x0f | 0x70 // version 7
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+	var out [36]byte
+	hex.Encode(out[0:8], b[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], b[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], b[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], b[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], b[10:])
+	return string(out[:])
+}
+
+// putMillis writes the unix time in milliseconds as a 48-bit big-endian number
+func putMillis(b []byte, t time.Time) {
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
@@ -0,0 +1,54 @@
+package mail
+
+import (
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestULID(t *testing.T) {
+	re := regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id := ULID(1)
+		if !re.MatchString(id) {
+			t.Error("invalid ulid:", id)
+		}
+		ids = append(ids, id)
+		time.Sleep(2 * time.Millisecond)
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Error("ulids are not sortable", ids)
+	}
+	// timestamp taken from the example in the ULID spec
+	var b [16]byte
+	putMillis(b[:6], time.Unix(0, 1469918176385*int64(time.Millisecond)))
+	if id := encodeULID(b); id[:10] != "01ARYZ6S41" {
+		t.Error("expecting timestamp 01ARYZ6S41, got", id[:10])
+	}
+}
+
+func TestUUIDv7(t *testing.T) {
+	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	id := UUIDv7(1)
+	if !re.MatchString(id) {
+		t.Error("invalid uuid v7:", id)
+	}
+}
+
+func TestSetIDGenerator(t *testing.T) {
+	defer SetIDGenerator(nil)
+	SetIDGenerator(func(clientID uint64) string {
+		return "test-id"
+	})
+	e := NewEnvelope("127.0.0.1", 1)
+	if e.QueuedId != "test-id" {
+		t.Error("expecting test-id, got", e.QueuedId)
+	}
+	SetIDGenerator(nil)
+	e.Reseed("127.0.0.1", 2)
+	if len(e.QueuedId) != 32 {
+		t.Error("expecting md5 id, got", e.QueuedId)
+	}
+}
@@ -174,7 +174,11 @@ func (s *RFC5322) displayName() error {
 // quotedString consumes a quoted-string production
 func (s *RFC5322) quotedString() error {
 	if s.ch == '"' {
-		if err := s.Parser.QcontentSMTP(); err != nil {
+		// QcontentSMTP flags the local-part as quoted, but this is the display name
+		localPartQuotes := s.LocalPartQuotes
+		err := s.Parser.QcontentSMTP()
+		s.LocalPartQuotes = localPartQuotes
+		if err != nil {
 			return err
 		}
 		if s.ch != '"' {
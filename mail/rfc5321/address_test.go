@@ -57,6 +57,20 @@ func TestParseRFC5322IP(t *testing.T) {
 	}
 }
 
+func TestParseRFC5322QuotedDisplayName(t *testing.T) {
+	var s RFC5322
+	// the quoted display name should not make the local-part quoted
+	if a, err := s.Address([]byte("\"Doe, John\" <john@example.com>")); err != nil {
+		t.Error(err)
+	} else if len(a.List) != 1 {
+		t.Error("expecting 1 address, but got", len(a.List))
+	} else if a.List[0].LocalPartQuoted {
+		t.Error(".List[0].LocalPartQuoted is true, expecting false")
+	} else if a.List[0].DisplayName != "Doe, John" {
+		t.Error("expecting display name 'Doe, John', got", a.List[0].DisplayName)
+	}
+}
+
 func TestParseRFC5322Group(t *testing.T) {
 	// A Group:Ed Jones <c@a.test>,joe@where.test,John <jdoe@one.test>;
 	var s RFC5322
@@ -82,3 +96,13 @@ func TestParseRFC5322Group(t *testing.T) {
 
 	}
 }
+
+// found by FuzzAddressParser: input ending with an atext char would never return
+func TestParseRFC5322Unterminated(t *testing.T) {
+	var s RFC5322
+	for _, str := range []string{"a", "\"", "=?", "a b", "a:b"} {
+		if _, err := s.Address([]byte(str)); err == nil {
+			t.Error("expecting an error for", str)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//go:build go1.18
+// +build go1.18
+
+package rfc5321
+
+import (
+	"testing"
+)
+
+// FuzzAddressParser runs the RFC5322 address parser with random input. Run with
+// go test -fuzz=FuzzAddressParser ./mail/rfc5321
+func FuzzAddressParser(f *testing.F) {
+	seeds := []string{
+		"\"Mike Jones\" <test@tdomain.com>",
+		"test@tdomain.com",
+		"=?ISO-8859-1?Q?Andr=E9?= =?ISO-8859-1?Q?Andr=E9?= <test@tdomain.com>",
+		"\"Mike Jones\" <\"testing 123\"@[IPv6:IPv6:2001:db8::1]>",
+		"\"Mike Jones\" <\"testing 123\"@[IPv6:2001:db8::1]>",
+		"A Group:Ed Jones <c@a.test>,joe@where.test,John <jdoe@one.test>;",
+		"Undisclosed recipients:;",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		var s RFC5322
+		_, _ = s.Address(input)
+	})
+}
+
+// FuzzPathParser runs the MAIL FROM and RCPT TO path parsers with random input
+func FuzzPathParser(f *testing.F) {
+	seeds := []string{
+		"<Postmaster>",
+		"<Postmaster@example.com> NOTIFY=SUCCESS,FAILURE",
+		"<>",
+		"<@a,@b:user@[227.0.0.1]> SIZE=2000 BODY=8BITMIME",
+		"<\"  yo-- man wazz'''up? surprise \\surprise, this is POSSIBLE@fake.com \"@example.com>",
+		"<u\xfd\xfdrU\x10c22695140\xfd727235530 Walter Sobchak\x1a\tDonny, x_6_, Donnyre   \t\t outof89 !om>",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		var s Parser
+		_ = s.MailFrom(input)
+		s.Reset()
+		_ = s.RcptTo(input)
+		s.Reset()
+		_, _, _ = s.Ehlo(input)
+		_, _ = s.Helo(input)
+	})
+}
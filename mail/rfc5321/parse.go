@@ -72,6 +72,8 @@ func (s *Parser) next() byte {
 		s.ch = s.buf[s.pos]
 		return s.ch
 	}
+	// past the end, so that productions looping on s.ch will stop
+	s.ch = 0
 	return 0
 }
 
@@ -88,6 +90,7 @@ func (s *Parser) reversePath() (err error) {
 	}
 	if i := bytes.Index(s.buf[s.pos+1:], []byte{'<', '>'}); i == 0 {
 		s.NullPath = true
+		s.next() // the '<', the caller skips the '>' before the parameters
 		return nil
 	}
 	if err = s.path(); err != nil {
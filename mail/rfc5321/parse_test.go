@@ -67,6 +67,19 @@ func TestParseRcptTo(t *testing.T) {
 
 }
 
+func TestParseMailFromNullPath(t *testing.T) {
+	var s Parser
+	if err := s.MailFrom([]byte("<> SIZE=1024 BODY=8BITMIME")); err != nil {
+		t.Error("error not expected ", err)
+	}
+	if !s.NullPath {
+		t.Error("expecting the null path")
+	}
+	if len(s.PathParams) != 2 || s.PathParams[0][0] != "SIZE" || s.PathParams[0][1] != "1024" {
+		t.Error("expecting the parameters of the null path, got", s.PathParams)
+	}
+}
+
 func TestParseForwardPath(t *testing.T) {
 	s := NewParser([]byte("<@a,@b:user@[227.0.0.1>")) // missing ]
 	err := s.forwardPath()
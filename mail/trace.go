@@ -0,0 +1,50 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Trace is what the header of a message tells of the way it came
+type Trace struct {
+	// Hops is the number of Received header fields
+	Hops int
+	// DeliveredTo are the values of the Delivered-To header fields, in the order they appeared
+	DeliveredTo []string
+}
+
+// ReadTrace reads the header of the message from r, up to the empty line that ends it, and returns its
+// trace fields. At most limit bytes are read, the whole header if limit is 0
+func ReadTrace(r io.Reader, limit int64) Trace {
+	if limit > 0 {
+		r = io.LimitReader(r, limit)
+	}
+	br := bufio.NewReader(r)
+	var t Trace
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// end of the header
+			return t
+		}
+		if i := bytes.IndexByte(line, ':'); i > 0 && line[0] != ' ' && line[0] != '\t' {
+			switch name := string(bytes.TrimSpace(line[:i])); {
+			case strings.EqualFold(name, "Received"):
+				t.Hops++
+			case strings.EqualFold(name, "Delivered-To") && err != bufio.ErrBufferFull:
+				t.DeliveredTo = append(t.DeliveredTo, string(bytes.TrimSpace(line[i+1:])))
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			// a long line, skip the rest of it
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+		}
+		if err != nil {
+			return t
+		}
+	}
+}
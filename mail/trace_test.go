@@ -0,0 +1,22 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadTrace(t *testing.T) {
+	header := "Received: from a\r\n\tby b\r\nDelivered-To: test@example.com\r\n" +
+		"X-Long: " + strings.Repeat("x", 8192) + "\r\nreceived: from c\r\n\r\nReceived: in the body\r\n"
+	trace := ReadTrace(strings.NewReader(header), 0)
+	if trace.Hops != 2 {
+		t.Error("expecting 2 hops, got", trace.Hops)
+	}
+	if len(trace.DeliveredTo) != 1 || trace.DeliveredTo[0] != "test@example.com" {
+		t.Error("unexpected Delivered-To", trace.DeliveredTo)
+	}
+	// the header is cut after the first Received field
+	if trace := ReadTrace(strings.NewReader(header), 30); trace.Hops != 1 || trace.DeliveredTo != nil {
+		t.Error("expecting a hop only, got", trace)
+	}
+}
@@ -0,0 +1,128 @@
+// Package metrics records counters, gauges and timings about the daemon, eg. connections and messages.
+// Metrics are sent to the Recorder passed to Set, they are discarded until a Recorder is set.
+// Tags are given as "key:value" strings, a Recorder that does not support tags ignores them.
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Names of the core metrics
+const (
+	// Connections counts the accepted connections, tagged with the listener
+	Connections = "connections"
+	// ActiveClients is a gauge of the clients connected to a listener
+	ActiveClients = "clients.active"
+	// MessagesAccepted counts the messages saved by the backend, tagged with the listener
+	MessagesAccepted = "messages.accepted"
+	// MessagesRejected counts the messages that were not saved, tagged with the listener
+	MessagesRejected = "messages.rejected"
+	// MessagesDeferred counts the messages deferred with a 4xx reply, tagged with the listener and
+	// the reason, eg. "reason:data_budget", see guerrilla.MessageEvent
+	MessagesDeferred = "messages.deferred"
+	// MessageBytes counts the bytes of DATA received, tagged with the listener
+	MessageBytes = "messages.bytes"
+	// RecipientsRejected counts the recipients rejected by the backend, tagged with the listener
+	RecipientsRejected = "recipients.rejected"
+	// SaveTime is how long the backend took to save a message, tagged with the listener
+	SaveTime = "backend.save_time"
+	// BackendPanics counts the panics of the processors recovered by the backend's workers, tagged with the stack
+	BackendPanics = "backend.panics"
+	// BackendFallbacks counts the messages saved by save_process_fallback, after save_process failed
+	BackendFallbacks = "backend.fallbacks"
+	// DNSCacheHits counts the DNS lookups answered from the cache, tagged with the query type
+	DNSCacheHits = "dns.cache_hits"
+	// DNSCacheMisses counts the DNS lookups sent to the resolvers, tagged with the query type
+	DNSCacheMisses = "dns.cache_misses"
+	// DNSErrors counts the DNS lookups that failed, not counting the names that do not exist
+	DNSErrors = "dns.errors"
+	// DNSLookupTime is how long the resolvers took to answer, tagged with the query type
+	DNSLookupTime = "dns.lookup_time"
+	// RetentionExpired counts the stored messages deleted or archived by the retention rules,
+	// tagged with the store and the action
+	RetentionExpired = "retention.expired"
+	// RetentionErrors counts the stored messages that the retention rules failed to expire, tagged with the store
+	RetentionErrors = "retention.errors"
+	// MXChecks counts the sender domains checked by the mxcheck processor, tagged with the result
+	MXChecks = "mx_check.results"
+	// Callouts counts the senders verified by the callout processor, tagged with the result
+	Callouts = "callout.results"
+	// AutoReplies counts the messages the autoreply processor replied to, or not, tagged with the result
+	AutoReplies = "autoreply.results"
+	// OutboundDelivered counts the recipients of the outbound queue accepted by their MX
+	OutboundDelivered = "outbound.delivered"
+	// OutboundDeferred counts the recipients of the outbound queue deferred by their MX, or not reached
+	OutboundDeferred = "outbound.deferred"
+	// OutboundFailed counts the recipients of the outbound queue rejected by their MX, or expired
+	OutboundFailed = "outbound.failed"
+	// OutboundBounces counts the bounces queued to the senders of the outbound queue
+	OutboundBounces = "outbound.bounces"
+	// EventsDropped counts the client, message and backend events that were not passed to a handler
+	// because too many were waiting for it, tagged with the event
+	EventsDropped = "events.dropped"
+)
+
+// Recorder receives the metrics
+type Recorder interface {
+	// Count adds value to a counter
+	Count(name string, value int64, tags ...string)
+	// Gauge sets the current value of a gauge
+	Gauge(name string, value float64, tags ...string)
+	// Timing records how long something took
+	Timing(name string, d time.Duration, tags ...string)
+}
+
+// holder lets a Recorder be stored in an atomic.Value, which needs the same concrete type every time
+type holder struct {
+	Recorder
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) Count(string, int64, ...string)          {}
+func (nopRecorder) Gauge(string, float64, ...string)        {}
+func (nopRecorder) Timing(string, time.Duration, ...string) {}
+
+var recorder atomic.Value
+
+func init() {
+	Set(nil)
+}
+
+// Set sets where the metrics go, nil discards them
+func Set(r Recorder) {
+	if r == nil {
+		r = nopRecorder{}
+	}
+	recorder.Store(holder{r})
+}
+
+func get() Recorder {
+	return recorder.Load().(holder).Recorder
+}
+
+// Count adds value to a counter
+func Count(name string, value int64, tags ...string) {
+	get().Count(name, value, tags...)
+}
+
+// Incr adds 1 to a counter
+func Incr(name string, tags ...string) {
+	get().Count(name, 1, tags...)
+}
+
+// Gauge sets the current value of a gauge
+func Gauge(name string, value float64, tags ...string) {
+	get().Gauge(name, value, tags...)
+}
+
+// Timing records how long something took
+func Timing(name string, d time.Duration, tags ...string) {
+	get().Timing(name, d, tags...)
+}
+
+// Since records the time elapsed since start
+func Since(name string, start time.Time, tags ...string) {
+	get().Timing(name, time.Since(start), tags...)
+}
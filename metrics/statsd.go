@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+const (
+	// ExporterStatsD sends the metrics to a StatsD server, without tags
+	ExporterStatsD = "statsd"
+	// ExporterDogStatsD sends the metrics to a Datadog agent (DogStatsD), with tags
+	ExporterDogStatsD = "dogstatsd"
+)
+
+const (
+	defaultAddress       = "127.0.0.1:8125"
+	defaultPrefix        = "guerrilla"
+	defaultFlushInterval = 10 * time.Second
+	// keep the packets under the usual MTU, so that they are not fragmented
+	maxPacketSize = 1432
+	// timings recorded between flushes, more are dropped
+	maxTimings = 10000
+)
+
+// Config configures the metrics emitter. Metrics are disabled when Exporter is empty
+type Config struct {
+	// Exporter is "statsd" or "dogstatsd"
+	Exporter string `json:"exporter,omitempty"`
+	// Address is the host:port of the StatsD server (UDP), defaults to 127.0.0.1:8125
+	Address string `json:"address,omitempty"`
+	// Prefix is prepended to the metric names, followed by a dot. Defaults to "guerrilla"
+	Prefix string `json:"prefix,omitempty"`
+	// Tags are added to all the metrics, only sent by the dogstatsd exporter
+	Tags map[string]string `json:"tags,omitempty"`
+	// FlushInterval is how often the metrics are sent, eg. "10s" (the default)
+	FlushInterval string `json:"flush_interval,omitempty"`
+}
+
+// Validate checks the config, an empty config is valid (metrics disabled)
+func (c *Config) Validate() error {
+	switch c.Exporter {
+	case "":
+		return nil
+	case ExporterStatsD, ExporterDogStatsD:
+	default:
+		return fmt.Errorf("unknown metrics exporter [%s], use %s or %s", c.Exporter, ExporterStatsD, ExporterDogStatsD)
+	}
+	if c.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return fmt.Errorf("metrics address [%s] is invalid: %s", c.Address, err)
+		}
+	}
+	if c.FlushInterval != "" {
+		if d, err := time.ParseDuration(c.FlushInterval); err != nil || d <= 0 {
+			return fmt.Errorf("metrics flush_interval [%s] must be a positive duration, eg. 10s", c.FlushInterval)
+		}
+	}
+	for k := range c.Tags {
+		if k == "" || strings.ContainsAny(k, ":,|#") {
+			return fmt.Errorf("metrics tag [%s] is invalid", k)
+		}
+	}
+	return nil
+}
+
+// metricKey identifies a metric by name and tags
+type metricKey struct {
+	name string
+	// tags formatted for the packet, eg. "|#server:127.0.0.1:25,env:prod", or empty
+	tags string
+}
+
+// StatsD aggregates the metrics and sends them to a StatsD server every flush interval.
+// Counters are summed and gauges keep their last value. All the methods can be called on a nil *StatsD
+type StatsD struct {
+	conn     net.Conn
+	prefix   string
+	tags     []string
+	withTags bool
+	log      log.Logger
+
+	mu       sync.Mutex
+	counters map[metricKey]int64
+	gauges   map[metricKey]float64
+	timings  map[metricKey][]float64
+	nTimings int
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns a StatsD emitter for the config, or nil if metrics are disabled.
+// Errors while sending are logged to l
+func New(c Config, l log.Logger) (*StatsD, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Exporter == "" {
+		return nil, nil
+	}
+	address := c.Address
+	if address == "" {
+		address = defaultAddress
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the metrics server [%s]: %s", address, err)
+	}
+	interval := defaultFlushInterval
+	if c.FlushInterval != "" {
+		interval, _ = time.ParseDuration(c.FlushInterval)
+	}
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	if !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	s := &StatsD{
+		conn:     conn,
+		prefix:   prefix,
+		withTags: c.Exporter == ExporterDogStatsD,
+		log:      l,
+		counters: make(map[metricKey]int64),
+		gauges:   make(map[metricKey]float64),
+		timings:  make(map[metricKey][]float64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for k, v := range c.Tags {
+		s.tags = append(s.tags, k+":"+v)
+	}
+	sort.Strings(s.tags)
+	go s.run(interval)
+	return s, nil
+}
+
+// Count adds value to a counter
+func (s *StatsD) Count(name string, value int64, tags ...string) {
+	if s == nil {
+		return
+	}
+	k := s.key(name, tags)
+	s.mu.Lock()
+	s.counters[k] += value
+	s.mu.Unlock()
+}
+
+// Gauge sets the current value of a gauge
+func (s *StatsD) Gauge(name string, value float64, tags ...string) {
+	if s == nil {
+		return
+	}
+	k := s.key(name, tags)
+	s.mu.Lock()
+	s.gauges[k] = value
+	s.mu.Unlock()
+}
+
+// Timing records how long something took, sent in milliseconds
+func (s *StatsD) Timing(name string, d time.Duration, tags ...string) {
+	if s == nil {
+		return
+	}
+	k := s.key(name, tags)
+	s.mu.Lock()
+	if s.nTimings < maxTimings {
+		s.timings[k] = append(s.timings[k], float64(d)/float64(time.Millisecond))
+		s.nTimings++
+	}
+	s.mu.Unlock()
+}
+
+// Close sends the remaining metrics and stops the emitter
+func (s *StatsD) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	return s.conn.Close()
+}
+
+func (s *StatsD) key(name string, tags []string) metricKey {
+	k := metricKey{name: s.prefix + name}
+	if !s.withTags || len(tags)+len(s.tags) == 0 {
+		return k
+	}
+	all := make([]string, 0, len(tags)+len(s.tags))
+	all = append(all, tags...)
+	all = append(all, s.tags...)
+	k.tags = "|#" + strings.Join(all, ",")
+	return k
+}
+
+func (s *StatsD) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush sends the metrics aggregated since the last flush. Gauges are sent every time
+func (s *StatsD) flush() {
+	s.mu.Lock()
+	counters, timings := s.counters, s.timings
+	s.counters = make(map[metricKey]int64, len(counters))
+	s.timings = make(map[metricKey][]float64, len(timings))
+	s.nTimings = 0
+	lines := make([]string, 0, len(counters)+len(s.gauges)+len(timings))
+	for k, v := range counters {
+		lines = append(lines, k.name+":"+strconv.FormatInt(v, 10)+"|c"+k.tags)
+	}
+	for k, v := range s.gauges {
+		lines = append(lines, k.name+":"+strconv.FormatFloat(v, 'f', -1, 64)+"|g"+k.tags)
+	}
+	s.mu.Unlock()
+	for k, values := range timings {
+		for _, v := range values {
+			lines = append(lines, k.name+":"+strconv.FormatFloat(v, 'f', -1, 64)+"|ms"+k.tags)
+		}
+	}
+	if err := s.send(lines); err != nil && s.log != nil {
+		s.log.WithError(err).Warn("could not send metrics")
+	}
+}
+
+// send writes the lines to the server, as many lines in each packet as will fit
+func (s *StatsD) send(lines []string) error {
+	var packet bytes.Buffer
+	var err error
+	write := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, writeErr := s.conn.Write(packet.Bytes()); writeErr != nil {
+			err = writeErr
+		}
+		packet.Reset()
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			write()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	write()
+	return err
+}
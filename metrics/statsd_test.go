@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receive reads the packets sent to conn until no more arrive, and returns their lines sorted
+func receive(t *testing.T, conn net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n > maxPacketSize {
+			t.Error("packet is bigger than", maxPacketSize)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	s, err := New(Config{Exporter: ExporterStatsD, Address: conn.LocalAddr().String(), Prefix: "mx"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Set(s)
+	defer Set(nil)
+	Incr(Connections, "listener:127.0.0.1:25")
+	Count(Connections, 2, "listener:127.0.0.1:25")
+	Gauge(ActiveClients, 3)
+	Timing(SaveTime, 1500*time.Microsecond)
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+	expect := []string{"mx.backend.save_time:1.5|ms", "mx.clients.active:3|g", "mx.connections:3|c"}
+	if got := receive(t, conn); strings.Join(got, " ") != strings.Join(expect, " ") {
+		t.Error("expecting", expect, "got", got)
+	}
+}
+
+func TestDogStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	s, err := New(Config{
+		Exporter: ExporterDogStatsD,
+		Address:  conn.LocalAddr().String(),
+		Tags:     map[string]string{"env": "test"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Count(MessagesAccepted, 1, "listener:a")
+	s.Count(MessagesAccepted, 1, "listener:b")
+	// enough metrics to need more than one packet
+	for i := 0; i < 100; i++ {
+		s.Timing(SaveTime, time.Millisecond, "listener:a")
+	}
+	_ = s.Close()
+	got := receive(t, conn)
+	if len(got) != 102 {
+		t.Fatal("expecting 102 lines, got", len(got))
+	}
+	if got[0] != "guerrilla.backend.save_time:1|ms|#listener:a,env:test" ||
+		got[100] != "guerrilla.messages.accepted:1|c|#listener:a,env:test" ||
+		got[101] != "guerrilla.messages.accepted:1|c|#listener:b,env:test" {
+		t.Error("unexpected lines", got[0], got[100], got[101])
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{Exporter: ExporterStatsD},
+		{Exporter: ExporterDogStatsD, Address: "localhost:8125", FlushInterval: "1s", Tags: map[string]string{"env": "prod"}},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("expecting %+v to be valid: %s", c, err)
+		}
+	}
+	for _, c := range []Config{
+		{Exporter: "graphite"},
+		{Exporter: ExporterStatsD, Address: "localhost"},
+		{Exporter: ExporterStatsD, FlushInterval: "10"},
+		{Exporter: ExporterDogStatsD, Tags: map[string]string{"a:b": "c"}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expecting %+v to be invalid", c)
+		}
+	}
+	var s *StatsD
+	// a disabled emitter does nothing
+	s.Count(Connections, 1)
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
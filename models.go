@@ -2,6 +2,7 @@ package guerrilla
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
 )
@@ -9,8 +10,61 @@ import (
 var (
 	LineLimitExceeded   = errors.New("maximum line length exceeded")
 	MessageSizeExceeded = errors.New("maximum message size exceeded")
+	// BounceSizeExceeded is returned when a message from the null sender is larger than null_sender_max_size
+	BounceSizeExceeded = errors.New("maximum bounce size exceeded")
+	// HopCountExceeded is returned when a message has more Received header fields than max_hops
+	HopCountExceeded = errors.New("too many hops")
+	// MailLoopDetected is returned when a message was already delivered to one of its recipients
+	MailLoopDetected = errors.New("mail forwarding loop detected")
+	// HeaderSizeExceeded is returned when the header of a message is larger than max_header_size
+	HeaderSizeExceeded = errors.New("maximum header size exceeded")
 )
 
+// headerReader limits the size of the header of a message, the data up to the first empty line.
+// Each client has one, it's reset for every DATA command
+type headerReader struct {
+	r   io.Reader
+	max int64
+	// read is the size of the header read so far
+	read int64
+	// prev is the last byte read, the header ends with two new lines in a row
+	prev byte
+	done bool
+}
+
+// reset makes hr limit the header read from r, the dot-reader of the DATA, to max bytes.
+// Returns r unwrapped when max is 0
+func (hr *headerReader) reset(r io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		hr.r = nil
+		return r
+	}
+	// a message may start with the empty line, when it has no header
+	hr.r, hr.max, hr.read, hr.prev, hr.done = r, max, 0, '\n', false
+	return hr
+}
+
+func (hr *headerReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	if hr.done {
+		return n, err
+	}
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' && hr.prev == '\n' {
+			hr.done = true
+			return n, err
+		}
+		if p[i] != '\r' {
+			hr.prev = p[i]
+		}
+		hr.read++
+		if hr.read > hr.max {
+			return i, HeaderSizeExceeded
+		}
+	}
+	return n, err
+}
+
 // we need to adjust the limit, so we embed io.LimitedReader
 type adjustableLimitedReader struct {
 	R *io.LimitedReader
@@ -56,9 +110,19 @@ func (sbr *smtpBufferedReader) Reset(r io.Reader) {
 	sbr.Reader.Reset(sbr.alr)
 }
 
-// Allocate a new SMTPBufferedReader
-func newSMTPBufferedReader(rd io.Reader) *smtpBufferedReader {
+// hasLine returns true if a whole line is buffered, so that it can be read without blocking
+func (sbr *smtpBufferedReader) hasLine() bool {
+	n := sbr.Buffered()
+	if n == 0 {
+		return false
+	}
+	buf, _ := sbr.Peek(n)
+	return bytes.IndexByte(buf, '\n') != -1
+}
+
+// Allocate a new SMTPBufferedReader, its bufio.Reader of the given size is borrowed from ioBuffers
+func newSMTPBufferedReader(rd io.Reader, size int) *smtpBufferedReader {
 	alr := newAdjustableLimitedReader(rd, CommandLineMaxLength)
-	s := &smtpBufferedReader{bufio.NewReader(alr), alr}
+	s := &smtpBufferedReader{ioBuffers.reader(alr, size), alr}
 	return s
 }
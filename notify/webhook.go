@@ -0,0 +1,309 @@
+// Package notify sends events about the mail flow to webhooks
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+// Events sent to the webhooks
+const (
+	// EventAccepted is sent when a message was accepted by the backend
+	EventAccepted = "message.accepted"
+	// EventRejected is sent when a message was rejected with a permanent (5xx) error
+	EventRejected = "message.rejected"
+	// EventDeferred is sent when a message was deferred with a transient (4xx) error
+	EventDeferred = "message.deferred"
+	// EventSaveFailed is sent when a message was received, but the backend did not accept it.
+	// It is sent instead of EventRejected or EventDeferred
+	EventSaveFailed = "message.save_failed"
+	// EventBounce is sent when an accepted message was a bounce or a complaint about a message sent earlier,
+	// see the BounceParser processor
+	EventBounce = "message.bounce"
+)
+
+// Headers of the requests
+const (
+	// HeaderEvent is the name of the event
+	HeaderEvent = "X-Guerrilla-Event"
+	// HeaderDelivery is the unique id of the delivery, it's the same for the retries
+	HeaderDelivery = "X-Guerrilla-Delivery"
+	// HeaderSignature is "sha256=" followed by the hex encoded HMAC-SHA256 of the body, keyed with the secret.
+	// Only sent if a secret is configured
+	HeaderSignature = "X-Guerrilla-Signature"
+)
+
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultMaxAttempts = 4
+	defaultQueueSize   = 1000
+	// how long to wait before the first retry, the wait doubles for each retry
+	defaultBackoff = time.Second
+	// how many deliveries are sent at the same time
+	workers = 4
+)
+
+var knownEvents = map[string]bool{
+	EventAccepted:   true,
+	EventRejected:   true,
+	EventDeferred:   true,
+	EventSaveFailed: true,
+	EventBounce:     true,
+}
+
+// Config configures the webhooks. They are disabled when URLs is empty
+type Config struct {
+	// URLs receive a POST request with a JSON Payload for each event
+	URLs []string `json:"urls,omitempty"`
+	// Secret signs the requests, see HeaderSignature
+	Secret string `json:"secret,omitempty"`
+	// Events to send, eg. ["message.accepted"]. All the events are sent if empty
+	Events []string `json:"events,omitempty"`
+	// Timeout of each request, eg. "10s" (the default)
+	Timeout string `json:"timeout,omitempty"`
+	// MaxAttempts is how many times a delivery is tried, 4 by default.
+	// Deliveries are retried after a network error, a 429 or a 5xx response
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// QueueSize is how many events can wait for delivery, more are dropped. 1000 by default
+	QueueSize int `json:"queue_size,omitempty"`
+}
+
+// Validate checks the config, an empty config is valid (webhooks disabled)
+func (c *Config) Validate() error {
+	for _, u := range c.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("webhook url [%s] is invalid, it must be an http or https url", u)
+		}
+	}
+	for _, e := range c.Events {
+		if !knownEvents[e] {
+			return fmt.Errorf("unknown webhook event [%s]", e)
+		}
+	}
+	if c.Timeout != "" {
+		if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("webhook timeout [%s] must be a positive duration, eg. 10s", c.Timeout)
+		}
+	}
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("webhook max_attempts [%d] cannot be negative", c.MaxAttempts)
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("webhook queue_size [%d] cannot be negative", c.QueueSize)
+	}
+	return nil
+}
+
+// Payload is the body of the requests
+type Payload struct {
+	// ID is the unique id of the delivery, also sent in HeaderDelivery
+	ID    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Data describes the event, eg. the message
+	Data interface{} `json:"data"`
+}
+
+// delivery is a payload waiting to be sent
+type delivery struct {
+	id    string
+	event string
+	body  []byte
+}
+
+// Notifier sends the events to the webhooks in the background, retrying failed deliveries.
+// All the methods can be called on a nil *Notifier
+type Notifier struct {
+	urls        []string
+	secret      []byte
+	events      map[string]bool
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	log         log.Logger
+
+	queue     chan delivery
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// New returns a Notifier for the config, or nil if the webhooks are disabled.
+// Failed deliveries are logged to l
+func New(c Config, l log.Logger) (*Notifier, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if len(c.URLs) == 0 {
+		return nil, nil
+	}
+	timeout := defaultTimeout
+	if c.Timeout != "" {
+		timeout, _ = time.ParseDuration(c.Timeout)
+	}
+	n := &Notifier{
+		urls:        c.URLs,
+		secret:      []byte(c.Secret),
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: c.MaxAttempts,
+		backoff:     defaultBackoff,
+		log:         l,
+		queue:       make(chan delivery, defaultQueueSize),
+		stop:        make(chan struct{}),
+	}
+	if n.maxAttempts == 0 {
+		n.maxAttempts = defaultMaxAttempts
+	}
+	if c.QueueSize > 0 {
+		n.queue = make(chan delivery, c.QueueSize)
+	}
+	if len(c.Events) > 0 {
+		n.events = make(map[string]bool, len(c.Events))
+		for _, e := range c.Events {
+			n.events[e] = true
+		}
+	}
+	n.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go n.run()
+	}
+	return n, nil
+}
+
+// Notify queues the event for delivery, data is marshalled to JSON.
+// It does not block: the event is dropped if the queue is full
+func (n *Notifier) Notify(event string, data interface{}) {
+	if n == nil || (n.events != nil && !n.events[event]) {
+		return
+	}
+	d := delivery{id: newID(), event: event}
+	var err error
+	d.body, err = json.Marshal(Payload{ID: d.id, Event: event, Time: time.Now(), Data: data})
+	if err != nil {
+		n.log.WithError(err).Errorf("could not marshal the webhook event [%s]", event)
+		return
+	}
+	select {
+	case <-n.stop:
+	case n.queue <- d:
+	default:
+		n.log.Warnf("webhook queue is full, dropped event [%s] %s", event, d.id)
+	}
+}
+
+// Close stops the notifier after trying to deliver the queued events once
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.closeOnce.Do(func() {
+		close(n.stop)
+		n.wg.Wait()
+	})
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for {
+		select {
+		case d := <-n.queue:
+			n.deliver(d)
+		case <-n.stop:
+			for {
+				select {
+				case d := <-n.queue:
+					n.deliver(d)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends d to each url, retrying with an exponential backoff until the notifier is closed
+func (n *Notifier) deliver(d delivery) {
+	for _, u := range n.urls {
+		wait := n.backoff
+		for attempt := 1; ; attempt++ {
+			retry, err := n.post(u, d)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= n.maxAttempts || n.stopped() {
+				n.log.WithError(err).Errorf("webhook [%s] failed to deliver event [%s] %s after %d attempts",
+					u, d.event, d.id, attempt)
+				break
+			}
+			select {
+			case <-time.After(wait):
+			case <-n.stop:
+			}
+			wait *= 2
+		}
+	}
+}
+
+// post sends d to u once, retry is true if the delivery should be tried again
+func (n *Notifier) post(u string, d delivery) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.event)
+	req.Header.Set(HeaderDelivery, d.id)
+	if len(n.secret) > 0 {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(n.secret, d.body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// drain the body so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected response: %s", resp.Status)
+}
+
+func (n *Notifier) stopped() bool {
+	select {
+	case <-n.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body keyed with secret,
+// receivers can compare it with the value of HeaderSignature after the "sha256=" prefix
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newID returns a random id for a delivery
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
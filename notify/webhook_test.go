@@ -0,0 +1,101 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := (&Config{}).Validate(); err != nil {
+		t.Error("an empty config should be valid", err)
+	}
+	for _, c := range []Config{
+		{URLs: []string{"ftp://example.com/"}},
+		{URLs: []string{"http://"}},
+		{URLs: []string{"http://example.com/"}, Events: []string{"message.lost"}},
+		{URLs: []string{"http://example.com/"}, Timeout: "soon"},
+		{URLs: []string{"http://example.com/"}, MaxAttempts: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expecting an error for %+v", c)
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	l, err := log.GetLogger(log.OutputOff.String(), "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var received []Payload
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			// the first delivery is retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if sig := r.Header.Get(HeaderSignature); sig != "sha256="+Sign([]byte("secret"), body) {
+			t.Errorf("bad signature %q", sig)
+		}
+		var p Payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error(err)
+		}
+		if p.Event != r.Header.Get(HeaderEvent) || p.ID != r.Header.Get(HeaderDelivery) {
+			t.Errorf("headers do not match the payload %+v", p)
+		}
+		received = append(received, p)
+	}))
+	defer srv.Close()
+
+	n, err := New(Config{
+		URLs:   []string{srv.URL},
+		Secret: "secret",
+		Events: []string{EventAccepted, EventSaveFailed},
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = 10 * time.Millisecond
+	n.Notify(EventAccepted, map[string]string{"queued_id": "abc"})
+	// not in the events of the config
+	n.Notify(EventRejected, map[string]string{"queued_id": "def"})
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		done := len(received) == 1
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.Close()
+	// notifying after Close does nothing
+	n.Notify(EventAccepted, nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 2 || len(received) != 1 {
+		t.Fatalf("expecting a retry and one delivery, got %d requests and %+v", requests, received)
+	}
+	if p := received[0]; p.Event != EventAccepted || p.Data.(map[string]interface{})["queued_id"] != "abc" {
+		t.Errorf("unexpected payload %+v", p)
+	}
+
+	var nilNotifier *Notifier
+	nilNotifier.Notify(EventAccepted, nil)
+	nilNotifier.Close()
+}
@@ -0,0 +1,557 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/dnscache"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/metrics"
+)
+
+// dnsResolver is the part of dnscache.Resolver used by the deliveries
+type dnsResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupTLSA(ctx context.Context, name string) ([]dnscache.TLSA, error)
+}
+
+// resolver returns the resolver of the MX and of the policies, replaced by the tests
+var resolver = func() dnsResolver {
+	return dnscache.Default()
+}
+
+// dial connects to the MX, replaced by the tests
+var dial = func(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// rootCAs verify the certificates of the MX when the MTA-STS policy is enforced, nil for the system's
+var rootCAs *x509.CertPool
+
+// errNullMX is returned for the domains that publish a null MX, they do not accept mail (RFC 7505)
+var errNullMX = errors.New("the domain does not accept mail, it has a null MX")
+
+// permanentError is an error of a domain that will not go away by retrying, its recipients fail
+type permanentError struct {
+	error
+}
+
+// tls levels of a connection
+const (
+	tlsNone = iota
+	// tlsOpportunistic is STARTTLS without verifying the certificate
+	tlsOpportunistic
+	// tlsVerified is STARTTLS with the certificate verified, by the root CAs or by DANE
+	tlsVerified
+)
+
+// deliver delivers the pending recipients of the item, domain by domain. The domains that cannot take
+// the message yet, because of their limits, are left for the next attempt
+func (q *Queue) deliver(it *item) {
+	q.mu.Lock()
+	s, l := q.settings, q.log
+	q.mu.Unlock()
+	byDomain := make(map[string][]*Recipient)
+	for _, r := range it.pending() {
+		d := strings.ToLower(r.Address[strings.LastIndexByte(r.Address, '@')+1:])
+		byDomain[d] = append(byDomain[d], r)
+	}
+	names := make([]string, 0, len(byDomain))
+	for d := range byDomain {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+	attempted := false
+	// wait is how long until the first of the domains left can take the message
+	var wait time.Duration
+	for _, d := range names {
+		ok, w := q.domains.acquire(d, q.now())
+		if ok {
+			w = q.deliverDomain(s, l, it, d, byDomain[d])
+			q.domains.release(d)
+		}
+		if w == 0 {
+			attempted = true
+		} else if wait == 0 || w < wait {
+			wait = w
+		}
+	}
+	// a message waiting for its domains is tried again when they can take it, it was not attempted
+	q.done(s, it, attempted, wait)
+}
+
+// deliverDomain delivers the item to the recipients of a domain, through the first of its MX that can be reached.
+// It returns how long to wait if no connection to the domain could be opened this minute, 0 if it was attempted.
+// The deliveries to the domain pause if its MX throttled them
+func (q *Queue) deliverDomain(s *settings, l log.Logger, it *item, domain string, rcpts []*Recipient) time.Duration {
+	// throttled is set if an MX replied 421 or 450, transacted if the transaction was done
+	var throttled, transacted bool
+	defer func() {
+		if throttled {
+			pause := q.domains.throttle(domain, q.now())
+			l.WithField("domain", domain).Infof("outbound queue: the MX throttled the deliveries, pausing for %s", pause)
+		} else if transacted {
+			q.domains.delivered(domain)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	hosts, err := mxHosts(ctx, domain)
+	var policy *stsPolicy
+	if err == nil && s.mtaSTS {
+		var stsErr *stsError
+		if policy, stsErr = q.sts.get(ctx, domain, q.now()); stsErr != nil {
+			l.WithError(stsErr).WithField("domain", domain).Debug("outbound queue: could not fetch the MTA-STS policy")
+			q.reportTLS(s, domain, "", nil, policy, nil, stsErr.result, stsErr)
+		}
+	}
+	cancel()
+	if err != nil {
+		q.unreached(rcpts, err)
+		return 0
+	}
+	for _, host := range hosts {
+		if (policy.enforced() || policy.testing()) && !policy.matches(host) {
+			err = fmt.Errorf("MX [%s] is not one of the MTA-STS policy of [%s]", host, domain)
+			q.reportTLS(s, domain, host, nil, policy, nil, resultValidationFailure, err)
+			if policy.enforced() {
+				continue
+			}
+		}
+		var c *conn
+		c, err = q.connect(s, domain, host, policy)
+		if limited, ok := err.(rateLimited); ok {
+			l.WithField("domain", domain).Debug("outbound queue: ", limited)
+			return limited.wait
+		}
+		if err != nil {
+			throttled = throttled || throttles(err)
+			l.WithError(err).WithField("mx", host).Debug("outbound queue: could not connect")
+			continue
+		}
+		err = q.transaction(s, c, it, rcpts)
+		throttled = throttled || c.throttled
+		if err != nil {
+			// the connection broke, the next MX may take the recipients not answered
+			c.close()
+			l.WithError(err).WithField("mx", host).Debug("outbound queue: delivery failed")
+			if rcpts = pendingOf(rcpts); len(rcpts) == 0 {
+				return 0
+			}
+			continue
+		}
+		q.conns.put(c, q.now())
+		q.record(l, it, host, rcpts)
+		transacted = true
+		return 0
+	}
+	if err == nil {
+		err = fmt.Errorf("no MX of [%s] could be reached", domain)
+	}
+	q.unreached(rcpts, err)
+	return 0
+}
+
+// mxHosts returns the hosts to deliver to for the domain, by preference. A domain without MX is its own MX,
+// a domain literal is delivered to its address
+func mxHosts(ctx context.Context, domain string) ([]string, error) {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		ip := strings.TrimPrefix(domain[1:len(domain)-1], "ipv6:")
+		if net.ParseIP(ip) == nil {
+			return nil, permanentError{fmt.Errorf("[%s] is not an address", domain)}
+		}
+		return []string{ip}, nil
+	}
+	r := resolver()
+	mxs, err := r.LookupMX(ctx, domain)
+	if err != nil && !dnscache.IsNotFound(err) {
+		return nil, err
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, permanentError{errNullMX}
+	}
+	if len(mxs) == 0 {
+		// the implicit MX, RFC 5321 5.1
+		if _, err := r.LookupHost(ctx, domain); err != nil {
+			if dnscache.IsNotFound(err) {
+				return nil, permanentError{fmt.Errorf("the domain [%s] does not exist", domain)}
+			}
+			return nil, err
+		}
+		return []string{domain}, nil
+	}
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.ToLower(strings.TrimSuffix(mx.Host, ".")))
+	}
+	return hosts, nil
+}
+
+// unreached sets the response of the recipients that could not be delivered to err. They fail if
+// err is permanent, or they are deferred
+func (q *Queue) unreached(rcpts []*Recipient, err error) {
+	deferred := 0
+	for _, r := range rcpts {
+		r.Response = err.Error()
+		if _, ok := err.(permanentError); ok {
+			r.Status = Failed
+		} else {
+			deferred++
+		}
+	}
+	metrics.Count(metrics.OutboundFailed, int64(len(rcpts)-deferred))
+	metrics.Count(metrics.OutboundDeferred, int64(deferred))
+}
+
+// record counts and logs the outcome of a transaction with host
+func (q *Queue) record(l log.Logger, it *item, host string, rcpts []*Recipient) {
+	var sent, failed, deferred int
+	for _, r := range rcpts {
+		switch r.Status {
+		case Sent:
+			sent++
+		case Failed:
+			failed++
+		default:
+			deferred++
+		}
+	}
+	metrics.Count(metrics.OutboundDelivered, int64(sent))
+	metrics.Count(metrics.OutboundFailed, int64(failed))
+	metrics.Count(metrics.OutboundDeferred, int64(deferred))
+	l.WithField("id", it.ID).WithField("mx", host).
+		Infof("outbound queue: %d recipients sent, %d failed, %d deferred", sent, failed, deferred)
+}
+
+func pendingOf(rcpts []*Recipient) []*Recipient {
+	var pending []*Recipient
+	for _, r := range rcpts {
+		if r.Status == Pending {
+			pending = append(pending, r)
+		}
+	}
+	return pending
+}
+
+// reply sets the status and the response of the recipient from the reply of the MX, it fails on a 5xx
+func (r *Recipient) reply(err *textproto.Error) {
+	r.Response = fmt.Sprintf("%d %s", err.Code, err.Msg)
+	if err.Code >= 500 {
+		r.Status = Failed
+	}
+}
+
+// replied records the reply of the MX to the recipients, and if the MX throttles the deliveries
+func (c *conn) replied(err *textproto.Error, rcpts ...*Recipient) {
+	for _, r := range rcpts {
+		r.reply(err)
+	}
+	if throttles(err) {
+		c.throttled = true
+	}
+}
+
+// transaction sends the item to the recipients over c. The replies of the MX are recorded in the recipients,
+// an error is returned if the connection broke
+func (q *Queue) transaction(s *settings, c *conn, it *item, rcpts []*Recipient) error {
+	c.throttled = false
+	_ = c.netConn.SetDeadline(time.Now().Add(s.timeout))
+	if err := c.Mail(it.From); err != nil {
+		tpErr, ok := err.(*textproto.Error)
+		if !ok {
+			return err
+		}
+		c.replied(tpErr, rcpts...)
+		return c.Reset()
+	}
+	var accepted []*Recipient
+	for _, r := range rcpts {
+		if err := c.Rcpt(r.Address); err != nil {
+			tpErr, ok := err.(*textproto.Error)
+			if !ok {
+				return err
+			}
+			c.replied(tpErr, r)
+			continue
+		}
+		accepted = append(accepted, r)
+	}
+	if len(accepted) == 0 {
+		return c.Reset()
+	}
+	f, err := os.Open(filepath.Join(s.dir, it.ID+".eml"))
+	if err != nil {
+		// the connection is fine, but the message is lost
+		for _, r := range accepted {
+			r.Status, r.Response = Failed, "the queued message could not be read: "+err.Error()
+		}
+		_ = c.Reset()
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+	w, err := c.Data()
+	if err != nil {
+		tpErr, ok := err.(*textproto.Error)
+		if !ok {
+			return err
+		}
+		c.replied(tpErr, accepted...)
+		return c.Reset()
+	}
+	if _, err = f.WriteTo(w); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		tpErr, ok := err.(*textproto.Error)
+		if !ok {
+			return err
+		}
+		c.replied(tpErr, accepted...)
+		return nil
+	}
+	for _, r := range accepted {
+		r.Status, r.Response = Sent, ""
+	}
+	return nil
+}
+
+// conn is a connection to an MX
+type conn struct {
+	*smtp.Client
+	netConn net.Conn
+	host    string
+	// tls is the tls level of the connection
+	tls       int
+	idleSince time.Time
+	// throttled is set if the MX replied 421 or 450 in the last transaction
+	throttled bool
+}
+
+func (c *conn) close() {
+	_ = c.netConn.SetDeadline(time.Now().Add(time.Second))
+	_ = c.Quit()
+	_ = c.Client.Close()
+}
+
+// connect returns a connection to host, one kept open if there is one. STARTTLS is used if the MX offers it,
+// the certificate is verified with the TLSA records of the host if it has some, or if the MTA-STS policy is
+// enforced. Without them, the connection falls back to plain text if the TLS handshake failed. The TLS sessions
+// are counted for the TLSRPT reports of the domain
+func (q *Queue) connect(s *settings, domain, host string, policy *stsPolicy) (*conn, error) {
+	var tlsa []dnscache.TLSA
+	if s.dane && net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), s.connectTimeout)
+		records, err := resolver().LookupTLSA(ctx, "_25._tcp."+host)
+		cancel()
+		if err != nil && !dnscache.IsNotFound(err) {
+			// the records may be hidden, RFC 7672 2.2
+			err = fmt.Errorf("could not look up the TLSA records of [%s]: %s", host, err)
+			q.reportTLS(s, domain, host, nil, policy, nil, resultDNSSECInvalid, err)
+			return nil, err
+		}
+		tlsa = usableTLSA(records)
+	}
+	verify := policy.enforced() || len(tlsa) > 0
+	// the certificate is verified in the testing mode of MTA-STS too, for the reports, but not required
+	testing := !verify && policy.testing()
+	// the tls level required, any connection kept will do without verification
+	level := tlsNone
+	if verify {
+		level = tlsVerified
+	}
+	for {
+		c := q.conns.get(host, level)
+		if c == nil {
+			break
+		}
+		_ = c.netConn.SetDeadline(time.Now().Add(s.timeout))
+		if c.Noop() == nil {
+			return c, nil
+		}
+		c.close()
+	}
+	if ok, wait := q.domains.connection(domain, q.now()); !ok {
+		return nil, rateLimited{wait}
+	}
+	report := func(c *conn, result string, err error) {
+		q.reportTLS(s, domain, host, c, policy, tlsa, result, err)
+	}
+	if !verify && !testing {
+		return q.opportunistic(s, host, report)
+	}
+	c, err := q.dial(s, host)
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		report(c, resultSTARTTLSNotSupported, nil)
+		if testing {
+			c.tls = tlsNone
+			return c, nil
+		}
+		c.close()
+		return nil, fmt.Errorf("[%s] does not offer STARTTLS, which is required", host)
+	}
+	config := &tls.Config{ServerName: host, RootCAs: rootCAs}
+	if len(tlsa) > 0 {
+		config = &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+				return daneVerify(tlsa, host, raw)
+			},
+		}
+	}
+	if err = c.StartTLS(config); err != nil {
+		report(c, tlsResultType(err), err)
+		_ = c.Client.Close()
+		if testing {
+			return q.opportunistic(s, host, nil)
+		}
+		return nil, fmt.Errorf("STARTTLS with [%s] failed: %s", host, err)
+	}
+	report(c, "", nil)
+	c.tls = tlsVerified
+	return c, nil
+}
+
+// opportunistic connects to host, with STARTTLS if the MX offers it, without verifying its certificate.
+// It connects again without TLS if the handshake failed, RFC 7435. report is called with the TLS session
+// established, if not nil
+func (q *Queue) opportunistic(s *settings, host string, report func(c *conn, result string, err error)) (*conn, error) {
+	c, err := q.dial(s, host)
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		c.tls = tlsNone
+		return c, nil
+	}
+	if err = c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+		_ = c.Client.Close()
+		if c, err = q.dial(s, host); err != nil {
+			return nil, err
+		}
+		c.tls = tlsNone
+		return c, nil
+	}
+	if report != nil {
+		report(c, "", nil)
+	}
+	c.tls = tlsOpportunistic
+	return c, nil
+}
+
+// dial connects to host, and says EHLO
+func (q *Queue) dial(s *settings, host string) (*conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.connectTimeout)
+	defer cancel()
+	nc, err := dial(ctx, net.JoinHostPort(host, "25"))
+	if err != nil {
+		return nil, err
+	}
+	_ = nc.SetDeadline(time.Now().Add(s.timeout))
+	client, err := smtp.NewClient(nc, host)
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	c := &conn{Client: client, netConn: nc, host: host}
+	if err = client.Hello(s.hostname); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connCache keeps the connections to the MX open between two messages
+type connCache struct {
+	sync.Mutex
+	conns map[string][]*conn
+	// idle is how long a connection is kept
+	idle time.Duration
+}
+
+func newConnCache() *connCache {
+	return &connCache{conns: make(map[string][]*conn), idle: DefaultIdleTimeout}
+}
+
+func (cc *connCache) setIdle(d time.Duration) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.idle = d
+}
+
+// get returns a connection to host with at least the tls level, nil if there is none
+func (cc *connCache) get(host string, level int) *conn {
+	cc.Lock()
+	defer cc.Unlock()
+	conns := cc.conns[host]
+	for i := len(conns) - 1; i >= 0; i-- {
+		if c := conns[i]; c.tls >= level {
+			cc.conns[host] = append(conns[:i], conns[i+1:]...)
+			return c
+		}
+	}
+	return nil
+}
+
+// put keeps c for the next messages to its host
+func (cc *connCache) put(c *conn, now time.Time) {
+	cc.Lock()
+	defer cc.Unlock()
+	c.idleSince = now
+	cc.conns[c.host] = append(cc.conns[c.host], c)
+}
+
+// expire closes the connections idle for too long
+func (cc *connCache) expire(now time.Time) {
+	cc.Lock()
+	var expired []*conn
+	for host, conns := range cc.conns {
+		kept := conns[:0]
+		for _, c := range conns {
+			if now.Sub(c.idleSince) >= cc.idle {
+				expired = append(expired, c)
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(cc.conns, host)
+		} else {
+			cc.conns[host] = kept
+		}
+	}
+	cc.Unlock()
+	for _, c := range expired {
+		c.close()
+	}
+}
+
+// closeAll closes all the connections
+func (cc *connCache) closeAll() {
+	cc.Lock()
+	conns := cc.conns
+	cc.conns = make(map[string][]*conn)
+	cc.Unlock()
+	for _, cs := range conns {
+		for _, c := range cs {
+			c.close()
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package outbound
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dsnBoundary separates the parts of the bounces
+const dsnBoundary = "=_outbound_dsn_"
+
+// enhancedStatus finds the enhanced status code of a response, eg. "5.1.1" in "550 5.1.1 No such user"
+var enhancedStatus = regexp.MustCompile(`^\d{3} ([245]\.\d{1,3}\.\d{1,3})\b`)
+
+// newDSN returns a bounce of the failed recipients of the item, a delivery status notification of RFC 3464,
+// with the header of the original message
+func newDSN(hostname string, it *item, failed []*Recipient, original io.Reader, now time.Time) []byte {
+	var b bytes.Buffer
+	date := now.Format(time.RFC1123Z)
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(&b, "To: <%s>\r\n", it.From)
+	b.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", date)
+	fmt.Fprintf(&b, "Message-ID: <%s.%d@%s>\r\n", it.ID, now.UnixNano(), hostname)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n", dsnBoundary)
+	b.WriteString("\r\n")
+	b.WriteString("This is a MIME-encapsulated message.\r\n\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\n", dsnBoundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "This is the mail system at host %s.\r\n\r\n", hostname)
+	b.WriteString("Your message could not be delivered to one or more recipients:\r\n\r\n")
+	for _, r := range failed {
+		fmt.Fprintf(&b, "<%s>: %s\r\n", r.Address, r.Response)
+	}
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\n", dsnBoundary)
+	b.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", hostname)
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", it.Queued.Format(time.RFC1123Z))
+	for _, r := range failed {
+		b.WriteString("\r\n")
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", r.Address)
+		b.WriteString("Action: failed\r\n")
+		fmt.Fprintf(&b, "Status: %s\r\n", r.status())
+		if !r.expired && r.Response != "" && r.Response[0] >= '2' && r.Response[0] <= '5' {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", r.Response)
+		}
+		fmt.Fprintf(&b, "Last-Attempt-Date: %s\r\n", date)
+	}
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\n", dsnBoundary)
+	b.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+	writeHeader(&b, original)
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "--%s--\r\n", dsnBoundary)
+	return b.Bytes()
+}
+
+// status returns the enhanced status code of a failed recipient
+func (r *Recipient) status() string {
+	if r.expired {
+		// delivery time expired
+		return "4.4.7"
+	}
+	if m := enhancedStatus.FindStringSubmatch(r.Response); m != nil && m[1][0] == '5' {
+		return m[1]
+	}
+	return "5.0.0"
+}
+
+// maxHeaderScan is how much of a message is read for the header returned in its bounce
+const maxHeaderScan = 64 << 10
+
+// writeHeader copies the header of the message to w, with CRLF line endings
+func writeHeader(w *bytes.Buffer, r io.Reader) {
+	br := bufio.NewReader(io.LimitReader(r, maxHeaderScan))
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return
+		}
+		w.WriteString(line)
+		w.WriteString("\r\n")
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package outbound
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/bounce"
+)
+
+func TestNewDSN(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	it := &item{ID: "q1", From: "alice@example.org", Queued: now.Add(-time.Hour)}
+	failed := []*Recipient{
+		{Address: "bad@example.com", Status: Failed, Response: "550 5.1.1 No such user"},
+		{Address: "x@nullmx.com", Status: Failed, Response: "the domain does not accept mail, it has a null MX"},
+		{Address: "slow@example.net", Status: Failed, Response: "451 4.3.0 Try again later", expired: true},
+	}
+	original := "Subject: hello\nMessage-ID: <1@example.org>\n\nthe body\n"
+	dsn := newDSN("out.example.org", it, failed, strings.NewReader(original), now)
+
+	bounces, err := bounce.Parse(bytes.NewReader(dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bounces) != 3 {
+		t.Fatal("expecting 3 bounces, got", len(bounces))
+	}
+	for i, want := range []struct{ rcpt, status string }{
+		{"bad@example.com", "5.1.1"},
+		{"x@nullmx.com", "5.0.0"},
+		{"slow@example.net", "4.4.7"},
+	} {
+		if bounces[i].Recipient != want.rcpt || bounces[i].Status != want.status || bounces[i].Action != "failed" {
+			t.Errorf("unexpected bounce %d: %+v", i, bounces[i])
+		}
+	}
+	if !strings.Contains(bounces[0].Diagnostic, "550 5.1.1 No such user") {
+		t.Error("the diagnostic should be the response of the MX, got", bounces[0].Diagnostic)
+	}
+	s := string(dsn)
+	for _, want := range []string{
+		"From: Mail Delivery System <MAILER-DAEMON@out.example.org>\r\n",
+		"To: <alice@example.org>\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"Subject: hello\r\nMessage-ID: <1@example.org>\r\n\r\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("the bounce should have %q", want)
+		}
+	}
+	if strings.Contains(s, "the body") {
+		t.Error("the bounce should only have the header of the message")
+	}
+}
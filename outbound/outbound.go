@@ -0,0 +1,435 @@
+// Package outbound delivers messages to the MX of their recipients' domains, so that the daemon can send
+// mail too, eg. for the messages of a submission server. The messages are queued to a directory, then
+// delivered by workers, with limits of connections and messages to each domain, which pause while the MX of
+// the domain throttle them. The connections are kept open for
+// the next messages to the same MX. STARTTLS is used when offered, and required by the MTA-STS policy
+// or the DANE TLSA records of the domain, when enabled. The recipients deferred by their MX are retried
+// with an exponential backoff, until the max age, and the sender gets a bounce for those that failed
+package outbound
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+const (
+	// DefaultWorkers is how many messages are delivered at once when workers is not set
+	DefaultWorkers = 16
+	// DefaultDomainConcurrency is how many messages are delivered to a domain at once when domain_concurrency is not set
+	DefaultDomainConcurrency = 4
+	// DefaultRetryMin is the delay before the first retry when retry_min is not set, it doubles with each attempt
+	DefaultRetryMin = 5 * time.Minute
+	// DefaultRetryMax is the longest delay between two attempts when retry_max is not set
+	DefaultRetryMax = 4 * time.Hour
+	// DefaultMaxAge is how long a message is retried when max_age is not set, its recipients then bounce
+	DefaultMaxAge = 5 * 24 * time.Hour
+	// DefaultTimeout is the timeout of the SMTP commands when timeout is not set. The data of a message
+	// must be sent within it too
+	DefaultTimeout = 5 * time.Minute
+	// DefaultConnectTimeout is the timeout of the connections to the MX when connect_timeout is not set
+	DefaultConnectTimeout = 30 * time.Second
+	// DefaultIdleTimeout is how long a connection is kept open for the next message when idle_timeout is not set
+	DefaultIdleTimeout = 30 * time.Second
+	// DefaultMaxHops is how many Received header fields a queued message may have when max_hops is not set,
+	// as RFC 5321 6.3 suggests
+	DefaultMaxHops = 25
+	// DefaultThrottleBackoff is how long the deliveries to a domain pause when its MX replied 421 or 450,
+	// if the domain has no throttle_backoff. It doubles while the MX keeps throttling them
+	DefaultThrottleBackoff = time.Minute
+)
+
+// Config configures the outbound delivery, disabled if there is no queue_dir
+type Config struct {
+	// QueueDir is the directory where the messages wait to be delivered, created if missing
+	QueueDir string `json:"queue_dir,omitempty"`
+	// Hostname is the name given with EHLO, and the domain of the bounces' sender. The OS host name if empty
+	Hostname string `json:"hostname,omitempty"`
+	// Workers is how many messages are delivered at once
+	Workers int `json:"workers,omitempty"`
+	// DomainConcurrency is how many messages are delivered to the same domain at once, each on its own connection
+	DomainConcurrency int `json:"domain_concurrency,omitempty"`
+	// RetryMin is the delay before the first retry, eg. "5m". It doubles with each attempt, up to RetryMax, eg. "4h"
+	RetryMin string `json:"retry_min,omitempty"`
+	RetryMax string `json:"retry_max,omitempty"`
+	// MaxAge is how long a message is retried, eg. "120h". The recipients that are still deferred then bounce
+	MaxAge string `json:"max_age,omitempty"`
+	// Timeout is the timeout of each SMTP command, eg. "5m", ConnectTimeout of the connections, eg. "30s"
+	Timeout        string `json:"timeout,omitempty"`
+	ConnectTimeout string `json:"connect_timeout,omitempty"`
+	// IdleTimeout is how long a connection is kept open for the next message to the same MX, eg. "30s"
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+	// MTASTS applies the MTA-STS policies of the domains (RFC 8461): the MX must be one of the policy's,
+	// and its certificate must be valid, when the policy is enforced
+	MTASTS bool `json:"mta_sts,omitempty"`
+	// DANE verifies the certificates of the MX with their TLSA records (RFC 7672), and requires STARTTLS
+	// from the MX that have them. The dns upstream servers must validate DNSSEC
+	DANE bool `json:"dane,omitempty"`
+	// MaxHops is how many Received header fields a message may have to be queued, to stop the loops
+	MaxHops int `json:"max_hops,omitempty"`
+	// TLSRPT sends a daily report of the TLS sessions with their MX to the domains that publish a TLSRPT
+	// record (RFC 8460), by mail through the queue or to their https URL
+	TLSRPT bool `json:"tls_rpt,omitempty"`
+	// TLSRPTOrg is the organization-name of the reports, the hostname if empty, and TLSRPTContact their
+	// contact-info, postmaster@<hostname> if empty. The reports sent by mail are from TLSRPTContact
+	TLSRPTOrg     string `json:"tls_rpt_org,omitempty"`
+	TLSRPTContact string `json:"tls_rpt_contact,omitempty"`
+	// Domains shapes the deliveries to some domains, keyed by domain, eg. "gmail.com". A key starting
+	// with "*." applies to the subdomains, eg. "*.example.com"
+	Domains map[string]DomainPolicy `json:"domains,omitempty"`
+}
+
+// Validate checks the config, an empty config is valid
+func (c *Config) Validate() error {
+	for _, d := range []struct {
+		name, value string
+	}{
+		{"retry_min", c.RetryMin},
+		{"retry_max", c.RetryMax},
+		{"max_age", c.MaxAge},
+		{"timeout", c.Timeout},
+		{"connect_timeout", c.ConnectTimeout},
+		{"idle_timeout", c.IdleTimeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v <= 0 {
+			return fmt.Errorf("outbound %s [%s] is not a valid duration", d.name, d.value)
+		}
+	}
+	if duration(c.RetryMin, DefaultRetryMin) > duration(c.RetryMax, DefaultRetryMax) {
+		return errors.New("outbound retry_min is longer than retry_max")
+	}
+	if c.Workers < 0 {
+		return errors.New("outbound workers cannot be negative")
+	}
+	if c.DomainConcurrency < 0 {
+		return errors.New("outbound domain_concurrency cannot be negative")
+	}
+	if c.MaxHops < 0 {
+		return errors.New("outbound max_hops cannot be negative")
+	}
+	if c.TLSRPTContact != "" && !strings.Contains(c.TLSRPTContact, "@") {
+		return fmt.Errorf("outbound tls_rpt_contact [%s] is not an address", c.TLSRPTContact)
+	}
+	for domain, p := range c.Domains {
+		if err := p.validate(domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func duration(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+func positive(n, def int) int {
+	if n > 0 {
+		return n
+	}
+	return def
+}
+
+// settings are the values of a config, with the defaults applied
+type settings struct {
+	dir               string
+	hostname          string
+	workers           int
+	domainConcurrency int
+	retryMin          time.Duration
+	retryMax          time.Duration
+	maxAge            time.Duration
+	timeout           time.Duration
+	connectTimeout    time.Duration
+	idleTimeout       time.Duration
+	mtaSTS            bool
+	dane              bool
+	maxHops           int
+	tlsRPT            bool
+	tlsRPTOrg         string
+	tlsRPTContact     string
+	domains           map[string]DomainPolicy
+}
+
+func newSettings(c Config) *settings {
+	s := &settings{
+		dir:               c.QueueDir,
+		hostname:          c.Hostname,
+		workers:           positive(c.Workers, DefaultWorkers),
+		domainConcurrency: positive(c.DomainConcurrency, DefaultDomainConcurrency),
+		retryMin:          duration(c.RetryMin, DefaultRetryMin),
+		retryMax:          duration(c.RetryMax, DefaultRetryMax),
+		maxAge:            duration(c.MaxAge, DefaultMaxAge),
+		timeout:           duration(c.Timeout, DefaultTimeout),
+		connectTimeout:    duration(c.ConnectTimeout, DefaultConnectTimeout),
+		idleTimeout:       duration(c.IdleTimeout, DefaultIdleTimeout),
+		mtaSTS:            c.MTASTS,
+		dane:              c.DANE,
+		maxHops:           positive(c.MaxHops, DefaultMaxHops),
+		tlsRPT:            c.TLSRPT,
+		tlsRPTOrg:         c.TLSRPTOrg,
+		tlsRPTContact:     c.TLSRPTContact,
+		domains:           c.Domains,
+	}
+	if s.hostname == "" {
+		if h, err := os.Hostname(); err == nil {
+			s.hostname = h
+		} else {
+			s.hostname = "localhost"
+		}
+	}
+	if s.tlsRPTOrg == "" {
+		s.tlsRPTOrg = s.hostname
+	}
+	if s.tlsRPTContact == "" {
+		s.tlsRPTContact = "postmaster@" + s.hostname
+	}
+	return s
+}
+
+// backoff returns the delay before the next attempt, after the given number of attempts
+func (s *settings) backoff(attempts int) time.Duration {
+	d := s.retryMin
+	for i := 1; i < attempts && d < s.retryMax; i++ {
+		d *= 2
+	}
+	if d > s.retryMax {
+		d = s.retryMax
+	}
+	return d
+}
+
+// queueHolder holds the queue in an atomic.Value, which needs the same concrete type every time
+type queueHolder struct {
+	*Queue
+}
+
+var defaultQueue atomic.Value
+
+func init() {
+	defaultQueue.Store(queueHolder{})
+}
+
+// Default returns the process-wide queue, that the Outbound processor queues the messages to.
+// Nil until Set is called
+func Default() *Queue {
+	return defaultQueue.Load().(queueHolder).Queue
+}
+
+// Set replaces the process-wide queue
+func Set(q *Queue) {
+	defaultQueue.Store(queueHolder{q})
+}
+
+// Queue keeps the messages until they are delivered, and delivers them. The zero value is not usable, use New
+type Queue struct {
+	mu       sync.Mutex
+	settings *settings
+	log      log.Logger
+	clock    clock.Clock
+	// items are the queued messages, keyed by id, of the settings' dir
+	items map[string]*item
+	// stop is closed to stop the scheduler and the workers, nil when they are not running
+	stop chan struct{}
+	// wake makes the scheduler look for the messages due
+	wake chan struct{}
+	// work passes the messages due to the workers
+	work  chan *item
+	conns *connCache
+	// domains limits the deliveries to each domain, their counts are kept across the reloads
+	domains *domainLimits
+	sts     *stsCache
+	// reports counts the TLS sessions for the TLSRPT reports
+	reports *tlsReports
+}
+
+// New returns a queue configured with c, which should be valid. The messages of its queue_dir are
+// loaded, and the workers start delivering them. The queue is disabled if c has no queue_dir
+func New(c Config, l log.Logger) *Queue {
+	q := &Queue{
+		clock:   clock.Real,
+		wake:    make(chan struct{}, 1),
+		work:    make(chan *item),
+		conns:   newConnCache(),
+		domains: newDomainLimits(),
+		sts:     newSTSCache(),
+	}
+	q.reports = newTLSReports(q.clock.Now())
+	q.Reconfigure(c, l)
+	return q
+}
+
+// Reconfigure applies c. The messages are loaded again if the queue_dir changed, the deliveries
+// in progress finish with the previous config
+func (q *Queue) Reconfigure(c Config, l log.Logger) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := newSettings(c)
+	if q.settings == nil || q.settings.dir != s.dir {
+		q.items = make(map[string]*item)
+		if s.dir != "" {
+			if err := q.load(s.dir, l); err != nil {
+				l.WithError(err).Errorf("could not load the outbound queue [%s]", s.dir)
+			}
+		}
+		if err := q.sts.load(s.dir); err != nil {
+			l.WithError(err).Errorf("could not load the MTA-STS policies of the outbound queue [%s]", s.dir)
+		}
+	}
+	q.settings = s
+	q.log = l
+	q.domains.configure(s)
+	q.conns.setIdle(s.idleTimeout)
+	q.restart()
+}
+
+// SetClock sets the clock of the schedule and of the messages' age, nil for the real clock
+func (q *Queue) SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.clock = c
+	if q.stop != nil {
+		q.restart()
+	}
+}
+
+// Close stops the workers once their deliveries are done, and closes the connections kept open.
+// The messages stay queued, for the next start
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.stop != nil {
+		close(q.stop)
+		q.stop = nil
+	}
+	q.mu.Unlock()
+	q.conns.closeAll()
+}
+
+// Enabled returns true if the queue has a queue_dir
+func (q *Queue) Enabled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.settings.dir != ""
+}
+
+// Len returns the number of queued messages
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Flush makes the deferred messages due now
+func (q *Queue) Flush() {
+	q.mu.Lock()
+	now := q.clock.Now()
+	for _, it := range q.items {
+		it.Next = now
+	}
+	q.mu.Unlock()
+	q.poke()
+}
+
+// poke wakes up the scheduler
+func (q *Queue) poke() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// restart starts the scheduler and the workers again, with the settings and the clock. Called with mu held
+func (q *Queue) restart() {
+	if q.stop != nil {
+		close(q.stop)
+		q.stop = nil
+	}
+	if q.settings.dir == "" {
+		return
+	}
+	q.stop = make(chan struct{})
+	for i := 0; i < q.settings.workers; i++ {
+		go q.worker(q.stop)
+	}
+	go q.schedule(q.clock, q.stop)
+	if q.settings.tlsRPT {
+		go q.reportDaily(q.clock, q.stop)
+	}
+}
+
+// schedule passes the messages due to the workers, until stop is closed
+func (q *Queue) schedule(c clock.Clock, stop chan struct{}) {
+	for {
+		due, wait := q.due()
+		for i, it := range due {
+			select {
+			case q.work <- it:
+			case <-stop:
+				// the next workers will deliver them
+				q.mu.Lock()
+				for _, it := range due[i:] {
+					it.busy = false
+				}
+				q.mu.Unlock()
+				return
+			}
+		}
+		q.conns.expire(c.Now())
+		select {
+		case <-c.After(wait):
+		case <-q.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// due returns the messages due, marked busy, and how long to wait for the next one
+func (q *Queue) due() ([]*item, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.clock.Now()
+	// the idle connections are closed at least this often
+	wait := q.settings.idleTimeout
+	var due []*item
+	for _, it := range q.items {
+		if it.busy {
+			continue
+		}
+		if d := it.Next.Sub(now); d > 0 {
+			if d < wait {
+				wait = d
+			}
+			continue
+		}
+		it.busy = true
+		due = append(due, it)
+	}
+	return due, wait
+}
+
+func (q *Queue) worker(stop chan struct{}) {
+	for {
+		select {
+		case it := <-q.work:
+			q.deliver(it)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package outbound
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{QueueDir: "/tmp/queue", RetryMin: "1m", RetryMax: "1h", MaxAge: "48h", Workers: 4, DomainConcurrency: 1},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%+v should be valid: %s", c, err)
+		}
+	}
+	for _, c := range []Config{
+		{RetryMin: "soon"},
+		{Timeout: "-1s"},
+		{RetryMin: "5h"},
+		{Workers: -1},
+		{DomainConcurrency: -1},
+		{MaxHops: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v should not be valid", c)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := newSettings(Config{RetryMin: "5m", RetryMax: "1h"})
+	for attempts, want := range []time.Duration{
+		5 * time.Minute, 5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour, time.Hour,
+	} {
+		if got := s.backoff(attempts); got != want {
+			t.Errorf("after %d attempts: got %s, want %s", attempts, got, want)
+		}
+	}
+	if s.backoff(1000) != time.Hour {
+		t.Error("the backoff should stop at retry_max")
+	}
+}
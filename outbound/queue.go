@@ -0,0 +1,366 @@
+package outbound
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/metrics"
+)
+
+var (
+	// ErrDisabled is returned when a message is queued to a queue without a queue_dir
+	ErrDisabled = errors.New("outbound delivery is not enabled, it needs a queue_dir")
+	// ErrTooManyHops is returned when a message to be queued has more Received header fields than max_hops
+	ErrTooManyHops = errors.New("too many hops, the message may be looping")
+	// ErrNoRecipients is returned when a message to be queued has no recipient
+	ErrNoRecipients = errors.New("the message has no recipient")
+	// ErrNullSender is returned when a message from the null sender is to be bounced, bounces are not bounced
+	ErrNullSender = errors.New("the message has the null sender, it's not bounced")
+)
+
+// Status of a recipient
+const (
+	// Pending is the status of the recipients to be delivered, or deferred
+	Pending = "pending"
+	// Sent is the status of the recipients accepted by their MX
+	Sent = "sent"
+	// Failed is the status of the recipients rejected by their MX, or not delivered within the max age
+	Failed = "failed"
+)
+
+// item is a queued message. The message is kept in <id>.eml in the queue_dir, the item in <id>.json
+type item struct {
+	ID string `json:"id"`
+	// From is the sender, empty for the null sender of the bounces
+	From   string       `json:"from"`
+	Rcpts  []*Recipient `json:"rcpts"`
+	Queued time.Time    `json:"queued"`
+	// Attempts counts the deliveries tried
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`
+	// busy is true while a worker delivers the message, guarded by the queue's mu
+	busy bool
+}
+
+// Recipient is a recipient of a queued message
+type Recipient struct {
+	Address string `json:"address"`
+	// Status is Pending, Sent or Failed
+	Status string `json:"status"`
+	// Response is the last response of the MX to the recipient, or why the MX could not be reached
+	Response string `json:"response,omitempty"`
+	// expired is true for a recipient that failed because the message was too old
+	expired bool
+}
+
+func (it *item) pending() []*Recipient {
+	var rcpts []*Recipient
+	for _, r := range it.Rcpts {
+		if r.Status == Pending {
+			rcpts = append(rcpts, r)
+		}
+	}
+	return rcpts
+}
+
+// load reads the items of dir into q.items, creating dir if missing. Called with mu held
+func (q *Queue) load(dir string, l log.Logger) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		it := &item{}
+		if err := json.Unmarshal(b, it); err != nil || it.ID+".json" != name {
+			l.WithError(err).Errorf("outbound queue: [%s] is not a queued message, skipped", name)
+			continue
+		}
+		q.items[it.ID] = it
+	}
+	return nil
+}
+
+// Enqueue queues the message of the envelope to its recipients, and returns its id in the queue. The message
+// is written to the queue_dir before Enqueue returns. Returns ErrTooManyHops if the message has more
+// Received header fields than max_hops
+func (q *Queue) Enqueue(e *mail.Envelope) (string, error) {
+	if len(e.RcptTo) == 0 {
+		return "", ErrNoRecipients
+	}
+	q.mu.Lock()
+	s := q.settings
+	q.mu.Unlock()
+	if s.dir == "" {
+		return "", ErrDisabled
+	}
+	if mail.ReadTrace(e.NewReader(), 0).Hops > s.maxHops {
+		return "", ErrTooManyHops
+	}
+	from := e.MailFrom.String()
+	if e.MailFrom.NullPath {
+		from = ""
+	}
+	rcpts := make([]string, len(e.RcptTo))
+	for i := range e.RcptTo {
+		rcpts[i] = e.RcptTo[i].String()
+	}
+	return q.add(s, e.QueuedId, from, rcpts, func(w io.Writer) error {
+		_, err := e.WriteTo(w)
+		return err
+	})
+}
+
+// Send queues a message written by the daemon, eg. an auto-reply, from the sender to the recipients. An empty
+// from is the null sender. Returns the id of the message in the queue
+func (q *Queue) Send(from string, rcpts []string, msg []byte) (string, error) {
+	if len(rcpts) == 0 {
+		return "", ErrNoRecipients
+	}
+	q.mu.Lock()
+	s := q.settings
+	q.mu.Unlock()
+	if s.dir == "" {
+		return "", ErrDisabled
+	}
+	return q.add(s, "", from, rcpts, func(w io.Writer) error {
+		_, err := w.Write(msg)
+		return err
+	})
+}
+
+// add writes the message with write, then queues it with the id, or another one if the id is taken
+func (q *Queue) add(s *settings, id, from string, rcpts []string, write func(w io.Writer) error) (string, error) {
+	if !validID(id) {
+		id = mail.ULID(0)
+	}
+	now := q.now()
+	it := &item{From: from, Queued: now, Next: now}
+	for _, rcpt := range rcpts {
+		it.Rcpts = append(it.Rcpts, &Recipient{Address: rcpt, Status: Pending})
+	}
+	var err error
+	// the message is written first, the item says it's complete
+	for i := 0; i < 10; i++ {
+		it.ID = id
+		if i > 0 {
+			it.ID += "-" + string(rune('0'+i))
+		}
+		var f *os.File
+		f, err = os.OpenFile(filepath.Join(s.dir, it.ID+".eml"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		w := bufio.NewWriter(f)
+		if err = write(w); err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = q.save(s.dir, it)
+		}
+		if err != nil {
+			_ = os.Remove(f.Name())
+			return "", err
+		}
+		break
+	}
+	if err != nil {
+		return "", err
+	}
+	q.mu.Lock()
+	if q.settings.dir == s.dir {
+		q.items[it.ID] = it
+	}
+	q.mu.Unlock()
+	q.poke()
+	return it.ID, nil
+}
+
+// validID returns true if the id can be used as a file name
+func validID(id string) bool {
+	return id != "" && id[0] != '.' && !strings.ContainsAny(id, `/\`)
+}
+
+// save writes the item to <id>.json
+func (q *Queue) save(dir string, it *item) error {
+	b, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dir, it.ID+".json", b)
+}
+
+// writeFileAtomic writes b to name in dir, through a temporary file renamed, so that name is complete
+func writeFileAtomic(dir, name string, b []byte) error {
+	f, err := ioutil.TempFile(dir, ".tmp-"+name+"-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// remove deletes the files of the item, the .json first so that it's not loaded again
+func (q *Queue) remove(dir string, it *item) error {
+	if err := os.Remove(filepath.Join(dir, it.ID+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, it.ID+".eml")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (q *Queue) now() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.clock.Now()
+}
+
+// done records the outcome of a delivery attempt: the message is removed once all its recipients are sent or
+// failed, with a bounce to the sender for the failed ones. It's retried after the backoff otherwise, or after
+// retry if it was only waiting for a domain. The pending recipients fail once the message is older than max_age
+func (q *Queue) done(s *settings, it *item, attempted bool, retry time.Duration) {
+	q.mu.Lock()
+	l, now := q.log, q.clock.Now()
+	q.mu.Unlock()
+	if attempted {
+		it.Attempts++
+	}
+	pending := it.pending()
+	if len(pending) > 0 && now.Sub(it.Queued) >= s.maxAge {
+		for _, r := range pending {
+			r.Status = Failed
+			r.expired = true
+			if r.Response == "" {
+				r.Response = "the message could not be delivered in time"
+			}
+		}
+		metrics.Count(metrics.OutboundFailed, int64(len(pending)))
+		pending = nil
+	}
+	var err error
+	if len(pending) == 0 {
+		q.bounce(s, it, l)
+		err = q.remove(s.dir, it)
+	} else {
+		if attempted {
+			retry = s.backoff(it.Attempts)
+		}
+		it.Next = now.Add(retry)
+		err = q.save(s.dir, it)
+	}
+	if err != nil {
+		l.WithError(err).Errorf("outbound queue: could not update message [%s]", it.ID)
+	}
+	q.mu.Lock()
+	it.busy = false
+	if len(pending) == 0 {
+		delete(q.items, it.ID)
+	}
+	q.mu.Unlock()
+}
+
+// bounce queues a bounce of the failed recipients of the item to its sender. The bounces are not bounced
+func (q *Queue) bounce(s *settings, it *item, l log.Logger) {
+	var failed []*Recipient
+	for _, r := range it.Rcpts {
+		if r.Status == Failed {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	if it.From == "" {
+		l.WithField("id", it.ID).Info("outbound queue: a bounce could not be delivered, it's dropped")
+		return
+	}
+	f, err := os.Open(filepath.Join(s.dir, it.ID+".eml"))
+	if err != nil {
+		l.WithError(err).Errorf("outbound queue: could not read message [%s] to bounce it", it.ID)
+		return
+	}
+	defer func() { _ = f.Close() }()
+	id, err := q.queueDSN(s, it, failed, f)
+	if err != nil {
+		l.WithError(err).Errorf("outbound queue: could not queue the bounce of message [%s]", it.ID)
+		return
+	}
+	l.WithField("id", it.ID).WithField("bounce", id).Infof("outbound queue: %d recipients failed, bounced to [%s]", len(failed), it.From)
+}
+
+// Bounce queues a bounce of the message of the envelope to its sender, for the failed recipients, with their
+// Address and Response. It's for a message that was accepted, then could not be delivered to some recipients,
+// eg. a backend returned backends.RcptResults. Returns ErrNullSender if the message has the null sender,
+// bounces are not bounced, or the id of the bounce in the queue
+func (q *Queue) Bounce(e *mail.Envelope, failed []*Recipient) (string, error) {
+	if len(failed) == 0 {
+		return "", ErrNoRecipients
+	}
+	q.mu.Lock()
+	s := q.settings
+	q.mu.Unlock()
+	if s.dir == "" {
+		return "", ErrDisabled
+	}
+	if e.MailFrom.NullPath || e.MailFrom.IsEmpty() {
+		return "", ErrNullSender
+	}
+	it := &item{ID: e.QueuedId, From: e.MailFrom.String(), Queued: q.now()}
+	return q.queueDSN(s, it, failed, e.NewReader())
+}
+
+// queueDSN queues a bounce of the failed recipients of the item to its sender, from the null sender,
+// with the header of the original message
+func (q *Queue) queueDSN(s *settings, it *item, failed []*Recipient, original io.Reader) (string, error) {
+	dsn := newDSN(s.hostname, it, failed, original, q.now())
+	id, err := q.add(s, it.ID+"-bounce", "", []string{it.From}, func(w io.Writer) error {
+		_, err := w.Write(dsn)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	metrics.Incr(metrics.OutboundBounces)
+	return id, nil
+}
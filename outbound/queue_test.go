@@ -0,0 +1,570 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/dnscache"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/tests/testcert"
+)
+
+// fakeMessage is a message received by the fakeMX
+type fakeMessage struct {
+	from  string
+	rcpts []string
+	data  string
+	tls   bool
+}
+
+// fakeMX accepts the recipients, but rejects bad@, throttles busy@ and defers later@ until accept is set
+type fakeMX struct {
+	sync.Mutex
+	ln       net.Listener
+	tls      *tls.Config
+	accept   bool
+	messages []fakeMessage
+	conns    int
+}
+
+func newFakeMX(t *testing.T) *fakeMX {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mx := &fakeMX{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mx.Lock()
+			mx.conns++
+			mx.Unlock()
+			go mx.serve(conn)
+		}
+	}()
+	return mx
+}
+
+func (mx *fakeMX) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	reply := func(s string) {
+		_, _ = w.WriteString(s + "\r\n")
+		_ = w.Flush()
+	}
+	reply("220 mx.example.com ESMTP")
+	var m fakeMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			if mx.tls != nil && !m.tls {
+				reply("250-mx.example.com")
+				reply("250 STARTTLS")
+			} else {
+				reply("250 mx.example.com")
+			}
+		case cmd == "STARTTLS":
+			reply("220 Go ahead")
+			tlsConn := tls.Server(conn, mx.tls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			r, w = bufio.NewReader(conn), bufio.NewWriter(conn)
+			m = fakeMessage{tls: true}
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			m = fakeMessage{tls: m.tls, from: strings.Trim(strings.Fields(line[10:])[0], "<>")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			rcpt := strings.Trim(strings.TrimSpace(line[8:]), "<>")
+			mx.Lock()
+			accept := mx.accept
+			mx.Unlock()
+			if strings.HasPrefix(rcpt, "bad@") {
+				reply("550 5.1.1 No such user")
+			} else if strings.HasPrefix(rcpt, "later@") && !accept {
+				reply("451 4.3.0 Try again later")
+			} else if strings.HasPrefix(rcpt, "busy@") {
+				reply("450 4.2.1 Too many messages, slow down")
+			} else {
+				m.rcpts = append(m.rcpts, rcpt)
+				reply("250 OK")
+			}
+		case cmd == "DATA":
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			m.data = data.String()
+			mx.Lock()
+			mx.messages = append(mx.messages, m)
+			mx.Unlock()
+			reply("250 OK queued")
+		case cmd == "RSET" || cmd == "NOOP":
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func (mx *fakeMX) received() []fakeMessage {
+	mx.Lock()
+	defer mx.Unlock()
+	return append([]fakeMessage(nil), mx.messages...)
+}
+
+func (mx *fakeMX) setAccept(accept bool) {
+	mx.Lock()
+	defer mx.Unlock()
+	mx.accept = accept
+}
+
+// fakeResolver answers from its maps, the names it doesn't know do not exist
+type fakeResolver struct {
+	sync.Mutex
+	mx     map[string][]*net.MX
+	hosts  map[string][]string
+	txt    map[string][]string
+	tlsa   map[string][]dnscache.TLSA
+	broken map[string]bool
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+			"example.org": {{Host: "mx.example.com.", Pref: 10}},
+			"nullmx.com":  {{Host: ".", Pref: 0}},
+		},
+		hosts:  map[string][]string{"mx.example.com": {"127.0.0.1"}},
+		txt:    map[string][]string{},
+		tlsa:   map[string][]dnscache.TLSA{},
+		broken: map[string]bool{"broken.com": true},
+	}
+}
+
+func (r *fakeResolver) err(name string) error {
+	if r.broken[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.Lock()
+	defer r.Unlock()
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, r.err(host)
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r *fakeResolver) LookupTLSA(ctx context.Context, name string) ([]dnscache.TLSA, error) {
+	r.Lock()
+	defer r.Unlock()
+	if tlsa, ok := r.tlsa[name]; ok {
+		return tlsa, nil
+	}
+	return nil, r.err(name)
+}
+
+// install makes the queues resolve with r, and connect to mx for mx.example.com
+func install(r *fakeResolver, mx *fakeMX) func() {
+	savedResolver, savedDial := resolver, dial
+	resolver = func() dnsResolver { return r }
+	dial = func(ctx context.Context, addr string) (net.Conn, error) {
+		if addr != "mx.example.com:25" {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: addr}}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", mx.ln.Addr().String())
+	}
+	return func() {
+		resolver, dial = savedResolver, savedDial
+		_ = mx.ln.Close()
+	}
+}
+
+func testQueue(t *testing.T, c Config) (*Queue, func()) {
+	dir, err := ioutil.TempDir("", "outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	if c.QueueDir == "" {
+		c.QueueDir = dir
+	}
+	c.Hostname = "out.example.org"
+	q := New(c, l)
+	return q, func() {
+		q.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func testEnvelope(from string, rcpts ...string) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.QueuedId = "q1"
+	if from == "" {
+		e.MailFrom = mail.Address{NullPath: true}
+	} else {
+		a, _ := mail.NewAddress(from)
+		e.MailFrom = *a
+	}
+	for _, rcpt := range rcpts {
+		a, _ := mail.NewAddress(rcpt)
+		e.RcptTo = append(e.RcptTo, *a)
+	}
+	e.Data.WriteString("Received: from client\r\nSubject: hello\r\nMessage-ID: <1@example.org>\r\n\r\nHi\r\n.dot\r\n")
+	return e
+}
+
+// waitFor polls cond for a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for", what)
+}
+
+// itemOf returns a copy of the queued item with the id
+func itemOf(q *Queue, id string) (item, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it, ok := q.items[id]
+	if !ok || it.busy {
+		return item{}, false
+	}
+	c := *it
+	c.Rcpts = nil
+	for _, r := range it.Rcpts {
+		rc := *r
+		c.Rcpts = append(c.Rcpts, &rc)
+	}
+	return c, true
+}
+
+func TestDeliver(t *testing.T) {
+	mx := newFakeMX(t)
+	defer install(newFakeResolver(), mx)()
+	q, cleanup := testQueue(t, Config{})
+	defer cleanup()
+
+	id, err := q.Enqueue(testEnvelope("alice@example.org", "good@example.com", "bad@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "q1" {
+		t.Error("the queued id should be the id in the queue, got", id)
+	}
+	// the message, then its bounce
+	waitFor(t, "the bounce", func() bool { return len(mx.received()) == 2 && q.Len() == 0 })
+	msgs := mx.received()
+	if msgs[0].from != "alice@example.org" || len(msgs[0].rcpts) != 1 || msgs[0].rcpts[0] != "good@example.com" {
+		t.Errorf("unexpected message: %+v", msgs[0])
+	}
+	if !strings.Contains(msgs[0].data, "Subject: hello\r\n") || !strings.Contains(msgs[0].data, "\r\n.dot\r\n") {
+		t.Errorf("unexpected data: %q", msgs[0].data)
+	}
+	bounce := msgs[1]
+	if bounce.from != "" || len(bounce.rcpts) != 1 || bounce.rcpts[0] != "alice@example.org" {
+		t.Errorf("unexpected bounce: %+v", bounce)
+	}
+	for _, s := range []string{"Final-Recipient: rfc822; bad@example.com", "Status: 5.1.1", "Subject: hello"} {
+		if !strings.Contains(bounce.data, s) {
+			t.Errorf("the bounce should have [%s]: %s", s, bounce.data)
+		}
+	}
+	if strings.Contains(bounce.data, "good@example.com") {
+		t.Error("the bounce should only be about the failed recipients")
+	}
+	if files, _ := ioutil.ReadDir(q.settings.dir); len(files) != 0 {
+		t.Error("the queue_dir should be empty, got", len(files), "files")
+	}
+}
+
+func TestBounce(t *testing.T) {
+	mx := newFakeMX(t)
+	defer install(newFakeResolver(), mx)()
+	q, cleanup := testQueue(t, Config{})
+	defer cleanup()
+
+	failed := []*Recipient{{Address: "bob@example.com", Status: Failed, Response: "550 5.2.2 Mailbox full"}}
+	if _, err := q.Bounce(testEnvelope("", "bob@example.com"), failed); err != ErrNullSender {
+		t.Error("the bounces should not be bounced, got", err)
+	}
+	id, err := q.Bounce(testEnvelope("alice@example.org", "bob@example.com", "carol@example.com"), failed)
+	if err != nil || id != "q1-bounce" {
+		t.Fatal("unexpected bounce", id, err)
+	}
+	waitFor(t, "the bounce", func() bool { return len(mx.received()) == 1 && q.Len() == 0 })
+	bounce := mx.received()[0]
+	if bounce.from != "" || len(bounce.rcpts) != 1 || bounce.rcpts[0] != "alice@example.org" {
+		t.Errorf("unexpected bounce: %+v", bounce)
+	}
+	for _, s := range []string{"Final-Recipient: rfc822; bob@example.com", "Status: 5.2.2",
+		"Diagnostic-Code: smtp; 550 5.2.2 Mailbox full", "Subject: hello"} {
+		if !strings.Contains(bounce.data, s) {
+			t.Errorf("the bounce should have [%s]: %s", s, bounce.data)
+		}
+	}
+	if strings.Contains(bounce.data, "carol@example.com") {
+		t.Error("the bounce should only be about the failed recipients")
+	}
+}
+
+func TestDeferred(t *testing.T) {
+	mx := newFakeMX(t)
+	defer install(newFakeResolver(), mx)()
+	q, cleanup := testQueue(t, Config{RetryMin: "1h"})
+	defer cleanup()
+
+	id, err := q.Enqueue(testEnvelope("alice@example.org", "later@example.com", "good@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var it item
+	waitFor(t, "the first attempt", func() bool {
+		var ok bool
+		it, ok = itemOf(q, id)
+		return ok && it.Attempts == 1
+	})
+	if it.Rcpts[0].Status != Pending || !strings.HasPrefix(it.Rcpts[0].Response, "451 ") {
+		t.Errorf("later@ should be deferred, got %+v", it.Rcpts[0])
+	}
+	if it.Rcpts[1].Status != Sent {
+		t.Errorf("good@ should be sent, got %+v", it.Rcpts[1])
+	}
+	if d := it.Next.Sub(time.Now()); d < 50*time.Minute {
+		t.Error("the message should be retried in an hour, got", d)
+	}
+	mx.setAccept(true)
+	q.Flush()
+	waitFor(t, "the retry", func() bool { return q.Len() == 0 })
+	msgs := mx.received()
+	if len(msgs) != 2 || msgs[1].rcpts[0] != "later@example.com" || len(msgs[1].rcpts) != 1 {
+		t.Errorf("later@ should get the message once, good@ should not get it again: %+v", msgs)
+	}
+	mx.Lock()
+	conns := mx.conns
+	mx.Unlock()
+	if conns != 1 {
+		t.Error("the connection should be kept for the retry, got", conns, "connections")
+	}
+}
+
+func TestExpired(t *testing.T) {
+	r := newFakeResolver()
+	defer install(r, newFakeMX(t))()
+	q, cleanup := testQueue(t, Config{MaxAge: "1h"})
+	defer cleanup()
+
+	// the domain of the recipient cannot be resolved, the message and its bounce wait
+	id, err := q.Enqueue(testEnvelope("alice@broken.com", "someone@broken.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first attempt", func() bool {
+		it, ok := itemOf(q, id)
+		return ok && it.Attempts == 1
+	})
+	q.mu.Lock()
+	it := q.items[id]
+	it.busy = true
+	it.Queued = it.Queued.Add(-2 * time.Hour)
+	s := q.settings
+	q.mu.Unlock()
+	q.done(s, it, false, time.Second)
+	q.mu.Lock()
+	_, queued := q.items[id]
+	_, bounced := q.items[id+"-bounce"]
+	q.mu.Unlock()
+	if queued || !bounced {
+		t.Fatal("the message should be replaced by its bounce")
+	}
+	b, err := ioutil.ReadFile(s.dir + "/" + id + "-bounce.eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "Status: 4.4.7") {
+		t.Error("the recipient should have expired:", string(b))
+	}
+}
+
+func TestBounceNotBounced(t *testing.T) {
+	mx := newFakeMX(t)
+	defer install(newFakeResolver(), mx)()
+	q, cleanup := testQueue(t, Config{})
+	defer cleanup()
+
+	if _, err := q.Enqueue(testEnvelope("", "bad@example.com", "x@nullmx.com")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return q.Len() == 0 })
+	if len(mx.received()) != 0 {
+		t.Error("a bounce should not be bounced")
+	}
+}
+
+func TestMaxHops(t *testing.T) {
+	q, cleanup := testQueue(t, Config{MaxHops: 2})
+	defer cleanup()
+	e := testEnvelope("alice@example.org", "good@example.com")
+	e.DeliveryHeader = "Received: from a\r\nReceived: from b\r\n"
+	if _, err := q.Enqueue(e); err != ErrTooManyHops {
+		t.Error("expecting ErrTooManyHops, got", err)
+	}
+	e.DeliveryHeader = "Received: from a\r\n"
+	if n := mail.ReadTrace(e.NewReader(), 0).Hops; n != 2 {
+		t.Error("expecting 2 hops, got", n)
+	}
+	if _, err := q.Enqueue(testEnvelope("alice@example.org")); err != ErrNoRecipients {
+		t.Error("expecting ErrNoRecipients, got", err)
+	}
+	disabled := New(Config{}, q.log)
+	if _, err := disabled.Enqueue(e); err != ErrDisabled {
+		t.Error("expecting ErrDisabled, got", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer install(newFakeResolver(), newFakeMX(t))()
+	q, cleanup := testQueue(t, Config{})
+	defer cleanup()
+
+	id, err := q.Enqueue(testEnvelope("alice@example.org", "someone@broken.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same id is not reused
+	e := testEnvelope("alice@example.org", "other@broken.com")
+	if id2, err := q.Enqueue(e); err != nil || id2 == id {
+		t.Error("the second message should get another id, got", id2, err)
+	}
+	waitFor(t, "the first attempts", func() bool {
+		a, ok1 := itemOf(q, id)
+		b, ok2 := itemOf(q, id+"-1")
+		return ok1 && ok2 && a.Attempts == 1 && b.Attempts == 1
+	})
+	q.Close()
+
+	q2 := New(Config{QueueDir: q.settings.dir}, q.log)
+	defer q2.Close()
+	if q2.Len() != 2 {
+		t.Fatal("the messages should be loaded, got", q2.Len())
+	}
+	it, _ := itemOf(q2, id)
+	if it.From != "alice@example.org" || it.Rcpts[0].Address != "someone@broken.com" || it.Attempts != 1 {
+		t.Errorf("unexpected item: %+v", it)
+	}
+}
+
+func TestSTARTTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := testcert.GenerateCert("mx.example.com", "", time.Hour, false, 2048, "P256", dir+"/"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(dir+"/mx.example.com.cert.pem", dir+"/mx.example.com.key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mx := newFakeMX(t)
+	mx.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	r := newFakeResolver()
+	defer install(r, mx)()
+
+	// opportunistic
+	q, cleanup := testQueue(t, Config{})
+	defer cleanup()
+	if _, err := q.Enqueue(testEnvelope("alice@example.org", "good@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return q.Len() == 0 })
+	if msgs := mx.received(); len(msgs) != 1 || !msgs[0].tls {
+		t.Fatalf("the message should be sent over TLS: %+v", msgs)
+	}
+
+	// DANE, the certificate does not match
+	r.Lock()
+	r.tlsa["_25._tcp.mx.example.com"] = []dnscache.TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Data: make([]byte, 32)}}
+	r.Unlock()
+	q2, cleanup2 := testQueue(t, Config{DANE: true, RetryMin: "1h"})
+	defer cleanup2()
+	id, err := q2.Enqueue(testEnvelope("alice@example.org", "good@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var it item
+	waitFor(t, "the first attempt", func() bool {
+		var ok bool
+		it, ok = itemOf(q2, id)
+		return ok && it.Attempts == 1
+	})
+	if !strings.Contains(it.Rcpts[0].Response, "STARTTLS") {
+		t.Error("the delivery should fail with STARTTLS, got", it.Rcpts[0].Response)
+	}
+
+	// DANE, the certificate matches
+	r.Lock()
+	r.tlsa["_25._tcp.mx.example.com"] = []dnscache.TLSA{{Usage: 3, Selector: 0, MatchingType: 0, Data: cert.Certificate[0]}}
+	r.Unlock()
+	q2.Flush()
+	waitFor(t, "the retry", func() bool { return q2.Len() == 0 })
+	if msgs := mx.received(); len(msgs) != 2 || !msgs[1].tls {
+		t.Fatalf("the message should be sent over TLS: %+v", msgs)
+	}
+}
@@ -0,0 +1,227 @@
+package outbound
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainPolicy shapes the deliveries to a domain
+type DomainPolicy struct {
+	// Concurrency is how many messages are delivered to the domain at once, domain_concurrency if 0
+	Concurrency int `json:"concurrency,omitempty"`
+	// MessagesPerMinute is how many messages are delivered to the domain each minute, no limit if 0
+	MessagesPerMinute int `json:"messages_per_minute,omitempty"`
+	// ConnectionsPerMinute is how many connections are opened to the MX of the domain each minute, no limit
+	// if 0. The connections kept open are not counted again
+	ConnectionsPerMinute int `json:"connections_per_minute,omitempty"`
+	// ThrottleBackoff is how long the deliveries to the domain pause when its MX replied 421 or 450, eg. "1m".
+	// It doubles while the MX keeps throttling them, up to retry_max, until a message is delivered
+	ThrottleBackoff string `json:"throttle_backoff,omitempty"`
+}
+
+// validate checks the policy of the domain
+func (p DomainPolicy) validate(domain string) error {
+	if strings.TrimPrefix(domain, "*.") == "" {
+		return fmt.Errorf("outbound domains: [%s] is not a domain", domain)
+	}
+	if p.Concurrency < 0 || p.MessagesPerMinute < 0 || p.ConnectionsPerMinute < 0 {
+		return fmt.Errorf("outbound domains: the limits of [%s] cannot be negative", domain)
+	}
+	if p.ThrottleBackoff != "" {
+		if d, err := time.ParseDuration(p.ThrottleBackoff); err != nil || d <= 0 {
+			return fmt.Errorf("outbound domains: throttle_backoff [%s] of [%s] is not a valid duration",
+				p.ThrottleBackoff, domain)
+		}
+	}
+	return nil
+}
+
+// domainPolicy is a DomainPolicy with the defaults applied
+type domainPolicy struct {
+	concurrency int
+	messages    int
+	connections int
+	backoff     time.Duration
+}
+
+func newDomainPolicy(p DomainPolicy, s *settings) domainPolicy {
+	return domainPolicy{
+		concurrency: positive(p.Concurrency, s.domainConcurrency),
+		messages:    p.MessagesPerMinute,
+		connections: p.ConnectionsPerMinute,
+		backoff:     duration(p.ThrottleBackoff, DefaultThrottleBackoff),
+	}
+}
+
+// domainState counts the deliveries to a domain
+type domainState struct {
+	// busy is how many deliveries are in progress
+	busy int
+	// messages and connections are counted in the minute from windowStart
+	windowStart time.Time
+	messages    int
+	connections int
+	// throttled is how many times in a row the MX throttled the deliveries, they pause until resume
+	throttled int
+	resume    time.Time
+}
+
+// domainLimits limits the deliveries to each domain: how many at once, how many messages and connections
+// each minute, and it pauses them while the MX of the domain throttle them
+type domainLimits struct {
+	sync.Mutex
+	// def is the policy of the domains that have none
+	def      domainPolicy
+	policies map[string]domainPolicy
+	// wildcards are the policies of the subdomains, keyed by suffix, eg. ".example.com"
+	wildcards map[string]domainPolicy
+	// maxBackoff is the longest pause of a throttled domain
+	maxBackoff time.Duration
+	states     map[string]*domainState
+}
+
+func newDomainLimits() *domainLimits {
+	return &domainLimits{states: make(map[string]*domainState)}
+}
+
+// configure applies the policies of the settings, the domains keep their counts
+func (d *domainLimits) configure(s *settings) {
+	policies := make(map[string]domainPolicy, len(s.domains))
+	wildcards := make(map[string]domainPolicy)
+	for name, p := range s.domains {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if strings.HasPrefix(name, "*.") {
+			wildcards[name[1:]] = newDomainPolicy(p, s)
+		} else {
+			policies[name] = newDomainPolicy(p, s)
+		}
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.def = newDomainPolicy(DomainPolicy{}, s)
+	d.policies, d.wildcards = policies, wildcards
+	d.maxBackoff = s.retryMax
+}
+
+// policy returns the policy of the domain, the most specific wildcard applies when the domain has
+// none of its own. Called with the lock held
+func (d *domainLimits) policy(domain string) domainPolicy {
+	if p, ok := d.policies[domain]; ok {
+		return p
+	}
+	for i := strings.IndexByte(domain, '.'); i >= 0; i = strings.IndexByte(domain, '.') {
+		if p, ok := d.wildcards[domain[i:]]; ok {
+			return p
+		}
+		domain = domain[i+1:]
+	}
+	return d.def
+}
+
+// state returns the counts of the domain, those of a new minute if the last one is over. Called with the lock held
+func (d *domainLimits) state(domain string, now time.Time) *domainState {
+	st := d.states[domain]
+	if st == nil {
+		st = &domainState{windowStart: now}
+		d.states[domain] = st
+	}
+	if now.Sub(st.windowStart) >= time.Minute {
+		st.windowStart, st.messages, st.connections = now, 0, 0
+	}
+	return st
+}
+
+// acquire counts a message to the domain. It returns false if the domain cannot take it yet, with how long
+// to wait: the domain already has its deliveries at once, its messages of the minute, or it's paused
+func (d *domainLimits) acquire(domain string, now time.Time) (bool, time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+	p, st := d.policy(domain), d.state(domain, now)
+	switch {
+	case now.Before(st.resume):
+		return false, st.resume.Sub(now)
+	case p.messages > 0 && st.messages >= p.messages:
+		return false, st.windowStart.Add(time.Minute).Sub(now)
+	case st.busy >= p.concurrency:
+		return false, time.Second
+	}
+	st.busy++
+	st.messages++
+	return true, 0
+}
+
+// release ends a delivery to the domain. The counts of a domain without rate limits are not kept once idle
+func (d *domainLimits) release(domain string) {
+	d.Lock()
+	defer d.Unlock()
+	st := d.states[domain]
+	if st == nil {
+		return
+	}
+	if st.busy--; st.busy > 0 || st.throttled > 0 {
+		return
+	}
+	if p := d.policy(domain); p.messages == 0 && p.connections == 0 {
+		delete(d.states, domain)
+	}
+}
+
+// connection counts a new connection to an MX of the domain. It returns false if the domain had its
+// connections of the minute, with how long to wait for the next minute
+func (d *domainLimits) connection(domain string, now time.Time) (bool, time.Duration) {
+	d.Lock()
+	defer d.Unlock()
+	p, st := d.policy(domain), d.state(domain, now)
+	if p.connections > 0 && st.connections >= p.connections {
+		return false, st.windowStart.Add(time.Minute).Sub(now)
+	}
+	st.connections++
+	return true, 0
+}
+
+// throttle pauses the deliveries to the domain, for twice as long as the last time if it's throttled
+// again before a message is delivered. It returns the pause
+func (d *domainLimits) throttle(domain string, now time.Time) time.Duration {
+	d.Lock()
+	defer d.Unlock()
+	p, st := d.policy(domain), d.state(domain, now)
+	pause := p.backoff
+	for i := 0; i < st.throttled && pause < d.maxBackoff; i++ {
+		pause *= 2
+	}
+	if pause > d.maxBackoff {
+		pause = d.maxBackoff
+	}
+	st.throttled++
+	st.resume = now.Add(pause)
+	return pause
+}
+
+// delivered ends the throttling of the domain, its MX take the messages again
+func (d *domainLimits) delivered(domain string) {
+	d.Lock()
+	defer d.Unlock()
+	if st := d.states[domain]; st != nil {
+		st.throttled = 0
+	}
+}
+
+// rateLimited is returned when a domain has no connection left this minute, its delivery waits for
+// the next minute, it's not attempted
+type rateLimited struct {
+	wait time.Duration
+}
+
+func (e rateLimited) Error() string {
+	return fmt.Sprintf("the connections are rate limited for %s", e.wait)
+}
+
+// throttles returns true if err is a reply of an MX asking to slow down: 421, the service is not available,
+// or 450, the mailbox is unavailable, eg. because of too many messages
+func throttles(err error) bool {
+	tpErr, ok := err.(*textproto.Error)
+	return ok && (tpErr.Code == 421 || tpErr.Code == 450)
+}
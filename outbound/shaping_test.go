@@ -0,0 +1,188 @@
+package outbound
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDomainLimits(t *testing.T) {
+	c := Config{
+		DomainConcurrency: 2,
+		RetryMax:          "10m",
+		Domains: map[string]DomainPolicy{
+			"gmail.com":       {MessagesPerMinute: 2, ConnectionsPerMinute: 1, ThrottleBackoff: "3m"},
+			"*.example.com":   {Concurrency: 1},
+			"a.example.com.":  {Concurrency: 3},
+			"*.b.example.com": {MessagesPerMinute: 1},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	d, now := newDomainLimits(), time.Now()
+	d.configure(newSettings(c))
+	for domain, want := range map[string]int{
+		"example.org":     2,
+		"x.example.com":   1,
+		"example.com":     2,
+		"a.example.com":   3,
+		"x.b.example.com": 2,
+	} {
+		if p := d.policy(domain); p.concurrency != want {
+			t.Errorf("%s: expecting a concurrency of %d, got %d", domain, want, p.concurrency)
+		}
+	}
+	if p := d.policy("x.b.example.com"); p.messages != 1 {
+		t.Error("the most specific wildcard should apply, got", p)
+	}
+
+	// the messages of the minute
+	if ok, _ := d.acquire("gmail.com", now); !ok {
+		t.Fatal("the first message should be delivered")
+	}
+	d.release("gmail.com")
+	if ok, _ := d.acquire("gmail.com", now.Add(10*time.Second)); !ok {
+		t.Fatal("the second message should be delivered")
+	}
+	d.release("gmail.com")
+	if ok, wait := d.acquire("gmail.com", now.Add(20*time.Second)); ok || wait != 40*time.Second {
+		t.Error("the third message should wait for the next minute, got", ok, wait)
+	}
+	if ok, _ := d.acquire("gmail.com", now.Add(time.Minute)); !ok {
+		t.Error("the next minute should take messages again")
+	}
+	d.release("gmail.com")
+
+	// the connections of the minute
+	if ok, _ := d.connection("gmail.com", now.Add(time.Minute)); !ok {
+		t.Error("the first connection should be opened")
+	}
+	if ok, wait := d.connection("gmail.com", now.Add(90*time.Second)); ok || wait != 30*time.Second {
+		t.Error("the second connection should wait for the next minute, got", ok, wait)
+	}
+	if ok, _ := d.connection("example.org", now); !ok {
+		t.Error("the connections of a domain without policy are not limited")
+	}
+
+	// the deliveries at once
+	for i := 0; i < 2; i++ {
+		if ok, _ := d.acquire("example.org", now); !ok {
+			t.Fatal("expecting a delivery to start")
+		}
+	}
+	if ok, wait := d.acquire("example.org", now); ok || wait != time.Second {
+		t.Error("the domain has its deliveries at once, got", ok, wait)
+	}
+	d.release("example.org")
+	d.release("example.org")
+	if _, ok := d.states["example.org"]; ok {
+		t.Error("the counts of an idle domain without rate limits should not be kept")
+	}
+
+	// the pauses double while the domain is throttled, up to retry_max
+	for i, want := range []time.Duration{3 * time.Minute, 6 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		if pause := d.throttle("gmail.com", now); pause != want {
+			t.Errorf("throttle %d: expecting a pause of %s, got %s", i, want, pause)
+		}
+	}
+	if ok, wait := d.acquire("gmail.com", now.Add(4*time.Minute)); ok || wait != 6*time.Minute {
+		t.Error("the domain should be paused, got", ok, wait)
+	}
+	d.delivered("gmail.com")
+	if pause := d.throttle("gmail.com", now); pause != 3*time.Minute {
+		t.Error("a delivery should end the throttling, got a pause of", pause)
+	}
+	// the pause is the default for the domains without policy
+	if pause := d.throttle("example.org", now); pause != DefaultThrottleBackoff {
+		t.Error("expecting the default pause, got", pause)
+	}
+
+	for _, domains := range []map[string]DomainPolicy{
+		{"*.": {}},
+		{"gmail.com": {MessagesPerMinute: -1}},
+		{"gmail.com": {ThrottleBackoff: "soon"}},
+	} {
+		if err := (&Config{Domains: domains}).Validate(); err == nil {
+			t.Errorf("%v should not be valid", domains)
+		}
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	mx := newFakeMX(t)
+	defer install(newFakeResolver(), mx)()
+	q, cleanup := testQueue(t, Config{
+		RetryMin: "1h",
+		Domains:  map[string]DomainPolicy{"example.com": {ThrottleBackoff: "30m"}},
+	})
+	defer cleanup()
+
+	// the MX throttles busy@, the deliveries to example.com pause
+	id, err := q.Enqueue(testEnvelope("alice@example.org", "busy@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var it item
+	waitFor(t, "the first attempt", func() bool {
+		var ok bool
+		it, ok = itemOf(q, id)
+		return ok && it.Attempts == 1
+	})
+	if it.Rcpts[0].Status != Pending || !strings.HasPrefix(it.Rcpts[0].Response, "450 ") {
+		t.Errorf("busy@ should be deferred, got %+v", it.Rcpts[0])
+	}
+	e := testEnvelope("alice@example.org", "good@example.com")
+	e.QueuedId = "q2"
+	if _, err := q.Enqueue(e); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the message to wait for the pause", func() bool {
+		it, ok := itemOf(q, "q2")
+		return ok && it.Next.Sub(time.Now()) > 25*time.Minute
+	})
+	if it, _ := itemOf(q, "q2"); it.Attempts != 0 {
+		t.Error("the message should not be attempted while the domain is paused")
+	}
+	if msgs := mx.received(); len(msgs) != 0 {
+		t.Error("no message should be delivered, got", len(msgs))
+	}
+	// the other domains are not paused
+	e = testEnvelope("alice@example.org", "good@example.org")
+	e.QueuedId = "q3"
+	if _, err := q.Enqueue(e); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the message to example.org", func() bool { return len(mx.received()) == 1 })
+}
+
+func TestMessagesPerMinute(t *testing.T) {
+	mx := newFakeMX(t)
+	defer install(newFakeResolver(), mx)()
+	q, cleanup := testQueue(t, Config{
+		Domains: map[string]DomainPolicy{"example.com": {MessagesPerMinute: 1}},
+	})
+	defer cleanup()
+
+	for _, id := range []string{"q1", "q2"} {
+		e := testEnvelope("alice@example.org", "good@example.com")
+		e.QueuedId = id
+		if _, err := q.Enqueue(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the first message", func() bool { return len(mx.received()) == 1 && q.Len() == 1 })
+	var waiting item
+	waitFor(t, "the second message to wait for the next minute", func() bool {
+		for _, id := range []string{"q1", "q2"} {
+			if it, ok := itemOf(q, id); ok && it.Next.Sub(time.Now()) > 30*time.Second {
+				waiting = it
+				return true
+			}
+		}
+		return false
+	})
+	if waiting.Attempts != 0 || waiting.Next.Sub(time.Now()) > time.Minute {
+		t.Errorf("the second message should wait less than a minute, without an attempt: %+v", waiting)
+	}
+}
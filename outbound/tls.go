@@ -0,0 +1,361 @@
+package outbound
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/dnscache"
+)
+
+// maxSTSPolicySize is the largest MTA-STS policy fetched
+const maxSTSPolicySize = 64 << 10
+
+// maxSTSMaxAge is the longest max_age of an MTA-STS policy, RFC 8461 3.2
+const maxSTSMaxAge = 31557600 * time.Second
+
+// stsClient fetches the MTA-STS policies. The redirects are not followed, RFC 8461 3.3
+var stsClient = &http.Client{
+	Timeout: time.Minute,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// stsURL returns the URL of the MTA-STS policy of domain, replaced by the tests
+var stsURL = func(domain string) string {
+	return "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+}
+
+// modes of an MTA-STS policy
+const (
+	stsEnforce = "enforce"
+	stsTesting = "testing"
+	stsNone    = "none"
+)
+
+// stsPolicy is the MTA-STS policy of a domain, RFC 8461. It's kept in the queue_dir across restarts
+type stsPolicy struct {
+	// ID is of the TXT record of the domain, it changes with the policy
+	ID      string    `json:"id"`
+	Mode    string    `json:"mode"`
+	MX      []string  `json:"mx"`
+	Expires time.Time `json:"expires"`
+	// Lines are the lines of the policy as fetched, for the TLSRPT reports
+	Lines []string `json:"lines"`
+}
+
+// enforced returns true if the policy must be applied, a nil policy is not
+func (p *stsPolicy) enforced() bool {
+	return p != nil && p.Mode == stsEnforce
+}
+
+// testing returns true if the failures of the policy are only reported
+func (p *stsPolicy) testing() bool {
+	return p != nil && p.Mode == stsTesting
+}
+
+// matches returns true if host is one of the policy's mx. A pattern "*.example.com" matches one label
+func (p *stsPolicy) matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, mx := range p.MX {
+		if strings.HasPrefix(mx, "*.") {
+			if label := strings.TrimSuffix(host, mx[1:]); label != host && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		} else if mx == host {
+			return true
+		}
+	}
+	return false
+}
+
+// stsError is an MTA-STS policy that could not be fetched, with the result type of the TLSRPT reports
+type stsError struct {
+	result string
+	err    error
+}
+
+func (e *stsError) Error() string {
+	return e.err.Error()
+}
+
+// parseSTSPolicy parses the body of an MTA-STS policy
+func parseSTSPolicy(r io.Reader) (*stsPolicy, time.Duration, error) {
+	p := &stsPolicy{}
+	var version string
+	maxAge := time.Duration(-1)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		p.Lines = append(p.Lines, line)
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = value
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(value))
+		case "max_age":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, 0, fmt.Errorf("max_age [%s] is not a number of seconds", value)
+			}
+			maxAge = time.Duration(n) * time.Second
+			if maxAge > maxSTSMaxAge {
+				maxAge = maxSTSMaxAge
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if version != "STSv1" {
+		return nil, 0, errors.New("the policy is not STSv1")
+	}
+	switch p.Mode {
+	case stsEnforce, stsTesting:
+		if len(p.MX) == 0 {
+			return nil, 0, errors.New("the policy has no mx")
+		}
+	case stsNone:
+	default:
+		return nil, 0, fmt.Errorf("mode [%s] is not valid", p.Mode)
+	}
+	if maxAge < 0 {
+		return nil, 0, errors.New("the policy has no max_age")
+	}
+	return p, maxAge, nil
+}
+
+// stsID returns the id of the MTA-STS TXT record of the domain, empty if it has none
+func stsID(ctx context.Context, domain string) (string, error) {
+	txts, err := resolver().LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		if dnscache.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	var id string
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		if id != "" {
+			// more than one record, as if there were none, RFC 8461 3.1
+			return "", nil
+		}
+		for _, field := range strings.Split(txt, ";") {
+			if kv := strings.SplitN(strings.TrimSpace(field), "=", 2); len(kv) == 2 && kv[0] == "id" {
+				id = kv[1]
+			}
+		}
+	}
+	return id, nil
+}
+
+// fetchSTSPolicy fetches the MTA-STS policy of the domain
+func fetchSTSPolicy(ctx context.Context, domain string) (*stsPolicy, time.Duration, *stsError) {
+	req, err := http.NewRequest(http.MethodGet, stsURL(domain), nil)
+	if err != nil {
+		return nil, 0, &stsError{resultSTSFetchError, err}
+	}
+	resp, err := stsClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if tlsResultType(err) != resultValidationFailure {
+			// the certificate of the policy host is not valid
+			return nil, 0, &stsError{resultSTSWebPKIInvalid, err}
+		}
+		return nil, 0, &stsError{resultSTSFetchError, err}
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("fetching the MTA-STS policy of [%s] returned %s", domain, resp.Status)
+		return nil, 0, &stsError{resultSTSFetchError, err}
+	}
+	p, maxAge, err := parseSTSPolicy(io.LimitReader(resp.Body, maxSTSPolicySize))
+	if err != nil {
+		return nil, 0, &stsError{resultSTSPolicyInvalid, err}
+	}
+	return p, maxAge, nil
+}
+
+// stsCache keeps the MTA-STS policies of the domains until their max_age
+type stsCache struct {
+	sync.Mutex
+	policies map[string]*stsPolicy
+	// dir is where the policies are saved, empty if they are not
+	dir string
+}
+
+func newSTSCache() *stsCache {
+	return &stsCache{policies: make(map[string]*stsPolicy)}
+}
+
+// stsFile is the file of the queue_dir where the policies are saved, its name is not of a queued message
+const stsFile = ".mta-sts.json"
+
+// load replaces the policies with those saved in dir, and saves them there from now on. Empty for none
+func (sc *stsCache) load(dir string) error {
+	sc.Lock()
+	defer sc.Unlock()
+	sc.dir = dir
+	sc.policies = make(map[string]*stsPolicy)
+	if dir == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, stsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, &sc.policies); err != nil || sc.policies == nil {
+		sc.policies = make(map[string]*stsPolicy)
+	}
+	return err
+}
+
+// save writes the policies to the dir. Called with the lock held
+func (sc *stsCache) save() error {
+	if sc.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(sc.policies)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sc.dir, stsFile, b)
+}
+
+// get returns the MTA-STS policy of the domain, nil if it has none. The cached policy is fetched again when
+// the id of the domain's TXT record changes, and kept if fetching it again failed, RFC 8461 5.1.
+// The error is of the fetch that failed, the cached policy is returned with it
+func (sc *stsCache) get(ctx context.Context, domain string, now time.Time) (*stsPolicy, *stsError) {
+	sc.Lock()
+	cached := sc.policies[domain]
+	if cached != nil && !now.Before(cached.Expires) {
+		delete(sc.policies, domain)
+		cached = nil
+	}
+	sc.Unlock()
+	id, err := stsID(ctx, domain)
+	if err != nil || id == "" || (cached != nil && cached.ID == id) {
+		return active(cached), nil
+	}
+	p, maxAge, fetchErr := fetchSTSPolicy(ctx, domain)
+	if fetchErr != nil {
+		return active(cached), fetchErr
+	}
+	p.ID = id
+	p.Expires = now.Add(maxAge)
+	sc.Lock()
+	sc.policies[domain] = p
+	err = sc.save()
+	sc.Unlock()
+	if err != nil {
+		return active(p), &stsError{resultSTSFetchError, fmt.Errorf("could not save the MTA-STS policies: %s", err)}
+	}
+	return active(p), nil
+}
+
+// active returns the policy, nil if its mode is none
+func active(p *stsPolicy) *stsPolicy {
+	if p == nil || p.Mode == stsNone {
+		return nil
+	}
+	return p
+}
+
+// usableTLSA returns the TLSA records that can verify an MX: DANE-TA and DANE-EE, RFC 7672 3.1
+func usableTLSA(records []dnscache.TLSA) []dnscache.TLSA {
+	var usable []dnscache.TLSA
+	for _, r := range records {
+		if (r.Usage == 2 || r.Usage == 3) && r.Selector <= 1 && r.MatchingType <= 2 {
+			usable = append(usable, r)
+		}
+	}
+	return usable
+}
+
+// tlsaMatches returns true if the record is of the certificate
+func tlsaMatches(r dnscache.TLSA, cert *x509.Certificate) bool {
+	data := cert.Raw
+	if r.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch r.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// daneVerify verifies the certificates of host with its TLSA records. A DANE-EE record must match the
+// server's certificate, its name and dates are not checked. A DANE-TA record must match a certificate of
+// the chain, which the server's certificate for host must chain to
+func daneVerify(records []dnscache.TLSA, host string, raw [][]byte) error {
+	certs := make([]*x509.Certificate, len(raw))
+	for i := range raw {
+		cert, err := x509.ParseCertificate(raw[i])
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("the server has no certificate")
+	}
+	for _, r := range records {
+		if r.Usage == 3 {
+			if tlsaMatches(r, certs[0]) {
+				return nil
+			}
+			continue
+		}
+		for _, ta := range certs[1:] {
+			if !tlsaMatches(r, ta) {
+				continue
+			}
+			roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+			roots.AddCert(ta)
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			if _, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       host,
+				Roots:         roots,
+				Intermediates: intermediates,
+			}); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no TLSA record of [%s] matches its certificate", host)
+}
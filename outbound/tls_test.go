@@ -0,0 +1,181 @@
+package outbound
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/dnscache"
+	"github.com/flashmob/go-guerrilla/tests/testcert"
+)
+
+func TestParseSTSPolicy(t *testing.T) {
+	p, maxAge, err := parseSTSPolicy(strings.NewReader(
+		"version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: *.Example.net\r\nmax_age: 86400\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.enforced() || maxAge != 24*time.Hour || len(p.MX) != 2 {
+		t.Errorf("unexpected policy: %+v %s", p, maxAge)
+	}
+	for host, want := range map[string]bool{
+		"mx1.example.com":      true,
+		"MX1.example.com.":     true,
+		"mx2.example.com":      false,
+		"mx.example.net":       true,
+		"a.mx.example.net":     false,
+		"example.net":          false,
+		"mx.notexample.net":    false,
+		"mx1.example.com.evil": false,
+	} {
+		if p.matches(host) != want {
+			t.Errorf("%s: expecting %v", host, want)
+		}
+	}
+	for _, s := range []string{
+		"version: STSv2\nmode: enforce\nmx: mx.example.com\nmax_age: 1\n",
+		"version: STSv1\nmode: strict\nmx: mx.example.com\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmx: mx.example.com\n",
+		"version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: soon\n",
+	} {
+		if _, _, err := parseSTSPolicy(strings.NewReader(s)); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+	var none *stsPolicy
+	if none.enforced() {
+		t.Error("a missing policy is not enforced")
+	}
+}
+
+func TestSTSCache(t *testing.T) {
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		_, _ = fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 3600\n")
+	}))
+	defer srv.Close()
+	savedURL, savedResolver := stsURL, resolver
+	defer func() { stsURL, resolver = savedURL, savedResolver }()
+	stsURL = func(domain string) string { return srv.URL + "/" + domain }
+	r := newFakeResolver()
+	r.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=1"}
+	resolver = func() dnsResolver { return r }
+
+	c, now := newSTSCache(), time.Now()
+	if p, _ := c.get(context.Background(), "example.com", now); !p.enforced() || !p.matches("mx.example.com") {
+		t.Fatalf("unexpected policy: %+v", p)
+	}
+	if p, _ := c.get(context.Background(), "example.com", now.Add(time.Minute)); p == nil || fetches != 1 {
+		t.Error("the policy should be cached, fetched", fetches)
+	}
+	r.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	if p, _ := c.get(context.Background(), "example.com", now.Add(time.Minute)); p == nil || fetches != 2 {
+		t.Error("the policy should be fetched again when the id changes, fetched", fetches)
+	}
+	// the policy is kept while the TXT record is missing, until its max_age
+	delete(r.txt, "_mta-sts.example.com")
+	if p, _ := c.get(context.Background(), "example.com", now.Add(time.Minute)); p == nil {
+		t.Error("the cached policy should be kept")
+	}
+	if p, _ := c.get(context.Background(), "example.com", now.Add(2*time.Hour)); p != nil {
+		t.Error("the cached policy should expire")
+	}
+	if p, _ := c.get(context.Background(), "example.org", now); p != nil {
+		t.Error("a domain without TXT record has no policy")
+	}
+}
+
+func TestSTSCacheSaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+		_, _ = fmt.Fprint(w, "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 3600\n")
+	}))
+	defer srv.Close()
+	savedURL, savedResolver := stsURL, resolver
+	defer func() { stsURL, resolver = savedURL, savedResolver }()
+	stsURL = func(domain string) string { return srv.URL + "/" + domain }
+	r := newFakeResolver()
+	r.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=1"}
+	resolver = func() dnsResolver { return r }
+
+	c, now := newSTSCache(), time.Now()
+	if err := c.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := c.get(context.Background(), "example.com", now); p == nil || err != nil {
+		t.Fatal("expecting the policy, got", err)
+	}
+	// after a restart, the policy is kept though it cannot be fetched again
+	status = http.StatusNotFound
+	r.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	c2 := newSTSCache()
+	if err := c2.load(dir); err != nil {
+		t.Fatal(err)
+	}
+	p, fetchErr := c2.get(context.Background(), "example.com", now.Add(time.Minute))
+	if !p.enforced() || !p.matches("mx.example.com") {
+		t.Errorf("the policy should be loaded, got %+v", p)
+	}
+	if fetchErr == nil || fetchErr.result != resultSTSFetchError {
+		t.Error("expecting a fetch error, got", fetchErr)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Error("expecting only the policies in the dir, got", len(files), "files")
+	}
+}
+
+func TestDANEVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := testcert.GenerateCert("mx.example.com", "", time.Hour, false, 2048, "P256", dir+"/"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(dir+"/mx.example.com.cert.pem", dir+"/mx.example.com.key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, test := range []struct {
+		name    string
+		records []dnscache.TLSA
+		ok      bool
+	}{
+		{"DANE-EE of the public key", []dnscache.TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Data: spki[:]}}, true},
+		{"DANE-EE of the certificate", []dnscache.TLSA{{Usage: 3, Data: leaf.Raw}}, true},
+		{"DANE-EE not matching", []dnscache.TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Data: leaf.Raw[:32]}}, false},
+		// the certificate is not in the chain, it's the server's
+		{"DANE-TA of the server", []dnscache.TLSA{{Usage: 2, Data: leaf.Raw}}, false},
+	} {
+		if err := daneVerify(test.records, "mx.example.com", cert.Certificate); (err == nil) != test.ok {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+	if usable := usableTLSA([]dnscache.TLSA{{Usage: 1}, {Usage: 3, Selector: 2}, {Usage: 2}}); len(usable) != 1 {
+		t.Error("only DANE-TA and DANE-EE with a known selector and matching type are usable, got", usable)
+	}
+}
@@ -0,0 +1,379 @@
+package outbound
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/dnscache"
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// result types of the TLSRPT reports, RFC 8460 4.3
+const (
+	resultSTARTTLSNotSupported = "starttls-not-supported"
+	resultCertHostMismatch     = "certificate-host-mismatch"
+	resultCertExpired          = "certificate-expired"
+	resultCertNotTrusted       = "certificate-not-trusted"
+	resultValidationFailure    = "validation-failure"
+	resultDNSSECInvalid        = "dnssec-invalid"
+	resultSTSPolicyInvalid     = "sts-policy-invalid"
+	resultSTSFetchError        = "sts-policy-fetch-error"
+	resultSTSWebPKIInvalid     = "sts-webpki-invalid"
+)
+
+// policy types of the TLSRPT reports
+const (
+	policySTS      = "sts"
+	policyTLSA     = "tlsa"
+	policyNotFound = "no-policy-found"
+)
+
+// rptClient posts the TLSRPT reports to the https URLs
+var rptClient = &http.Client{Timeout: time.Minute}
+
+// tlsResultType returns the result type of a failed TLS handshake
+func tlsResultType(err error) string {
+	for err != nil {
+		switch e := err.(type) {
+		case x509.HostnameError:
+			return resultCertHostMismatch
+		case x509.UnknownAuthorityError:
+			return resultCertNotTrusted
+		case x509.CertificateInvalidError:
+			if e.Reason == x509.Expired {
+				return resultCertExpired
+			}
+			return resultCertNotTrusted
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		err = u.Unwrap()
+	}
+	return resultValidationFailure
+}
+
+// tlsReportPolicy is a policy of a TLSRPT report, with its sessions
+type tlsReportPolicy struct {
+	Policy struct {
+		Type    string   `json:"policy-type"`
+		Strings []string `json:"policy-string,omitempty"`
+		Domain  string   `json:"policy-domain"`
+		MX      []string `json:"mx-host,omitempty"`
+	} `json:"policy"`
+	Summary struct {
+		Successful int64 `json:"total-successful-session-count"`
+		Failed     int64 `json:"total-failure-session-count"`
+	} `json:"summary"`
+	Failures []*tlsFailure `json:"failure-details,omitempty"`
+}
+
+// tlsFailure counts the sessions that failed the same way
+type tlsFailure struct {
+	ResultType  string `json:"result-type"`
+	SendingIP   string `json:"sending-mta-ip,omitempty"`
+	ReceivingMX string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP string `json:"receiving-ip,omitempty"`
+	Count       int64  `json:"failed-session-count"`
+	// Info is the error of the first failure
+	Info string `json:"additional-information,omitempty"`
+}
+
+// tlsReport is a TLSRPT aggregate report, RFC 8460 4
+type tlsReport struct {
+	Organization string `json:"organization-name"`
+	DateRange    struct {
+		Start time.Time `json:"start-datetime"`
+		End   time.Time `json:"end-datetime"`
+	} `json:"date-range"`
+	Contact  string             `json:"contact-info"`
+	ID       string             `json:"report-id"`
+	Policies []*tlsReportPolicy `json:"policies"`
+}
+
+// tlsReports counts the TLS sessions with the MX of each domain since start
+type tlsReports struct {
+	sync.Mutex
+	start time.Time
+	// domains are the policies of each domain, keyed by their type and strings
+	domains map[string]map[string]*tlsReportPolicy
+}
+
+func newTLSReports(now time.Time) *tlsReports {
+	return &tlsReports{start: now, domains: make(map[string]map[string]*tlsReportPolicy)}
+}
+
+// record counts a session with the MX of the domain under the policy, it failed if result is not empty
+func (r *tlsReports) record(domain string, policy *tlsReportPolicy, mx, sendingIP, receivingIP, result string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	key := policy.Policy.Type + "\n" + strings.Join(policy.Policy.Strings, "\n")
+	policies := r.domains[domain]
+	if policies == nil {
+		policies = make(map[string]*tlsReportPolicy)
+		r.domains[domain] = policies
+	}
+	if p, ok := policies[key]; ok {
+		policy = p
+	} else {
+		policies[key] = policy
+	}
+	if result == "" {
+		policy.Summary.Successful++
+		return
+	}
+	policy.Summary.Failed++
+	for _, f := range policy.Failures {
+		if f.ResultType == result && f.ReceivingMX == mx && f.SendingIP == sendingIP && f.ReceivingIP == receivingIP {
+			f.Count++
+			return
+		}
+	}
+	f := &tlsFailure{ResultType: result, SendingIP: sendingIP, ReceivingMX: mx, ReceivingIP: receivingIP, Count: 1}
+	if err != nil {
+		f.Info = err.Error()
+	}
+	policy.Failures = append(policy.Failures, f)
+}
+
+// flush returns the sessions counted since the start, and starts counting again at now
+func (r *tlsReports) flush(now time.Time) (time.Time, map[string]map[string]*tlsReportPolicy) {
+	r.Lock()
+	defer r.Unlock()
+	start, domains := r.start, r.domains
+	r.start, r.domains = now, make(map[string]map[string]*tlsReportPolicy)
+	return start, domains
+}
+
+// reportTLS counts a session with the MX of the domain for the TLSRPT reports, if enabled. c is the connection
+// of the session, nil if there was none. The policy is of the TLSA records of the MX if it has some, or of the
+// MTA-STS policy of the domain
+func (q *Queue) reportTLS(s *settings, domain, mx string, c *conn, sts *stsPolicy, tlsa []dnscache.TLSA, result string, err error) {
+	if !s.tlsRPT {
+		return
+	}
+	p := &tlsReportPolicy{}
+	p.Policy.Domain = domain
+	switch {
+	case len(tlsa) > 0:
+		p.Policy.Type = policyTLSA
+		for _, r := range tlsa {
+			p.Policy.Strings = append(p.Policy.Strings,
+				fmt.Sprintf("%d %d %d %s", r.Usage, r.Selector, r.MatchingType, hex.EncodeToString(r.Data)))
+		}
+	case sts != nil:
+		p.Policy.Type = policySTS
+		p.Policy.Strings = sts.Lines
+		p.Policy.MX = sts.MX
+	default:
+		p.Policy.Type = policyNotFound
+	}
+	var sendingIP, receivingIP string
+	if c != nil {
+		sendingIP, receivingIP = addrIP(c.netConn.LocalAddr()), addrIP(c.netConn.RemoteAddr())
+	}
+	q.reports.record(domain, p, mx, sendingIP, receivingIP, result, err)
+}
+
+func addrIP(a net.Addr) string {
+	if host, _, err := net.SplitHostPort(a.String()); err == nil {
+		return host
+	}
+	return ""
+}
+
+// rua returns the URIs that the TLSRPT reports of the domain are sent to, RFC 8460 3
+func rua(ctx context.Context, domain string) ([]string, error) {
+	txts, err := resolver().LookupTXT(ctx, "_smtp._tls."+domain)
+	if err != nil {
+		if dnscache.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var uris []string
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=TLSRPTv1") {
+			continue
+		}
+		if uris != nil {
+			// more than one record, as if there were none
+			return nil, nil
+		}
+		uris = []string{}
+		for _, field := range strings.Split(txt, ";") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 || kv[0] != "rua" {
+				continue
+			}
+			for _, uri := range strings.Split(kv[1], ",") {
+				uris = append(uris, strings.TrimSpace(uri))
+			}
+		}
+	}
+	return uris, nil
+}
+
+// reportDaily sends the TLSRPT reports of each UTC day after it ends, until stop is closed
+func (q *Queue) reportDaily(c clock.Clock, stop chan struct{}) {
+	for {
+		now := c.Now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		select {
+		case <-c.After(next.Sub(now)):
+			q.sendReports(next)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sendReports sends the reports of the sessions counted until end to the domains that publish a TLSRPT record
+func (q *Queue) sendReports(end time.Time) {
+	q.mu.Lock()
+	s, l := q.settings, q.log
+	q.mu.Unlock()
+	start, domains := q.reports.flush(end)
+	names := make([]string, 0, len(domains))
+	for domain := range domains {
+		names = append(names, domain)
+	}
+	sort.Strings(names)
+	for _, domain := range names {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		uris, err := rua(ctx, domain)
+		if err != nil || len(uris) == 0 {
+			cancel()
+			continue
+		}
+		report := newTLSReport(s, start.UTC(), end.UTC(), domains[domain])
+		body, err := gzipJSON(report)
+		if err != nil {
+			cancel()
+			l.WithError(err).Errorf("outbound queue: could not write the TLSRPT report of [%s]", domain)
+			continue
+		}
+		for _, uri := range uris {
+			if err := q.sendReport(ctx, s, domain, report, body, uri); err != nil {
+				l.WithError(err).WithField("rua", uri).Errorf("outbound queue: could not send the TLSRPT report of [%s]", domain)
+			}
+		}
+		cancel()
+	}
+}
+
+func newTLSReport(s *settings, start, end time.Time, policies map[string]*tlsReportPolicy) *tlsReport {
+	report := &tlsReport{Organization: s.tlsRPTOrg, Contact: s.tlsRPTContact}
+	report.DateRange.Start, report.DateRange.End = start, end
+	report.ID = start.Format("2006-01-02T15:04:05Z") + "_" + mail.ULID(0) + "@" + s.hostname
+	keys := make([]string, 0, len(policies))
+	for key := range policies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		report.Policies = append(report.Policies, policies[key])
+	}
+	return report
+}
+
+func gzipJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// sendReport sends the gzipped report to a mailto: or https: URI
+func (q *Queue) sendReport(ctx context.Context, s *settings, domain string, report *tlsReport, body []byte, uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+		req, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/tlsrpt+gzip")
+		resp, err := rptClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("the report was not accepted, %s", resp.Status)
+		}
+		return nil
+	case "mailto":
+		rcpt := u.Opaque
+		if i := strings.IndexByte(rcpt, '?'); i >= 0 {
+			rcpt = rcpt[:i]
+		}
+		if rcpt, err = url.PathUnescape(rcpt); err != nil || !strings.Contains(rcpt, "@") {
+			return fmt.Errorf("[%s] is not an address", uri)
+		}
+		msg := newReportMessage(s, domain, report, body)
+		_, err = q.add(s, "tlsrpt-"+mail.ULID(0), s.tlsRPTContact, []string{rcpt}, func(w io.Writer) error {
+			_, err := w.Write(msg)
+			return err
+		})
+		return err
+	}
+	return fmt.Errorf("the scheme of [%s] is not supported", uri)
+}
+
+// newReportMessage returns the message of a report sent by mail, RFC 8460 5.3
+func newReportMessage(s *settings, domain string, report *tlsReport, body []byte) []byte {
+	var b bytes.Buffer
+	boundary := "=_tlsrpt_" + mail.ULID(0)
+	filename := fmt.Sprintf("%s!%s!%d!%d.json.gz", s.tlsRPTOrg, domain,
+		report.DateRange.Start.Unix(), report.DateRange.End.Unix())
+	fmt.Fprintf(&b, "From: <%s>\r\n", s.tlsRPTContact)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", domain, s.tlsRPTOrg, report.ID)
+	fmt.Fprintf(&b, "TLS-Report-Domain: %s\r\n", domain)
+	fmt.Fprintf(&b, "TLS-Report-Submitter: %s\r\n", s.tlsRPTOrg)
+	fmt.Fprintf(&b, "Message-ID: <%s>\r\n", report.ID)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=\"tlsrpt\"; boundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "This is an aggregate TLS report from %s.\r\n\r\n", s.tlsRPTOrg)
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	b.WriteString("Content-Type: application/tlsrpt+gzip\r\n")
+	b.WriteString("Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(&b, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", filename)
+	encoded := base64.StdEncoding.EncodeToString(body)
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+	return b.Bytes()
+}
@@ -0,0 +1,129 @@
+package outbound
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/tests/testcert"
+)
+
+func TestTLSResultType(t *testing.T) {
+	for err, want := range map[error]string{
+		x509.HostnameError{Host: "mx.example.com"}:         resultCertHostMismatch,
+		x509.UnknownAuthorityError{}:                       resultCertNotTrusted,
+		x509.CertificateInvalidError{Reason: x509.Expired}: resultCertExpired,
+		errors.New("no TLSA record matches"):               resultValidationFailure,
+	} {
+		if got := tlsResultType(err); got != want {
+			t.Errorf("%v: got %s, want %s", err, got, want)
+		}
+	}
+}
+
+func TestTLSRPT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := testcert.GenerateCert("mx.example.com", "", time.Hour, false, 2048, "P256", dir+"/"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(dir+"/mx.example.com.cert.pem", dir+"/mx.example.com.key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mx := newFakeMX(t)
+	mx.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	r := newFakeResolver()
+	defer install(r, mx)()
+
+	// the policy of example.com is tested, the certificate of its MX is not trusted
+	policies := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprint(w, "version: STSv1\nmode: testing\nmx: mx.example.com\nmax_age: 86400\n")
+	}))
+	defer policies.Close()
+	reports := make(chan *tlsReport, 1)
+	collector := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := &tlsReport{}
+		if req.Header.Get("Content-Type") == "application/tlsrpt+gzip" {
+			if zr, err := gzip.NewReader(req.Body); err == nil {
+				_ = json.NewDecoder(zr).Decode(report)
+			}
+		}
+		reports <- report
+	}))
+	defer collector.Close()
+	savedURL, savedClient := stsURL, rptClient
+	defer func() { stsURL, rptClient = savedURL, savedClient }()
+	stsURL = func(domain string) string { return policies.URL + "/" + domain }
+	rptClient = collector.Client()
+	r.Lock()
+	r.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=20200501"}
+	r.txt["_smtp._tls.example.com"] = []string{"v=TLSRPTv1; rua=" + collector.URL + ",mailto:tlsrpt@example.com"}
+	r.Unlock()
+
+	q, cleanup := testQueue(t, Config{MTASTS: true, TLSRPT: true, TLSRPTOrg: "Example Org"})
+	defer cleanup()
+	if _, err := q.Enqueue(testEnvelope("alice@example.org", "good@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the delivery", func() bool { return q.Len() == 0 })
+	if msgs := mx.received(); len(msgs) != 1 || !msgs[0].tls {
+		t.Fatalf("the message should be sent over TLS, without verification: %+v", msgs)
+	}
+	if _, err := os.Stat(q.settings.dir + "/" + stsFile); err != nil {
+		t.Error("the MTA-STS policies should be saved:", err)
+	}
+
+	q.sendReports(time.Now())
+	var report *tlsReport
+	select {
+	case report = <-reports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the report was not posted")
+	}
+	if report.Organization != "Example Org" || report.Contact != "postmaster@out.example.org" || len(report.Policies) != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	p := report.Policies[0]
+	if p.Policy.Type != policySTS || p.Policy.Domain != "example.com" || len(p.Policy.Strings) != 4 ||
+		p.Policy.MX[0] != "mx.example.com" {
+		t.Errorf("unexpected policy: %+v", p.Policy)
+	}
+	if p.Summary.Successful != 0 || p.Summary.Failed != 1 || len(p.Failures) != 1 {
+		t.Fatalf("expecting a failed session, got %+v", p.Summary)
+	}
+	if f := p.Failures[0]; f.ResultType != resultCertNotTrusted || f.ReceivingMX != "mx.example.com" ||
+		f.ReceivingIP != "127.0.0.1" || f.Count != 1 {
+		t.Errorf("unexpected failure: %+v", f)
+	}
+
+	// the report sent by mail is delivered by the queue
+	waitFor(t, "the report by mail", func() bool { return len(mx.received()) == 2 && q.Len() == 0 })
+	msg := mx.received()[1]
+	if msg.from != "postmaster@out.example.org" || msg.rcpts[0] != "tlsrpt@example.com" ||
+		!strings.Contains(msg.data, "TLS-Report-Domain: example.com\r\n") ||
+		!strings.Contains(msg.data, "Content-Type: application/tlsrpt+gzip\r\n") {
+		t.Errorf("unexpected report by mail: %+v", msg)
+	}
+
+	// the sessions were sent, the next reports start again
+	q.sendReports(time.Now())
+	select {
+	case <-reports:
+		t.Error("there should be no report without sessions")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,82 @@
+package guerrilla
+
+import (
+	"net"
+	"time"
+)
+
+// PolicyAction is what a ConnectionPolicy decides to do with a connection
+type PolicyAction int
+
+const (
+	// PolicyAllow lets the connection proceed, to the reputation checks if any
+	PolicyAllow PolicyAction = iota
+	// PolicyDeny sends a 554 instead of the greeting, then closes the connection
+	PolicyDeny
+	// PolicyTarpit lets the connection proceed, but holds each reply for the server's tarpit_delay
+	PolicyTarpit
+)
+
+// defaultTarpitDelay is the tarpit_delay when it's not set, in seconds
+const defaultTarpitDelay = 10
+
+func (a PolicyAction) String() string {
+	switch a {
+	case PolicyAllow:
+		return "allow"
+	case PolicyDeny:
+		return "deny"
+	case PolicyTarpit:
+		return "tarpit"
+	}
+	return "unknown"
+}
+
+// ConnectionPolicy decides what to do with each connection as it's accepted, before the greeting is sent,
+// eg. to block countries or the addresses of a custom list without a processor. It must be safe for concurrent use
+type ConnectionPolicy interface {
+	// Connect is called with the IP address of the client and the listen interface of the server
+	Connect(ip net.IP, listener string) PolicyAction
+}
+
+// ConnectionPolicyFunc is a function that implements ConnectionPolicy
+type ConnectionPolicyFunc func(ip net.IP, listener string) PolicyAction
+
+func (f ConnectionPolicyFunc) Connect(ip net.IP, listener string) PolicyAction {
+	return f(ip, listener)
+}
+
+// policyHolder holds the ConnectionPolicy of a server, atomic.Value cannot store a nil interface
+type policyHolder struct {
+	policy ConnectionPolicy
+}
+
+func (s *server) setConnectionPolicy(p ConnectionPolicy) {
+	s.policyStore.Store(policyHolder{p})
+}
+
+// checkPolicy returns what the connection policy decided for the client, PolicyAllow if there is none
+func (s *server) checkPolicy(c *client) PolicyAction {
+	if h, ok := s.policyStore.Load().(policyHolder); ok && h.policy != nil {
+		return h.policy.Connect(net.ParseIP(c.peer), s.listenInterface)
+	}
+	return PolicyAllow
+}
+
+// tarpitDelay returns how long to hold each reply to a tarpitted client
+func (sc *ServerConfig) tarpitDelay() time.Duration {
+	if sc.TarpitDelay == 0 {
+		return defaultTarpitDelay * time.Second
+	}
+	return time.Duration(sc.TarpitDelay) * time.Second
+}
+
+// tarpit holds a reply for d, or until the server shuts down
+func (s *server) tarpit(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.ctx.Done():
+	}
+}
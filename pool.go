@@ -1,9 +1,12 @@
 package guerrilla
 
 import (
+	"bufio"
 	"errors"
+	"github.com/flashmob/go-guerrilla/clock"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -18,11 +21,15 @@ var (
 type Poolable interface {
 	// ability to set read/write timeout
 	setTimeout(t time.Duration) error
-	// set a new connection and client id
-	init(c net.Conn, clientID uint64, ep *mail.Pool)
+	// set a new connection and client id, and borrow buffers of the given sizes
+	init(c net.Conn, clientID uint64, ep *mail.Pool, sizes bufferSizes)
+	// release the buffers once the connection is closed
+	release()
 	// get a unique id
 	getID() uint64
 	kill()
+	// true if waiting for a command between transactions
+	idle() bool
 }
 
 // Pool holds Clients.
@@ -36,6 +43,12 @@ type Pool struct {
 	isShuttingDownFlg atomic.Value
 	poolGuard         sync.Mutex
 	ShutdownChan      chan int
+	// bufferSizes stores the bufferSizes of the clients borrowed
+	bufferSizes atomic.Value
+	// shutdownAt stores the time.Time when ShutdownState was called
+	shutdownAt atomic.Value
+	// clockStore stores the clock that times the shutdown, see SetClock
+	clockStore clock.Value
 }
 
 type lentClients struct {
@@ -73,19 +86,22 @@ func (p *Pool) Start() {
 	p.isShuttingDownFlg.Store(true)
 }
 
-// Lock the pool from borrowing then remove all active clients
-// each active client's timeout is lowered to 1 sec and notified
-// to stop accepting commands
+// Lock the pool from borrowing then remove all active clients.
+// The clients waiting for a command between transactions are woken up to be told to disconnect,
+// the others are notified to stop accepting commands once they finish their transaction
 func (p *Pool) ShutdownState() {
-	const aVeryLowTimeout = 1
 	p.poolGuard.Lock() // ensure no other thread is in the borrowing now
 	defer p.poolGuard.Unlock()
+	p.shutdownAt.Store(p.clock().Now())
 	p.isShuttingDownFlg.Store(true) // no more borrowing
 	p.ShutdownChan <- 1             // release any waiting p.sem
 
-	// set a low timeout (let the clients finish whatever the're doing)
+	// time out the idle clients' reads now, the clients in a transaction are left to finish it
 	p.activeClients.mapAll(func(p Poolable) {
-		if err := p.setTimeout(time.Duration(int64(aVeryLowTimeout))); err != nil {
+		if !p.idle() {
+			return
+		}
+		if err := p.setTimeout(0); err != nil {
 			p.kill()
 		}
 	})
@@ -111,6 +127,26 @@ func (p *Pool) IsShuttingDown() bool {
 	return false
 }
 
+// shutdownElapsed returns how long the pool has been shutting down, 0 if it's not
+func (p *Pool) shutdownElapsed() time.Duration {
+	if !p.IsShuttingDown() {
+		return 0
+	}
+	if at, ok := p.shutdownAt.Load().(time.Time); ok {
+		return p.clock().Now().Sub(at)
+	}
+	return 0
+}
+
+// SetClock sets the clock that tells how long the pool has been shutting down, nil for the real clock
+func (p *Pool) SetClock(c clock.Clock) {
+	p.clockStore.Store(c)
+}
+
+func (p *Pool) clock() clock.Clock {
+	return p.clockStore.Load()
+}
+
 // set a timeout for all lent clients
 func (p *Pool) SetTimeout(duration time.Duration) {
 	p.activeClients.mapAll(func(p Poolable) {
@@ -126,12 +162,19 @@ func (p *Pool) GetActiveClientsCount() int {
 	return len(p.sem)
 }
 
+// SetBufferSizes sets the sizes of the read and write buffers of the clients borrowed from now on,
+// DefaultBufferSize if 0
+func (p *Pool) SetBufferSizes(read, write int) {
+	p.bufferSizes.Store(bufferSizes{read: read, write: write})
+}
+
 // Borrow a Client from the pool. Will block if len(activeClients) > maxClients
 func (p *Pool) Borrow(conn net.Conn, clientID uint64, logger log.Logger, ep *mail.Pool) (Poolable, error) {
 	p.poolGuard.Lock()
 	defer p.poolGuard.Unlock()
 
 	var c Poolable
+	sizes, _ := p.bufferSizes.Load().(bufferSizes)
 	if yes, really := p.isShuttingDownFlg.Load().(bool); yes && really {
 		// pool is shutting down.
 		return c, ErrPoolShuttingDown
@@ -140,9 +183,9 @@ func (p *Pool) Borrow(conn net.Conn, clientID uint64, logger log.Logger, ep *mai
 	case p.sem <- true: // block the client from serving until there is room
 		select {
 		case c = <-p.pool:
-			c.init(conn, clientID, ep)
+			c.init(conn, clientID, ep, sizes)
 		default:
-			c = NewClient(conn, clientID, logger, ep)
+			c = newClient(conn, clientID, logger, ep, sizes)
 		}
 		p.activeClientsAdd(c)
 
@@ -156,6 +199,7 @@ func (p *Pool) Borrow(conn net.Conn, clientID uint64, logger log.Logger, ep *mai
 // Return returns a Client back to the pool.
 func (p *Pool) Return(c Poolable) {
 	p.activeClientsRemove(c)
+	c.release()
 	select {
 	case p.pool <- c:
 	default:
@@ -178,3 +222,83 @@ func (p *Pool) activeClientsRemove(c Poolable) {
 		p.activeClients.wg.Done()
 	}, c)
 }
+
+const (
+	// DefaultBufferSize is the size of the clients' read and write buffers when it's not configured
+	DefaultBufferSize = 4096
+	// MinReadBufferSize is the smallest read buffer, it holds the longest command line
+	MinReadBufferSize = CommandLineMaxLength + 1
+)
+
+// bufferSizes are the sizes of a client's read and write buffers, DefaultBufferSize if 0
+type bufferSizes struct {
+	read, write int
+}
+
+// ioBuffers pools the readers and writers of the clients of all the servers
+var ioBuffers = bufferPool{
+	readers: make(map[int]*sync.Pool),
+	writers: make(map[int]*sync.Pool),
+}
+
+// bufferPool pools bufio readers and writers, keyed by size
+type bufferPool struct {
+	readers map[int]*sync.Pool
+	writers map[int]*sync.Pool
+	sync.Mutex
+}
+
+// pool returns the pool of the buffers of size in m, alloc allocates the buffers
+func (b *bufferPool) pool(m map[int]*sync.Pool, size int, alloc func(size int) interface{}) *sync.Pool {
+	b.Lock()
+	defer b.Unlock()
+	p, ok := m[size]
+	if !ok {
+		p = &sync.Pool{New: func() interface{} {
+			return alloc(size)
+		}}
+		m[size] = p
+	}
+	return p
+}
+
+func newReader(size int) interface{} {
+	return bufio.NewReaderSize(nil, size)
+}
+
+func newWriter(size int) interface{} {
+	return bufio.NewWriterSize(nil, size)
+}
+
+// reader borrows a reader of size that reads from r
+func (b *bufferPool) reader(r io.Reader, size int) *bufio.Reader {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	br := b.pool(b.readers, size, newReader).Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+// putReader returns a reader
+func (b *bufferPool) putReader(br *bufio.Reader) {
+	// don't keep the connection referenced
+	br.Reset(nil)
+	b.pool(b.readers, br.Size(), newReader).Put(br)
+}
+
+// writer borrows a writer of size that writes to w
+func (b *bufferPool) writer(w io.Writer, size int) *bufio.Writer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	bw := b.pool(b.writers, size, newWriter).Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+// putWriter returns a writer, anything buffered is discarded
+func (b *bufferPool) putWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	b.pool(b.writers, bw.Size(), newWriter).Put(bw)
+}
@@ -0,0 +1,85 @@
+package guerrilla
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+)
+
+// pprofHost is the only interface pprof listens on, the profiles must not be reachable from the network
+const pprofHost = "127.0.0.1"
+
+// validatePprofPort checks the pprof_port setting, 0 disables pprof
+func validatePprofPort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("pprof_port [%d] is not a valid port", port)
+	}
+	return nil
+}
+
+// newPprofServer returns a server for the net/http/pprof handlers, eg. /debug/pprof/goroutine?debug=2
+func newPprofServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return &http.Server{Handler: mux}
+}
+
+// startPprof starts serving pprof on localhost, if pprof_port is set in the config
+func (d *Daemon) startPprof() error {
+	d.adminGuard.Lock()
+	defer d.adminGuard.Unlock()
+	if d.pprof != nil || d.Config.PprofPort == 0 {
+		return nil
+	}
+	if err := validatePprofPort(d.Config.PprofPort); err != nil {
+		return err
+	}
+	iface := net.JoinHostPort(pprofHost, strconv.Itoa(d.Config.PprofPort))
+	l, err := net.Listen("tcp", iface)
+	if err != nil {
+		return fmt.Errorf("pprof cannot listen on [%s]: %s", iface, err)
+	}
+	srv := newPprofServer()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			d.Log().WithError(err).Error("pprof stopped")
+		}
+	}()
+	d.pprof = srv
+	d.Log().Infof("pprof listening on http://%s/debug/pprof/", l.Addr())
+	return nil
+}
+
+// stopPprof stops serving pprof, if it's running
+func (d *Daemon) stopPprof() {
+	d.adminGuard.Lock()
+	defer d.adminGuard.Unlock()
+	if d.pprof == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	if err := d.pprof.Shutdown(ctx); err != nil {
+		// a profile may still be running, don't wait for it
+		_ = d.pprof.Close()
+	}
+	d.pprof = nil
+}
+
+// reloadPprof restarts pprof on the new port if pprof_port changed
+func (d *Daemon) reloadPprof(oldPort int) {
+	if d.Config.PprofPort == oldPort {
+		return
+	}
+	d.stopPprof()
+	if err := d.startPprof(); err != nil {
+		d.Log().WithError(err).Error("could not restart pprof")
+	}
+}
@@ -0,0 +1,47 @@
+package guerrilla
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPprof(t *testing.T) {
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		PprofPort:    2651,
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2652", IsEnabled: true}},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	const url = "http://127.0.0.1:2651/debug/pprof/goroutine?debug=1"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine profile") {
+		t.Error("expecting a goroutine profile, got", resp.StatusCode)
+	}
+
+	newConfig := *d.Config
+	newConfig.PprofPort = 0
+	if err := d.ReloadConfig(newConfig); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.Get(url); err == nil {
+		_ = resp.Body.Close()
+		t.Error("expecting pprof to be stopped after the reload")
+	}
+
+	newConfig.PprofPort = 70000
+	if err := d.ReloadConfig(newConfig); err == nil {
+		t.Error("expecting an invalid port to be rejected")
+	}
+}
@@ -0,0 +1,138 @@
+package guerrilla
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ClientInfo describes a connected client, as listed by Daemon.Clients
+type ClientInfo struct {
+	// ID of the client, unique for the listener
+	ID uint64 `json:"id"`
+	// Listener is the listen interface of the server the client is connected to
+	Listener string `json:"listener"`
+	// Peer is the IP address the client connected from
+	Peer string `json:"peer"`
+	// State is the part of the SMTP session the client is in, eg. "cmd" or "data"
+	State string `json:"state"`
+	// BytesIn and BytesOut count the bytes read from and written to the connection
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// Commands are the last commands of the client, oldest first, when command_history is set.
+	// Only in the client:disconnect events, and the message:rejected events
+	Commands []string `json:"commands,omitempty"`
+}
+
+// String returns the name of the state
+func (s ClientState) String() string {
+	switch s {
+	case ClientGreeting:
+		return "greeting"
+	case ClientCmd:
+		return "cmd"
+	case ClientData:
+		return "data"
+	case ClientStartTLS:
+		return "starttls"
+	case ClientShutdown:
+		return "shutdown"
+	}
+	return "unknown"
+}
+
+// countingConn counts the bytes read from and written to a connection, goroutine safe
+type countingConn struct {
+	net.Conn
+	read    uint64
+	written uint64
+}
+
+func (c *countingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddUint64(&c.read, uint64(n))
+	return
+}
+
+func (c *countingConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return
+}
+
+// setState changes the state of the client's session, keeping a copy for the registry
+func (c *client) setState(state ClientState) {
+	c.state = state
+	atomic.StoreInt32(&c.registryState, int32(state))
+}
+
+// info returns a snapshot of the client, it can be called from any goroutine
+func (c *client) info(listener string) ClientInfo {
+	return ClientInfo{
+		ID:          c.ID,
+		Listener:    listener,
+		Peer:        c.peer,
+		State:       ClientState(atomic.LoadInt32(&c.registryState)).String(),
+		BytesIn:     atomic.LoadUint64(&c.counter.read),
+		BytesOut:    atomic.LoadUint64(&c.counter.written),
+		ConnectedAt: c.ConnectedAt,
+	}
+}
+
+// disconnect closes the client's connection, goroutine safe.
+// The client's session ends when its next read or write fails
+func (c *client) disconnect() {
+	defer c.connGuard.Unlock()
+	c.connGuard.Lock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
+
+// clients returns a snapshot of the clients connected to the server
+func (s *server) clients() []ClientInfo {
+	var list []ClientInfo
+	s.clientPool.activeClients.mapAll(func(p Poolable) {
+		list = append(list, p.(*client).info(s.listenInterface))
+	})
+	return list
+}
+
+// disconnectClients disconnects the clients for which match returns true, returning how many
+func (s *server) disconnectClients(match func(ClientInfo) bool) int {
+	n := 0
+	s.clientPool.activeClients.mapAll(func(p Poolable) {
+		c := p.(*client)
+		if match(c.info(s.listenInterface)) {
+			c.disconnect()
+			n++
+		}
+	})
+	return n
+}
+
+// clients returns the clients connected to all servers, sorted by listener then by ID
+func (g *guerrilla) clients() []ClientInfo {
+	var list []ClientInfo
+	g.mapServers(func(s *server) {
+		list = append(list, s.clients()...)
+	})
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Listener != list[j].Listener {
+			return list[i].Listener < list[j].Listener
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// disconnectClients disconnects the matching clients of all servers, returning how many
+func (g *guerrilla) disconnectClients(match func(ClientInfo) bool) int {
+	n := 0
+	g.mapServers(func(s *server) {
+		n += s.disconnectClients(match)
+	})
+	return n
+}
@@ -0,0 +1,59 @@
+package guerrilla
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/response"
+)
+
+// replies are the greeting, the HELO/EHLO replies and the relay denial of a server, made once for each config of
+// the server instead of for each client
+type replies struct {
+	// greeting is the start of the 220 greeting, the client's id, the active clients and the time follow
+	greeting string
+	helo     string
+	// ehlo advertises the extensions, ehloTLS advertises STARTTLS too
+	ehlo    string
+	ehloTLS string
+	// relayDenied rejects the recipients of the domains that are not allowed, the domain follows
+	relayDenied string
+}
+
+func newReplies(sc *ServerConfig) *replies {
+	size := "250-SIZE " + strconv.FormatInt(sc.MaxSize, 10) + "\r\n"
+	if sc.Strict7Bit != "" {
+		// so that the clients can declare the 8-bit messages
+		size += "250-8BITMIME\r\n"
+	}
+	// the last line has no dash, and doesn't need \r\n since it's sent as a line
+	return &replies{
+		greeting: "220 " + sc.Hostname + " SMTP Guerrilla(" + Version + ") #",
+		helo:     "250 " + sc.Hostname + " Hello",
+		ehlo: "250-" + sc.Hostname + " Hello\r\n" + size + "250-PIPELINING\r\n" +
+			"250-ENHANCEDSTATUSCODES\r\n250 HELP",
+		ehloTLS: "250-" + sc.Hostname + " Hello\r\n" + size + "250-PIPELINING\r\n" +
+			"250-STARTTLS\r\n250-ENHANCEDSTATUSCODES\r\n250 HELP",
+		relayDenied: relayDenied(sc),
+	}
+}
+
+// relayDenied returns the relay_denied_response of the server, or the canned response
+func relayDenied(sc *ServerConfig) string {
+	if sc.RelayDeniedResponse != "" {
+		return sc.RelayDeniedResponse
+	}
+	return response.Canned.ErrorRelayDenied.String()
+}
+
+// greetingFor returns the greeting of the client, with its id, the number of active clients and the time
+func (r *replies) greetingFor(id uint64, active int, now time.Time) string {
+	b := make([]byte, 0, len(r.greeting)+48)
+	b = append(b, r.greeting...)
+	b = strconv.AppendUint(b, id, 10)
+	b = append(b, " ("...)
+	b = strconv.AppendInt(b, int64(active), 10)
+	b = append(b, ") "...)
+	b = now.AppendFormat(b, time.RFC3339)
+	return string(b)
+}
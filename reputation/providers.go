@@ -0,0 +1,168 @@
+package reputation
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/dnscache"
+)
+
+// List scores the addresses of a list of networks. It's safe for concurrent use
+type List struct {
+	networks []*net.IPNet
+	score    float64
+	reason   string
+}
+
+// NewList returns the list of c, reading its file if it has one
+func NewList(c ListConfig) (*List, error) {
+	l := &List{score: c.Score, reason: c.Reason}
+	if l.reason == "" {
+		l.reason = "list"
+	}
+	networks := c.Networks
+	if c.File != "" {
+		lines, err := readLines(c.File)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(append([]string(nil), networks...), lines...)
+	}
+	for _, s := range networks {
+		n, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		l.networks = append(l.networks, n)
+	}
+	return l, nil
+}
+
+// Score returns the score of the list if ip is in one of its networks
+func (l *List) Score(ip net.IP) (Score, error) {
+	for _, n := range l.networks {
+		if n.Contains(ip) {
+			return Score{Value: l.score, Reason: l.reason}, nil
+		}
+	}
+	return Score{}, nil
+}
+
+// parseNetwork parses a network in CIDR notation, or a single address
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network [%s]", s)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network [%s]", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// readLines returns the lines of a file, without the blank lines and the comments
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// LookupFunc resolves a host name to its addresses, like net.Resolver.LookupHost
+type LookupFunc func(ctx context.Context, host string) ([]string, error)
+
+// DNSBL scores the addresses listed in a DNS block list. It's safe for concurrent use
+type DNSBL struct {
+	zone    string
+	score   float64
+	codes   map[string]float64
+	timeout time.Duration
+	// Lookup resolves the queries, the LookupHost of dnscache.Default if nil
+	Lookup LookupFunc
+}
+
+// NewDNSBL returns the DNSBL of c, its lookups time out after timeout
+func NewDNSBL(c DNSBLConfig, timeout time.Duration) *DNSBL {
+	return &DNSBL{
+		zone:    strings.Trim(c.Zone, "."),
+		score:   c.Score,
+		codes:   c.Codes,
+		timeout: timeout,
+	}
+}
+
+// Score looks up ip in the zone. An address that is not listed scores 0
+func (d *DNSBL) Score(ip net.IP) (Score, error) {
+	lookup := d.Lookup
+	if lookup == nil {
+		lookup = dnscache.Default().LookupHost
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	addrs, err := lookup(ctx, reverse(ip)+"."+d.zone)
+	if err != nil {
+		// not listed
+		if dnscache.IsNotFound(err) {
+			return Score{}, nil
+		}
+		return Score{}, fmt.Errorf("dnsbl [%s]: %s", d.zone, err)
+	}
+	s := Score{Reason: d.zone}
+	for _, a := range addrs {
+		code := net.ParseIP(a).To4()
+		if code == nil || code[0] != 127 {
+			continue
+		}
+		if code[1] == 255 && code[2] == 255 {
+			// 127.255.255.0/24 are errors, eg. the query was refused
+			return Score{}, errors.New("dnsbl [" + d.zone + "] returned the error code " + a)
+		}
+		if d.codes == nil {
+			s.Value = d.score
+			break
+		}
+		s.Value += d.codes[code.String()]
+	}
+	return s, nil
+}
+
+// reverse returns ip in the order of the DNSBL queries, eg. 2.0.0.127 for 127.0.0.2,
+// the IPv6 addresses are reversed nibble by nibble
+func reverse(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hex = "0123456789abcdef"
+	b := make([]byte, 0, 63)
+	for i := len(ip) - 1; i >= 0; i-- {
+		if len(b) > 0 {
+			b = append(b, '.')
+		}
+		b = append(b, hex[ip[i]&0xf], '.', hex[ip[i]>>4])
+	}
+	return string(b)
+}
@@ -0,0 +1,368 @@
+// Package reputation scores the IP addresses of clients with providers, such as local lists and DNSBLs,
+// and decides what to do with them: accept, tag, greylist or reject
+package reputation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+const (
+	// DefaultCacheTTL is how long a score is cached when its provider did not say
+	DefaultCacheTTL = 10 * time.Minute
+	// DefaultGreylistDelay is how long a greylisted sender must wait before trying again
+	DefaultGreylistDelay = 5 * time.Minute
+	// DefaultGreylistExpire is how long a greylisted sender is remembered
+	DefaultGreylistExpire = 36 * time.Hour
+	// DefaultTimeout is the timeout of the DNSBL lookups
+	DefaultTimeout = 3 * time.Second
+	// the cached scores and greylisted senders are pruned when there are more than this
+	maxEntries = 100000
+	// how long the score is cached when a provider failed
+	failedTTL = time.Minute
+)
+
+// Provider scores the IP addresses of clients. Higher scores are worse, negative scores vouch for an address.
+// It must be safe for concurrent use
+type Provider interface {
+	Score(ip net.IP) (Score, error)
+}
+
+// Score is how bad an IP address is
+type Score struct {
+	Value float64
+	// Reason says why, eg. the DNSBL zone listing the address
+	Reason string
+	// TTL is how long the score can be cached, DefaultCacheTTL if 0
+	TTL time.Duration
+}
+
+// String returns the value and the reason, eg. "7.5 zen.spamhaus.org"
+func (s Score) String() string {
+	v := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", s.Value), "0"), ".")
+	if s.Reason == "" {
+		return v
+	}
+	return v + " " + s.Reason
+}
+
+// Action is what to do with a client, depending on its score
+type Action int
+
+const (
+	// Accept the client
+	Accept Action = iota
+	// Tag the messages of the client, eg. with a header
+	Tag
+	// Greylist the client, defer its recipients until it tries again after the greylist delay
+	Greylist
+	// Reject the client
+	Reject
+)
+
+func (a Action) String() string {
+	switch a {
+	case Tag:
+		return "tag"
+	case Greylist:
+		return "greylist"
+	case Reject:
+		return "reject"
+	}
+	return "accept"
+}
+
+// Config configures the providers and the policy. Each threshold applies when the score is at least
+// its value, it's disabled if 0. Reputation checks are disabled when no threshold is set
+type Config struct {
+	// Lists are local lists of networks with their score
+	Lists []ListConfig `json:"lists,omitempty"`
+	// DNSBL are the DNS block lists to query
+	DNSBL []DNSBLConfig `json:"dnsbl,omitempty"`
+	// RejectScore is the score from which clients are rejected when they connect
+	RejectScore float64 `json:"reject_score,omitempty"`
+	// GreylistScore is the score from which recipients are greylisted
+	GreylistScore float64 `json:"greylist_score,omitempty"`
+	// TagScore is the score from which the messages are tagged with an X-Reputation header,
+	// added by the Header processor
+	TagScore float64 `json:"tag_score,omitempty"`
+	// GreylistDelay is how long a greylisted sender must wait before trying again, eg. "5m"
+	GreylistDelay string `json:"greylist_delay,omitempty"`
+	// GreylistExpire is how long a greylisted sender is remembered, eg. "36h"
+	GreylistExpire string `json:"greylist_expire,omitempty"`
+	// CacheTTL is how long the scores are cached when the providers don't say, eg. "10m"
+	CacheTTL string `json:"cache_ttl,omitempty"`
+	// Timeout is the timeout of the DNSBL lookups, eg. "3s"
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ListConfig is a list of networks, or single addresses, with the score they get
+type ListConfig struct {
+	Networks []string `json:"networks,omitempty"`
+	// File is the path of a file with one network per line. Lines starting with # are ignored
+	File   string  `json:"file,omitempty"`
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// DNSBLConfig is a DNSBL zone, eg. "zen.spamhaus.org"
+type DNSBLConfig struct {
+	Zone string `json:"zone"`
+	// Score is the score of the listed addresses
+	Score float64 `json:"score"`
+	// Codes gives the score of each return code instead, eg. {"127.0.0.2": 10, "127.0.0.10": 2}.
+	// The scores of the codes returned are added up
+	Codes map[string]float64 `json:"codes,omitempty"`
+}
+
+// Enabled returns true if any threshold is set
+func (c *Config) Enabled() bool {
+	return c.RejectScore != 0 || c.GreylistScore != 0 || c.TagScore != 0
+}
+
+// Validate checks the config, an empty config is valid
+func (c *Config) Validate() error {
+	for _, d := range []struct {
+		name, value string
+	}{
+		{"greylist_delay", c.GreylistDelay},
+		{"greylist_expire", c.GreylistExpire},
+		{"cache_ttl", c.CacheTTL},
+		{"timeout", c.Timeout},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v <= 0 {
+			return fmt.Errorf("reputation %s [%s] is not a valid duration", d.name, d.value)
+		}
+	}
+	for _, l := range c.Lists {
+		if len(l.Networks) == 0 && l.File == "" {
+			return errors.New("reputation lists need networks or a file")
+		}
+		if _, err := NewList(l); err != nil {
+			return fmt.Errorf("reputation list: %s", err)
+		}
+	}
+	for _, d := range c.DNSBL {
+		if strings.Trim(d.Zone, ".") == "" {
+			return errors.New("reputation dnsbl needs a zone")
+		}
+		for code := range d.Codes {
+			if net.ParseIP(code).To4() == nil {
+				return fmt.Errorf("reputation dnsbl [%s] code [%s] is not an IPv4 address", d.Zone, code)
+			}
+		}
+	}
+	return nil
+}
+
+func duration(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// Checker consults the providers and applies the policy. It's safe for concurrent use
+type Checker struct {
+	mu        sync.Mutex
+	config    Config
+	enabled   bool
+	providers []Provider
+	// custom are the providers added with SetProviders
+	custom   []Provider
+	cache    map[string]cachedScore
+	greylist map[string]time.Time
+	clock    clock.Clock
+	log      log.Logger
+}
+
+type cachedScore struct {
+	score   Score
+	expires time.Time
+}
+
+// New returns a checker configured with c. The errors of the lists are logged, see Reconfigure
+func New(c Config, l log.Logger) *Checker {
+	ch := &Checker{
+		cache:    make(map[string]cachedScore),
+		greylist: make(map[string]time.Time),
+		clock:    clock.Real,
+	}
+	ch.Reconfigure(c, l)
+	return ch
+}
+
+// Reconfigure applies a new config. The cached scores are dropped, the greylisted senders are kept.
+// A list that cannot be read is logged and left out
+func (ch *Checker) Reconfigure(c Config, l log.Logger) {
+	timeout := duration(c.Timeout, DefaultTimeout)
+	var providers []Provider
+	for _, lc := range c.Lists {
+		list, err := NewList(lc)
+		if err != nil {
+			l.WithError(err).Error("could not load the reputation list")
+			continue
+		}
+		providers = append(providers, list)
+	}
+	for _, dc := range c.DNSBL {
+		providers = append(providers, NewDNSBL(dc, timeout))
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.config = c
+	ch.enabled = c.Enabled()
+	ch.providers = providers
+	ch.log = l
+	ch.cache = make(map[string]cachedScore)
+}
+
+// SetProviders sets providers to consult in addition to those of the config, eg. from an embedding program
+func (ch *Checker) SetProviders(providers []Provider) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.custom = providers
+	ch.cache = make(map[string]cachedScore)
+}
+
+// SetClock sets the clock for the cache and the greylisting, nil for the real one
+func (ch *Checker) SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.clock = c
+}
+
+// Enabled returns true if the config sets a threshold
+func (ch *Checker) Enabled() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.enabled
+}
+
+// Check scores ip and returns what to do with the client
+func (ch *Checker) Check(ip net.IP) (Score, Action) {
+	ch.mu.Lock()
+	if !ch.enabled || ip == nil {
+		ch.mu.Unlock()
+		return Score{}, Accept
+	}
+	key := ip.String()
+	now := ch.clock.Now()
+	cached, ok := ch.cache[key]
+	providers := append(append([]Provider(nil), ch.providers...), ch.custom...)
+	c, l := ch.config, ch.log
+	ch.mu.Unlock()
+
+	score := cached.score
+	if !ok || !now.Before(cached.expires) {
+		score = ch.score(ip, providers, duration(c.CacheTTL, DefaultCacheTTL), l)
+		ch.mu.Lock()
+		if len(ch.cache) >= maxEntries {
+			for k, v := range ch.cache {
+				if !now.Before(v.expires) {
+					delete(ch.cache, k)
+				}
+			}
+		}
+		if len(ch.cache) < maxEntries {
+			ch.cache[key] = cachedScore{score: score, expires: now.Add(score.TTL)}
+		}
+		ch.mu.Unlock()
+	}
+	return score, c.action(score.Value)
+}
+
+// Tagged returns true if the messages of a client with the given score should be tagged
+func (ch *Checker) Tagged(s Score) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.config.TagScore != 0 && s.Value >= ch.config.TagScore
+}
+
+// action returns what to do with a client of the given score
+func (c *Config) action(score float64) Action {
+	switch {
+	case c.RejectScore != 0 && score >= c.RejectScore:
+		return Reject
+	case c.GreylistScore != 0 && score >= c.GreylistScore:
+		return Greylist
+	case c.TagScore != 0 && score >= c.TagScore:
+		return Tag
+	}
+	return Accept
+}
+
+// score asks all the providers at once and adds up their scores. The TTL is the shortest of the providers'
+func (ch *Checker) score(ip net.IP, providers []Provider, ttl time.Duration, l log.Logger) Score {
+	scores := make([]Score, len(providers))
+	var wg sync.WaitGroup
+	for i := range providers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := providers[i].Score(ip)
+			if err != nil {
+				l.WithError(err).Warnf("reputation of [%s] could not be checked", ip)
+				s = Score{TTL: failedTTL}
+			}
+			scores[i] = s
+		}(i)
+	}
+	wg.Wait()
+	total := Score{TTL: ttl}
+	var reasons []string
+	for _, s := range scores {
+		total.Value += s.Value
+		if s.Value != 0 && s.Reason != "" {
+			reasons = append(reasons, s.Reason)
+		}
+		if s.TTL > 0 && s.TTL < total.TTL {
+			total.TTL = s.TTL
+		}
+	}
+	sort.Strings(reasons)
+	total.Reason = strings.Join(reasons, ",")
+	return total
+}
+
+// Greylisted returns true if the recipient must be deferred, because the sender has not waited
+// the greylist delay since it was first seen. The sender is the IP address with the envelope's from and to
+func (ch *Checker) Greylisted(ip net.IP, from, to string) bool {
+	key := ip.String() + " " + strings.ToLower(from) + " " + strings.ToLower(to)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	now := ch.clock.Now()
+	delay := duration(ch.config.GreylistDelay, DefaultGreylistDelay)
+	expire := duration(ch.config.GreylistExpire, DefaultGreylistExpire)
+	first, ok := ch.greylist[key]
+	if ok && now.Sub(first) < expire {
+		return now.Sub(first) < delay
+	}
+	if len(ch.greylist) >= maxEntries {
+		for k, t := range ch.greylist {
+			if now.Sub(t) >= expire {
+				delete(ch.greylist, k)
+			}
+		}
+		if len(ch.greylist) >= maxEntries {
+			// too many senders waiting, let this one through rather than forget the others
+			return false
+		}
+	}
+	ch.greylist[key] = now
+	return true
+}
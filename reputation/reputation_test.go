@@ -0,0 +1,166 @@
+package reputation
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+// countingProvider scores every address 1, and counts the lookups
+type countingProvider struct {
+	lookups int32
+}
+
+func (p *countingProvider) Score(ip net.IP) (Score, error) {
+	atomic.AddInt32(&p.lookups, 1)
+	return Score{Value: 1, Reason: "counted", TTL: time.Minute}, nil
+}
+
+func testLog() log.Logger {
+	l, _ := log.GetLogger(log.OutputOff.String(), log.InfoLevel.String())
+	return l
+}
+
+func TestCheck(t *testing.T) {
+	f, err := ioutil.TempFile("", "reputation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, _ = f.WriteString("# known good\n192.0.2.10\n\n")
+	_ = f.Close()
+
+	c := Config{
+		Lists: []ListConfig{
+			{Networks: []string{"198.51.100.0/24"}, Score: 10, Reason: "abusers"},
+			{File: f.Name(), Score: -5, Reason: "partners"},
+		},
+		RejectScore:   10,
+		GreylistScore: 5,
+		TagScore:      2,
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ch := New(c, testLog())
+	counter := &countingProvider{}
+	ch.SetProviders([]Provider{counter})
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ch.SetClock(mock)
+
+	for _, test := range []struct {
+		ip     string
+		value  float64
+		reason string
+		action Action
+	}{
+		{"198.51.100.7", 11, "abusers,counted", Reject},
+		{"192.0.2.10", -4, "counted,partners", Accept},
+		{"203.0.113.1", 1, "counted", Accept},
+	} {
+		s, a := ch.Check(net.ParseIP(test.ip))
+		if s.Value != test.value || s.Reason != test.reason || a != test.action {
+			t.Errorf("%s: expecting %v %s %s, got %v %s %s", test.ip, test.value, test.reason, test.action, s.Value, s.Reason, a)
+		}
+	}
+	// cached for the shortest TTL
+	ch.Check(net.ParseIP("203.0.113.1"))
+	if n := atomic.LoadInt32(&counter.lookups); n != 3 {
+		t.Error("expecting the score to be cached, got lookups:", n)
+	}
+	mock.Add(time.Minute)
+	ch.Check(net.ParseIP("203.0.113.1"))
+	if n := atomic.LoadInt32(&counter.lookups); n != 4 {
+		t.Error("expecting the score to expire, got lookups:", n)
+	}
+
+	for score, action := range map[float64]Action{0: Accept, 2: Tag, 5: Greylist, 9.9: Greylist, 10: Reject} {
+		if a := c.action(score); a != action {
+			t.Errorf("%v: expecting %s, got %s", score, action, a)
+		}
+	}
+
+	ch.Reconfigure(Config{}, testLog())
+	if s, a := ch.Check(net.ParseIP("198.51.100.7")); a != Accept || s.Value != 0 {
+		t.Error("expecting checks to be disabled without thresholds, got", s, a)
+	}
+}
+
+func TestGreylisted(t *testing.T) {
+	ch := New(Config{GreylistScore: 1, GreylistDelay: "5m", GreylistExpire: "1h"}, testLog())
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ch.SetClock(mock)
+	ip := net.ParseIP("192.0.2.1")
+	if !ch.Greylisted(ip, "a@example.com", "b@example.org") {
+		t.Error("expecting the first try to be greylisted")
+	}
+	mock.Add(4 * time.Minute)
+	if !ch.Greylisted(ip, "A@example.com", "b@example.org") {
+		t.Error("expecting a try before the delay to be greylisted")
+	}
+	if !ch.Greylisted(ip, "a@example.com", "c@example.org") {
+		t.Error("expecting another recipient to be greylisted")
+	}
+	mock.Add(time.Minute)
+	if ch.Greylisted(ip, "a@example.com", "b@example.org") {
+		t.Error("expecting a try after the delay to pass")
+	}
+	mock.Add(time.Hour)
+	if !ch.Greylisted(ip, "a@example.com", "b@example.org") {
+		t.Error("expecting the sender to be forgotten after greylist_expire")
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	var queried string
+	d := NewDNSBL(DNSBLConfig{Zone: "zen.example.org.", Codes: map[string]float64{"127.0.0.2": 5, "127.0.0.4": 3}}, time.Second)
+	d.Lookup = func(ctx context.Context, host string) ([]string, error) {
+		queried = host
+		switch host {
+		case "2.0.0.127.zen.example.org":
+			return []string{"127.0.0.2", "127.0.0.4", "127.0.0.10"}, nil
+		case "3.0.0.127.zen.example.org":
+			return []string{"127.255.255.254"}, nil
+		case "4.0.0.127.zen.example.org":
+			return nil, errors.New("i/o timeout")
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	if s, err := d.Score(net.ParseIP("127.0.0.2")); err != nil || s.Value != 8 || s.Reason != "zen.example.org" {
+		t.Error("expecting the scores of the codes to be added up, got", s, err)
+	}
+	if s, err := d.Score(net.ParseIP("192.0.2.1")); err != nil || s.Value != 0 {
+		t.Error("expecting an address not listed to score 0, got", s, err)
+	}
+	for _, ip := range []string{"127.0.0.3", "127.0.0.4"} {
+		if _, err := d.Score(net.ParseIP(ip)); err == nil {
+			t.Error("expecting an error for", ip)
+		}
+	}
+	_, _ = d.Score(net.ParseIP("2001:db8::567:89ab"))
+	if queried != "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example.org" {
+		t.Error("unexpected IPv6 query", queried)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Timeout: "soon"},
+		{Lists: []ListConfig{{Score: 1}}},
+		{Lists: []ListConfig{{Networks: []string{"192.0.2.0/33"}}}},
+		{DNSBL: []DNSBLConfig{{Zone: "."}}},
+		{DNSBL: []DNSBLConfig{{Zone: "zen.example.org", Codes: map[string]float64{"two": 1}}}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expecting %+v to be invalid", c)
+		}
+	}
+}
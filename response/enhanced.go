@@ -2,6 +2,7 @@ package response
 
 import (
 	"fmt"
+	"reflect"
 )
 
 const (
@@ -130,6 +131,9 @@ type Responses struct {
 	FailSyntaxError              *Response
 	FailReadLimitExceededDataCmd *Response
 	FailMessageSizeExceeded      *Response
+	FailHeaderSizeExceeded       *Response
+	FailEightBitData             *Response
+	FailRoutingLoop              *Response
 	FailReadErrorDataCmd         *Response
 	FailPathTooLong              *Response
 	FailInvalidAddress           *Response
@@ -139,11 +143,29 @@ type Responses struct {
 	FailBackendTransaction       *Response
 	FailBackendTimeout           *Response
 	FailRcptCmd                  *Response
+	FailReputationConnect        *Response
+	FailConnectionPolicy         *Response
+	FailReputationRcpt           *Response
+	FailRcptMessageSize          *Response
+	FailBounceSize               *Response
+	FailSenderDomain             *Response
+	FailSenderNullMX             *Response
+	FailSenderUnverified         *Response
+	FailSenderAddressLiteral     *Response
+	FailRcptAddressLiteral       *Response
 
 	// The 400's
-	ErrorTooManyRecipients *Response
-	ErrorRelayDenied       *Response
-	ErrorShutdown          *Response
+	ErrorTooManyRecipients  *Response
+	ErrorBounceRecipients   *Response
+	ErrorRelayDenied        *Response
+	ErrorShutdown           *Response
+	ErrorDataBudgetExceeded *Response
+	ErrorDataSessions       *Response
+	ErrorGreylisted         *Response
+	ErrorDomainRoute        *Response
+	ErrorSenderDomain       *Response
+	ErrorSenderUnverified   *Response
+	ErrorBackendDisabled    *Response
 
 	// The 200's
 	SuccessMailCmd       *Response
@@ -207,6 +229,13 @@ func init() {
 		Comment:      "Too many recipients",
 	}
 
+	Canned.ErrorBounceRecipients = &Response{
+		EnhancedCode: TooManyRecipients,
+		BasicCode:    452,
+		Class:        ClassTransientFailure,
+		Comment:      "Bounces are accepted for one recipient at a time",
+	}
+
 	Canned.ErrorRelayDenied = &Response{
 		EnhancedCode: BadDestinationMailboxAddress,
 		BasicCode:    454,
@@ -261,6 +290,125 @@ func init() {
 		Comment:      "Too many unrecognized commands",
 	}
 
+	Canned.ErrorDataBudgetExceeded = &Response{
+		EnhancedCode: MailSystemFull,
+		BasicCode:    452,
+		Class:        ClassTransientFailure,
+		Comment:      "Insufficient system storage, please try again later",
+	}
+
+	Canned.ErrorDataSessions = &Response{
+		EnhancedCode: SystemNotAcceptingNetworkMessages,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Too many messages being received, please try again later",
+	}
+
+	Canned.ErrorGreylisted = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Greylisted, please try again later",
+	}
+
+	Canned.ErrorDomainRoute = &Response{
+		EnhancedCode: TooManyRecipients,
+		BasicCode:    452,
+		Class:        ClassTransientFailure,
+		Comment:      "Recipient routed differently, please send it in another transaction",
+	}
+
+	Canned.FailRcptMessageSize = &Response{
+		EnhancedCode: MessageTooBigForSystem,
+		BasicCode:    552,
+		Class:        ClassPermanentFailure,
+		Comment:      "Message too big for the recipient's domain",
+	}
+
+	Canned.FailBounceSize = &Response{
+		EnhancedCode: MessageTooBigForSystem,
+		BasicCode:    552,
+		Class:        ClassPermanentFailure,
+		Comment:      "Message too big for a bounce",
+	}
+
+	Canned.FailSenderDomain = &Response{
+		EnhancedCode: BadSendersSystemAddress,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Sender address rejected: domain not found",
+	}
+
+	Canned.FailSenderNullMX = &Response{
+		EnhancedCode: SenderAddressNullMX,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Sender address rejected: domain does not accept mail",
+	}
+
+	Canned.ErrorSenderDomain = &Response{
+		EnhancedCode: BadSendersSystemAddress,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Sender address rejected: domain lookup failed, please try again later",
+	}
+
+	Canned.FailSenderUnverified = &Response{
+		EnhancedCode: BadSendersMailboxAddressSyntax,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Sender address rejected: undeliverable address",
+	}
+
+	Canned.ErrorSenderUnverified = &Response{
+		EnhancedCode: BadSendersMailboxAddressSyntax,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Sender address rejected: unverified address, please try again later",
+	}
+
+	Canned.FailReputationConnect = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Rejected because of the reputation of your IP address",
+	}
+
+	Canned.FailConnectionPolicy = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Connection refused by policy",
+	}
+
+	Canned.FailReputationRcpt = &Response{
+		EnhancedCode: DeliveryNotAuthorized,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Rejected because of the reputation of your IP address",
+	}
+
+	Canned.ErrorBackendDisabled = &Response{
+		EnhancedCode: OtherOrUndefinedMailSystemStatus,
+		BasicCode:    451,
+		Class:        ClassTransientFailure,
+		Comment:      "Storage temporarily unavailable, please try again later",
+	}
+
+	Canned.FailSenderAddressLiteral = &Response{
+		EnhancedCode: BadSendersMailboxAddressSyntax,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Address literals are not accepted for the sender",
+	}
+
+	Canned.FailRcptAddressLiteral = &Response{
+		EnhancedCode: BadDestinationMailboxAddressSyntax,
+		BasicCode:    550,
+		Class:        ClassPermanentFailure,
+		Comment:      "Address literals are not accepted for the recipients",
+	}
+
 	Canned.ErrorShutdown = &Response{
 		EnhancedCode: OtherOrUndefinedMailSystemStatus,
 		BasicCode:    421,
@@ -289,6 +437,27 @@ func init() {
 		Comment:      "Error:",
 	}
 
+	Canned.FailHeaderSizeExceeded = &Response{
+		EnhancedCode: MessageLengthExceedsAdministrativeLimit,
+		BasicCode:    552,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error:",
+	}
+
+	Canned.FailEightBitData = &Response{
+		EnhancedCode: OtherOrUndefinedMediaError,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error:",
+	}
+
+	Canned.FailRoutingLoop = &Response{
+		EnhancedCode: RoutingLoopDetected,
+		BasicCode:    554,
+		Class:        ClassPermanentFailure,
+		Comment:      "Error:",
+	}
+
 	Canned.FailReadErrorDataCmd = &Response{
 		EnhancedCode: OtherOrUndefinedMailSystemStatus,
 		BasicCode:    451,
@@ -359,6 +528,13 @@ func init() {
 		Comment:      "User unknown in local recipient table",
 	}
 
+	// build the strings now, String caches them and the clients share the canned responses
+	v := reflect.ValueOf(&Canned).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if r, ok := v.Field(i).Interface().(*Response); ok && r != nil {
+			_ = r.String()
+		}
+	}
 }
 
 // DefaultMap contains defined default codes (RfC 3463)
@@ -403,6 +579,9 @@ const (
 	ConversionRequiredButNotSupported       = ".6.3"
 	ConversionWithLossPerformed             = ".6.4"
 	ConversionFailed                        = ".6.5"
+	OtherOrUndefinedSecurityStatus          = ".7.0"
+	DeliveryNotAuthorized                   = ".7.1"
+	SenderAddressNullMX                     = ".7.27"
 )
 
 var defaultTexts = struct {
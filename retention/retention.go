@@ -0,0 +1,387 @@
+// Package retention deletes or archives the stored messages once they are older than the max age
+// of their recipient's rule. The rules are applied on a schedule to the stores of the backend's
+// processors, eg. the table of the sql processor
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/metrics"
+)
+
+// DefaultInterval is how often the rules are applied when interval is not set
+const DefaultInterval = time.Hour
+
+// Actions of the rules
+const (
+	// Delete deletes the messages older than the max age, it's the default action
+	Delete = "delete"
+	// Archive writes the messages older than the max age to the archive_dir, then deletes them
+	Archive = "archive"
+	// Keep keeps the messages, eg. to exempt a recipient from the rule of its domain
+	Keep = "keep"
+)
+
+// Config configures the retention of the stored messages, disabled if there are no rules
+type Config struct {
+	// Interval is how often the rules are applied, eg. "30m". DefaultInterval if empty
+	Interval string `json:"interval,omitempty"`
+	// DryRun logs how many messages would be deleted or archived, and keeps them
+	DryRun bool `json:"dry_run,omitempty"`
+	// Rules are the max ages of the messages, per recipient or per domain. The rule of a recipient applies
+	// before the rule of its domain, then of its parent domains' wildcards, then the rule without either
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// Rule is the max age of the messages to some recipients
+type Rule struct {
+	// Recipient is the address the rule applies to, eg. "alice@example.com"
+	Recipient string `json:"recipient,omitempty"`
+	// Domain is the recipients' domain the rule applies to, eg. "example.com", or "*.example.com" for its
+	// subdomains. The rule applies to all the recipients if neither the recipient nor the domain is set
+	Domain string `json:"domain,omitempty"`
+	// MaxAge is how long the messages are kept, eg. "720h". Not used by the keep action
+	MaxAge string `json:"max_age,omitempty"`
+	// Action is Delete, Archive or Keep. Delete if empty
+	Action string `json:"action,omitempty"`
+	// ArchiveDir is the directory that the archive action writes the messages to, one .eml file each
+	ArchiveDir string `json:"archive_dir,omitempty"`
+}
+
+// key returns what the rule applies to, the rules must not have the same key
+func (r *Rule) key() string {
+	if r.Recipient != "" {
+		return strings.ToLower(r.Recipient)
+	}
+	return strings.ToLower(r.Domain)
+}
+
+func (r *Rule) action() string {
+	if r.Action == "" {
+		return Delete
+	}
+	return r.Action
+}
+
+// Validate checks the config, an empty config is valid
+func (c *Config) Validate() error {
+	if c.Interval != "" {
+		if d, err := time.ParseDuration(c.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("retention interval [%s] is not a valid duration", c.Interval)
+		}
+	}
+	seen := make(map[string]bool, len(c.Rules))
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if r.Recipient != "" && r.Domain != "" {
+			return fmt.Errorf("retention rule %d cannot have both a recipient and a domain", i)
+		}
+		if r.Recipient != "" && strings.IndexByte(r.Recipient, '@') < 1 {
+			return fmt.Errorf("retention rule %d: [%s] is not an address", i, r.Recipient)
+		}
+		if r.Domain != "" && strings.TrimPrefix(r.Domain, "*.") == "" {
+			return fmt.Errorf("retention rule %d: [%s] is not a domain", i, r.Domain)
+		}
+		if seen[r.key()] {
+			return fmt.Errorf("retention rule %d: there is already a rule for [%s]", i, r.key())
+		}
+		seen[r.key()] = true
+		switch r.action() {
+		case Keep:
+			continue
+		case Archive:
+			if r.ArchiveDir == "" {
+				return fmt.Errorf("retention rule %d: the archive action needs an archive_dir", i)
+			}
+		case Delete:
+		default:
+			return fmt.Errorf("retention rule %d: unknown action [%s]", i, r.Action)
+		}
+		if d, err := time.ParseDuration(r.MaxAge); err != nil || d <= 0 {
+			return fmt.Errorf("retention rule %d: max_age [%s] is not a valid duration", i, r.MaxAge)
+		}
+	}
+	return nil
+}
+
+func (c *Config) interval() time.Duration {
+	if d, err := time.ParseDuration(c.Interval); err == nil && d > 0 {
+		return d
+	}
+	return DefaultInterval
+}
+
+// Message is a stored message that the rules apply to
+type Message struct {
+	// ID identifies the message in its store, eg. the mail_id of the sql processor's table
+	ID string
+	// Recipient is the address that the message was stored for. Stores that keep one copy
+	// for all the recipients give the first
+	Recipient string
+	// Open returns the message, for the archive action
+	Open func() (io.Reader, error)
+}
+
+// Store is where a processor keeps the messages
+type Store interface {
+	// Expire calls expired with each of the messages received before t, and deletes those that it
+	// returned true for. Returns the number of messages deleted
+	Expire(before time.Time, expired func(m Message) bool) (int, error)
+}
+
+// rule is a valid Rule, ready to be applied
+type rule struct {
+	Rule
+	maxAge time.Duration
+}
+
+// rules looks up the rule of a recipient
+type rules struct {
+	list       []*rule
+	recipients map[string]*rule
+	domains    map[string]*rule
+	// wildcards are the rules of the subdomains, keyed by suffix, eg. ".example.com"
+	wildcards map[string]*rule
+	all       *rule
+}
+
+func newRules(c Config) *rules {
+	rs := &rules{
+		recipients: make(map[string]*rule),
+		domains:    make(map[string]*rule),
+		wildcards:  make(map[string]*rule),
+	}
+	for i := range c.Rules {
+		r := &rule{Rule: c.Rules[i]}
+		r.maxAge, _ = time.ParseDuration(r.MaxAge)
+		rs.list = append(rs.list, r)
+		switch {
+		case r.Recipient != "":
+			rs.recipients[strings.ToLower(r.Recipient)] = r
+		case strings.HasPrefix(r.Domain, "*."):
+			rs.wildcards[strings.ToLower(r.Domain[1:])] = r
+		case r.Domain != "":
+			rs.domains[strings.ToLower(r.Domain)] = r
+		default:
+			rs.all = r
+		}
+	}
+	return rs
+}
+
+// lookup returns the rule of the recipient, nil if none applies
+func (rs *rules) lookup(recipient string) *rule {
+	recipient = strings.ToLower(recipient)
+	if r, ok := rs.recipients[recipient]; ok {
+		return r
+	}
+	host := recipient[strings.LastIndexByte(recipient, '@')+1:]
+	if r, ok := rs.domains[host]; ok {
+		return r
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		if r, ok := rs.wildcards[host[i:]]; ok {
+			return r
+		}
+		host = host[i+1:]
+	}
+	return rs.all
+}
+
+// Report counts what a run did
+type Report struct {
+	Deleted  int `json:"deleted"`
+	Archived int `json:"archived"`
+	// Expired counts the messages that a dry run would have deleted or archived
+	Expired int `json:"expired"`
+	Errors  int `json:"errors"`
+}
+
+// Policy applies the rules to the stores on a schedule. The zero value is not usable, use New
+type Policy struct {
+	mu     sync.Mutex
+	config Config
+	rules  *rules
+	log    log.Logger
+	clock  clock.Clock
+	stores func() map[string]Store
+	// stop is closed to stop the schedule
+	stop chan struct{}
+	// running is held during a run, so that the runs don't overlap
+	running sync.Mutex
+}
+
+// New returns a policy that applies the rules of c to the stores, which are the stores of the running backend.
+// The schedule starts if c has rules
+func New(c Config, l log.Logger, stores func() map[string]Store) *Policy {
+	p := &Policy{clock: clock.Real, stores: stores}
+	p.Reconfigure(c, l)
+	return p
+}
+
+// Reconfigure applies c, and restarts the schedule
+func (p *Policy) Reconfigure(c Config, l log.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = c
+	p.rules = newRules(c)
+	p.log = l
+	p.restart()
+}
+
+// SetClock sets the clock of the schedule and of the messages' age, nil for the real clock
+func (p *Policy) SetClock(c clock.Clock) {
+	if c == nil {
+		c = clock.Real
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clock = c
+	if p.stop != nil {
+		p.restart()
+	}
+}
+
+// Close stops the schedule
+func (p *Policy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// restart starts the schedule again, with the config and the clock. Called with mu held
+func (p *Policy) restart() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	if len(p.config.Rules) == 0 {
+		return
+	}
+	p.stop = make(chan struct{})
+	go p.runEvery(p.config.interval(), p.clock, p.stop)
+}
+
+// runEvery runs the rules at each interval, until stop is closed
+func (p *Policy) runEvery(interval time.Duration, c clock.Clock, stop chan struct{}) {
+	for {
+		select {
+		case <-c.After(interval):
+			p.Run()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Run applies the rules to the stores now, and returns what it did
+func (p *Policy) Run() Report {
+	p.running.Lock()
+	defer p.running.Unlock()
+	p.mu.Lock()
+	rs, dryRun, l, now := p.rules, p.config.DryRun, p.log, p.clock.Now()
+	p.mu.Unlock()
+
+	var report Report
+	stores := p.stores()
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, r := range rs.list {
+			if r.action() == Keep {
+				continue
+			}
+			var archived int
+			deleted, err := stores[name].Expire(now.Add(-r.maxAge), func(m Message) bool {
+				if rs.lookup(m.Recipient) != r {
+					return false
+				}
+				if dryRun {
+					report.Expired++
+					return false
+				}
+				if r.action() == Archive {
+					if err := archive(r.ArchiveDir, name, m); err != nil {
+						l.WithError(err).Errorf("retention could not archive message [%s] of [%s]", m.ID, name)
+						report.Errors++
+						metrics.Incr(metrics.RetentionErrors, "store:"+name)
+						return false
+					}
+					archived++
+				}
+				return true
+			})
+			if err != nil {
+				l.WithError(err).Errorf("retention could not expire the messages of [%s]", name)
+				report.Errors++
+				metrics.Incr(metrics.RetentionErrors, "store:"+name)
+			}
+			// the archived messages that could not be deleted are archived again next time
+			if archived > deleted {
+				archived = deleted
+			}
+			report.Archived += archived
+			report.Deleted += deleted - archived
+			if deleted > 0 {
+				metrics.Count(metrics.RetentionExpired, int64(deleted), "store:"+name, "action:"+r.action())
+			}
+		}
+	}
+	if dryRun {
+		l.Infof("retention dry run: %d messages would expire, %d errors", report.Expired, report.Errors)
+	} else if report.Deleted+report.Archived+report.Errors > 0 {
+		l.Infof("retention deleted %d messages and archived %d, %d errors",
+			report.Deleted, report.Archived, report.Errors)
+	}
+	return report
+}
+
+// archive writes the message to dir, in a file named after the store and the message's ID
+func archive(dir, store string, m Message) error {
+	if m.Open == nil {
+		return errors.New("the store cannot read its messages")
+	}
+	r, err := m.Open()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, fileName(store+"-"+m.ID)+".eml"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// fileName replaces the characters that don't belong in a file name, eg. the ':' of "sql:emails"
+func fileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
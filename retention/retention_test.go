@@ -0,0 +1,171 @@
+package retention
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/clock"
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+// fakeMessage is a message of a fakeStore
+type fakeMessage struct {
+	id, rcpt, data string
+	received       time.Time
+}
+
+type fakeStore struct {
+	sync.Mutex
+	messages []fakeMessage
+}
+
+func (s *fakeStore) Expire(before time.Time, expired func(m Message) bool) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	var kept []fakeMessage
+	var deleted int
+	for _, m := range s.messages {
+		data := m.data
+		if m.received.Before(before) && expired(Message{ID: m.id, Recipient: m.rcpt, Open: func() (io.Reader, error) {
+			if data == "" {
+				return nil, errors.New("no data")
+			}
+			return strings.NewReader(data), nil
+		}}) {
+			deleted++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	s.messages = kept
+	return deleted, nil
+}
+
+func (s *fakeStore) ids() string {
+	s.Lock()
+	defer s.Unlock()
+	var ids []string
+	for _, m := range s.messages {
+		ids = append(ids, m.id)
+	}
+	return strings.Join(ids, " ")
+}
+
+func testLog() log.Logger {
+	l, _ := log.GetLogger(log.OutputOff.String(), log.InfoLevel.String())
+	return l
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	store := &fakeStore{messages: []fakeMessage{
+		{"1", "alice@example.com", "", now.Add(-10 * day)},
+		{"2", "bob@example.com", "", now.Add(-10 * day)},
+		{"3", "carol@example.com", "", now.Add(-2 * day)},
+		{"4", "dave@archive.example.com", "Subject: 4\r\n\r\nkept\r\n", now.Add(-40 * day)},
+		{"5", "erin@archive.example.com", "", now.Add(-40 * day)},
+		{"6", "frank@example.net", "", now.Add(-100 * day)},
+		{"7", "grace@example.net", "", now.Add(-400 * day)},
+	}}
+	c := Config{
+		DryRun: true,
+		Rules: []Rule{
+			{Domain: "example.com", MaxAge: "168h"},
+			{Recipient: "bob@example.com", Action: Keep},
+			{Domain: "*.example.com", MaxAge: "720h", Action: Archive, ArchiveDir: dir},
+			{MaxAge: "8760h"},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := New(c, testLog(), func() map[string]Store {
+		return map[string]Store{"fake:store": store}
+	})
+	defer p.Close()
+	p.SetClock(clock.NewMock(now))
+
+	// message 5 cannot be archived, it has no data
+	expected := Report{Expired: 4}
+	if r := p.Run(); r != expected {
+		t.Errorf("expected the dry run report %+v, got %+v", expected, r)
+	}
+	if store.ids() != "1 2 3 4 5 6 7" {
+		t.Error("expected the dry run to keep the messages, got", store.ids())
+	}
+
+	c.DryRun = false
+	p.Reconfigure(c, testLog())
+	expected = Report{Deleted: 2, Archived: 1, Errors: 1}
+	if r := p.Run(); r != expected {
+		t.Errorf("expected the report %+v, got %+v", expected, r)
+	}
+	if store.ids() != "2 3 5 6" {
+		t.Error("unexpected messages left", store.ids())
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "fake_store-4.eml"))
+	if err != nil || string(b) != "Subject: 4\r\n\r\nkept\r\n" {
+		t.Errorf("expected message 4 in the archive, got %q %v", b, err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	now := time.Now()
+	store := &fakeStore{messages: []fakeMessage{{"1", "alice@example.com", "", now}}}
+	mock := clock.NewMock(now)
+	p := New(Config{}, testLog(), func() map[string]Store {
+		return map[string]Store{"fake": store}
+	})
+	defer p.Close()
+	p.SetClock(mock)
+	p.Reconfigure(Config{Interval: "1h", Rules: []Rule{{MaxAge: "2h"}}}, testLog())
+
+	mock.BlockUntil(1)
+	mock.Add(time.Hour)
+	mock.BlockUntil(1)
+	if store.ids() != "1" {
+		t.Error("expected the message to be kept after an hour")
+	}
+	mock.Add(2 * time.Hour)
+	// the run after the first is waiting once the second run is done
+	mock.BlockUntil(1)
+	if store.ids() != "" {
+		t.Error("expected the message to expire after 3 hours, got", store.ids())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Interval: "soon"},
+		{Rules: []Rule{{}}},
+		{Rules: []Rule{{MaxAge: "-1h"}}},
+		{Rules: []Rule{{MaxAge: "1h", Action: "shred"}}},
+		{Rules: []Rule{{MaxAge: "1h", Action: Archive}}},
+		{Rules: []Rule{{MaxAge: "1h", Recipient: "alice"}}},
+		{Rules: []Rule{{MaxAge: "1h", Recipient: "alice@example.com", Domain: "example.com"}}},
+		{Rules: []Rule{{MaxAge: "1h", Domain: "*."}}},
+		{Rules: []Rule{{MaxAge: "1h", Domain: "example.com"}, {MaxAge: "2h", Domain: "Example.com"}}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+	c := Config{Interval: "30m", Rules: []Rule{{Recipient: "alice@example.com", Action: Keep}, {MaxAge: "24h"}}}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
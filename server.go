@@ -2,6 +2,7 @@ package guerrilla
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
@@ -11,16 +12,24 @@ import (
 	"io/ioutil"
 	"net"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/bounce"
+	"github.com/flashmob/go-guerrilla/clock"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/mail/rfc5321"
+	"github.com/flashmob/go-guerrilla/metrics"
+	"github.com/flashmob/go-guerrilla/outbound"
+	"github.com/flashmob/go-guerrilla/reputation"
 	"github.com/flashmob/go-guerrilla/response"
+	"github.com/flashmob/go-guerrilla/tracing"
 )
 
 const (
@@ -49,7 +58,7 @@ type server struct {
 	listenInterface string
 	clientPool      *Pool
 	wg              sync.WaitGroup // for waiting to shutdown
-	listener        net.Listener
+	listeners       []net.Listener // one, or several sharing the port with SO_REUSEPORT
 	closedListener  chan bool
 	hosts           allowedHosts // stores map[string]bool for faster lookup
 	state           int
@@ -58,12 +67,53 @@ type server struct {
 	mainlogStore atomic.Value
 	backendStore atomic.Value
 	envelopePool *mail.Pool
+	// hostFunc and ipFunc store the AllowsHostFunc and AllowsIPFunc consulted after the allowed hosts list
+	hostFunc atomic.Value
+	ipFunc   atomic.Value
+	// ctx is cancelled on Shutdown, envelope contexts are derived from it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// draining is set to 1 when the listener is closed by Drain
+	draining int32
+	// startErr is the reason why the server is in the ServerStateStartError state
+	startErr error
+	// tracerStore stores the *tracing.Tracer that traces the connections
+	tracerStore atomic.Value
+	// publish publishes the client and message events, nil if the server is not managed by a guerrilla
+	publish func(topic Event, args ...interface{})
+	// budget is shared by the servers to limit the DATA held in memory, nil for no limit
+	budget *dataBudget
+	// reputation is shared by the servers to score the clients, nil for no checks
+	reputation *reputation.Checker
+	// policyStore stores the policyHolder of the ConnectionPolicy consulted before the greeting
+	policyStore atomic.Value
+	// domains is shared by the servers, it holds the settings of the recipients' domains
+	domains *domainTable
+	// dataSessions is the number of clients sending DATA, counted when max_data_sessions is set. Accessed atomically
+	dataSessions int32
+	// metricTagsStore stores the []string tagging the server's metrics with its listen interface and
+	// its tags. Built when the config is set, passing them on does not allocate
+	metricTagsStore atomic.Value
+	// repliesStore stores the *replies made for the server's config
+	repliesStore atomic.Value
 }
 
 type allowedHosts struct {
-	table      map[string]bool // host lookup table
-	wildcards  []string        // host wildcard list (* is used as a wildcard)
-	sync.Mutex                 // guard access to the map
+	table     map[string]bool  // host lookup table
+	wildcards []string         // host wildcard list (* is used as a wildcard)
+	patterns  []*regexp.Regexp // host regex list, the hosts starting with ~
+	// matched caches whether the hosts matched a pattern, it's emptied when it has maxHostPatternCache hosts
+	matched    map[string]bool
+	sync.Mutex // guard access to the map
+}
+
+// maxHostPatternCache is how many hosts the allowed hosts cache the result of the patterns for
+const maxHostPatternCache = 10000
+
+// compileHostPattern compiles an allowed host starting with ~, without the ~. The pattern must match
+// the whole host, ignoring the case, eg. "~mail\.(eu|us)-[0-9]+\.example\.com"
+func compileHostPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?i:` + pattern + `)$`)
 }
 
 type command []byte
@@ -96,6 +146,7 @@ func newServer(sc *ServerConfig, b backends.Backend, mainlog log.Logger) (*serve
 		state:           ServerStateNew,
 		envelopePool:    mail.NewPool(sc.MaxClients),
 	}
+	server.ctx, server.cancel = context.WithCancel(context.Background())
 	server.mainlogStore.Store(mainlog)
 	server.backendStore.Store(b)
 	if sc.LogFile == "" {
@@ -191,6 +242,131 @@ func (s *server) backend() backends.Backend {
 	return nil
 }
 
+// setTracer sets the tracer for new connections, nil disables tracing
+func (s *server) setTracer(t *tracing.Tracer) {
+	s.tracerStore.Store(t)
+}
+
+// tracer gets the tracer for new connections, nil if tracing is disabled
+func (s *server) tracer() *tracing.Tracer {
+	t, _ := s.tracerStore.Load().(*tracing.Tracer)
+	return t
+}
+
+// checkReputation scores the client's IP address, it's accepted when there are no reputation checks
+func (s *server) checkReputation(c *client) (reputation.Score, reputation.Action) {
+	if s.reputation == nil {
+		return reputation.Score{}, reputation.Accept
+	}
+	return s.reputation.Check(net.ParseIP(c.RemoteIP))
+}
+
+// rcptReputation applies the reputation policy to a recipient, returning the response if it's refused.
+// The score is saved in the envelope's Values for the processors, with the tag if the score is high enough
+func (s *server) rcptReputation(c *client, to mail.Address, clog *logrus.Entry) *response.Response {
+	if s.reputation == nil || !s.reputation.Enabled() {
+		return nil
+	}
+	score, action := s.checkReputation(c)
+	switch action {
+	case reputation.Reject:
+		clog.Infof("Rejected a recipient from [%s] with a reputation score of %s", c.RemoteIP, score)
+		return response.Canned.FailReputationRcpt
+	case reputation.Greylist:
+		if s.reputation.Greylisted(net.ParseIP(c.RemoteIP), c.MailFrom.String(), to.String()) {
+			clog.Infof("Greylisted [%s] from [%s] to [%s] with a reputation score of %s",
+				c.RemoteIP, c.MailFrom.String(), to.String(), score)
+			return response.Canned.ErrorGreylisted
+		}
+	}
+	c.Values["reputation_score"] = score.Value
+	if s.reputation.Tagged(score) {
+		c.Values["reputation_tag"] = score.String()
+	}
+	return nil
+}
+
+// publishClient publishes a client event, the client:disconnect event has the client's command history
+func (s *server) publishClient(topic Event, c *client) {
+	if s.publish != nil {
+		info := c.info(s.listenInterface)
+		if topic == EventClientDisconnect {
+			info.Commands = c.history.list()
+		}
+		s.publish(topic, info)
+	}
+}
+
+// publishMessage publishes the outcome of a DATA command, the event depends on the response's code.
+// reason is one of the Reason constants, empty if the message was accepted. The deferred messages are
+// counted too, so that the rate of temporary failures can be alerted on. The command history of a client
+// whose message was rejected is logged
+func (s *server) publishMessage(clog *logrus.Entry, c *client, size int64, res backends.Result, reason string) {
+	if code := res.Code(); code > 399 && code < 500 {
+		metrics.Incr(metrics.MessagesDeferred, append(s.metricTags(), "reason:"+reason)...)
+	}
+	var commands []string
+	if res.Code() > 499 {
+		if commands = c.history.list(); commands != nil {
+			clog.WithField("commands", commands).Info("commands of the client whose message was rejected")
+		}
+	}
+	if s.publish == nil {
+		return
+	}
+	topic := EventMessageAccepted
+	if res.Code() > 499 {
+		topic = EventMessageRejected
+	} else if res.Code() > 399 {
+		topic = EventMessageDeferred
+	}
+	m := MessageEvent{
+		Client:     c.info(s.listenInterface),
+		QueuedID:   c.QueuedId,
+		RemoteIP:   c.RemoteIP,
+		Helo:       c.Helo,
+		MailFrom:   c.MailFrom.String(),
+		Size:       size,
+		Code:       res.Code(),
+		Response:   res.String(),
+		SaveFailed: reason == ReasonBackend || reason == ReasonBackendTimeout,
+		Reason:     reason,
+	}
+	m.Client.Commands = commands
+	for i := range c.RcptTo {
+		m.RcptTo = append(m.RcptTo, c.RcptTo[i].String())
+	}
+	if _, ok := res.(backends.RcptResults); ok {
+		for i, rcpt := range backends.RcptResultsOf(res, len(c.RcptTo)) {
+			m.Rcpts = append(m.Rcpts, RcptResult{Rcpt: m.RcptTo[i], Code: rcpt.Code(), Response: rcpt.String()})
+		}
+	}
+	s.publish(topic, m)
+}
+
+// publishBounces publishes the bounces that the BounceParser processor read from a saved message
+func (s *server) publishBounces(c *client) {
+	list, ok := c.Values["bounces"].([]bounce.Bounce)
+	if s.publish == nil || !ok {
+		return
+	}
+	b := BounceEvent{
+		Client:   c.info(s.listenInterface),
+		QueuedID: c.QueuedId,
+		MailFrom: c.MailFrom.String(),
+		Bounces:  list,
+	}
+	for i := range c.RcptTo {
+		b.RcptTo = append(b.RcptTo, c.RcptTo[i].String())
+	}
+	s.publish(EventMessageBounce, b)
+}
+
+// gaugeActiveClients records the number of connected clients
+func (s *server) gaugeActiveClients() {
+	metrics.Gauge(metrics.ActiveClients, float64(s.clientPool.GetActiveClientsCount()), s.metricTags()...)
+}
+
 // Set the timeout for the server and all clients
 func (s *server) setTimeout(seconds int) {
 	duration := time.Duration(int64(seconds))
@@ -201,6 +377,135 @@ func (s *server) setTimeout(seconds int) {
 // goroutine safe config store
 func (s *server) setConfig(sc *ServerConfig) {
 	s.configStore.Store(*sc)
+	s.metricTagsStore.Store(serverMetricTags(sc))
+	s.repliesStore.Store(newReplies(sc))
+	if s.clientPool != nil {
+		s.clientPool.SetBufferSizes(sc.ReadBufferSize, sc.WriteBufferSize)
+	}
+}
+
+// serverMetricTags returns the tags of the server's metrics, the listen interface then the server's tags by name
+func serverMetricTags(sc *ServerConfig) []string {
+	tags := make([]string, 0, len(sc.Tags)+1)
+	for key, value := range sc.Tags {
+		tags = append(tags, key+":"+value)
+	}
+	sort.Strings(tags)
+	return append([]string{"listener:" + sc.ListenInterface}, tags...)
+}
+
+// replies returns the greeting and the HELO/EHLO replies of the server's config
+func (s *server) replies() *replies {
+	return s.repliesStore.Load().(*replies)
+}
+
+// metricTags returns the tags of the server's metrics
+func (s *server) metricTags() []string {
+	tags, _ := s.metricTagsStore.Load().([]string)
+	return tags
+}
+
+// enterData counts the client against max, it returns false if max clients are already sending DATA.
+// The clients are not counted when max is 0
+func (s *server) enterData(c *client, max int) bool {
+	if max <= 0 {
+		return true
+	}
+	if atomic.AddInt32(&s.dataSessions, 1) > int32(max) {
+		atomic.AddInt32(&s.dataSessions, -1)
+		return false
+	}
+	c.dataSession = true
+	return true
+}
+
+// leaveData stops counting the client, if it was counted by enterData
+func (s *server) leaveData(c *client) {
+	if c.dataSession {
+		atomic.AddInt32(&s.dataSessions, -1)
+		c.dataSession = false
+	}
+}
+
+// logRcptResults logs the recipients that the backend did not deliver to, when a message was
+// accepted for some of its recipients only. The client cannot be told after DATA
+func (s *server) logRcptResults(clog *logrus.Entry, c *client, res backends.Result) {
+	for i, rcpt := range backends.RcptResultsOf(res, len(c.RcptTo)) {
+		if rcpt.Code() > 399 {
+			c.transcript.note("not delivered to %s: %s", c.RcptTo[i].String(), rcpt.String())
+			clog.WithFields(logrus.Fields{
+				"queuedID": c.QueuedId,
+				"rcpt":     c.RcptTo[i].String(),
+			}).Warn("message not delivered to the recipient: ", rcpt.String())
+		}
+	}
+}
+
+// bounceFailedRcpts queues a bounce to the sender of an accepted message, by the outbound queue, for the
+// recipients of the backends.RcptResults that it was not delivered to. The client was told that the message
+// was accepted, so the sender would not know otherwise. Nothing is bounced if the outbound queue is not enabled
+func (s *server) bounceFailedRcpts(clog *logrus.Entry, c *client, res backends.Result) {
+	if _, ok := res.(backends.RcptResults); !ok {
+		return
+	}
+	q := outbound.Default()
+	if q == nil || !q.Enabled() {
+		return
+	}
+	var failed []*outbound.Recipient
+	for i, rcpt := range backends.RcptResultsOf(res, len(c.RcptTo)) {
+		if rcpt.Code() > 399 {
+			failed = append(failed, &outbound.Recipient{Address: c.RcptTo[i].String(), Status: outbound.Failed,
+				Response: rcpt.String()})
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	id, err := q.Bounce(c.Envelope, failed)
+	if err == outbound.ErrNullSender {
+		clog.WithField("queuedID", c.QueuedId).Info("the message is a bounce, the recipients that failed are not bounced")
+		return
+	}
+	if err != nil {
+		clog.WithError(err).WithField("queuedID", c.QueuedId).Error("could not queue the bounce of the recipients that failed")
+		return
+	}
+	c.transcript.note("bounced %d recipients to %s", len(failed), c.MailFrom.String())
+	clog.WithFields(logrus.Fields{"queuedID": c.QueuedId, "bounce": id}).Infof("bounced %d recipients to [%s]",
+		len(failed), c.MailFrom.String())
+}
+
+// logTimings logs how long each stage of the transaction took, from the previous stage
+func (s *server) logTimings(clog *logrus.Entry, c *client) {
+	if !s.log().IsDebug() {
+		return
+	}
+	t := &c.Timings
+	fields := logrus.Fields{"queuedID": c.QueuedId, "connected": t.Mail.Sub(t.Connected).String()}
+	stages := []struct {
+		name     string
+		from, to time.Time
+	}{
+		{"rcpt", t.Mail, t.FirstRcpt},
+		{"data_cmd", t.FirstRcpt, t.DataStart},
+		{"data", t.DataStart, t.DataEnd},
+		{"save", t.DataEnd, t.Saved},
+	}
+	for _, stage := range stages {
+		if !stage.to.IsZero() {
+			fields[stage.name] = stage.to.Sub(stage.from).String()
+		}
+	}
+	clog.WithFields(fields).Debug("transaction timings")
+}
+
+// backendReason returns the reason of a result of the backend that is not a success
+func backendReason(res backends.Result) string {
+	if res.String() == response.Canned.FailBackendTimeout.String() {
+		return ReasonBackendTimeout
+	}
+	return ReasonBackend
 }
 
 // goroutine safe
@@ -215,16 +520,28 @@ func (s *server) setAllowedHosts(allowedHosts []string) {
 	defer s.hosts.Unlock()
 	s.hosts.table = make(map[string]bool, len(allowedHosts))
 	s.hosts.wildcards = nil
+	s.hosts.patterns = nil
+	s.hosts.matched = nil
 	for _, h := range allowedHosts {
-		if strings.Contains(h, "*") {
-			s.hosts.wildcards = append(s.hosts.wildcards, strings.ToLower(h))
+		if strings.HasPrefix(h, "~") {
+			re, err := compileHostPattern(h[1:])
+			if err != nil {
+				s.log().WithError(err).Errorf("invalid allowed host pattern [%s]", h)
+				continue
+			}
+			s.hosts.patterns = append(s.hosts.patterns, re)
+			if s.hosts.matched == nil {
+				s.hosts.matched = make(map[string]bool)
+			}
+		} else if strings.Contains(h, "*") {
+			s.hosts.wildcards = append(s.hosts.wildcards, strings.ToLower(mail.NormalizeHost(h)))
 		} else if len(h) > 5 && h[0] == '[' && h[len(h)-1] == ']' {
 			if ip := net.ParseIP(h[1 : len(h)-1]); ip != nil {
 				// this will save the normalized ip, as ip.String always returns ipv6 in short form
 				s.hosts.table["["+ip.String()+"]"] = true
 			}
 		} else {
-			s.hosts.table[strings.ToLower(h)] = true
+			s.hosts.table[strings.ToLower(mail.NormalizeHost(h))] = true
 		}
 	}
 }
@@ -232,34 +549,84 @@ func (s *server) setAllowedHosts(allowedHosts []string) {
 // Begin accepting SMTP clients. Will block unless there is an error or server.Shutdown() is called
 func (s *server) Start(startWG *sync.WaitGroup) error {
 	var clientID uint64
-	clientID = 0
 
-	listener, err := net.Listen("tcp", s.listenInterface)
-	s.listener = listener
+	sc := s.configStore.Load().(ServerConfig)
+	listeners, err := s.listen(&sc)
+	s.listeners = listeners
 	if err != nil {
-		startWG.Done() // don't wait for me
 		s.state = ServerStateStartError
-		return fmt.Errorf("[%s] Cannot listen on port: %s ", s.listenInterface, err.Error())
+		s.startErr = fmt.Errorf("[%s] Cannot listen on port: %s ", s.listenInterface, err.Error())
+		startWG.Done() // don't wait for me
+		return s.startErr
 	}
 
-	s.log().Infof("Listening on TCP %s", s.listenInterface)
+	if len(listeners) > 1 {
+		s.log().Infof("Listening on TCP %s with %d sockets (SO_REUSEPORT)", s.listenInterface, len(listeners))
+	} else {
+		s.log().Infof("Listening on TCP %s", s.listenInterface)
+	}
+	if s.ctx.Err() != nil {
+		// restarting after a shutdown
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
 	s.state = ServerStateRunning
 	startWG.Done() // start successful, don't wait for me
 
+	var loops sync.WaitGroup
+	for _, l := range listeners[1:] {
+		loops.Add(1)
+		go func(l net.Listener) {
+			defer loops.Done()
+			s.acceptLoop(l, &clientID)
+		}(l)
+	}
+	s.acceptLoop(listeners[0], &clientID)
+	loops.Wait()
+
+	s.log().Infof("Server [%s] has stopped accepting new clients", s.listenInterface)
+	// the listeners have been closed, wait for clients to exit
+	if atomic.CompareAndSwapInt32(&s.draining, 1, 0) {
+		s.log().Infof("draining pool [%s]", s.listenInterface)
+	} else {
+		s.log().Infof("shutting down pool [%s]", s.listenInterface)
+		s.clientPool.ShutdownState()
+	}
+	s.clientPool.ShutdownWait()
+	s.state = ServerStateStopped
+	s.closedListener <- true
+	return nil
+}
+
+// listen opens the server's listeners, several sharing the port if reuse_port is set
+func (s *server) listen(sc *ServerConfig) ([]net.Listener, error) {
+	if !sc.ReusePort {
+		l, err := listen(s.listenInterface)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	return listenReusePort(s.listenInterface, sc.acceptLoops())
+}
+
+// closeListeners closes the server's listeners, which stops the accept loops
+func (s *server) closeListeners() {
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+}
+
+// acceptLoop accepts the clients of listener until it's closed, clientID is shared by the loops of the server.
+// The other listeners are closed when it returns, so that the server stops as a whole
+func (s *server) acceptLoop(listener net.Listener, clientID *uint64) {
+	defer s.closeListeners()
 	for {
-		s.log().Debugf("[%s] Waiting for a new client. Next Client ID: %d", s.listenInterface, clientID+1)
+		s.log().Debugf("[%s] Waiting for a new client. Next Client ID: %d", s.listenInterface, atomic.LoadUint64(clientID)+1)
 		conn, err := listener.Accept()
-		clientID++
+		id := atomic.AddUint64(clientID, 1)
 		if err != nil {
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				s.log().Infof("Server [%s] has stopped accepting new clients", s.listenInterface)
-				// the listener has been closed, wait for clients to exit
-				s.log().Infof("shutting down pool [%s]", s.listenInterface)
-				s.clientPool.ShutdownState()
-				s.clientPool.ShutdownWait()
-				s.state = ServerStateStopped
-				s.closedListener <- true
-				return nil
+				return
 			}
 			s.mainlog().WithError(err).Info("Temporary error accepting client")
 			continue
@@ -267,9 +634,12 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 		go func(p Poolable, borrowErr error) {
 			c := p.(*client)
 			if borrowErr == nil {
+				metrics.Incr(metrics.Connections, s.metricTags()...)
+				s.gaugeActiveClients()
 				s.handleClient(c)
 				s.envelopePool.Return(c.Envelope)
 				s.clientPool.Return(c)
+				s.gaugeActiveClients()
 			} else {
 				s.log().WithError(borrowErr).Info("couldn't borrow a new client")
 				// we could not get a client, so close the connection.
@@ -278,15 +648,34 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 			}
 			// intentionally placed Borrow in args so that it's called in the
 			// same main goroutine.
-		}(s.clientPool.Borrow(conn, clientID, s.log(), s.envelopePool))
+		}(s.clientPool.Borrow(conn, id, s.log(), s.envelopePool))
 
 	}
 }
 
 func (s *server) Shutdown() {
-	if s.listener != nil {
+	// signal to the backend that any processing for this server's clients can be abandoned
+	s.cancel()
+	s.stop()
+}
+
+// Drain stops accepting new clients, then waits for the connected clients to finish their sessions.
+// Unlike Shutdown, the clients are not hurried along
+func (s *server) Drain() {
+	if len(s.listeners) == 0 {
+		s.clientPool.ShutdownWait()
+		s.state = ServerStateStopped
+		return
+	}
+	atomic.StoreInt32(&s.draining, 1)
+	s.stop()
+}
+
+// stop closes the listener and waits for the clients to exit
+func (s *server) stop() {
+	if len(s.listeners) > 0 {
 		// This will cause Start function to return, by causing an error on listener.Accept
-		_ = s.listener.Close()
+		s.closeListeners()
 		// wait for the listener to listener.Accept
 		<-s.closedListener
 		// At this point Start will exit and close down the pool
@@ -302,9 +691,49 @@ func (s *server) GetActiveClientsCount() int {
 	return s.clientPool.GetActiveClientsCount()
 }
 
-// Verifies that the host is a valid recipient.
-// host checking turned off if there is a single entry and it's a dot.
+// stateName returns a name for the server's state, used for reporting
+func (s *server) stateName() string {
+	switch s.state {
+	case ServerStateNew:
+		return "new"
+	case ServerStateStopped:
+		return "stopped"
+	case ServerStateRunning:
+		return "running"
+	case ServerStateStartError:
+		return "start error"
+	}
+	return "unknown"
+}
+
+// AllowsHostFunc decides if email for the host of a recipient should be accepted. It's set with
+// Daemon.SetAllowedHostsFunc, and consulted for the hosts that are not in the allowed hosts list,
+// eg. to look them up in a database. It's called by the clients' goroutines, so it must be safe for concurrent use
+type AllowsHostFunc func(host string) bool
+
+// AllowsIPFunc decides if email for an address literal should be accepted, when it's not in the allowed hosts list
+type AllowsIPFunc func(ip net.IP) bool
+
+func (s *server) setAllowsFuncs(hostFunc AllowsHostFunc, ipFunc AllowsIPFunc) {
+	s.hostFunc.Store(hostFunc)
+	s.ipFunc.Store(ipFunc)
+}
+
+// Verifies that the host is a valid recipient: it's in the allowed hosts list, or the AllowsHostFunc accepts it
 func (s *server) allowsHost(host string) bool {
+	if s.allowsHostList(host) {
+		return true
+	}
+	if f, ok := s.hostFunc.Load().(AllowsHostFunc); ok && f != nil {
+		return f(host)
+	}
+	return false
+}
+
+// allowsHostList checks if the host is in the allowed hosts list.
+// host checking turned off if there is a single entry and it's a dot.
+func (s *server) allowsHostList(host string) bool {
+	host = mail.NormalizeHost(host)
 	s.hosts.Lock()
 	defer s.hosts.Unlock()
 	// if hosts contains a single dot, further processing is skipped
@@ -322,12 +751,37 @@ func (s *server) allowsHost(host string) bool {
 			return true
 		}
 	}
-	return false
+	if len(s.hosts.patterns) == 0 {
+		return false
+	}
+	// then the patterns, the result is cached
+	host = strings.ToLower(host)
+	if matched, ok := s.hosts.matched[host]; ok {
+		return matched
+	}
+	matched := false
+	for _, re := range s.hosts.patterns {
+		if re.MatchString(host) {
+			matched = true
+			break
+		}
+	}
+	if len(s.hosts.matched) >= maxHostPatternCache {
+		s.hosts.matched = make(map[string]bool)
+	}
+	s.hosts.matched[host] = matched
+	return matched
 }
 
 func (s *server) allowsIp(ip net.IP) bool {
 	ipStr := ip.String()
-	return s.allowsHost("[" + ipStr + "]")
+	if s.allowsHostList("[" + ipStr + "]") {
+		return true
+	}
+	if f, ok := s.ipFunc.Load().(AllowsIPFunc); ok && f != nil {
+		return f(ip)
+	}
+	return false
 }
 
 const commandSuffix = "\r\n"
@@ -356,77 +810,188 @@ func (s *server) flushResponse(client *client) error {
 	return client.bufout.Flush()
 }
 
+// pipelined returns true if the client is to read another command that it has already sent,
+// so that the responses can be flushed together
+func (s *server) pipelined(client *client) bool {
+	return client.state == ClientCmd && client.isAlive() && client.bufin.hasLine()
+}
+
+// toUpper appends in to buf with the ASCII letters upper-cased, unlike bytes.ToUpper it does not allocate
+// if buf has enough capacity
+func toUpper(buf, in []byte) []byte {
+	for _, c := range in {
+		if 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		buf = append(buf, c)
+	}
+	return buf
+}
+
+// setClock sets the clock that times the shutdown of the server's clients, nil for the real clock
+func (s *server) setClock(c clock.Clock) {
+	s.clientPool.SetClock(c)
+}
+
 func (s *server) isShuttingDown() bool {
 	return s.clientPool.IsShuttingDown()
 }
 
+// shutdownClient returns true if the client is to be told that the server is shutting down.
+// A client in a transaction may finish it, unless the server has been shutting down for longer than the timeout
+func (s *server) shutdownClient(client *client) bool {
+	if !s.isShuttingDown() {
+		return false
+	}
+	return !client.isInTransaction() || s.clientPool.shutdownElapsed() > s.timeout.Load().(time.Duration)*time.Second
+}
+
 // Handles an entire client SMTP exchange
 func (s *server) handleClient(client *client) {
 	defer client.closeConn()
+	client.SetContext(s.ctx)
+	// cancel any work still being done for the client once it's gone
+	defer client.Cancel()
+	client.startSpan(s.tracer(), s.listenInterface)
+	defer client.endSpan()
+	s.publishClient(EventClientConnect, client)
+	defer s.publishClient(EventClientDisconnect, client)
 	sc := s.configStore.Load().(ServerConfig)
-	s.log().Infof("Handle client [%s], id: %d", client.RemoteIP, client.ID)
+	// every line logged for the connection describes it with the same fields
+	clog := s.log().WithQueuedID(client.ID, client.QueuedId).WithFields(logrus.Fields{
+		log.FieldIface:    s.listenInterface,
+		log.FieldServerID: sc.Hostname,
+		log.FieldPeer:     client.RemoteIP,
+	})
+	clog.Infof("Handle client [%s], id: %d", client.RemoteIP, client.ID)
+	client.history.reset(sc.CommandHistory)
+	defer func() {
+		if commands := client.history.list(); commands != nil {
+			clog.WithField("commands", commands).Info("Client disconnected")
+		}
+	}()
+	client.Tags = sc.Tags
+	// a client that goes away in DATA is still counted
+	defer s.leaveData(client)
+	if sc.TranscriptDir != "" {
+		var err error
+		if client.transcript, err = newTranscript(&sc, client); err != nil {
+			clog.WithError(err).Error("could not create the transcript")
+		}
+		defer func() {
+			if err := client.transcript.close(); err != nil {
+				clog.WithError(err).Error("could not write the transcript")
+			}
+			client.transcript = nil
+		}()
+	}
 
 	// Initial greeting
-	greeting := fmt.Sprintf("220 %s SMTP Guerrilla(%s) #%d (%d) %s",
-		sc.Hostname, Version, client.ID,
-		s.clientPool.GetActiveClientsCount(), time.Now().Format(time.RFC3339))
-
-	helo := fmt.Sprintf("250 %s Hello", sc.Hostname)
-	// ehlo is a multi-line reply and need additional \r\n at the end
-	ehlo := fmt.Sprintf("250-%s Hello\r\n", sc.Hostname)
-
-	// Extended feature advertisements
-	messageSize := fmt.Sprintf("250-SIZE %d\r\n", sc.MaxSize)
-	pipelining := "250-PIPELINING\r\n"
-	advertiseTLS := "250-STARTTLS\r\n"
-	advertiseEnhancedStatusCodes := "250-ENHANCEDSTATUSCODES\r\n"
-	// The last line doesn't need \r\n since string will be printed as a new line.
-	// Also, Last line has no dash -
-	help := "250 HELP"
+	replies := s.replies()
+	greeting := replies.greetingFor(client.ID, s.clientPool.GetActiveClientsCount(), time.Now())
+	// STARTTLS is advertised until the connection is TLS
+	advertiseTLS := true
 
 	if sc.TLS.AlwaysOn {
 		tlsConfig, ok := s.tlsConfigStore.Load().(*tls.Config)
 		if !ok {
 			s.mainlog().Error("Failed to load *tls.Config")
 		} else if err := client.upgradeToTLS(tlsConfig); err == nil {
-			advertiseTLS = ""
+			client.transcript.note("TLS handshake completed")
+			advertiseTLS = false
 		} else {
-			s.log().WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
+			client.transcript.note("TLS handshake failed: %s", err)
+			clog.WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
 			// server requires TLS, but can't handshake
 			client.kill()
 		}
 	}
 	if !sc.TLS.StartTLSOn {
 		// STARTTLS turned off, don't advertise it
-		advertiseTLS = ""
+		advertiseTLS = false
+	}
+	// idleTimeout is the timeout for reading a command between transactions, if it's less than the timeout
+	var idleTimeout time.Duration
+	if sc.IdleTimeout > 0 && sc.IdleTimeout < sc.Timeout {
+		idleTimeout = time.Duration(int64(sc.IdleTimeout))
 	}
 	r := response.Canned
+	// verb holds the upper-cased command verb
+	var verb [CommandVerbMaxLength]byte
 	for client.isAlive() {
 		switch client.state {
 		case ClientGreeting:
+			switch s.checkPolicy(client) {
+			case PolicyDeny:
+				clog.Infof("Denied [%s] by the connection policy", client.RemoteIP)
+				client.sendResponse(r.FailConnectionPolicy)
+				client.kill()
+			case PolicyTarpit:
+				clog.Infof("Tarpitted [%s] by the connection policy", client.RemoteIP)
+				client.tarpitDelay = sc.tarpitDelay()
+			}
+			if !client.isAlive() {
+				break
+			}
+			if score, action := s.checkReputation(client); action == reputation.Reject {
+				clog.Infof("Rejected [%s] with a reputation score of %s", client.RemoteIP, score)
+				client.sendResponse(r.FailReputationConnect)
+				client.kill()
+				break
+			}
 			client.sendResponse(greeting)
-			client.state = ClientCmd
+			client.setState(ClientCmd)
 		case ClientCmd:
 			client.bufin.setLimit(CommandLineMaxLength)
+			idle := !client.isInTransaction()
+			if idle {
+				// a shutdown wakes up the idle clients, see Pool.ShutdownState
+				client.setIdle(true)
+				if idleTimeout > 0 {
+					if err := client.setTimeout(idleTimeout); err != nil {
+						clog.WithError(err).Debug("could not set the idle timeout")
+					}
+				}
+				if s.isShuttingDown() {
+					client.setIdle(false)
+					client.setState(ClientShutdown)
+					continue
+				}
+			}
 			input, err := s.readCommand(client)
-			s.log().Debugf("Client sent: %s", input)
+			client.setIdle(false)
+			if s.log().IsDebug() {
+				clog.Debugf("Client sent: %s", input)
+			}
+			if err == nil {
+				client.transcript.command(input)
+				client.history.add(input)
+			}
 			if err == io.EOF {
-				s.log().WithError(err).Warnf("Client closed the connection: %s", client.RemoteIP)
+				clog.WithError(err).Warnf("Client closed the connection: %s", client.RemoteIP)
 				return
 			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				s.log().WithError(err).Warnf("Timeout: %s", client.RemoteIP)
+				if idle && s.isShuttingDown() {
+					client.setState(ClientShutdown)
+					continue
+				}
+				if idle && idleTimeout > 0 {
+					clog.Infof("Idle timeout: %s", client.RemoteIP)
+				} else {
+					clog.WithError(err).Warnf("Timeout: %s", client.RemoteIP)
+				}
 				return
 			} else if err == LineLimitExceeded {
 				client.sendResponse(r.FailLineTooLong)
 				client.kill()
 				break
 			} else if err != nil {
-				s.log().WithError(err).Warnf("Read error: %s", client.RemoteIP)
+				clog.WithError(err).Warnf("Read error: %s", client.RemoteIP)
 				client.kill()
 				break
 			}
-			if s.isShuttingDown() {
-				client.state = ClientShutdown
+			if s.shutdownClient(client) {
+				client.setState(ClientShutdown)
 				continue
 			}
 
@@ -434,36 +999,34 @@ func (s *server) handleClient(client *client) {
 			if cmdLen > CommandVerbMaxLength {
 				cmdLen = CommandVerbMaxLength
 			}
-			cmd := bytes.ToUpper(input[:cmdLen])
+			cmd := toUpper(verb[:0], input[:cmdLen])
 			switch {
 			case cmdHELO.match(cmd):
 				if h, err := client.parser.Helo(input[4:]); err == nil {
 					client.Helo = h
 				} else {
-					s.log().WithFields(logrus.Fields{"helo": h, "client": client.ID}).Warn("invalid helo")
+					clog.WithFields(logrus.Fields{"helo": h, "client": client.ID}).Warn("invalid helo")
 					client.sendResponse(r.FailSyntaxError)
 					break
 				}
 				client.resetTransaction()
-				client.sendResponse(helo)
+				client.sendResponse(replies.helo)
 
 			case cmdEHLO.match(cmd):
 				if h, _, err := client.parser.Ehlo(input[4:]); err == nil {
 					client.Helo = h
 				} else {
-					client.sendResponse(r.FailSyntaxError)
-					s.log().WithFields(logrus.Fields{"ehlo": h, "client": client.ID}).Warn("invalid ehlo")
+					clog.WithFields(logrus.Fields{"ehlo": h, "client": client.ID}).Warn("invalid ehlo")
 					client.sendResponse(r.FailSyntaxError)
 					break
 				}
 				client.ESMTP = true
 				client.resetTransaction()
-				client.sendResponse(ehlo,
-					messageSize,
-					pipelining,
-					advertiseTLS,
-					advertiseEnhancedStatusCodes,
-					help)
+				if advertiseTLS {
+					client.sendResponse(replies.ehloTLS)
+				} else {
+					client.sendResponse(replies.ehlo)
+				}
 
 			case cmdHELP.match(cmd):
 				quote := response.GetQuote()
@@ -494,13 +1057,26 @@ func (s *server) handleClient(client *client) {
 				}
 				client.MailFrom, err = client.parsePath(input[10:], client.parser.MailFrom)
 				if err != nil {
-					s.log().WithError(err).Error("MAIL parse error", "["+string(input[10:])+"]")
+					clog.WithError(err).Error("MAIL parse error", "["+string(input[10:])+"]")
 					client.sendResponse(err)
 					break
 				} else if client.parser.NullPath {
 					// bounce has empty from address
+					client.MailFrom = mail.Address{NullPath: true}
+				} else if client.MailFrom.IP != nil && sc.AddressLiterals == addressLiteralsReject {
 					client.MailFrom = mail.Address{}
+					client.sendResponse(r.FailSenderAddressLiteral)
+					break
 				}
+				client.MailParams = mail.NewESMTPParams(client.parser.PathParams)
+				if size, ok := client.MailParams.Size(); ok && client.MailFrom.NullPath &&
+					sc.NullSenderMaxSize > 0 && size > sc.NullSenderMaxSize {
+					client.resetTransaction()
+					client.sendResponse(r.FailBounceSize)
+					break
+				}
+				client.Timings.Mail = time.Now()
+				client.startTransactionSpan()
 				client.sendResponse(r.SuccessMailCmd)
 
 			case cmdRCPT.match(cmd):
@@ -508,22 +1084,56 @@ func (s *server) handleClient(client *client) {
 					client.sendResponse(r.ErrorTooManyRecipients)
 					break
 				}
+				if client.MailFrom.NullPath && sc.NullSenderSingleRcpt && len(client.RcptTo) > 0 {
+					client.sendResponse(r.ErrorBounceRecipients)
+					break
+				}
 				to, err := client.parsePath(input[8:], client.parser.RcptTo)
 				if err != nil {
-					s.log().WithError(err).Error("RCPT parse error", "["+string(input[8:])+"]")
+					clog.WithError(err).Error("RCPT parse error", "["+string(input[8:])+"]")
 					client.sendResponse(err.Error())
 					break
 				}
 				s.defaultHost(&to)
-				if (to.IP != nil && !s.allowsIp(to.IP)) || (to.IP == nil && !s.allowsHost(to.Host)) {
-					client.sendResponse(r.ErrorRelayDenied, " ", to.Host)
+				if to.IP != nil && (sc.AddressLiterals == addressLiteralsReject ||
+					sc.AddressLiterals == addressLiteralsRejectRcpt) {
+					client.sendResponse(r.FailRcptAddressLiteral)
+				} else if (to.IP != nil && !s.allowsIp(to.IP)) || (to.IP == nil && !s.allowsHost(to.Host)) {
+					client.sendResponse(replies.relayDenied, " ", to.Host)
+				} else if res := s.rcptReputation(client, to, clog); res != nil {
+					client.sendResponse(res)
+				} else if d, res := s.rcptDomain(client, to); res != nil {
+					client.sendResponse(res)
 				} else {
 					client.PushRcpt(to)
-					rcptError := s.backend().ValidateRcpt(client.Envelope)
+					var rcptError backends.RcptError
+					if d == nil || !d.Discard {
+						rcptError = s.backend().ValidateRcpt(client.Envelope)
+					}
+					if rcptError == backends.NoSuchUser && client.catchAll(d) {
+						clog.WithField("rcpt", to.String()).Debug("recipient rejected, sent to the catch-all address")
+						rcptError = nil
+					}
 					if rcptError != nil {
+						metrics.Incr(metrics.RecipientsRejected, s.metricTags()...)
 						client.PopRcpt()
-						client.sendResponse(r.FailRcptCmd, " ", rcptError.Error())
+						switch rcptError {
+						case backends.SenderDomainRejected:
+							client.sendResponse(r.FailSenderDomain)
+						case backends.SenderNullMX:
+							client.sendResponse(r.FailSenderNullMX)
+						case backends.SenderUnverified:
+							client.sendResponse(r.FailSenderUnverified)
+						case backends.StorageDisabled:
+							client.sendResponse(r.ErrorBackendDisabled)
+						default:
+							client.sendResponse(r.FailRcptCmd, " ", rcptError.Error())
+						}
 					} else {
+						client.addDomain(d)
+						if client.Timings.FirstRcpt.IsZero() {
+							client.Timings.FirstRcpt = time.Now()
+						}
 						client.sendResponse(r.SuccessRcptCmd)
 					}
 				}
@@ -547,13 +1157,26 @@ func (s *server) handleClient(client *client) {
 					client.sendResponse(r.FailNoRecipientsDataCmd)
 					break
 				}
+				if s.budget.exhausted() {
+					clog.Warnf("DATA deferred, %d bytes of DATA already in memory", s.budget.inUse())
+					client.sendResponse(r.ErrorDataBudgetExceeded)
+					s.publishMessage(clog, client, 0, backends.NewResult(r.ErrorDataBudgetExceeded), ReasonDataBudget)
+					break
+				}
+				if !s.enterData(client, sc.MaxDataSessions) {
+					clog.Warnf("DATA deferred, %d clients already sending DATA", sc.MaxDataSessions)
+					client.sendResponse(r.ErrorDataSessions)
+					s.publishMessage(clog, client, 0, backends.NewResult(r.ErrorDataSessions), ReasonDataSessions)
+					break
+				}
+				client.Timings.DataStart = time.Now()
 				client.sendResponse(r.SuccessDataCmd)
-				client.state = ClientData
+				client.setState(ClientData)
 
 			case sc.TLS.StartTLSOn && cmdSTARTTLS.match(cmd):
 
 				client.sendResponse(r.SuccessStartTLSCmd)
-				client.state = ClientStartTLS
+				client.setState(ClientStartTLS)
 			default:
 				client.errors++
 				if client.errors >= MaxUnrecognizedCommands {
@@ -570,35 +1193,99 @@ func (s *server) handleClient(client *client) {
 			// if the client goes a little over. Anything above will err
 			client.bufin.setLimit(sc.MaxSize + 1024000) // This a hard limit.
 
-			n, err := client.Data.ReadFrom(client.smtpReader.DotReader())
+			data := client.header.reset(client.smtpReader.DotReader(), sc.MaxHeaderSize)
+			data = client.eightBit.reset(data, sc.Strict7Bit, client.MailParams)
+			data = client.budget.reset(s.budget, data, sc.SpoolThreshold)
+			n, err := client.ReadData(data, sc.SpoolThreshold, sc.SpoolDir)
+			client.Timings.DataEnd = time.Now()
 			if n > sc.MaxSize {
 				err = fmt.Errorf("maximum DATA size exceeded (%d)", sc.MaxSize)
+			} else if client.domain.maxSize > 0 && n > client.domain.maxSize && err == nil {
+				err = MessageSizeExceeded
+			} else if client.MailFrom.NullPath && sc.NullSenderMaxSize > 0 && n > sc.NullSenderMaxSize && err == nil {
+				err = BounceSizeExceeded
 			}
+			client.transcript.data(client.Envelope, n)
 			if err != nil {
+				client.transcript.note("error reading data: %s", err)
+				var res backends.Result
+				reason := ReasonReadError
 				if err == LineLimitExceeded {
-					client.sendResponse(r.FailReadLimitExceededDataCmd, " ", LineLimitExceeded.Error())
-					client.kill()
+					res = backends.NewResult(r.FailReadLimitExceededDataCmd, " ", LineLimitExceeded.Error())
+					reason = ReasonLineLimit
 				} else if err == MessageSizeExceeded {
-					client.sendResponse(r.FailMessageSizeExceeded, " ", MessageSizeExceeded.Error())
-					client.kill()
+					res = backends.NewResult(r.FailMessageSizeExceeded, " ", MessageSizeExceeded.Error())
+					reason = ReasonMessageSize
+				} else if err == HeaderSizeExceeded {
+					res = backends.NewResult(r.FailHeaderSizeExceeded, " ", HeaderSizeExceeded.Error())
+					reason = ReasonHeaderSize
+				} else if err == BounceSizeExceeded {
+					res = backends.NewResult(r.FailBounceSize)
+					reason = ReasonMessageSize
 				} else {
-					client.sendResponse(r.FailReadErrorDataCmd, " ", err.Error())
-					client.kill()
+					res = backends.NewResult(r.FailReadErrorDataCmd, " ", err.Error())
+					if n > sc.MaxSize {
+						reason = ReasonMessageSize
+					}
 				}
-				s.log().WithError(err).Warn("Error reading data")
+				client.sendResponse(res)
+				client.kill()
+				clog.WithError(err).Warn("Error reading data")
+				metrics.Incr(metrics.MessagesRejected, s.metricTags()...)
+				client.Span.SetError(err)
+				s.publishMessage(clog, client, n, res, reason)
+				s.leaveData(client)
 				client.resetTransaction()
 				break
 			}
 
-			res := s.backend().Process(client.Envelope)
+			metrics.Count(metrics.MessageBytes, n, s.metricTags()...)
+			var res backends.Result
+			var reason string
+			if err := checkHops(client.Envelope, sc.maxHops(), sc.maxHeaderScan()); err != nil {
+				clog.WithError(err).Warn("message rejected")
+				res = backends.NewResult(r.FailRoutingLoop, " ", err.Error())
+				reason = ReasonLoop
+			} else if err := client.check7Bit(sc.Strict7Bit); err != nil {
+				clog.WithError(err).Info("message rejected")
+				res = backends.NewResult(r.FailEightBitData, " ", err.Error())
+				reason = ReasonEightBit
+			} else if client.domain.discard {
+				// accepted as if saved
+				clog.WithField("queuedID", client.QueuedId).Debug("message discarded")
+				res = backends.NewResult(r.SuccessMessageQueued, " ", client.QueuedId)
+			} else {
+				saveStart := time.Now()
+				client.Values["listener"] = sc.ListenInterface
+				res = s.backend().Process(client.Envelope)
+				client.Timings.Saved = time.Now()
+				metrics.Since(metrics.SaveTime, saveStart, s.metricTags()...)
+				if res.Code() > 399 {
+					reason = backendReason(res)
+				} else if _, ok := res.(backends.RcptResults); ok {
+					s.logRcptResults(clog, client, res)
+				}
+			}
 			if res.Code() < 300 {
 				client.messagesSent++
+				metrics.Incr(metrics.MessagesAccepted, s.metricTags()...)
+			} else {
+				metrics.Incr(metrics.MessagesRejected, s.metricTags()...)
 			}
+			s.logTimings(clog, client)
+			client.endTransactionSpan(n, res)
 			client.sendResponse(res)
-			client.state = ClientCmd
+			s.publishMessage(clog, client, n, res, reason)
+			if res.Code() < 300 {
+				s.publishBounces(client)
+				s.bounceFailedRcpts(clog, client, res)
+			}
+			client.setState(ClientCmd)
 			if s.isShuttingDown() {
-				client.state = ClientShutdown
+				client.setState(ClientShutdown)
 			}
+			// the message was saved, another client can send DATA
+			s.leaveData(client)
 			client.resetTransaction()
 
 		case ClientStartTLS:
@@ -607,15 +1294,17 @@ func (s *server) handleClient(client *client) {
 				if !ok {
 					s.mainlog().Error("Failed to load *tls.Config")
 				} else if err := client.upgradeToTLS(tlsConfig); err == nil {
-					advertiseTLS = ""
+					client.transcript.note("TLS handshake completed")
+					advertiseTLS = false
 					client.resetTransaction()
 				} else {
-					s.log().WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
+					client.transcript.note("TLS handshake failed: %s", err)
+					clog.WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
 					// Don't disconnect, let the client decide if it wants to continue
 				}
 			}
 			// change to command state
-			client.state = ClientCmd
+			client.setState(ClientCmd)
 		case ClientShutdown:
 			// shutdown state
 			client.sendResponse(r.ErrorShutdown)
@@ -623,17 +1312,23 @@ func (s *server) handleClient(client *client) {
 		}
 
 		if client.bufErr != nil {
-			s.log().WithError(client.bufErr).Debug("client could not buffer a response")
+			clog.WithError(client.bufErr).Debug("client could not buffer a response")
 			return
 		}
-		// flush the response buffer
-		if client.bufout.Buffered() > 0 {
+		// flush the response buffer, unless the client pipelined more commands that are already buffered,
+		// their responses are then sent together in one write
+		if client.bufout.Buffered() > 0 && !s.pipelined(client) {
 			if s.log().IsDebug() {
-				s.log().Debugf("Writing response to client: \n%s", client.response.String())
+				clog.Debugf("Writing response to client: \n%s", client.response.String())
+			}
+			// client.response collects the responses for the debug log until they are flushed
+			client.response.Reset()
+			if client.tarpitDelay > 0 {
+				s.tarpit(client.tarpitDelay)
 			}
 			err := s.flushResponse(client)
 			if err != nil {
-				s.log().WithError(err).Debug("error writing response")
+				clog.WithError(err).Debug("error writing response")
 				return
 			}
 		}
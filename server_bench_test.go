@@ -0,0 +1,160 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/flashmob/go-guerrilla/mail"
+	"github.com/flashmob/go-guerrilla/mocks"
+)
+
+// benchMessage is a transaction sent by the benchmarks
+const benchMessage = "MAIL FROM:<sender@example.com>\r\n" +
+	"RCPT TO:<rcpt@test.com>\r\n" +
+	"DATA\r\n" +
+	"Subject: benchmark\r\n" +
+	"From: sender@example.com\r\n" +
+	"To: rcpt@test.com\r\n" +
+	"\r\n" +
+	"Hello, this is a benchmark.\r\n" +
+	".\r\n"
+
+// queuedReply starts the reply to a message saved by the dummy backend
+var queuedReply = []byte("250 2.0.0 OK: queued")
+
+// The allocation budgets of the benchmarks, they include the work of the dummy backend.
+// Before the hot path was audited a message on an open connection cost 72 allocs/op (1764 B/op),
+// and a whole connection 195 allocs/op (18850 B/op). After: 15 allocs/op (548 B/op) and 99 allocs/op (17265 B/op).
+// Making the greeting and the EHLO reply once per config took a greeted connection from 84 to 73 allocs/op.
+// The budgets leave room for the race detector, which drops some of the pooled objects
+const (
+	maxDataPathAllocs     = 25
+	maxHandleClientAllocs = 125
+	maxGreetingAllocs     = 90
+)
+
+// benchServer returns a server with the dummy backend, that does not log
+func benchServer(b *testing.B) *server {
+	mainlog, err := log.GetLogger(log.OutputOff.String(), "info")
+	if err != nil {
+		b.Fatal(err)
+	}
+	backend, err := backends.New(backends.BackendConfig{"save_workers_size": 1}, mainlog)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := backend.Start(); err != nil {
+		b.Fatal(err)
+	}
+	sc := &ServerConfig{
+		IsEnabled:       true,
+		Hostname:        "bench.test.com",
+		MaxSize:         1024,
+		Timeout:         5,
+		ListenInterface: "127.0.0.1:2529",
+		MaxClients:      1,
+	}
+	s, err := newServer(sc, backend, mainlog)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s.setAllowedHosts([]string{"test.com"})
+	return s
+}
+
+// session sends script to a new client of s, and returns the number of messages queued
+func session(b *testing.B, s *server, pool *mail.Pool, id uint64, script io.Reader) int {
+	conn := mocks.NewConn()
+	client := NewClient(conn.Server, id, s.mainlog(), pool)
+	go func() {
+		_, _ = io.Copy(conn.Client, script)
+	}()
+	queued := make(chan int)
+	go func() {
+		n := 0
+		in := bufio.NewScanner(conn.Client)
+		for in.Scan() {
+			if bytes.HasPrefix(in.Bytes(), queuedReply) {
+				n++
+			}
+		}
+		queued <- n
+	}()
+	s.handleClient(client)
+	// handleClient closed the connection, the reader gets EOF
+	n := <-queued
+	pool.Return(client.Envelope)
+	return n
+}
+
+// BenchmarkHandleClient measures a whole connection delivering a message
+func BenchmarkHandleClient(b *testing.B) {
+	s := benchServer(b)
+	defer func() { _ = s.backend().Shutdown() }()
+	pool := mail.NewPool(1)
+	script := "EHLO client.example.com\r\n" + benchMessage + "QUIT\r\n"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if n := session(b, s, pool, uint64(i), strings.NewReader(script)); n != 1 {
+			b.Fatal("expecting the message to be queued, got", n)
+		}
+	}
+}
+
+// BenchmarkGreeting measures a connection that is greeted, says EHLO and quits, like the probes of monitoring
+func BenchmarkGreeting(b *testing.B) {
+	s := benchServer(b)
+	defer func() { _ = s.backend().Shutdown() }()
+	pool := mail.NewPool(1)
+	script := "EHLO client.example.com\r\nQUIT\r\n"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		session(b, s, pool, uint64(i), strings.NewReader(script))
+	}
+}
+
+// BenchmarkDataPath measures a message delivered on an open connection, from MAIL FROM to the end of DATA
+func BenchmarkDataPath(b *testing.B) {
+	s := benchServer(b)
+	defer func() { _ = s.backend().Shutdown() }()
+	var script bytes.Buffer
+	script.WriteString("EHLO client.example.com\r\n")
+	for i := 0; i < b.N; i++ {
+		script.WriteString(benchMessage)
+	}
+	script.WriteString("QUIT\r\n")
+	b.ReportAllocs()
+	b.ResetTimer()
+	if n := session(b, s, mail.NewPool(1), 1, &script); n != b.N {
+		b.Fatalf("expecting %d messages to be queued, got %d", b.N, n)
+	}
+}
+
+// TestAllocs fails when the hot path allocates more than its budget
+func TestAllocs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the allocation budgets in short mode")
+	}
+	for _, bench := range []struct {
+		name   string
+		f      func(b *testing.B)
+		budget int64
+	}{
+		{"BenchmarkDataPath", BenchmarkDataPath, maxDataPathAllocs},
+		{"BenchmarkHandleClient", BenchmarkHandleClient, maxHandleClientAllocs},
+		{"BenchmarkGreeting", BenchmarkGreeting, maxGreetingAllocs},
+	} {
+		res := testing.Benchmark(bench.f)
+		if allocs := res.AllocsPerOp(); allocs > bench.budget {
+			t.Errorf("%s: %d allocs/op, the budget is %d", bench.name, allocs, bench.budget)
+		}
+		t.Logf("%s: %s %s", bench.name, res, res.MemString())
+	}
+}
@@ -6,18 +6,25 @@ import (
 
 	"bufio"
 	"net/textproto"
+	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"path/filepath"
 
 	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/clock"
 	"github.com/flashmob/go-guerrilla/log"
 	"github.com/flashmob/go-guerrilla/mail"
 	"github.com/flashmob/go-guerrilla/mocks"
+	"github.com/flashmob/go-guerrilla/outbound"
+	"github.com/flashmob/go-guerrilla/response"
 )
 
 // getMockServerConfig gets a mock ServerConfig struct used for creating a new server
@@ -40,10 +47,18 @@ func getMockServerConfig() *ServerConfig {
 	return sc
 }
 
+// getQuietMockServerConfig is getMockServerConfig logging nowhere, for the tests that don't read the log:
+// tests/testlog is shared with the packages tested in parallel
+func getQuietMockServerConfig() *ServerConfig {
+	sc := getMockServerConfig()
+	sc.LogFile = log.OutputOff.String()
+	return sc
+}
+
 // getMockServerConn gets a new server using sc. Server will be using a mocked TCP connection
 // using the dummy backend
 // RCP TO command only allows test.com host
-func getMockServerConn(sc *ServerConfig, t *testing.T) (*mocks.Conn, *server) {
+func getMockServerConn(sc *ServerConfig, t testing.TB) (*mocks.Conn, *server) {
 	var logOpenError error
 	var mainlog log.Logger
 	mainlog, logOpenError = log.GetLogger(sc.LogFile, "debug")
@@ -302,6 +317,929 @@ func TestHandleClient(t *testing.T) {
 	wg.Wait() // wait for handleClient to exit
 }
 
+func TestBufferSizes(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.ReadBufferSize = MinReadBufferSize - 1
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting an error for a read buffer smaller than", MinReadBufferSize)
+	}
+	sc.ReadBufferSize, sc.WriteBufferSize = 0, -1
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting an error for a negative write buffer")
+	}
+	sc.ReadBufferSize, sc.WriteBufferSize = 8192, 1024
+	if err := sc.Validate(); err != nil {
+		t.Error(err)
+	}
+	conn, server := getMockServerConn(sc, t)
+	borrow := func() *client {
+		c, err := server.clientPool.Borrow(conn.Server, 1, server.log(), server.envelopePool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.(*client)
+	}
+	c := borrow()
+	if c.bufin.Size() != 8192 || c.bufout.Size() != 1024 {
+		t.Errorf("expecting buffers of 8192 and 1024 bytes, got %d and %d", c.bufin.Size(), c.bufout.Size())
+	}
+	server.clientPool.Return(c)
+	if c.bufin != nil || c.bufout != nil {
+		t.Error("expecting the buffers to be released")
+	}
+	// the new sizes apply to the clients borrowed after the change, including those reused from the pool
+	sc.ReadBufferSize, sc.WriteBufferSize = 0, 0
+	server.setConfig(sc)
+	c = borrow()
+	if c.bufin.Size() != DefaultBufferSize || c.bufout.Size() != DefaultBufferSize {
+		t.Errorf("expecting buffers of the default size, got %d and %d", c.bufin.Size(), c.bufout.Size())
+	}
+	server.clientPool.Return(c)
+}
+
+func TestDataBudget(t *testing.T) {
+	if err := validateDataBudget(-1); err == nil {
+		t.Error("expecting an error for a negative data_budget")
+	}
+	budget := newDataBudget(100)
+	// only the bytes kept in memory are counted, the rest would be spooled
+	var br budgetReader
+	if _, err := ioutil.ReadAll(br.reset(budget, strings.NewReader(strings.Repeat("a", 50)), 20)); err != nil {
+		t.Fatal(err)
+	}
+	if budget.inUse() != 20 {
+		t.Error("expecting 20 bytes in use, got", budget.inUse())
+	}
+	br.release()
+	if budget.inUse() != 0 {
+		t.Error("expecting the bytes to be released, got", budget.inUse())
+	}
+
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	conn, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	server.budget = budget
+	client := NewClient(conn.Server, 1, server.log(), mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	cmd := func(line string) string {
+		if err := w.PrintfLine(line); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if _, err := r.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	cmd("HELO test.test.com")
+	cmd("MAIL FROM:<sender@example.com>")
+	cmd("RCPT TO:<rcpt@test.com>")
+	// other clients hold the whole budget
+	atomic.StoreInt64(&budget.used, 100)
+	if reply := cmd("DATA"); !strings.HasPrefix(reply, "452 4.3.1") {
+		t.Error("expecting DATA to be deferred, got", reply)
+	}
+	atomic.StoreInt64(&budget.used, 0)
+	if reply := cmd("DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatal("expecting DATA to be accepted, got", reply)
+	}
+	if reply := cmd("Subject: test\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the message to be queued, got", reply)
+	}
+	if budget.inUse() != 0 {
+		t.Error("expecting the message's bytes to be released, got", budget.inUse())
+	}
+	cmd("QUIT")
+	wg.Wait()
+}
+
+func TestCheckHops(t *testing.T) {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "test", Host: "example.com"})
+	received := strings.Repeat("Received: from a\r\n\tby b\r\n", 3)
+	looping := strings.Repeat("Received: from mail-relay.example.org (mail-relay.example.org [192.0.2.25])\r\n"+
+		"\tby mx.example.com (Postfix) with ESMTPS id 4C2F1A0B3D\r\n"+
+		"\tfor <test@example.com>; Tue, 14 Jan 2020 09:31:07 +0000 (UTC)\r\n", 26)
+	for _, test := range []struct {
+		header string
+		max    int
+		err    error
+	}{
+		{received + "Subject: test\r\n", 3, nil},
+		{received + "Subject: test\r\n", 2, HopCountExceeded},
+		{"Delivered-To: Test@example.com\r\n" + received, 25, MailLoopDetected},
+		{"Delivered-To: other@example.com\r\n" + received, 25, nil},
+		// the body is not a header
+		{"Subject: test\r\n\r\n" + received, 1, nil},
+		// a looping message has a header well over 4 KB
+		{looping, 25, HopCountExceeded},
+		{looping + "Delivered-To: test@example.com\r\n", 26, MailLoopDetected},
+	} {
+		e.Data.Reset()
+		e.Data.WriteString(test.header + "\r\nHello\r\n")
+		if err := checkHops(e, test.max, 64<<10); err != test.err {
+			t.Errorf("expecting %v, got %v for %q", test.err, err, test.header)
+		}
+	}
+
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.MaxHops = 1
+	conn, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	client := NewClient(conn.Server, 1, server.log(), mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	cmd := func(line string) string {
+		if err := w.PrintfLine(line); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if _, err := r.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	cmd("HELO test.test.com")
+	cmd("MAIL FROM:<sender@example.com>")
+	cmd("RCPT TO:<rcpt@test.com>")
+	cmd("DATA")
+	if reply := cmd("Received: from a\r\nReceived: from b\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "554 5.4.6") {
+		t.Error("expecting the message to be rejected as looping, got", reply)
+	}
+	// the client can go on
+	cmd("MAIL FROM:<sender@example.com>")
+	cmd("RCPT TO:<rcpt@test.com>")
+	cmd("DATA")
+	if reply := cmd("Received: from a\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the message to be queued, got", reply)
+	}
+	cmd("QUIT")
+	wg.Wait()
+}
+
+func TestServerTags(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.Tags = map[string]string{"tenant": "acme", "env": "prod"}
+	conn, server := getMockServerConn(sc, t)
+	if tags := strings.Join(server.metricTags(), ","); tags != "listener:127.0.0.1:2529,env:prod,tenant:acme" {
+		t.Error("unexpected metric tags", tags)
+	}
+	backend, err := backends.New(backends.BackendConfig{"save_process": "Memory", "save_workers_size": 1}, server.mainlog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.backendStore.Store(backend)
+	if err := backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = backend.Shutdown() }()
+	backends.MemoryStore.Reset()
+	defer backends.MemoryStore.Reset()
+
+	client := NewClient(conn.Server, 1, server.log(), mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	cmd := func(line string) string {
+		if err := w.PrintfLine(line); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if _, err := r.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	cmd("HELO test.test.com")
+	cmd("MAIL FROM:<sender@example.com>")
+	cmd("RCPT TO:<rcpt@test.com>")
+	cmd("DATA")
+	if reply := cmd("Subject: test\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the message to be queued, got", reply)
+	}
+	cmd("QUIT")
+	wg.Wait()
+	if envelopes := backends.MemoryStore.Envelopes(); len(envelopes) != 1 || envelopes[0].Tags["tenant"] != "acme" {
+		t.Error("expecting the envelope to have the server's tags, got", envelopes)
+	}
+
+	// a reload changes the tags
+	sc.Tags = map[string]string{"tenant": "example"}
+	server.setConfig(sc)
+	if tags := strings.Join(server.metricTags(), ","); tags != "listener:127.0.0.1:2529,tenant:example" {
+		t.Error("unexpected metric tags after the reload", tags)
+	}
+	if changes := getChanges(ServerConfig{Tags: map[string]string{"a": "b"}}, *sc); changes["Tags"] != `{"tenant":"example"}` {
+		t.Error("expecting the tags to have changed, got", changes)
+	}
+	sc.Tags = map[string]string{"tenant:id": "acme"}
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting a tag name with a colon to be invalid")
+	}
+}
+
+// pipeClient starts handling a client connected with net.Pipe, which unlike mocks.Conn has deadlines.
+// The returned channel is closed when handleClient returns
+func pipeClient(t *testing.T, server *server, id uint64) (*textproto.Conn, chan struct{}) {
+	serverEnd, clientEnd := net.Pipe()
+	c, err := server.clientPool.Borrow(serverEnd, id, server.log(), server.envelopePool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		server.handleClient(c.(*client))
+		server.clientPool.Return(c)
+		close(done)
+	}()
+	conn := textproto.NewConn(clientEnd)
+	if _, err := conn.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	return conn, done
+}
+
+// pipeCmd sends a command and returns the reply
+func pipeCmd(t *testing.T, conn *textproto.Conn, line string) string {
+	if err := conn.PrintfLine(line); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := conn.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestIdleTimeout(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.IdleTimeout = 10
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting an error for an idle_timeout more than the timeout")
+	}
+	sc.IdleTimeout = 1
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+
+	conn, done := pipeClient(t, server, 1)
+	pipeCmd(t, conn, "HELO test.test.com")
+	// a transaction in progress is not idle
+	pipeCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	time.Sleep(1500 * time.Millisecond)
+	if reply := pipeCmd(t, conn, "RSET"); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the client in a transaction to be served, got", reply)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Error("expecting the idle client to be disconnected after the idle_timeout")
+	}
+}
+
+func TestMaxDataSessions(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.MaxDataSessions = 1
+	_, server := getMockServerConn(sc, t)
+	deferred := make(chan MessageEvent, 1)
+	server.publish = func(topic Event, args ...interface{}) {
+		if topic == EventMessageDeferred {
+			deferred <- args[0].(MessageEvent)
+		}
+	}
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+
+	var conns [2]*textproto.Conn
+	var done [2]chan struct{}
+	for i := range conns {
+		conns[i], done[i] = pipeClient(t, server, uint64(i+1))
+		pipeCmd(t, conns[i], "HELO test.test.com")
+		pipeCmd(t, conns[i], "MAIL FROM:<sender@example.com>")
+		pipeCmd(t, conns[i], "RCPT TO:<rcpt@test.com>")
+	}
+	if reply := pipeCmd(t, conns[0], "DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatal("expecting DATA to be accepted, got", reply)
+	}
+	if reply := pipeCmd(t, conns[1], "DATA"); !strings.HasPrefix(reply, "451 4.3.2") {
+		t.Error("expecting DATA to be deferred, got", reply)
+	}
+	select {
+	case m := <-deferred:
+		if m.Reason != ReasonDataSessions || m.RemoteIP != "pipe" || m.MailFrom != "sender@example.com" ||
+			len(m.RcptTo) != 1 || m.RcptTo[0] != "rcpt@test.com" || m.Code != 451 {
+			t.Errorf("unexpected deferred event %+v", m)
+		}
+	default:
+		t.Error("expecting a deferred event")
+	}
+	// the other client can still send commands
+	if reply := pipeCmd(t, conns[1], "NOOP"); !strings.HasPrefix(reply, "2") {
+		t.Error("expecting NOOP to be served, got", reply)
+	}
+	if reply := pipeCmd(t, conns[0], "Subject: test\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the message to be queued, got", reply)
+	}
+	if reply := pipeCmd(t, conns[1], "DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatal("expecting DATA to be accepted once the first message was saved, got", reply)
+	}
+	// a client that goes away in DATA is not counted anymore
+	_ = conns[1].Close()
+	<-done[1]
+	if n := atomic.LoadInt32(&server.dataSessions); n != 0 {
+		t.Error("expecting no DATA sessions, got", n)
+	}
+	pipeCmd(t, conns[0], "QUIT")
+	<-done[0]
+}
+
+func TestReplies(t *testing.T) {
+	sc := &ServerConfig{Hostname: "mx.test.com", MaxSize: 1024}
+	r := newReplies(sc)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if g := r.greetingFor(42, 7, now); g != "220 mx.test.com SMTP Guerrilla("+Version+") #42 (7) 2020-01-02T03:04:05Z" {
+		t.Error("unexpected greeting", g)
+	}
+	if r.helo != "250 mx.test.com Hello" {
+		t.Error("unexpected HELO reply", r.helo)
+	}
+	expect := "250-mx.test.com Hello\r\n250-SIZE 1024\r\n250-PIPELINING\r\n250-STARTTLS\r\n250-ENHANCEDSTATUSCODES\r\n250 HELP"
+	if r.ehloTLS != expect {
+		t.Errorf("unexpected EHLO reply %q", r.ehloTLS)
+	}
+	if r.ehlo != strings.Replace(expect, "250-STARTTLS\r\n", "", 1) {
+		t.Errorf("unexpected EHLO reply without STARTTLS %q", r.ehlo)
+	}
+	// a new config makes new replies
+	_, server := getMockServerConn(getMockServerConfig(), t)
+	sc = getMockServerConfig()
+	sc.Hostname = "other.test.com"
+	server.setConfig(sc)
+	if !strings.Contains(server.replies().helo, "other.test.com") {
+		t.Error("expecting the replies of the new config, got", server.replies().helo)
+	}
+}
+
+func TestRelayDeniedResponse(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	for _, reply := range []string{"250 OK", "550 4.7.1 Denied", "Denied", "55 5.7.1"} {
+		sc.RelayDeniedResponse = reply
+		if err := sc.Validate(); err == nil {
+			t.Errorf("expecting %q to be invalid", reply)
+		}
+	}
+	sc.RelayDeniedResponse = "550 5.7.1 Relay access denied"
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	conn, done := pipeClient(t, server, 1)
+	pipeCmd(t, conn, "HELO test.test.com")
+	pipeCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	if reply := pipeCmd(t, conn, "RCPT TO:<rcpt@example.org>"); reply != "550 5.7.1 Relay access denied example.org" {
+		t.Error("expecting the relay to be denied permanently, got", reply)
+	}
+	pipeCmd(t, conn, "QUIT")
+	<-done
+
+	// the default is temporary
+	server.setConfig(getMockServerConfig())
+	conn, done = pipeClient(t, server, 2)
+	pipeCmd(t, conn, "HELO test.test.com")
+	pipeCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	if reply := pipeCmd(t, conn, "RCPT TO:<rcpt@example.org>"); !strings.HasPrefix(reply, "454 4.1.1") {
+		t.Error("expecting the relay to be denied, got", reply)
+	}
+	pipeCmd(t, conn, "QUIT")
+	<-done
+}
+
+func TestAddressLiterals(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.AddressLiterals = "deny"
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting address_literals to be invalid")
+	}
+	_, server := getMockServerConn(sc, t)
+	server.setAllowedHosts([]string{"test.com", "[192.0.2.1]"})
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	for _, test := range []struct {
+		literals   string
+		mail, rcpt string
+	}{
+		{"", "250", "250"},
+		{"allow", "250", "250"},
+		{"reject_rcpt", "250", "550 5.1.3"},
+		{"reject", "550 5.1.7", "550 5.1.3"},
+	} {
+		sc.AddressLiterals = test.literals
+		server.setConfig(sc)
+		conn, done := pipeClient(t, server, 1)
+		pipeCmd(t, conn, "HELO test.test.com")
+		if reply := pipeCmd(t, conn, "MAIL FROM:<sender@[192.0.2.2]>"); !strings.HasPrefix(reply, test.mail) {
+			t.Errorf("%s: expecting the sender to get %s, got %s", test.literals, test.mail, reply)
+		}
+		pipeCmd(t, conn, "RSET")
+		pipeCmd(t, conn, "MAIL FROM:<sender@example.com>")
+		if reply := pipeCmd(t, conn, "RCPT TO:<rcpt@[192.0.2.1]>"); !strings.HasPrefix(reply, test.rcpt) {
+			t.Errorf("%s: expecting the recipient to get %s, got %s", test.literals, test.rcpt, reply)
+		}
+		pipeCmd(t, conn, "QUIT")
+		<-done
+	}
+}
+
+func TestNullSender(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.NullSenderMaxSize = 64
+	sc.NullSenderSingleRcpt = true
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+
+	conn, done := pipeClient(t, server, 1)
+	pipeCmd(t, conn, "HELO test.test.com")
+	if reply := pipeCmd(t, conn, "MAIL FROM:<> SIZE=65"); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Error("expecting the size of the bounce to be rejected, got", reply)
+	}
+	if reply := pipeCmd(t, conn, "MAIL FROM:<> SIZE=64"); !strings.HasPrefix(reply, "250") {
+		t.Fatal("expecting the bounce to be accepted, got", reply)
+	}
+	if reply := pipeCmd(t, conn, "MAIL FROM:<>"); !strings.HasPrefix(reply, "503") {
+		t.Error("expecting a nested MAIL to be rejected, got", reply)
+	}
+	pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+	if reply := pipeCmd(t, conn, "RCPT TO:<other@test.com>"); !strings.HasPrefix(reply, "452 4.5.3") {
+		t.Error("expecting the second recipient of the bounce to be deferred, got", reply)
+	}
+	pipeCmd(t, conn, "DATA")
+	if reply := pipeCmd(t, conn, "Subject: test\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the bounce to be queued, got", reply)
+	}
+	// a sender other than <> is not limited
+	pipeCmd(t, conn, "MAIL FROM:<sender@example.com> SIZE=65")
+	pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+	if reply := pipeCmd(t, conn, "RCPT TO:<other@test.com>"); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the second recipient to be accepted, got", reply)
+	}
+	pipeCmd(t, conn, "RSET")
+	pipeCmd(t, conn, "MAIL FROM:<>")
+	pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+	pipeCmd(t, conn, "DATA")
+	if reply := pipeCmd(t, conn, "Subject: test\r\n\r\n"+strings.Repeat("x", 64)+"\r\n."); !strings.HasPrefix(reply, "552 5.3.4") {
+		t.Error("expecting the bounce to be too big, got", reply)
+	}
+	<-done
+}
+
+func TestMaxHeaderSize(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.MaxHeaderSize = 64
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	rejected := make(chan MessageEvent, 1)
+	server.publish = func(topic Event, args ...interface{}) {
+		if topic == EventMessageRejected {
+			rejected <- args[0].(MessageEvent)
+		}
+	}
+
+	conn, done := pipeClient(t, server, 1)
+	pipeCmd(t, conn, "HELO test.test.com")
+	pipeCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+	pipeCmd(t, conn, "DATA")
+	// the body is not limited
+	body := strings.Repeat("x", 80) + "\r\n"
+	if reply := pipeCmd(t, conn, "Subject: test\r\n\r\n"+body+body+"."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the message to be queued, got", reply)
+	}
+	pipeCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+	pipeCmd(t, conn, "DATA")
+	header := "X-Test: " + strings.Repeat("x", 40) + "\r\n"
+	if reply := pipeCmd(t, conn, header+header+"\r\nHello\r\n."); !strings.HasPrefix(reply, "552 5.2.3") {
+		t.Error("expecting the header to be too big, got", reply)
+	}
+	if m := <-rejected; m.Reason != ReasonHeaderSize {
+		t.Error("expecting the reason to be", ReasonHeaderSize, "got", m.Reason)
+	}
+	<-done
+}
+
+func TestCommandHistoryEvents(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.MaxHeaderSize = 64
+	sc.CommandHistory = 3
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	rejected := make(chan MessageEvent, 1)
+	disconnected := make(chan ClientInfo, 1)
+	server.publish = func(topic Event, args ...interface{}) {
+		switch topic {
+		case EventMessageRejected:
+			rejected <- args[0].(MessageEvent)
+		case EventClientDisconnect:
+			disconnected <- args[0].(ClientInfo)
+		}
+	}
+
+	conn, done := pipeClient(t, server, 1)
+	pipeCmd(t, conn, "HELO test.test.com")
+	pipeCmd(t, conn, "AUTH PLAIN c2VjcmV0")
+	pipeCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+	pipeCmd(t, conn, "DATA")
+	header := "X-Test: " + strings.Repeat("x", 40) + "\r\n"
+	pipeCmd(t, conn, header+header+"\r\nHello\r\n.")
+	<-done
+	want := []string{"MAIL FROM:<sender@example.com>", "RCPT TO:<rcpt@test.com>", "DATA"}
+	if m := <-rejected; !reflect.DeepEqual(m.Client.Commands, want) {
+		t.Error("expecting the commands of the rejected message to be", want, "got", m.Client.Commands)
+	}
+	if info := <-disconnected; !reflect.DeepEqual(info.Commands, want) {
+		t.Error("expecting the commands of the disconnected client to be", want, "got", info.Commands)
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.TarpitDelay = 1
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	server.setConnectionPolicy(ConnectionPolicyFunc(func(ip net.IP, listener string) PolicyAction {
+		return PolicyTarpit
+	}))
+
+	start := time.Now()
+	conn, done := pipeClient(t, server, 1)
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Error("expecting the greeting to be held for the tarpit_delay, it took", elapsed)
+	}
+	if reply := pipeCmd(t, conn, "QUIT"); !strings.HasPrefix(reply, "221") {
+		t.Error("expecting QUIT to be accepted, got", reply)
+	}
+	<-done
+}
+
+func TestStrict7Bit(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	sc.Strict7Bit = "strict"
+	if err := sc.Validate(); err == nil {
+		t.Error("expecting strict_7bit to be invalid")
+	}
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	for _, test := range []struct {
+		strict, mail, reply string
+	}{
+		{"", "MAIL FROM:<sender@example.com>", "250"},
+		{"reject", "MAIL FROM:<sender@example.com> BODY=8BITMIME", "250"},
+		{"reject", "MAIL FROM:<sender@example.com>", "554 5.6.0"},
+		{"transcode", "MAIL FROM:<sender@example.com>", "250"},
+	} {
+		sc.Strict7Bit = test.strict
+		server.setConfig(sc)
+		conn, done := pipeClient(t, server, 1)
+		pipeCmd(t, conn, "HELO test.test.com")
+		pipeCmd(t, conn, test.mail)
+		pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+		pipeCmd(t, conn, "DATA")
+		if reply := pipeCmd(t, conn, "Subject: test\r\n\r\nCaf\xc3\xa9\r\n."); !strings.HasPrefix(reply, test.reply) {
+			t.Errorf("%s: expecting %s, got %s", test.strict, test.reply, reply)
+		}
+		pipeCmd(t, conn, "QUIT")
+		<-done
+	}
+}
+
+func TestTimings(t *testing.T) {
+	timings := make(chan mail.Timings, 1)
+	backends.Svc.AddProcessor("Timings", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail {
+					timings <- e.Timings
+				}
+				return p.Process(e, task)
+			})
+		}
+	})
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	_, server := getMockServerConn(sc, t)
+	be, err := backends.New(backends.BackendConfig{"save_process": "Timings", "save_workers_size": 1}, server.log())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.setBackend(be)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+
+	conn, done := pipeClient(t, server, 1)
+	pipeCmd(t, conn, "HELO test.test.com")
+	for i := 0; i < 2; i++ {
+		pipeCmd(t, conn, "MAIL FROM:<sender@example.com>")
+		pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+		pipeCmd(t, conn, "RCPT TO:<other@test.com>")
+		pipeCmd(t, conn, "DATA")
+		if reply := pipeCmd(t, conn, "Subject: test\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+			t.Fatal("expecting the message to be queued, got", reply)
+		}
+		tm := <-timings
+		if tm.Connected.IsZero() || tm.Mail.Before(tm.Connected) || tm.FirstRcpt.Before(tm.Mail) ||
+			tm.DataStart.Before(tm.FirstRcpt) || tm.DataEnd.Before(tm.DataStart) || !tm.Saved.IsZero() {
+			t.Errorf("unexpected timings of transaction %d: %+v", i, tm)
+		}
+	}
+	pipeCmd(t, conn, "QUIT")
+	<-done
+}
+
+func TestRcptResults(t *testing.T) {
+	backends.Svc.AddProcessor("FullMailbox", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWith(func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task != backends.TaskSaveMail {
+					return p.Process(e, task)
+				}
+				var rcpts []backends.Result
+				for i := range e.RcptTo {
+					if e.RcptTo[i].User == "full" {
+						rcpts = append(rcpts, backends.NewResult("452 4.2.2 Mailbox full"))
+					} else {
+						rcpts = append(rcpts, backends.NewResult(response.Canned.SuccessMessageQueued, " ", e.QueuedId))
+					}
+				}
+				return backends.NewRcptResults(backends.NewResult(response.Canned.SuccessMessageQueued, " ", e.QueuedId), rcpts), nil
+			})
+		}
+	})
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	_, server := getMockServerConn(sc, t)
+	be, err := backends.New(backends.BackendConfig{"save_process": "FullMailbox", "save_workers_size": 1}, server.log())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.setBackend(be)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	accepted := make(chan MessageEvent, 1)
+	server.publish = func(topic Event, args ...interface{}) {
+		if topic == EventMessageAccepted {
+			accepted <- args[0].(MessageEvent)
+		}
+	}
+
+	// the recipients that failed are bounced by the outbound queue
+	dir, err := ioutil.TempDir("", "outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	q := outbound.New(outbound.Config{QueueDir: dir, RetryMin: "1h"}, server.log())
+	defer q.Close()
+	outbound.Set(q)
+	defer outbound.Set(nil)
+
+	conn, done := pipeClient(t, server, 1)
+	pipeCmd(t, conn, "HELO test.test.com")
+	// the delivery of the bounce to an address literal fails without looking up the DNS, it stays queued
+	pipeCmd(t, conn, "MAIL FROM:<sender@[127.0.0.1]>")
+	pipeCmd(t, conn, "RCPT TO:<rcpt@test.com>")
+	pipeCmd(t, conn, "RCPT TO:<full@test.com>")
+	pipeCmd(t, conn, "DATA")
+	if reply := pipeCmd(t, conn, "Subject: test\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the message to be queued, got", reply)
+	}
+	m := <-accepted
+	if len(m.Rcpts) != 2 || m.Rcpts[0].Rcpt != "rcpt@test.com" || m.Rcpts[0].Code != 250 ||
+		m.Rcpts[1].Rcpt != "full@test.com" || m.Rcpts[1].Code != 452 {
+		t.Errorf("unexpected results of the recipients %+v", m.Rcpts)
+	}
+	pipeCmd(t, conn, "QUIT")
+	<-done
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatal("expecting a bounce in the queue, got", files)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "Final-Recipient: rfc822; full@test.com") ||
+		strings.Contains(string(b), "rcpt@test.com") || !strings.Contains(string(b), "Subject: test") {
+		t.Error("the bounce should be about full@test.com only, got", string(b))
+	}
+}
+
+func TestShutdownIdleFirst(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+
+	idle, idleDone := pipeClient(t, server, 1)
+	pipeCmd(t, idle, "HELO test.test.com")
+	sender, senderDone := pipeClient(t, server, 2)
+	pipeCmd(t, sender, "HELO test.test.com")
+	pipeCmd(t, sender, "MAIL FROM:<sender@example.com>")
+
+	go server.clientPool.ShutdownState()
+	// the idle client is told right away
+	if reply, err := idle.ReadLine(); err != nil || !strings.HasPrefix(reply, "421") {
+		t.Error("expecting the idle client to be shut down, got", reply, err)
+	}
+	<-idleDone
+	// the sender may finish its message
+	pipeCmd(t, sender, "RCPT TO:<rcpt@test.com>")
+	if reply := pipeCmd(t, sender, "DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatal("expecting DATA to be accepted while shutting down, got", reply)
+	}
+	if reply := pipeCmd(t, sender, "Subject: test\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the message to be queued while shutting down, got", reply)
+	}
+	if reply, err := sender.ReadLine(); err != nil || !strings.HasPrefix(reply, "421") {
+		t.Error("expecting the sender to be shut down after its message, got", reply, err)
+	}
+	<-senderDone
+	server.clientPool.ShutdownWait()
+}
+
+func TestShutdownGrace(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	// the real clock can be swapped for the mock
+	server.setClock(nil)
+	mock := clock.NewMock(time.Now())
+	server.setClock(mock)
+
+	sender, senderDone := pipeClient(t, server, 1)
+	pipeCmd(t, sender, "HELO test.test.com")
+	pipeCmd(t, sender, "MAIL FROM:<sender@example.com>")
+	server.clientPool.ShutdownState()
+	if reply := pipeCmd(t, sender, "RCPT TO:<rcpt@test.com>"); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the transaction to continue while shutting down, got", reply)
+	}
+	// the shutdown has lasted longer than the timeout, without sleeping for it
+	mock.Add(time.Duration(sc.Timeout+1) * time.Second)
+	if reply := pipeCmd(t, sender, "RCPT TO:<rcpt2@test.com>"); !strings.HasPrefix(reply, "421") {
+		t.Error("expecting the sender to be shut down once the grace is over, got", reply)
+	}
+	<-senderDone
+	server.clientPool.ShutdownWait()
+}
+
+// writeCounter counts the writes to a connection
+type writeCounter struct {
+	net.Conn
+	writes int32
+}
+
+func (w *writeCounter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&w.writes, 1)
+	return w.Conn.Write(b)
+}
+
+func TestPipelining(t *testing.T) {
+	sc := getQuietMockServerConfig()
+	sc.TLS.StartTLSOn = false
+	_, server := getMockServerConn(sc, t)
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	serverEnd, clientEnd := net.Pipe()
+	counter := &writeCounter{Conn: serverEnd}
+	client := NewClient(counter, 1, server.log(), mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	conn := textproto.NewConn(clientEnd)
+	if _, err := conn.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	pipeCmd(t, conn, "HELO test.test.com")
+
+	writes := atomic.LoadInt32(&counter.writes)
+	batch := "MAIL FROM:<sender@example.com>\r\n"
+	for i := 0; i < 10; i++ {
+		batch += fmt.Sprintf("RCPT TO:<rcpt%d@test.com>\r\n", i)
+	}
+	batch += "DATA\r\n"
+	if _, err := clientEnd.Write([]byte(batch)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		reply, err := conn.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := "250"
+		if i == 11 {
+			expect = "354"
+		}
+		if !strings.HasPrefix(reply, expect) {
+			t.Errorf("expecting %s to the command #%d, got %s", expect, i, reply)
+		}
+	}
+	if n := atomic.LoadInt32(&counter.writes) - writes; n != 1 {
+		t.Error("expecting the responses to the pipelined commands in one write, got", n)
+	}
+	if reply := pipeCmd(t, conn, "Subject: test\r\n\r\nHello\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Error("expecting the message to be queued, got", reply)
+	}
+	pipeCmd(t, conn, "QUIT")
+	wg.Wait()
+}
+
 func TestGithubIssue197(t *testing.T) {
 	var mainlog log.Logger
 	var logOpenError error
@@ -1020,6 +1958,12 @@ func TestGatewayPanic(t *testing.T) {
 	if err != nil {
 		t.Error("server didn't start")
 	} else {
+		panics := make(chan backends.PanicInfo, 2)
+		if err := d.Subscribe(EventBackendPanic, func(p backends.PanicInfo) {
+			panics <- p
+		}); err != nil {
+			t.Error(err)
+		}
 
 		conn, err := net.Dial("tcp", "127.0.0.1:2525")
 		if err != nil {
@@ -1079,6 +2023,14 @@ func TestGatewayPanic(t *testing.T) {
 					t.Error("Expected the reply to have'", expect, "'but got", str)
 				}
 			}
+			select {
+			case p := <-panics:
+				if p.Stack != "save_process" || p.Value != "panic on purpose" || !strings.Contains(p.Trace, "Debugger") {
+					t.Errorf("unexpected panic event %+v", p)
+				}
+			default:
+				t.Error("expecting the panic to be published")
+			}
 		}
 		d.Shutdown()
 	}
@@ -1148,3 +2100,89 @@ func TestAllowsHosts(t *testing.T) {
 	s.setAllowedHosts([]string{"grr.la", "example.com"})
 
 }
+
+func TestAllowsHostPatterns(t *testing.T) {
+	s := server{}
+	s.setAllowedHosts([]string{"grr.la", `~mail\.(eu|us)-[0-9]+\.example\.com`, "~[invalid"})
+	testTable := map[string]bool{
+		"grr.la":                   true,
+		"mail.eu-1.example.com":    true,
+		"MAIL.US-42.EXAMPLE.COM":   true,
+		"mail.asia-1.example.com":  false,
+		"mail.eu-1.example.com.ru": false,
+		"xmail.eu-1.example.com":   false,
+		"[invalid":                 false,
+	}
+	// the second time, the results are cached
+	for i := 0; i < 2; i++ {
+		for host, allows := range testTable {
+			if res := s.allowsHost(host); res != allows {
+				t.Error(host, ": expected", allows, "but got", res)
+			}
+		}
+	}
+	if len(s.hosts.patterns) != 1 || len(s.hosts.matched) != 6 {
+		t.Error("expecting 1 pattern and 6 cached results, got", len(s.hosts.patterns), len(s.hosts.matched))
+	}
+	if err := (&AppConfig{AllowedHosts: []string{"~[invalid"}}).setDefaults(); err == nil {
+		t.Error("expecting the invalid pattern to be rejected")
+	}
+}
+
+func TestAllowsHostIDN(t *testing.T) {
+	s := server{}
+	s.setAllowedHosts([]string{"bücher.example", "*.münchen.test"})
+	testTable := map[string]bool{
+		"bücher.example":           true,
+		"xn--bcher-kva.example":    true,
+		"XN--BCHER-KVA.EXAMPLE":    true,
+		"mail.xn--mnchen-3ya.test": true,
+		"mail.münchen.test":        true,
+		"xn--mnchen-3ya.test":      false,
+		"buecher.example":          false,
+	}
+	for host, allows := range testTable {
+		if res := s.allowsHost(host); res != allows {
+			t.Error(host, ": expected", allows, "but got", res)
+		}
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	d := Daemon{Config: &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers: []ServerConfig{{
+			ListenInterface: "127.0.0.1:2666",
+			IsEnabled:       true,
+			ReusePort:       true,
+			AcceptLoops:     4,
+		}},
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := d.g.(*guerrilla).findServer("127.0.0.1:2666")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.listeners) != 4 {
+		t.Error("expecting 4 listeners, got", len(s.listeners))
+	}
+	for i := 0; i < 10; i++ {
+		if err := talkToServer("127.0.0.1:2666"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// all the accept loops stop
+	d.Shutdown()
+	if _, err := net.Dial("tcp", "127.0.0.1:2666"); err == nil {
+		t.Error("expecting the server to stop listening")
+	}
+	if s.state != ServerStateStopped {
+		t.Error("expecting the server to be stopped, it's", s.stateName())
+	}
+}
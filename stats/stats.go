@@ -0,0 +1,365 @@
+// Package stats aggregates the outcome of the messages received, per listener and per recipient domain,
+// over rolling windows of the last minute, 5 minutes and hour
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxDomains is the number of recipient domains tracked when max_domains is not set
+const DefaultMaxDomains = 1000
+
+// OtherDomains is the key of the domains counted once MaxDomains are tracked
+const OtherDomains = "(other)"
+
+// Config configures the statistics
+type Config struct {
+	// LogInterval is how often the statistics are written to the main log, eg. "5m". Never if empty
+	LogInterval string `json:"log_interval,omitempty"`
+	// MaxDomains is the number of recipient domains tracked, the other domains are counted under OtherDomains.
+	// DefaultMaxDomains if 0
+	MaxDomains int `json:"max_domains,omitempty"`
+}
+
+// Validate checks the config, an empty config is valid
+func (c *Config) Validate() error {
+	if c.LogInterval != "" {
+		if d, err := time.ParseDuration(c.LogInterval); err != nil || d <= 0 {
+			return fmt.Errorf("stats log_interval [%s] is not a valid duration", c.LogInterval)
+		}
+	}
+	if c.MaxDomains < 0 {
+		return errors.New("stats max_domains cannot be negative")
+	}
+	return nil
+}
+
+// logInterval returns how often the statistics are logged, 0 if never
+func (c *Config) logInterval() time.Duration {
+	d, _ := time.ParseDuration(c.LogInterval)
+	return d
+}
+
+func (c *Config) maxDomains() int {
+	if c.MaxDomains == 0 {
+		return DefaultMaxDomains
+	}
+	return c.MaxDomains
+}
+
+// Outcome is what happened to a message
+type Outcome int
+
+const (
+	// Accepted messages were saved by the backend
+	Accepted Outcome = iota
+	// Rejected messages got a permanent (5xx) error
+	Rejected
+	// Deferred messages got a transient (4xx) error
+	Deferred
+)
+
+// Counts are the messages and bytes received
+type Counts struct {
+	Accepted uint64 `json:"accepted"`
+	Rejected uint64 `json:"rejected"`
+	Deferred uint64 `json:"deferred"`
+	// Bytes is the size of all the messages received, whatever their outcome
+	Bytes uint64 `json:"bytes"`
+}
+
+// Messages returns the number of messages received
+func (c Counts) Messages() uint64 {
+	return c.Accepted + c.Rejected + c.Deferred
+}
+
+func (c *Counts) add(o Counts) {
+	c.Accepted += o.Accepted
+	c.Rejected += o.Rejected
+	c.Deferred += o.Deferred
+	c.Bytes += o.Bytes
+}
+
+// Windows are the counts over the rolling windows
+type Windows struct {
+	Minute     Counts `json:"1m"`
+	FiveMinute Counts `json:"5m"`
+	Hour       Counts `json:"1h"`
+}
+
+// Report is a snapshot of the statistics
+type Report struct {
+	Listeners map[string]Windows `json:"listeners"`
+	Domains   map[string]Windows `json:"domains"`
+}
+
+// TopDomains returns the n domains that received the most messages in the last hour, busiest first
+func (r Report) TopDomains(n int) []string {
+	domains := make([]string, 0, len(r.Domains))
+	for d := range r.Domains {
+		domains = append(domains, d)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		mi, mj := r.Domains[domains[i]].Hour.Messages(), r.Domains[domains[j]].Hour.Messages()
+		if mi != mj {
+			return mi > mj
+		}
+		return domains[i] < domains[j]
+	})
+	if len(domains) > n {
+		domains = domains[:n]
+	}
+	return domains
+}
+
+// LogTopDomains is the number of domains written to the log
+const LogTopDomains = 10
+
+// Log writes a line for each listener, and for the LogTopDomains busiest domains, to l
+func (r Report) Log(l log.Logger) {
+	listeners := make([]string, 0, len(r.Listeners))
+	for listener := range r.Listeners {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+	for _, listener := range listeners {
+		l.WithFields(r.Listeners[listener].fields()).WithField("listener", listener).Info("listener stats")
+	}
+	for _, domain := range r.TopDomains(LogTopDomains) {
+		l.WithFields(r.Domains[domain].fields()).WithField("domain", domain).Info("domain stats")
+	}
+}
+
+// fields returns the counts as log fields, eg. accepted_5m
+func (w Windows) fields() logrus.Fields {
+	f := make(logrus.Fields, 12)
+	for suffix, c := range map[string]Counts{"1m": w.Minute, "5m": w.FiveMinute, "1h": w.Hour} {
+		f["accepted_"+suffix] = c.Accepted
+		f["rejected_"+suffix] = c.Rejected
+		f["deferred_"+suffix] = c.Deferred
+		f["bytes_"+suffix] = c.Bytes
+	}
+	return f
+}
+
+// bucket holds the counts of one slot of time
+type bucket struct {
+	// slot is the time of the counts divided by the width of the ring's buckets
+	slot int64
+	Counts
+}
+
+// ring keeps the counts of the last len(buckets) slots of width seconds
+type ring struct {
+	width   int64
+	buckets []bucket
+}
+
+func newRing(width time.Duration, n int) ring {
+	return ring{width: int64(width / time.Second), buckets: make([]bucket, n)}
+}
+
+func (r *ring) add(now time.Time, c Counts) {
+	slot := now.Unix() / r.width
+	b := &r.buckets[slot%int64(len(r.buckets))]
+	if b.slot != slot {
+		*b = bucket{slot: slot}
+	}
+	b.add(c)
+}
+
+// sum returns the counts of the last n slots, including the current one
+func (r *ring) sum(now time.Time, n int64) Counts {
+	var c Counts
+	slot := now.Unix() / r.width
+	for i := range r.buckets {
+		if b := &r.buckets[i]; b.slot <= slot && b.slot > slot-n {
+			c.add(b.Counts)
+		}
+	}
+	return c
+}
+
+// series are the counts of a listener or a domain. The last minute is kept in buckets of 5 seconds,
+// the last hour in buckets of a minute
+type series struct {
+	fine   ring
+	coarse ring
+	last   time.Time
+}
+
+func newSeries() *series {
+	return &series{fine: newRing(5*time.Second, 12), coarse: newRing(time.Minute, 60)}
+}
+
+func (s *series) add(now time.Time, c Counts) {
+	s.fine.add(now, c)
+	s.coarse.add(now, c)
+	s.last = now
+}
+
+func (s *series) windows(now time.Time) Windows {
+	return Windows{
+		Minute:     s.fine.sum(now, 12),
+		FiveMinute: s.coarse.sum(now, 5),
+		Hour:       s.coarse.sum(now, 60),
+	}
+}
+
+// Aggregator aggregates the outcome of messages. The zero value is not usable, use New
+type Aggregator struct {
+	listeners  map[string]*series
+	domains    map[string]*series
+	maxDomains int
+	// now returns the current time, it's replaced in tests
+	now func() time.Time
+	// stopLog is closed to stop writing the statistics to the log
+	stopLog chan struct{}
+	sync.Mutex
+}
+
+// New returns an aggregator for c, which writes the statistics to l if c has a log_interval
+func New(c Config, l log.Logger) *Aggregator {
+	a := &Aggregator{
+		listeners: make(map[string]*series),
+		domains:   make(map[string]*series),
+		now:       time.Now,
+	}
+	a.Reconfigure(c, l)
+	return a
+}
+
+// Reconfigure applies c. Domains already tracked stay tracked until they are idle for an hour
+func (a *Aggregator) Reconfigure(c Config, l log.Logger) {
+	a.Lock()
+	defer a.Unlock()
+	a.maxDomains = c.maxDomains()
+	if a.stopLog != nil {
+		close(a.stopLog)
+		a.stopLog = nil
+	}
+	if interval := c.logInterval(); interval > 0 {
+		a.stopLog = make(chan struct{})
+		go a.logEvery(interval, l, a.stopLog)
+	}
+}
+
+// Close stops writing the statistics to the log
+func (a *Aggregator) Close() {
+	a.Lock()
+	defer a.Unlock()
+	if a.stopLog != nil {
+		close(a.stopLog)
+		a.stopLog = nil
+	}
+}
+
+// logEvery writes a report to l at each interval, until stop is closed
+func (a *Aggregator) logEvery(interval time.Duration, l log.Logger, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.Report().Log(l)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Record counts a message received by the server listening on listener, for the given recipients.
+// The message is counted once for each of their domains
+func (a *Aggregator) Record(listener string, rcpts []string, outcome Outcome, size int64) {
+	c := Counts{}
+	switch outcome {
+	case Accepted:
+		c.Accepted = 1
+	case Rejected:
+		c.Rejected = 1
+	case Deferred:
+		c.Deferred = 1
+	}
+	if size > 0 {
+		c.Bytes = uint64(size)
+	}
+	a.Lock()
+	defer a.Unlock()
+	now := a.now()
+	a.seriesOf(a.listeners, listener, -1).add(now, c)
+	// several domains may be counted under OtherDomains
+	seen := make(map[*series]bool, len(rcpts))
+	for _, rcpt := range rcpts {
+		s := a.seriesOf(a.domains, Domain(rcpt), a.maxDomains)
+		if !seen[s] {
+			seen[s] = true
+			s.add(now, c)
+		}
+	}
+}
+
+// seriesOf returns the series of key, creating it unless there are max series already,
+// in which case the series of OtherDomains is returned. There's no maximum if max is negative
+func (a *Aggregator) seriesOf(m map[string]*series, key string, max int) *series {
+	if s, ok := m[key]; ok {
+		return s
+	}
+	if max >= 0 && len(m) >= max {
+		a.prune(m)
+		if len(m) >= max {
+			key = OtherDomains
+			if s, ok := m[key]; ok {
+				return s
+			}
+		}
+	}
+	s := newSeries()
+	m[key] = s
+	return s
+}
+
+// prune removes the series that had no messages in the last hour
+func (a *Aggregator) prune(m map[string]*series) {
+	idle := a.now().Add(-time.Hour)
+	for key, s := range m {
+		if s.last.Before(idle) {
+			delete(m, key)
+		}
+	}
+}
+
+// Report returns the counts of each listener and domain that received messages in the last hour
+func (a *Aggregator) Report() Report {
+	a.Lock()
+	defer a.Unlock()
+	a.prune(a.listeners)
+	a.prune(a.domains)
+	now := a.now()
+	r := Report{
+		Listeners: make(map[string]Windows, len(a.listeners)),
+		Domains:   make(map[string]Windows, len(a.domains)),
+	}
+	for key, s := range a.listeners {
+		r.Listeners[key] = s.windows(now)
+	}
+	for key, s := range a.domains {
+		r.Domains[key] = s.windows(now)
+	}
+	return r
+}
+
+// Domain returns the lower-cased domain of an address, or the address if it has no domain
+func Domain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		address = address[i+1:]
+	}
+	return strings.ToLower(strings.TrimSuffix(address, ">"))
+}
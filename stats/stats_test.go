@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := (&Config{}).Validate(); err != nil {
+		t.Error("an empty config should be valid", err)
+	}
+	for _, c := range []Config{
+		{LogInterval: "often"},
+		{LogInterval: "-1m"},
+		{MaxDomains: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expecting an error for %+v", c)
+		}
+	}
+}
+
+func TestDomain(t *testing.T) {
+	for address, domain := range map[string]string{
+		"test@Example.COM":  "example.com",
+		"<test@grr.la>":     "grr.la",
+		"postmaster":        "postmaster",
+		"a@b@sub.grr.la":    "sub.grr.la",
+		"test@grr.la.":      "grr.la.",
+		"test@[127.0.0.1]":  "[127.0.0.1]",
+		"Test@Mail.GRR.la>": "mail.grr.la",
+	} {
+		if d := Domain(address); d != domain {
+			t.Errorf("expecting the domain of %s to be %s, got %s", address, domain, d)
+		}
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	l, err := log.GetLogger(log.OutputOff.String(), "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	a := New(Config{MaxDomains: 2}, l)
+	defer a.Close()
+	a.now = func() time.Time { return now }
+
+	// counted once for grr.la
+	a.Record("127.0.0.1:25", []string{"a@grr.la", "b@GRR.LA", "c@example.com"}, Accepted, 100)
+	now = now.Add(2 * time.Minute)
+	a.Record("127.0.0.1:25", []string{"a@grr.la"}, Rejected, 10)
+	a.Record("127.0.0.1:587", []string{"a@grr.la"}, Deferred, 20)
+	// over max_domains
+	a.Record("127.0.0.1:25", []string{"a@test.com", "a@other.com"}, Accepted, 30)
+
+	r := a.Report()
+	if w := r.Listeners["127.0.0.1:25"]; w.Minute != (Counts{Accepted: 1, Rejected: 1, Bytes: 40}) ||
+		w.FiveMinute != (Counts{Accepted: 2, Rejected: 1, Bytes: 140}) || w.Hour != w.FiveMinute {
+		t.Errorf("unexpected counts for the listener %+v", w)
+	}
+	if w := r.Listeners["127.0.0.1:587"]; w.Hour != (Counts{Deferred: 1, Bytes: 20}) {
+		t.Errorf("unexpected counts for the second listener %+v", w)
+	}
+	if w := r.Domains["grr.la"]; w.Minute.Messages() != 2 || w.Hour != (Counts{Accepted: 1, Rejected: 1, Deferred: 1, Bytes: 130}) {
+		t.Errorf("unexpected counts for grr.la %+v", w)
+	}
+	if len(r.Domains) != 3 || r.Domains[OtherDomains].Hour.Accepted != 1 {
+		t.Errorf("expecting the domains over max_domains to be counted together, got %+v", r.Domains)
+	}
+	if top := r.TopDomains(2); len(top) != 2 || top[0] != "grr.la" || top[1] != OtherDomains {
+		t.Errorf("unexpected top domains %v", top)
+	}
+
+	// the windows roll
+	now = now.Add(10 * time.Minute)
+	if w := a.Report().Listeners["127.0.0.1:25"]; w.Minute.Messages() != 0 || w.FiveMinute.Messages() != 0 || w.Hour.Messages() != 3 {
+		t.Errorf("unexpected counts after 10 minutes %+v", w)
+	}
+	// idle listeners and domains are removed after an hour, making room for new domains
+	now = now.Add(time.Hour)
+	a.Record("127.0.0.1:25", []string{"a@new.com"}, Accepted, 1)
+	r = a.Report()
+	if len(r.Listeners) != 1 || len(r.Domains) != 1 || r.Domains["new.com"].Minute.Accepted != 1 {
+		t.Errorf("expecting the idle series to be removed, got %+v", r)
+	}
+	r.Log(l)
+}
+
+func TestLogInterval(t *testing.T) {
+	l, err := log.GetLogger(log.OutputOff.String(), "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := New(Config{LogInterval: "1h"}, l)
+	if a.stopLog == nil {
+		t.Error("expecting the stats to be logged")
+	}
+	a.Reconfigure(Config{}, l)
+	if a.stopLog != nil {
+		t.Error("expecting the stats not to be logged")
+	}
+	a.Close()
+}
@@ -0,0 +1,188 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+// OTLPExporter posts spans to an OTLP/HTTP endpoint, using the JSON encoding
+type OTLPExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter returns an exporter that posts to endpoint, eg. http://localhost:4318/v1/traces
+func NewOTLPExporter(endpoint string, headers map[string]string, serviceName string) *OTLPExporter {
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// the OTLP JSON encoding, see opentelemetry-proto/opentelemetry/proto/trace/v1/trace.proto
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusError  = 2
+)
+
+// Export posts the spans to the endpoint
+func (e *OTLPExporter) Export(spans []SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// drain the body so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP endpoint [%s] returned %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) request(spans []SpanData) *otlpRequest {
+	ss := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/flashmob/go-guerrilla"},
+		Spans: make([]otlpSpan, 0, len(spans)),
+	}
+	for i := range spans {
+		sd := &spans[i]
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(sd.TraceID[:]),
+			SpanID:            hex.EncodeToString(sd.SpanID[:]),
+			Name:              sd.Name,
+			Kind:              otlpKindServer,
+			StartTimeUnixNano: strconv.FormatInt(sd.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sd.End.UnixNano(), 10),
+		}
+		if sd.HasParent() {
+			span.ParentSpanID = hex.EncodeToString(sd.ParentID[:])
+			span.Kind = otlpKindInternal
+		}
+		for _, a := range sd.Attributes {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: a.Key, Value: otlpValue{StringValue: a.Value}})
+		}
+		if sd.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: sd.Error}
+		}
+		ss.Spans = append(ss.Spans, span)
+	}
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpAttribute{
+				{Key: "service.name", Value: otlpValue{StringValue: e.serviceName}},
+			}},
+			ScopeSpans: []otlpScopeSpans{ss},
+		}},
+	}
+}
+
+// LogExporter writes spans to a logger, at debug level
+type LogExporter struct {
+	log log.Logger
+}
+
+// NewLogExporter returns an exporter that writes to l
+func NewLogExporter(l log.Logger) *LogExporter {
+	return &LogExporter{log: l}
+}
+
+// Export logs each span with its ids, duration and attributes
+func (e *LogExporter) Export(spans []SpanData) error {
+	for i := range spans {
+		sd := &spans[i]
+		fields := map[string]interface{}{
+			"trace_id": hex.EncodeToString(sd.TraceID[:]),
+			"span_id":  hex.EncodeToString(sd.SpanID[:]),
+			"duration": sd.End.Sub(sd.Start).String(),
+		}
+		if sd.HasParent() {
+			fields["parent_id"] = hex.EncodeToString(sd.ParentID[:])
+		}
+		for _, a := range sd.Attributes {
+			fields[a.Key] = a.Value
+		}
+		if sd.Error != "" {
+			fields["error"] = sd.Error
+		}
+		e.log.WithFields(fields).Debugf("span %s", sd.Name)
+	}
+	return nil
+}
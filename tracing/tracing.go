@@ -0,0 +1,314 @@
+// Package tracing records spans for SMTP connections, transactions and backend processors,
+// and exports them in batches, eg. to an OpenTelemetry collector with the OTLP/HTTP exporter.
+// All the Span methods can be called on a nil span, which is what a disabled Tracer returns.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/log"
+)
+
+const (
+	// ExporterOTLP exports spans to an OTLP/HTTP endpoint, eg. an OpenTelemetry collector, Jaeger or Tempo
+	ExporterOTLP = "otlp"
+	// ExporterLog writes spans to the log, at debug level
+	ExporterLog = "log"
+)
+
+const (
+	defaultServiceName = "guerrilla"
+	defaultEndpoint    = "http://localhost:4318/v1/traces"
+	// how many spans can wait to be exported, spans are dropped when the queue is full
+	queueSize = 2048
+	// how many spans to export in one request
+	batchSize = 512
+	// how often to export spans, if the batch is not full
+	flushInterval = 5 * time.Second
+)
+
+// Config configures tracing. Tracing is disabled when Exporter is empty
+type Config struct {
+	// Exporter is where the spans go, "otlp" or "log"
+	Exporter string `json:"exporter,omitempty"`
+	// Endpoint is the OTLP/HTTP traces endpoint, defaults to http://localhost:4318/v1/traces
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are added to the export requests, eg. for authentication
+	Headers map[string]string `json:"headers,omitempty"`
+	// ServiceName is reported as the service.name resource attribute, defaults to "guerrilla"
+	ServiceName string `json:"service_name,omitempty"`
+	// SampleRate is the fraction of connections traced, between 0 and 1. Defaults to 1 (trace all)
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+// Validate checks the config, an empty config is valid (tracing disabled)
+func (c *Config) Validate() error {
+	switch c.Exporter {
+	case "", ExporterLog:
+	case ExporterOTLP:
+		if c.Endpoint != "" {
+			if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("tracing endpoint [%s] must be an http or https URL", c.Endpoint)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown tracing exporter [%s], use %s or %s", c.Exporter, ExporterOTLP, ExporterLog)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("tracing sample_rate [%v] must be between 0 and 1", c.SampleRate)
+	}
+	return nil
+}
+
+// Exporter sends finished spans somewhere
+type Exporter interface {
+	Export(spans []SpanData) error
+}
+
+// Attribute is a key/value pair describing a span
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// SpanData is a finished span, as passed to an Exporter
+type SpanData struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	// Error describes why the span failed, empty if it didn't
+	Error string
+}
+
+// HasParent returns true if the span is not the root of its trace
+func (sd *SpanData) HasParent() bool {
+	return sd.ParentID != [8]byte{}
+}
+
+// Tracer starts spans and exports them when they end
+type Tracer struct {
+	exporter   Exporter
+	sampleRate float64
+	queue      chan SpanData
+	stop       chan struct{}
+	done       chan struct{}
+	stopOnce   sync.Once
+	log        log.Logger
+}
+
+// New returns a Tracer for the config, or nil if tracing is disabled.
+// Spans that cannot be exported are logged to l
+func New(c Config, l log.Logger) (*Tracer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var exporter Exporter
+	switch c.Exporter {
+	case "":
+		return nil, nil
+	case ExporterLog:
+		exporter = NewLogExporter(l)
+	case ExporterOTLP:
+		endpoint := c.Endpoint
+		if endpoint == "" {
+			endpoint = defaultEndpoint
+		}
+		exporter = NewOTLPExporter(endpoint, c.Headers, c.ServiceName)
+	}
+	t := NewTracer(exporter, c.SampleRate)
+	t.log = l
+	return t, nil
+}
+
+// NewTracer returns a Tracer that exports its spans to exporter in the background.
+// A sampleRate of 0 traces all connections
+func NewTracer(exporter Exporter, sampleRate float64) *Tracer {
+	if sampleRate <= 0 {
+		sampleRate = 1
+	}
+	t := &Tracer{
+		exporter:   exporter,
+		sampleRate: sampleRate,
+		queue:      make(chan SpanData, queueSize),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start starts a new trace, returning its root span.
+// Returns nil if the tracer is nil or the trace was not sampled
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, data: SpanData{Name: name, Start: time.Now()}}
+	randomID(s.data.TraceID[:])
+	if t.sampleRate < 1 {
+		// the first 8 bytes of the trace id are random, use them to decide
+		var n uint64
+		for _, b := range s.data.TraceID[:8] {
+			n = n<<8 | uint64(b)
+		}
+		if float64(n>>11)/(1<<53) >= t.sampleRate {
+			return nil
+		}
+	}
+	randomID(s.data.SpanID[:])
+	return s
+}
+
+// Shutdown exports the queued spans and stops the tracer. Spans ended afterwards are dropped
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+	<-t.done
+}
+
+// enqueue queues a finished span for export, dropping it if the queue is full or the tracer is stopped
+func (t *Tracer) enqueue(sd SpanData) {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+	select {
+	case t.queue <- sd:
+	default:
+	}
+}
+
+// run exports the queued spans in batches, until the tracer is shut down
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil && t.log != nil {
+			t.log.WithError(err).Warnf("could not export %d spans", len(batch))
+		}
+		batch = make([]SpanData, 0, batchSize)
+	}
+	for {
+		select {
+		case sd := <-t.queue:
+			batch = append(batch, sd)
+			if len(batch) == batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case sd := <-t.queue:
+					batch = append(batch, sd)
+					if len(batch) == batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Span is a timed operation in a trace. A nil *Span is valid and does nothing
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+	ended  bool
+	sync.Mutex
+}
+
+// Child starts a new span as a child of s. Returns nil if s is nil
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{tracer: s.tracer, data: SpanData{Name: name, Start: time.Now()}}
+	c.data.TraceID = s.data.TraceID
+	c.data.ParentID = s.data.SpanID
+	randomID(c.data.SpanID[:])
+	return c
+}
+
+// SetAttribute sets the value of an attribute, replacing any previous value
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.data.Attributes {
+		if s.data.Attributes[i].Key == key {
+			s.data.Attributes[i].Value = value
+			return
+		}
+	}
+	s.data.Attributes = append(s.data.Attributes, Attribute{Key: key, Value: value})
+}
+
+// SetError marks the span as failed. A nil err does nothing
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and queues it for export. Only the first call has an effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	sd := s.data
+	s.Unlock()
+	s.tracer.enqueue(sd)
+}
+
+// TraceID returns the id of the span's trace in hex, or an empty string if s is nil
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.data.TraceID[:])
+}
+
+// randomID fills id with random bytes
+func randomID(id []byte) {
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand does not fail on the supported platforms
+		panic(errors.New("tracing: cannot generate an id: " + err.Error()))
+	}
+}
@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+type recorder struct {
+	sync.Mutex
+	spans []SpanData
+}
+
+func (r *recorder) Export(spans []SpanData) error {
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestNilSpan(t *testing.T) {
+	var tracer *Tracer
+	s := tracer.Start("root")
+	if s != nil {
+		t.Fatal("expecting a nil tracer to start nil spans")
+	}
+	// none of these should panic
+	c := s.Child("child")
+	c.SetAttribute("k", "v")
+	c.SetError(errors.New("failed"))
+	c.End()
+	if s.TraceID() != "" {
+		t.Error("expecting an empty trace id")
+	}
+	tracer.Shutdown()
+}
+
+func TestSpans(t *testing.T) {
+	r := &recorder{}
+	tracer := NewTracer(r, 0)
+	root := tracer.Start("root")
+	child := root.Child("child")
+	child.SetAttribute("k", "v1")
+	child.SetAttribute("k", "v2")
+	child.SetError(errors.New("failed"))
+	child.End()
+	child.End()
+	root.End()
+	tracer.Shutdown()
+	// dropped, the tracer is shut down
+	tracer.Start("late").End()
+
+	if len(r.spans) != 2 {
+		t.Fatal("expecting 2 spans, got", len(r.spans))
+	}
+	c, p := r.spans[0], r.spans[1]
+	if c.Name != "child" || p.Name != "root" {
+		t.Error("unexpected span names", c.Name, p.Name)
+	}
+	if c.TraceID != p.TraceID || c.ParentID != p.SpanID || p.HasParent() {
+		t.Error("expecting the child to be in the root's trace, with the root as parent")
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Value != "v2" {
+		t.Error("expecting the attribute to be replaced", c.Attributes)
+	}
+	if c.Error != "failed" || p.Error != "" {
+		t.Error("unexpected span errors", c.Error, p.Error)
+	}
+	if c.End.Before(c.Start) {
+		t.Error("span ended before it started")
+	}
+}
+
+func TestSampling(t *testing.T) {
+	tracer := NewTracer(&recorder{}, 0.0001)
+	defer tracer.Shutdown()
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if tracer.Start("root") != nil {
+			sampled++
+		}
+	}
+	if sampled > 10 {
+		t.Error("expecting almost no traces to be sampled, got", sampled)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{},
+		{Exporter: ExporterLog},
+		{Exporter: ExporterOTLP},
+		{Exporter: ExporterOTLP, Endpoint: "https://collector:4318/v1/traces", SampleRate: 0.5},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("expecting %+v to be valid: %s", c, err)
+		}
+	}
+	for _, c := range []Config{
+		{Exporter: "zipkin"},
+		{Exporter: ExporterOTLP, Endpoint: "collector:4318"},
+		{Exporter: ExporterLog, SampleRate: 2},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expecting %+v to be invalid", c)
+		}
+	}
+	if tracer, err := New(Config{}, nil); tracer != nil || err != nil {
+		t.Error("expecting no tracer when tracing is disabled")
+	}
+}
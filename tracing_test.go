@@ -0,0 +1,102 @@
+package guerrilla
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/tracing"
+)
+
+// otlpSpan is the part of an exported OTLP span that the test looks at
+type otlpSpan struct {
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+}
+
+func (s *otlpSpan) attribute(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue
+		}
+	}
+	return ""
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	spans := make(map[string]*otlpSpan)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []*otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2650", IsEnabled: true}},
+		BackendConfig: backends.BackendConfig{
+			"save_process":       "HeadersParser|Debugger",
+			"validate_process":   "",
+			"log_received_mails": false,
+		},
+		Tracing: tracing.Config{Exporter: tracing.ExporterOTLP, Endpoint: collector.URL},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := talkToServer("127.0.0.1:2650"); err != nil {
+		t.Error(err)
+	}
+	// the spans are exported when the tracer shuts down
+	d.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	conn, tx := spans["smtp.connection"], spans["smtp.transaction"]
+	parser, debugger := spans["processor headersparser"], spans["processor debugger"]
+	if conn == nil || tx == nil || parser == nil || debugger == nil {
+		t.Fatal("missing spans, got", spans)
+	}
+	if conn.ParentSpanID != "" || tx.ParentSpanID != conn.SpanID {
+		t.Error("expecting the transaction to be a child of the connection")
+	}
+	if parser.ParentSpanID != tx.SpanID || debugger.ParentSpanID != parser.SpanID {
+		t.Error("expecting the processors to be nested in the transaction")
+	}
+	if tx.attribute("guerrilla.queued_id") == "" || tx.attribute("smtp.response_code") != "250" {
+		t.Error("unexpected transaction attributes", tx.Attributes)
+	}
+	if conn.attribute("guerrilla.listen_interface") != "127.0.0.1:2650" {
+		t.Error("unexpected connection attributes", conn.Attributes)
+	}
+}
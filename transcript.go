@@ -0,0 +1,128 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/mail"
+)
+
+// transcript records the SMTP dialog of a connection to a file named after the envelope's queued id.
+// Lines sent by the client are prefixed with "C: ", lines sent by the server with "S: ",
+// and notes about the connection with "*: ". All the methods can be called on a nil *transcript
+type transcript struct {
+	f *os.File
+	w *bufio.Writer
+	// dataLimit is how many bytes of DATA to record, 0 for all
+	dataLimit int64
+	// redactData records only the size of DATA
+	redactData bool
+}
+
+// newTranscript creates the transcript file for the client in sc.TranscriptDir
+func newTranscript(sc *ServerConfig, c *client) (*transcript, error) {
+	name := filepath.Join(sc.TranscriptDir, c.QueuedId+".txt")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &transcript{
+		f:          f,
+		w:          bufio.NewWriter(f),
+		dataLimit:  sc.TranscriptDataLimit,
+		redactData: sc.TranscriptRedactData,
+	}
+	t.note("connection from %s to %s, client id %d, at %s",
+		c.RemoteIP, sc.ListenInterface, c.ID, time.Now().Format(time.RFC3339))
+	return t, nil
+}
+
+// write records each line of text with the prefix
+func (t *transcript) write(prefix string, text []byte) {
+	for len(text) > 0 {
+		line := text
+		if i := bytes.IndexByte(text, '\n'); i >= 0 {
+			line, text = text[:i], text[i+1:]
+		} else {
+			text = nil
+		}
+		_, _ = t.w.WriteString(prefix)
+		_, _ = t.w.Write(bytes.TrimRight(line, "\r"))
+		_ = t.w.WriteByte('\n')
+	}
+}
+
+// command records a command line sent by the client. The credentials of AUTH commands are redacted
+func (t *transcript) command(line []byte) {
+	if t == nil {
+		return
+	}
+	t.write("C: ", redactAuth(line))
+}
+
+// redactAuth returns the command line with the credentials of an AUTH command redacted, keeping the mechanism
+func redactAuth(line []byte) []byte {
+	if len(line) > 5 && bytes.EqualFold(line[:5], []byte("AUTH ")) {
+		if i := bytes.IndexByte(line[5:], ' '); i >= 0 {
+			line = append(line[:5+i:5+i], " [redacted]"...)
+		}
+	}
+	return line
+}
+
+// response records a response sent by the server
+func (t *transcript) response(text string) {
+	if t == nil {
+		return
+	}
+	t.write("S: ", []byte(text))
+}
+
+// data records the message data received with DATA, truncated or redacted as configured
+func (t *transcript) data(e *mail.Envelope, size int64) {
+	if t == nil {
+		return
+	}
+	if t.redactData {
+		t.note("%d bytes of data redacted", size)
+		return
+	}
+	r := e.NewReader()
+	if t.dataLimit > 0 {
+		r = io.LimitReader(r, t.dataLimit)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		t.note("could not read the data: %s", err)
+	}
+	t.write("C: ", buf.Bytes())
+	if t.dataLimit > 0 && size > t.dataLimit {
+		t.note("data truncated, %d of %d bytes recorded", t.dataLimit, size)
+	}
+}
+
+// note records something that happened on the connection
+func (t *transcript) note(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.write("*: ", []byte(fmt.Sprintf(format, args...)))
+}
+
+// close writes out the transcript and closes the file
+func (t *transcript) close() error {
+	if t == nil {
+		return nil
+	}
+	t.note("connection closed at %s", time.Now().Format(time.RFC3339))
+	if err := t.w.Flush(); err != nil {
+		_ = t.f.Close()
+		return err
+	}
+	return t.f.Close()
+}
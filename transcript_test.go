@@ -0,0 +1,85 @@
+package guerrilla
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTranscriptRedactsAuth(t *testing.T) {
+	var buf bytes.Buffer
+	tr := &transcript{w: bufio.NewWriter(&buf)}
+	line := []byte("AUTH PLAIN dGVzdAB0ZXN0AHRlc3Q=")
+	tr.command(line)
+	tr.command([]byte("AUTH LOGIN"))
+	tr.response("250-mx Hello\r\n250 HELP\r\n")
+	_ = tr.w.Flush()
+	expect := "C: AUTH PLAIN [redacted]\nC: AUTH LOGIN\nS: 250-mx Hello\nS: 250 HELP\n"
+	if buf.String() != expect {
+		t.Errorf("expecting %q, got %q", expect, buf.String())
+	}
+	if string(line) != "AUTH PLAIN dGVzdAB0ZXN0AHRlc3Q=" {
+		t.Error("the command line should not be modified")
+	}
+	// a nil transcript does nothing
+	var nilTr *transcript
+	nilTr.command(line)
+	nilTr.note("nothing")
+	if err := nilTr.close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guerrilla-transcripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers: []ServerConfig{{
+			ListenInterface:     "127.0.0.1:2654",
+			IsEnabled:           true,
+			TranscriptDir:       dir,
+			TranscriptDataLimit: 10,
+		}},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := talkToServer("127.0.0.1:2654"); err != nil {
+		t.Error(err)
+	}
+	d.Shutdown()
+	files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil || len(files) != 1 {
+		t.Fatal("expecting one transcript, got", files, err)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript := string(b)
+	for _, expect := range []string{
+		"*: connection from 127.0.0.1 to 127.0.0.1:2654",
+		"S: 220 ",
+		"C: HELO maildiranasaurustester\n",
+		"C: RCPT TO:<test@grr.la>\n",
+		"S: 354 ",
+		"C: Subject: T\n",
+		"*: data truncated, 10 of ",
+		"S: 250 ",
+		"*: connection closed",
+	} {
+		if !strings.Contains(transcript, expect) {
+			t.Errorf("expecting the transcript to contain %q:\n%s", expect, transcript)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package webauth secures the HTTP listeners of the daemon, such as the admin API and the dashboard.
+// Requests are authenticated with a token, a client certificate (mTLS), or both, and clients that
+// fail to authenticate too often are turned away for a while
+package webauth
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxFailures is how many times a client IP may fail to authenticate in FailureWindow
+	MaxFailures = 10
+	// FailureWindow is how long the failures of a client IP are counted, and how long it's turned away after
+	// MaxFailures
+	FailureWindow = time.Minute
+)
+
+// Settings are the security settings of a listener
+type Settings struct {
+	// Name of the listener, used in errors, eg. "admin"
+	Name string
+	// ListenInterface is the address the listener binds to, eg. "127.0.0.1:8025"
+	ListenInterface string
+	// Token must be sent in an "Authorization: Bearer <token>" header, or as the password of basic auth.
+	// Not checked if empty, then ClientCAFile must be set
+	Token string
+	// PrivateKeyFile and PublicKeyFile are the TLS key and certificate of the listener.
+	// TLS is required unless the listener binds to a loopback address
+	PrivateKeyFile string
+	PublicKeyFile  string
+	// ClientCAFile are the PEM certificates of the CAs that sign the client certificates.
+	// If set, clients must present a valid certificate
+	ClientCAFile string
+}
+
+// TLS returns true if the listener is served over TLS
+func (s *Settings) TLS() bool {
+	return s.PrivateKeyFile != "" || s.PublicKeyFile != ""
+}
+
+// Validate checks the settings
+func (s *Settings) Validate() error {
+	host, _, err := net.SplitHostPort(s.ListenInterface)
+	if err != nil {
+		return fmt.Errorf("%s listen_interface [%s] is invalid: %s", s.Name, s.ListenInterface, err)
+	}
+	if s.Token == "" && s.ClientCAFile == "" {
+		return fmt.Errorf("%s token or client_ca_file is required", s.Name)
+	}
+	if s.TLS() && (s.PrivateKeyFile == "" || s.PublicKeyFile == "") {
+		return fmt.Errorf("%s private_key_file and public_key_file must both be set", s.Name)
+	}
+	if !s.TLS() {
+		if s.ClientCAFile != "" {
+			return fmt.Errorf("%s client_ca_file requires private_key_file and public_key_file", s.Name)
+		}
+		if !IsLoopback(host) {
+			return fmt.Errorf("%s must be served over TLS (set private_key_file and public_key_file) "+
+				"unless it listens on a loopback address, [%s] is not", s.Name, s.ListenInterface)
+		}
+	}
+	return nil
+}
+
+// IsLoopback returns true if host is "localhost" or a loopback IP address
+func IsLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Listen validates the settings and listens on the listen interface, with TLS if it's configured
+func (s *Settings) Listen() (net.Listener, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	var config *tls.Config
+	if s.TLS() {
+		cert, err := tls.LoadX509KeyPair(s.PublicKeyFile, s.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the %s key pair: %s", s.Name, err)
+		}
+		config = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if s.ClientCAFile != "" {
+			pem, err := ioutil.ReadFile(s.ClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read the %s client_ca_file: %s", s.Name, err)
+			}
+			config.ClientCAs = x509.NewCertPool()
+			if !config.ClientCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in the %s client_ca_file [%s]", s.Name, s.ClientCAFile)
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	l, err := net.Listen("tcp", s.ListenInterface)
+	if err != nil {
+		return nil, fmt.Errorf("%s cannot listen on [%s]: %s", s.Name, s.ListenInterface, err)
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	return l, nil
+}
+
+// Guard authenticates the requests with the token of its settings, client certificates are checked
+// by the listener returned by Settings.Listen
+type Guard struct {
+	token string
+	// challenge is the WWW-Authenticate header sent with 401 responses
+	challenge string
+	// deny writes the responses to the requests that are refused
+	deny     func(w http.ResponseWriter, code int, msg string)
+	failures map[string]*failures
+	sync.Mutex
+	// now returns the current time, it's replaced in tests
+	now func() time.Time
+}
+
+// failures are the failed authentications of a client IP
+type failures struct {
+	count int
+	since time.Time
+}
+
+// NewGuard returns a guard for the token of s. challenge is the WWW-Authenticate header of 401 responses,
+// eg. `Basic realm="guerrilla"`, and deny writes the responses to the requests that are refused
+func NewGuard(s Settings, challenge string, deny func(w http.ResponseWriter, code int, msg string)) *Guard {
+	return &Guard{
+		token:     s.Token,
+		challenge: challenge,
+		deny:      deny,
+		failures:  make(map[string]*failures),
+		now:       time.Now,
+	}
+}
+
+// Wrap returns a handler that calls next for the requests that carry the token
+func (g *Guard) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if g.blocked(ip) {
+			w.Header().Set("Retry-After", fmt.Sprint(int(FailureWindow/time.Second)))
+			g.deny(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+			return
+		}
+		if g.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, password, ok := r.BasicAuth(); ok {
+				token = password
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+				g.fail(ip)
+				w.Header().Set("WWW-Authenticate", g.challenge)
+				g.deny(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// blocked returns true if ip failed to authenticate MaxFailures times in the current window
+func (g *Guard) blocked(ip string) bool {
+	g.Lock()
+	defer g.Unlock()
+	f, ok := g.failures[ip]
+	if !ok {
+		return false
+	}
+	if g.now().Sub(f.since) >= FailureWindow {
+		delete(g.failures, ip)
+		return false
+	}
+	return f.count >= MaxFailures
+}
+
+// fail counts a failed authentication of ip
+func (g *Guard) fail(ip string) {
+	g.Lock()
+	defer g.Unlock()
+	now := g.now()
+	f, ok := g.failures[ip]
+	if !ok || now.Sub(f.since) >= FailureWindow {
+		if len(g.failures) >= maxTrackedIPs {
+			g.prune(now)
+		}
+		f = &failures{since: now}
+		g.failures[ip] = f
+	}
+	f.count++
+	if f.count == MaxFailures {
+		// turned away for a whole window
+		f.since = now
+	}
+}
+
+// how many client IPs are tracked before the expired failures are removed
+const maxTrackedIPs = 1000
+
+// prune removes the failures counted before the current window
+func (g *Guard) prune(now time.Time) {
+	for ip, f := range g.failures {
+		if now.Sub(f.since) >= FailureWindow {
+			delete(g.failures, ip)
+		}
+	}
+}
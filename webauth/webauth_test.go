@@ -0,0 +1,128 @@
+package webauth
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flashmob/go-guerrilla/tests/testcert"
+)
+
+func TestValidate(t *testing.T) {
+	for _, s := range []Settings{
+		{ListenInterface: "127.0.0.1", Token: "x"},
+		{ListenInterface: "127.0.0.1:8025"},
+		{ListenInterface: "127.0.0.1:8025", Token: "x", PrivateKeyFile: "k"},
+		{ListenInterface: "127.0.0.1:8025", ClientCAFile: "ca"},
+		{ListenInterface: "0.0.0.0:8025", Token: "x"},
+		{ListenInterface: ":8025", Token: "x"},
+		{ListenInterface: "mail.test.com:8025", Token: "x"},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("expecting an error for %+v", s)
+		}
+	}
+	for _, s := range []Settings{
+		{ListenInterface: "127.0.0.1:8025", Token: "x"},
+		{ListenInterface: "[::1]:8025", Token: "x"},
+		{ListenInterface: "localhost:8025", Token: "x"},
+		{ListenInterface: "0.0.0.0:8025", Token: "x", PrivateKeyFile: "k", PublicKeyFile: "c"},
+		{ListenInterface: "0.0.0.0:8025", PrivateKeyFile: "k", PublicKeyFile: "c", ClientCAFile: "ca"},
+	} {
+		if err := s.Validate(); err != nil {
+			t.Errorf("expecting %+v to be valid, got %s", s, err)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	g := NewGuard(Settings{Token: "secret"}, `Bearer realm="test"`, func(w http.ResponseWriter, code int, msg string) {
+		http.Error(w, msg, code)
+	})
+	g.now = func() time.Time { return now }
+	h := g.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(ip, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("127.0.0.1", ""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="test"` {
+		t.Error("expecting 401 without a token, got", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("anyone", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Error("expecting the token to be accepted as the basic auth password, got", w.Code)
+	}
+	for i := 1; i < MaxFailures; i++ {
+		if w := request("127.0.0.1", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatal("expecting 401 with a wrong token, got", w.Code)
+		}
+	}
+	// the right token is refused too once blocked
+	if w := request("127.0.0.1", "secret"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Error("expecting 429 after too many failures, got", w.Code)
+	}
+	if w := request("127.0.0.2", "secret"); w.Code != http.StatusOK {
+		t.Error("expecting other clients to be served, got", w.Code)
+	}
+	now = now.Add(FailureWindow)
+	if w := request("127.0.0.1", "secret"); w.Code != http.StatusOK {
+		t.Error("expecting the client to be served after the window, got", w.Code)
+	}
+}
+
+func TestListen(t *testing.T) {
+	if err := testcert.GenerateCert("webauth.test.com", "", 365*24*time.Hour, false, 2048, "P256", "../tests/"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove("../tests/webauth.test.com.key.pem")
+		_ = os.Remove("../tests/webauth.test.com.cert.pem")
+	}()
+	s := Settings{
+		Name:            "test",
+		ListenInterface: "127.0.0.1:0",
+		PrivateKeyFile:  "../tests/webauth.test.com.key.pem",
+		PublicKeyFile:   "../tests/webauth.test.com.cert.pem",
+		ClientCAFile:    "../tests/webauth.test.com.key.pem",
+	}
+	if _, err := s.Listen(); err == nil {
+		t.Error("expecting an error when the client_ca_file has no certificate")
+	}
+
+	s.ClientCAFile = "../tests/webauth.test.com.cert.pem"
+	l, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			_, _ = ioutil.ReadAll(conn)
+			_ = conn.Close()
+		}
+	}()
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		// TLS 1.3 reports the missing certificate after the handshake
+		_, err = conn.Read(make([]byte, 1))
+		_ = conn.Close()
+	}
+	if err == nil {
+		t.Error("expecting a client without a certificate to be refused")
+	}
+}
@@ -0,0 +1,50 @@
+package guerrilla
+
+import (
+	"fmt"
+
+	"github.com/flashmob/go-guerrilla/notify"
+)
+
+// notifier returns the notifier of the webhooks, nil if they are disabled
+func (g *guerrilla) notifier() *notify.Notifier {
+	n, _ := g.notifierStore.Load().(*notify.Notifier)
+	return n
+}
+
+// startNotifier starts the notifier configured in g.Config
+func (g *guerrilla) startNotifier() error {
+	n, err := notify.New(g.Config.Webhooks, g.mainlog())
+	if err != nil {
+		return fmt.Errorf("could not configure the webhooks: %s", err)
+	}
+	g.notifierStore.Store(n)
+	return nil
+}
+
+// stopNotifier delivers the queued events and stops the notifier
+func (g *guerrilla) stopNotifier() {
+	g.notifier().Close()
+	g.notifierStore.Store((*notify.Notifier)(nil))
+}
+
+// reloadNotifier replaces the notifier with one for c, the old one delivers its queued events in the background
+func (g *guerrilla) reloadNotifier(c notify.Config) error {
+	n, err := notify.New(c, g.mainlog())
+	if err != nil {
+		return err
+	}
+	old := g.notifier()
+	g.notifierStore.Store(n)
+	go old.Close()
+	return nil
+}
+
+// notify sends a message event to the webhooks. Messages that were received, but that the backend
+// did not accept, are sent as notify.EventSaveFailed
+func (g *guerrilla) notify(event string, m MessageEvent) {
+	if m.SaveFailed {
+		event = notify.EventSaveFailed
+	}
+	g.notifier().Notify(event, m)
+}
@@ -0,0 +1,140 @@
+package guerrilla
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync"
+	"testing"
+
+	"github.com/flashmob/go-guerrilla/backends"
+	"github.com/flashmob/go-guerrilla/bounce"
+	"github.com/flashmob/go-guerrilla/notify"
+)
+
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	var message MessageEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(notify.HeaderSignature) != "sha256="+notify.Sign([]byte("secret"), body) {
+			t.Error("bad signature")
+		}
+		p := struct {
+			Event string       `json:"event"`
+			Data  MessageEvent `json:"data"`
+		}{}
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		events = append(events, p.Event)
+		message = p.Data
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2658", IsEnabled: true}},
+		Webhooks:     notify.Config{URLs: []string{srv.URL}, Secret: "secret"},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := talkToServer("127.0.0.1:2658"); err != nil {
+		t.Error(err)
+	}
+	// the queued events are delivered on shutdown
+	d.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0] != notify.EventAccepted {
+		t.Fatal("expecting one accepted event, got", events)
+	}
+	if message.QueuedID == "" || message.Code != 250 || len(message.RcptTo) != 1 ||
+		message.RcptTo[0] != "test@grr.la" || message.Client.Listener != "127.0.0.1:2658" {
+		t.Errorf("unexpected message %+v", message)
+	}
+}
+
+func TestWebhooksBounce(t *testing.T) {
+	var mu sync.Mutex
+	var bounces []BounceEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := struct {
+			Event string      `json:"event"`
+			Data  BounceEvent `json:"data"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		if p.Event != notify.EventBounce {
+			t.Error("expecting only the bounce events, got", p.Event)
+		}
+		mu.Lock()
+		bounces = append(bounces, p.Data)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	d := Daemon{}
+	d.Config = &AppConfig{
+		AllowedHosts: []string{"grr.la"},
+		LogFile:      "off",
+		Servers:      []ServerConfig{{ListenInterface: "127.0.0.1:2669", IsEnabled: true}},
+		BackendConfig: backends.BackendConfig{
+			"save_process":       "BounceParser|Debugger",
+			"bounce_verp_prefix": "bounces",
+		},
+		Webhooks: notify.Config{URLs: []string{srv.URL}, Events: []string{notify.EventBounce}},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := textproto.Dial("tcp", "127.0.0.1:2669")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	cmd := func(expect int, format string, args ...interface{}) {
+		if err := conn.PrintfLine(format, args...); err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := conn.ReadResponse(expect); err != nil {
+			t.Error(format, msg, err)
+		}
+	}
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	cmd(250, "EHLO mx.example.org")
+	cmd(250, "MAIL FROM:<>")
+	cmd(250, "RCPT TO:<bounces+alice=example.org@grr.la>")
+	cmd(354, "DATA")
+	cmd(250, "Subject: failure notice\r\n\r\nSorry.\r\n.")
+	// not a bounce
+	cmd(250, "MAIL FROM:<sender@example.com>")
+	cmd(250, "RCPT TO:<test@grr.la>")
+	cmd(354, "DATA")
+	cmd(250, "Subject: test\r\n\r\nThis is a test.\r\n.")
+	cmd(221, "QUIT")
+	d.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bounces) != 1 {
+		t.Fatal("expecting one bounce event, got", bounces)
+	}
+	b := bounces[0]
+	if b.QueuedID == "" || len(b.Bounces) != 1 || b.Bounces[0].Kind != bounce.Unknown ||
+		b.Bounces[0].Recipient != "alice@example.org" || len(b.RcptTo) != 1 {
+		t.Errorf("unexpected bounce %+v", b)
+	}
+}